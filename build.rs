@@ -6,6 +6,12 @@
 //!
 //!   PENUMBRA_REINDEXER_STATIC_LIB
 //!
+//! With the `subprocess-store` feature, a standalone store server binary,
+//! built without cgo, is needed instead of the C archive. A prebuilt one
+//! can be provided via the env var
+//!
+//!   PENUMBRA_REINDEXER_STORE_SERVER
+//!
 //! Currently the cargo cache is invalidated if this `build.rs` file
 //! changes. Makes sense, maybe that's default.
 
@@ -52,7 +58,68 @@ fn build_cometbft_c_archive() -> PathBuf {
     archive_filepath
 }
 
+// Build the store server for cometbft via golang, without cgo.
+//
+// Like for the C archive, this assumes `go` is on the PATH, unless a prebuilt binary
+// is passed in with `PENUMBRA_REINDEXER_STORE_SERVER` instead.
+fn build_cometbft_store_server() -> PathBuf {
+    let cargo_out_dir = PathBuf::from(env::var("OUT_DIR").expect("cargo build should set OUT_DIR"));
+    let go_source_dir = PathBuf::from(
+        env::var("CARGO_MANIFEST_DIR").expect("cargo build should set CARGO_MANIFEST_DIR"),
+    )
+    .join("go");
+
+    let binary_filepath = cargo_out_dir.join("penumbra-reindexer-store");
+    let status = Command::new("go")
+        .args([
+            "build",
+            "-tags=netgo",
+            "-o",
+            binary_filepath
+                .as_os_str()
+                .to_str()
+                .expect("failed to convert store server filepath to str"),
+            "./cmd/store-server",
+        ])
+        .env("CGO_ENABLED", "0")
+        .current_dir(&go_source_dir)
+        .status()
+        .expect("failed to run go build command; make sure go is installed and on PATH");
+    assert!(
+        status.success(),
+        "failed to build store server for cometbft code"
+    );
+    binary_filepath
+}
+
+// Point the crate at the store server, rather than linking in the C archive.
+fn setup_store_server() {
+    let server = match env::var("PENUMBRA_REINDEXER_STORE_SERVER") {
+        Ok(p) => {
+            let p = PathBuf::from(&p);
+            assert!(
+                p.exists(),
+                "store server for cometbft not found: {}",
+                &p.display()
+            );
+            p
+        }
+        Err(_e) => build_cometbft_store_server(),
+    };
+    println!(
+        "cargo:rustc-env=PENUMBRA_REINDEXER_STORE_SERVER_PATH={}",
+        server.display()
+    );
+    println!("cargo::rerun-if-env-changed=PENUMBRA_REINDEXER_STORE_SERVER");
+    println!("cargo::rerun-if-changed=go");
+}
+
 fn main() {
+    if env::var("CARGO_FEATURE_SUBPROCESS_STORE").is_ok() {
+        setup_store_server();
+        return;
+    }
+
     // Check if a prebuilt static lib is provided.
     let static_lib = match env::var("PENUMBRA_REINDEXER_STATIC_LIB") {
         Ok(p) => {
@@ -73,7 +73,7 @@
             #   2. run `go mod tidy` within the `go` directory
             #   3. run `nix build`, view mismatched hash, update `vendorHash` value below.
             #
-            vendorHash = "sha256-fxvcw9oqRsANg0P+QVc1idAxkiDSbtcVntU6eoLjox0=";
+            vendorHash = "sha256-5J2nJUjhSo6j6B/FAiVKjKvPEwL9GP8RzlQ6FXcMD1s=";
 
             # Ensure Go doesn't treat the golang source directory as GOPATH;
             # this is only necessary because we've named the subdir `go`.
@@ -0,0 +1,24 @@
+// Command store-server serves a cometbft block store over stdin and stdout.
+//
+// This is the cgo free alternative to linking the store package into the reindexer:
+// the reindexer runs this as a subprocess instead, speaking the protocol of the
+// storeserver package to it.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/penumbra-zone/reindexer/go/storeserver"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: store-server, speaking the storeserver protocol over stdin and stdout")
+		os.Exit(2)
+	}
+	if err := storeserver.Serve(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "store-server:", err)
+		os.Exit(1)
+	}
+}
@@ -1,48 +1,1064 @@
 package main
 
+/*
+typedef int (*block_callback)(void *ctx, const unsigned char *data, int len, long height);
+
+static inline int call_block_callback(block_callback cb, void *ctx, const unsigned char *data, int len, long height) {
+	return cb(ctx, data, len, height);
+}
+
+typedef void (*progress_callback)(void *ctx, long height);
+
+static inline void call_progress_callback(progress_callback cb, void *ctx, long height) {
+	cb(ctx, height);
+}
+
+typedef void (*range_progress_callback)(void *ctx, long height, long last);
+
+static inline void call_range_progress_callback(range_progress_callback cb, void *ctx, long height, long last) {
+	cb(ctx, height, last);
+}
+*/
+import "C"
+
 import (
-	"C"
+	"errors"
+	"fmt"
+	"math"
 	"runtime/cgo"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/penumbra-zone/reindexer/go/store"
 )
 
+// handle is what the C side holds on to, remembering the last error for that store.
+//
+// A handle may be shared between threads, since the store is safe for concurrent use,
+// in which case the last error is that of whichever call failed most recently.
+type handle struct {
+	store *store.Store
+	errMu sync.Mutex
+	err   error
+	// buf is the buffer registered with c_store_register_buffer, held for as long as it's in use.
+	bufMu sync.Mutex
+	buf   []byte
+}
+
+// globalErr holds the error from the last failed call without a handle to put it in,
+// such as c_store_new.
+var (
+	globalErrMu sync.Mutex
+	globalErr   error
+)
+
+func setGlobalErr(err error) {
+	globalErrMu.Lock()
+	globalErr = err
+	globalErrMu.Unlock()
+}
+
+// errHeightOverflow is recorded when a height can't be handed back to C.
+var errHeightOverflow = errors.New("height does not fit into a C long")
+
+// cLong converts a height into a C long, checking that it fits.
+//
+// C longs are only 32 bits wide on some platforms, where a truncated height
+// would silently point at the wrong block.
+func cLong(height int64) (C.long, bool) {
+	out := C.long(height)
+	return out, int64(out) == height
+}
+
+// maxHeight is the largest height the exports take.
+//
+// Range operations hand back the height after the last block they got to, which has to fit
+// into an int64 too, so math.MaxInt64 itself is refused with HeightOverflow, rather than
+// wrapping around to a negative height. No store can have a block there in any case.
+const maxHeight = math.MaxInt64 - 1
+
+// errHeightTooLarge is recorded when a height from C is above maxHeight.
+var errHeightTooLarge = fmt.Errorf("height is above the largest supported height, %d", int64(maxHeight))
+
+// goHeight converts a height from C, checking that it's no larger than maxHeight.
+func goHeight(height C.long) (int64, bool) {
+	return int64(height), int64(height) <= maxHeight
+}
+
+// goEnd converts the end of a range of heights from C, bounding it by maxHeight.
+//
+// Since there's no block above maxHeight, such a range holds the same blocks either way,
+// and callers can pass the largest C long for a range without an end.
+func goEnd(end C.long) int64 {
+	return min(int64(end), maxHeight)
+}
+
+// heightOrOverflow converts a height into a C long, or HeightOverflow if it doesn't fit.
+func heightOrOverflow(height int64) C.long {
+	if out, ok := cLong(height); ok {
+		return out
+	}
+	return C.long(store.HeightOverflow)
+}
+
+func lookup(ptr uintptr) *handle {
+	return cgo.Handle(ptr).Value().(*handle)
+}
+
+// cursor is what the C side holds on to for a cursor, along with the handle of its store,
+// which its errors are recorded in.
+type cursor struct {
+	cursor *store.Cursor
+	h      *handle
+}
+
+func lookupCursor(ptr uintptr) *cursor {
+	return cgo.Handle(ptr).Value().(*cursor)
+}
+
+// fail records an error, returning the generic error code.
+func (h *handle) fail(err error) C.int {
+	h.errMu.Lock()
+	h.err = err
+	h.errMu.Unlock()
+	return C.int(store.BlockError)
+}
+
+// failHeight records that a height from C was above maxHeight, returning HeightOverflow.
+func (h *handle) failHeight() C.int {
+	h.fail(errHeightTooLarge)
+	return C.int(store.HeightOverflow)
+}
+
+// failRange records an error from a range operation, returning BlockCancelled if it was cancelled,
+// and BlockExceedsLimit if it got to a block above the maximum block size.
+func (h *handle) failRange(err error) C.int {
+	res := h.fail(err)
+	switch {
+	case errors.Is(err, store.ErrCancelled):
+		return C.int(store.BlockCancelled)
+	case errors.Is(err, store.ErrBlockExceedsLimit):
+		return C.int(store.BlockExceedsLimit)
+	}
+	return res
+}
+
+// guard turns panics from inside cometbft into an error code, instead of unwinding into C.
+func (h *handle) guard(res *C.int) {
+	if r := recover(); r != nil {
+		if name := h.store.Name(); name != "" {
+			*res = h.fail(fmt.Errorf("store '%s': panic: %v", name, r))
+		} else {
+			*res = h.fail(fmt.Errorf("panic: %v", r))
+		}
+	}
+}
+
 //export c_store_new
-func c_store_new(dir_ptr *C.char, dir_len C.int, backend_ptr *C.char, backend_len C.int) unsafe.Pointer {
+func c_store_new(dir_ptr *C.char, dir_len C.int, backend_ptr *C.char, backend_len C.int, db_name_ptr *C.char, db_name_len C.int, read_only C.int) (ptr uintptr) {
+	backend := C.GoStringN(backend_ptr, backend_len)
+	dir := C.GoStringN(dir_ptr, dir_len)
+	dbName := C.GoStringN(db_name_ptr, db_name_len)
+	defer func() {
+		if r := recover(); r != nil {
+			setGlobalErr(fmt.Errorf("panic: %v", r))
+			ptr = 0
+		}
+	}()
+	store, err := store.NewStore(backend, dir, dbName, read_only != 0)
+	if err != nil {
+		setGlobalErr(err)
+		return 0
+	}
+	return uintptr(cgo.NewHandle(&handle{store: store}))
+}
+
+// c_store_new_named is like c_store_new, but includes name in every error from the store.
+//
+//export c_store_new_named
+func c_store_new_named(name_ptr *C.char, name_len C.int, dir_ptr *C.char, dir_len C.int, backend_ptr *C.char, backend_len C.int, db_name_ptr *C.char, db_name_len C.int, read_only C.int) (ptr uintptr) {
+	name := C.GoStringN(name_ptr, name_len)
 	backend := C.GoStringN(backend_ptr, backend_len)
 	dir := C.GoStringN(dir_ptr, dir_len)
-	store, err := store.NewStore(backend, dir)
+	dbName := C.GoStringN(db_name_ptr, db_name_len)
+	defer func() {
+		if r := recover(); r != nil {
+			setGlobalErr(fmt.Errorf("store '%s': panic: %v", name, r))
+			ptr = 0
+		}
+	}()
+	store, err := store.NewNamedStore(name, backend, dir, dbName, read_only != 0, store.Options{})
 	if err != nil {
-		panic(err)
+		setGlobalErr(err)
+		return 0
 	}
-	return unsafe.Pointer(uintptr(cgo.NewHandle(store)))
+	return uintptr(cgo.NewHandle(&handle{store: store}))
 }
 
+// c_store_open_existing is like c_store_new, but refuses to create a store if dir doesn't contain one.
+//
+// The database is opened with the options in store.Options, passed along one by one, where
+// the zero value of each, with an empty compression, is the backend's default.
+// If fallback is non-zero, the other backends detected in dir are tried if the store fails
+// to open with the one given, as store.OpenExistingWithFallback does, and c_store_backend
+// tells which one opened it.
+// The handle is written to out_ptr, and this returns 0 on success, or an error code,
+// with the error available through c_store_last_error with a null handle.
+//
+//export c_store_open_existing
+func c_store_open_existing(dir_ptr *C.char, dir_len C.int, backend_ptr *C.char, backend_len C.int, db_name_ptr *C.char, db_name_len C.int, read_only C.int, block_cache_size C.long, disable_compaction C.int, compression_ptr *C.char, compression_len C.int, fallback C.int, out_ptr *uintptr) (res C.int) {
+	backend := C.GoStringN(backend_ptr, backend_len)
+	dir := C.GoStringN(dir_ptr, dir_len)
+	dbName := C.GoStringN(db_name_ptr, db_name_len)
+	options := store.Options{
+		BlockCacheSize:    int(block_cache_size),
+		DisableCompaction: disable_compaction != 0,
+		Compression:       C.GoStringN(compression_ptr, compression_len),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			setGlobalErr(fmt.Errorf("panic: %v", r))
+			res = C.int(store.BlockError)
+		}
+	}()
+	open := store.OpenExisting
+	if fallback != 0 {
+		open = store.OpenExistingWithFallback
+	}
+	opened, err := open(backend, dir, dbName, read_only != 0, options)
+	if errors.Is(err, store.ErrStoreNotFound) {
+		setGlobalErr(err)
+		return C.int(store.StoreNotFound)
+	}
+	if err != nil {
+		setGlobalErr(err)
+		return C.int(store.BlockError)
+	}
+	*out_ptr = uintptr(cgo.NewHandle(&handle{store: opened}))
+	return 0
+}
+
+// c_store_snapshot opens a snapshot of a store, reading it as it is now, even as it changes.
+//
+// The handle is written to out_ptr, and this returns 0 on success, or an error code,
+// with the error available through c_store_last_error with the handle of the store.
+// The snapshot is deleted like any other store, which must happen before the store is.
+//
+//export c_store_snapshot
+func c_store_snapshot(ptr uintptr, out_ptr *uintptr) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	snap, err := h.store.Snapshot()
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_ptr = uintptr(cgo.NewHandle(&handle{store: snap}))
+	return 0
+}
+
+// c_store_detect_backend writes the name of the backend detected in dir into out.
+//
+// This returns the length of the name, or an error code, with the error available
+// through c_store_last_error with a null handle.
+//
+//export c_store_detect_backend
+func c_store_detect_backend(dir_ptr *C.char, dir_len C.int, out unsafe.Pointer, out_cap C.int) C.int {
+	dir := C.GoStringN(dir_ptr, dir_len)
+	backend, err := store.DetectBackend(dir)
+	if err != nil {
+		setGlobalErr(err)
+		return C.int(store.BlockError)
+	}
+	if len(backend) > int(out_cap) {
+		return C.int(store.BlockTooBig)
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	return C.int(copy(go_out, backend))
+}
+
+// c_block_hash computes the hash of an encoded block, writing HashSize bytes to out.
+//
+// This returns the number of bytes written, or an error code, with the error available
+// through c_store_last_error with a null handle.
+//
+//export c_block_hash
+func c_block_hash(block_ptr unsafe.Pointer, block_len C.int, out unsafe.Pointer) (res C.int) {
+	defer func() {
+		if r := recover(); r != nil {
+			setGlobalErr(fmt.Errorf("panic: %v", r))
+			res = C.int(store.BlockError)
+		}
+	}()
+	hash, err := store.BlockHash(C.GoBytes(block_ptr, block_len))
+	if err != nil {
+		setGlobalErr(err)
+		return C.int(store.BlockError)
+	}
+	go_out := unsafe.Slice((*byte)(out), store.HashSize)
+	return C.int(copy(go_out, hash))
+}
+
+// c_verify_block_hashes checks that an encoded block hashes to what it claims to, and to
+// the block ID given, unless it's empty, with store.VerifyBlockHashes.
+//
+// This returns 0 if it does, or an error code, with the error available through
+// c_store_last_error with a null handle.
+//
+//export c_verify_block_hashes
+func c_verify_block_hashes(block_ptr unsafe.Pointer, block_len C.int, id_ptr unsafe.Pointer, id_len C.int) (res C.int) {
+	defer func() {
+		if r := recover(); r != nil {
+			setGlobalErr(fmt.Errorf("panic: %v", r))
+			res = C.int(store.BlockError)
+		}
+	}()
+	err := store.VerifyBlockHashes(C.GoBytes(block_ptr, block_len), C.GoBytes(id_ptr, id_len))
+	if err != nil {
+		setGlobalErr(err)
+		return C.int(store.BlockError)
+	}
+	return 0
+}
+
+// c_store_last_error copies the last error for a store into out, returning the length written.
+//
+// Passing a null handle retrieves the error for the last failed call without a handle,
+// like c_store_new, instead.
+// Messages longer than out_cap are truncated, and 0 is returned if there's no error.
+//
+//export c_store_last_error
+func c_store_last_error(ptr uintptr, out unsafe.Pointer, out_cap C.int) C.int {
+	var err error
+	if ptr == 0 {
+		globalErrMu.Lock()
+		err = globalErr
+		globalErrMu.Unlock()
+	} else {
+		h := lookup(ptr)
+		h.errMu.Lock()
+		err = h.err
+		h.errMu.Unlock()
+	}
+	if err == nil {
+		return 0
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	return C.int(copy(go_out, err.Error()))
+}
+
+// c_store_backend writes the type of the backend a store was opened with into out.
+//
+// This returns the length of the name, or BlockTooBig if it doesn't fit into out_cap bytes.
+//
+//export c_store_backend
+func c_store_backend(ptr uintptr, out unsafe.Pointer, out_cap C.int) C.int {
+	backend := lookup(ptr).store.Backend()
+	if len(backend) > int(out_cap) {
+		return C.int(store.BlockTooBig)
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	return C.int(copy(go_out, backend))
+}
+
+// c_store_first_height returns the first height in the store, or 0 if the store is empty.
+//
 //export c_store_first_height
-func c_store_first_height(ptr unsafe.Pointer) C.long {
-	return C.long(cgo.Handle(uintptr(ptr)).Value().(*store.Store).FirstHeight())
+func c_store_first_height(ptr uintptr) C.long {
+	height, _ := lookup(ptr).store.FirstHeight()
+	return heightOrOverflow(height)
 }
 
+// c_store_last_height returns the last height in the store, or 0 if the store is empty.
+//
 //export c_store_last_height
-func c_store_last_height(ptr unsafe.Pointer) C.long {
-	return C.long(cgo.Handle(uintptr(ptr)).Value().(*store.Store).LastHeight())
+func c_store_last_height(ptr uintptr) C.long {
+	height, _ := lookup(ptr).store.LastHeight()
+	return heightOrOverflow(height)
+}
+
+// c_store_height is cometbft's own notion of the store height.
+//
+// This matches c_store_last_height, which is what callers should use for
+// the end of the range of blocks to read.
+//
+//export c_store_height
+func c_store_height(ptr uintptr) C.long {
+	return heightOrOverflow(lookup(ptr).store.Height())
+}
+
+// c_store_height_range writes the first and last heights in the store, read consistently.
+//
+// Both are 0 if the store is empty, since no block is ever at height 0.
+//
+//export c_store_height_range
+func c_store_height_range(ptr uintptr, out_first *C.long, out_last *C.long) {
+	first, last, _ := lookup(ptr).store.HeightRange()
+	*out_first = heightOrOverflow(first)
+	*out_last = heightOrOverflow(last)
+}
+
+// c_store_set_max_block_size bounds the size of the blocks any read of the store returns.
+//
+// Larger blocks produce BlockExceedsLimit, with their size in out_needed for reads of a single
+// block, and in the error recorded for the handle for range operations. A size of 0 removes the bound.
+//
+//export c_store_set_max_block_size
+func c_store_set_max_block_size(ptr uintptr, size C.long) {
+	lookup(ptr).store.SetMaxBlockSize(int(size))
 }
 
+// c_store_block_by_height writes the encoded block at height into out.
+//
+// This returns the length of the block, or a result code, with the size of the block in
+// out_needed. A height without a block is BlockBeyondRange if it's below the first height
+// of the store, or above its last, and BlockNotFound if it's in a gap between them.
+// Like every export reading at a height, a height above maxHeight is HeightOverflow.
+//
 //export c_store_block_by_height
-func c_store_block_by_height(ptr unsafe.Pointer, height C.long, out unsafe.Pointer, out_cap C.int) C.int {
-	go_height := int64(height)
+func c_store_block_by_height(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.BlockByHeight(go_height, go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_register_buffer registers a buffer for c_store_block_by_height_registered to write into,
+// saving the caller from passing one, and the bridge from setting it up, with every call.
+//
+// The buffer lives on the C side, and must stay valid until another buffer is registered,
+// or the store is deleted. Registering a null buffer, or one with no capacity, unregisters
+// the current one. Registering waits for any call writing into the current buffer to finish,
+// so once this returns, that buffer is no longer used, and may be freed.
+//
+//export c_store_register_buffer
+func c_store_register_buffer(ptr uintptr, buf unsafe.Pointer, buf_cap C.int) {
+	h := lookup(ptr)
+	h.bufMu.Lock()
+	defer h.bufMu.Unlock()
+	if buf == nil || buf_cap <= 0 {
+		h.buf = nil
+		return
+	}
+	h.buf = unsafe.Slice((*byte)(buf), int(buf_cap))
+}
+
+// c_store_block_by_height_registered is c_store_block_by_height, writing into the registered buffer.
+//
+// It returns the length of the block written, or a result code, with the size of the block
+// in out_needed, as the unregistered call does. Without a registered buffer, every block is
+// BlockTooBig. Calls on the same handle which use the registered buffer run one at a time.
+//
+//export c_store_block_by_height_registered
+func c_store_block_by_height_registered(ptr uintptr, height C.long, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	h.bufMu.Lock()
+	defer h.bufMu.Unlock()
+	block_res, needed, err := h.store.BlockByHeight(go_height, h.buf)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+//export c_store_block_by_height_compressed
+func c_store_block_by_height_compressed(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.BlockByHeightCompressed(go_height, go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+//export c_store_block_by_hash
+func c_store_block_by_hash(ptr uintptr, hash_ptr unsafe.Pointer, hash_len C.int, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_hash := C.GoBytes(hash_ptr, hash_len)
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.BlockByHash(go_hash, go_out)
+	if errors.Is(err, store.ErrInvalidHashLength) {
+		h.fail(err)
+		return C.int(store.BlockInvalidHash)
+	}
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_has_block returns 1 if the store contains a block at height, and 0 otherwise,
+// or HeightOverflow if height is above maxHeight.
+//
+//export c_store_has_block
+func c_store_has_block(ptr uintptr, height C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	if h.store.HasBlock(go_height) {
+		return 1
+	}
+	return 0
+}
+
+// c_store_gaps writes the ranges of heights missing from the store into out.
+//
+// Each gap is a pair of little-endian 64 bit heights, the first and last missing.
+//
+//export c_store_gaps
+func c_store_gaps(ptr uintptr, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.WriteGaps(go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_size_stats writes the sizes of the blocks in the store into out.
+//
+// This is the total and largest sizes, then a histogram of sizes, as Store.WriteSizeStats lays them out.
+//
+//export c_store_size_stats
+func c_store_size_stats(ptr uintptr, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.WriteSizeStats(go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_hash_by_height writes the hash of the block at height into out, which must hold 32 bytes.
+//
+// This returns the length of the hash, or an error code, with BlockNotFound and BlockBeyondRange
+// telling a height in a gap from one outside of the heights of the store, as for blocks.
+//
+//export c_store_hash_by_height
+func c_store_hash_by_height(ptr uintptr, height C.long, out unsafe.Pointer) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	hash, err := h.store.HashByHeight(go_height)
+	if err != nil {
+		return h.fail(err)
+	}
+	if hash == nil {
+		return C.int(h.store.MissingResult(go_height))
+	}
+	go_out := unsafe.Slice((*byte)(out), store.HashSize)
+	return C.int(copy(go_out, hash))
+}
+
+// c_store_block_part_set_header writes the part set header of the block at height into out_total
+// and out_hash, which must hold 32 bytes, and the size of the block into out_size.
+//
+// This returns the length of the part set hash, or an error code, as c_store_hash_by_height does.
+//
+//export c_store_block_part_set_header
+func c_store_block_part_set_header(ptr uintptr, height C.long, out_total *C.long, out_hash unsafe.Pointer, out_size *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	header, size, err := h.store.BlockPartSetHeader(go_height)
+	if err != nil {
+		return h.fail(err)
+	}
+	if header == nil {
+		return C.int(h.store.MissingResult(go_height))
+	}
+	*out_total = C.long(header.Total)
+	*out_size = C.long(size)
+	go_out := unsafe.Slice((*byte)(out_hash), store.HashSize)
+	return C.int(copy(go_out, header.Hash))
+}
+
+// c_store_chain_id writes the chain id in the header of the first block of a store into out.
+//
+// This returns the length of the chain id, BlockTooBig if it doesn't fit into out_cap bytes,
+// or an error code, if the store has no blocks.
+//
+//export c_store_chain_id
+func c_store_chain_id(ptr uintptr, out unsafe.Pointer, out_cap C.int) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	chainID, err := h.store.ChainID()
+	if err != nil {
+		return h.fail(err)
+	}
+	if len(chainID) > int(out_cap) {
+		return C.int(store.BlockTooBig)
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	return C.int(copy(go_out, chainID))
+}
+
+// c_store_height_by_hash writes the height of the block with a given hash into out_height.
+//
+// This returns 0 on success, or an error code.
+//
+//export c_store_height_by_hash
+func c_store_height_by_hash(ptr uintptr, hash_ptr unsafe.Pointer, hash_len C.int, out_height *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_hash := C.GoBytes(hash_ptr, hash_len)
+	height, err := h.store.HeightByHash(go_hash)
+	if errors.Is(err, store.ErrInvalidHashLength) {
+		h.fail(err)
+		return C.int(store.BlockInvalidHash)
+	}
+	if err != nil {
+		return h.fail(err)
+	}
+	if height == 0 {
+		return C.int(store.BlockNotFound)
+	}
+	c_height, ok := cLong(height)
+	if !ok {
+		h.fail(errHeightOverflow)
+		return C.int(store.HeightOverflow)
+	}
+	*out_height = c_height
+	return 0
+}
+
+// c_store_app_height writes the height of the last block applied to the application into out_height.
+//
+// This returns 0 on success, BlockNotFound if there's no state recorded beside the store,
+// or another error code.
+//
+//export c_store_app_height
+func c_store_app_height(ptr uintptr, out_height *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	height, found, err := h.store.AppHeight()
+	if err != nil {
+		return h.fail(err)
+	}
+	if !found {
+		return C.int(store.BlockNotFound)
+	}
+	c_height, ok := cLong(height)
+	if !ok {
+		h.fail(errHeightOverflow)
+		return C.int(store.HeightOverflow)
+	}
+	*out_height = c_height
+	return 0
+}
+
+//export c_store_block_meta_by_height
+func c_store_block_meta_by_height(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.BlockMetaByHeight(go_height, go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+//export c_store_commit_by_height
+func c_store_commit_by_height(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.CommitByHeight(go_height, go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+//export c_store_seen_commit_by_height
+func c_store_seen_commit_by_height(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.SeenCommitByHeight(go_height, go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_extended_commit_by_height writes the extended commit for a given height, if there is one.
+//
+//export c_store_extended_commit_by_height
+func c_store_extended_commit_by_height(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
 	go_out := unsafe.Slice((*byte)(out), int(out_cap))
-	res, err := cgo.Handle(uintptr(ptr)).Value().(*store.Store).BlockByHeight(go_height, go_out)
+	block_res, needed, err := h.store.ExtendedCommitByHeight(go_height, go_out)
 	if err != nil {
-		panic(err)
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_evidence_by_height writes the evidence committed in the block at a given height, if any.
+//
+//export c_store_evidence_by_height
+func c_store_evidence_by_height(ptr uintptr, height C.long, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.EvidenceByHeight(go_height, go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_genesis_doc writes the genesis saved in the node's state database, if any.
+//
+//export c_store_genesis_doc
+func c_store_genesis_doc(ptr uintptr, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := h.store.GenesisDoc(go_out)
+	if err != nil {
+		return h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_blocks_range packs the blocks between start and end (inclusive) into out.
+//
+// Each block is written as a 4 byte little-endian length, followed by its encoding. This returns
+// the number of blocks written, writing the next height which wasn't to out_next, and, if writing
+// stopped at a block which didn't fit, the size its entry needs to out_needed, which is 0 if
+// writing stopped at a missing block, or the end of the range or of the store, instead.
+// A start above maxHeight is HeightOverflow, while an end above it is the same as maxHeight.
+//
+//export c_store_blocks_range
+func c_store_blocks_range(ptr uintptr, start C.long, end C.long, out unsafe.Pointer, out_cap C.int, out_next *C.long, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	go_start, ok := goHeight(start)
+	if !ok {
+		*out_next, *out_needed = start, 0
+		return h.failHeight()
+	}
+	count, next, needed, err := h.store.BlocksByRange(go_start, goEnd(end), go_out)
+	*out_next = heightOrOverflow(next)
+	*out_needed = C.long(needed)
+	if err != nil {
+		return h.failRange(err)
+	}
+	return C.int(count)
+}
+
+// c_store_blocks_by_heights packs the blocks at the heights_len heights in heights into out.
+//
+// Heights without a block are written as entries with a length of 0. This returns the number
+// of entries written, setting out_needed to the size of the entry which didn't fit, if any.
+//
+//export c_store_blocks_by_heights
+func c_store_blocks_by_heights(ptr uintptr, heights *C.long, heights_len C.int, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_heights := make([]int64, int(heights_len))
+	for i, height := range unsafe.Slice(heights, int(heights_len)) {
+		go_height, ok := goHeight(height)
+		if !ok {
+			*out_needed = 0
+			return h.failHeight()
+		}
+		go_heights[i] = go_height
+	}
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	count, needed, err := h.store.BlocksByHeights(go_heights, go_out)
+	*out_needed = C.long(needed)
+	if err != nil {
+		return h.failRange(err)
+	}
+	return C.int(count)
+}
+
+// c_store_cancel stops the range operations in progress on a store, from any thread.
+//
+// c_store_blocks_range, c_store_blocks_by_heights, and c_store_stream_blocks then return BlockCancelled,
+// with out_next, where there is one, set to the first height they didn't get to. Later operations aren't affected.
+//
+//export c_store_cancel
+func c_store_cancel(ptr uintptr) {
+	lookup(ptr).store.Cancel()
+}
+
+// c_store_set_progress makes range operations call cb with ctx and the height they've reached,
+// after every so many blocks. A null cb, or a count of 0, stops reporting progress.
+//
+// cb is called on the thread running the operation, and must not save or prune blocks in this store.
+//
+//export c_store_set_progress
+func c_store_set_progress(ptr uintptr, every C.long, cb C.progress_callback, ctx unsafe.Pointer) {
+	h := lookup(ptr)
+	if cb == nil || every <= 0 {
+		h.store.SetProgress(0, nil)
+		return
+	}
+	h.store.SetProgress(int(every), func(height int64) {
+		// Heights that don't fit are left unreported, rather than reported wrong.
+		if c_height, ok := cLong(height); ok {
+			C.call_progress_callback(cb, ctx, c_height)
+		}
+	})
+}
+
+// progressCallbackInterval bounds how often c_store_set_progress_cb calls into C.
+const progressCallbackInterval = 100 * time.Millisecond
+
+// c_store_set_progress_cb makes range operations call cb with ctx, the height they've reached,
+// and the last height they're to reach, for working out how far along they are.
+// A null cb stops reporting progress.
+//
+// Unlike with c_store_set_progress, calls are bounded to one every progressCallbackInterval,
+// beside the first block of an operation, and the last height of its range, however fast
+// blocks are read. cb is called on the thread running the operation, and must not save or
+// prune blocks in this store.
+//
+//export c_store_set_progress_cb
+func c_store_set_progress_cb(ptr uintptr, cb C.range_progress_callback, ctx unsafe.Pointer) {
+	h := lookup(ptr)
+	if cb == nil {
+		h.store.SetRangeProgress(0, nil)
+		return
+	}
+	h.store.SetRangeProgress(progressCallbackInterval, func(height, last int64) {
+		// Heights that don't fit are left unreported, rather than reported wrong.
+		c_height, ok := cLong(height)
+		if !ok {
+			return
+		}
+		c_last, ok := cLong(last)
+		if !ok {
+			return
+		}
+		C.call_range_progress_callback(cb, ctx, c_height, c_last)
+	})
+}
+
+// c_store_stream_blocks calls cb with each block between start and end (inclusive), in order.
+//
+// cb is given ctx, along with a buffer holding the encoded block, which is only valid
+// for the duration of the call, and the height of the block. A non-zero return from cb
+// stops the stream early. cb must not save or prune blocks in this store.
+//
+// This returns the number of blocks streamed, writing the next height which wasn't to out_next.
+//
+//export c_store_stream_blocks
+func c_store_stream_blocks(ptr uintptr, start C.long, end C.long, cb C.block_callback, ctx unsafe.Pointer, out_next *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	overflow := false
+	go_start, ok := goHeight(start)
+	if !ok {
+		*out_next = start
+		return h.failHeight()
+	}
+	count, next, err := h.store.StreamBlocks(go_start, goEnd(end), func(height int64, data []byte) bool {
+		c_height, ok := cLong(height)
+		if !ok {
+			overflow = true
+			return false
+		}
+		return C.call_block_callback(cb, ctx, (*C.uchar)(unsafe.Pointer(unsafe.SliceData(data))), C.int(len(data)), c_height) == 0
+	})
+	*out_next = heightOrOverflow(next)
+	if err != nil {
+		return h.failRange(err)
+	}
+	if overflow {
+		h.fail(errHeightOverflow)
+		return C.int(store.HeightOverflow)
+	}
+	return C.int(count)
+}
+
+// c_store_cursor_open opens a cursor over the blocks of a store, starting at the block at start.
+//
+// Each call to c_store_cursor_next reads the block the cursor is at, and moves it on to the next
+// height, so blocks can be read one at a time, pausing for as long as needed between them.
+// Cursors are independent of each other, so several can be open on the same store at once,
+// over the same heights or not. The cursor is closed with c_store_cursor_close, which must
+// happen before the store is deleted.
+//
+// The handle is written to out_ptr, and this returns 0 on success, or HeightOverflow if start
+// is above maxHeight, in which case no cursor is opened.
+//
+//export c_store_cursor_open
+func c_store_cursor_open(ptr uintptr, start C.long, out_ptr *uintptr) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_start, ok := goHeight(start)
+	if !ok {
+		return h.failHeight()
+	}
+	*out_ptr = uintptr(cgo.NewHandle(&cursor{cursor: h.store.Cursor(go_start), h: h}))
+	return 0
+}
+
+// c_store_cursor_next writes the block a cursor is at into out, moving the cursor on to the next height.
+//
+// This returns the length of the block, or a result code, with the size of the block in out_needed,
+// as c_store_block_by_height does. The cursor only moves on once a block has been written, so after
+// BlockTooBig, it can be called again with a larger buffer, and at a height without a block, it stays
+// there. Errors are available through c_store_last_error with the handle of the store. Calls on
+// the same cursor must not overlap, but calls on different cursors may.
+//
+//export c_store_cursor_next
+func c_store_cursor_next(ptr uintptr, out unsafe.Pointer, out_cap C.int, out_needed *C.long) (res C.int) {
+	c := lookupCursor(ptr)
+	defer c.h.guard(&res)
+	go_out := unsafe.Slice((*byte)(out), int(out_cap))
+	block_res, needed, err := c.cursor.Next(go_out)
+	if err != nil {
+		return c.h.fail(err)
+	}
+	*out_needed = C.long(needed)
+	return C.int(block_res)
+}
+
+// c_store_cursor_close releases a cursor, leaving its store, and any other cursors on it, as they are.
+//
+//export c_store_cursor_close
+func c_store_cursor_close(ptr uintptr) {
+	cgo.Handle(ptr).Delete()
+}
+
+// c_store_save_block appends an encoded block, and the commit seen for it, to the store.
+//
+// This returns 0 on success.
+//
+//export c_store_save_block
+func c_store_save_block(ptr uintptr, block_ptr unsafe.Pointer, block_len C.int, commit_ptr unsafe.Pointer, commit_len C.int) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_block := C.GoBytes(block_ptr, block_len)
+	go_commit := C.GoBytes(commit_ptr, commit_len)
+	if err := h.store.SaveBlock(go_block, go_commit); err != nil {
+		return h.fail(err)
+	}
+	return 0
+}
+
+// c_store_prune_blocks removes all blocks below height, writing how many were removed to out_pruned.
+//
+// This returns 0 on success, or HeightOverflow if the count doesn't fit into a C long,
+// though the blocks are removed nonetheless.
+//
+//export c_store_prune_blocks
+func c_store_prune_blocks(ptr uintptr, height C.long, out_pruned *C.long) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	go_height, ok := goHeight(height)
+	if !ok {
+		return h.failHeight()
+	}
+	pruned, err := h.store.PruneBlocks(go_height)
+	if err != nil {
+		return h.fail(err)
+	}
+	c_pruned, ok := cLong(int64(pruned))
+	if pruned > math.MaxInt64 || !ok {
+		h.fail(fmt.Errorf("pruned %d blocks, more than fit into a C long", pruned))
+		return C.int(store.HeightOverflow)
+	}
+	*out_pruned = c_pruned
+	return 0
+}
+
+// c_store_validate checks that the first and last blocks of the store load.
+//
+// This returns 0 if they do, or an error code, with the error available through c_store_last_error.
+//
+//export c_store_validate
+func c_store_validate(ptr uintptr) (res C.int) {
+	h := lookup(ptr)
+	defer h.guard(&res)
+	if err := h.store.Validate(); err != nil {
+		return h.fail(err)
 	}
-	return C.int(res)
+	return 0
 }
 
+// c_store_delete closes the store behind a handle, and releases the handle.
+//
 //export c_store_delete
-func c_store_delete(ptr unsafe.Pointer) {
-	cgo.Handle(uintptr(ptr)).Delete()
+func c_store_delete(ptr uintptr) {
+	h := lookup(ptr)
+	// There's nobody left to report a failure to close to.
+	_ = h.store.Close()
+	cgo.Handle(ptr).Delete()
 }
 
 func main() {}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/cgo"
+	"testing"
+	"unsafe"
+
+	db "github.com/cometbft/cometbft-db"
+	"github.com/penumbra-zone/reindexer/go/store"
+)
+
+// fixtureDir is the data directory of one of the fixture nodes in test_data, as the Rust tests use.
+func fixtureDir(name string) string {
+	return filepath.Join("..", "test_data", name, "data")
+}
+
+// copyFixture copies the block store of a fixture node into a directory of its own,
+// for tests which write to it.
+func copyFixture(tb testing.TB, name string) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	from := filepath.Join(fixtureDir(name), store.DATABASE_NAME+".db")
+	to := filepath.Join(dir, store.DATABASE_NAME+".db")
+	if err := os.Mkdir(to, 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(from, entry.Name()))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(to, entry.Name()), data, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// openHandle opens the block store in dir as the C side would, deleting the handle after the test.
+func openHandle(tb testing.TB, dir string, readOnly bool) (uintptr, *store.Store) {
+	tb.Helper()
+	s, err := store.NewStore(string(db.GoLevelDBBackend), dir, store.DATABASE_NAME, readOnly)
+	if err != nil {
+		tb.Fatalf("opening the store in '%s': %v", dir, err)
+	}
+	ptr := uintptr(cgo.NewHandle(&handle{store: s}))
+	tb.Cleanup(func() { c_store_delete(ptr) })
+	return ptr, s
+}
+
+func TestHeightExports(t *testing.T) {
+	ptr, _ := openHandle(t, fixtureDir("cometbft"), true)
+	if first, last, height := c_store_first_height(ptr), c_store_last_height(ptr), c_store_height(ptr); first != 1 || last != 5 || height != 5 {
+		t.Fatalf("a fully written store: first height %d, last height %d, height %d", first, last, height)
+	}
+
+	// Pruning moves the base, which the first height reflects, but neither of the others.
+	pruned, s := openHandle(t, copyFixture(t, "cometbft"), false)
+	if _, err := s.PruneBlocks(3); err != nil {
+		t.Fatalf("pruning the store: %v", err)
+	}
+	if first, last, height := c_store_first_height(pruned), c_store_last_height(pruned), c_store_height(pruned); first != 3 || last != 5 || height != 5 {
+		t.Fatalf("a store pruned to 3: first height %d, last height %d, height %d", first, last, height)
+	}
+}
+
+func TestHasBlock(t *testing.T) {
+	ptr, _ := openHandle(t, fixtureDir("cometbft"), true)
+	for height, expected := range map[int64]int{1: 1, 5: 1, 6: 0, 0: 0, -1: 0} {
+		if res := c_store_has_block(ptr, heightOrOverflow(height)); int(res) != expected {
+			t.Errorf("height %d: expected %d, got %d", height, expected, res)
+		}
+	}
+	gap, _ := openHandle(t, fixtureDir("cometbft-gap"), true)
+	for height, expected := range map[int64]int{2: 1, 3: 0, 4: 1} {
+		if res := c_store_has_block(gap, heightOrOverflow(height)); int(res) != expected {
+			t.Errorf("height %d of a store with a gap: expected %d, got %d", height, expected, res)
+		}
+	}
+
+	// Blocks below the base of a pruned store are gone, as if they had never been there.
+	pruned, s := openHandle(t, copyFixture(t, "cometbft"), false)
+	if _, err := s.PruneBlocks(3); err != nil {
+		t.Fatalf("pruning the store: %v", err)
+	}
+	for height, expected := range map[int64]int{1: 0, 2: 0, 3: 1, 5: 1} {
+		if res := c_store_has_block(pruned, heightOrOverflow(height)); int(res) != expected {
+			t.Errorf("height %d of a store pruned to 3: expected %d, got %d", height, expected, res)
+		}
+	}
+}
+
+func TestHeightsRoundTripThroughHashes(t *testing.T) {
+	ptr, _ := openHandle(t, fixtureDir("cometbft"), true)
+	for height := int64(1); height <= 5; height++ {
+		var hash [store.HashSize]byte
+		if res := c_store_hash_by_height(ptr, heightOrOverflow(height), unsafe.Pointer(&hash[0])); res != store.HashSize {
+			t.Fatalf("hash of the block at height %d: result %d", height, res)
+		}
+		out := heightOrOverflow(0)
+		if res := c_store_height_by_hash(ptr, unsafe.Pointer(&hash[0]), store.HashSize, &out); res != 0 || int64(out) != height {
+			t.Fatalf("height of the block at height %d, by its hash: result %d, height %d", height, res, out)
+		}
+	}
+	var hash [store.HashSize]byte
+	if res := c_store_hash_by_height(ptr, 6, unsafe.Pointer(&hash[0])); int(res) != int(store.BlockBeyondRange) {
+		t.Fatalf("hash of a height past the store: expected BlockBeyondRange, got %d", res)
+	}
+
+	// A hash no block has isn't found, while one of the wrong length can't be looked up at all.
+	var unknown [store.HashSize + 1]byte
+	out := heightOrOverflow(0)
+	for _, test := range []struct {
+		name     string
+		res      int
+		expected store.BlockResult
+	}{
+		{"an unknown hash", int(c_store_height_by_hash(ptr, unsafe.Pointer(&unknown[0]), store.HashSize, &out)), store.BlockNotFound},
+		{"a short hash", int(c_store_height_by_hash(ptr, unsafe.Pointer(&unknown[0]), store.HashSize-1, &out)), store.BlockInvalidHash},
+		{"a long hash", int(c_store_height_by_hash(ptr, unsafe.Pointer(&unknown[0]), store.HashSize+1, &out)), store.BlockInvalidHash},
+	} {
+		if test.res != int(test.expected) {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, test.res)
+		}
+	}
+}
+
+func TestHeightsThatDontFitIntoACLong(t *testing.T) {
+	long := heightOrOverflow(0)
+	height := int64(math.MaxInt32) + 1
+	out, ok := cLong(height)
+	if unsafe.Sizeof(long) < 8 {
+		if ok || heightOrOverflow(height) != heightOrOverflow(int64(store.HeightOverflow)) {
+			t.Fatalf("height %d fits into a %d byte C long, as %d", height, unsafe.Sizeof(long), out)
+		}
+		return
+	}
+	for _, height := range []int64{height, math.MaxInt64, math.MinInt64} {
+		if out, ok := cLong(height); !ok || int64(out) != height {
+			t.Fatalf("height %d doesn't fit into an 8 byte C long, becoming %d", height, out)
+		}
+	}
+}
+
+func TestHeightsNearMaxInt64(t *testing.T) {
+	if long := heightOrOverflow(0); unsafe.Sizeof(long) < 8 {
+		t.Skipf("a %d byte C long can't hold heights near math.MaxInt64", unsafe.Sizeof(long))
+	}
+	ptr, _ := openHandle(t, fixtureDir("cometbft"), true)
+	output := make([]byte, 1<<20)
+	out := unsafe.Pointer(&output[0])
+	var hash [store.HashSize]byte
+	needed, next, total := heightOrOverflow(0), heightOrOverflow(0), heightOrOverflow(0)
+	reads := map[string]func(height int64) int{
+		"c_store_block_by_height": func(height int64) int {
+			return int(c_store_block_by_height(ptr, heightOrOverflow(height), out, 1<<20, &needed))
+		},
+		"c_store_block_by_height_compressed": func(height int64) int {
+			return int(c_store_block_by_height_compressed(ptr, heightOrOverflow(height), out, 1<<20, &needed))
+		},
+		"c_store_block_meta_by_height": func(height int64) int {
+			return int(c_store_block_meta_by_height(ptr, heightOrOverflow(height), out, 1<<20, &needed))
+		},
+		"c_store_commit_by_height": func(height int64) int {
+			return int(c_store_commit_by_height(ptr, heightOrOverflow(height), out, 1<<20, &needed))
+		},
+		"c_store_extended_commit_by_height": func(height int64) int {
+			return int(c_store_extended_commit_by_height(ptr, heightOrOverflow(height), out, 1<<20, &needed))
+		},
+		"c_store_evidence_by_height": func(height int64) int {
+			return int(c_store_evidence_by_height(ptr, heightOrOverflow(height), out, 1<<20, &needed))
+		},
+		"c_store_hash_by_height": func(height int64) int {
+			return int(c_store_hash_by_height(ptr, heightOrOverflow(height), unsafe.Pointer(&hash[0])))
+		},
+		"c_store_block_part_set_header": func(height int64) int {
+			return int(c_store_block_part_set_header(ptr, heightOrOverflow(height), &total, unsafe.Pointer(&hash[0]), &needed))
+		},
+		"c_store_blocks_range": func(height int64) int {
+			return int(c_store_blocks_range(ptr, heightOrOverflow(height), heightOrOverflow(height), out, 1<<20, &next, &needed))
+		},
+		"c_store_cursor_open": func(height int64) int {
+			var cursor uintptr
+			res := int(c_store_cursor_open(ptr, heightOrOverflow(height), &cursor))
+			if res == 0 {
+				res = int(c_store_cursor_next(cursor, out, 1<<20, &needed))
+				c_store_cursor_close(cursor)
+			}
+			return res
+		},
+		"c_store_stream_blocks": func(height int64) int {
+			// Nothing is past the store for the callback to be called with.
+			return int(c_store_stream_blocks(ptr, heightOrOverflow(height), heightOrOverflow(height), nil, nil, &next))
+		},
+	}
+	for name, read := range reads {
+		if res := read(math.MaxInt64); res != int(store.HeightOverflow) {
+			t.Errorf("%s at math.MaxInt64: expected HeightOverflow, got %d", name, res)
+		}
+		// The height just below is past the store, like any other.
+		if res := read(math.MaxInt64 - 1); res > 0 || res == int(store.HeightOverflow) {
+			t.Errorf("%s at math.MaxInt64 - 1: expected no block, got %d", name, res)
+		}
+	}
+	if res := c_store_has_block(ptr, heightOrOverflow(math.MaxInt64)); int(res) != int(store.HeightOverflow) {
+		t.Errorf("c_store_has_block at math.MaxInt64: expected HeightOverflow, got %d", res)
+	}
+
+	// A range without an end reads up to the end of the store, and says where it got to.
+	if res := c_store_blocks_range(ptr, 1, heightOrOverflow(math.MaxInt64), out, 1<<20, &next, &needed); res != 5 || next != 6 {
+		t.Fatalf("c_store_blocks_range from 1 to math.MaxInt64: %d blocks, up to %d", res, next)
+	}
+}
+
+func TestBlockByHeightWritesTheSizeNeeded(t *testing.T) {
+	ptr, s := openHandle(t, fixtureDir("cometbft"), true)
+	output := make([]byte, 1<<20)
+	for height := int64(1); height <= 5; height++ {
+		res, size, err := s.BlockByHeight(height, output)
+		if err != nil || res < 0 {
+			t.Fatalf("reading block at height %d: result %d, error %v", height, res, err)
+		}
+		// The size the caller is told to allocate is the same whether the block fits or not.
+		needed := heightOrOverflow(0)
+		if res := c_store_block_by_height(ptr, heightOrOverflow(height), unsafe.Pointer(&output[0]), 0, &needed); int(res) != int(store.BlockTooBig) || int(needed) != size {
+			t.Fatalf("height %d into no buffer: result %d, needing %d, expected BlockTooBig, needing %d", height, res, needed, size)
+		}
+		needed = heightOrOverflow(0)
+		if res := c_store_block_by_height(ptr, heightOrOverflow(height), unsafe.Pointer(&output[0]), 1<<20, &needed); int(res) != size || int(needed) != size {
+			t.Fatalf("height %d into a large buffer: result %d, needing %d, expected %d", height, res, needed, size)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build badgerdb
+
+package store
+
+import db "github.com/cometbft/cometbft-db"
+
+func init() {
+	supportedBackends = append(supportedBackends, db.BadgerDBBackend)
+}
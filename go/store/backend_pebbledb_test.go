@@ -0,0 +1,47 @@
+//go:build pebbledb
+
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	db "github.com/cometbft/cometbft-db"
+)
+
+func TestPebbleDBRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(string(db.PebbleDBBackend), dir, DATABASE_NAME, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := map[int64][]byte{}
+	for height := int64(1); height <= 3; height++ {
+		blockProto, commitProto := encodedBlockAt(t, height)
+		if err := s.SaveBlock(blockProto, commitProto); err != nil {
+			t.Fatalf("saving block at height %d: %v", height, err)
+		}
+		saved[height] = blockProto
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is told apart from those of other backends, and opens again with its own.
+	if backend, err := DetectBackend(dir); err != nil || backend != string(db.PebbleDBBackend) {
+		t.Fatalf("detected '%s', error %v", backend, err)
+	}
+	s, err = OpenExistingWithFallback(string(db.PebbleDBBackend), dir, DATABASE_NAME, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if first, last, ok := s.HeightRange(); !ok || first != 1 || last != 3 {
+		t.Errorf("heights %d to %d, %v, expected 1 to 3", first, last, ok)
+	}
+	for height, expected := range saved {
+		if block := readBlock(t, s, height); !bytes.Equal(block, expected) {
+			t.Errorf("block at height %d doesn't read back as it was saved", height)
+		}
+	}
+}
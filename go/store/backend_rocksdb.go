@@ -0,0 +1,9 @@
+//go:build rocksdb
+
+package store
+
+import db "github.com/cometbft/cometbft-db"
+
+func init() {
+	supportedBackends = append(supportedBackends, db.RocksDBBackend)
+}
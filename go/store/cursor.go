@@ -0,0 +1,41 @@
+package store
+
+// Cursor reads the blocks of a store one at a time, in order of height, picking up where it left off.
+//
+// Unlike StreamBlocks, a cursor only holds the store's lock while reading a block, not between
+// blocks, so its caller can pause between them for as long as it likes, with saves and prunes
+// going ahead in the meantime. Each cursor keeps a position of its own, so that several can walk
+// the same store, over ranges that overlap or not, without affecting each other.
+// A cursor isn't safe for concurrent use; open one for each goroutine instead.
+type Cursor struct {
+	s    *Store
+	next int64
+}
+
+// Cursor opens a cursor whose first block is the one at start.
+//
+// The cursor reads from this store, so it must not be used once the store is closed.
+func (s *Store) Cursor(start int64) *Cursor {
+	return &Cursor{s: s, next: start}
+}
+
+// Height returns the height of the block Next reads.
+func (c *Cursor) Height() int64 {
+	return c.next
+}
+
+// Next writes the encoded block at the cursor's height into output, moving on to the next height.
+//
+// This follows BlockByHeight, returning the length of the block, or a result code, along with
+// the encoded size. The cursor only moves on once a block has been written, so after BlockTooBig,
+// Next can be called again with a larger output for the same block. At a height without a block,
+// the cursor stays where it is: past the last block of the store, Next returns BlockBeyondRange
+// until the block there is saved, and in a gap, BlockNotFound, so a caller wanting to skip it
+// opens a cursor past it instead.
+func (c *Cursor) Next(output []byte) (res BlockResult, size int, err error) {
+	res, size, err = c.s.BlockByHeight(c.next, output)
+	if err == nil && res >= 0 {
+		c.next++
+	}
+	return res, size, err
+}
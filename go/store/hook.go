@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cometbft/cometbft/types"
+)
+
+// BlockHook transforms a block as it's read from a store, before it's encoded for the archive.
+//
+// The hook is given the height and the block, freshly loaded from the store, which it may
+// change in place, or replace, returning the block to encode in its place. This is meant for
+// redacting or annotating blocks, say stripping transactions out of a public dataset.
+//
+// Every read of a block goes through the hooks, whether by height, by hash, in a range, or
+// through Iterate, so they all agree on what a block is. Only Validate, which checks the
+// blocks as stored, skips them.
+//
+// Returning nil drops the block, which then reads as missing: BlockByHeight and BlockByHash
+// report it as not found, and range operations stop at it, as they would at a gap. The heights around it
+// are no longer contiguous, so an archive read through such a hook stops at the first block
+// dropped. To leave a block out without breaking contiguity, return a marker in its place,
+// such as the block with its transactions removed. Either way, a block changed in any part
+// that's hashed no longer matches the commit for it, so checks of block IDs will fail.
+//
+// Returning an error stops the read at that height, with the error naming the height.
+type BlockHook func(height int64, block *types.Block) (*types.Block, error)
+
+// blockHooks holds the hooks registered with RegisterBlockHook, in order.
+var blockHooks struct {
+	mtx   sync.Mutex
+	hooks []BlockHook
+}
+
+// RegisterBlockHook adds a hook applied to the blocks of every store opened afterwards.
+//
+// Hooks are applied in the order they're registered, each to the block the one before it
+// returned, stopping at the first to drop the block. Stores which are already open, and
+// their snapshots, keep the hooks registered when they were opened. Registering hooks from
+// an init function in a file of the main package makes sure they apply from the start.
+func RegisterBlockHook(hook BlockHook) {
+	blockHooks.mtx.Lock()
+	defer blockHooks.mtx.Unlock()
+	blockHooks.hooks = append(blockHooks.hooks, hook)
+}
+
+// registeredBlockHooks returns the hooks registered so far, for a store being opened.
+func registeredBlockHooks() []BlockHook {
+	blockHooks.mtx.Lock()
+	defer blockHooks.mtx.Unlock()
+	return append([]BlockHook(nil), blockHooks.hooks...)
+}
+
+// applyBlockHooks passes a loaded block through the hooks of the store, in order.
+//
+// A nil block, as for a missing height, is passed through without calling any hook.
+func (s *Store) applyBlockHooks(height int64, block *types.Block) (*types.Block, error) {
+	for _, hook := range s.hooks {
+		if block == nil {
+			break
+		}
+		var err error
+		block, err = hook(height, block)
+		if err != nil {
+			return nil, fmt.Errorf("block hook at height %d: %w", height, err)
+		}
+	}
+	return block, nil
+}
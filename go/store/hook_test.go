@@ -0,0 +1,190 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	cmtproto "github.com/cometbft/cometbft/proto/tendermint/types"
+	"github.com/cometbft/cometbft/types"
+)
+
+// registerTestHook registers a hook for the stores the test opens, unregistering it afterwards.
+func registerTestHook(tb testing.TB, hook BlockHook) {
+	tb.Helper()
+	previous := registeredBlockHooks()
+	RegisterBlockHook(hook)
+	tb.Cleanup(func() {
+		blockHooks.mtx.Lock()
+		defer blockHooks.mtx.Unlock()
+		blockHooks.hooks = previous
+	})
+}
+
+// decodeBlock decodes an encoded block, failing the test if it doesn't decode.
+func decodeBlock(tb testing.TB, data []byte) *cmtproto.Block {
+	tb.Helper()
+	var block cmtproto.Block
+	if err := block.Unmarshal(data); err != nil {
+		tb.Fatalf("decoding block: %v", err)
+	}
+	return &block
+}
+
+// annotation is the transaction the transforming hook appends to every block.
+var annotation = []byte("annotated by a hook")
+
+func annotate(height int64, block *types.Block) (*types.Block, error) {
+	block.Data.Txs = append(block.Data.Txs, annotation)
+	return block, nil
+}
+
+func TestBlockHookTransformsEveryRead(t *testing.T) {
+	plain := openTestStore(t, "cometbft")
+	hash, err := plain.HashByHeight(2)
+	if err != nil || hash == nil {
+		t.Fatalf("reading the hash of block 2: %v", err)
+	}
+	plainTxs := len(decodeBlock(t, readBlock(t, plain, 2)).Data.Txs)
+	registerTestHook(t, annotate)
+	s := openTestStore(t, "cometbft")
+
+	check := func(what string, height int64, data []byte) {
+		t.Helper()
+		block := decodeBlock(t, data)
+		if block.Header.Height != height {
+			t.Fatalf("%s: expected the block at height %d, got %d", what, height, block.Header.Height)
+		}
+		txs := block.Data.Txs
+		if len(txs) != plainTxs+1 || !bytes.Equal(txs[len(txs)-1], annotation) {
+			t.Fatalf("%s at height %d: the hook's annotation is missing", what, height)
+		}
+	}
+	for height := int64(1); height <= 5; height++ {
+		check("BlockByHeight", height, readBlock(t, s, height))
+	}
+	// A store opened before the hook was registered doesn't have it.
+	if txs := decodeBlock(t, readBlock(t, plain, 2)).Data.Txs; len(txs) != plainTxs {
+		t.Fatalf("a store opened before the hook was registered has %d transactions, expected %d", len(txs), plainTxs)
+	}
+
+	output := make([]byte, 1<<20)
+	res, _, err := s.BlockByHash(hash, output)
+	if err != nil || res < 0 {
+		t.Fatalf("BlockByHash: result %d, error %v", res, err)
+	}
+	check("BlockByHash", 2, output[:res])
+
+	count, next, err := s.StreamBlocks(1, 5, func(height int64, data []byte) bool {
+		check("StreamBlocks", height, data)
+		return true
+	})
+	if err != nil || count != 5 || next != 6 {
+		t.Fatalf("StreamBlocks: %d blocks, up to %d, error %v", count, next, err)
+	}
+
+	cursor := s.Cursor(4)
+	res, _, err = cursor.Next(output)
+	if err != nil || res < 0 {
+		t.Fatalf("Cursor.Next: result %d, error %v", res, err)
+	}
+	check("Cursor.Next", 4, output[:res])
+
+	err = s.Iterate(1, 5, func(height int64, block *types.Block) error {
+		txs := block.Data.Txs
+		if len(txs) != plainTxs+1 || !bytes.Equal(txs[len(txs)-1], annotation) {
+			t.Errorf("Iterate at height %d: the hook's annotation is missing", height)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+}
+
+func TestBlockHookFiltersBlocks(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	hash, err := s.HashByHeight(3)
+	if err != nil || hash == nil {
+		t.Fatalf("reading the hash of block 3: %v", err)
+	}
+	s.hooks = []BlockHook{func(height int64, block *types.Block) (*types.Block, error) {
+		if height == 3 {
+			return nil, nil
+		}
+		return block, nil
+	}}
+
+	output := make([]byte, 1<<20)
+	for height, expected := range map[int64]BlockResult{2: 0, 3: BlockNotFound, 4: 0} {
+		res, _, err := s.BlockByHeight(height, output)
+		if err != nil {
+			t.Fatalf("BlockByHeight at height %d: %v", height, err)
+		}
+		if min(res, 0) != expected {
+			t.Fatalf("BlockByHeight at height %d: expected %d, got %d", height, expected, res)
+		}
+	}
+	if res, _, err := s.BlockByHash(hash, output); err != nil || res != BlockNotFound {
+		t.Fatalf("BlockByHash of the dropped block: result %d, error %v", res, err)
+	}
+
+	// Range operations stop at the dropped block, as they would at a gap.
+	if count, next, _, err := s.BlocksByRange(1, 5, output); err != nil || count != 2 || next != 3 {
+		t.Fatalf("BlocksByRange: %d blocks, up to %d, error %v", count, next, err)
+	}
+	count, next, err := s.StreamBlocks(1, 5, func(int64, []byte) bool { return true })
+	if err != nil || count != 2 || next != 3 {
+		t.Fatalf("StreamBlocks: %d blocks, up to %d, error %v", count, next, err)
+	}
+	if count, _, err := s.BlocksByHeights([]int64{3, 4}, output); err != nil || count != 2 {
+		t.Fatalf("BlocksByHeights: %d entries, error %v", count, err)
+	}
+	if length := output[0]; length != 0 {
+		t.Fatalf("BlocksByHeights: the dropped block has an entry of length %d", length)
+	}
+	cursor := s.Cursor(3)
+	if res, _, err := cursor.Next(output); err != nil || res != BlockNotFound || cursor.Height() != 3 {
+		t.Fatalf("Cursor.Next at the dropped block: result %d, at %d, error %v", res, cursor.Height(), err)
+	}
+	var seen []int64
+	err = s.Iterate(1, 5, func(height int64, _ *types.Block) error {
+		seen = append(seen, height)
+		return nil
+	})
+	if !errors.Is(err, ErrMissingBlock) || !strings.Contains(err.Error(), "at height 3") {
+		t.Fatalf("Iterate: expected a missing block at height 3, got %v", err)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("Iterate: passed along heights %v, expected 1 and 2", seen)
+	}
+
+	// Validate checks the blocks as stored, which the hooks don't change.
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestBlockHookErrorsNameTheHeight(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	errRedacted := errors.New("redacted")
+	s.hooks = []BlockHook{func(height int64, block *types.Block) (*types.Block, error) {
+		if height == 4 {
+			return nil, errRedacted
+		}
+		return block, nil
+	}}
+	output := make([]byte, 1<<20)
+	_, _, err := s.BlockByHeight(4, output)
+	if !errors.Is(err, errRedacted) || !strings.Contains(err.Error(), "block hook at height 4") {
+		t.Fatalf("BlockByHeight: expected the hook's error at height 4, got %v", err)
+	}
+	count, next, _, err := s.BlocksByRange(1, 5, output)
+	if !errors.Is(err, errRedacted) || count != 3 || next != 4 {
+		t.Fatalf("BlocksByRange: %d blocks, up to %d, error %v", count, next, err)
+	}
+	if err := s.Iterate(1, 5, func(int64, *types.Block) error { return nil }); !errors.Is(err, errRedacted) {
+		t.Fatalf("Iterate: expected the hook's error, got %v", err)
+	}
+}
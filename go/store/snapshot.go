@@ -0,0 +1,177 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	db "github.com/cometbft/cometbft-db"
+	"github.com/cometbft/cometbft/store"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrSnapshotUnsupported is returned by Snapshot for backends without snapshots.
+var ErrSnapshotUnsupported = errors.New("snapshots are not supported")
+
+// errSnapshotReadOnly is returned by writes to a snapshot, which can only be read.
+var errSnapshotReadOnly = errors.New("a snapshot of a block store is read-only")
+
+// Snapshot returns a store reading the block store as it is now, even as this one changes.
+//
+// Reads from the snapshot are consistent with each other: blocks saved or pruned afterwards
+// don't show up in it, nor does a save or a prune halfway through. This is only supported
+// by the goleveldb backend, whose snapshots live as long as the process, or until the snapshot
+// is closed; other backends fail with ErrSnapshotUnsupported. Only the block store is pinned:
+// reads from the state database beside it, like GenesisDoc, see it as it is.
+//
+// The snapshot must be closed before this store, after which reads from it fail.
+func (s *Store) Snapshot() (snap *Store, err error) {
+	defer s.wrapErr(&err)
+	if s.snapshot {
+		return nil, errors.New("cannot take a snapshot of a snapshot")
+	}
+	goleveldb, ok := s.raw.(*db.GoLevelDB)
+	if !ok {
+		return nil, fmt.Errorf("%w by backend '%s'; only '%s' supports them", ErrSnapshotUnsupported, s.backend, db.GoLevelDBBackend)
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	leveldbSnap, err := goleveldb.DB().GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	raw := &snapshotDB{snap: leveldbSnap}
+	return &Store{
+		db:           store.NewBlockStore(raw),
+		raw:          raw,
+		name:         s.name,
+		backend:      s.backend,
+		dir:          s.dir,
+		readOnly:     true,
+		snapshot:     true,
+		options:      s.options,
+		maxBlockSize: s.maxBlockSize,
+		hooks:        s.hooks,
+	}, nil
+}
+
+// snapshotDB implements the database interface of cometbft-db for reading a goleveldb snapshot.
+type snapshotDB struct {
+	snap *leveldb.Snapshot
+}
+
+var _ db.DB = (*snapshotDB)(nil)
+
+func (d *snapshotDB) Get(key []byte) ([]byte, error) {
+	value, err := d.snap.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (d *snapshotDB) Has(key []byte) (bool, error) {
+	return d.snap.Has(key, nil)
+}
+
+func (d *snapshotDB) Set([]byte, []byte) error     { return errSnapshotReadOnly }
+func (d *snapshotDB) SetSync([]byte, []byte) error { return errSnapshotReadOnly }
+func (d *snapshotDB) Delete([]byte) error          { return errSnapshotReadOnly }
+func (d *snapshotDB) DeleteSync([]byte) error      { return errSnapshotReadOnly }
+func (d *snapshotDB) NewBatch() db.Batch           { return snapshotBatch{} }
+func (d *snapshotDB) Compact([]byte, []byte) error { return errSnapshotReadOnly }
+
+func (d *snapshotDB) Iterator(start, end []byte) (db.Iterator, error) {
+	return newSnapshotIterator(d.snap, start, end, false), nil
+}
+
+func (d *snapshotDB) ReverseIterator(start, end []byte) (db.Iterator, error) {
+	return newSnapshotIterator(d.snap, start, end, true), nil
+}
+
+func (d *snapshotDB) Close() error {
+	d.snap.Release()
+	return nil
+}
+
+func (d *snapshotDB) Print() error {
+	return nil
+}
+
+func (d *snapshotDB) Stats() map[string]string {
+	return map[string]string{}
+}
+
+// snapshotBatch refuses every write, like the snapshot it was made for.
+type snapshotBatch struct{}
+
+func (snapshotBatch) Set([]byte, []byte) error { return errSnapshotReadOnly }
+func (snapshotBatch) Delete([]byte) error      { return errSnapshotReadOnly }
+func (snapshotBatch) Write() error             { return errSnapshotReadOnly }
+func (snapshotBatch) WriteSync() error         { return errSnapshotReadOnly }
+func (snapshotBatch) Close() error             { return nil }
+
+// snapshotIterator walks the keys of a snapshot between start, inclusive, and end, exclusive.
+//
+// goleveldb bounds the keys itself, so this only has to walk them in the right direction.
+type snapshotIterator struct {
+	source     iterator.Iterator
+	start, end []byte
+	reverse    bool
+}
+
+func newSnapshotIterator(snap *leveldb.Snapshot, start, end []byte, reverse bool) *snapshotIterator {
+	source := snap.NewIterator(&util.Range{Start: start, Limit: end}, nil)
+	if reverse {
+		source.Last()
+	} else {
+		source.First()
+	}
+	return &snapshotIterator{source: source, start: start, end: end, reverse: reverse}
+}
+
+func (it *snapshotIterator) Domain() ([]byte, []byte) {
+	return it.start, it.end
+}
+
+func (it *snapshotIterator) Valid() bool {
+	return it.source.Valid()
+}
+
+func (it *snapshotIterator) Next() {
+	it.assertValid()
+	if it.reverse {
+		it.source.Prev()
+	} else {
+		it.source.Next()
+	}
+}
+
+// Key returns a copy of the current key, since goleveldb reuses its buffer.
+func (it *snapshotIterator) Key() []byte {
+	it.assertValid()
+	return append([]byte(nil), it.source.Key()...)
+}
+
+// Value returns a copy of the current value, since goleveldb reuses its buffer.
+func (it *snapshotIterator) Value() []byte {
+	it.assertValid()
+	return append([]byte(nil), it.source.Value()...)
+}
+
+func (it *snapshotIterator) Error() error {
+	return it.source.Error()
+}
+
+func (it *snapshotIterator) Close() error {
+	it.source.Release()
+	return nil
+}
+
+// assertValid panics like the iterators of cometbft-db do, when used past their end.
+func (it *snapshotIterator) assertValid() {
+	if !it.Valid() {
+		panic("iterator is invalid")
+	}
+}
@@ -1,58 +1,1669 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	db "github.com/cometbft/cometbft-db"
+	"github.com/cometbft/cometbft/crypto/tmhash"
+	cmtstate "github.com/cometbft/cometbft/proto/tendermint/state"
+	cmtproto "github.com/cometbft/cometbft/proto/tendermint/types"
+	sm "github.com/cometbft/cometbft/state"
 	"github.com/cometbft/cometbft/store"
+	"github.com/cometbft/cometbft/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
+// DATABASE_NAME is the name cometbft gives the database holding its block store.
 const DATABASE_NAME = "blockstore"
 
+// STATE_DATABASE_NAME is the database where cometbft keeps its state, including the genesis.
+const STATE_DATABASE_NAME = "state"
+
+// genesisDocKey matches the key cometbft's node package saves the genesis under.
+var genesisDocKey = []byte("genesisDoc")
+
+// stateKey matches the key cometbft's state package saves the latest state under.
+var stateKey = []byte("stateKey")
+
+// errReadOnly is returned by writes to a store opened read-only.
+var errReadOnly = errors.New("the block store was opened read-only")
+
+// Store wraps a cometbft block store, and is safe to use from several goroutines at once.
+//
+// The block store, and the databases beneath it, already support concurrent use,
+// but mtx makes sure that reads never observe a save or a prune halfway through.
 type Store struct {
-	db *store.BlockStore
+	mtx sync.RWMutex
+	db  *store.BlockStore
+	// raw is the database beneath the block store, kept around to take snapshots of.
+	raw db.DB
+	// snapshot is set for stores returned by Snapshot, which can't be written to.
+	snapshot bool
+	// name distinguishes stores in errors, when a process opens several.
+	name string
+	// These are kept around to open the state database beside the block store.
+	backend  db.BackendType
+	dir      string
+	readOnly bool
+	// options are those the block store's database was opened with.
+	options Options
+	// maxBlockSize bounds the blocks every read encodes, if positive.
+	maxBlockSize int
+	// cancelled counts calls to Cancel, which range operations watch for changes.
+	cancelled atomic.Uint64
+	// progress is called by range operations every progressEvery blocks, if set.
+	progress      func(height int64)
+	progressEvery int
+	// rangeProgress is called by range operations with the height they've reached, and the
+	// last one they're to reach, at most once every rangeProgressInterval, if set.
+	rangeProgress         func(height, last int64)
+	rangeProgressInterval time.Duration
+	// hooks transform blocks before they're encoded, as registered when the store was opened.
+	hooks []BlockHook
+}
+
+// supportedBackends lists the backends compiled into this build.
+//
+// cometbft-db only includes backends other than goleveldb and memdb when built with the tag of the
+// same name, and the files adding those backends here follow suit.
+var supportedBackends = []db.BackendType{db.GoLevelDBBackend, db.MemDBBackend}
+
+// nodeBackends lists the backends cometbft nodes keep their block stores with, which are those
+// named when a backend isn't known at all, whether this build includes them or not.
+var nodeBackends = []string{string(db.GoLevelDBBackend), string(db.RocksDBBackend), string(db.PebbleDBBackend)}
+
+// checkBackend makes sure that a backend is one we can actually open a store with.
+func checkBackend(backend string) (db.BackendType, error) {
+	for _, supported := range supportedBackends {
+		if string(supported) == backend {
+			return supported, nil
+		}
+	}
+	for _, known := range nodeBackends {
+		if known == backend {
+			return "", fmt.Errorf("backend '%s' isn't included in this build", backend)
+		}
+	}
+	return "", fmt.Errorf("unknown backend '%s'; supported: %s", backend, strings.Join(nodeBackends, ", "))
 }
 
-func NewStore(backend string, dir string) (*Store, error) {
-	db, err := db.NewDB(DATABASE_NAME, db.BackendType(backend), dir)
+// checkDBName makes sure that a database name can actually name a database in a directory.
+func checkDBName(dbName string) error {
+	if dbName == "" {
+		return errors.New("the block store database name cannot be empty")
+	}
+	return nil
+}
+
+// Options tune how the database of a block store is opened, which can change read throughput.
+//
+// The zero value opens the database as cometbft-db does by default. Only goleveldb can be
+// tuned, so setting anything with another backend is an error, rather than being ignored.
+// The state database beside the block store is always opened with the defaults.
+type Options struct {
+	// BlockCacheSize is how many bytes of uncompressed blocks the database caches, if positive.
+	BlockCacheSize int
+	// DisableCompaction stops reads from triggering compactions, which reading a whole store
+	// otherwise does a lot of, for no benefit to the reader.
+	DisableCompaction bool
+	// Compression is how tables written by the database are compressed: "snappy", "none",
+	// or empty for the backend's default. Only writes are affected, so this can't be set
+	// for a database opened read-only.
+	Compression string
+}
+
+// compressions maps the values of Options.Compression to those of goleveldb.
+var compressions = map[string]opt.Compression{
+	"snappy": opt.SnappyCompression,
+	"none":   opt.NoCompression,
+}
+
+// check makes sure that options make sense for a database opened with a given backend.
+func (o Options) check(backend db.BackendType, readOnly bool) error {
+	if o == (Options{}) {
+		return nil
+	}
+	if backend != db.GoLevelDBBackend {
+		return fmt.Errorf("backend '%s' cannot be tuned; only '%s' supports database options", backend, db.GoLevelDBBackend)
+	}
+	if o.BlockCacheSize < 0 {
+		return fmt.Errorf("the block cache size cannot be negative, but was %d", o.BlockCacheSize)
+	}
+	if _, ok := compressions[o.Compression]; o.Compression != "" && !ok {
+		return fmt.Errorf("unknown compression '%s'; supported: none, snappy", o.Compression)
+	}
+	if readOnly && o.Compression != "" {
+		return errors.New("compression only applies to what's written, so it cannot be set for a store opened read-only")
+	}
+	return nil
+}
+
+// NewStore opens the block store in dir, using a given cometbft-db backend.
+//
+// The backend must be one of those compiled into this build.
+// dbName is the name of the database holding the block store, which is DATABASE_NAME
+// for stores created by cometbft.
+// If readOnly is set, the database is opened without write access, which is
+// only supported by the goleveldb backend: other backends produce an error,
+// rather than silently falling back to opening the database for writing.
+//
+// With the memdb backend, nothing is written to dir: the store only lives in memory,
+// until it's deleted, which makes it useful for tests and for ephemeral runs.
+func NewStore(backend string, dir string, dbName string, readOnly bool) (*Store, error) {
+	return NewNamedStore("", backend, dir, dbName, readOnly, Options{})
+}
+
+// NewStoreWithOptions is like NewStore, but opens the database with the given options.
+func NewStoreWithOptions(backend string, dir string, dbName string, readOnly bool, options Options) (*Store, error) {
+	return NewNamedStore("", backend, dir, dbName, readOnly, options)
+}
+
+// NewNamedStore is like NewStoreWithOptions, but includes name in every error the store returns.
+//
+// An empty name behaves exactly like NewStoreWithOptions.
+func NewNamedStore(name string, backend string, dir string, dbName string, readOnly bool, options Options) (s *Store, err error) {
+	defer nameErr(name, &err)
+	backendType, err := checkBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDBName(dbName); err != nil {
+		return nil, err
+	}
+	if err := options.check(backendType, readOnly); err != nil {
+		return nil, err
+	}
+	db, err := openDB(dbName, backendType, dir, readOnly, options)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Store{
-		db: store.NewBlockStore(db),
+		db:       store.NewBlockStore(db),
+		raw:      db,
+		name:     name,
+		backend:  backendType,
+		dir:      dir,
+		readOnly: readOnly,
+		options:  options,
+		hooks:    registeredBlockHooks(),
 	}, nil
 }
 
-func (s *Store) FirstHeight() int64 {
-	return s.db.Base()
+// ErrStoreNotFound is returned by OpenExisting when there's no block store to open.
+var ErrStoreNotFound = errors.New("no block store found")
+
+// OpenExisting is like NewStoreWithOptions, but fails with ErrStoreNotFound instead of creating
+// a new, empty, block store if dir doesn't already contain one.
+func OpenExisting(backend string, dir string, dbName string, readOnly bool, options Options) (*Store, error) {
+	if err := checkDBName(dbName); err != nil {
+		return nil, err
+	}
+	// Nothing outlives an in-memory store, so there's never one to open.
+	if backend == string(db.MemDBBackend) {
+		return nil, errors.New("an in-memory store can only be created, not opened; use NewStore instead")
+	}
+	path := filepath.Join(dir, dbName+".db")
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w in '%s'", ErrStoreNotFound, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A directory with nothing in it is left behind by a store that was never written to.
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("%w in '%s'", ErrStoreNotFound, dir)
+		}
+	}
+	return NewStoreWithOptions(backend, dir, dbName, readOnly, options)
+}
+
+// OpenExistingWithFallback is like OpenExisting, but if the store fails to open with backend,
+// it tries the other backends compiled in which the files in dir point to, in turn.
+//
+// Configs can name the wrong backend, as for a store copied from another node, or one built
+// with backends this build lacks, like cleveldb, whose stores goleveldb reads just as well.
+// Backends which nothing in dir points to aren't tried, since opening a directory with the wrong
+// backend can leave files of its own behind in it. The store reports the backend it was opened
+// with through Backend. If no backend opens it, the error from backend is returned, along with
+// those from the others tried. A missing store isn't retried, since no backend changes that.
+func OpenExistingWithFallback(backend string, dir string, dbName string, readOnly bool, options Options) (*Store, error) {
+	opened, err := OpenExisting(backend, dir, dbName, readOnly, options)
+	if err == nil || errors.Is(err, ErrStoreNotFound) || checkDBName(dbName) != nil {
+		return opened, err
+	}
+	// Nothing to fall back to is no worse than the failure already at hand.
+	candidates, _ := backendCandidates(filepath.Join(dir, dbName+".db"))
+	errs := []error{err}
+	for _, fallback := range candidates {
+		if fallback == backend {
+			continue
+		}
+		if _, unsupported := checkBackend(fallback); unsupported != nil {
+			continue
+		}
+		opened, fallbackErr := OpenExisting(fallback, dir, dbName, readOnly, options)
+		if fallbackErr == nil {
+			return opened, nil
+		}
+		errs = append(errs, fmt.Errorf("falling back to backend '%s': %w", fallback, fallbackErr))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// openDB opens a database with a backend, where options have already been checked.
+func openDB(name string, backend db.BackendType, dir string, readOnly bool, options Options) (db.DB, error) {
+	if !readOnly && options == (Options{}) {
+		return db.NewDB(name, backend, dir)
+	}
+	if backend != db.GoLevelDBBackend {
+		return nil, fmt.Errorf("backend '%s' cannot be opened read-only; only '%s' supports this", backend, db.GoLevelDBBackend)
+	}
+	return db.NewGoLevelDBWithOpts(name, dir, &opt.Options{
+		ReadOnly:               readOnly,
+		BlockCacheCapacity:     options.BlockCacheSize,
+		DisableSeeksCompaction: options.DisableCompaction,
+		Compression:            compressions[options.Compression],
+	})
+}
+
+// Options returns the options the database of the store was opened with.
+func (s *Store) Options() Options {
+	return s.options
+}
+
+// DetectBackend guesses which cometbft-db backend created the block store in dir.
+//
+// This looks at the files each backend leaves behind, and fails if there are
+// no clues, or if the clues point to several backends.
+// Stores created by cleveldb share the file format of goleveldb, and are reported as such.
+func DetectBackend(dir string) (string, error) {
+	path := filepath.Join(dir, DATABASE_NAME+".db")
+	names, err := backendCandidates(path)
+	if err != nil {
+		return "", err
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("unable to detect the backend of the store in '%s'", path)
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("ambiguous backend for the store in '%s'; candidates: %s", path, strings.Join(names, ", "))
+	}
 }
 
-func (s *Store) LastHeight() int64 {
+// backendCandidates lists the backends the files of the database at path point to, in order of name.
+func backendCandidates(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// Bolt keeps everything in a single file, rather than a directory.
+	if !info.IsDir() {
+		return []string{string(db.BoltDBBackend)}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	candidates := map[string]bool{}
+	hasRocksFiles := false
+	hasCurrent := false
+	hasSst := false
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".vlog"), name == "KEYREGISTRY":
+			candidates[string(db.BadgerDBBackend)] = true
+		case strings.HasPrefix(name, "MARKER."),
+			strings.HasPrefix(name, "OPTIONS-") && isPebbleOptions(filepath.Join(path, name)):
+			candidates[string(db.PebbleDBBackend)] = true
+		case strings.HasPrefix(name, "OPTIONS-"), name == "IDENTITY":
+			hasRocksFiles = true
+		case strings.HasSuffix(name, ".ldb"):
+			candidates[string(db.GoLevelDBBackend)] = true
+		case name == "CURRENT":
+			hasCurrent = true
+		case strings.HasSuffix(name, ".sst"):
+			hasSst = true
+		}
+	}
+	// Pebble writes OPTIONS files as well, so those only point to rocksdb when nothing else
+	// points to pebble.
+	if hasRocksFiles && !candidates[string(db.PebbleDBBackend)] {
+		candidates[string(db.RocksDBBackend)] = true
+	}
+	// Leveldb keeps a CURRENT file, but none of the files specific to its successors.
+	if hasCurrent && !hasRocksFiles && len(candidates) == 0 {
+		candidates[string(db.GoLevelDBBackend)] = true
+	}
+	// Older leveldb tables also end in .sst, so without more information we can't tell these apart.
+	if hasSst && len(candidates) == 0 {
+		candidates[string(db.GoLevelDBBackend)] = true
+		candidates[string(db.RocksDBBackend)] = true
+	}
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isPebbleOptions reports whether the OPTIONS file at path was written by pebble, which names
+// its version in it, where rocksdb names its own. Stores in older pebble formats have no markers,
+// so this is all that tells them apart from those of rocksdb.
+func isPebbleOptions(path string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && bytes.Contains(data, []byte("pebble_version="))
+}
+
+// heights returns the first and last heights of the store, and false if it has no blocks.
+// It must be called with the lock held.
+//
+// cometbft records a base and height of 0 for a store it has never saved a block to,
+// and callers must not mistake that for a block at height 0, which never exists.
+func (s *Store) heights() (first, last int64, ok bool) {
+	first, last = s.db.Base(), s.db.Height()
+	if first <= 0 || last <= 0 {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// FirstHeight returns the base of the store, and false if the store is empty.
+//
+// cometbft never stores a block at height 0, so a store with blocks starts at the initial
+// height of its chain, as GenesisHeight gives it, unless it was pruned, or restored from a
+// state sync, in which case it starts above that.
+func (s *Store) FirstHeight() (height int64, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	height, _, ok = s.heights()
+	return height, ok
+}
+
+// LastHeight returns the last height in the store, as recorded by cometbft, and false if
+// the store is empty.
+func (s *Store) LastHeight() (height int64, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	_, height, ok = s.heights()
+	return height, ok
+}
+
+// Height returns the height that cometbft records for the store.
+//
+// cometbft updates this together with the base whenever a block is saved,
+// so for this version of cometbft, this is always the same as LastHeight,
+// except that it's 0, rather than reported separately, for an empty store.
+func (s *Store) Height() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 	return s.db.Height()
 }
 
+// HeightRange returns the first and last heights in the store together, and false if the
+// store is empty, in which case both heights are 0.
+//
+// Unlike calling FirstHeight and LastHeight separately, this can't observe
+// a save or prune happening in between the two.
+func (s *Store) HeightRange() (first, last int64, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.heights()
+}
+
+// Validate checks that the blocks at the first and last heights of the store actually load.
+//
+// Corruption can leave the heights cometbft records pointing past the blocks it really has,
+// which otherwise only shows up once those blocks are read, far from the cause.
+// An empty store is valid.
+func (s *Store) Validate() (err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	first, last := s.db.Base(), s.db.Height()
+	if _, _, ok := s.heights(); !ok {
+		return nil
+	}
+	if first > last {
+		return fmt.Errorf("the store's first height %d is above its last height %d", first, last)
+	}
+	for _, bound := range []struct {
+		name   string
+		height int64
+	}{{"first", first}, {"last", last}} {
+		// This checks the blocks as stored, so they're loaded without the hooks of the store.
+		block, err := s.loadBlock(bound.height)
+		if err != nil {
+			return fmt.Errorf("the block at the store's %s height doesn't load: %w", bound.name, err)
+		}
+		if block == nil {
+			return fmt.Errorf("the store's %s height is %d, but it has no block at that height", bound.name, bound.height)
+		}
+		proto, err := newBlockProto(bound.height, block)
+		if err != nil {
+			return fmt.Errorf("the block at the store's %s height doesn't load: %w", bound.name, err)
+		}
+		putBlockProto(proto)
+	}
+	return nil
+}
+
+// nameErr adds the name of a store, if it has one, to an error.
+func nameErr(name string, err *error) {
+	if *err != nil && name != "" {
+		*err = fmt.Errorf("store '%s': %w", name, *err)
+	}
+}
+
+// wrapErr adds the name of the store to an error returned by one of its methods.
+func (s *Store) wrapErr(err *error) {
+	nameErr(s.name, err)
+}
+
+// Name returns the name the store was opened with, which may be empty.
+func (s *Store) Name() string {
+	return s.name
+}
+
+// Backend returns the type of the cometbft-db backend the store was opened with.
+func (s *Store) Backend() string {
+	return string(s.backend)
+}
+
 type BlockResult int
 
 const (
-	BlockNotFound BlockResult = -1
-	BlockTooBig   BlockResult = -2
+	BlockNotFound    BlockResult = -1
+	BlockTooBig      BlockResult = -2
+	BlockInvalidHash BlockResult = -3
+	BlockError       BlockResult = -4
+	StoreNotFound    BlockResult = -5
+	HeightOverflow   BlockResult = -6
+	// BlockExceedsLimit means that a block is larger than the store's maximum block size.
+	BlockExceedsLimit BlockResult = -7
+	// BlockCancelled means that a range operation was stopped by Cancel.
+	BlockCancelled BlockResult = -8
+	// BlockBeyondRange means that there's no block at a height because it's below the first
+	// height of the store, or above its last one, rather than in a gap between them, which is
+	// BlockNotFound. Every height of an empty store is beyond its range.
+	BlockBeyondRange BlockResult = -9
 )
 
-func (s *Store) BlockByHeight(height int64, output []byte) (BlockResult, error) {
-	block := s.db.LoadBlock(height)
-	if block == nil {
-		return BlockNotFound, nil
+// ErrCancelled is returned by range operations which were stopped by Cancel.
+var ErrCancelled = errors.New("operation cancelled")
+
+// ErrBlockExceedsLimit is returned by range operations which got to a block larger than the
+// store's maximum block size, where reads of a single block return BlockExceedsLimit instead.
+var ErrBlockExceedsLimit = errors.New("block exceeds the maximum block size")
+
+var ErrInvalidHashLength = errors.New("invalid block hash length")
+
+// blockProto loads the block at a given height, as protobuf, returning nil if there's no such block.
+//
+// The block is passed through the hooks of the store first, so a block a hook drops is nil.
+// The protobuf comes from blockProtos, so it should be handed back with putBlockProto once
+// it's been encoded, and not be used afterwards. One which isn't handed back, as on errors,
+// is simply collected. Like any other error here, one from loading the block names its height.
+func (s *Store) blockProto(height int64) (proto *cmtproto.Block, err error) {
+	block, err := s.loadBlock(height)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	if block, err = s.applyBlockHooks(height, block); err != nil || block == nil {
+		return nil, err
+	}
+	return newBlockProto(height, block)
+}
+
+// newBlockProto fills a protobuf from blockProtos with a block loaded at a given height.
+func newBlockProto(height int64, block *types.Block) (*cmtproto.Block, error) {
+	proto := blockProtos.Get().(*cmtproto.Block)
+	if err := fillBlockProto(proto, block); err != nil {
+		putBlockProto(proto)
+		return nil, fmt.Errorf("encoding block at height %d: %w", height, err)
+	}
+	return proto, nil
+}
+
+// blockProtos holds the protobufs of blocks which have been encoded, to be filled again.
+//
+// Archiving encodes millions of blocks, each only to be marshaled right away, so reusing
+// the protobuf, along with the slices of its commit signatures, transactions and evidence,
+// saves allocating them again for every block.
+var blockProtos = sync.Pool{New: func() any {
+	return &cmtproto.Block{LastCommit: new(cmtproto.Commit)}
+}}
+
+// fillBlockProto fills a protobuf from blockProtos with a block, as block.ToProto would.
+func fillBlockProto(pb *cmtproto.Block, block *types.Block) error {
+	pb.Header = *block.Header.ToProto()
+	if commit := block.LastCommit; commit != nil {
+		c := pb.LastCommit
+		if c == nil {
+			c = new(cmtproto.Commit)
+		}
+		sigs := c.Signatures[:0]
+		for i := range commit.Signatures {
+			sig := &commit.Signatures[i]
+			sigs = append(sigs, cmtproto.CommitSig{
+				BlockIdFlag:      cmtproto.BlockIDFlag(sig.BlockIDFlag),
+				ValidatorAddress: sig.ValidatorAddress,
+				Timestamp:        sig.Timestamp,
+				Signature:        sig.Signature,
+			})
+		}
+		c.Signatures = sigs
+		c.Height = commit.Height
+		c.Round = commit.Round
+		c.BlockID = commit.BlockID.ToProto()
+		pb.LastCommit = c
+	} else {
+		// The commit is kept for the next block, but doesn't belong in this one.
+		pb.LastCommit = nil
+	}
+	// Without transactions, Txs stays empty, which encodes the same as it being nil.
+	txs := pb.Data.Txs[:0]
+	for _, tx := range block.Data.Txs {
+		txs = append(txs, tx)
+	}
+	pb.Data.Txs = txs
+	evidence := pb.Evidence.Evidence[:0]
+	for _, ev := range block.Evidence.Evidence {
+		proto, err := types.EvidenceToProto(ev)
+		if err != nil {
+			return err
+		}
+		evidence = append(evidence, *proto)
+	}
+	pb.Evidence.Evidence = evidence
+	return nil
+}
+
+// putBlockProto resets a protobuf from blockProtos, and hands it back, if it isn't nil.
+//
+// Nothing of the block it was filled with is kept, so that the pool doesn't hold on to
+// the transactions or signatures of blocks long gone.
+func putBlockProto(pb *cmtproto.Block) {
+	if pb == nil {
+		return
+	}
+	commit := pb.LastCommit
+	if commit == nil {
+		commit = new(cmtproto.Commit)
+	}
+	clear(commit.Signatures)
+	clear(pb.Data.Txs)
+	clear(pb.Evidence.Evidence)
+	*commit = cmtproto.Commit{Signatures: commit.Signatures[:0]}
+	*pb = cmtproto.Block{
+		LastCommit: commit,
+		Data:       cmtproto.Data{Txs: pb.Data.Txs[:0]},
+		Evidence:   cmtproto.EvidenceList{Evidence: pb.Evidence.Evidence[:0]},
+	}
+	blockProtos.Put(pb)
+}
+
+// loadBlock loads the block at a given height, returning nil if there's no such block.
+//
+// cometbft panics if a stored block fails to decode, so this recovers that into an error,
+// which names the height of the offending block.
+func (s *Store) loadBlock(height int64) (block *types.Block, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			block, err = nil, fmt.Errorf("loading block at height %d: %v", height, r)
+		}
+	}()
+	return s.db.LoadBlock(height), nil
+}
+
+// blockSize returns the size of the encoding of a block, checking it against the maximum block
+// size. It must be called with the lock held.
+//
+// Every read encoding blocks goes through this, so that none allocates for a block above the
+// limit. A block above it fails with ErrBlockExceedsLimit, along with its size.
+func (s *Store) blockSize(height int64, proto *cmtproto.Block) (int, error) {
+	size := proto.Size()
+	if s.maxBlockSize > 0 && size > s.maxBlockSize {
+		return size, fmt.Errorf("%w: the block at height %d is %d bytes, above the limit of %d", ErrBlockExceedsLimit, height, size, s.maxBlockSize)
+	}
+	return size, nil
+}
+
+// writeBlock marshals a block into output, in reads of a single block.
+//
+// This follows writeProto, but returns BlockExceedsLimit, with the size of the block, for one
+// above the maximum block size, since no buffer the caller allocates would do.
+func (s *Store) writeBlock(height int64, proto *cmtproto.Block, output []byte) (BlockResult, int, error) {
+	if size, err := s.blockSize(height, proto); err != nil {
+		return BlockExceedsLimit, size, nil
 	}
-	proto, err := block.ToProto()
+	res, size, err := writeProto(proto, output)
 	if err != nil {
-		return 0, err
+		return 0, 0, fmt.Errorf("encoding block at height %d: %w", height, err)
 	}
+	return res, size, nil
+}
+
+type sizedMarshaler interface {
+	Size() int
+	MarshalTo([]byte) (int, error)
+}
+
+// writeProto marshals proto into output, following the BlockResult convention.
+func writeProto(proto sizedMarshaler, output []byte) (BlockResult, int, error) {
 	size := proto.Size()
-	if size >= len(output) {
-		return BlockTooBig, err
+	if size > len(output) {
+		return BlockTooBig, size, nil
+	}
+	if _, err := proto.MarshalTo(output); err != nil {
+		return 0, 0, err
+	}
+	return BlockResult(size), size, nil
+}
+
+// SetMaxBlockSize bounds the size of the blocks the store encodes.
+//
+// This applies to every read of blocks, by height, by hash, compressed, through cursors, or in
+// a range. A size of 0, the default, means there's no bound.
+func (s *Store) SetMaxBlockSize(size int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.maxBlockSize = size
+}
+
+// Cancel stops the range operations in progress, which then return ErrCancelled.
+//
+// This can be called from any goroutine. Operations started afterwards aren't affected,
+// so the store stays usable.
+func (s *Store) Cancel() {
+	s.cancelled.Add(1)
+}
+
+// SetProgress makes range operations call progress with the height they've reached,
+// after every so many blocks. A nil progress, or a count of 0, stops reporting progress.
+//
+// progress is called with the store locked for reading, so it must not save or prune blocks.
+func (s *Store) SetProgress(every int, progress func(height int64)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.progress = progress
+	s.progressEvery = every
+}
+
+// SetRangeProgress makes range operations call progress with the height they've reached, and
+// the last height they're to reach, at most once every interval, however fast blocks are read.
+// A nil progress stops reporting it.
+//
+// The first block an operation reads is always reported, as is the last height of its range,
+// so that a caller showing a percentage sees it start, and finish. Unlike with SetProgress,
+// the rate of calls is bounded by time, so callers crossing into another language don't pay
+// for a call on every block. progress is called with the store locked for reading, so it must
+// not save or prune blocks.
+func (s *Store) SetRangeProgress(interval time.Duration, progress func(height, last int64)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.rangeProgress = progress
+	s.rangeProgressInterval = interval
+}
+
+// rangeWatch tracks cancellation and progress for a single range operation.
+type rangeWatch struct {
+	s         *Store
+	cancelled uint64
+	every     int
+	progress  func(height int64)
+	// last is the last height of the range, as given to rangeProgress.
+	last          int64
+	interval      time.Duration
+	rangeProgress func(height, last int64)
+	// reported is when rangeProgress was last called.
+	reported time.Time
+	// reached is the highest height handled, which is what's reported.
+	reached int64
+}
+
+// watchRange starts watching a range operation ending at last, which must hold the store's lock.
+func (s *Store) watchRange(last int64) rangeWatch {
+	w := rangeWatch{s: s, cancelled: s.cancelled.Load(), last: last}
+	if s.progress != nil && s.progressEvery > 0 {
+		w.every, w.progress = s.progressEvery, s.progress
+	}
+	if s.rangeProgress != nil {
+		w.interval, w.rangeProgress = s.rangeProgressInterval, s.rangeProgress
+	}
+	return w
+}
+
+// check returns ErrCancelled if the store was cancelled since the operation started.
+func (w *rangeWatch) check() error {
+	if w.s.cancelled.Load() != w.cancelled {
+		return ErrCancelled
+	}
+	return nil
+}
+
+// advanced reports progress, once count blocks have been handled, up to height.
+//
+// Heights needn't come in order, so rangeProgress is given the highest one handled so far,
+// and the last height is reported only once, on reaching it.
+func (w *rangeWatch) advanced(height int64, count int) {
+	if w.progress != nil && count%w.every == 0 {
+		w.progress(height)
+	}
+	if w.rangeProgress != nil {
+		finished := height == w.last && w.reached < w.last
+		w.reached = max(w.reached, height)
+		now := time.Now()
+		if count == 1 || finished || now.Sub(w.reported) >= w.interval {
+			w.reported = now
+			w.rangeProgress(w.reached, w.last)
+		}
 	}
-	_, err = proto.MarshalTo(output)
+}
+
+// missing is the result for a height without a block, telling a height outside of the blocks
+// in the store apart from a gap between them. It must be called with the lock held.
+func (s *Store) missing(height int64) BlockResult {
+	first, last, ok := s.heights()
+	if !ok || height < first || height > last {
+		return BlockBeyondRange
+	}
+	return BlockNotFound
+}
+
+// MissingResult is the result for a height without a block, as missing gives it, for callers
+// which looked the block up some other way.
+func (s *Store) MissingResult(height int64) BlockResult {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.missing(height)
+}
+
+// BlockByHeight writes the encoded block at a given height into output.
+//
+// A height without a block is BlockBeyondRange if it's outside of the heights of the store,
+// and BlockNotFound if it's in a gap between them, or its block was dropped by a hook.
+//
+// If output is too small, BlockTooBig is returned along with the encoded size,
+// so that the caller can allocate exactly once before trying again.
+// If the block is larger than the maximum block size, BlockExceedsLimit is returned
+// along with the encoded size instead, since no buffer the caller allocates would do.
+func (s *Store) BlockByHeight(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	proto, err := s.blockProto(height)
+	if err != nil {
+		return 0, 0, err
+	}
+	if proto == nil {
+		return s.missing(height), 0, nil
+	}
+	defer putBlockProto(proto)
+	return s.writeBlock(height, proto, output)
+}
+
+// encoder is shared between calls, since it supports concurrent use through EncodeAll.
+var encoder, _ = zstd.NewWriter(nil)
+
+// BlockByHeightCompressed is like BlockByHeight, but writes the block compressed with zstd.
+//
+// If compression would make the block larger, the plain encoding is written instead.
+// Callers can tell these apart by checking for the zstd magic number, which can never
+// start an encoded block. The returned sizes are those of whatever was written, but for
+// BlockExceedsLimit, which is checked, and returned, with the size of the plain encoding,
+// since that's what the caller ends up holding.
+func (s *Store) BlockByHeightCompressed(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	proto, err := s.blockProto(height)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	if proto == nil {
+		return s.missing(height), 0, nil
 	}
-	return BlockResult(size), nil
+	if size, err := s.blockSize(height, proto); err != nil {
+		putBlockProto(proto)
+		return BlockExceedsLimit, size, nil
+	}
+	raw, err := proto.Marshal()
+	putBlockProto(proto)
+	if err != nil {
+		return 0, 0, fmt.Errorf("encoding block at height %d: %w", height, err)
+	}
+	data := encoder.EncodeAll(raw, make([]byte, 0, len(raw)))
+	if len(data) >= len(raw) {
+		data = raw
+	}
+	if len(data) > len(output) {
+		return BlockTooBig, len(data), nil
+	}
+	copy(output, data)
+	return BlockResult(len(data)), len(data), nil
+}
+
+// openStateDB opens the state database beside the block store, returning nil if there's none.
+//
+// The database should be closed once done with.
+func (s *Store) openStateDB() (db.DB, error) {
+	// An in-memory store has no state database beside it, and dir might have one that isn't ours.
+	if s.backend == db.MemDBBackend {
+		return nil, nil
+	}
+	// Opening a database that doesn't exist would create it, so check first.
+	_, err := os.Stat(filepath.Join(s.dir, STATE_DATABASE_NAME+".db"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openDB(STATE_DATABASE_NAME, s.backend, s.dir, s.readOnly, Options{})
+}
+
+// GenesisDoc writes the genesis document that cometbft saved in its state database.
+//
+// This is the same JSON as the genesis file. BlockNotFound is returned if there's
+// no state database next to the block store, or if it doesn't contain a genesis,
+// in which case callers should read the genesis file instead.
+func (s *Store) GenesisDoc(output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	stateDB, err := s.openStateDB()
+	if err != nil || stateDB == nil {
+		return BlockNotFound, 0, err
+	}
+	defer stateDB.Close()
+	data, err := stateDB.Get(genesisDocKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) == 0 {
+		return BlockNotFound, 0, nil
+	}
+	if len(data) > len(output) {
+		return BlockTooBig, len(data), nil
+	}
+	copy(output, data)
+	return BlockResult(len(data)), len(data), nil
+}
+
+// GenesisHeight returns the height of the first block of the chain, as the genesis that
+// cometbft saved in its state database gives it.
+//
+// A genesis gives its initial height, under "initial_height", where 0, or leaving it out,
+// means the chain starts at height 1, as cometbft reads it. This is normalized, so the
+// height is never 0: there's never a genesis block at height 0. found is false if there's
+// no state database next to the block store, or if it has no genesis saved in it, in which
+// case the genesis file says where the chain starts, rather than the blocks of the store.
+func (s *Store) GenesisHeight() (height int64, found bool, err error) {
+	defer s.wrapErr(&err)
+	stateDB, err := s.openStateDB()
+	if err != nil || stateDB == nil {
+		return 0, false, err
+	}
+	defer stateDB.Close()
+	data, err := stateDB.Get(genesisDocKey)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(data) == 0 {
+		return 0, false, nil
+	}
+	height, err = genesisInitialHeight(data)
+	if err != nil {
+		return 0, false, err
+	}
+	return height, true, nil
+}
+
+// genesisInitialHeight reads the initial height out of a genesis, normalizing 0 to 1.
+//
+// Only that field is decoded, since the rest of the genesis isn't needed, and the app
+// state can be large. cometbft writes the height as a string, but a number is accepted too.
+func genesisInitialHeight(genesis []byte) (int64, error) {
+	var doc struct {
+		InitialHeight json.RawMessage `json:"initial_height"`
+	}
+	if err := json.Unmarshal(genesis, &doc); err != nil {
+		return 0, fmt.Errorf("decoding genesis: %w", err)
+	}
+	var height int64
+	if raw := bytes.Trim(doc.InitialHeight, `"`); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &height); err != nil {
+			return 0, fmt.Errorf("decoding initial height of genesis %s: %w", doc.InitialHeight, err)
+		}
+	}
+	if height < 0 {
+		return 0, fmt.Errorf("genesis has a negative initial height %d", height)
+	}
+	if height == 0 {
+		height = 1
+	}
+	return height, nil
+}
+
+// AppHeight returns the height of the last block cometbft applied to the application,
+// as recorded in its state database.
+//
+// cometbft saves a block before applying it, so after an abnormal shutdown, this can
+// trail the last height of the block store. found is false if there's no state database
+// next to the block store, or if it has no state saved in it yet.
+func (s *Store) AppHeight() (height int64, found bool, err error) {
+	defer s.wrapErr(&err)
+	stateDB, err := s.openStateDB()
+	if err != nil || stateDB == nil {
+		return 0, false, err
+	}
+	defer stateDB.Close()
+	data, err := stateDB.Get(stateKey)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(data) == 0 {
+		return 0, false, nil
+	}
+	// Decoding just the proto avoids pulling in the state package, and everything it depends on.
+	var state cmtstate.State
+	if err := state.Unmarshal(data); err != nil {
+		return 0, false, fmt.Errorf("decoding state: %w", err)
+	}
+	return state.LastBlockHeight, true, nil
+}
+
+// BlockByHash writes the encoded block with a given hash into output.
+//
+// This follows the same conventions as BlockByHeight, and fails with
+// ErrInvalidHashLength if the hash can't possibly be a block hash.
+// The block goes through the hooks of the store, like any other, and one they drop
+// is BlockNotFound, just as a hash no block in the store has.
+func (s *Store) BlockByHash(hash []byte, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	if len(hash) != tmhash.Size {
+		return 0, 0, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidHashLength, tmhash.Size, len(hash))
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	block := s.db.LoadBlockByHash(hash)
+	if block == nil {
+		return BlockNotFound, 0, nil
+	}
+	// The hash is that of the block as stored, which the hooks see, as for any other read.
+	height := block.Height
+	if block, err = s.applyBlockHooks(height, block); err != nil {
+		return 0, 0, err
+	}
+	if block == nil {
+		return BlockNotFound, 0, nil
+	}
+	proto, err := newBlockProto(height, block)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer putBlockProto(proto)
+	return s.writeBlock(height, proto, output)
+}
+
+// HasBlock checks if the store contains a block at a given height.
+//
+// This only reads the block's metadata, which is much cheaper than loading the block.
+func (s *Store) HasBlock(height int64) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.db.LoadBlockMeta(height) != nil
+}
+
+// Gap is a range of missing heights, from From to To inclusive.
+type Gap struct {
+	From int64
+	To   int64
+}
+
+// GapSize is the size of each gap written by WriteGaps: two 8 byte little-endian heights.
+const GapSize = 16
+
+// Gaps finds the ranges of heights missing between the first and last heights of the store.
+//
+// This only reads the metadata for each block, so it's much cheaper than reading every block.
+func (s *Store) Gaps() (gaps []Gap, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	first, last, ok := s.heights()
+	if !ok {
+		return gaps, nil
+	}
+	for height := first; height <= last; height++ {
+		if s.db.LoadBlockMeta(height) != nil {
+			continue
+		}
+		if len(gaps) > 0 && gaps[len(gaps)-1].To == height-1 {
+			gaps[len(gaps)-1].To = height
+		} else {
+			gaps = append(gaps, Gap{From: height, To: height})
+		}
+	}
+	return gaps, nil
+}
+
+// WriteGaps writes the gaps in the store into output, following the BlockResult convention.
+//
+// Each gap takes up GapSize bytes, holding its first and last missing heights.
+func (s *Store) WriteGaps(output []byte) (BlockResult, int, error) {
+	gaps, err := s.Gaps()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := len(gaps) * GapSize
+	if size > len(output) {
+		return BlockTooBig, size, nil
+	}
+	for i, gap := range gaps {
+		binary.LittleEndian.PutUint64(output[i*GapSize:], uint64(gap.From))
+		binary.LittleEndian.PutUint64(output[i*GapSize+8:], uint64(gap.To))
+	}
+	return BlockResult(size), size, nil
+}
+
+// SizeStats sums up the sizes of the blocks in the store, as recorded in their metadata.
+//
+// This returns the total size of every block, the size of the largest, and a histogram of
+// their sizes, where the count at index i is of blocks of at least 2^i bytes, but less than
+// 2^(i+1), with the empty buckets above the largest left out. Like Gaps, this never loads a
+// block itself.
+func (s *Store) SizeStats() (total uint64, maxBlock int64, buckets []uint64, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	first, last, ok := s.heights()
+	if !ok {
+		return 0, 0, nil, nil
+	}
+	for height := first; height <= last; height++ {
+		meta := s.db.LoadBlockMeta(height)
+		if meta == nil {
+			continue
+		}
+		size := int64(meta.BlockSize)
+		total += uint64(size)
+		maxBlock = max(maxBlock, size)
+		bucket := max(bits.Len64(uint64(size))-1, 0)
+		for len(buckets) <= bucket {
+			buckets = append(buckets, 0)
+		}
+		buckets[bucket]++
+	}
+	return total, maxBlock, buckets, nil
+}
+
+// WriteSizeStats writes the stats of SizeStats into output, following the BlockResult convention.
+//
+// The total and largest sizes come first, then the count of each bucket, all 8 bytes little-endian.
+func (s *Store) WriteSizeStats(output []byte) (BlockResult, int, error) {
+	total, maxBlock, buckets, err := s.SizeStats()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := (2 + len(buckets)) * 8
+	if size > len(output) {
+		return BlockTooBig, size, nil
+	}
+	binary.LittleEndian.PutUint64(output, total)
+	binary.LittleEndian.PutUint64(output[8:], uint64(maxBlock))
+	for i, count := range buckets {
+		binary.LittleEndian.PutUint64(output[16+i*8:], count)
+	}
+	return BlockResult(size), size, nil
+}
+
+// HashSize is the size of a block hash.
+const HashSize = tmhash.Size
+
+// HashByHeight returns the hash of the block at a given height, or nil if there's no such block.
+func (s *Store) HashByHeight(height int64) (hash []byte, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	meta := s.db.LoadBlockMeta(height)
+	if meta == nil {
+		return nil, nil
+	}
+	return meta.BlockID.Hash, nil
+}
+
+// HeightByHash returns the height of the block with a given hash, or 0 if there's no such block.
+//
+// Like BlockByHash, this fails with ErrInvalidHashLength if the hash can't possibly be a block hash.
+func (s *Store) HeightByHash(hash []byte) (height int64, err error) {
+	defer s.wrapErr(&err)
+	if len(hash) != HashSize {
+		return 0, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidHashLength, HashSize, len(hash))
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	meta := s.db.LoadBlockMetaByHash(hash)
+	if meta == nil {
+		return 0, nil
+	}
+	return meta.Header.Height, nil
+}
+
+// ErrStoreEmpty is returned by ChainID when there are no blocks to read the chain id from.
+var ErrStoreEmpty = errors.New("the block store contains no blocks")
+
+// ChainID returns the chain id in the header of the first block in the store.
+//
+// Every header records the chain it belongs to, so this doesn't need a genesis file.
+// Like HashByHeight, this only reads the metadata of the block. An empty store fails
+// with ErrStoreEmpty.
+func (s *Store) ChainID() (chainID string, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	base, _, ok := s.heights()
+	if !ok {
+		return "", fmt.Errorf("%w, so it has no chain id", ErrStoreEmpty)
+	}
+	meta := s.db.LoadBlockMeta(base)
+	if meta == nil {
+		return "", fmt.Errorf("the store's first height is %d, but it has no block at that height", base)
+	}
+	return meta.Header.ChainID, nil
+}
+
+// BlockMetaByHeight writes the encoded metadata for the block at a given height into output.
+//
+// This avoids loading the transactions in a block, when only the header,
+// block id, or number of transactions is needed. A height without a block is BlockNotFound or
+// BlockBeyondRange, as with BlockByHeight.
+func (s *Store) BlockMetaByHeight(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	meta := s.db.LoadBlockMeta(height)
+	if meta == nil {
+		return s.missing(height), 0, nil
+	}
+	return writeProto(meta.ToProto(), output)
+}
+
+// BlockPartSetHeader returns the part set header of the block at a given height, along with
+// the size of the block, or nil if there's no such block.
+//
+// Like BlockMetaByHeight, this only reads the metadata of the block, which records how it was
+// split into parts to be gossiped, without loading the block itself.
+func (s *Store) BlockPartSetHeader(height int64) (header *types.PartSetHeader, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	meta := s.db.LoadBlockMeta(height)
+	if meta == nil {
+		return nil, 0, nil
+	}
+	return &meta.BlockID.PartSetHeader, meta.BlockSize, nil
+}
+
+// CommitByHeight writes the encoded commit for the block at a given height into output.
+//
+// This follows the same conventions as BlockByHeight.
+func (s *Store) CommitByHeight(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	commit := s.db.LoadBlockCommit(height)
+	if commit == nil {
+		return s.missing(height), 0, nil
+	}
+	return writeProto(commit.ToProto(), output)
+}
+
+// SeenCommitByHeight writes the encoded commit seen locally for a given height into output.
+//
+// Only the last height in a store is guaranteed to have a seen commit.
+func (s *Store) SeenCommitByHeight(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	commit := s.db.LoadSeenCommit(height)
+	if commit == nil {
+		return BlockNotFound, 0, nil
+	}
+	return writeProto(commit.ToProto(), output)
+}
+
+// ExtendedCommitByHeight writes the encoded extended commit, with vote extensions, for a given height.
+//
+// Nodes only save these from cometbft 0.38 on, and only while vote extensions are enabled,
+// so heights without one, like any before the upgrade, are BlockNotFound.
+func (s *Store) ExtendedCommitByHeight(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	commit := s.db.LoadBlockExtendedCommit(height)
+	if commit == nil {
+		return BlockNotFound, 0, nil
+	}
+	return writeProto(commit.ToProto(), output)
+}
+
+// RangePrefixSize is the size of the length prefix preceding each block in a range.
+const RangePrefixSize = 4
+
+// EvidenceByHeight writes the evidence of misbehavior committed in the block at a given height.
+//
+// The evidence is written as an encoded EvidenceList, following the BlockResult convention.
+// Most blocks carry none, so a height without evidence is BlockNotFound, and one without
+// a block is BlockNotFound or BlockBeyondRange, as with BlockByHeight.
+func (s *Store) EvidenceByHeight(height int64, output []byte) (res BlockResult, size int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	proto, err := s.blockProto(height)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer putBlockProto(proto)
+	if proto == nil {
+		return s.missing(height), 0, nil
+	}
+	if len(proto.Evidence.Evidence) == 0 {
+		return BlockNotFound, 0, nil
+	}
+	res, size, err = writeProto(&proto.Evidence, output)
+	if err != nil {
+		return 0, 0, fmt.Errorf("encoding evidence at height %d: %w", height, err)
+	}
+	return res, size, nil
+}
+
+// BlocksByRange packs the blocks between start and end (inclusive) into output.
+//
+// Each block is written as a 4 byte little-endian length, followed by its encoding.
+// Writing stops at the first block which would overflow output, at the first
+// missing block, or past the last height of the store.
+// Writing also stops with ErrCancelled if Cancel is called in the meantime, and with
+// ErrBlockExceedsLimit at a block larger than the maximum block size.
+//
+// This returns the number of blocks written, and the next height which wasn't, along with,
+// if writing stopped at a block which didn't fit, the size its entry needs, so that the caller
+// can tell a full output from a missing block, and grow output to fit that block before
+// continuing from there. needed is 0 if writing stopped for any other reason.
+func (s *Store) BlocksByRange(start int64, end int64, output []byte) (count int, next int64, needed int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if last := s.db.Height(); end > last {
+		end = last
+	}
+	watch := s.watchRange(end)
+	offset := 0
+	height := start
+	for ; height <= end; height++ {
+		if err := watch.check(); err != nil {
+			return count, height, 0, err
+		}
+		proto, err := s.blockProto(height)
+		if err != nil {
+			return count, height, 0, err
+		}
+		if proto == nil {
+			break
+		}
+		size, err := s.blockSize(height, proto)
+		if err != nil {
+			putBlockProto(proto)
+			return count, height, 0, err
+		}
+		if offset+RangePrefixSize+size > len(output) {
+			putBlockProto(proto)
+			return count, height, RangePrefixSize + size, nil
+		}
+		binary.LittleEndian.PutUint32(output[offset:], uint32(size))
+		offset += RangePrefixSize
+		_, err = proto.MarshalTo(output[offset : offset+size])
+		putBlockProto(proto)
+		if err != nil {
+			return count, height, 0, fmt.Errorf("encoding block at height %d: %w", height, err)
+		}
+		offset += size
+		count++
+		watch.advanced(height, count)
+	}
+	return count, height, 0, nil
+}
+
+// BlocksByHeights packs the blocks at a set of heights into output, in the order given.
+//
+// Each block is written as in BlocksByRange, with a 4 byte little-endian length, followed
+// by its encoding. The heights don't have to be contiguous, or even in order, and a height
+// without a block is written as an entry with a length of 0, so that every entry lines up
+// with the height it was asked for. Writing stops at the first block which would overflow
+// output, with ErrCancelled if Cancel is called in the meantime, or with ErrBlockExceedsLimit
+// at a block larger than the maximum block size.
+//
+// This returns the number of entries written, and, if writing stopped at a block which
+// didn't fit, the size its entry needs, so that the caller can continue from there.
+func (s *Store) BlocksByHeights(heights []int64, output []byte) (count int, needed int, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	// The heights needn't be in order, so progress runs up to the highest one asked for.
+	var last int64
+	if len(heights) > 0 {
+		last = slices.Max(heights)
+	}
+	watch := s.watchRange(last)
+	offset := 0
+	for _, height := range heights {
+		if err := watch.check(); err != nil {
+			return count, 0, err
+		}
+		proto, err := s.blockProto(height)
+		if err != nil {
+			return count, 0, err
+		}
+		size := 0
+		if proto != nil {
+			if size, err = s.blockSize(height, proto); err != nil {
+				putBlockProto(proto)
+				return count, 0, err
+			}
+		}
+		if offset+RangePrefixSize+size > len(output) {
+			putBlockProto(proto)
+			return count, RangePrefixSize + size, nil
+		}
+		binary.LittleEndian.PutUint32(output[offset:], uint32(size))
+		offset += RangePrefixSize
+		if proto != nil {
+			_, err := proto.MarshalTo(output[offset : offset+size])
+			putBlockProto(proto)
+			if err != nil {
+				return count, 0, fmt.Errorf("encoding block at height %d: %w", height, err)
+			}
+		}
+		offset += size
+		count++
+		watch.advanced(height, count)
+	}
+	return count, 0, nil
+}
+
+// StreamBlocks passes the encoding of each block between start and end (inclusive) to yield, in order.
+//
+// The data given to yield is reused between blocks, so it must be copied to be kept around.
+// Streaming stops at the first missing block, past the last height of the store,
+// as soon as yield returns false, with ErrCancelled if Cancel is called in the meantime,
+// or with ErrBlockExceedsLimit at a block larger than the maximum block size.
+// The store stays locked for reading throughout, so yield must not save or prune blocks.
+//
+// This returns the number of blocks passed to yield, and the next height which wasn't.
+func (s *Store) StreamBlocks(start int64, end int64, yield func(height int64, data []byte) bool) (count int, next int64, err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if last := s.db.Height(); end > last {
+		end = last
+	}
+	watch := s.watchRange(end)
+	var buf []byte
+	height := start
+	for ; height <= end; height++ {
+		if err := watch.check(); err != nil {
+			return count, height, err
+		}
+		proto, err := s.blockProto(height)
+		if err != nil {
+			return count, height, err
+		}
+		if proto == nil {
+			break
+		}
+		size, err := s.blockSize(height, proto)
+		if err != nil {
+			putBlockProto(proto)
+			return count, height, err
+		}
+		if size > cap(buf) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		_, err = proto.MarshalTo(buf)
+		putBlockProto(proto)
+		if err != nil {
+			return count, height, fmt.Errorf("encoding block at height %d: %w", height, err)
+		}
+		count++
+		watch.advanced(height, count)
+		if !yield(height, buf) {
+			return count, height + 1, nil
+		}
+	}
+	return count, height, nil
+}
+
+// ErrMissingBlock is returned by Iterate for a height in its range without a block, or whose
+// block was dropped by a hook.
+var ErrMissingBlock = errors.New("missing block")
+
+// Iterate decodes each block between start and end (inclusive), passing it to fn, in order.
+//
+// This is meant for Go callers, who want typed blocks rather than their encoding, unlike
+// the C ABI. Like StreamBlocks, the range is cut down to the last height of the store, and
+// the store stays locked for reading throughout, so fn must not save or prune blocks.
+// fn is given each block as the hooks of the store return it, as every other read encodes it.
+// Iteration stops at the first error fn returns, which is returned, wrapped with the name of
+// the store, as is ErrMissingBlock for a height without a block, or ErrCancelled if Cancel is
+// called in the meantime.
+func (s *Store) Iterate(start, end int64, fn func(height int64, block *types.Block) error) (err error) {
+	defer s.wrapErr(&err)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if last := s.db.Height(); end > last {
+		end = last
+	}
+	watch := s.watchRange(end)
+	count := 0
+	for height := start; height <= end; height++ {
+		if err := watch.check(); err != nil {
+			return err
+		}
+		block, err := s.loadBlock(height)
+		if err != nil {
+			return err
+		}
+		if block, err = s.applyBlockHooks(height, block); err != nil {
+			return err
+		}
+		if block == nil {
+			return fmt.Errorf("%w at height %d", ErrMissingBlock, height)
+		}
+		count++
+		watch.advanced(height, count)
+		if err := fn(height, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BlockHash decodes a block, and computes its hash, as used to identify it in commits.
+//
+// Only the header is used, so the rest of the block isn't validated.
+func BlockHash(blockProto []byte) ([]byte, error) {
+	var rawBlock cmtproto.Block
+	if err := rawBlock.Unmarshal(blockProto); err != nil {
+		return nil, fmt.Errorf("decoding block: %w", err)
+	}
+	header, err := types.HeaderFromProto(&rawBlock.Header)
+	if err != nil {
+		return nil, fmt.Errorf("decoding header of block at height %d: %w", rawBlock.Header.Height, err)
+	}
+	hash := header.Hash()
+	if hash == nil {
+		return nil, fmt.Errorf("header of block at height %d is incomplete, and has no hash", header.Height)
+	}
+	return hash, nil
+}
+
+// ErrHashMismatch is returned by VerifyBlockHashes when a block doesn't hash to what it should.
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// VerifyBlockHashes decodes a block, and checks that it hashes to what it claims to.
+//
+// The hashes of the data, evidence and last commit of the block must match those in its
+// header, and unless blockID is empty, the hash of the header must match it too, as the
+// block's ID. This fails with ErrHashMismatch, naming the hash that's wrong, if any isn't.
+func VerifyBlockHashes(blockProto []byte, blockID []byte) error {
+	var rawBlock cmtproto.Block
+	if err := rawBlock.Unmarshal(blockProto); err != nil {
+		return fmt.Errorf("decoding block: %w", err)
+	}
+	height := rawBlock.Header.Height
+	// BlockFromProto would check the hashes as well, but without saying which one is wrong.
+	header, err := types.HeaderFromProto(&rawBlock.Header)
+	if err != nil {
+		return fmt.Errorf("decoding header of block at height %d: %w", height, err)
+	}
+	data, err := types.DataFromProto(&rawBlock.Data)
+	if err != nil {
+		return fmt.Errorf("decoding data of block at height %d: %w", height, err)
+	}
+	var evidence types.EvidenceData
+	if err := evidence.FromProto(&rawBlock.Evidence); err != nil {
+		return fmt.Errorf("decoding evidence of block at height %d: %w", height, err)
+	}
+	var lastCommit *types.Commit
+	if rawBlock.LastCommit != nil {
+		if lastCommit, err = types.CommitFromProto(rawBlock.LastCommit); err != nil {
+			return fmt.Errorf("decoding last commit of block at height %d: %w", height, err)
+		}
+	}
+	checks := []struct {
+		name     string
+		expected []byte
+		actual   []byte
+	}{
+		{"data hash", header.DataHash, data.Hash()},
+		{"evidence hash", header.EvidenceHash, evidence.Hash()},
+		{"last commit hash", header.LastCommitHash, lastCommit.Hash()},
+	}
+	for _, check := range checks {
+		if !bytes.Equal(check.expected, check.actual) {
+			return fmt.Errorf("%w at height %d: the header has %s %X, but the block hashes to %X", ErrHashMismatch, height, check.name, check.expected, check.actual)
+		}
+	}
+	if len(blockID) == 0 {
+		return nil
+	}
+	if hash := header.Hash(); !bytes.Equal(hash, blockID) {
+		return fmt.Errorf("%w at height %d: the block ID is %X, but the header hashes to %X", ErrHashMismatch, height, blockID, hash)
+	}
+	return nil
+}
+
+// SaveBlock decodes a block, and the commit seen for it, and appends them to the store.
+//
+// Blocks must be saved in order: the first block can be at any height,
+// but each block after that must be at the height following the last one.
+func (s *Store) SaveBlock(blockProto []byte, commitProto []byte) (err error) {
+	defer s.wrapErr(&err)
+	var rawBlock cmtproto.Block
+	if err := rawBlock.Unmarshal(blockProto); err != nil {
+		return fmt.Errorf("decoding block: %w", err)
+	}
+	block, err := types.BlockFromProto(&rawBlock)
+	if err != nil {
+		return fmt.Errorf("decoding block: %w", err)
+	}
+	var rawCommit cmtproto.Commit
+	if err := rawCommit.Unmarshal(commitProto); err != nil {
+		return fmt.Errorf("decoding commit for block at height %d: %w", block.Height, err)
+	}
+	commit, err := types.CommitFromProto(&rawCommit)
+	if err != nil {
+		return fmt.Errorf("decoding commit for block at height %d: %w", block.Height, err)
+	}
+	if commit.Height != block.Height {
+		return fmt.Errorf("commit at height %d does not match block at height %d", commit.Height, block.Height)
+	}
+	if s.snapshot {
+		return errSnapshotReadOnly
+	}
+	if s.readOnly {
+		return errReadOnly
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.db.Base() > 0 && block.Height != s.db.Height()+1 {
+		return fmt.Errorf("cannot save block at height %d: expected height %d", block.Height, s.db.Height()+1)
+	}
+	parts, err := block.MakePartSet(types.BlockPartSizeBytes)
+	if err != nil {
+		return fmt.Errorf("splitting block at height %d into parts: %w", block.Height, err)
+	}
+	s.db.SaveBlock(block, parts, commit)
+	return nil
+}
+
+// Close closes the underlying database, after which the store can't be used.
+//
+// Until then, the database stays locked, so a store in the same directory can't be opened again.
+func (s *Store) Close() (err error) {
+	defer s.wrapErr(&err)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.db.Close()
+}
+
+// PruneBlocks removes all blocks below a given height, returning how many were removed.
+//
+// FirstHeight reflects the new base afterwards.
+func (s *Store) PruneBlocks(height int64) (pruned uint64, err error) {
+	defer s.wrapErr(&err)
+	if s.snapshot {
+		return 0, errSnapshotReadOnly
+	}
+	// The block store only learns that its database refuses writes after it has moved its base.
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	pruned, _, err = s.db.PruneBlocks(height, pastEvidenceAge(height))
+	return pruned, err
+}
+
+// pastEvidenceAge is the state to prune below a height with, in which every block below it
+// is older than any evidence can be.
+//
+// From cometbft 0.38 on, pruning keeps the header and commit of blocks young enough to be
+// evidence against, as the state judges; this has it remove all of each block, as before.
+func pastEvidenceAge(height int64) sm.State {
+	return sm.State{LastBlockHeight: height, LastBlockTime: time.Unix(1<<40, 0)}
 }
@@ -0,0 +1,1232 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/cometbft/cometbft-db"
+	"github.com/cometbft/cometbft/crypto"
+	cmtproto "github.com/cometbft/cometbft/proto/tendermint/types"
+	"github.com/cometbft/cometbft/types"
+)
+
+// testDataDir is the data directory of one of the fixture nodes the Rust tests read as well.
+//
+// "cometbft" holds the blocks at heights 1 to 5, and "cometbft-gap" the same, but for height 3.
+func testDataDir(name string) string {
+	return filepath.Join("..", "..", "test_data", name, "data")
+}
+
+// openTestStore opens the block store of a fixture node read-only, closing it after the test.
+func openTestStore(tb testing.TB, name string) *Store {
+	tb.Helper()
+	s, err := NewStore(string(db.GoLevelDBBackend), testDataDir(name), DATABASE_NAME, true)
+	if err != nil {
+		tb.Fatalf("opening fixture '%s': %v", name, err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// copyTestDataDir copies the data directory of a fixture node to a temporary one, for tests
+// which may change it, returning the copy.
+func copyTestDataDir(tb testing.TB, name string) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	from := filepath.Join(testDataDir(name), DATABASE_NAME+".db")
+	to := filepath.Join(dir, DATABASE_NAME+".db")
+	if err := os.Mkdir(to, 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(from, entry.Name()))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(to, entry.Name()), data, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readBlock reads the encoded block at a height, failing the test if there's none.
+func readBlock(tb testing.TB, s *Store, height int64) []byte {
+	tb.Helper()
+	output := make([]byte, 1<<20)
+	res, _, err := s.BlockByHeight(height, output)
+	if err != nil {
+		tb.Fatalf("reading block at height %d: %v", height, err)
+	}
+	if res < 0 {
+		tb.Fatalf("reading block at height %d: result %d", height, res)
+	}
+	return output[:res]
+}
+
+// encodedBlockAt encodes the block at height 2 of the "cometbft" fixture, moved to a height,
+// along with a commit for it, as SaveBlock takes them.
+func encodedBlockAt(tb testing.TB, height int64) (blockProto, commitProto []byte) {
+	tb.Helper()
+	s := openTestStore(tb, "cometbft")
+	var proto cmtproto.Block
+	if err := proto.Unmarshal(readBlock(tb, s, 2)); err != nil {
+		tb.Fatalf("decoding the fixture block: %v", err)
+	}
+	output := make([]byte, 1<<20)
+	res, _, err := s.SeenCommitByHeight(2, output)
+	if err != nil || res < 0 {
+		tb.Fatalf("reading the fixture commit: result %d, error %v", res, err)
+	}
+	var commit cmtproto.Commit
+	if err := commit.Unmarshal(output[:res]); err != nil {
+		tb.Fatalf("decoding the fixture commit: %v", err)
+	}
+
+	proto.Header.Height = height
+	block, err := types.BlockFromProto(&proto)
+	if err != nil {
+		tb.Fatalf("decoding block at height %d: %v", height, err)
+	}
+	parts, err := block.MakePartSet(types.BlockPartSizeBytes)
+	if err != nil {
+		tb.Fatalf("splitting block at height %d into parts: %v", height, err)
+	}
+	blockID := types.BlockID{Hash: block.Hash(), PartSetHeader: parts.Header()}
+	commit.Height = height
+	commit.BlockID = blockID.ToProto()
+	if blockProto, err = proto.Marshal(); err != nil {
+		tb.Fatal(err)
+	}
+	if commitProto, err = commit.Marshal(); err != nil {
+		tb.Fatal(err)
+	}
+	return blockProto, commitProto
+}
+
+// syntheticStore creates an in-memory store with blocks at heights 1 to count.
+//
+// Each is the block at height 2 of the "cometbft" fixture, moved to its height, which is enough
+// for reading the blocks back, though they don't chain together as a node's would.
+func syntheticStore(tb testing.TB, count int64) *Store {
+	tb.Helper()
+	var proto cmtproto.Block
+	if err := proto.Unmarshal(readBlock(tb, openTestStore(tb, "cometbft"), 2)); err != nil {
+		tb.Fatalf("decoding the fixture block: %v", err)
+	}
+	s, err := NewStore(string(db.MemDBBackend), "", DATABASE_NAME, false)
+	if err != nil {
+		tb.Fatalf("creating an in-memory store: %v", err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	for height := int64(1); height <= count; height++ {
+		proto.Header.Height = height
+		block, err := types.BlockFromProto(&proto)
+		if err != nil {
+			tb.Fatalf("decoding block at height %d: %v", height, err)
+		}
+		parts, err := block.MakePartSet(types.BlockPartSizeBytes)
+		if err != nil {
+			tb.Fatalf("splitting block at height %d into parts: %v", height, err)
+		}
+		seen := &types.Commit{Height: height, BlockID: types.BlockID{Hash: block.Hash(), PartSetHeader: parts.Header()}}
+		s.db.SaveBlock(block, parts, seen)
+	}
+	return s
+}
+
+func TestCheckBackend(t *testing.T) {
+	for _, backend := range []string{string(db.GoLevelDBBackend), string(db.MemDBBackend)} {
+		if checked, err := checkBackend(backend); err != nil || string(checked) != backend {
+			t.Errorf("backend '%s': checked as '%s', error %v", backend, checked, err)
+		}
+	}
+
+	// A name no node uses gets the ones they do, while one this build lacks only says so.
+	if _, err := checkBackend("pebble"); err == nil || err.Error() != "unknown backend 'pebble'; supported: goleveldb, rocksdb, pebbledb" {
+		t.Errorf("backend 'pebble': error %v", err)
+	}
+	for _, backend := range nodeBackends {
+		if slices.Contains(supportedBackends, db.BackendType(backend)) {
+			continue
+		}
+		if _, err := checkBackend(backend); err == nil || err.Error() != fmt.Sprintf("backend '%s' isn't included in this build", backend) {
+			t.Errorf("backend '%s': error %v", backend, err)
+		}
+	}
+}
+
+func TestDetectBackend(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// files are those of the database directory, unless it's a plain file.
+		files []string
+		// contents are those of the files named, which are otherwise empty.
+		contents map[string]string
+		file     bool
+		backend  string
+		err      string
+	}{
+		{name: "goleveldb", files: []string{"CURRENT", "LOCK", "MANIFEST-000002", "000001.ldb"}, backend: "goleveldb"},
+		{name: "goleveldb without tables", files: []string{"CURRENT", "LOCK", "MANIFEST-000002"}, backend: "goleveldb"},
+		{name: "rocksdb", files: []string{"CURRENT", "IDENTITY", "OPTIONS-000005", "000004.sst"}, backend: "rocksdb"},
+		{name: "rocksdb options only", files: []string{"CURRENT", "OPTIONS-000005"}, backend: "rocksdb"},
+		{name: "pebble", files: []string{"CURRENT", "MARKER.format-version.000001.013", "OPTIONS-000003", "000002.sst"}, backend: "pebbledb"},
+		{name: "pebble without markers", files: []string{"CURRENT", "MANIFEST-000001", "OPTIONS-000007", "000004.sst"}, contents: map[string]string{"OPTIONS-000007": "[Version]\n  pebble_version=0.1\n"}, backend: "pebbledb"},
+		{name: "rocksdb options", files: []string{"CURRENT", "OPTIONS-000005"}, contents: map[string]string{"OPTIONS-000005": "[Version]\n  rocksdb_version=8.9.1\n"}, backend: "rocksdb"},
+		{name: "badger", files: []string{"000001.vlog", "KEYREGISTRY", "MANIFEST"}, backend: "badgerdb"},
+		{name: "badger key registry only", files: []string{"KEYREGISTRY"}, backend: "badgerdb"},
+		{name: "boltdb", file: true, backend: "boltdb"},
+		{name: "sst only", files: []string{"000004.sst"}, err: "ambiguous backend for the store in '%s'; candidates: goleveldb, rocksdb"},
+		{name: "empty", err: "unable to detect the backend of the store in '%s'"},
+		{name: "badger and leveldb", files: []string{"000001.vlog", "000001.ldb"}, err: "ambiguous backend for the store in '%s'; candidates: badgerdb, goleveldb"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, DATABASE_NAME+".db")
+			if c.file {
+				if err := os.WriteFile(path, []byte("bolt"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.Mkdir(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range c.files {
+				if err := os.WriteFile(filepath.Join(path, name), []byte(c.contents[name]), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			backend, err := DetectBackend(dir)
+			if c.err != "" {
+				if expected := fmt.Sprintf(c.err, path); err == nil || err.Error() != expected {
+					t.Errorf("detected '%s', error %v, expected error %q", backend, err, expected)
+				}
+				return
+			}
+			if err != nil || backend != c.backend {
+				t.Errorf("detected '%s', error %v, expected '%s'", backend, err, c.backend)
+			}
+		})
+	}
+
+	// The fixture nodes are the real thing.
+	if backend, err := DetectBackend(testDataDir("cometbft")); err != nil || backend != "goleveldb" {
+		t.Errorf("fixture: detected '%s', error %v", backend, err)
+	}
+	// A directory without a database in it at all fails on that.
+	if _, err := DetectBackend(t.TempDir()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing database: error %v", err)
+	}
+}
+
+func TestReadOnlyStoreRefusesWrites(t *testing.T) {
+	dir := copyTestDataDir(t, "cometbft")
+	s, err := NewStore(string(db.GoLevelDBBackend), dir, DATABASE_NAME, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	blocks := map[int64][]byte{}
+	for height := int64(1); height <= 5; height++ {
+		blocks[height] = readBlock(t, s, height)
+	}
+
+	// The block after the last, which would otherwise be saved.
+	blockProto, commitProto := encodedBlockAt(t, 6)
+	if err := s.SaveBlock(blockProto, commitProto); !errors.Is(err, errReadOnly) {
+		t.Errorf("saving a block to a read-only store: error %v", err)
+	}
+	if pruned, err := s.PruneBlocks(3); !errors.Is(err, errReadOnly) {
+		t.Errorf("pruning a read-only store: pruned %d blocks, error %v", pruned, err)
+	}
+
+	check := func(s *Store) {
+		t.Helper()
+		if first, last, ok := s.HeightRange(); !ok || first != 1 || last != 5 {
+			t.Errorf("heights %d to %d, %v, expected 1 to 5", first, last, ok)
+		}
+		for height, expected := range blocks {
+			if block := readBlock(t, s, height); !bytes.Equal(block, expected) {
+				t.Errorf("block at height %d changed", height)
+			}
+		}
+	}
+	check(s)
+	// Nothing was written behind the store's back either.
+	s.Close()
+	reopened, err := NewStore(string(db.GoLevelDBBackend), dir, DATABASE_NAME, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+func TestSnapshotIgnoresLaterWrites(t *testing.T) {
+	s, err := NewStore(string(db.GoLevelDBBackend), copyTestDataDir(t, "cometbft"), DATABASE_NAME, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	blocks := map[int64][]byte{}
+	for height := int64(1); height <= 5; height++ {
+		blocks[height] = readBlock(t, s, height)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	// The store sees its own writes, and the snapshot none of them.
+	if err := s.SaveBlock(encodedBlockAt(t, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PruneBlocks(3); err != nil {
+		t.Fatal(err)
+	}
+	if first, last, ok := s.HeightRange(); !ok || first != 3 || last != 6 {
+		t.Errorf("store: heights %d to %d, %v, expected 3 to 6", first, last, ok)
+	}
+	if first, last, ok := snap.HeightRange(); !ok || first != 1 || last != 5 {
+		t.Errorf("snapshot: heights %d to %d, %v, expected 1 to 5", first, last, ok)
+	}
+	for height, expected := range blocks {
+		if block := readBlock(t, snap, height); !bytes.Equal(block, expected) {
+			t.Errorf("snapshot: block at height %d changed", height)
+		}
+	}
+	if res, _, err := snap.BlockByHeight(6, make([]byte, 1<<20)); err != nil || res >= 0 {
+		t.Errorf("snapshot: block at height 6: result %d, error %v", res, err)
+	}
+
+	// Nothing can be written to the snapshot itself, and there's no taking one of it.
+	if err := snap.SaveBlock(encodedBlockAt(t, 6)); !errors.Is(err, errSnapshotReadOnly) {
+		t.Errorf("saving a block to a snapshot: error %v", err)
+	}
+	if _, err := snap.PruneBlocks(4); !errors.Is(err, errSnapshotReadOnly) {
+		t.Errorf("pruning a snapshot: error %v", err)
+	}
+	if _, err := snap.Snapshot(); err == nil {
+		t.Error("taking a snapshot of a snapshot should fail")
+	}
+	// Only goleveldb has snapshots.
+	if _, err := syntheticStore(t, 1).Snapshot(); !errors.Is(err, ErrSnapshotUnsupported) {
+		t.Errorf("a snapshot of an in-memory store: error %v", err)
+	}
+}
+
+func TestCursorsReadIndependently(t *testing.T) {
+	s := syntheticStore(t, 5)
+	expected := map[int64][]byte{}
+	for height := int64(1); height <= 5; height++ {
+		expected[height] = readBlock(t, s, height)
+	}
+	next := func(name string, c *Cursor, height int64) {
+		t.Helper()
+		output := make([]byte, 1<<20)
+		res, _, err := c.Next(output)
+		if err != nil || res < 0 {
+			t.Fatalf("cursor %s at height %d: result %d, error %v", name, height, res, err)
+		}
+		if !bytes.Equal(output[:res], expected[height]) {
+			t.Fatalf("cursor %s read the wrong block at height %d", name, height)
+		}
+		if c.Height() != height+1 {
+			t.Fatalf("cursor %s: at height %d after reading %d", name, c.Height(), height)
+		}
+	}
+
+	// Two cursors over overlapping heights, read in turn, don't move each other.
+	a, b := s.Cursor(1), s.Cursor(3)
+	next("a", a, 1)
+	next("b", b, 3)
+	next("a", a, 2)
+	next("a", a, 3)
+	next("b", b, 4)
+	next("a", a, 4)
+	next("b", b, 5)
+
+	// A buffer too small leaves the cursor where it is, to try again with a larger one.
+	res, size, err := a.Next(make([]byte, 8))
+	if err != nil || res != BlockTooBig || size != len(expected[5]) {
+		t.Fatalf("a small buffer: result %d, size %d, error %v", res, size, err)
+	}
+	next("a", a, 5)
+
+	// Past the last block, cursors wait for the next one to be saved, rather than moving on.
+	for _, c := range []*Cursor{a, b} {
+		if res, _, err := c.Next(make([]byte, 1<<20)); err != nil || res != BlockBeyondRange || c.Height() != 6 {
+			t.Fatalf("past the last block: result %d, at height %d, error %v", res, c.Height(), err)
+		}
+	}
+	if err := s.SaveBlock(encodedBlockAt(t, 6)); err != nil {
+		t.Fatal(err)
+	}
+	expected[6] = readBlock(t, s, 6)
+	next("a", a, 6)
+	next("b", b, 6)
+}
+
+func TestOpenExistingWithFallback(t *testing.T) {
+	dir := copyTestDataDir(t, "cometbft")
+	open := func(backend string) {
+		t.Helper()
+		s, err := OpenExistingWithFallback(backend, dir, DATABASE_NAME, true, Options{})
+		if err != nil {
+			t.Fatalf("configured as '%s': %v", backend, err)
+		}
+		defer s.Close()
+		if s.Backend() != string(db.GoLevelDBBackend) {
+			t.Errorf("configured as '%s': opened with '%s'", backend, s.Backend())
+		}
+		if first, last, ok := s.HeightRange(); !ok || first != 1 || last != 5 {
+			t.Errorf("configured as '%s': heights %d to %d, %v", backend, first, last, ok)
+		}
+	}
+	// The backend configured is used if it opens the store, and the one detected otherwise.
+	open(string(db.GoLevelDBBackend))
+	open(string(db.RocksDBBackend))
+	open("cleveldb")
+
+	// Nothing is tried for a store which isn't there.
+	if _, err := OpenExistingWithFallback(string(db.RocksDBBackend), t.TempDir(), DATABASE_NAME, true, Options{}); !errors.Is(err, ErrStoreNotFound) {
+		t.Errorf("missing store: error %v", err)
+	}
+	// Nor for a backend missing from the build, or one nothing points to, so only the failure
+	// with the configured backend is left.
+	if _, err := checkBackend(string(db.BoltDBBackend)); err != nil {
+		bolt := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bolt, DATABASE_NAME+".db"), []byte("bolt"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := OpenExistingWithFallback(string(db.GoLevelDBBackend), bolt, DATABASE_NAME, true, Options{})
+		if err == nil || strings.Contains(err.Error(), "falling back") {
+			t.Errorf("a bolt store without bolt in the build: error %v", err)
+		}
+	}
+	if _, err := checkBackend(string(db.RocksDBBackend)); err != nil {
+		rocks := t.TempDir()
+		if err := os.Mkdir(filepath.Join(rocks, DATABASE_NAME+".db"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(rocks, DATABASE_NAME+".db", "OPTIONS-000005"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := OpenExistingWithFallback(string(db.RocksDBBackend), rocks, DATABASE_NAME, true, Options{})
+		if err == nil || err.Error() != "backend 'rocksdb' isn't included in this build" {
+			t.Errorf("a rocksdb store without rocksdb in the build: error %v", err)
+		}
+		// Nothing of goleveldb's was left behind either.
+		if entries, err := os.ReadDir(filepath.Join(rocks, DATABASE_NAME+".db")); err != nil || len(entries) != 1 {
+			t.Errorf("a rocksdb store without rocksdb in the build: %d files left, error %v", len(entries), err)
+		}
+	}
+}
+
+func TestOptionsCheck(t *testing.T) {
+	for _, c := range []struct {
+		options  Options
+		backend  db.BackendType
+		readOnly bool
+		err      string
+	}{
+		{options: Options{}, backend: db.MemDBBackend},
+		{options: Options{}, backend: db.GoLevelDBBackend, readOnly: true},
+		{options: Options{BlockCacheSize: 64 << 20, DisableCompaction: true}, backend: db.GoLevelDBBackend, readOnly: true},
+		{options: Options{Compression: "none"}, backend: db.GoLevelDBBackend},
+		{options: Options{Compression: "snappy"}, backend: db.GoLevelDBBackend},
+		{options: Options{DisableCompaction: true}, backend: db.MemDBBackend, err: "backend 'memdb' cannot be tuned; only 'goleveldb' supports database options"},
+		{options: Options{BlockCacheSize: -1}, backend: db.GoLevelDBBackend, err: "the block cache size cannot be negative, but was -1"},
+		{options: Options{Compression: "zstd"}, backend: db.GoLevelDBBackend, err: "unknown compression 'zstd'; supported: none, snappy"},
+		{options: Options{Compression: "snappy"}, backend: db.GoLevelDBBackend, readOnly: true, err: "compression only applies to what's written, so it cannot be set for a store opened read-only"},
+	} {
+		err := c.options.check(c.backend, c.readOnly)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("%+v with backend '%s', read-only %v: error %v, expected %q", c.options, c.backend, c.readOnly, err, c.err)
+		}
+	}
+
+	// Stores are opened with the options, or not at all.
+	options := Options{BlockCacheSize: 1 << 20, DisableCompaction: true}
+	s, err := NewStoreWithOptions(string(db.GoLevelDBBackend), testDataDir("cometbft"), DATABASE_NAME, true, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Options() != options {
+		t.Errorf("opened with %+v, expected %+v", s.Options(), options)
+	}
+	readBlock(t, s, 5)
+	if _, err := NewStoreWithOptions(string(db.MemDBBackend), "", DATABASE_NAME, false, options); err == nil {
+		t.Error("tuning an in-memory store should fail")
+	}
+}
+
+func TestMemDBRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(string(db.MemDBBackend), dir, DATABASE_NAME, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, _, ok := s.HeightRange(); ok {
+		t.Error("a new in-memory store should have no blocks")
+	}
+	if res, _, err := s.BlockByHeight(1, make([]byte, 1<<20)); err != nil || res != BlockBeyondRange {
+		t.Errorf("block at height 1 of a new in-memory store: result %d, error %v", res, err)
+	}
+
+	saved := map[int64][]byte{}
+	for height := int64(1); height <= 3; height++ {
+		blockProto, commitProto := encodedBlockAt(t, height)
+		if err := s.SaveBlock(blockProto, commitProto); err != nil {
+			t.Fatalf("saving block at height %d: %v", height, err)
+		}
+		saved[height] = blockProto
+	}
+	if first, last, ok := s.HeightRange(); !ok || first != 1 || last != 3 {
+		t.Errorf("heights %d to %d, %v, expected 1 to 3", first, last, ok)
+	}
+	for height, expected := range saved {
+		if block := readBlock(t, s, height); !bytes.Equal(block, expected) {
+			t.Errorf("block at height %d doesn't read back as it was saved", height)
+		}
+	}
+
+	// Nothing is written to disk, nor shared with other in-memory stores.
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("%d files in the directory of an in-memory store, error %v", len(entries), err)
+	}
+	other, err := NewStore(string(db.MemDBBackend), dir, DATABASE_NAME, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, _, ok := other.HeightRange(); ok {
+		t.Error("another in-memory store should have no blocks")
+	}
+	if _, err := OpenExisting(string(db.MemDBBackend), dir, DATABASE_NAME, false, Options{}); err == nil {
+		t.Error("opening an existing in-memory store should fail")
+	}
+}
+
+func TestSaveBlock(t *testing.T) {
+	s := syntheticStore(t, 3)
+	blockProto, commitProto := encodedBlockAt(t, 4)
+	savedProto, savedCommitProto := encodedBlockAt(t, 3)
+	laterProto, laterCommitProto := encodedBlockAt(t, 5)
+	for _, c := range []struct {
+		name                    string
+		blockProto, commitProto []byte
+	}{
+		{"a block which doesn't decode", []byte("not a block"), commitProto},
+		{"a commit which doesn't decode", blockProto, []byte("not a commit")},
+		{"a commit for another height", blockProto, laterCommitProto},
+		{"a block past the next height", laterProto, laterCommitProto},
+		{"a block already saved", savedProto, savedCommitProto},
+	} {
+		if err := s.SaveBlock(c.blockProto, c.commitProto); err == nil {
+			t.Errorf("%s: saved", c.name)
+		}
+	}
+	if _, last, _ := s.HeightRange(); last != 3 {
+		t.Fatalf("blocks which failed to save moved the store to height %d", last)
+	}
+
+	// The next block is saved along with its commit, and found by its hash.
+	if err := s.SaveBlock(blockProto, commitProto); err != nil {
+		t.Fatal(err)
+	}
+	if _, last, _ := s.HeightRange(); last != 4 {
+		t.Errorf("saved block at height 4, but the store is at height %d", last)
+	}
+	if block := readBlock(t, s, 4); !bytes.Equal(block, blockProto) {
+		t.Error("block at height 4 doesn't read back as it was saved")
+	}
+	output := make([]byte, 1<<20)
+	res, _, err := s.SeenCommitByHeight(4, output)
+	if err != nil || res < 0 || !bytes.Equal(output[:res], commitProto) {
+		t.Errorf("seen commit at height 4: result %d, error %v", res, err)
+	}
+	hash, err := s.HashByHeight(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height, err := s.HeightByHash(hash); err != nil || height != 4 {
+		t.Errorf("height of the saved block, by its hash: %d, error %v", height, err)
+	}
+}
+
+func TestPruneBlocks(t *testing.T) {
+	s := syntheticStore(t, 5)
+	hash, err := s.HashByHeight(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int64][]byte{}
+	for height := int64(3); height <= 5; height++ {
+		expected[height] = readBlock(t, s, height)
+	}
+
+	pruned, err := s.PruneBlocks(3)
+	if err != nil || pruned != 2 {
+		t.Fatalf("pruning to height 3: pruned %d, error %v", pruned, err)
+	}
+	if first, last, ok := s.HeightRange(); !ok || first != 3 || last != 5 {
+		t.Errorf("heights %d to %d, %v, expected 3 to 5", first, last, ok)
+	}
+	// Everything of the blocks below the new base is gone, and the rest is as it was.
+	output := make([]byte, 1<<20)
+	for height := int64(1); height <= 2; height++ {
+		if res, _, err := s.BlockByHeight(height, output); err != nil || res != BlockBeyondRange {
+			t.Errorf("pruned block at height %d: result %d, error %v", height, res, err)
+		}
+		if res, _, err := s.SeenCommitByHeight(height, output); err != nil || res != BlockNotFound {
+			t.Errorf("seen commit of pruned block at height %d: result %d, error %v", height, res, err)
+		}
+		// Nothing is kept for evidence, which pruning would otherwise keep the header for.
+		if res, _, err := s.BlockMetaByHeight(height, output); err != nil || res >= 0 {
+			t.Errorf("meta of pruned block at height %d: result %d, error %v", height, res, err)
+		}
+	}
+	if res, _, err := s.BlockByHash(hash, output); err != nil || res >= 0 {
+		t.Errorf("pruned block, by its hash: result %d, error %v", res, err)
+	}
+	for height, block := range expected {
+		if !bytes.Equal(readBlock(t, s, height), block) {
+			t.Errorf("block at height %d changed", height)
+		}
+	}
+
+	// Pruning below the base, or past the last block, fails without removing anything.
+	for _, height := range []int64{2, 6} {
+		if pruned, err := s.PruneBlocks(height); err == nil {
+			t.Errorf("pruning to height %d: pruned %d", height, pruned)
+		}
+	}
+	if first, last, _ := s.HeightRange(); first != 3 || last != 5 {
+		t.Errorf("after failing to prune: heights %d to %d", first, last)
+	}
+}
+
+func TestConcurrentBlockByHeight(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	expected := map[int64][]byte{}
+	for height := int64(1); height <= 5; height++ {
+		expected[height] = readBlock(t, s, height)
+	}
+
+	const readers = 32
+	const rounds = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each reader walks a range overlapping those of the others, into a buffer of its own,
+			// which is sized to never fit every block, so that BlockTooBig is hit concurrently too.
+			start := int64(i%5) + 1
+			end := min(start+3, 6)
+			output := make([]byte, len(expected[start]))
+			for round := 0; round < rounds; round++ {
+				for height := start; height <= end; height++ {
+					res, size, err := s.BlockByHeight(height, output)
+					if err != nil {
+						errs <- fmt.Errorf("reader %d at height %d: %w", i, height, err)
+						return
+					}
+					want, ok := expected[height]
+					switch {
+					case !ok && res != BlockBeyondRange:
+						errs <- fmt.Errorf("reader %d at height %d: expected BlockBeyondRange, got %d", i, height, res)
+						return
+					case !ok:
+					case res == BlockTooBig:
+						if size != len(want) {
+							errs <- fmt.Errorf("reader %d at height %d: needed %d bytes, expected %d", i, height, size, len(want))
+							return
+						}
+					case !bytes.Equal(output[:max(res, 0)], want):
+						errs <- fmt.Errorf("reader %d at height %d: block differs from a serial read (result %d)", i, height, res)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMaxBlockSizeAppliesToEveryRead(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	const height = 2
+	size := len(readBlock(t, s, height))
+	hash, err := s.HashByHeight(height)
+	if err != nil || hash == nil {
+		t.Fatalf("reading the hash of block %d: %v", height, err)
+	}
+	output := make([]byte, 1<<20)
+
+	// Each read is given the block at height alone, and reports whether it exceeded the limit.
+	reads := map[string]func() (bool, error){
+		"BlockByHeight": func() (bool, error) {
+			res, needed, err := s.BlockByHeight(height, output)
+			return res == BlockExceedsLimit && needed == size, err
+		},
+		"BlockByHeightCompressed": func() (bool, error) {
+			res, needed, err := s.BlockByHeightCompressed(height, output)
+			return res == BlockExceedsLimit && needed == size, err
+		},
+		"BlockByHash": func() (bool, error) {
+			res, needed, err := s.BlockByHash(hash, output)
+			return res == BlockExceedsLimit && needed == size, err
+		},
+		"Cursor.Next": func() (bool, error) {
+			res, needed, err := s.Cursor(height).Next(output)
+			return res == BlockExceedsLimit && needed == size, err
+		},
+		"BlocksByRange": func() (bool, error) {
+			_, _, _, err := s.BlocksByRange(height, height, output)
+			return rangeExceeded(err)
+		},
+		"BlocksByHeights": func() (bool, error) {
+			_, _, err := s.BlocksByHeights([]int64{height}, output)
+			return rangeExceeded(err)
+		},
+		"StreamBlocks": func() (bool, error) {
+			_, _, err := s.StreamBlocks(height, height, func(int64, []byte) bool { return true })
+			return rangeExceeded(err)
+		},
+	}
+	for _, limit := range []struct {
+		size     int
+		exceeded bool
+	}{{size - 1, true}, {size, false}, {size + 1, false}, {0, false}} {
+		s.SetMaxBlockSize(limit.size)
+		for name, read := range reads {
+			exceeded, err := read()
+			if err != nil {
+				t.Fatalf("%s with a limit of %d for a block of %d bytes: %v", name, limit.size, size, err)
+			}
+			if exceeded != limit.exceeded {
+				t.Errorf("%s with a limit of %d for a block of %d bytes: exceeded is %v, expected %v", name, limit.size, size, exceeded, limit.exceeded)
+			}
+		}
+	}
+}
+
+// rangeExceeded tells whether a range operation stopped at a block above the maximum block size.
+func rangeExceeded(err error) (bool, error) {
+	if errors.Is(err, ErrBlockExceedsLimit) {
+		return true, nil
+	}
+	return false, err
+}
+
+// decodeEntries splits output, as packed by BlocksByRange, into its first count entries.
+func decodeEntries(tb testing.TB, output []byte, count int) [][]byte {
+	tb.Helper()
+	var entries [][]byte
+	for i := 0; i < count; i++ {
+		if len(output) < RangePrefixSize {
+			tb.Fatalf("entry %d has no room for its length", i)
+		}
+		size := int(binary.LittleEndian.Uint32(output))
+		output = output[RangePrefixSize:]
+		if len(output) < size {
+			tb.Fatalf("entry %d is %d bytes, but only %d are left", i, size, len(output))
+		}
+		entries = append(entries, output[:size])
+		output = output[size:]
+	}
+	return entries
+}
+
+func TestBlocksByRange(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	entrySize := func(heights ...int64) int {
+		size := 0
+		for _, height := range heights {
+			size += RangePrefixSize + len(readBlock(t, s, height))
+		}
+		return size
+	}
+	for _, test := range []struct {
+		name       string
+		start, end int64
+		outputSize int
+		count      int
+		next       int64
+		needed     int
+	}{
+		{"exact fit", 1, 5, entrySize(1, 2, 3, 4, 5), 5, 6, 0},
+		{"partial fit", 1, 5, entrySize(1, 2, 3) - 1, 2, 3, entrySize(3)},
+		{"first block too big", 2, 5, entrySize(2) - 1, 0, 2, entrySize(2)},
+		{"empty range", 4, 3, entrySize(4), 0, 4, 0},
+		{"empty output", 1, 5, 0, 0, 1, entrySize(1)},
+		{"past the last height", 4, 100, 1 << 20, 2, 6, 0},
+		{"beyond the store", 7, 9, 1 << 20, 0, 7, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			output := make([]byte, test.outputSize)
+			count, next, needed, err := s.BlocksByRange(test.start, test.end, output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != test.count || next != test.next || needed != test.needed {
+				t.Fatalf("expected %d blocks, up to %d, needing %d, got %d, up to %d, needing %d", test.count, test.next, test.needed, count, next, needed)
+			}
+			for i, entry := range decodeEntries(t, output, count) {
+				if height := test.start + int64(i); !bytes.Equal(entry, readBlock(t, s, height)) {
+					t.Fatalf("the entry for height %d differs from the block", height)
+				}
+			}
+		})
+	}
+}
+
+func TestBlocksByRangeStopsAtGaps(t *testing.T) {
+	s := openTestStore(t, "cometbft-gap")
+	output := make([]byte, 1<<20)
+	// A missing block needs nothing more, which tells it apart from one that doesn't fit.
+	for _, test := range []struct {
+		start int64
+		count int
+		next  int64
+	}{{1, 2, 3}, {3, 0, 3}, {4, 2, 6}} {
+		count, next, needed, err := s.BlocksByRange(test.start, 5, output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.count || next != test.next || needed != 0 {
+			t.Fatalf("from %d: expected %d blocks, up to %d, needing nothing, got %d, up to %d, needing %d", test.start, test.count, test.next, count, next, needed)
+		}
+	}
+}
+
+func TestRangeProgress(t *testing.T) {
+	s := syntheticStore(t, 6)
+	var reports [][2]int64
+	// With an interval this long, only the first block and the last height are reported.
+	s.SetRangeProgress(time.Hour, func(height, last int64) {
+		reports = append(reports, [2]int64{height, last})
+	})
+	output := make([]byte, 1<<20)
+	for _, test := range []struct {
+		name    string
+		read    func() error
+		reports [][2]int64
+	}{
+		{"range", func() error {
+			_, _, _, err := s.BlocksByRange(2, 4, output)
+			return err
+		}, [][2]int64{{2, 4}, {4, 4}}},
+		// Out of order, progress runs up to the highest height, never back down, and finishes once.
+		{"heights", func() error {
+			_, _, err := s.BlocksByHeights([]int64{5, 6, 2, 6, 3}, output)
+			return err
+		}, [][2]int64{{5, 6}, {6, 6}}},
+	} {
+		reports = nil
+		if err := test.read(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !slices.Equal(reports, test.reports) {
+			t.Errorf("%s: expected progress %v, got %v", test.name, test.reports, reports)
+		}
+	}
+}
+
+func BenchmarkBlockMetaVsBlock(b *testing.B) {
+	const heights = 10_000
+	s := syntheticStore(b, heights)
+	output := make([]byte, 1<<20)
+	for _, read := range []struct {
+		name string
+		read func(height int64, output []byte) (BlockResult, int, error)
+	}{
+		{"meta", s.BlockMetaByHeight},
+		{"block", s.BlockByHeight},
+	} {
+		b.Run(read.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var bytes int64
+			for i := 0; i < b.N; i++ {
+				height := int64(i%heights) + 1
+				res, _, err := read.read(height, output)
+				if err != nil || res < 0 {
+					b.Fatalf("reading at height %d: result %d, error %v", height, res, err)
+				}
+				bytes += int64(res)
+			}
+			b.ReportMetric(float64(bytes)/float64(b.N), "bytes/read")
+		})
+	}
+}
+
+func TestBlockByHeightFitsExactly(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	for height := int64(1); height <= 5; height++ {
+		block := readBlock(t, s, height)
+		size := len(block)
+		for _, test := range []struct {
+			name       string
+			outputSize int
+			res        BlockResult
+		}{
+			{"exact fit", size, BlockResult(size)},
+			{"a byte short", size - 1, BlockTooBig},
+			{"a byte to spare", size + 1, BlockResult(size)},
+		} {
+			output := make([]byte, test.outputSize)
+			res, needed, err := s.BlockByHeight(height, output)
+			if err != nil {
+				t.Fatalf("%s at height %d: %v", test.name, height, err)
+			}
+			if res != test.res || needed != size {
+				t.Fatalf("%s at height %d: expected result %d, needing %d, got %d, needing %d", test.name, height, test.res, size, res, needed)
+			}
+			if res < 0 {
+				continue
+			}
+			decoded := decodeBlock(t, output[:res])
+			if decoded.Header.Height != height || !bytes.Equal(output[:res], block) {
+				t.Fatalf("%s at height %d: the block differs from the one read into a large buffer", test.name, height)
+			}
+		}
+	}
+}
+
+func TestTooBigReportsTheSizeNeeded(t *testing.T) {
+	s := openTestStore(t, "cometbft")
+	for height := int64(1); height <= 5; height++ {
+		var proto cmtproto.Block
+		if err := proto.Unmarshal(readBlock(t, s, height)); err != nil {
+			t.Fatalf("decoding block at height %d: %v", height, err)
+		}
+		size := proto.Size()
+		hash, err := s.HashByHeight(height)
+		if err != nil || hash == nil {
+			t.Fatalf("reading the hash of block %d: %v", height, err)
+		}
+		reads := map[string]func(output []byte) (BlockResult, int, error){
+			"BlockByHeight": func(output []byte) (BlockResult, int, error) { return s.BlockByHeight(height, output) },
+			"BlockByHash":   func(output []byte) (BlockResult, int, error) { return s.BlockByHash(hash, output) },
+			"Cursor.Next":   func(output []byte) (BlockResult, int, error) { return s.Cursor(height).Next(output) },
+		}
+		for name, read := range reads {
+			for _, test := range []struct {
+				outputSize int
+				res        BlockResult
+			}{{size, BlockResult(size)}, {size - 1, BlockTooBig}, {0, BlockTooBig}} {
+				res, needed, err := read(make([]byte, test.outputSize))
+				if err != nil {
+					t.Fatalf("%s at height %d into %d bytes: %v", name, height, test.outputSize, err)
+				}
+				if res != test.res || needed != size {
+					t.Fatalf("%s at height %d into %d bytes: expected result %d, needing %d, got %d, needing %d", name, height, test.outputSize, test.res, size, res, needed)
+				}
+			}
+		}
+	}
+}
+
+// fixtureBlock decodes the block at a height of the "cometbft" fixture.
+func fixtureBlock(tb testing.TB, height int64) *types.Block {
+	tb.Helper()
+	block, err := types.BlockFromProto(decodeBlock(tb, readBlock(tb, openTestStore(tb, "cometbft"), height)))
+	if err != nil {
+		tb.Fatalf("decoding block at height %d: %v", height, err)
+	}
+	return block
+}
+
+// largeBlock is the block at height 2 of the fixture, with many more transactions and signatures.
+func largeBlock(tb testing.TB) *types.Block {
+	tb.Helper()
+	block := fixtureBlock(tb, 2)
+	for i := 0; i < 200; i++ {
+		block.Data.Txs = append(block.Data.Txs, bytes.Repeat([]byte{byte(i)}, 1024))
+	}
+	sig := block.LastCommit.Signatures[0]
+	for i := 0; i < 50; i++ {
+		block.LastCommit.Signatures = append(block.LastCommit.Signatures, sig)
+	}
+	return block
+}
+
+// encodeBlock encodes a block as cometbft does, without the pool.
+func encodeBlock(tb testing.TB, block *types.Block) []byte {
+	tb.Helper()
+	pb, err := block.ToProto()
+	if err != nil {
+		tb.Fatalf("encoding block: %v", err)
+	}
+	data, err := pb.Marshal()
+	if err != nil {
+		tb.Fatalf("encoding block: %v", err)
+	}
+	return data
+}
+
+func TestPooledProtoIsResetBetweenBlocks(t *testing.T) {
+	large := largeBlock(t)
+	small := fixtureBlock(t, 1)
+	noCommit := fixtureBlock(t, 3)
+	noCommit.LastCommit = nil
+
+	pb := &cmtproto.Block{LastCommit: new(cmtproto.Commit)}
+	if err := fillBlockProto(pb, large); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := pb.Marshal(); !bytes.Equal(data, encodeBlock(t, large)) {
+		t.Fatal("the large block encodes differently from the pool")
+	}
+	txs, sigs := pb.Data.Txs[:cap(pb.Data.Txs)], pb.LastCommit.Signatures[:cap(pb.LastCommit.Signatures)]
+
+	// Resetting keeps the slices to be filled again, but nothing in them.
+	putBlockProto(pb)
+	if len(pb.Data.Txs) != 0 || len(pb.LastCommit.Signatures) != 0 || pb.Header.Height != 0 {
+		t.Fatalf("a reset proto still has %d transactions, %d signatures, and height %d", len(pb.Data.Txs), len(pb.LastCommit.Signatures), pb.Header.Height)
+	}
+	for i, tx := range txs {
+		if tx != nil {
+			t.Fatalf("a reset proto still holds on to transaction %d", i)
+		}
+	}
+	for i, sig := range sigs {
+		if sig.Signature != nil || sig.ValidatorAddress != nil {
+			t.Fatalf("a reset proto still holds on to signature %d", i)
+		}
+	}
+
+	// Nothing of the large block is left for the smaller ones to pick up.
+	for _, block := range []*types.Block{small, noCommit, large, small} {
+		if err := fillBlockProto(pb, block); err != nil {
+			t.Fatal(err)
+		}
+		data, err := pb.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, encodeBlock(t, block)) {
+			t.Fatalf("the block at height %d, with %d transactions, encodes differently after a reused proto", block.Height, len(block.Data.Txs))
+		}
+		if (block.LastCommit == nil) != (pb.LastCommit == nil) {
+			t.Fatalf("the block at height %d has a last commit in one encoding only", block.Height)
+		}
+		putBlockProto(pb)
+	}
+}
+
+func TestPooledProtosConcurrently(t *testing.T) {
+	blocks := []*types.Block{largeBlock(t), fixtureBlock(t, 1), fixtureBlock(t, 4)}
+	expected := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		expected[i] = encodeBlock(t, block)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for round := 0; round < 100; round++ {
+				j := (i + round) % len(blocks)
+				pb, err := newBlockProto(blocks[j].Height, blocks[j])
+				if err != nil {
+					errs <- err
+					return
+				}
+				data, err := pb.Marshal()
+				putBlockProto(pb)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(data, expected[j]) {
+					errs <- fmt.Errorf("goroutine %d, round %d: the block at height %d encodes differently", i, round, blocks[j].Height)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkEncodeBlock(b *testing.B) {
+	for _, block := range []struct {
+		name  string
+		block *types.Block
+	}{{"small", fixtureBlock(b, 2)}, {"large", largeBlock(b)}} {
+		b.Run(block.name+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pb, err := newBlockProto(block.block.Height, block.block)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := pb.Marshal(); err != nil {
+					b.Fatal(err)
+				}
+				putBlockProto(pb)
+			}
+		})
+		b.Run(block.name+"/ToProto", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pb, err := block.block.ToProto()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := pb.Marshal(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIterate(t *testing.T) {
+	s, err := NewNamedStore("iterated", string(db.GoLevelDBBackend), testDataDir("cometbft"), DATABASE_NAME, true, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	var seen []int64
+	collect := func(height int64, block *types.Block) error {
+		if block.Height != height {
+			return fmt.Errorf("passed the block at height %d for height %d", block.Height, height)
+		}
+		seen = append(seen, height)
+		return nil
+	}
+	// The range is cut down to the last height of the store.
+	if err := s.Iterate(2, 100, collect); err != nil || fmt.Sprint(seen) != "[2 3 4 5]" {
+		t.Fatalf("iterating from 2: passed along %v, error %v", seen, err)
+	}
+
+	// An error from fn stops iterating right away, and is returned as it is, but for the name.
+	errStop := errors.New("stop")
+	seen = nil
+	err = s.Iterate(1, 5, func(height int64, block *types.Block) error {
+		if err := collect(height, block); err != nil || height == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || err.Error() != "store 'iterated': stop" || fmt.Sprint(seen) != "[1 2 3]" {
+		t.Fatalf("stopping at 3: passed along %v, error %v", seen, err)
+	}
+
+	// Cancelling stops iterating before the next block, and leaves the store usable.
+	seen = nil
+	err = s.Iterate(1, 5, func(height int64, block *types.Block) error {
+		if height == 2 {
+			s.Cancel()
+		}
+		return collect(height, block)
+	})
+	if !errors.Is(err, ErrCancelled) || fmt.Sprint(seen) != "[1 2]" {
+		t.Fatalf("cancelling at 2: passed along %v, error %v", seen, err)
+	}
+	seen = nil
+	if err := s.Iterate(4, 5, collect); err != nil || fmt.Sprint(seen) != "[4 5]" {
+		t.Fatalf("iterating after a cancellation: passed along %v, error %v", seen, err)
+	}
+
+	// A gap stops iterating with ErrMissingBlock, naming the height.
+	gap := openTestStore(t, "cometbft-gap")
+	seen = nil
+	err = gap.Iterate(1, 5, collect)
+	if !errors.Is(err, ErrMissingBlock) || err.Error() != "missing block at height 3" || fmt.Sprint(seen) != "[1 2]" {
+		t.Fatalf("iterating over a gap: passed along %v, error %v", seen, err)
+	}
+}
+
+func TestExtendedCommitByHeight(t *testing.T) {
+	// The first heights are saved as before cometbft 0.38, and the next with vote extensions.
+	s := syntheticStore(t, 3)
+	var proto cmtproto.Block
+	if err := proto.Unmarshal(readBlock(t, s, 3)); err != nil {
+		t.Fatalf("decoding block at height 3: %v", err)
+	}
+	expected := map[int64][]byte{}
+	for height := int64(4); height <= 5; height++ {
+		proto.Header.Height = height
+		block, err := types.BlockFromProto(&proto)
+		if err != nil {
+			t.Fatalf("decoding block at height %d: %v", height, err)
+		}
+		parts, err := block.MakePartSet(types.BlockPartSizeBytes)
+		if err != nil {
+			t.Fatalf("splitting block at height %d into parts: %v", height, err)
+		}
+		commit := &types.ExtendedCommit{
+			Height:  height,
+			BlockID: types.BlockID{Hash: block.Hash(), PartSetHeader: parts.Header()},
+			ExtendedSignatures: []types.ExtendedCommitSig{{
+				CommitSig: types.CommitSig{
+					BlockIDFlag:      types.BlockIDFlagCommit,
+					ValidatorAddress: make([]byte, crypto.AddressSize),
+					Timestamp:        block.Time,
+					Signature:        []byte("signature"),
+				},
+				Extension:          []byte(fmt.Sprintf("vote extension at %d", height)),
+				ExtensionSignature: []byte("extension signature"),
+			}},
+		}
+		s.db.SaveBlockWithExtendedCommit(block, parts, commit)
+		if expected[height], err = commit.ToProto().Marshal(); err != nil {
+			t.Fatalf("encoding extended commit at height %d: %v", height, err)
+		}
+	}
+
+	output := make([]byte, 1<<16)
+	for height := int64(1); height <= 6; height++ {
+		res, size, err := s.ExtendedCommitByHeight(height, output)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+		want, ok := expected[height]
+		if !ok {
+			if res != BlockNotFound {
+				t.Errorf("height %d: expected BlockNotFound, got %d", height, res)
+			}
+			continue
+		}
+		if int(res) != len(want) || size != len(want) || !bytes.Equal(output[:size], want) {
+			t.Errorf("height %d: got result %d and %d bytes, expected %d bytes of the saved commit", height, res, size, len(want))
+		}
+	}
+
+	// Like blocks, a commit which doesn't fit says how much space it needs.
+	if res, size, err := s.ExtendedCommitByHeight(4, output[:8]); err != nil || res != BlockTooBig || size != len(expected[4]) {
+		t.Errorf("height 4 into 8 bytes: result %d, size %d, error %v", res, size, err)
+	}
+}
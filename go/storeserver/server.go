@@ -0,0 +1,458 @@
+// Package storeserver serves a block store over a pair of streams, such as stdin and stdout.
+//
+// This makes the store package usable from processes which can't, or would rather not,
+// link against Go code through cgo: they run the store-server command instead, and talk
+// to it with the protocol implemented here.
+//
+// # Protocol
+//
+// Requests and responses are frames: a 4 byte little-endian length, followed by that many bytes.
+// Each request is answered by exactly one response, in order.
+//
+// A request starts with a byte naming the operation, followed by its arguments.
+// Heights are 8 byte little-endian signed integers, and strings and byte arrays are
+// a 4 byte little-endian length, followed by their contents.
+//
+// A response starts with a status byte, followed by a body, which is the result of
+// the operation for StatusOK, and an error message for StatusError and StatusStoreNotFound.
+//
+// A server holds at most one store, opened with OpOpen, and closes it once its input ends.
+// OpDetectBackend, OpBlockHash and OpVerifyBlockHashes don't need a store.
+package storeserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/penumbra-zone/reindexer/go/store"
+)
+
+// Operations a request can ask for.
+const (
+	// OpOpen takes a flags byte, then the backend, directory and database name, as strings,
+	// then the block cache size, like a height, and the compression, as a string, of store.Options.
+	OpOpen byte = 1
+	// OpHeightRange returns the first and last heights of the store.
+	OpHeightRange byte = 2
+	// OpBlockByHeight takes a height, and returns the encoded block at that height.
+	OpBlockByHeight byte = 3
+	// OpGenesisDoc returns the genesis saved next to the store.
+	OpGenesisDoc byte = 4
+	// OpGaps returns the gaps in the store, laid out like Store.WriteGaps does.
+	OpGaps byte = 5
+	// OpSaveBlock takes an encoded block, and the encoded commit for it, as byte arrays.
+	OpSaveBlock byte = 6
+	// OpValidate checks the store with Store.Validate.
+	OpValidate byte = 7
+	// OpDetectBackend takes a directory, as a string, and returns the backend detected there.
+	OpDetectBackend byte = 8
+	// OpBlockHash takes an encoded block, as a byte array, and returns its hash.
+	OpBlockHash byte = 9
+	// OpAppHeight returns the height of the last block applied to the application, if recorded.
+	OpAppHeight byte = 10
+	// OpSetMaxBlockSize takes a size, like a height, bounding the blocks OpBlockByHeight returns.
+	OpSetMaxBlockSize byte = 11
+	// OpExtendedCommitByHeight takes a height, and returns the encoded extended commit for it.
+	OpExtendedCommitByHeight byte = 12
+	// OpBackend returns the type of the backend the store was opened with.
+	OpBackend byte = 13
+	// OpChainID returns the chain id in the header of the first block of the store.
+	OpChainID byte = 14
+	// OpEvidenceByHeight takes a height, and returns the encoded evidence committed in the block there.
+	OpEvidenceByHeight byte = 15
+	// OpHashByHeight takes a height, and returns the hash of the block at that height, as its ID.
+	OpHashByHeight byte = 16
+	// OpVerifyBlockHashes takes an encoded block, and its ID, which may be empty, as byte arrays,
+	// and checks them with store.VerifyBlockHashes.
+	OpVerifyBlockHashes byte = 17
+	// OpSizeStats returns the sizes of the blocks in the store, laid out like Store.WriteSizeStats does.
+	OpSizeStats byte = 18
+	// OpBlockByHeightCompressed takes a height, and returns the block at that height,
+	// as compressed by Store.BlockByHeightCompressed.
+	OpBlockByHeightCompressed byte = 19
+	// OpSeenCommitByHeight takes a height, and returns the encoded commit seen locally for it.
+	OpSeenCommitByHeight byte = 20
+)
+
+// Flags for OpOpen.
+const (
+	// FlagReadOnly opens the store without write access.
+	FlagReadOnly byte = 1 << 0
+	// FlagCreate creates the store if it doesn't exist, like NewStore, rather than failing.
+	FlagCreate byte = 1 << 1
+	// FlagDisableCompaction sets DisableCompaction in the store.Options the store is opened with.
+	FlagDisableCompaction byte = 1 << 2
+	// FlagBackendFallback tries the other backends detected, if the store fails to open with the one
+	// given, like store.OpenExistingWithFallback. This has no effect along with FlagCreate.
+	FlagBackendFallback byte = 1 << 3
+)
+
+// Statuses a response can have.
+const (
+	StatusOK byte = 0
+	// StatusNotFound means that there's no such block, genesis, or state, and has no body.
+	StatusNotFound byte = 1
+	StatusError    byte = 2
+	// StatusStoreNotFound means that OpOpen found no store to open.
+	StatusStoreNotFound byte = 3
+	// StatusExceedsLimit means that a block is over the maximum block size,
+	// and has the size of the block as its body, like a height.
+	StatusExceedsLimit byte = 4
+	// StatusBeyondRange means that there's no block at a height because it's outside of the
+	// heights of the store, rather than in a gap between them, which is StatusNotFound.
+	// Like that, it has no body.
+	StatusBeyondRange byte = 5
+)
+
+// MaxFrameSize bounds the size of a request, so that a garbled length can't exhaust memory.
+const MaxFrameSize = 1 << 30
+
+var errNoStore = errors.New("no store is open")
+
+// server holds the state of a connection.
+type server struct {
+	store *store.Store
+	// buf is reused to read blocks into, growing as needed.
+	buf []byte
+}
+
+// Serve answers requests read from r, writing responses to w, until r ends.
+//
+// Failed operations are reported in their response. Only failing to read a request,
+// or to write a response, ends serving with an error.
+func Serve(r io.Reader, w io.Writer) error {
+	in := bufio.NewReader(r)
+	out := bufio.NewWriter(w)
+	s := &server{}
+	defer s.close()
+	for {
+		request, err := readFrame(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		status, body := s.handle(request)
+		if err := writeFrame(out, status, body); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) close() {
+	if s.store != nil {
+		s.store.Close()
+		s.store = nil
+	}
+}
+
+// handle runs a single request, turning its outcome into a status and a body.
+func (s *server) handle(request []byte) (status byte, body []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			status, body = StatusError, []byte(fmt.Sprintf("panic: %v", r))
+		}
+	}()
+	args := &reader{data: request}
+	op := args.readByte()
+	var err error
+	switch op {
+	case OpOpen:
+		status, err = s.open(args)
+	case OpHeightRange:
+		status, body, err = s.heightRange(args)
+	case OpAppHeight:
+		status, body, err = s.appHeight(args)
+	case OpBlockByHeight:
+		height := args.readInt64()
+		status, body, err = s.readStore(args, func(st *store.Store, out []byte) (store.BlockResult, int, error) {
+			return st.BlockByHeight(height, out)
+		})
+	case OpBlockByHeightCompressed:
+		height := args.readInt64()
+		status, body, err = s.readStore(args, func(st *store.Store, out []byte) (store.BlockResult, int, error) {
+			return st.BlockByHeightCompressed(height, out)
+		})
+	case OpSeenCommitByHeight:
+		height := args.readInt64()
+		status, body, err = s.readStore(args, func(st *store.Store, out []byte) (store.BlockResult, int, error) {
+			return st.SeenCommitByHeight(height, out)
+		})
+	case OpExtendedCommitByHeight:
+		height := args.readInt64()
+		status, body, err = s.readStore(args, func(st *store.Store, out []byte) (store.BlockResult, int, error) {
+			return st.ExtendedCommitByHeight(height, out)
+		})
+	case OpEvidenceByHeight:
+		height := args.readInt64()
+		status, body, err = s.readStore(args, func(st *store.Store, out []byte) (store.BlockResult, int, error) {
+			return st.EvidenceByHeight(height, out)
+		})
+	case OpSetMaxBlockSize:
+		size := args.readInt64()
+		status, err = s.withStore(args, func(st *store.Store) error {
+			st.SetMaxBlockSize(int(size))
+			return nil
+		})
+	case OpBackend:
+		status, err = s.withStore(args, func(st *store.Store) error {
+			body = []byte(st.Backend())
+			return nil
+		})
+	case OpChainID:
+		status, err = s.withStore(args, func(st *store.Store) error {
+			chainID, err := st.ChainID()
+			body = []byte(chainID)
+			return err
+		})
+	case OpHashByHeight:
+		height := args.readInt64()
+		status, err = s.withStore(args, func(st *store.Store) error {
+			hash, err := st.HashByHeight(height)
+			body = hash
+			return err
+		})
+		if err == nil && body == nil {
+			status = StatusNotFound
+		}
+	case OpGenesisDoc:
+		status, body, err = s.readStore(args, (*store.Store).GenesisDoc)
+	case OpGaps:
+		status, body, err = s.readStore(args, (*store.Store).WriteGaps)
+	case OpSizeStats:
+		status, body, err = s.readStore(args, (*store.Store).WriteSizeStats)
+	case OpSaveBlock:
+		block, commit := args.readBytes(), args.readBytes()
+		status, err = s.withStore(args, func(st *store.Store) error {
+			return st.SaveBlock(block, commit)
+		})
+	case OpValidate:
+		status, err = s.withStore(args, (*store.Store).Validate)
+	case OpDetectBackend:
+		dir := args.readString()
+		if err = args.finish(); err == nil {
+			var backend string
+			backend, err = store.DetectBackend(dir)
+			status, body = StatusOK, []byte(backend)
+		}
+	case OpBlockHash:
+		block := args.readBytes()
+		if err = args.finish(); err == nil {
+			status = StatusOK
+			body, err = store.BlockHash(block)
+		}
+	case OpVerifyBlockHashes:
+		block, blockID := args.readBytes(), args.readBytes()
+		if err = args.finish(); err == nil {
+			status = StatusOK
+			err = store.VerifyBlockHashes(block, blockID)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %d", op)
+	}
+	if errors.Is(err, store.ErrStoreNotFound) {
+		return StatusStoreNotFound, []byte(err.Error())
+	}
+	if err != nil {
+		return StatusError, []byte(err.Error())
+	}
+	return status, body
+}
+
+func (s *server) open(args *reader) (byte, error) {
+	flags := args.readByte()
+	backend, dir, dbName := args.readString(), args.readString(), args.readString()
+	options := store.Options{
+		BlockCacheSize:    int(args.readInt64()),
+		DisableCompaction: flags&FlagDisableCompaction != 0,
+		Compression:       args.readString(),
+	}
+	if err := args.finish(); err != nil {
+		return 0, err
+	}
+	if s.store != nil {
+		return 0, errors.New("a store is already open")
+	}
+	readOnly := flags&FlagReadOnly != 0
+	var opened *store.Store
+	var err error
+	if flags&FlagCreate != 0 {
+		opened, err = store.NewStoreWithOptions(backend, dir, dbName, readOnly, options)
+	} else if flags&FlagBackendFallback != 0 {
+		opened, err = store.OpenExistingWithFallback(backend, dir, dbName, readOnly, options)
+	} else {
+		opened, err = store.OpenExisting(backend, dir, dbName, readOnly, options)
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.store = opened
+	return StatusOK, nil
+}
+
+func (s *server) heightRange(args *reader) (byte, []byte, error) {
+	if err := args.finish(); err != nil {
+		return 0, nil, err
+	}
+	if s.store == nil {
+		return 0, nil, errNoStore
+	}
+	// An empty store is sent as heights of 0, which no block is ever at.
+	first, last, _ := s.store.HeightRange()
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint64(body, uint64(first))
+	binary.LittleEndian.PutUint64(body[8:], uint64(last))
+	return StatusOK, body, nil
+}
+
+func (s *server) appHeight(args *reader) (byte, []byte, error) {
+	if err := args.finish(); err != nil {
+		return 0, nil, err
+	}
+	if s.store == nil {
+		return 0, nil, errNoStore
+	}
+	height, found, err := s.store.AppHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+	if !found {
+		return StatusNotFound, nil, nil
+	}
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, uint64(height))
+	return StatusOK, body, nil
+}
+
+// withStore runs an operation on the open store, once the arguments are all read.
+func (s *server) withStore(args *reader, op func(*store.Store) error) (byte, error) {
+	if err := args.finish(); err != nil {
+		return 0, err
+	}
+	if s.store == nil {
+		return 0, errNoStore
+	}
+	if err := op(s.store); err != nil {
+		return 0, err
+	}
+	return StatusOK, nil
+}
+
+// readStore runs a read following the BlockResult convention, growing the buffer until it fits.
+func (s *server) readStore(args *reader, read func(*store.Store, []byte) (store.BlockResult, int, error)) (byte, []byte, error) {
+	if err := args.finish(); err != nil {
+		return 0, nil, err
+	}
+	if s.store == nil {
+		return 0, nil, errNoStore
+	}
+	for {
+		res, size, err := read(s.store, s.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case res == store.BlockNotFound:
+			return StatusNotFound, nil, nil
+		case res == store.BlockBeyondRange:
+			return StatusBeyondRange, nil, nil
+		case res == store.BlockExceedsLimit:
+			body := make([]byte, 8)
+			binary.LittleEndian.PutUint64(body, uint64(size))
+			return StatusExceedsLimit, body, nil
+		case res == store.BlockTooBig:
+			s.buf = make([]byte, size)
+		case res < 0:
+			return 0, nil, fmt.Errorf("unexpected result code %d from store", res)
+		default:
+			return StatusOK, s.buf[:size], nil
+		}
+	}
+}
+
+// reader parses the arguments of a request, remembering the first error.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("request is too short for its arguments")
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+func (r *reader) readByte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) readInt64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *reader) readBytes() []byte {
+	size := r.take(4)
+	if size == nil {
+		return nil
+	}
+	return r.take(int(binary.LittleEndian.Uint32(size)))
+}
+
+func (r *reader) readString() string {
+	return string(r.readBytes())
+}
+
+// finish returns the first error parsing the arguments, or an error if any are left over.
+func (r *reader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("request has %d bytes past its arguments", len(r.data))
+	}
+	return r.err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("request of %d bytes is too large", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, status byte, body []byte) error {
+	var header [5]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(1+len(body)))
+	header[4] = status
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
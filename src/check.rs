@@ -8,6 +8,9 @@ use sqlx::PgPool;
 use sqlx::{Error, FromRow, Row};
 use std::path::Path;
 
+use crate::error::{ErrorKind, Failure};
+use crate::penumbra::RegenerationPlan;
+
 // Allowing dead_code because no logic explicitly reads from the `gap_start` and `gap_end` fields;
 // these are used via debug-printing, but debug derivations don't count as live code.
 #[allow(dead_code)]
@@ -163,3 +166,46 @@ pub async fn check_num_blocks_postgres(pg_db_url: String, expected: u64) -> anyh
     }
     Ok(count)
 }
+
+/// Check that the blocks of an archive start where the history of its chain does.
+///
+/// A full regeneration runs every block from the genesis the plan for the chain starts with,
+/// so an archive starting anywhere else can only regenerate part of the chain. Chains without
+/// a known plan have nothing to check against, so pass.
+pub fn check_starts_at_genesis(chain_id: &str, first_height: u64) -> anyhow::Result<()> {
+    let Some(genesis_height) =
+        RegenerationPlan::from_known_chain_id(chain_id).and_then(|x| x.genesis_height())
+    else {
+        return Ok(());
+    };
+    if first_height != genesis_height {
+        anyhow::bail!(Failure::new(
+            ErrorKind::BoundaryNotFound,
+            format!(
+                "the archive for '{}' starts at height {}, but the chain starts at genesis height {}, so it can't be regenerated in full; pass --allow-partial if the archive is meant to be partial",
+                chain_id, first_height, genesis_height
+            )
+        ));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn test_archive_must_start_at_genesis() {
+        assert!(check_starts_at_genesis("penumbra-1", 1).is_ok());
+        let err = check_starts_at_genesis("penumbra-1", 501975)
+            .expect_err("an archive starting mid-history isn't complete");
+        assert_eq!(crate::error::exit_code(&err), 7);
+        assert!(
+            err.to_string().contains("starts at height 501975"),
+            "{:#}",
+            err
+        );
+        // Nothing is known about where other chains start.
+        assert!(check_starts_at_genesis("penumbra-local-devnet", 100).is_ok());
+    }
+}
@@ -1,128 +1,298 @@
 //! This module contains utilities for reading cometbft data.
 //!
-//! This contains the actual FFI shim and what not.
+//! The block store itself is read by Go code, either linked in through cgo, or,
+//! with the `subprocess-store` feature, running as a separate process.
 use anyhow::{anyhow, Context};
 use async_stream::try_stream;
 use async_trait::async_trait;
 use futures_core::Stream;
 use serde_json::Value;
 use std::{
-    os::raw::c_void,
     path::{Path, PathBuf},
     pin::Pin,
     sync::Arc,
 };
-use tendermint_proto::{v0_37::types::Block as ProtoBlock, Protobuf};
-use tendermint_v0o40::{Block as TendermintBlock, Genesis as TendermintGenesis};
+use tendermint_proto::{
+    v0_37::types::{Block as ProtoBlock, Commit as ProtoCommit},
+    Protobuf,
+};
+use tendermint_v0o40::{
+    block::Commit as TendermintCommit, Block as TendermintBlock, Genesis as TendermintGenesis,
+};
 use tokio::sync::Mutex;
 
-#[link(name = "cometbft", kind = "static")]
-extern "C" {
-    fn c_store_new(
-        dir_ptr: *const u8,
-        dir_len: i32,
-        backend_ptr: *const u8,
-        backend_len: i32,
-    ) -> *const c_void;
-    fn c_store_first_height(ptr: *const c_void) -> i64;
-    fn c_store_last_height(ptr: *const c_void) -> i64;
-    fn c_store_block_by_height(
-        ptr: *const c_void,
-        height: i64,
-        out_ptr: *mut u8,
-        out_cap: i32,
-    ) -> i32;
-    fn c_store_delete(ptr: *const c_void);
-}
+#[cfg(not(feature = "subprocess-store"))]
+use cgo::{block_hash, detect_backend, verify_block_hashes, RawStore};
+#[cfg(feature = "subprocess-store")]
+use subprocess::{block_hash, detect_backend, verify_block_hashes, RawStore};
 
 /// How many bytes we expect an encoded block to be.
 ///
 /// About 1 MiB seems fine, maybe a bit small in extreme cases.
 const EXPECTED_BLOCK_PROTO_SIZE: usize = 1 << 20;
 
-/// A wrapper around the FFI for the cometbft store.
+/// How many heights a local store reads from the Go side at once, when asked for a range of blocks.
+///
+/// This bounds how many encoded blocks are held at a time, before they're decoded.
+const RANGE_CHUNK_SIZE: u64 = 64;
+
+/// The name cometbft gives the database of its block store, mirroring `DATABASE_NAME` in go/store/store.go.
+pub const DEFAULT_BLOCKSTORE_NAME: &str = "blockstore";
+
+/// The backend keeping a store entirely in memory, for tests and ephemeral runs.
 ///
-/// This uses unsafe internally, but presents a safe interface.
-struct RawStore {
-    handle: *const c_void,
-    buf: Vec<u8>,
-}
-
-impl RawStore {
-    pub fn new(backend: &str, dir: &Path) -> anyhow::Result<Self> {
-        let dir_bytes = dir.as_os_str().as_encoded_bytes();
-        let handle = unsafe {
-            // Safety: the Go side of things will immediately copy the data, and not write into it,
-            // or read past the provided bounds.
-            c_store_new(
-                dir_bytes.as_ptr(),
-                i32::try_from(dir_bytes.len())
-                    .context("directory length should fit into an i32")?,
-                backend.as_ptr(),
-                i32::try_from(backend.len()).context("backend type should fit into an i32")?,
+/// Such a store can only be created, never opened, since nothing of it outlives the process.
+#[allow(dead_code)]
+pub const MEMORY_BACKEND: &str = "memdb";
+
+/// The size of a block hash, mirroring `HashSize` in go/store/store.go.
+const BLOCK_HASH_SIZE: usize = 32;
+
+/// The magic number starting a zstd frame, which an encoded block never starts with.
+///
+/// This tells compressed blocks read from the Go side from those it wrote as they are,
+/// because compressing them would not have made them smaller.
+const ZSTD_MAGIC: [u8; 4] = [0x28, 0xb5, 0x2f, 0xfd];
+
+/// Decompress a block as written by `Store.BlockByHeightCompressed` in go/store/store.go.
+fn decompress_block(data: &[u8]) -> anyhow::Result<Vec<u8>> {
+    if !data.starts_with(&ZSTD_MAGIC) {
+        return Ok(data.to_vec());
+    }
+    zstd::stream::decode_all(data).context("failed to decompress block")
+}
+
+/// The size of each gap reported by the Go side, mirroring `GapSize` in go/store/store.go.
+const GAP_SIZE: usize = 16;
+
+/// The error for reading a block larger than the maximum block size of a store.
+fn block_exceeds_limit(size: i64, limit: u64) -> anyhow::Error {
+    anyhow!(
+        "block is {} bytes, more than the maximum block size of {} bytes",
+        size,
+        limit
+    )
+}
+
+/// Decode the gaps the Go side wrote, as pairs of inclusive heights.
+fn decode_gaps(data: &[u8]) -> Vec<(i64, i64)> {
+    data.chunks_exact(GAP_SIZE)
+        .map(|chunk| {
+            let (from, to) = chunk.split_at(GAP_SIZE / 2);
+            (
+                i64::from_le_bytes(from.try_into().expect("gap should have two heights")),
+                i64::from_le_bytes(to.try_into().expect("gap should have two heights")),
             )
-        };
-        Ok(Self {
-            handle,
-            buf: Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE),
         })
+        .collect()
+}
+
+/// The sizes of the blocks in a store, as the Go side sums them up from their metadata.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct BlockSizeStats {
+    /// The size of every block together.
+    pub total_bytes: u64,
+    pub max_block_bytes: u64,
+    /// How many blocks there are of each size, where those at index i are at least 2^i bytes,
+    /// but less than 2^(i+1). There are no buckets past the one holding the largest block.
+    pub buckets: Vec<u64>,
+}
+
+impl BlockSizeStats {
+    pub fn block_count(&self) -> u64 {
+        self.buckets.iter().sum()
     }
 
-    pub fn first_height(&mut self) -> i64 {
-        unsafe {
-            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
-            c_store_first_height(self.handle)
-        }
+    /// The buckets from the one holding the smallest block, with the sizes each starts and
+    /// stops at, exclusive, and how many blocks are in it.
+    pub fn histogram(&self) -> Vec<(u64, u64, u64)> {
+        let first = self.buckets.iter().take_while(|x| **x == 0).count();
+        self.buckets
+            .iter()
+            .enumerate()
+            .skip(first)
+            .map(|(i, count)| (1 << i, 1 << (i + 1), *count))
+            .collect()
     }
+}
 
-    pub fn last_height(&mut self) -> i64 {
-        unsafe {
-            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
-            c_store_last_height(self.handle)
-        }
+/// Decode the size stats the Go side wrote, laid out like `WriteSizeStats` in go/store/store.go.
+fn decode_size_stats(data: &[u8]) -> anyhow::Result<BlockSizeStats> {
+    if data.len() < 16 || data.len() % 8 != 0 {
+        anyhow::bail!("size stats should be 8 byte numbers, at least two of them");
     }
+    let mut numbers = data
+        .chunks_exact(8)
+        .map(|x| u64::from_le_bytes(x.try_into().expect("chunks should be 8 bytes")));
+    Ok(BlockSizeStats {
+        total_bytes: numbers.next().unwrap_or_default(),
+        max_block_bytes: numbers.next().unwrap_or_default(),
+        buckets: numbers.collect(),
+    })
+}
 
-    pub fn block_by_height(&mut self, height: i64) -> Option<&[u8]> {
-        // Try reading the block, growing our buffer as necessary
-        let mut res;
-        while {
-            res = unsafe {
-                // Safety: the Go side will not write past the capacity we give it here,
-                // and we've allocated the appropriate amount of capacity on the rust side.
-                let out_ptr = self.buf.as_mut_ptr();
-                let out_cap = i32::try_from(self.buf.capacity())
-                    .expect("capacity should not have exceeded i32");
-                c_store_block_by_height(self.handle, height, out_ptr, out_cap)
-            };
-            if res == -1 {
-                return None;
-            }
-            res < 0
-        } {
-            // Increase the buffer by another block size's worth.
-            self.buf.reserve(EXPECTED_BLOCK_PROTO_SIZE);
-        }
-        unsafe {
-            // Safety: res will be positive here, and be the length that Go
-            // actually wrote bytes into on the other side.
-            self.buf.set_len(res as usize);
-        }
-        Some(self.buf.as_slice())
+/// The size of everything in a directory on disk, added up.
+fn dir_bytes(dir: &Path) -> anyhow::Result<u64> {
+    let mut total = 0;
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        let metadata = entry.metadata()?;
+        total += if metadata.is_dir() {
+            dir_bytes(&entry.path())?
+        } else {
+            metadata.len()
+        };
     }
+    Ok(total)
 }
 
-impl Drop for RawStore {
-    fn drop(&mut self) {
-        unsafe {
-            // Safety: the existence of this method ensures we don't leak memory,
-            // and the &mut avoids other shenanigans.
-            c_store_delete(self.handle);
-        }
+/// Find the cometbft home directory in the home directory of a node.
+///
+/// This is either the `cometbft` directory inside of it, which is how `pd` lays out a node,
+/// or the directory itself, if it's laid out like a cometbft home, with `config`, or `data`.
+pub fn find_cometbft_dir(node_home: &Path) -> anyhow::Result<PathBuf> {
+    let looks_like_cometbft = |dir: &Path| dir.join("config").is_dir() || dir.join("data").is_dir();
+    let nested = node_home.join("cometbft");
+    if looks_like_cometbft(&nested) {
+        return Ok(nested);
     }
+    if looks_like_cometbft(node_home) {
+        return Ok(node_home.to_owned());
+    }
+    anyhow::bail!(
+        "no cometbft data found in '{}'; expected either a ./cometbft/ directory, or ./config/ and ./data/ directories",
+        node_home.display()
+    )
+}
+
+/// Lay out a node home with a cometbft directory holding the test blocks and genesis.
+///
+/// There's no config file, so only the standard cometbft layout says where things are.
+/// If `nested`, the cometbft directory is in `./cometbft`, like `pd` does it.
+#[cfg(test)]
+pub fn test_node_home(name: &str, nested: bool) -> anyhow::Result<PathBuf> {
+    let home = std::env::temp_dir().join(format!(
+        "penumbra-reindexer-test-{}-{}",
+        name,
+        std::process::id()
+    ));
+    if home.exists() {
+        std::fs::remove_dir_all(&home)?;
+    }
+    let test_data = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data");
+    let cometbft_dir = if nested {
+        home.join("cometbft")
+    } else {
+        home.clone()
+    };
+    std::fs::create_dir_all(cometbft_dir.join("config"))?;
+    std::fs::copy(
+        test_data.join("genesis.json"),
+        cometbft_dir.join("config/genesis.json"),
+    )?;
+    let blockstore = cometbft_dir.join("data/blockstore.db");
+    std::fs::create_dir_all(&blockstore)?;
+    for entry in std::fs::read_dir(test_data.join("cometbft/data/blockstore.db"))? {
+        let entry = entry?;
+        std::fs::copy(entry.path(), blockstore.join(entry.file_name()))?;
+    }
+    Ok(home)
+}
+
+/// Read the chain id from the genesis file of a cometbft home directory.
+pub fn read_chain_id(cometbft_dir: &Path) -> anyhow::Result<String> {
+    let config = Config::read_dir(cometbft_dir)?;
+    Ok(Genesis::read_cometbft_dir(cometbft_dir, &config)?.chain_id())
+}
+
+/// Read the chain id from the headers of the blocks in the block store of a cometbft home directory.
+///
+/// Unlike [read_chain_id], this doesn't need a genesis file, but the store needs to have blocks.
+pub fn read_block_store_chain_id(
+    cometbft_dir: &Path,
+    opts: &LocalStoreOpts,
+) -> anyhow::Result<String> {
+    let config = Config::read_dir(cometbft_dir)?;
+    FileStore::new(cometbft_dir, &config, opts)?.chain_id()
+}
+
+/// What the block store of a cometbft home directory holds, and how much room it takes.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct BlockStoreSizes {
+    /// The heights of the first and last blocks, if there are any.
+    pub heights: Option<(u64, u64)>,
+    pub blocks: BlockSizeStats,
+    /// The size of the database holding the blocks on disk, if it's on disk at all.
+    pub disk_bytes: Option<u64>,
+}
+
+/// Sum up the sizes of the blocks in the block store of a cometbft home directory.
+///
+/// Like [read_block_store_chain_id], this doesn't need a genesis file, and it only reads the
+/// metadata of each block. Most backends keep a directory on disk, but boltdb keeps a single
+/// file, and memdb keeps nothing.
+pub fn read_block_store_sizes(
+    cometbft_dir: &Path,
+    opts: &LocalStoreOpts,
+) -> anyhow::Result<BlockStoreSizes> {
+    let config = Config::read_dir(cometbft_dir)?;
+    let mut store = FileStore::new(cometbft_dir, &config, opts)?;
+    let db_path = cometbft_dir.join(&config.db_dir).join(format!(
+        "{}.db",
+        opts.db_name.as_deref().unwrap_or(DEFAULT_BLOCKSTORE_NAME)
+    ));
+    let disk_bytes = match std::fs::metadata(&db_path) {
+        Ok(x) if x.is_dir() => Some(
+            dir_bytes(&db_path)
+                .with_context(|| format!("failed to read the size of '{}'", db_path.display()))?,
+        ),
+        Ok(x) => Some(x.len()),
+        Err(_) => None,
+    };
+    Ok(BlockStoreSizes {
+        heights: store.height_bounds()?,
+        blocks: store.size_stats()?,
+        disk_bytes,
+    })
 }
 
-// Safety: a [RawStore] will always contain a unique handle to the Go object.
-unsafe impl Send for RawStore {}
+/// A block store opened only to read the encoding of its blocks, as for measuring how fast it reads.
+///
+/// Like [read_block_store_sizes], this doesn't need a genesis file, so any store can be read.
+pub struct EncodedBlockReader(FileStore);
+
+impl EncodedBlockReader {
+    pub fn open(cometbft_dir: &Path, opts: &LocalStoreOpts) -> anyhow::Result<Self> {
+        let config = Config::read_dir(cometbft_dir)?;
+        Ok(Self(FileStore::new(cometbft_dir, &config, opts)?))
+    }
+
+    /// The name of the database backend the store is kept in.
+    pub fn backend(&mut self) -> anyhow::Result<String> {
+        self.0.raw.backend()
+    }
+
+    pub fn height_bounds(&mut self) -> anyhow::Result<Option<(u64, u64)>> {
+        self.0.height_bounds()
+    }
+
+    /// Read the encoding of the block at a height, if the store has one.
+    pub fn encoded_block(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        self.0.encoded_block_by_height(height)
+    }
+
+    /// Read the block at a height as the Go side compressed it, if the store has one.
+    ///
+    /// This is as much as crosses over from the Go side, which [Self::decompress] undoes.
+    pub fn compressed_block(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        self.0.compressed_block_by_height(height)
+    }
+
+    /// Decompress a block read with [Self::compressed_block] back into its encoding.
+    pub fn decompress(data: &[u8]) -> anyhow::Result<Vec<u8>> {
+        decompress_block(data)
+    }
+}
 
 #[derive(Clone, Debug, PartialEq)]
 pub struct Block {
@@ -142,12 +312,111 @@ impl Block {
         self.height
     }
 
+    /// Get the number of transactions in this block.
+    pub fn num_txs(&self) -> usize {
+        self.inner.data.len()
+    }
+
+    /// Get the identifier of the chain this block belongs to.
+    pub fn chain_id(&self) -> String {
+        self.inner.header.chain_id.to_string()
+    }
+
+    /// Get the time in the header of this block, in nanoseconds since the unix epoch.
+    ///
+    /// This fails for times too far from the epoch for that to fit into an i64,
+    /// roughly before 1678, or after 2261.
+    pub fn time(&self) -> anyhow::Result<i64> {
+        i64::try_from(self.inner.header.time.unix_timestamp_nanos()).context(format!(
+            "the time of the block at height {} is out of range",
+            self.height
+        ))
+    }
+
+    /// Compute the hash of this block, which is how commits refer to it.
+    pub fn hash(&self) -> anyhow::Result<[u8; BLOCK_HASH_SIZE]> {
+        block_hash(&self.encode())
+            .context(format!("failed to hash block at height {}", self.height))
+    }
+
+    /// Check that this block hashes to what it claims to, failing with the hash that doesn't.
+    ///
+    /// The hashes of the transactions, evidence and last commit must match those in the header,
+    /// and, if given, the hash of the header must match the ID the block is stored under.
+    pub fn verify_hashes(&self, block_id: Option<&[u8]>) -> anyhow::Result<()> {
+        verify_block_hashes(&self.encode(), block_id)
+            .context(format!("block at height {} is corrupt", self.height))
+    }
+
+    /// List the parts of this block which differ from another block, by name.
+    ///
+    /// The fields of the header are listed individually, as `header.<field>`.
+    pub fn differing_fields(&self, other: &Self) -> Vec<&'static str> {
+        let (a, b) = (&self.inner, &other.inner);
+        let (x, y) = (&a.header, &b.header);
+        [
+            ("header.version", x.version == y.version),
+            ("header.chain_id", x.chain_id == y.chain_id),
+            ("header.height", x.height == y.height),
+            ("header.time", x.time == y.time),
+            ("header.last_block_id", x.last_block_id == y.last_block_id),
+            (
+                "header.last_commit_hash",
+                x.last_commit_hash == y.last_commit_hash,
+            ),
+            ("header.data_hash", x.data_hash == y.data_hash),
+            (
+                "header.validators_hash",
+                x.validators_hash == y.validators_hash,
+            ),
+            (
+                "header.next_validators_hash",
+                x.next_validators_hash == y.next_validators_hash,
+            ),
+            (
+                "header.consensus_hash",
+                x.consensus_hash == y.consensus_hash,
+            ),
+            ("header.app_hash", x.app_hash == y.app_hash),
+            (
+                "header.last_results_hash",
+                x.last_results_hash == y.last_results_hash,
+            ),
+            ("header.evidence_hash", x.evidence_hash == y.evidence_hash),
+            (
+                "header.proposer_address",
+                x.proposer_address == y.proposer_address,
+            ),
+            ("data", a.data == b.data),
+            ("evidence", a.evidence == b.evidence),
+            ("last_commit", a.last_commit == b.last_commit),
+        ]
+        .into_iter()
+        .filter(|(_, same)| !same)
+        .map(|(name, _)| name)
+        .collect()
+    }
+
+    /// Encode the commit for the previous block which this block contains, if any.
+    pub fn encoded_last_commit(&self) -> Option<(u64, Vec<u8>)> {
+        let commit = self.inner.last_commit.clone()?;
+        let height = commit.height.value();
+        Some((
+            height,
+            <TendermintCommit as Protobuf<ProtoCommit>>::encode_vec(commit),
+        ))
+    }
+
     fn try_from_inner(inner: TendermintBlock) -> anyhow::Result<Self> {
         let height = inner.header.height.value();
         Ok(Self { inner, height })
     }
 
     /// Attempt to decode data producing Self.
+    ///
+    /// cometbft 0.38 left the encoding of blocks as it was in 0.37, so this reads blocks
+    /// stored by either, and an archive needs no record of which one stored each block.
+    /// What 0.38 added, the extended commit of each height, is kept apart from the block.
     pub fn decode(data: &[u8]) -> anyhow::Result<Self> {
         let inner = <TendermintBlock as Protobuf<ProtoBlock>>::decode_vec(data)?;
         Self::try_from_inner(inner)
@@ -163,11 +432,61 @@ impl Block {
         Self::try_from_inner(inner)
     }
 
+    /// Encode this block as JSON, in the form [Self::from_value] reads.
+    pub fn to_value(&self) -> anyhow::Result<Value> {
+        Ok(serde_json::to_value(&self.inner)?)
+    }
+
     #[cfg(test)]
     pub fn test_value() -> Self {
         Self::decode(include_bytes!("../test_data/block.bin"))
             .expect("test data should be a valid block")
     }
+
+    /// The test block, but claiming to be at a different height.
+    #[cfg(test)]
+    pub fn test_value_at_height(height: u64) -> Self {
+        let mut inner = Self::test_value().inner;
+        inner.header.height = height.try_into().expect("test height should be valid");
+        Self::try_from_inner(inner).expect("test block should be valid")
+    }
+
+    /// The test block at a different height, made at a different time.
+    #[cfg(test)]
+    pub fn test_value_at_time(height: u64, time: i64) -> Self {
+        let mut inner = Self::test_value_at_height(height).inner;
+        inner.header.time = tendermint_v0o40::Time::from_unix_timestamp(
+            time.div_euclid(1_000_000_000),
+            time.rem_euclid(1_000_000_000) as u32,
+        )
+        .expect("test time should be valid");
+        Self::try_from_inner(inner).expect("test block should be valid")
+    }
+
+    /// The test block at a different height, with evidence of a validator voting twice.
+    ///
+    /// The votes aren't signed by anyone, so cometbft wouldn't accept this block, but it decodes.
+    #[cfg(test)]
+    pub fn test_value_with_evidence(height: u64) -> Self {
+        // An EvidenceList, holding a DuplicateVoteEvidence for two prevotes at height 5.
+        const EVIDENCE: &str = "0adb010ad8010a64080110052a060880e2cfaa06321411111111111111111111111111111111111111114240aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa1264080110052a060880e2cfaa06321411111111111111111111111111111111111111114240bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb180a20012a060880e2cfaa06";
+        let evidence = hex::decode(EVIDENCE).expect("test evidence should be valid hex");
+        let mut data = Self::test_value_at_height(height).encode();
+        // A message field appearing again is merged into it, so this fills in the empty evidence.
+        data.push((3 << 3) | 2);
+        // Its length, as a varint, which takes two bytes for this much evidence.
+        data.extend([(evidence.len() as u8) | 0x80, (evidence.len() >> 7) as u8]);
+        data.extend(evidence);
+        Self::decode(&data).expect("test block with evidence should decode")
+    }
+
+    /// The test block at a different height, containing some transactions.
+    #[cfg(test)]
+    pub fn test_value_with_transactions(height: u64, transactions: Vec<Vec<u8>>) -> Self {
+        let mut inner = Self::test_value_at_height(height).inner;
+        inner.data = transactions;
+        Self::try_from_inner(inner).expect("test block should be valid")
+    }
 }
 
 impl TryFrom<Value> for Block {
@@ -190,16 +509,37 @@ impl Config {
     /// Read this from a cometbft directory.
     ///
     /// This assumes that the config file is in the usual ./config/config.toml location.
+    /// Without a config file there, the directory is assumed to follow the standard layout.
     ///
     /// Use [Self::read_file] if you want to use a different file.
     pub fn read_dir(cometbft_dir: &Path) -> anyhow::Result<Self> {
         let f = cometbft_dir.join("config/config.toml");
+        if !f.exists() {
+            tracing::info!(
+                "no cometbft config file at '{}', assuming the standard layout",
+                f.display()
+            );
+            return Self::standard_layout(cometbft_dir);
+        }
         Self::read_file(&f).context(format!(
             "failed to read cometbft config file at '{}'",
             f.display()
         ))
     }
 
+    /// The config of a cometbft directory laid out with the defaults of cometbft.
+    ///
+    /// Blocks are in ./data/, and the genesis in ./config/genesis.json. There's no default
+    /// for the backend that works for every node, so that's detected from the block store.
+    fn standard_layout(cometbft_dir: &Path) -> anyhow::Result<Self> {
+        let db_dir = PathBuf::from("data");
+        Ok(Self {
+            db_backend: detect_backend(&cometbft_dir.join(&db_dir))?,
+            db_dir,
+            genesis_file: "config/genesis.json".into(),
+        })
+    }
+
     /// Read this from a specific file.
     ///
     /// Use [Self::from_toml] if you want to read from the contents directly.
@@ -259,12 +599,18 @@ impl Genesis {
         Ok(Self { inner })
     }
 
-    /// The initial height of the chain.
+    /// The initial height of the chain, where its first block is.
+    ///
+    /// A genesis may give its initial height as 0, which cometbft reads as 1, since no
+    /// chain has a block at height 0. This is normalized the same way, so that a chain
+    /// starting from such a genesis is found at the height of its first block.
     pub fn initial_height(&self) -> u64 {
-        self.inner
+        let height: u64 = self
+            .inner
             .initial_height
             .try_into()
-            .expect("initial height should fit into u64")
+            .expect("initial height should fit into u64");
+        height.max(1)
     }
 
     /// The identifier of the chain this genesis is for.
@@ -298,6 +644,16 @@ impl Genesis {
         Self::decode(include_bytes!("../test_data/genesis.json"))
             .expect("test genesis should parse")
     }
+
+    /// The test genesis, but with a different initial height.
+    #[cfg(test)]
+    pub fn test_value_at_height(initial_height: u64) -> Self {
+        let mut out = Self::test_value();
+        out.inner.initial_height = initial_height
+            .try_into()
+            .expect("test height should be valid");
+        out
+    }
 }
 
 impl TryFrom<Value> for Genesis {
@@ -318,12 +674,54 @@ pub type BlockStream<'a> = Pin<Box<dyn Stream<Item = anyhow::Result<(u64, Block)
 pub trait Store: Sync + Send + 'static {
     /// Get the genesis file for this Generation.
     async fn get_genesis(&self) -> anyhow::Result<Genesis>;
+    /// Get the genesis of every Generation this store has blocks of, in order of initial height.
+    ///
+    /// Most stores hold a single Generation, which is what the default implementation assumes.
+    async fn get_geneses(&self) -> anyhow::Result<Vec<Genesis>> {
+        Ok(vec![self.get_genesis().await?])
+    }
     /// Get the height bounds for this Generation.
     ///
     /// If present, this is expected to be the first block, and last block present in the store.
     async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>>;
+    /// Get the ranges of heights missing between the height bounds, inclusive on both ends.
+    ///
+    /// This returns `None` for stores which can't report this without fetching every block,
+    /// which is what the default implementation does.
+    async fn get_gaps(&self) -> anyhow::Result<Option<Vec<(u64, u64)>>> {
+        Ok(None)
+    }
     /// Get a specific block.
     async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>>;
+    /// Get the blocks between two heights, inclusive, in order, with their heights.
+    ///
+    /// This stops before the first height without a block, so fewer blocks than asked for
+    /// means that the next height is missing. The default implementation gets each block
+    /// in turn, and stores able to fetch several at once override it.
+    async fn get_blocks(&self, start: u64, end: u64) -> anyhow::Result<Vec<(u64, Block)>> {
+        let mut out = Vec::new();
+        for height in start..=end {
+            match self.get_block(height).await? {
+                Some(block) => out.push((height, block)),
+                None => break,
+            }
+        }
+        Ok(out)
+    }
+    /// Get the encoded extended commit for a specific height, with its vote extensions.
+    ///
+    /// Only heights from cometbft 0.38 on have these, and stores which can't provide them
+    /// return `None`, which is what the default implementation does.
+    async fn get_extended_commit(&self, _height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(None)
+    }
+    /// Get the ID of a specific block, the hash of its header, as the store records it.
+    ///
+    /// Stores which only record blocks, and not their IDs apart from them, return `None`,
+    /// which is what the default implementation does.
+    async fn get_block_id(&self, _height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(None)
+    }
     /// Stream blocks between optional bounds.
     ///
     /// This has a default implementation which will:
@@ -356,6 +754,15 @@ pub trait Store: Sync + Send + 'static {
     }
 }
 
+/// Turn the first and last heights of a store into bounds, or `None` if the store is empty.
+fn height_bounds((first, last): (i64, i64)) -> anyhow::Result<Option<(u64, u64)>> {
+    // Heights of 0 are indicative of an empty block store, so we can wrap this nicely.
+    if first <= 0 || last <= 0 {
+        return Ok(None);
+    }
+    Ok(Some((first.try_into()?, last.try_into()?)))
+}
+
 /// A store over cometbft data, using the filesystem.
 ///
 /// This can be used to retrieve blocks, among other things.
@@ -368,39 +775,165 @@ impl FileStore {
     ///
     /// `backend` should be the type of the cometbft database.
     /// `dir` should be the path of the cometbft data store.
-    fn new(cometbft_dir: &Path, config: &Config) -> anyhow::Result<Self> {
-        Ok(Self {
-            raw: RawStore::new(&config.db_backend, &cometbft_dir.join(&config.db_dir))?,
-        })
+    fn new(cometbft_dir: &Path, config: &Config, opts: &LocalStoreOpts) -> anyhow::Result<Self> {
+        let mut raw = RawStore::with_options(
+            &config.db_backend,
+            &cometbft_dir.join(&config.db_dir),
+            opts.db_name.as_deref().unwrap_or(DEFAULT_BLOCKSTORE_NAME),
+            opts.read_only,
+            &opts.db_options,
+        )?;
+        let backend = raw.backend()?;
+        if backend != config.db_backend {
+            tracing::warn!(
+                "the cometbft block store failed to open with its configured backend '{}', but opened with '{}'",
+                config.db_backend,
+                backend
+            );
+        }
+        tracing::debug!(
+            backend,
+            dir = cometbft_dir.join(&config.db_dir).display().to_string(),
+            "opened cometbft block store"
+        );
+        if let Some(size) = opts.max_block_bytes {
+            raw.set_max_block_size(size)?;
+        }
+        Ok(Self { raw })
     }
 
-    /// Retrieve the height of the last block in the store.
-    fn first_height(&mut self) -> Option<u64> {
-        // Heights of 0 are indicative of an empty block store, so we can wrap this nicely.
-        match self.raw.first_height() {
-            x if x <= 0 => None,
-            x => Some(x.try_into().expect("height should fit into u64")),
-        }
+    /// Retrieve the heights of the first and last blocks in the store.
+    ///
+    /// This will return `None` if the store is empty.
+    fn height_bounds(&mut self) -> anyhow::Result<Option<(u64, u64)>> {
+        height_bounds(self.raw.height_range()?)
     }
 
-    /// Retrieve the height of the last block in the store.
-    fn last_height(&mut self) -> Option<u64> {
-        // Heights of 0 are indicative of an empty block store, so we can wrap this nicely.
-        match self.raw.last_height() {
-            x if x <= 0 => None,
-            x => Some(x.try_into().expect("height should fit into u64")),
-        }
+    /// Retrieve the genesis the node saved in its database.
+    ///
+    /// This will return `None` if the node hasn't saved one.
+    fn genesis(&mut self) -> anyhow::Result<Option<Genesis>> {
+        self.raw.genesis_doc()?.map(Genesis::decode).transpose()
+    }
+
+    /// Retrieve the chain id from the header of the first block in the store.
+    fn chain_id(&mut self) -> anyhow::Result<String> {
+        self.raw
+            .chain_id()
+            .context("failed to read the chain id from the block store")
+    }
+
+    /// Retrieve the ranges of heights missing from the store.
+    fn gaps(&mut self) -> anyhow::Result<Vec<(u64, u64)>> {
+        self.raw
+            .gaps()?
+            .into_iter()
+            .map(|(from, to)| Ok((from.try_into()?, to.try_into()?)))
+            .collect()
+    }
+
+    /// Sum up the sizes of the blocks in the store, from their metadata.
+    fn size_stats(&mut self) -> anyhow::Result<BlockSizeStats> {
+        self.raw
+            .size_stats()
+            .context("failed to read the sizes of the blocks in the block store")
     }
 
-    /// Attempt to retrieve a block at a given height.
+    /// Check that the first and last blocks of the store load.
+    fn validate(&mut self) -> anyhow::Result<()> {
+        self.raw.validate()
+    }
+
+    /// Retrieve the height of the last block applied to the application.
     ///
-    /// This will return `None` if there's no such block.
-    fn block_by_height(&mut self, height: u64) -> anyhow::Result<Option<Block>> {
+    /// This will return `None` if the node recorded no state next to the store.
+    fn app_height(&mut self) -> anyhow::Result<Option<u64>> {
         self.raw
-            .block_by_height(height.try_into()?)
-            .map(Block::decode)
+            .app_height()?
+            .map(|x| Ok(x.try_into()?))
             .transpose()
     }
+
+    /// Attempt to retrieve the encoding of a block at a given height.
+    ///
+    /// This will return `None` if there's no such block.
+    fn encoded_block_by_height(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(self
+            .raw
+            .block_by_height(height.try_into()?)
+            .with_context(|| format!("failed to read the block at height {}", height))?
+            .map(|x| x.to_vec()))
+    }
+
+    /// Attempt to retrieve the encoding of a block, as compressed by the Go side.
+    ///
+    /// Decompress it with [decompress_block].
+    fn compressed_block_by_height(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(self
+            .raw
+            .block_by_height_compressed(height.try_into()?)
+            .with_context(|| format!("failed to read the block at height {}", height))?
+            .map(|x| x.to_vec()))
+    }
+
+    /// Attempt to retrieve the encodings of the blocks between two heights, inclusive.
+    ///
+    /// This stops before the first height without a block, reading as many blocks
+    /// as fit with each crossing into the Go side.
+    fn encoded_blocks_range(
+        &mut self,
+        start: u64,
+        end: u64,
+    ) -> anyhow::Result<Vec<(u64, Vec<u8>)>> {
+        self.raw
+            .blocks_range(start.try_into()?, end.try_into().unwrap_or(i64::MAX))
+            .with_context(|| format!("failed to read the blocks {}..={}", start, end))?
+            .into_iter()
+            .map(|(height, data)| Ok((height.try_into()?, data)))
+            .collect()
+    }
+
+    fn block_id(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(self
+            .raw
+            .hash_by_height(height.try_into()?)
+            .with_context(|| format!("failed to read the ID of the block at height {}", height))?
+            .map(|x| x.to_vec()))
+    }
+
+    /// Attempt to retrieve the encoded commit the node saw for the block at a given height.
+    ///
+    /// This will return `None` if it saw none there, which is only certain not to be
+    /// the case for the last block of the store.
+    fn encoded_seen_commit_by_height(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(self
+            .raw
+            .seen_commit_by_height(height.try_into()?)
+            .with_context(|| format!("failed to read the seen commit at height {}", height))?
+            .map(|x| x.to_vec()))
+    }
+
+    fn encoded_extended_commit_by_height(
+        &mut self,
+        height: u64,
+    ) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(self
+            .raw
+            .extended_commit_by_height(height.try_into()?)
+            .with_context(|| format!("failed to read the extended commit at height {}", height))?
+            .map(|x| x.to_vec()))
+    }
+
+    /// Attempt to retrieve the encoded evidence committed in the block at a given height.
+    ///
+    /// This will return `None` if there's no such block, or if it carries no evidence.
+    fn encoded_evidence_by_height(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        Ok(self
+            .raw
+            .evidence_by_height(height.try_into()?)
+            .with_context(|| format!("failed to read the evidence at height {}", height))?
+            .map(|x| x.to_vec()))
+    }
 }
 
 pub enum LocalStoreGenesisLocation<'p> {
@@ -409,6 +942,40 @@ pub enum LocalStoreGenesisLocation<'p> {
     FromConfig,
 }
 
+#[derive(Clone, Debug, Default)]
+pub struct LocalStoreOpts {
+    /// If set, open the block store without write access.
+    ///
+    /// This avoids interfering with a running node, but isn't supported by every backend.
+    pub read_only: bool,
+    /// The name of the database holding the block store, if not [DEFAULT_BLOCKSTORE_NAME].
+    pub db_name: Option<String>,
+    /// If set, fail to read blocks larger than this many bytes, rather than allocate for them.
+    pub max_block_bytes: Option<u64>,
+    /// How to tune the database of the block store, if at all.
+    pub db_options: DbOptions,
+}
+
+/// Tunables for opening the database of a block store, mirroring `Options` in go/store/store.go.
+///
+/// The default opens the database as cometbft does. Only the goleveldb backend can be tuned,
+/// so setting anything with another backend fails to open the store.
+/// Besides these, the store can be kept from falling back to other backends.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct DbOptions {
+    /// How many bytes of blocks the database caches in memory, if not its default.
+    pub block_cache_bytes: Option<u64>,
+    /// Stop reads from triggering compactions of the database.
+    pub disable_compaction: bool,
+    /// How tables the database writes are compressed, `snappy` or `none`, if not its default.
+    ///
+    /// This only affects writes, so it can't be set for a store opened read-only.
+    pub compression: Option<String>,
+    /// Fail if the store doesn't open with the backend asked for, rather than trying
+    /// the others which its files point to.
+    pub strict_backend: bool,
+}
+
 /// A store which accesses data locally.
 pub struct LocalStore {
     file_store: Arc<Mutex<FileStore>>,
@@ -423,13 +990,16 @@ impl LocalStore {
     pub fn init(
         cometbft_dir: &Path,
         genesis: LocalStoreGenesisLocation<'_>,
+        opts: LocalStoreOpts,
     ) -> anyhow::Result<Self> {
         let config = Config::read_dir(cometbft_dir)?;
-        let file_store = FileStore::new(cometbft_dir, &config)?;
+        let mut file_store = FileStore::new(cometbft_dir, &config, &opts)?;
         let genesis = match genesis {
-            LocalStoreGenesisLocation::FromConfig => {
-                Genesis::read_cometbft_dir(cometbft_dir, &config)?
-            }
+            // Prefer the genesis the node actually started with, if it saved one.
+            LocalStoreGenesisLocation::FromConfig => match file_store.genesis()? {
+                Some(genesis) => genesis,
+                None => Genesis::read_cometbft_dir(cometbft_dir, &config)?,
+            },
             LocalStoreGenesisLocation::DirectFile(path) => Genesis::read_file(path)?,
         };
         Ok(Self {
@@ -437,6 +1007,50 @@ impl LocalStore {
             file_store: Arc::new(Mutex::new(file_store)),
         })
     }
+
+    /// Check that the blocks at the first and last heights the store records actually load.
+    ///
+    /// A corrupted store can record heights past the blocks it has, which would
+    /// otherwise only fail once those blocks are reached.
+    pub async fn validate(&self) -> anyhow::Result<()> {
+        self.file_store
+            .lock()
+            .await
+            .validate()
+            .context("the cometbft block store is inconsistent, and may be corrupted")
+    }
+
+    /// Retrieve the height of the last block the node applied to the application.
+    ///
+    /// cometbft saves a block before applying it, so after an abnormal shutdown,
+    /// the block store can be ahead of this height.
+    /// This will return `None` if the node recorded no state next to the store.
+    pub async fn app_height(&self) -> anyhow::Result<Option<u64>> {
+        self.file_store.lock().await.app_height()
+    }
+
+    /// Retrieve the evidence of misbehavior committed in the block at a given height, encoded.
+    ///
+    /// This reads only the evidence, as an `EvidenceList`, which most blocks have none of,
+    /// in which case this returns `None`, as it does for heights without a block.
+    #[allow(dead_code)]
+    pub async fn evidence(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        self.file_store
+            .lock()
+            .await
+            .encoded_evidence_by_height(height)
+    }
+
+    /// Retrieve the commit the node saw for the block at a given height, encoded.
+    ///
+    /// Blocks carry the commit of the block before them, so this is the only commit there is
+    /// for the last block of the store, which is the only one certain to have a seen commit.
+    pub async fn seen_commit(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        self.file_store
+            .lock()
+            .await
+            .encoded_seen_commit_by_height(height)
+    }
 }
 
 #[async_trait]
@@ -446,28 +1060,151 @@ impl Store for LocalStore {
     }
 
     async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
-        let mut file_store = self.file_store.lock().await;
-        let start = file_store.first_height();
-        let end = file_store.last_height();
-        let out = match (start, end) {
-            (None, _) => None,
-            (_, None) => None,
-            (Some(x), Some(y)) => Some((x, y)),
-        };
-        Ok(out)
+        self.file_store.lock().await.height_bounds()
+    }
+
+    async fn get_gaps(&self) -> anyhow::Result<Option<Vec<(u64, u64)>>> {
+        self.file_store.lock().await.gaps().map(Some)
     }
 
     async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
-        self.file_store.lock().await.block_by_height(height)
+        // Decoding happens outside of the lock, so that several readers can decode at once.
+        let data = self
+            .file_store
+            .lock()
+            .await
+            .encoded_block_by_height(height)?;
+        data.map(|x| Block::decode(&x)).transpose()
+    }
+
+    async fn get_blocks(&self, start: u64, end: u64) -> anyhow::Result<Vec<(u64, Block)>> {
+        let mut out = Vec::new();
+        let mut chunk_start = start;
+        while chunk_start <= end {
+            let chunk_end = end.min(chunk_start.saturating_add(RANGE_CHUNK_SIZE - 1));
+            // Like get_block, this only holds the lock while reading, not while decoding.
+            let data = self
+                .file_store
+                .lock()
+                .await
+                .encoded_blocks_range(chunk_start, chunk_end)?;
+            let complete = data.len() as u64 == chunk_end - chunk_start + 1;
+            for (height, data) in data {
+                out.push((height, Block::decode(&data)?));
+            }
+            if !complete || chunk_end == u64::MAX {
+                break;
+            }
+            chunk_start = chunk_end + 1;
+        }
+        Ok(out)
+    }
+
+    async fn get_extended_commit(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        self.file_store
+            .lock()
+            .await
+            .encoded_extended_commit_by_height(height)
+    }
+
+    /// Stream blocks between optional bounds, reading several at a time from the Go side.
+    ///
+    /// This behaves like the default implementation, but for fetching blocks in chunks.
+    fn stream_blocks(&self, start: Option<u64>, end: Option<u64>) -> BlockStream<'_> {
+        Box::pin(try_stream! {
+            let (first, last) = self.get_height_bounds().await?.ok_or(anyhow!("stream_blocks expects height bounds to exist"))?;
+            let start = start.map_or(first, |x| x.max(first));
+            let end = end.map_or(last, |x| x.min(last));
+            let mut height = start;
+            while height <= end {
+                let chunk_end = end.min(height + RANGE_CHUNK_SIZE - 1);
+                for (block_height, block) in self.get_blocks(height, chunk_end).await? {
+                    yield (block_height, block);
+                    height = block_height + 1;
+                }
+                if height <= chunk_end {
+                    Err(anyhow!("expected block at height {}", height))?;
+                }
+            }
+        })
+    }
+
+    async fn get_block_id(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        self.file_store.lock().await.block_id(height)
+    }
+}
+
+/// Writes blocks into a new cometbft block store, as a node would have.
+pub struct BlockStoreWriter {
+    raw: RawStore,
+}
+
+impl BlockStoreWriter {
+    /// Create a block store inside of a cometbft data directory, failing if there's one already.
+    pub fn create(data_dir: &Path, backend: &str) -> anyhow::Result<Self> {
+        let existing = data_dir.join(format!("{}.db", DEFAULT_BLOCKSTORE_NAME));
+        anyhow::ensure!(
+            !existing.exists(),
+            "there's already a block store at '{}'",
+            existing.display()
+        );
+        Ok(Self {
+            raw: RawStore::create(backend, data_dir, DEFAULT_BLOCKSTORE_NAME)?,
+        })
+    }
+
+    /// Append a block to the store, using the block after it for the commit of that block.
+    ///
+    /// The archive doesn't contain commits, but each block contains the commit for the block
+    /// before it, so saving a block requires having the next one as well.
+    ///
+    /// Blocks must be saved in order of height, without gaps.
+    pub fn save_block(&mut self, block: &Block, next: &Block) -> anyhow::Result<()> {
+        let (commit_height, commit) = next.encoded_last_commit().ok_or(anyhow!(
+            "block at height {} contains no commit for the block before it",
+            next.height()
+        ))?;
+        anyhow::ensure!(
+            commit_height == block.height(),
+            "block at height {} contains a commit for height {}, rather than height {}",
+            next.height(),
+            commit_height,
+            block.height()
+        );
+        self.raw.save_block(&block.encode(), &commit)
+    }
+
+    /// Append the last block to the store, with the encoded commit a node saw for it.
+    ///
+    /// No block follows the last one to take its commit from, as [Self::save_block] does.
+    pub fn save_last_block(&mut self, block: &Block, seen_commit: &[u8]) -> anyhow::Result<()> {
+        self.raw.save_block(&block.encode(), seen_commit)
+    }
+
+    /// Retrieve the heights of the first and last blocks in the store.
+    ///
+    /// This will return `None` if the store is empty.
+    pub fn height_bounds(&mut self) -> anyhow::Result<Option<(u64, u64)>> {
+        height_bounds(self.raw.height_range()?)
     }
 }
 
+mod backup;
+#[cfg(not(feature = "subprocess-store"))]
+mod cgo;
 mod remote;
+mod rpc;
+mod stitched;
+#[cfg(feature = "subprocess-store")]
+mod subprocess;
+pub use backup::ExtractedBackup;
 pub use remote::RemoteStore;
+pub use rpc::RpcStore;
+pub use stitched::StitchedStore;
 
 #[cfg(test)]
 mod test {
-    use super::Config;
+    use super::*;
 
     #[test]
     fn test_config_parsing() -> anyhow::Result<()> {
@@ -487,4 +1224,569 @@ genesis_file = "config/genesis.json"
         );
         Ok(())
     }
+
+    #[test]
+    fn test_store_with_custom_name() -> anyhow::Result<()> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-store-name-{}",
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        // Put the block store under test_data/cometbft under another name.
+        let original =
+            Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data/blockstore.db");
+        std::fs::create_dir_all(dir.join("custom.db"))?;
+        for entry in std::fs::read_dir(original)? {
+            let entry = entry?;
+            std::fs::copy(entry.path(), dir.join("custom.db").join(entry.file_name()))?;
+        }
+
+        let mut store = RawStore::new("goleveldb", &dir, "custom", true)?;
+        assert_eq!(store.height_range()?, (1, 5));
+        let block = store.block_by_height(3)?.map(Block::decode).transpose()?;
+        assert_eq!(block.map(|x| x.height()), Some(3));
+        drop(store);
+
+        let err = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)
+            .err()
+            .expect("there should be no store under the default name");
+        assert!(
+            format!("{:#}", err).contains("no cometbft block store"),
+            "{:#}",
+            err
+        );
+        let err = RawStore::new("goleveldb", &dir, "", true)
+            .err()
+            .expect("an empty name should be rejected");
+        assert!(
+            format!("{:#}", err).contains("cannot be empty"),
+            "{:#}",
+            err
+        );
+
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_standard_layout_discovery() -> anyhow::Result<()> {
+        for nested in [true, false] {
+            let home = test_node_home("discovery", nested)?;
+            let cometbft_dir = find_cometbft_dir(&home)?;
+            assert_eq!(
+                cometbft_dir,
+                if nested {
+                    home.join("cometbft")
+                } else {
+                    home.clone()
+                }
+            );
+            assert_eq!(
+                Config::read_dir(&cometbft_dir)?,
+                Config {
+                    db_dir: "data".into(),
+                    db_backend: "goleveldb".into(),
+                    genesis_file: "config/genesis.json".into()
+                }
+            );
+            assert_eq!(read_chain_id(&cometbft_dir)?, "penumbra-1");
+
+            let store = LocalStore::init(
+                &cometbft_dir,
+                LocalStoreGenesisLocation::FromConfig,
+                LocalStoreOpts {
+                    read_only: true,
+                    db_name: None,
+                    max_block_bytes: None,
+                    db_options: DbOptions::default(),
+                },
+            )?;
+            assert_eq!(store.get_height_bounds().await?, Some((1, 5)));
+            assert_eq!(store.get_genesis().await?.chain_id(), "penumbra-1");
+            drop(store);
+            std::fs::remove_dir_all(&home)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_backend_falls_back_to_detected_one() -> anyhow::Result<()> {
+        let home = test_node_home("backend-fallback", false)?;
+        // A config naming a backend this build lacks, for a store goleveldb reads.
+        std::fs::write(
+            home.join("config/config.toml"),
+            "db_backend = \"cleveldb\"\ndb_dir = \"data\"\ngenesis_file = \"config/genesis.json\"\n",
+        )?;
+        let open = |strict_backend| {
+            LocalStore::init(
+                &home,
+                LocalStoreGenesisLocation::FromConfig,
+                LocalStoreOpts {
+                    read_only: true,
+                    db_options: DbOptions {
+                        strict_backend,
+                        ..DbOptions::default()
+                    },
+                    ..LocalStoreOpts::default()
+                },
+            )
+        };
+        let store = open(false)?;
+        assert_eq!(store.get_height_bounds().await?, Some((1, 5)));
+        drop(store);
+        let err = open(true)
+            .err()
+            .expect("a strict backend shouldn't fall back");
+        assert!(
+            format!("{:#}", err).contains("unknown backend 'cleveldb'"),
+            "{:#}",
+            err
+        );
+
+        // Only backends which the files of the store point to are tried.
+        let mut raw = RawStore::new("boltdb", &home.join("data"), DEFAULT_BLOCKSTORE_NAME, true)?;
+        assert_eq!(raw.backend()?, "goleveldb");
+        drop(raw);
+        let empty = home.join("data/empty.db");
+        std::fs::create_dir_all(&empty)?;
+        std::fs::write(empty.join("unrelated"), b"")?;
+        let err = RawStore::new("boltdb", &home.join("data"), "empty", true)
+            .err()
+            .expect("nothing points to a backend to fall back to");
+        assert!(
+            format!("{:#}", err).contains("unknown backend 'boltdb'"),
+            "{:#}",
+            err
+        );
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_discovery_without_cometbft_data() -> anyhow::Result<()> {
+        let home = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-no-discovery-{}",
+            std::process::id()
+        ));
+        std::fs::create_dir_all(&home)?;
+        let err = find_cometbft_dir(&home)
+            .err()
+            .expect("an empty directory has no cometbft data");
+        assert!(
+            format!("{:#}", err).contains("no cometbft data found"),
+            "{:#}",
+            err
+        );
+        // Without a block store to look at, there's no telling what the backend is.
+        std::fs::create_dir_all(home.join("data"))?;
+        assert!(Config::read_dir(&home).is_err());
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_validate_healthy_store() -> anyhow::Result<()> {
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let mut store = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        store.validate()?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_validate_store_with_missing_last_block() -> anyhow::Result<()> {
+        // This is the usual test store, but with the last block removed, and not the height.
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft-truncated");
+        let mut raw = RawStore::new(
+            "goleveldb",
+            &dir.join("data"),
+            DEFAULT_BLOCKSTORE_NAME,
+            true,
+        )?;
+        assert_eq!(raw.height_range()?, (1, 5));
+        assert!(raw.block_by_height(5)?.is_none());
+        let err = raw
+            .validate()
+            .expect_err("a store missing its last block should not validate");
+        assert!(
+            format!("{:#}", err).contains("last height is 5, but it has no block"),
+            "{:#}",
+            err
+        );
+        drop(raw);
+
+        let store = LocalStore::init(
+            &dir,
+            LocalStoreGenesisLocation::FromConfig,
+            LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        )?;
+        let err = store
+            .validate()
+            .await
+            .expect_err("a store missing its last block should not validate");
+        assert!(
+            format!("{:#}", err).contains("may be corrupted"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_max_block_size() -> anyhow::Result<()> {
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let mut raw = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        let size = raw
+            .block_by_height(3)?
+            .ok_or(anyhow!("missing test block at height 3"))?
+            .len() as u64;
+
+        // A block right at the limit is still fine.
+        raw.set_max_block_size(size)?;
+        assert_eq!(raw.block_by_height(3)?.map(|x| x.len() as u64), Some(size));
+        raw.set_max_block_size(size - 1)?;
+        let err = raw
+            .block_by_height(3)
+            .expect_err("a block over the limit should not be read");
+        assert_eq!(
+            format!("{:#}", err),
+            format!(
+                "block is {} bytes, more than the maximum block size of {} bytes",
+                size,
+                size - 1
+            )
+        );
+        // Missing blocks are still missing, rather than over the limit.
+        assert!(raw.block_by_height(6)?.is_none());
+        raw.set_max_block_size(0)?;
+        assert!(raw.block_by_height(3)?.is_some());
+        drop(raw);
+
+        let test_data = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data");
+        let store = LocalStore::init(
+            &test_data.join("cometbft"),
+            LocalStoreGenesisLocation::DirectFile(&test_data.join("genesis.json")),
+            LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: Some(size - 1),
+                db_options: Default::default(),
+            },
+        )?;
+        let err = store
+            .get_block(3)
+            .await
+            .expect_err("a block over the limit should not be read");
+        assert!(
+            format!("{:#}", err).contains("block at height 3"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_local_store_reads_ranges_of_blocks() -> anyhow::Result<()> {
+        use tokio_stream::StreamExt as _;
+
+        let test_data = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data");
+        let open = |name: &str| {
+            LocalStore::init(
+                &test_data.join(name),
+                LocalStoreGenesisLocation::DirectFile(&test_data.join("genesis.json")),
+                LocalStoreOpts {
+                    read_only: true,
+                    ..Default::default()
+                },
+            )
+        };
+        let store = open("cometbft")?;
+        let blocks = store.get_blocks(1, 5).await?;
+        assert_eq!(
+            blocks.iter().map(|(height, _)| *height).collect::<Vec<_>>(),
+            (1..=5).collect::<Vec<_>>()
+        );
+        for (height, block) in &blocks {
+            assert_eq!(Some(block), store.get_block(*height).await?.as_ref());
+        }
+        // A range past the last block ends there, and one beyond the store is empty.
+        assert_eq!(store.get_blocks(4, 100).await?.len(), 2);
+        assert!(store.get_blocks(7, 9).await?.is_empty());
+
+        let streamed: Vec<_> = store.stream_blocks(Some(2), None).collect().await;
+        let streamed = streamed.into_iter().collect::<anyhow::Result<Vec<_>>>()?;
+        assert_eq!(
+            streamed
+                .iter()
+                .map(|(height, _)| *height)
+                .collect::<Vec<_>>(),
+            (2..=5).collect::<Vec<_>>()
+        );
+
+        // Streaming over a gap yields the blocks before it, then fails at the missing height.
+        let gap = open("cometbft-gap")?;
+        assert_eq!(gap.get_blocks(1, 5).await?.len(), 2);
+        let streamed: Vec<_> = gap.stream_blocks(None, None).collect().await;
+        assert_eq!(streamed.len(), 3);
+        let err = streamed[2].as_ref().expect_err("height 3 is missing");
+        assert!(
+            format!("{:#}", err).contains("expected block at height 3"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_app_height_trailing_block_height() -> anyhow::Result<()> {
+        // This is the usual test store, with state saying only the first 4 blocks were applied.
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft-behind");
+        let store = LocalStore::init(
+            &dir,
+            LocalStoreGenesisLocation::FromConfig,
+            LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        )?;
+        assert_eq!(store.get_height_bounds().await?, Some((1, 5)));
+        assert_eq!(store.app_height().await?, Some(4));
+        drop(store);
+
+        // The usual test store has no state at all.
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let mut raw = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        assert_eq!(raw.app_height()?, None);
+        drop(raw);
+
+        let mut raw = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        assert_eq!(raw.app_height()?, None);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_genesis_height_of_stores() -> anyhow::Result<()> {
+        let open = |name: &str| {
+            LocalStore::init(
+                &Path::new(env!("CARGO_MANIFEST_DIR"))
+                    .join("test_data")
+                    .join(name),
+                LocalStoreGenesisLocation::FromConfig,
+                LocalStoreOpts {
+                    read_only: true,
+                    ..Default::default()
+                },
+            )
+        };
+        // This store has no genesis saved next to it, so the genesis file is read instead.
+        let store = open("cometbft-behind")?;
+        assert_eq!(store.get_height_bounds().await?, Some((1, 5)));
+        assert_eq!(
+            store.get_genesis().await?.initial_height(),
+            Genesis::test_value().initial_height()
+        );
+        drop(store);
+
+        // This one has the genesis the node saved, which gives its initial height as 0,
+        // read as 1, where the first block of the store is, rather than the genesis file.
+        let store = open("cometbft-genesis")?;
+        assert_eq!(store.get_height_bounds().await?, Some((1, 5)));
+        assert_eq!(store.get_genesis().await?.initial_height(), 1);
+        Ok(())
+    }
+
+    #[test]
+    fn test_chain_id_matches_block_headers() -> anyhow::Result<()> {
+        let fixture = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let mut store = RawStore::new("goleveldb", &fixture, DEFAULT_BLOCKSTORE_NAME, true)?;
+        let chain_id = store.chain_id()?;
+        for height in 1..=5 {
+            let data = store
+                .block_by_height(height)?
+                .ok_or(anyhow!("missing test block at height {}", height))?;
+            assert_eq!(Block::decode(data)?.chain_id(), chain_id);
+        }
+        drop(store);
+
+        let home = test_node_home("block-store-chain-id", false)?;
+        std::fs::remove_file(home.join("config/genesis.json"))?;
+        let opts = LocalStoreOpts {
+            read_only: true,
+            ..Default::default()
+        };
+        assert_eq!(read_block_store_chain_id(&home, &opts)?, chain_id);
+        std::fs::remove_dir_all(&home)?;
+
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-chain-id-memdb-{}",
+            std::process::id()
+        ));
+        let mut empty = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        let err = empty
+            .chain_id()
+            .expect_err("an empty store should have no chain id");
+        assert!(
+            format!("{:#}", err).contains("contains no blocks"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_blocks_encode_the_same_for_0_37_and_0_38() -> anyhow::Result<()> {
+        use tendermint_proto::v0_38::types::Block as ProtoBlockV0o38;
+
+        let blocks = [
+            Block::test_value_at_height(1),
+            Block::test_value_at_time(7, 1_700_000_000_000_000_000),
+            Block::test_value_with_transactions(8, vec![vec![1; 100], vec![2; 3]]),
+            Block::test_value_with_evidence(9),
+        ];
+        let archive = crate::storage::Storage::new(None, Some("penumbra-test")).await?;
+        for block in &blocks {
+            let v0o38 =
+                <TendermintBlock as Protobuf<ProtoBlockV0o38>>::encode_vec(block.inner.clone());
+            assert_eq!(v0o38, block.encode(), "height {}", block.height());
+            // Whichever version a block was stored with, it comes back out of an archive the same.
+            archive
+                .put_encoded_block(block.height(), &v0o38, 0, 0, None)
+                .await?;
+        }
+        for block in &blocks {
+            let data = archive
+                .get_encoded_block(block.height())
+                .await?
+                .ok_or(anyhow!("missing block at height {}", block.height()))?;
+            assert_eq!(&Block::decode(&data)?, block);
+            let v0o38 = <TendermintBlock as Protobuf<ProtoBlockV0o38>>::decode_vec(&data)?;
+            assert_eq!(v0o38, block.inner);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_empty_store_has_no_heights() -> anyhow::Result<()> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-empty-memdb-{}",
+            std::process::id()
+        ));
+        let mut empty = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        // The heights of 0 cometbft records for an empty store aren't taken for a block there.
+        assert_eq!(empty.height_range()?, (0, 0));
+        assert_eq!(height_bounds(empty.height_range()?)?, None);
+        assert!(empty.block_by_height(0)?.is_none());
+        assert!(empty.gaps()?.is_empty());
+        empty.validate()?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_size_stats_match_blocks() -> anyhow::Result<()> {
+        let fixture = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let mut store = RawStore::new("goleveldb", &fixture, DEFAULT_BLOCKSTORE_NAME, true)?;
+        let mut sizes = Vec::new();
+        for height in 1..=5 {
+            let data = store
+                .block_by_height(height)?
+                .ok_or(anyhow!("missing test block at height {}", height))?;
+            sizes.push(data.len() as u64);
+        }
+        let stats = store.size_stats()?;
+        drop(store);
+        assert_eq!(stats.total_bytes, sizes.iter().sum::<u64>());
+        assert_eq!(stats.max_block_bytes, *sizes.iter().max().unwrap());
+        assert_eq!(stats.block_count(), 5);
+        // Every block is counted in the bucket of its size, and the last bucket holds the largest.
+        let mut buckets = vec![0u64; stats.buckets.len()];
+        for size in &sizes {
+            buckets[size.ilog2() as usize] += 1;
+        }
+        assert_eq!(stats.buckets, buckets);
+        assert_ne!(stats.buckets.last(), Some(&0));
+        for (min, max, _) in stats.histogram() {
+            assert_eq!(max, min * 2);
+        }
+
+        let home = test_node_home("block-store-sizes", true)?;
+        let sizes = read_block_store_sizes(
+            &home.join("cometbft"),
+            &LocalStoreOpts {
+                read_only: true,
+                ..Default::default()
+            },
+        )?;
+        assert_eq!(sizes.heights, Some((1, 5)));
+        assert_eq!(sizes.blocks, stats);
+        let disk_bytes: u64 = std::fs::read_dir(home.join("cometbft/data/blockstore.db"))?
+            .map(|x| Ok(x?.metadata()?.len()))
+            .sum::<anyhow::Result<u64>>()?;
+        assert_eq!(sizes.disk_bytes, Some(disk_bytes));
+        std::fs::remove_dir_all(&home)?;
+
+        // An empty store has no blocks to count, and nothing on disk.
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-sizes-memdb-{}",
+            std::process::id()
+        ));
+        let mut empty = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        assert_eq!(empty.size_stats()?, BlockSizeStats::default());
+        assert!(empty.size_stats()?.histogram().is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn test_memory_store_round_trip() -> anyhow::Result<()> {
+        let fixture = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let mut source = RawStore::new("goleveldb", &fixture, DEFAULT_BLOCKSTORE_NAME, true)?;
+        let blocks = (1..=5)
+            .map(|height| {
+                let data = source
+                    .block_by_height(height)?
+                    .ok_or(anyhow!("missing test block at height {}", height))?;
+                Block::decode(data)
+            })
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        drop(source);
+
+        // Nothing should ever be written here.
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-memdb-{}",
+            std::process::id()
+        ));
+        let mut store = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        assert_eq!(store.height_range()?, (0, 0));
+        for pair in blocks.windows(2) {
+            let (_, commit) = pair[1]
+                .encoded_last_commit()
+                .ok_or(anyhow!("test block should contain a commit"))?;
+            store.save_block(&pair[0].encode(), &commit)?;
+        }
+        assert_eq!(store.height_range()?, (1, 4));
+        for block in &blocks[..4] {
+            let height = i64::try_from(block.height())?;
+            let out = store
+                .block_by_height(height)?
+                .map(Block::decode)
+                .transpose()?;
+            assert_eq!(out.as_ref(), Some(block));
+        }
+        assert!(store.block_by_height(5)?.is_none());
+        assert!(store.genesis_doc()?.is_none());
+        assert!(store.gaps()?.is_empty());
+        drop(store);
+        assert!(!dir.exists());
+
+        // There's nothing in memory to open again.
+        assert!(RawStore::new(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME, false).is_err());
+        Ok(())
+    }
 }
@@ -0,0 +1,208 @@
+use anyhow::Context as _;
+use flate2::read::GzDecoder;
+use std::{
+    fs::File,
+    io::{BufRead as _, BufReader, Read},
+    path::{Path, PathBuf},
+};
+
+use super::find_cometbft_dir;
+
+/// The magic bytes at the start of gzip compressed data.
+const GZIP_MAGIC: &[u8] = &[0x1f, 0x8b];
+
+/// The magic bytes at the start of zstd compressed data.
+const ZSTD_MAGIC: &[u8] = &[0x28, 0xb5, 0x2f, 0xfd];
+
+/// A backup of a node, extracted into a directory of its own, for reading its block store.
+///
+/// The directory is removed once this is dropped, along with everything extracted into it,
+/// so the block store must be closed before then.
+#[derive(Debug)]
+pub struct ExtractedBackup {
+    dir: PathBuf,
+    cometbft_dir: PathBuf,
+}
+
+impl ExtractedBackup {
+    /// Extract a backup into a new directory, at a path which must not exist yet.
+    ///
+    /// The backup is a tar archive, compressed with gzip or not at all, of a node home,
+    /// or of a cometbft directory, which may also be inside of a single directory in it,
+    /// as when the archive was made from the parent of a node home. It's decompressed
+    /// as it's extracted, so the uncompressed archive is never written out in full.
+    pub fn extract(backup: &Path, dir: &Path) -> anyhow::Result<Self> {
+        let mut reader = BufReader::new(
+            File::open(backup)
+                .with_context(|| format!("failed to open backup '{}'", backup.display()))?,
+        );
+        let magic = reader.fill_buf()?;
+        let (zstd, gzip) = (magic.starts_with(ZSTD_MAGIC), magic.starts_with(GZIP_MAGIC));
+        if zstd {
+            anyhow::bail!(
+                "backup '{}' is compressed with zstd, which isn't supported; decompress it first, with `zstd -d`, or recompress it with gzip",
+                backup.display()
+            );
+        }
+        let reader: Box<dyn Read> = if gzip {
+            Box::new(GzDecoder::new(reader))
+        } else {
+            Box::new(reader)
+        };
+
+        std::fs::create_dir_all(dir.parent().unwrap_or(dir))?;
+        std::fs::create_dir(dir)
+            .with_context(|| format!("failed to create directory '{}'", dir.display()))?;
+        // Whatever was extracted is removed along with this, if extraction fails partway.
+        let mut out = Self {
+            dir: dir.to_owned(),
+            cometbft_dir: dir.to_owned(),
+        };
+        tracing::info!(
+            "extracting backup '{}' into '{}'",
+            backup.display(),
+            dir.display()
+        );
+        tar::Archive::new(reader)
+            .unpack(dir)
+            .with_context(|| format!("failed to extract backup '{}'", backup.display()))?;
+        out.cometbft_dir = find_extracted_cometbft_dir(dir)
+            .with_context(|| format!("no cometbft data found in backup '{}'", backup.display()))?;
+        Ok(out)
+    }
+
+    /// The cometbft directory of the node, among what was extracted.
+    pub fn cometbft_dir(&self) -> &Path {
+        &self.cometbft_dir
+    }
+}
+
+impl Drop for ExtractedBackup {
+    fn drop(&mut self) {
+        tracing::debug!("removing extracted backup in '{}'", self.dir.display());
+        if let Err(e) = std::fs::remove_dir_all(&self.dir) {
+            tracing::warn!(
+                "failed to remove extracted backup in '{}': {}",
+                self.dir.display(),
+                e
+            );
+        }
+    }
+}
+
+/// Find the cometbft directory in an extracted backup, looking inside a single top directory too.
+fn find_extracted_cometbft_dir(dir: &Path) -> anyhow::Result<PathBuf> {
+    let err = match find_cometbft_dir(dir) {
+        Ok(x) => return Ok(x),
+        Err(e) => e,
+    };
+    let entries: Vec<_> = std::fs::read_dir(dir)?.collect::<Result<_, _>>()?;
+    match entries.as_slice() {
+        [entry] if entry.file_type()?.is_dir() => find_cometbft_dir(&entry.path()),
+        _ => Err(err),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use flate2::{write::GzEncoder, Compression};
+
+    use super::*;
+    use crate::cometbft::{
+        test_node_home, LocalStore, LocalStoreGenesisLocation, LocalStoreOpts, Store as _,
+    };
+
+    /// Pack a node home into a tar archive, inside of a directory, as `tar -C <parent>` would.
+    fn pack(home: &Path, prefix: &str, path: &Path, gzip: bool) -> anyhow::Result<()> {
+        let file = File::create(path)?;
+        if gzip {
+            let mut builder = tar::Builder::new(GzEncoder::new(file, Compression::fast()));
+            builder.append_dir_all(prefix, home)?;
+            builder.into_inner()?.finish()?;
+        } else {
+            let mut builder = tar::Builder::new(file);
+            builder.append_dir_all(prefix, home)?;
+            builder.into_inner()?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_store_opens_from_compressed_backup() -> anyhow::Result<()> {
+        let home = test_node_home("backup", true)?;
+        let tmp = std::env::temp_dir();
+        for (name, prefix, gzip) in [
+            ("backup.tar.gz", ".", true),
+            ("backup.tar", ".", false),
+            ("backup-nested.tar.gz", "node0", true),
+        ] {
+            let backup = tmp.join(format!(
+                "penumbra-reindexer-test-{}-{}",
+                std::process::id(),
+                name
+            ));
+            pack(&home, prefix, &backup, gzip)?;
+            let dir = tmp.join(format!(
+                "penumbra-reindexer-test-extracted-{}",
+                std::process::id()
+            ));
+            let extracted = ExtractedBackup::extract(&backup, &dir)?;
+            assert!(extracted.cometbft_dir().ends_with("cometbft"), "{}", name);
+            {
+                let store = LocalStore::init(
+                    extracted.cometbft_dir(),
+                    LocalStoreGenesisLocation::FromConfig,
+                    LocalStoreOpts {
+                        read_only: true,
+                        db_name: None,
+                        max_block_bytes: None,
+                        db_options: Default::default(),
+                    },
+                )?;
+                assert_eq!(store.get_height_bounds().await?, Some((1, 5)), "{}", name);
+                assert_eq!(store.get_genesis().await?.chain_id(), "penumbra-1");
+            }
+            drop(extracted);
+            assert!(!dir.exists(), "{}", name);
+            std::fs::remove_file(&backup)?;
+        }
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_backup_without_cometbft_data_is_rejected() -> anyhow::Result<()> {
+        let tmp = std::env::temp_dir();
+        let backup = tmp.join(format!(
+            "penumbra-reindexer-test-{}-empty-backup.tar",
+            std::process::id()
+        ));
+        let mut builder = tar::Builder::new(File::create(&backup)?);
+        let data = b"not a node";
+        let mut header = tar::Header::new_gnu();
+        header.set_size(data.len() as u64);
+        header.set_cksum();
+        builder.append_data(&mut header, "README", data.as_slice())?;
+        builder.into_inner()?;
+
+        let dir = tmp.join(format!(
+            "penumbra-reindexer-test-extracted-empty-{}",
+            std::process::id()
+        ));
+        let err = ExtractedBackup::extract(&backup, &dir).expect_err("there's no node in it");
+        assert!(
+            format!("{:#}", err).contains("no cometbft data found in backup"),
+            "{:#}",
+            err
+        );
+        // What was extracted is cleaned up all the same.
+        assert!(!dir.exists());
+
+        std::fs::write(&backup, [0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0])?;
+        let err = ExtractedBackup::extract(&backup, &dir).expect_err("zstd isn't supported");
+        assert!(err.to_string().contains("zstd"), "{:#}", err);
+        assert!(!dir.exists());
+        std::fs::remove_file(&backup)?;
+        Ok(())
+    }
+}
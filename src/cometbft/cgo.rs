@@ -0,0 +1,2047 @@
+//! The block store reader, linked in from the Go code through cgo.
+use anyhow::{anyhow, Context};
+use std::ffi::c_void;
+use std::marker::PhantomData;
+use std::ops::{Deref, DerefMut};
+use std::path::Path;
+
+use super::{
+    block_exceeds_limit, decode_gaps, decode_size_stats, BlockSizeStats, DbOptions,
+    BLOCK_HASH_SIZE, EXPECTED_BLOCK_PROTO_SIZE,
+};
+
+#[link(name = "cometbft", kind = "static")]
+extern "C" {
+    fn c_store_new(
+        dir_ptr: *const u8,
+        dir_len: i32,
+        backend_ptr: *const u8,
+        backend_len: i32,
+        db_name_ptr: *const u8,
+        db_name_len: i32,
+        read_only: i32,
+    ) -> usize;
+    fn c_store_new_named(
+        name_ptr: *const u8,
+        name_len: i32,
+        dir_ptr: *const u8,
+        dir_len: i32,
+        backend_ptr: *const u8,
+        backend_len: i32,
+        db_name_ptr: *const u8,
+        db_name_len: i32,
+        read_only: i32,
+    ) -> usize;
+    fn c_store_open_existing(
+        dir_ptr: *const u8,
+        dir_len: i32,
+        backend_ptr: *const u8,
+        backend_len: i32,
+        db_name_ptr: *const u8,
+        db_name_len: i32,
+        read_only: i32,
+        block_cache_size: i64,
+        disable_compaction: i32,
+        compression_ptr: *const u8,
+        compression_len: i32,
+        fallback: i32,
+        out_ptr: *mut usize,
+    ) -> i32;
+    fn c_store_last_error(ptr: usize, out_ptr: *mut u8, out_cap: i32) -> i32;
+    fn c_store_height_range(ptr: usize, out_first: *mut i64, out_last: *mut i64);
+    fn c_store_block_by_height(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_blocks_range(
+        ptr: usize,
+        start: i64,
+        end: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_next: *mut i64,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_blocks_by_heights(
+        ptr: usize,
+        heights_ptr: *const i64,
+        heights_len: i32,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_block_by_height_compressed(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_block_meta_by_height(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_commit_by_height(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_seen_commit_by_height(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_extended_commit_by_height(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_block_by_hash(
+        ptr: usize,
+        hash_ptr: *const u8,
+        hash_len: i32,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_register_buffer(ptr: usize, buf_ptr: *mut u8, buf_cap: i32);
+    fn c_store_block_by_height_registered(ptr: usize, height: i64, out_needed: *mut i64) -> i32;
+    fn c_store_evidence_by_height(
+        ptr: usize,
+        height: i64,
+        out_ptr: *mut u8,
+        out_cap: i32,
+        out_needed: *mut i64,
+    ) -> i32;
+    fn c_store_stream_blocks(
+        ptr: usize,
+        start: i64,
+        end: i64,
+        cb: extern "C" fn(*mut c_void, *const u8, i32, i64) -> i32,
+        ctx: *mut c_void,
+        out_next: *mut i64,
+    ) -> i32;
+    fn c_store_cancel(ptr: usize);
+    fn c_store_set_progress(
+        ptr: usize,
+        every: i64,
+        cb: Option<extern "C" fn(*mut c_void, i64)>,
+        ctx: *mut c_void,
+    );
+    fn c_store_set_progress_cb(
+        ptr: usize,
+        cb: Option<extern "C" fn(*mut c_void, i64, i64)>,
+        ctx: *mut c_void,
+    );
+    fn c_store_gaps(ptr: usize, out_ptr: *mut u8, out_cap: i32, out_needed: *mut i64) -> i32;
+    fn c_store_size_stats(ptr: usize, out_ptr: *mut u8, out_cap: i32, out_needed: *mut i64) -> i32;
+    fn c_store_prune_blocks(ptr: usize, height: i64, out_pruned: *mut i64) -> i32;
+    fn c_store_validate(ptr: usize) -> i32;
+    fn c_store_app_height(ptr: usize, out_height: *mut i64) -> i32;
+    fn c_store_set_max_block_size(ptr: usize, size: i64);
+    fn c_store_genesis_doc(ptr: usize, out_ptr: *mut u8, out_cap: i32, out_needed: *mut i64)
+        -> i32;
+    fn c_store_save_block(
+        ptr: usize,
+        block_ptr: *const u8,
+        block_len: i32,
+        commit_ptr: *const u8,
+        commit_len: i32,
+    ) -> i32;
+    fn c_store_backend(ptr: usize, out_ptr: *mut u8, out_cap: i32) -> i32;
+    fn c_store_block_part_set_header(
+        ptr: usize,
+        height: i64,
+        out_total: *mut i64,
+        out_hash: *mut u8,
+        out_size: *mut i64,
+    ) -> i32;
+    fn c_store_snapshot(ptr: usize, out_ptr: *mut usize) -> i32;
+    fn c_store_cursor_open(ptr: usize, start: i64, out_ptr: *mut usize) -> i32;
+    fn c_store_cursor_next(ptr: usize, out_ptr: *mut u8, out_cap: i32, out_needed: *mut i64)
+        -> i32;
+    fn c_store_cursor_close(ptr: usize);
+    fn c_store_chain_id(ptr: usize, out_ptr: *mut u8, out_cap: i32) -> i32;
+    fn c_store_hash_by_height(ptr: usize, height: i64, out_ptr: *mut u8) -> i32;
+    fn c_store_delete(ptr: usize);
+    fn c_store_detect_backend(
+        dir_ptr: *const u8,
+        dir_len: i32,
+        out_ptr: *mut u8,
+        out_cap: i32,
+    ) -> i32;
+    fn c_block_hash(block_ptr: *const u8, block_len: i32, out_ptr: *mut u8) -> i32;
+    fn c_verify_block_hashes(
+        block_ptr: *const u8,
+        block_len: i32,
+        id_ptr: *const u8,
+        id_len: i32,
+    ) -> i32;
+}
+
+/// How many bytes of an error message we're willing to read back from the Go side.
+const MAX_ERROR_MESSAGE_SIZE: usize = 4096;
+
+// Result codes returned by the Go side, mirroring `BlockResult` in go/store/store.go.
+const BLOCK_NOT_FOUND: i32 = -1;
+const BLOCK_TOO_BIG: i32 = -2;
+const BLOCK_INVALID_HASH: i32 = -3;
+const BLOCK_ERROR: i32 = -4;
+const STORE_NOT_FOUND: i32 = -5;
+const HEIGHT_OVERFLOW: i32 = -6;
+const BLOCK_EXCEEDS_LIMIT: i32 = -7;
+const BLOCK_CANCELLED: i32 = -8;
+const BLOCK_BEYOND_RANGE: i32 = -9;
+
+/// The size of the length prefix before each block the Go side packs into a buffer.
+const RANGE_PREFIX_SIZE: usize = 4;
+
+/// Retrieve the last error the Go side recorded for a handle.
+///
+/// A null handle retrieves the error from the last failed attempt to open a store.
+fn last_error(handle: usize) -> anyhow::Error {
+    let mut buf = vec![0u8; MAX_ERROR_MESSAGE_SIZE];
+    let len = unsafe {
+        // Safety: the Go side will not write past the capacity we give it here.
+        c_store_last_error(
+            handle,
+            buf.as_mut_ptr(),
+            i32::try_from(buf.len()).expect("error buffer size should fit into an i32"),
+        )
+    };
+    buf.truncate(usize::try_from(len).unwrap_or(0));
+    anyhow!("cometbft store: {}", String::from_utf8_lossy(&buf))
+}
+
+/// Guess which cometbft-db backend created the block store in a cometbft data directory.
+pub fn detect_backend(data_dir: &Path) -> anyhow::Result<String> {
+    let dir_bytes = data_dir.as_os_str().as_encoded_bytes();
+    // Backend names are short, so this is plenty.
+    let mut buf = vec![0u8; 64];
+    let res = unsafe {
+        // Safety: the Go side copies the directory, and doesn't write past the capacity we report.
+        c_store_detect_backend(
+            dir_bytes.as_ptr(),
+            i32::try_from(dir_bytes.len()).context("directory length should fit into an i32")?,
+            buf.as_mut_ptr(),
+            i32::try_from(buf.len()).expect("buffer size should fit into an i32"),
+        )
+    };
+    if res < 0 {
+        return Err(last_error(0)).context(format!(
+            "failed to detect the backend of the block store in '{}'",
+            data_dir.display()
+        ));
+    }
+    buf.truncate(usize::try_from(res)?);
+    Ok(String::from_utf8(buf)?)
+}
+
+/// Compute the hash of an encoded block.
+pub fn block_hash(data: &[u8]) -> anyhow::Result<[u8; BLOCK_HASH_SIZE]> {
+    let mut out = [0u8; BLOCK_HASH_SIZE];
+    let res = unsafe {
+        // Safety: the Go side copies the block before using it, and writes
+        // exactly BLOCK_HASH_SIZE bytes into the output.
+        c_block_hash(
+            data.as_ptr(),
+            i32::try_from(data.len()).context("block length should fit into an i32")?,
+            out.as_mut_ptr(),
+        )
+    };
+    if res < 0 {
+        return Err(last_error(0));
+    }
+    Ok(out)
+}
+
+/// Check that an encoded block hashes to what its header claims, and to its ID, if given.
+pub fn verify_block_hashes(data: &[u8], block_id: Option<&[u8]>) -> anyhow::Result<()> {
+    let block_id = block_id.unwrap_or_default();
+    let res = unsafe {
+        // Safety: the Go side copies both the block and the ID before using them.
+        c_verify_block_hashes(
+            data.as_ptr(),
+            i32::try_from(data.len()).context("block length should fit into an i32")?,
+            block_id.as_ptr(),
+            i32::try_from(block_id.len()).context("block ID length should fit into an i32")?,
+        )
+    };
+    if res < 0 {
+        return Err(last_error(0));
+    }
+    Ok(())
+}
+
+/// How a call to [RawStore::stream_blocks] ended.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum StreamEnd {
+    /// The stream got to its end, or the callback stopped it, having passed on `count` blocks.
+    Finished { count: u64, next: i64 },
+    /// A [Canceller] stopped the stream, before it got to the block at `next`.
+    Cancelled { next: i64 },
+}
+
+/// How a block was split into parts to be gossiped during consensus, as its metadata records.
+#[derive(Clone, Debug, PartialEq)]
+pub struct PartSetHeader {
+    /// The number of parts.
+    pub total: u32,
+    /// The merkle root of the parts.
+    pub hash: Vec<u8>,
+    /// The size of the encoded block, which the parts are cut from.
+    pub block_size: u64,
+}
+
+/// Cancels the range operations in progress on a [RawStore], from any thread.
+///
+/// Operations started after cancelling aren't affected.
+#[derive(Clone, Copy)]
+pub struct Canceller<'s> {
+    handle: usize,
+    _store: PhantomData<&'s RawStore>,
+}
+
+impl Canceller<'_> {
+    pub fn cancel(&self) {
+        unsafe {
+            // Safety: the lifetime keeps the store, and thus the handle, alive,
+            // and the Go side allows cancelling while another call is in progress.
+            c_store_cancel(self.handle);
+        }
+    }
+}
+
+// Safety: cancelling only touches an atomic counter on the Go side.
+unsafe impl Send for Canceller<'_> {}
+unsafe impl Sync for Canceller<'_> {}
+
+/// Reads the blocks of a [RawStore] one at a time, in order, picking up where it left off.
+///
+/// Unlike [RawStore::stream_blocks], nothing is held on the Go side between blocks, so reading
+/// can pause for as long as needed. Several cursors can be open on a store at once, each with
+/// its own position, and dropping one closes only it.
+pub struct BlockCursor<'s> {
+    handle: usize,
+    /// The handle of the store, which the Go side records the errors of the cursor in.
+    store: usize,
+    buf: Vec<u8>,
+    max_block_size: u64,
+    /// The height of the block read next.
+    height: i64,
+    _store: PhantomData<&'s RawStore>,
+}
+
+impl BlockCursor<'_> {
+    /// The height of the block [Self::next_block] reads.
+    #[allow(dead_code)]
+    pub fn height(&self) -> i64 {
+        self.height
+    }
+
+    /// Read the block the cursor is at, with its height, moving on to the next height.
+    ///
+    /// At a height without a block, past the end of the store, or in a gap, this returns
+    /// [Option::None], and the cursor stays there, so that it reads the block once it's saved.
+    #[allow(dead_code)]
+    pub fn next_block(&mut self) -> anyhow::Result<Option<(i64, &[u8])>> {
+        let handle = self.handle;
+        let height = self.height;
+        let block = read_into(
+            self.store,
+            &mut self.buf,
+            self.max_block_size,
+            |_, out_ptr, out_cap, needed| unsafe {
+                // Safety: read_into provides a buffer with at least out_cap bytes of capacity,
+                // and the &mut keeps calls on this cursor from overlapping.
+                c_store_cursor_next(handle, out_ptr, out_cap, needed)
+            },
+        )?;
+        let Some(data) = block else {
+            return Ok(None);
+        };
+        self.height += 1;
+        Ok(Some((height, data)))
+    }
+}
+
+impl Drop for BlockCursor<'_> {
+    fn drop(&mut self) {
+        unsafe {
+            // Safety: the lifetime keeps the store alive until the cursor is closed.
+            c_store_cursor_close(self.handle);
+        }
+    }
+}
+
+// Safety: a [BlockCursor] contains a unique handle to its cursor, and the store it reads from
+// is safe to use from several threads at once.
+unsafe impl Send for BlockCursor<'_> {}
+
+/// A snapshot of a [RawStore], from [RawStore::snapshot], reading the store as it was then.
+///
+/// It reads like a store of its own, but can't be written to, and the lifetime keeps the store
+/// it was taken of open until it's dropped.
+pub struct Snapshot<'s> {
+    inner: RawStore,
+    _store: PhantomData<&'s RawStore>,
+}
+
+impl Deref for Snapshot<'_> {
+    type Target = RawStore;
+
+    fn deref(&self) -> &RawStore {
+        &self.inner
+    }
+}
+
+impl DerefMut for Snapshot<'_> {
+    fn deref_mut(&mut self) -> &mut RawStore {
+        &mut self.inner
+    }
+}
+
+/// A function told about the height range operations have reached.
+type ProgressFn = Box<dyn Fn(i64) + Send + Sync>;
+
+/// A function told about the height range operations have reached, and the last they'll reach.
+type RangeProgressFn = Box<dyn Fn(i64, i64) + Send + Sync>;
+
+/// A wrapper around the FFI for the cometbft store.
+///
+/// This uses unsafe internally, but presents a safe interface.
+pub struct RawStore {
+    handle: usize,
+    buf: Vec<u8>,
+    /// The address and capacity of the buffer registered with the Go side, for reading blocks.
+    ///
+    /// Growing the buffer moves it, so it's registered again before the next block is read.
+    registered: (usize, i32),
+    /// The maximum block size given to the Go side, or 0 if there's none.
+    max_block_size: u64,
+    /// The progress function given to the Go side, kept alive for as long as it's there.
+    progress: Option<Box<ProgressFn>>,
+    /// The function given to the Go side with [Self::set_range_progress], kept alive likewise.
+    range_progress: Option<Box<RangeProgressFn>>,
+}
+
+impl RawStore {
+    /// Open the existing store in a directory, failing if there's no store there.
+    ///
+    /// `db_name` is the name of the database holding the store, usually [DEFAULT_BLOCKSTORE_NAME].
+    pub fn new(backend: &str, dir: &Path, db_name: &str, read_only: bool) -> anyhow::Result<Self> {
+        Self::with_options(backend, dir, db_name, read_only, &DbOptions::default())
+    }
+
+    /// Open the existing store in a directory, like [Self::new], tuning its database with options.
+    pub fn with_options(
+        backend: &str,
+        dir: &Path,
+        db_name: &str,
+        read_only: bool,
+        options: &DbOptions,
+    ) -> anyhow::Result<Self> {
+        let dir_bytes = dir.as_os_str().as_encoded_bytes();
+        let block_cache_size = i64::try_from(options.block_cache_bytes.unwrap_or(0))
+            .context("block cache size should fit into an i64")?;
+        let compression = options.compression.as_deref().unwrap_or("");
+        let mut handle = 0usize;
+        let res = unsafe {
+            // Safety: the Go side of things will immediately copy the data, and not write into it,
+            // or read past the provided bounds.
+            c_store_open_existing(
+                dir_bytes.as_ptr(),
+                i32::try_from(dir_bytes.len())
+                    .context("directory length should fit into an i32")?,
+                backend.as_ptr(),
+                i32::try_from(backend.len()).context("backend type should fit into an i32")?,
+                db_name.as_ptr(),
+                i32::try_from(db_name.len()).context("database name should fit into an i32")?,
+                i32::from(read_only),
+                block_cache_size,
+                i32::from(options.disable_compaction),
+                compression.as_ptr(),
+                i32::try_from(compression.len()).context("compression should fit into an i32")?,
+                i32::from(!options.strict_backend),
+                &mut handle,
+            )
+        };
+        match res {
+            0 => {}
+            STORE_NOT_FOUND => {
+                return Err(last_error(0)).context(format!(
+                    "no cometbft block store at '{}'; is this the right directory?",
+                    dir.display()
+                ));
+            }
+            _ => {
+                return Err(last_error(0)).context(format!(
+                    "failed to open cometbft store at '{}'",
+                    dir.display()
+                ));
+            }
+        }
+        Ok(Self {
+            handle,
+            buf: Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE),
+            registered: (0, 0),
+            max_block_size: 0,
+            progress: None,
+            range_progress: None,
+        })
+    }
+
+    /// Open the store in a directory for writing, creating an empty one if there's none there.
+    pub fn create(backend: &str, dir: &Path, db_name: &str) -> anyhow::Result<Self> {
+        let dir_bytes = dir.as_os_str().as_encoded_bytes();
+        let handle = unsafe {
+            // Safety: the Go side of things will immediately copy the data, and not write into it,
+            // or read past the provided bounds.
+            c_store_new(
+                dir_bytes.as_ptr(),
+                i32::try_from(dir_bytes.len())
+                    .context("directory length should fit into an i32")?,
+                backend.as_ptr(),
+                i32::try_from(backend.len()).context("backend type should fit into an i32")?,
+                db_name.as_ptr(),
+                i32::try_from(db_name.len()).context("database name should fit into an i32")?,
+                0,
+            )
+        };
+        if handle == 0 {
+            return Err(last_error(0)).context(format!(
+                "failed to create cometbft store at '{}'",
+                dir.display()
+            ));
+        }
+        Ok(Self {
+            handle,
+            buf: Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE),
+            registered: (0, 0),
+            max_block_size: 0,
+            progress: None,
+            range_progress: None,
+        })
+    }
+
+    /// Open the store in a directory, like [Self::create], but naming it in every error it returns.
+    ///
+    /// This tells apart the stores of a process which opens several at once.
+    #[allow(dead_code)]
+    pub fn named(
+        name: &str,
+        backend: &str,
+        dir: &Path,
+        db_name: &str,
+        read_only: bool,
+    ) -> anyhow::Result<Self> {
+        let dir_bytes = dir.as_os_str().as_encoded_bytes();
+        let handle = unsafe {
+            // Safety: the Go side of things will immediately copy the data, and not write into it,
+            // or read past the provided bounds.
+            c_store_new_named(
+                name.as_ptr(),
+                i32::try_from(name.len()).context("store name should fit into an i32")?,
+                dir_bytes.as_ptr(),
+                i32::try_from(dir_bytes.len())
+                    .context("directory length should fit into an i32")?,
+                backend.as_ptr(),
+                i32::try_from(backend.len()).context("backend type should fit into an i32")?,
+                db_name.as_ptr(),
+                i32::try_from(db_name.len()).context("database name should fit into an i32")?,
+                i32::from(read_only),
+            )
+        };
+        if handle == 0 {
+            return Err(last_error(0)).context(format!(
+                "failed to open cometbft store '{}' at '{}'",
+                name,
+                dir.display()
+            ));
+        }
+        Ok(Self {
+            handle,
+            buf: Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE),
+            registered: (0, 0),
+            max_block_size: 0,
+            progress: None,
+            range_progress: None,
+        })
+    }
+
+    /// Append an encoded block, and the encoded commit seen for it, to the store.
+    ///
+    /// This only needs a shared reference, so that blocks can be saved while a [Snapshot]
+    /// of the store is open.
+    pub fn save_block(&self, block: &[u8], commit: &[u8]) -> anyhow::Result<()> {
+        let res = unsafe {
+            // Safety: the Go side copies both buffers before doing anything with them,
+            // and doesn't read past the provided bounds. Nothing on this side is touched.
+            c_store_save_block(
+                self.handle,
+                block.as_ptr(),
+                i32::try_from(block.len()).context("block size should fit into an i32")?,
+                commit.as_ptr(),
+                i32::try_from(commit.len()).context("commit size should fit into an i32")?,
+            )
+        };
+        match res {
+            0 => Ok(()),
+            _ => Err(last_error(self.handle)),
+        }
+    }
+
+    /// Open a snapshot of the store, reading it as it is now, even as blocks are saved to it after.
+    ///
+    /// Only the goleveldb backend supports snapshots. The snapshot can't be written to,
+    /// and the store stays open for as long as the snapshot is.
+    #[allow(dead_code)]
+    pub fn snapshot(&self) -> anyhow::Result<Snapshot<'_>> {
+        let mut handle = 0usize;
+        let res = unsafe {
+            // Safety: the Go side reads the snapshot through a handle of its own,
+            // and the lifetime of the snapshot keeps the store alive.
+            c_store_snapshot(self.handle, &mut handle)
+        };
+        match res {
+            0 => Ok(Snapshot {
+                inner: Self {
+                    handle,
+                    buf: Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE),
+                    registered: (0, 0),
+                    max_block_size: self.max_block_size,
+                    progress: None,
+                    range_progress: None,
+                },
+                _store: PhantomData,
+            }),
+            _ => Err(last_error(self.handle)),
+        }
+    }
+
+    /// Open a cursor reading the blocks of the store one at a time, from the block at start.
+    ///
+    /// This fails for a start above the largest height the Go side takes.
+    #[allow(dead_code)]
+    pub fn cursor(&self, start: i64) -> anyhow::Result<BlockCursor<'_>> {
+        let mut handle = 0usize;
+        let res = unsafe {
+            // Safety: the Go side allows several cursors to read from a store at once,
+            // and the lifetime of the cursor keeps the store alive.
+            c_store_cursor_open(self.handle, start, &mut handle)
+        };
+        match res {
+            0 => Ok(BlockCursor {
+                handle,
+                store: self.handle,
+                buf: Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE),
+                max_block_size: self.max_block_size,
+                height: start,
+                _store: PhantomData,
+            }),
+            _ => Err(last_error(self.handle)),
+        }
+    }
+
+    /// Read the first and last heights of the store, consistently with each other.
+    pub fn height_range(&mut self) -> anyhow::Result<(i64, i64)> {
+        let mut first = 0i64;
+        let mut last = 0i64;
+        unsafe {
+            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
+            c_store_height_range(self.handle, &mut first, &mut last);
+        }
+        Ok((first, last))
+    }
+
+    /// Check that the blocks at the first and last heights of the store actually load.
+    pub fn validate(&mut self) -> anyhow::Result<()> {
+        let res = unsafe {
+            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
+            c_store_validate(self.handle)
+        };
+        match res {
+            0 => Ok(()),
+            _ => Err(last_error(self.handle)),
+        }
+    }
+
+    /// The type of the backend the store was opened with.
+    pub fn backend(&mut self) -> anyhow::Result<String> {
+        // Backend names are short, so this is plenty.
+        let mut buf = vec![0u8; 64];
+        let res = unsafe {
+            // Safety: the Go side doesn't write past the capacity we report.
+            c_store_backend(
+                self.handle,
+                buf.as_mut_ptr(),
+                i32::try_from(buf.len()).expect("buffer size should fit into an i32"),
+            )
+        };
+        anyhow::ensure!(res >= 0, "the name of the store's backend is too long");
+        buf.truncate(usize::try_from(res)?);
+        Ok(String::from_utf8(buf)?)
+    }
+
+    /// Read the chain id from the header of the first block in the store.
+    ///
+    /// This fails if the store has no blocks.
+    pub fn chain_id(&mut self) -> anyhow::Result<String> {
+        // Chain ids are at most 50 bytes, so this is plenty.
+        let mut buf = vec![0u8; 64];
+        let res = unsafe {
+            // Safety: the Go side doesn't write past the capacity we report.
+            c_store_chain_id(
+                self.handle,
+                buf.as_mut_ptr(),
+                i32::try_from(buf.len()).expect("buffer size should fit into an i32"),
+            )
+        };
+        match res {
+            BLOCK_TOO_BIG => anyhow::bail!("the chain id of the store is too long"),
+            x if x < 0 => Err(last_error(self.handle)),
+            len => {
+                buf.truncate(len as usize);
+                Ok(String::from_utf8(buf)?)
+            }
+        }
+    }
+
+    /// Read the hash of the block at a given height, as recorded in its metadata, as its ID.
+    pub fn hash_by_height(&mut self, height: i64) -> anyhow::Result<Option<[u8; BLOCK_HASH_SIZE]>> {
+        let mut hash = [0u8; BLOCK_HASH_SIZE];
+        let res = unsafe {
+            // Safety: the Go side writes exactly BLOCK_HASH_SIZE bytes of hash.
+            c_store_hash_by_height(self.handle, height, hash.as_mut_ptr())
+        };
+        match res {
+            BLOCK_NOT_FOUND | BLOCK_BEYOND_RANGE => Ok(None),
+            x if x < 0 => Err(last_error(self.handle)),
+            _ => Ok(Some(hash)),
+        }
+    }
+
+    /// Read the part set header of the block at a given height, if there's such a block.
+    ///
+    /// This only reads the block's metadata, not the block itself.
+    #[allow(dead_code)]
+    pub fn block_part_set_header(&mut self, height: i64) -> anyhow::Result<Option<PartSetHeader>> {
+        let mut total = 0i64;
+        let mut hash = vec![0u8; BLOCK_HASH_SIZE];
+        let mut size = 0i64;
+        let res = unsafe {
+            // Safety: the Go side writes at most BLOCK_HASH_SIZE bytes of hash.
+            c_store_block_part_set_header(
+                self.handle,
+                height,
+                &mut total,
+                hash.as_mut_ptr(),
+                &mut size,
+            )
+        };
+        match res {
+            BLOCK_NOT_FOUND | BLOCK_BEYOND_RANGE => Ok(None),
+            x if x < 0 => Err(last_error(self.handle)),
+            len => {
+                hash.truncate(len as usize);
+                Ok(Some(PartSetHeader {
+                    total: total.try_into()?,
+                    hash,
+                    block_size: size.try_into()?,
+                }))
+            }
+        }
+    }
+
+    /// Read the height of the last block applied to the application, if there's state recorded.
+    pub fn app_height(&mut self) -> anyhow::Result<Option<i64>> {
+        let mut height = 0i64;
+        let res = unsafe {
+            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
+            c_store_app_height(self.handle, &mut height)
+        };
+        match res {
+            0 => Ok(Some(height)),
+            BLOCK_NOT_FOUND => Ok(None),
+            _ => Err(last_error(self.handle)),
+        }
+    }
+
+    /// Make reading blocks larger than a given size fail, rather than allocate for them.
+    ///
+    /// A size of 0 removes the limit.
+    pub fn set_max_block_size(&mut self, size: u64) -> anyhow::Result<()> {
+        let go_size = i64::try_from(size).context("maximum block size should fit into an i64")?;
+        unsafe {
+            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
+            c_store_set_max_block_size(self.handle, go_size);
+        }
+        self.max_block_size = size;
+        Ok(())
+    }
+
+    /// Read the encoded block at a given height, if there is one.
+    ///
+    /// Blocks are read far more often than anything else, so they're written into our buffer
+    /// as registered with the Go side, rather than passing the buffer along with every call.
+    pub fn block_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        let registered = &mut self.registered;
+        read_into(
+            self.handle,
+            &mut self.buf,
+            self.max_block_size,
+            |handle, out_ptr, out_cap, needed| unsafe {
+                // Safety: the Go side only writes into the buffer during the calls below, while
+                // it's the one registered, and the store is deleted before the buffer is dropped.
+                if *registered != (out_ptr as usize, out_cap) {
+                    c_store_register_buffer(handle, out_ptr, out_cap);
+                    *registered = (out_ptr as usize, out_cap);
+                }
+                c_store_block_by_height_registered(handle, height, needed)
+            },
+        )
+    }
+
+    /// Read the block at a given height, compressed by the Go side, if there is one.
+    ///
+    /// Blocks which compression wouldn't make smaller are returned as they are; decompressing
+    /// with `decompress_block` handles both. The maximum block size applies to the block itself.
+    pub fn block_by_height_compressed(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_block_by_height_compressed(handle, height, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Read the encoded metadata of the block at a given height, if there is one.
+    ///
+    /// This is far smaller than the block, and read without loading the block itself.
+    #[allow(dead_code)]
+    pub fn block_meta_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_block_meta_by_height(handle, height, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Read the encoded commit for the block at a given height, if there is one.
+    ///
+    /// This is the commit the block at the next height includes as its last commit,
+    /// so the last block of a store has none.
+    #[allow(dead_code)]
+    pub fn commit_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_commit_by_height(handle, height, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Read the encoded commit the node saw for the block at a given height, if there is one.
+    ///
+    /// Only the last block of a store is guaranteed to have one.
+    pub fn seen_commit_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_seen_commit_by_height(handle, height, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Read the extended commit, with vote extensions, for a given height, if there is one.
+    ///
+    /// Nodes only save these from cometbft 0.38 on, while vote extensions are enabled.
+    pub fn extended_commit_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_extended_commit_by_height(handle, height, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Remove every block below a given height, returning how many were removed.
+    ///
+    /// The block at height becomes the first of the store, so it has to be in the store.
+    #[allow(dead_code)]
+    pub fn prune_blocks(&mut self, height: i64) -> anyhow::Result<u64> {
+        let mut pruned = 0i64;
+        let res = unsafe {
+            // Safety: because we take mutable ownership, we avoid any shenanigans on the Go side.
+            c_store_prune_blocks(self.handle, height, &mut pruned)
+        };
+        match res {
+            0 => Ok(pruned.try_into()?),
+            _ => Err(last_error(self.handle)),
+        }
+    }
+
+    /// Read the encoded block with a given hash, if there is one.
+    ///
+    /// This fails if the hash isn't BLOCK_HASH_SIZE bytes long, as no block could have it.
+    #[allow(dead_code)]
+    pub fn block_by_hash(&mut self, hash: &[u8]) -> anyhow::Result<Option<&[u8]>> {
+        let hash_len = i32::try_from(hash.len()).context("block hash should fit into an i32")?;
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: the Go side copies the hash before returning, and read_into_buf provides
+            // a buffer with at least out_cap bytes of capacity.
+            c_store_block_by_hash(handle, hash.as_ptr(), hash_len, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Read the evidence committed in the block at a given height, if there's any.
+    pub fn evidence_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_evidence_by_height(handle, height, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Read the genesis saved by the node, if there is one.
+    pub fn genesis_doc(&mut self) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+            // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+            c_store_genesis_doc(handle, out_ptr, out_cap, needed)
+        })
+    }
+
+    /// Find the ranges of heights missing between the first and last heights of the store.
+    ///
+    /// Each range is inclusive on both ends.
+    pub fn gaps(&mut self) -> anyhow::Result<Vec<(i64, i64)>> {
+        let data = self
+            .read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+                // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+                c_store_gaps(handle, out_ptr, out_cap, needed)
+            })?
+            .unwrap_or_default();
+        Ok(decode_gaps(data))
+    }
+
+    /// Sum up the sizes of the blocks in the store, from their metadata, without loading them.
+    pub fn size_stats(&mut self) -> anyhow::Result<BlockSizeStats> {
+        let data = self
+            .read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+                // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+                c_store_size_stats(handle, out_ptr, out_cap, needed)
+            })?
+            .unwrap_or_default();
+        decode_size_stats(data)
+    }
+
+    /// Read the encoded blocks between two heights (inclusive), in order, with their heights.
+    ///
+    /// Reading stops before the first height without a block, or past the last height of the
+    /// store, so the blocks returned are contiguous from start, and fewer than asked for if it
+    /// stopped early. As many blocks as fit are read with each call to the Go side, into a buffer
+    /// of their own, like [Self::blocks_by_heights], rather than crossing over for every block.
+    pub fn blocks_range(&mut self, start: i64, end: i64) -> anyhow::Result<Vec<(i64, Vec<u8>)>> {
+        let mut out = Vec::new();
+        let mut buf = vec![0u8; self.buf.capacity().max(RANGE_PREFIX_SIZE)];
+        let mut height = start;
+        while height <= end {
+            let mut next = 0i64;
+            let mut needed = 0i64;
+            let res = unsafe {
+                // Safety: the Go side doesn't write past the capacity we give it.
+                c_store_blocks_range(
+                    self.handle,
+                    height,
+                    end,
+                    buf.as_mut_ptr(),
+                    i32::try_from(buf.len()).context("buffer size should fit into an i32")?,
+                    &mut next,
+                    &mut needed,
+                )
+            };
+            let count = match res {
+                BLOCK_CANCELLED => {
+                    anyhow::bail!("reading blocks {}..={} was cancelled", start, end)
+                }
+                x if x < 0 => return Err(last_error(self.handle)),
+                count => count as usize,
+            };
+            // Blocks are never empty, so every entry of a range holds one.
+            out.extend(
+                (height..)
+                    .zip(decode_entries(&buf, count))
+                    .map(|(height, entry)| (height, entry.unwrap_or_default())),
+            );
+            anyhow::ensure!(
+                next == height + count as i64,
+                "cometbft store read {} blocks from height {}, but stopped before height {}",
+                count,
+                height,
+                next
+            );
+            height = next;
+            // Nothing more being needed means reading stopped at a missing block, or the end.
+            if needed == 0 {
+                break;
+            }
+            if count == 0 {
+                let needed =
+                    usize::try_from(needed).context("needed size should fit into usize")?;
+                buf.resize(needed.max(2 * buf.len()), 0);
+            }
+        }
+        Ok(out)
+    }
+
+    /// Read the encoded blocks at a set of heights, in the order given, with None for those missing.
+    ///
+    /// The heights don't have to be contiguous, or in order. As many blocks as fit are read
+    /// with each call to the Go side, into a buffer of their own, so that the one registered
+    /// for [Self::block_by_height] stays put.
+    #[allow(dead_code)]
+    pub fn blocks_by_heights(&mut self, heights: &[i64]) -> anyhow::Result<Vec<Option<Vec<u8>>>> {
+        let mut out = Vec::with_capacity(heights.len());
+        let mut buf = vec![0u8; self.buf.capacity().max(RANGE_PREFIX_SIZE)];
+        while out.len() < heights.len() {
+            let remaining = &heights[out.len()..];
+            let mut needed = 0i64;
+            let res = unsafe {
+                // Safety: the Go side only reads remaining.len() heights, and doesn't write
+                // past the capacity we give it.
+                c_store_blocks_by_heights(
+                    self.handle,
+                    remaining.as_ptr(),
+                    i32::try_from(remaining.len()).context("too many heights to read at once")?,
+                    buf.as_mut_ptr(),
+                    i32::try_from(buf.len()).context("buffer size should fit into an i32")?,
+                    &mut needed,
+                )
+            };
+            let count = match res {
+                BLOCK_CANCELLED => anyhow::bail!("reading blocks by height was cancelled"),
+                x if x < 0 => return Err(last_error(self.handle)),
+                count => count as usize,
+            };
+            out.extend(decode_entries(&buf, count));
+            if count < remaining.len() {
+                // Nothing is written past the entry which didn't fit, so it starts the next call.
+                let needed =
+                    usize::try_from(needed).context("needed size should fit into usize")?;
+                anyhow::ensure!(
+                    needed > 0,
+                    "cometbft store stopped reading blocks by height without saying why"
+                );
+                if count == 0 {
+                    buf.resize(needed.max(2 * buf.len()), 0);
+                }
+            }
+        }
+        Ok(out)
+    }
+
+    /// Pass each block between two heights (inclusive) to a function, in order.
+    ///
+    /// The data passed along is only valid during the call. Returning false stops the stream.
+    /// The function must not panic, since it's called from the Go side.
+    #[allow(dead_code)]
+    pub fn stream_blocks<F: FnMut(i64, &[u8]) -> bool>(
+        &self,
+        start: i64,
+        end: i64,
+        mut f: F,
+    ) -> anyhow::Result<StreamEnd> {
+        extern "C" fn trampoline<F: FnMut(i64, &[u8]) -> bool>(
+            ctx: *mut c_void,
+            data: *const u8,
+            len: i32,
+            height: i64,
+        ) -> i32 {
+            // Safety: ctx is the function given to stream_blocks, which outlives the stream.
+            let f = unsafe { &mut *(ctx as *mut F) };
+            let data = match usize::try_from(len) {
+                // Safety: the Go side passes a buffer holding len bytes.
+                Ok(len) if len > 0 => unsafe { std::slice::from_raw_parts(data, len) },
+                _ => &[],
+            };
+            i32::from(!f(height, data))
+        }
+
+        let mut next = 0i64;
+        let res = unsafe {
+            // Safety: the Go side only calls the trampoline during this call, with our function.
+            c_store_stream_blocks(
+                self.handle,
+                start,
+                end,
+                trampoline::<F>,
+                &mut f as *mut F as *mut c_void,
+                &mut next,
+            )
+        };
+        match res {
+            BLOCK_CANCELLED => Ok(StreamEnd::Cancelled { next }),
+            x if x < 0 => Err(last_error(self.handle)),
+            count => Ok(StreamEnd::Finished {
+                count: count as u64,
+                next,
+            }),
+        }
+    }
+
+    /// Get a way to cancel the range operations in progress on this store, from another thread.
+    #[allow(dead_code)]
+    pub fn canceller(&self) -> Canceller<'_> {
+        Canceller {
+            handle: self.handle,
+            _store: PhantomData,
+        }
+    }
+
+    /// Make range operations call a function with the height they've reached, every so many blocks.
+    ///
+    /// The function is called on the thread running the operation, and must not panic.
+    #[allow(dead_code)]
+    pub fn set_progress(
+        &mut self,
+        every: u64,
+        progress: impl Fn(i64) + Send + Sync + 'static,
+    ) -> anyhow::Result<()> {
+        extern "C" fn trampoline(ctx: *mut c_void, height: i64) {
+            // Safety: ctx is the progress function we keep around while the Go side has it.
+            let progress = unsafe { &*(ctx as *const ProgressFn) };
+            progress(height);
+        }
+
+        let every = i64::try_from(every).context("progress interval should fit into an i64")?;
+        let progress: ProgressFn = Box::new(progress);
+        let progress = Box::new(progress);
+        unsafe {
+            // Safety: the function stays alive until it's replaced, which tells the Go side first.
+            c_store_set_progress(
+                self.handle,
+                every,
+                Some(trampoline),
+                &*progress as *const ProgressFn as *mut c_void,
+            );
+        }
+        self.progress = Some(progress);
+        Ok(())
+    }
+
+    /// Stop reporting progress to the function given to [Self::set_progress].
+    #[allow(dead_code)]
+    pub fn clear_progress(&mut self) {
+        unsafe {
+            // Safety: a null callback just removes the one the Go side had.
+            c_store_set_progress(self.handle, 0, None, std::ptr::null_mut());
+        }
+        self.progress = None;
+    }
+
+    /// Make range operations call a function with the height they've reached, and the last
+    /// height of their range, to work out how far along they are.
+    ///
+    /// The Go side bounds how often this is called, to around ten times a second, besides the
+    /// first block of each operation and the last height of its range. The function is called
+    /// on the thread running the operation, and must not panic.
+    #[allow(dead_code)]
+    pub fn set_range_progress(&mut self, progress: impl Fn(i64, i64) + Send + Sync + 'static) {
+        extern "C" fn trampoline(ctx: *mut c_void, height: i64, last: i64) {
+            // Safety: ctx is the progress function we keep around while the Go side has it.
+            let progress = unsafe { &*(ctx as *const RangeProgressFn) };
+            progress(height, last);
+        }
+
+        let progress: RangeProgressFn = Box::new(progress);
+        let progress = Box::new(progress);
+        unsafe {
+            // Safety: the function stays alive until it's replaced, which tells the Go side first.
+            c_store_set_progress_cb(
+                self.handle,
+                Some(trampoline),
+                &*progress as *const RangeProgressFn as *mut c_void,
+            );
+        }
+        self.range_progress = Some(progress);
+    }
+
+    /// Stop reporting progress to the function given to [Self::set_range_progress].
+    #[allow(dead_code)]
+    pub fn clear_range_progress(&mut self) {
+        unsafe {
+            // Safety: a null callback just removes the one the Go side had.
+            c_store_set_progress_cb(self.handle, None, std::ptr::null_mut());
+        }
+        self.range_progress = None;
+    }
+
+    /// Call a function following the Go side's conventions for writing data into our buffer.
+    fn read_into_buf(
+        &mut self,
+        read: impl FnMut(usize, *mut u8, i32, *mut i64) -> i32,
+    ) -> anyhow::Result<Option<&[u8]>> {
+        read_into(self.handle, &mut self.buf, self.max_block_size, read)
+    }
+}
+
+/// Call a function following the Go side's conventions for writing data into a buffer.
+///
+/// This grows the buffer if Go tells us it's too small.
+fn read_into(
+    handle: usize,
+    buf: &mut Vec<u8>,
+    max_block_size: u64,
+    mut read: impl FnMut(usize, *mut u8, i32, *mut i64) -> i32,
+) -> anyhow::Result<Option<&[u8]>> {
+    let res = loop {
+        let mut needed: i64 = 0;
+        let out_ptr = buf.as_mut_ptr();
+        let out_cap = i32::try_from(buf.capacity()).expect("capacity should not have exceeded i32");
+        let res = read(handle, out_ptr, out_cap, &mut needed);
+        match res {
+            // Callers which need to tell a gap from a height outside of the store check its range.
+            BLOCK_NOT_FOUND | BLOCK_BEYOND_RANGE => return Ok(None),
+            BLOCK_TOO_BIG => {
+                // The Go side reports the exact size it needs, so one allocation suffices.
+                buf.clear();
+                buf.reserve(
+                    usize::try_from(needed).expect("needed block size should fit into usize"),
+                );
+            }
+            BLOCK_ERROR | BLOCK_INVALID_HASH | HEIGHT_OVERFLOW => return Err(last_error(handle)),
+            BLOCK_EXCEEDS_LIMIT => return Err(block_exceeds_limit(needed, max_block_size)),
+            x if x < 0 => anyhow::bail!("unexpected result code {} from cometbft store", x),
+            x => break x,
+        }
+    };
+    unsafe {
+        // Safety: res will be positive here, and be the length that Go
+        // actually wrote bytes into on the other side.
+        buf.set_len(res as usize);
+    }
+    Ok(Some(buf.as_slice()))
+}
+
+/// Decode the first count entries the Go side packed into a buffer, each prefixed by its length.
+///
+/// An entry with a length of 0 is a height without a block.
+fn decode_entries(data: &[u8], count: usize) -> Vec<Option<Vec<u8>>> {
+    let mut out = Vec::with_capacity(count);
+    let mut rest = data;
+    for _ in 0..count {
+        let (prefix, tail) = rest.split_at(RANGE_PREFIX_SIZE);
+        let len = u32::from_le_bytes(prefix.try_into().expect("prefix should be 4 bytes")) as usize;
+        let (entry, tail) = tail.split_at(len);
+        out.push((len > 0).then(|| entry.to_vec()));
+        rest = tail;
+    }
+    out
+}
+
+impl Drop for RawStore {
+    fn drop(&mut self) {
+        unsafe {
+            // Safety: the existence of this method ensures we don't leak memory,
+            // and the &mut avoids other shenanigans.
+            c_store_delete(self.handle);
+        }
+    }
+}
+
+// Safety: a [RawStore] will always contain a unique handle to the Go object.
+unsafe impl Send for RawStore {}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{
+        decompress_block, Block, DEFAULT_BLOCKSTORE_NAME, MEMORY_BACKEND, ZSTD_MAGIC,
+    };
+    use std::sync::{mpsc, Arc, Mutex};
+
+    fn open_test_store() -> anyhow::Result<RawStore> {
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)
+    }
+
+    #[test]
+    fn test_cancel_stream_mid_flight() -> anyhow::Result<()> {
+        let store = open_test_store()?;
+        let canceller = store.canceller();
+        // Cancelling with nothing in progress doesn't affect what comes after.
+        canceller.cancel();
+
+        let (reached_tx, reached_rx) = mpsc::channel();
+        let (cancelled_tx, cancelled_rx) = mpsc::channel();
+        let mut seen = Vec::new();
+        let end = std::thread::scope(|scope| {
+            // Moved in here so that it's dropped, letting the other thread go, if height 2 never comes.
+            let reached_tx = reached_tx;
+            scope.spawn(move || {
+                if reached_rx.recv().is_ok() {
+                    canceller.cancel();
+                }
+                let _ = cancelled_tx.send(());
+            });
+            store.stream_blocks(1, 5, |height, data| {
+                seen.push(height);
+                assert!(!data.is_empty());
+                if height == 2 {
+                    // Wait for the other thread to cancel while we're in the middle of the stream.
+                    reached_tx.send(()).expect("canceller should be waiting");
+                    cancelled_rx
+                        .recv()
+                        .expect("canceller should have cancelled");
+                }
+                true
+            })
+        })?;
+        assert_eq!(end, StreamEnd::Cancelled { next: 3 });
+        assert_eq!(seen, vec![1, 2]);
+
+        // The store stays usable afterwards.
+        let mut count = 0;
+        let end = store.stream_blocks(1, 5, |_, _| {
+            count += 1;
+            true
+        })?;
+        assert_eq!(end, StreamEnd::Finished { count: 5, next: 6 });
+        assert_eq!(count, 5);
+        Ok(())
+    }
+
+    #[test]
+    fn test_cursors_read_independently() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        assert_eq!(store.height_range()?, (1, 5));
+        let mut expected = vec![Vec::new()];
+        for height in 1..=5 {
+            let block = store
+                .block_by_height(height)?
+                .expect("test store should have every block");
+            expected.push(block.to_vec());
+        }
+        let block = |height: i64| Some((height, expected[height as usize].clone()));
+        fn next(cursor: &mut BlockCursor) -> anyhow::Result<Option<(i64, Vec<u8>)>> {
+            Ok(cursor.next_block()?.map(|(height, x)| (height, x.to_vec())))
+        }
+
+        // Reading from one cursor doesn't move the others, even over the same heights.
+        let mut a = store.cursor(1)?;
+        let mut b = store.cursor(3)?;
+        let mut c = store.cursor(3)?;
+        assert_eq!(next(&mut a)?, block(1));
+        assert_eq!(next(&mut b)?, block(3));
+        assert_eq!(next(&mut a)?, block(2));
+        assert_eq!(next(&mut c)?, block(3));
+        assert_eq!(next(&mut b)?, block(4));
+        // Closing a cursor leaves the others where they were.
+        drop(b);
+        assert_eq!(next(&mut c)?, block(4));
+        for height in 3..=5 {
+            assert_eq!(next(&mut a)?, block(height));
+        }
+        // Past the last block, the cursor stays put, rather than skipping ahead.
+        assert_eq!(next(&mut a)?, None);
+        assert_eq!(next(&mut a)?, None);
+        assert_eq!(a.height(), 6);
+        assert_eq!(next(&mut c)?, block(5));
+        assert_eq!(next(&mut store.cursor(9)?)?, None);
+        // No height is past the largest one, so no cursor can start there.
+        assert!(store.cursor(i64::MAX).is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_backend_is_reported() -> anyhow::Result<()> {
+        assert_eq!(open_test_store()?.backend()?, "goleveldb");
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-backend-{}",
+            std::process::id()
+        ));
+        let mut store = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        assert_eq!(store.backend()?, MEMORY_BACKEND);
+        assert!(!dir.exists());
+        Ok(())
+    }
+
+    #[test]
+    fn test_stream_stopped_by_callback() -> anyhow::Result<()> {
+        let store = open_test_store()?;
+        let end = store.stream_blocks(2, 5, |height, _| height < 3)?;
+        assert_eq!(end, StreamEnd::Finished { count: 2, next: 4 });
+        Ok(())
+    }
+
+    #[test]
+    fn test_progress_is_reported() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        let reported = Arc::new(Mutex::new(Vec::new()));
+        store.set_progress(2, {
+            let reported = reported.clone();
+            move |height| reported.lock().unwrap().push(height)
+        })?;
+        store.stream_blocks(1, 5, |_, _| true)?;
+        assert_eq!(*reported.lock().unwrap(), vec![2, 4]);
+
+        store.clear_progress();
+        store.stream_blocks(1, 5, |_, _| true)?;
+        assert_eq!(*reported.lock().unwrap(), vec![2, 4]);
+        assert!(store.block_by_height(5)?.is_some());
+        Ok(())
+    }
+
+    #[test]
+    fn test_range_progress_is_reported_in_order() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        let reported = Arc::new(Mutex::new(Vec::new()));
+        store.set_range_progress({
+            let reported = reported.clone();
+            move |height, last| reported.lock().unwrap().push((height, last))
+        });
+        // A range past the end of the store is reported as ending with the store.
+        for (start, end) in [(2, 5), (1, 100)] {
+            reported.lock().unwrap().clear();
+            store.stream_blocks(start, end, |_, _| true)?;
+            let reported = reported.lock().unwrap();
+            assert!(reported.iter().all(|x| x.1 == 5), "{:?}", reported);
+            assert!(
+                reported.windows(2).all(|x| x[0].0 < x[1].0),
+                "{:?}",
+                reported
+            );
+            // The first block, and the end of the range, are always reported.
+            assert_eq!(reported.first(), Some(&(start, 5)));
+            assert_eq!(reported.last(), Some(&(5, 5)));
+            // The test blocks are read in far less time than the Go side waits between
+            // reports, so nothing in between is.
+            assert_eq!(reported.len(), 2, "{:?}", reported);
+        }
+
+        store.clear_range_progress();
+        reported.lock().unwrap().clear();
+        store.stream_blocks(1, 5, |_, _| true)?;
+        assert!(reported.lock().unwrap().is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn test_blocks_are_read_into_registered_buffer() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        // Starting without any capacity, the buffer has to grow, and be registered again.
+        store.buf = Vec::new();
+        for height in 1..=5 {
+            let unregistered = store
+                .read_into_buf(|handle, out_ptr, out_cap, needed| unsafe {
+                    // Safety: read_into_buf provides a buffer with at least out_cap bytes of capacity.
+                    c_store_block_by_height(handle, height, out_ptr, out_cap, needed)
+                })?
+                .expect("test store should have the block")
+                .to_vec();
+            let registered = store
+                .block_by_height(height)?
+                .expect("test store should have the block");
+            assert_eq!(registered, unregistered.as_slice());
+            assert_eq!(store.registered.0, store.buf.as_ptr() as usize);
+            assert!(store.registered.1 as usize >= unregistered.len());
+        }
+        assert!(store.block_by_height(6)?.is_none());
+
+        // Without a buffer registered, or with it unregistered, every block is too big.
+        for buf_ptr in [None, Some(std::ptr::null_mut())] {
+            let store = open_test_store()?;
+            if let Some(buf_ptr) = buf_ptr {
+                unsafe {
+                    // Safety: a null buffer is never written into.
+                    c_store_register_buffer(store.handle, buf_ptr, 0);
+                }
+            }
+            let mut needed = 0i64;
+            let res = unsafe {
+                // Safety: there's no buffer for the Go side to write into.
+                c_store_block_by_height_registered(store.handle, 1, &mut needed)
+            };
+            assert_eq!(res, BLOCK_TOO_BIG);
+            assert!(needed > 0);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_blocks_by_heights_mixes_present_and_missing() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        let heights = [3, 9, 1, 5, 0, 3, 6];
+        let mut expected = Vec::new();
+        for height in heights {
+            expected.push(store.block_by_height(height)?.map(|x| x.to_vec()));
+        }
+        // Starting without any capacity, every block needs the buffer to grow first.
+        store.buf = Vec::new();
+        let blocks = store.blocks_by_heights(&heights)?;
+        assert_eq!(blocks, expected);
+        assert_eq!(
+            blocks.iter().map(|x| x.is_some()).collect::<Vec<_>>(),
+            vec![true, false, true, true, false, true, false]
+        );
+        assert_eq!(Block::decode(blocks[0].as_deref().unwrap())?.height(), 3);
+
+        assert!(store.blocks_by_heights(&[])?.is_empty());
+        assert_eq!(store.blocks_by_heights(&[7, 8])?, vec![None, None]);
+        // Blocks keep being read into the registered buffer afterwards.
+        assert_eq!(store.block_by_height(3)?.map(|x| x.to_vec()), expected[0]);
+        Ok(())
+    }
+
+    #[test]
+    fn test_blocks_range_reads_several_blocks_at_once() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        let mut expected = Vec::new();
+        for height in 1..=5 {
+            let block = store
+                .block_by_height(height)?
+                .expect("test store should have every block");
+            expected.push((height, block.to_vec()));
+        }
+        let entry_size = |heights: std::ops::RangeInclusive<usize>| -> usize {
+            heights
+                .map(|x| RANGE_PREFIX_SIZE + expected[x - 1].1.len())
+                .sum()
+        };
+
+        // At the C ABI, out_needed tells a block which didn't fit from one which is missing.
+        for (start, end, cap, count, next, needed) in [
+            // An exact fit.
+            (1, 5, entry_size(1..=5), 5, 6, 0),
+            // A partial fit, stopping at the block which didn't.
+            (1, 5, entry_size(1..=3) - 1, 2, 3, entry_size(3..=3)),
+            // An empty range.
+            (4, 3, entry_size(4..=4), 0, 4, 0),
+            // A range past the last height of the store.
+            (4, 100, entry_size(4..=5), 2, 6, 0),
+            (6, 9, entry_size(1..=5), 0, 6, 0),
+        ] {
+            let mut buf = vec![0u8; cap];
+            let mut out_next = 0i64;
+            let mut out_needed = 0i64;
+            let res = unsafe {
+                // Safety: the Go side doesn't write past the capacity we give it.
+                c_store_blocks_range(
+                    store.handle,
+                    start,
+                    end,
+                    buf.as_mut_ptr(),
+                    i32::try_from(buf.len())?,
+                    &mut out_next,
+                    &mut out_needed,
+                )
+            };
+            let case = format!("{}..={} into {} bytes", start, end, cap);
+            assert_eq!(res, count, "{}", case);
+            assert_eq!(out_next, next, "{}", case);
+            assert_eq!(out_needed, needed as i64, "{}", case);
+            let entries = decode_entries(&buf, count as usize);
+            for (i, entry) in entries.into_iter().enumerate() {
+                assert_eq!(
+                    entry.as_ref(),
+                    Some(&expected[start as usize - 1 + i].1),
+                    "{}",
+                    case
+                );
+            }
+        }
+
+        // Through the store, the buffer grows as needed, whatever it starts out as.
+        for capacity in [0, entry_size(1..=1), entry_size(1..=5)] {
+            store.buf = Vec::with_capacity(capacity);
+            assert_eq!(store.blocks_range(1, 5)?, expected);
+        }
+        assert_eq!(store.blocks_range(2, 100)?, expected[1..]);
+        assert!(store.blocks_range(4, 3)?.is_empty());
+        assert!(store.blocks_range(6, 9)?.is_empty());
+
+        // Reading stops before a gap, rather than failing.
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft-gap/data");
+        let mut gap = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        let heights =
+            |blocks: Vec<(i64, Vec<u8>)>| blocks.into_iter().map(|x| x.0).collect::<Vec<_>>();
+        assert_eq!(heights(gap.blocks_range(1, 5)?), vec![1, 2]);
+        assert!(gap.blocks_range(3, 5)?.is_empty());
+        assert_eq!(heights(gap.blocks_range(4, 5)?), vec![4, 5]);
+        Ok(())
+    }
+
+    #[test]
+    fn test_heights_near_i64_max_overflow() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        let err = store
+            .block_by_height(i64::MAX)
+            .expect_err("i64::MAX should be refused");
+        assert!(
+            format!("{:#}", err).contains("height is above the largest supported height"),
+            "{:#}",
+            err
+        );
+        assert!(store.block_meta_by_height(i64::MAX).is_err());
+        assert!(store.blocks_range(i64::MAX, i64::MAX).is_err());
+        // The height below is merely past the store, and a range can end anywhere.
+        assert_eq!(store.block_by_height(i64::MAX - 1)?, None);
+        assert_eq!(store.blocks_range(4, i64::MAX)?.len(), 2);
+        Ok(())
+    }
+
+    #[test]
+    fn test_missing_heights_tell_gaps_from_out_of_range() -> anyhow::Result<()> {
+        // The same blocks as the usual test store, but for height 3, leaving a gap.
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft-gap/data");
+        let mut store = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        assert_eq!(store.height_range()?, (1, 5));
+        assert_eq!(store.gaps()?, vec![(3, 3)]);
+        let mut buf = vec![0u8; EXPECTED_BLOCK_PROTO_SIZE];
+        for (height, expected) in [
+            (0, BLOCK_BEYOND_RANGE),
+            (1, 0),
+            (3, BLOCK_NOT_FOUND),
+            (5, 0),
+            (6, BLOCK_BEYOND_RANGE),
+        ] {
+            let mut needed = 0i64;
+            let res = unsafe {
+                // Safety: the Go side doesn't write past the capacity we give it.
+                c_store_block_by_height(
+                    store.handle,
+                    height,
+                    buf.as_mut_ptr(),
+                    i32::try_from(buf.len())?,
+                    &mut needed,
+                )
+            };
+            assert_eq!(res.min(0), expected, "at height {}", height);
+            let mut hash = [0u8; BLOCK_HASH_SIZE];
+            let res = unsafe {
+                // Safety: the Go side writes exactly BLOCK_HASH_SIZE bytes of hash.
+                c_store_hash_by_height(store.handle, height, hash.as_mut_ptr())
+            };
+            assert_eq!(res.min(0), expected, "at height {}", height);
+            // Reading through the store, a missing block is missing, wherever it is.
+            assert_eq!(store.block_by_height(height)?.is_some(), expected == 0);
+            assert_eq!(store.hash_by_height(height)?.is_some(), expected == 0);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_db_options_are_checked() -> anyhow::Result<()> {
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let tuned = DbOptions {
+            block_cache_bytes: Some(16 << 20),
+            disable_compaction: true,
+            ..DbOptions::default()
+        };
+        let mut store =
+            RawStore::with_options("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true, &tuned)?;
+        assert_eq!(store.height_range()?, (1, 5));
+        assert!(store.block_by_height(3)?.is_some());
+        drop(store);
+
+        // These are rejected before the database is opened, so the fixture is never written to.
+        for (read_only, compression, expected) in [
+            (true, "snappy", "read-only"),
+            (false, "zstd", "unknown compression 'zstd'"),
+        ] {
+            let options = DbOptions {
+                compression: Some(compression.to_owned()),
+                ..DbOptions::default()
+            };
+            let err = RawStore::with_options(
+                "goleveldb",
+                &dir,
+                DEFAULT_BLOCKSTORE_NAME,
+                read_only,
+                &options,
+            )
+            .err()
+            .expect("invalid options should fail to open the store");
+            assert!(format!("{:#}", err).contains(expected), "{:#}", err);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_blocks_without_evidence_have_none() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        for height in 1..=5 {
+            assert!(store.block_by_height(height)?.is_some());
+            assert_eq!(store.evidence_by_height(height)?, None);
+        }
+        assert_eq!(store.evidence_by_height(6)?, None);
+        Ok(())
+    }
+
+    #[test]
+    fn test_part_set_header_matches_blocks() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        for height in 1..=4 {
+            let header = store
+                .block_part_set_header(height)?
+                .expect("test store should have the block");
+            let block = store
+                .block_by_height(height)?
+                .expect("test store should have the block")
+                .to_vec();
+            assert_eq!(header.block_size, block.len() as u64);
+            // The block after this one refers to it by its hash and part set header.
+            let next = store
+                .block_by_height(height + 1)?
+                .expect("test store should have the next block");
+            let last_block_id = Block::decode(next)?
+                .tendermint_v040()?
+                .header
+                .last_block_id
+                .expect("the next block should refer to this one");
+            assert_eq!(
+                last_block_id.hash.as_bytes(),
+                Block::decode(&block)?.hash()?
+            );
+            assert_eq!(header.total, last_block_id.part_set_header.total);
+            assert_eq!(header.hash, last_block_id.part_set_header.hash.as_bytes());
+        }
+        assert_eq!(store.block_part_set_header(1_000_000)?, None);
+        Ok(())
+    }
+
+    #[test]
+    fn test_block_hashes_match_block_ids() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        for height in 1..=5 {
+            let block_id = store
+                .hash_by_height(height)?
+                .expect("test store should have the block");
+            let block = store
+                .block_by_height(height)?
+                .expect("test store should have the block")
+                .to_vec();
+            verify_block_hashes(&block, Some(block_id.as_slice()))?;
+            verify_block_hashes(&block, None)?;
+            assert_eq!(block_hash(&block)?, block_id);
+
+            // The ID of any other block doesn't match.
+            let other = store
+                .hash_by_height(height % 5 + 1)?
+                .expect("test store should have the block");
+            let err = verify_block_hashes(&block, Some(other.as_slice()))
+                .expect_err("the block shouldn't hash to another block's ID");
+            assert!(
+                err.to_string().contains(&format!(
+                    "hash mismatch at height {}: the block ID is",
+                    height
+                )),
+                "{:#}",
+                err
+            );
+        }
+        assert_eq!(store.hash_by_height(6)?, None);
+        assert!(verify_block_hashes(b"junk", None).is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_compressed_blocks_round_trip() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        for height in 1..=5 {
+            let block = store
+                .block_by_height(height)?
+                .expect("test store should have the block")
+                .to_vec();
+            let compressed = store
+                .block_by_height_compressed(height)?
+                .expect("test store should have the block")
+                .to_vec();
+            // The Go side only compresses a block if that makes it smaller.
+            assert!(compressed.len() <= block.len());
+            assert_eq!(decompress_block(&compressed)?, block);
+        }
+        assert_eq!(store.block_by_height_compressed(6)?, None);
+
+        // Blocks left as they are, and junk after the magic number, are told apart.
+        let block = store
+            .block_by_height(2)?
+            .expect("test store should have the block")
+            .to_vec();
+        assert_eq!(decompress_block(&block)?, block);
+        let mut junk = ZSTD_MAGIC.to_vec();
+        junk.extend_from_slice(b"junk");
+        assert!(decompress_block(&junk).is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_block_meta_matches_blocks() -> anyhow::Result<()> {
+        use prost::Message as _;
+        use tendermint_proto::v0_37::types::BlockMeta;
+
+        let mut store = open_test_store()?;
+        for height in 1..=5 {
+            let block = Block::decode(
+                store
+                    .block_by_height(height)?
+                    .expect("test store should have the block"),
+            )?;
+            let size = store
+                .block_by_height(height)?
+                .expect("test store should have the block")
+                .len();
+            let hash = store
+                .hash_by_height(height)?
+                .expect("test store should have the block");
+            let meta = BlockMeta::decode(
+                store
+                    .block_meta_by_height(height)?
+                    .expect("test store should have the block meta"),
+            )?;
+            let header = meta.header.expect("the meta should have a header");
+            assert_eq!(header.height, height);
+            assert_eq!(meta.block_size, size as i64);
+            assert_eq!(meta.num_txs, block.num_txs() as i64);
+            assert_eq!(
+                meta.block_id.expect("the meta should have a block ID").hash,
+                hash
+            );
+        }
+        assert_eq!(store.block_meta_by_height(6)?, None);
+        Ok(())
+    }
+
+    #[test]
+    fn test_commits_match_the_next_block() -> anyhow::Result<()> {
+        use tendermint_proto::{v0_37::types::Commit as ProtoCommit, Protobuf};
+        use tendermint_v0o40::block::Commit;
+
+        let decode = |data: &[u8]| <Commit as Protobuf<ProtoCommit>>::decode_vec(data);
+        let mut store = open_test_store()?;
+        for height in 1..=4 {
+            let commit = decode(
+                store
+                    .commit_by_height(height)?
+                    .expect("test store should have the commit"),
+            )?;
+            let next = Block::decode(
+                store
+                    .block_by_height(height + 1)?
+                    .expect("test store should have the next block"),
+            )?;
+            assert_eq!(commit.height.value(), height as u64);
+            assert_eq!(Some(commit), next.inner.last_commit);
+        }
+        // The commit for the last block is only known as the one the node saw.
+        assert_eq!(store.commit_by_height(5)?, None);
+        let seen = decode(
+            store
+                .seen_commit_by_height(5)?
+                .expect("test store should have a seen commit for its last block"),
+        )?;
+        assert_eq!(seen.height.value(), 5);
+        assert_eq!(
+            seen.block_id.hash.as_bytes(),
+            store
+                .hash_by_height(5)?
+                .expect("test store should have the block")
+                .as_slice()
+        );
+        assert_eq!(store.seen_commit_by_height(6)?, None);
+        // The fixture node ran cometbft 0.37, which saved no extended commits.
+        for height in 1..=6 {
+            assert_eq!(store.extended_commit_by_height(height)?, None);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_blocks_are_pruned() -> anyhow::Result<()> {
+        // Pruning writes to the store, so it happens to a copy of the test blocks.
+        let home = crate::cometbft::test_node_home("prune-blocks", false)?;
+        let mut store = RawStore::new(
+            "goleveldb",
+            &home.join("data"),
+            DEFAULT_BLOCKSTORE_NAME,
+            false,
+        )?;
+        let kept = (3..=5)
+            .map(|height| {
+                Ok(store
+                    .block_by_height(height)?
+                    .expect("test store should have the block")
+                    .to_vec())
+            })
+            .collect::<anyhow::Result<Vec<_>>>()?;
+
+        assert_eq!(store.prune_blocks(3)?, 2);
+        assert_eq!(store.height_range()?, (3, 5));
+        for height in 1..=2 {
+            assert_eq!(store.block_by_height(height)?, None);
+        }
+        for (height, block) in (3..=5).zip(&kept) {
+            assert_eq!(store.block_by_height(height)?, Some(block.as_slice()));
+        }
+        // Pruning up to the first block again removes nothing, and pruning past the store fails.
+        assert_eq!(store.prune_blocks(3)?, 0);
+        let err = store
+            .prune_blocks(7)
+            .expect_err("pruning past the last block should fail");
+        assert!(
+            format!("{:#}", err).contains("cannot prune beyond the latest height 5"),
+            "{:#}",
+            err
+        );
+        assert_eq!(store.height_range()?, (3, 5));
+        drop(store);
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_named_stores_name_their_errors() -> anyhow::Result<()> {
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data");
+        let gap_dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft-gap/data");
+        let mut old = RawStore::named("old", "goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        let mut new = RawStore::named("new", "goleveldb", &gap_dir, DEFAULT_BLOCKSTORE_NAME, true)?;
+        // Both are open, and read, at once, each failing with its own name.
+        assert!(old.block_by_height(3)?.is_some());
+        assert!(new.block_by_height(3)?.is_none());
+        for (store, name) in [(&mut old, "old"), (&mut new, "new")] {
+            let err = store
+                .block_by_hash(b"short")
+                .expect_err("a hash of the wrong length should be rejected");
+            assert!(
+                format!("{:#}", err)
+                    .contains(&format!("store '{}': invalid block hash length", name)),
+                "{:#}",
+                err
+            );
+        }
+
+        // Failing to open a store names it as well.
+        let err = RawStore::named(
+            "broken",
+            "no-such-backend",
+            &dir,
+            DEFAULT_BLOCKSTORE_NAME,
+            true,
+        )
+        .err()
+        .expect("an unknown backend should be rejected");
+        assert!(
+            format!("{:#}", err).contains("store 'broken': unknown backend"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_blocks_are_read_by_hash() -> anyhow::Result<()> {
+        let mut store = open_test_store()?;
+        for height in 1..=5 {
+            let hash = store
+                .hash_by_height(height)?
+                .expect("test store should have the block");
+            let block = store
+                .block_by_height(height)?
+                .expect("test store should have the block")
+                .to_vec();
+            assert_eq!(store.block_by_hash(&hash)?, Some(block.as_slice()));
+        }
+
+        // A hash no block has isn't found, while one of the wrong length can't be looked up.
+        assert_eq!(store.block_by_hash(&[0u8; BLOCK_HASH_SIZE])?, None);
+        for len in [0, BLOCK_HASH_SIZE - 1, BLOCK_HASH_SIZE + 1] {
+            let err = store
+                .block_by_hash(&vec![1u8; len])
+                .expect_err("a hash of the wrong length should be rejected");
+            assert!(
+                format!("{:#}", err).contains(&format!(
+                    "invalid block hash length: expected {} bytes, got {}",
+                    BLOCK_HASH_SIZE, len
+                )),
+                "{:#}",
+                err
+            );
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_snapshot_ignores_later_writes() -> anyhow::Result<()> {
+        let mut source = open_test_store()?;
+        let blocks = (1..=5)
+            .map(|height| {
+                let data = source
+                    .block_by_height(height)?
+                    .ok_or(anyhow!("missing test block at height {}", height))?;
+                Block::decode(data)
+            })
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        drop(source);
+
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-snapshot-{}",
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        let mut store = RawStore::create("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        let save = |store: &RawStore, i: usize| -> anyhow::Result<()> {
+            let (_, commit) = blocks[i + 1]
+                .encoded_last_commit()
+                .ok_or(anyhow!("test block should contain a commit"))?;
+            store.save_block(&blocks[i].encode(), &commit)
+        };
+        save(&store, 0)?;
+        save(&store, 1)?;
+        let mut snapshot = store.snapshot()?;
+        save(&store, 2)?;
+        save(&store, 3)?;
+
+        assert_eq!(snapshot.height_range()?, (1, 2));
+        assert!(snapshot.block_by_height(3)?.is_none());
+        for block in &blocks[..2] {
+            let out = snapshot
+                .block_by_height(i64::try_from(block.height())?)?
+                .map(Block::decode)
+                .transpose()?;
+            assert_eq!(out.as_ref(), Some(block));
+        }
+        assert!(snapshot.gaps()?.is_empty());
+        assert!(save(&snapshot, 2).is_err());
+
+        // The store carried on regardless.
+        drop(snapshot);
+        assert_eq!(store.height_range()?, (1, 4));
+        assert!(store.block_by_height(4)?.is_some());
+        drop(store);
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_snapshot_unsupported_by_memory_backend() -> anyhow::Result<()> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-snapshot-memdb-{}",
+            std::process::id()
+        ));
+        let store = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        let err = store
+            .snapshot()
+            .err()
+            .expect("memdb should have no snapshots");
+        assert!(
+            format!("{:#}", err).contains("snapshots are not supported by backend 'memdb'"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+}
@@ -9,7 +9,7 @@ use tokio::time::Instant;
 
 use super::{Block, BlockStream, Genesis};
 
-trait ValueExtension: Sized {
+pub(super) trait ValueExtension: Sized {
     fn expect_key(&self, key: &str) -> anyhow::Result<&Self>;
     fn expect_u64_string(&self) -> anyhow::Result<u64>;
     fn expect_array(&self) -> anyhow::Result<&Vec<Self>>;
@@ -110,6 +110,10 @@ impl super::Store for RemoteStore {
             let end = sync_info
                 .expect_key("latest_block_height")?
                 .expect_u64_string()?;
+            // A store without blocks reports heights of 0, where there's never a block.
+            if start == 0 || end == 0 {
+                return Ok(None);
+            }
             Ok(Some((start, end)))
         })
         .await
@@ -0,0 +1,628 @@
+use anyhow::{anyhow, Context as _};
+use async_trait::async_trait;
+use reqwest::{header::RETRY_AFTER, Client, StatusCode};
+use serde_json::Value;
+use std::time::Duration;
+
+use super::{remote::ValueExtension, Block, Genesis};
+
+/// How a [RpcStore] retries requests which fail in ways that might not happen again.
+#[derive(Clone, Debug)]
+struct RetryPolicy {
+    /// How many times to try a request, including the first attempt.
+    attempts: u32,
+    /// How long to wait before the first retry, doubling with each retry after that.
+    initial_backoff: Duration,
+    /// The longest we'll ever wait between retries, including when told to wait by the node.
+    max_backoff: Duration,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        Self {
+            attempts: 8,
+            initial_backoff: Duration::from_millis(500),
+            max_backoff: Duration::from_secs(30),
+        }
+    }
+}
+
+/// The ways a single attempt at a request can fail.
+enum Failure {
+    /// Something that's worth trying again, like a timeout, or being rate limited.
+    Transient {
+        error: anyhow::Error,
+        retry_after: Option<Duration>,
+    },
+    /// The node answered, with an error that trying again won't fix.
+    Rpc(Value),
+    Fatal(anyhow::Error),
+}
+
+/// A store which fetches blocks one height at a time, using the `/block` and `/commit` RPC endpoints.
+///
+/// Unlike [super::RemoteStore], this doesn't need the node to index blocks, and checks
+/// each block it retrieves: the hash of the block has to match the hash the node reports
+/// for that height, along with the hash that the commit for that height signs.
+/// The signatures in the commit are not themselves verified.
+///
+/// Requests are retried, backing off between attempts, when the connection fails,
+/// or the node is overloaded, or rate limits us.
+#[derive(Clone)]
+pub struct RpcStore {
+    base_url: String,
+    client: Client,
+    retry: RetryPolicy,
+}
+
+impl RpcStore {
+    /// This takes in the URL for the cometbft rpc.
+    pub fn new(base_url: String) -> Self {
+        Self {
+            base_url: base_url.trim_end_matches('/').to_owned(),
+            client: Client::new(),
+            retry: RetryPolicy::default(),
+        }
+    }
+
+    /// Make a single attempt at a request, returning the `result` of the response.
+    async fn try_request(&self, url: &str, params: &[(&str, &str)]) -> Result<Value, Failure> {
+        let res = match self.client.get(url).query(params).send().await {
+            Ok(x) => x,
+            Err(e) if e.is_builder() => return Err(Failure::Fatal(e.into())),
+            Err(e) => {
+                return Err(Failure::Transient {
+                    error: e.into(),
+                    retry_after: None,
+                })
+            }
+        };
+        let status = res.status();
+        let retry_after = res
+            .headers()
+            .get(RETRY_AFTER)
+            .and_then(|x| x.to_str().ok()?.trim().parse().ok())
+            .map(Duration::from_secs);
+        // CometBFT reports errors, like asking for a height it doesn't have, with a 500,
+        // so the body is what tells those apart from the node actually being in trouble.
+        let body: Option<Value> = res.json().await.ok();
+        if let Some(err) = body.as_ref().and_then(|x| x.get("error")) {
+            return Err(Failure::Rpc(err.clone()));
+        }
+        if status == StatusCode::TOO_MANY_REQUESTS || status.is_server_error() {
+            return Err(Failure::Transient {
+                error: anyhow!("RPC responded with {}", status),
+                retry_after,
+            });
+        }
+        if !status.is_success() {
+            return Err(Failure::Fatal(anyhow!("RPC responded with {}", status)));
+        }
+        match body.as_ref().and_then(|x| x.get("result")) {
+            Some(x) => Ok(x.clone()),
+            None => Err(Failure::Transient {
+                error: anyhow!("RPC response had no `result`"),
+                retry_after: None,
+            }),
+        }
+    }
+
+    /// Make a request, retrying failures that might go away.
+    ///
+    /// Errors reported by the node itself are returned as `Ok(Err(_))`, so that callers
+    /// can treat some of them as an answer, rather than a failure.
+    async fn request(
+        &self,
+        endpoint: &str,
+        params: &[(&str, &str)],
+    ) -> anyhow::Result<Result<Value, Value>> {
+        let url = format!("{}/{}", self.base_url, endpoint);
+        let mut backoff = self.retry.initial_backoff;
+        let mut attempt = 1;
+        loop {
+            let (error, retry_after) = match self.try_request(&url, params).await {
+                Ok(x) => return Ok(Ok(x)),
+                Err(Failure::Rpc(x)) => return Ok(Err(x)),
+                Err(Failure::Fatal(e)) => return Err(e.context(format!("requesting {}", url))),
+                Err(Failure::Transient { error, retry_after }) => (error, retry_after),
+            };
+            if attempt >= self.retry.attempts {
+                return Err(error.context(format!(
+                    "requesting {}, giving up after {} attempts",
+                    url, attempt
+                )));
+            }
+            let wait = retry_after.unwrap_or(backoff).min(self.retry.max_backoff);
+            tracing::warn!(
+                "request to {} failed, retrying in {:?}: {:#}",
+                url,
+                wait,
+                error
+            );
+            tokio::time::sleep(wait).await;
+            backoff = (backoff * 2).min(self.retry.max_backoff);
+            attempt += 1;
+        }
+    }
+
+    /// Make a request where any error reported by the node is a failure.
+    async fn request_result(
+        &self,
+        endpoint: &str,
+        params: &[(&str, &str)],
+    ) -> anyhow::Result<Value> {
+        self.request(endpoint, params)
+            .await?
+            .map_err(|e| anyhow!("JSON RPC error from {}: {}", endpoint, e))
+    }
+
+    /// Make a request for a height, returning `None` if the node doesn't have that height.
+    async fn request_at_height(
+        &self,
+        endpoint: &str,
+        height: u64,
+    ) -> anyhow::Result<Option<Value>> {
+        let height_string = height.to_string();
+        match self
+            .request(endpoint, &[("height", &height_string)])
+            .await?
+        {
+            Ok(x) => Ok(Some(x)),
+            Err(e) if is_unavailable_height_error(&e) => Ok(None),
+            Err(e) => Err(anyhow!(
+                "JSON RPC error from {} at height {}: {}",
+                endpoint,
+                height,
+                e
+            )),
+        }
+    }
+}
+
+/// Check if an error means that a node doesn't have a height, because it's pruned, or in the future.
+fn is_unavailable_height_error(error: &Value) -> bool {
+    // The details of what went wrong are only available as a message.
+    let data = error.get("data").and_then(|x| x.as_str()).unwrap_or("");
+    data.contains("is not available") || data.contains("must be less than or equal to")
+}
+
+/// Parse a hash, in the uppercase hex that cometbft uses.
+fn parse_hash(value: &Value) -> anyhow::Result<Vec<u8>> {
+    let string = value.as_str().ok_or(anyhow!("expected string"))?;
+    Ok(hex::decode(string)?)
+}
+
+#[async_trait]
+impl super::Store for RpcStore {
+    async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+        self.request_result("genesis", &[])
+            .await?
+            .expect_key("genesis")?
+            .clone()
+            .try_into()
+    }
+
+    async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+        let status = self.request_result("status", &[]).await?;
+        let sync_info = status.expect_key("sync_info")?;
+        let start = sync_info
+            .expect_key("earliest_block_height")?
+            .expect_u64_string()?;
+        let end = sync_info
+            .expect_key("latest_block_height")?
+            .expect_u64_string()?;
+        // A node that hasn't committed anything yet reports a latest height of 0.
+        if end == 0 {
+            return Ok(None);
+        }
+        Ok(Some((start, end)))
+    }
+
+    async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+        let Some(res) = self.request_at_height("block", height).await? else {
+            return Ok(None);
+        };
+        // A node may also be missing a block within its bounds, and report it as null.
+        let block: Block = match res.expect_key("block")? {
+            Value::Null => return Ok(None),
+            x => x.clone().try_into()?,
+        };
+        anyhow::ensure!(
+            block.height() == height,
+            "RPC returned block at height {}, when asked for height {}",
+            block.height(),
+            height
+        );
+        let hash = block.hash()?;
+        let reported = parse_hash(res.expect_key("block_id")?.expect_key("hash")?)
+            .context("failed to parse block id")?;
+        anyhow::ensure!(
+            reported == hash,
+            "block at height {} has hash {}, but the RPC reported {}",
+            height,
+            hex::encode_upper(hash),
+            hex::encode_upper(&reported)
+        );
+
+        let commit = self
+            .request_at_height("commit", height)
+            .await?
+            .ok_or(anyhow!(
+                "RPC has a block at height {}, but no commit",
+                height
+            ))?;
+        let commit = commit.expect_key("signed_header")?.expect_key("commit")?;
+        let commit_height = commit.expect_key("height")?.expect_u64_string()?;
+        anyhow::ensure!(
+            commit_height == height,
+            "RPC returned commit at height {}, when asked for height {}",
+            commit_height,
+            height
+        );
+        let committed = parse_hash(commit.expect_key("block_id")?.expect_key("hash")?)
+            .context("failed to parse commit block id")?;
+        anyhow::ensure!(
+            committed == hash,
+            "block at height {} has hash {}, but the commit for that height is for {}",
+            height,
+            hex::encode_upper(hash),
+            hex::encode_upper(&committed)
+        );
+        Ok(Some(block))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{LocalStore, LocalStoreGenesisLocation, LocalStoreOpts, Store};
+    use std::{
+        collections::BTreeMap,
+        path::Path,
+        sync::{Arc, Mutex},
+    };
+    use tokio::{
+        io::{AsyncReadExt as _, AsyncWriteExt as _},
+        net::TcpListener,
+    };
+
+    /// The blocks in the block store under test_data/cometbft.
+    const TEST_STORE_HEIGHTS: std::ops::RangeInclusive<u64> = 1..=5;
+
+    /// A canned response to a request.
+    struct Response {
+        status: u16,
+        headers: Vec<(&'static str, String)>,
+        body: Value,
+    }
+
+    impl Response {
+        fn result(result: Value) -> Self {
+            Self {
+                status: 200,
+                headers: Vec::new(),
+                body: serde_json::json!({ "jsonrpc": "2.0", "id": -1, "result": result }),
+            }
+        }
+
+        fn error(data: String) -> Self {
+            Self {
+                status: 500,
+                headers: Vec::new(),
+                body: serde_json::json!({
+                    "jsonrpc": "2.0",
+                    "id": -1,
+                    "error": { "code": -32603, "message": "Internal error", "data": data },
+                }),
+            }
+        }
+
+        fn unavailable(status: u16) -> Self {
+            Self {
+                status,
+                headers: vec![("Retry-After", "0".to_owned())],
+                body: Value::Null,
+            }
+        }
+    }
+
+    /// The state behind a mock cometbft RPC, serving a fixed set of blocks.
+    #[derive(Default)]
+    struct MockNode {
+        genesis: Value,
+        /// The height bounds the node reports, which may include heights it has no block for.
+        bounds: (u64, u64),
+        blocks: BTreeMap<u64, Block>,
+        /// Heights for which the node reports a different hash than that of the block served.
+        forged_block_ids: BTreeMap<u64, Vec<u8>>,
+        /// Heights for which the commit is for a different block than the one served.
+        forged_commits: BTreeMap<u64, Vec<u8>>,
+        /// Failures to respond with, before responding normally, to each endpoint.
+        failures: BTreeMap<String, Vec<u16>>,
+        /// Every request received, by endpoint.
+        requests: Vec<String>,
+    }
+
+    impl MockNode {
+        fn respond(&mut self, endpoint: &str, height: Option<u64>) -> Response {
+            self.requests.push(endpoint.to_owned());
+            if let Some(status) = self
+                .failures
+                .get_mut(endpoint)
+                .and_then(|x| (!x.is_empty()).then(|| x.remove(0)))
+            {
+                return Response::unavailable(status);
+            }
+            let height = height.unwrap_or(self.bounds.1);
+            if height < self.bounds.0 {
+                return Response::error(format!(
+                    "height {} is not available, lowest height is {}",
+                    height, self.bounds.0
+                ));
+            }
+            if height > self.bounds.1 {
+                return Response::error(format!(
+                    "height {} must be less than or equal to the current blockchain height {}",
+                    height, self.bounds.1
+                ));
+            }
+            let block = self.blocks.get(&height);
+            let hash = block.map(|x| hex::encode_upper(x.hash().expect("test block should hash")));
+            match endpoint {
+                "genesis" => Response::result(serde_json::json!({ "genesis": self.genesis })),
+                "status" => Response::result(serde_json::json!({
+                    "sync_info": {
+                        "earliest_block_height": self.bounds.0.to_string(),
+                        "latest_block_height": self.bounds.1.to_string(),
+                    }
+                })),
+                "block" => Response::result(serde_json::json!({
+                    "block_id": {
+                        "hash": match self.forged_block_ids.get(&height) {
+                            Some(x) => hex::encode_upper(x),
+                            None => hash.unwrap_or_default(),
+                        }
+                    },
+                    "block": block.map(|x| serde_json::to_value(&x.inner).expect("test block should serialize")),
+                })),
+                "commit" => {
+                    let hash = match self.forged_commits.get(&height) {
+                        Some(x) => hex::encode_upper(x),
+                        None => hash.unwrap_or_default(),
+                    };
+                    Response::result(serde_json::json!({
+                        "signed_header": {
+                            "commit": {
+                                "height": height.to_string(),
+                                "block_id": { "hash": hash },
+                            }
+                        },
+                        "canonical": true,
+                    }))
+                }
+                _ => Response {
+                    status: 404,
+                    headers: Vec::new(),
+                    body: Value::Null,
+                },
+            }
+        }
+    }
+
+    /// Serve a mock node over HTTP, returning the URL to reach it.
+    async fn serve(node: Arc<Mutex<MockNode>>) -> anyhow::Result<String> {
+        let listener = TcpListener::bind("127.0.0.1:0").await?;
+        let addr = listener.local_addr()?;
+        tokio::spawn(async move {
+            loop {
+                let Ok((mut socket, _)) = listener.accept().await else {
+                    return;
+                };
+                let node = node.clone();
+                tokio::spawn(async move {
+                    let mut buf = Vec::new();
+                    let mut chunk = [0u8; 1024];
+                    while !buf.windows(4).any(|x| x == b"\r\n\r\n") {
+                        match socket.read(&mut chunk).await {
+                            Ok(0) | Err(_) => return,
+                            Ok(n) => buf.extend_from_slice(&chunk[..n]),
+                        }
+                    }
+                    let request = String::from_utf8_lossy(&buf);
+                    let target = request.split(' ').nth(1).unwrap_or("/");
+                    let url = url::Url::parse(&format!("http://localhost{}", target))
+                        .expect("request target should be a valid path");
+                    let height = url
+                        .query_pairs()
+                        .find(|(k, _)| k == "height")
+                        .and_then(|(_, v)| v.parse().ok());
+                    let response = node
+                        .lock()
+                        .unwrap()
+                        .respond(url.path().trim_start_matches('/'), height);
+                    let body = serde_json::to_vec(&response.body).unwrap();
+                    let mut head = format!(
+                        "HTTP/1.1 {} MOCK\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n",
+                        response.status,
+                        body.len()
+                    );
+                    for (k, v) in response.headers {
+                        head.push_str(&format!("{}: {}\r\n", k, v));
+                    }
+                    head.push_str("\r\n");
+                    let _ = socket.write_all(head.as_bytes()).await;
+                    let _ = socket.write_all(&body).await;
+                });
+            }
+        });
+        Ok(format!("http://{}", addr))
+    }
+
+    fn test_data(path: &str) -> std::path::PathBuf {
+        Path::new(env!("CARGO_MANIFEST_DIR"))
+            .join("test_data")
+            .join(path)
+    }
+
+    /// A mock node with the blocks in the test block store, which have real hashes.
+    async fn test_node() -> anyhow::Result<MockNode> {
+        let store = LocalStore::init(
+            &test_data("cometbft"),
+            LocalStoreGenesisLocation::DirectFile(&test_data("genesis.json")),
+            LocalStoreOpts {
+                read_only: true,
+                ..Default::default()
+            },
+        )?;
+        let mut blocks = BTreeMap::new();
+        for height in TEST_STORE_HEIGHTS {
+            let block = store
+                .get_block(height)
+                .await?
+                .expect("test store should contain block");
+            blocks.insert(height, block);
+        }
+        Ok(MockNode {
+            genesis: serde_json::from_slice(&store.get_genesis().await?.encode()?)?,
+            bounds: (*TEST_STORE_HEIGHTS.start(), *TEST_STORE_HEIGHTS.end()),
+            blocks,
+            ..Default::default()
+        })
+    }
+
+    /// Create a store talking to a mock node, without waiting around between retries.
+    async fn test_store(node: MockNode) -> anyhow::Result<(RpcStore, Arc<Mutex<MockNode>>)> {
+        let node = Arc::new(Mutex::new(node));
+        let mut store = RpcStore::new(serve(node.clone()).await?);
+        store.retry = RetryPolicy {
+            attempts: 4,
+            initial_backoff: Duration::from_millis(1),
+            max_backoff: Duration::from_millis(10),
+        };
+        Ok((store, node))
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_block_hash_matches_next_block() -> anyhow::Result<()> {
+        let node = test_node().await?;
+        for height in *TEST_STORE_HEIGHTS.start()..*TEST_STORE_HEIGHTS.end() {
+            let next = &node.blocks[&(height + 1)];
+            let last_block_id = next
+                .inner
+                .header
+                .last_block_id
+                .as_ref()
+                .expect("test block should have a last block id");
+            assert_eq!(
+                node.blocks[&height].hash()?.as_slice(),
+                last_block_id.hash.as_bytes()
+            );
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_fetches_blocks_through_retries() -> anyhow::Result<()> {
+        let mut node = test_node().await?;
+        let expected = node.blocks.clone();
+        node.failures.insert("status".to_owned(), vec![503]);
+        node.failures.insert("block".to_owned(), vec![429, 502]);
+        node.failures.insert("commit".to_owned(), vec![500]);
+        let (store, node) = test_store(node).await?;
+
+        assert_eq!(
+            store.get_height_bounds().await?,
+            Some((*TEST_STORE_HEIGHTS.start(), *TEST_STORE_HEIGHTS.end()))
+        );
+        assert_eq!(store.get_genesis().await?.chain_id(), "penumbra-1");
+        let mut blocks = BTreeMap::new();
+        for height in TEST_STORE_HEIGHTS {
+            let block = store.get_block(height).await?;
+            blocks.insert(height, block.expect("node should have block"));
+        }
+        assert_eq!(blocks, expected);
+
+        let node = node.lock().unwrap();
+        let count = |endpoint: &str| node.requests.iter().filter(|x| *x == endpoint).count();
+        assert_eq!(count("status"), 2);
+        assert_eq!(count("block"), TEST_STORE_HEIGHTS.count() + 2);
+        assert_eq!(count("commit"), TEST_STORE_HEIGHTS.count() + 1);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_gives_up_after_retries() -> anyhow::Result<()> {
+        let mut node = test_node().await?;
+        node.failures.insert("block".to_owned(), vec![503; 10]);
+        let (store, node) = test_store(node).await?;
+        let err = store
+            .get_block(1)
+            .await
+            .expect_err("a node that's always unavailable should fail");
+        assert!(err.to_string().contains("4 attempts"), "{:#}", err);
+        assert_eq!(node.lock().unwrap().requests.len(), 4);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_missing_heights() -> anyhow::Result<()> {
+        let mut node = test_node().await?;
+        // The node has pruned the first block, and lost the third.
+        node.bounds = (2, 5);
+        node.blocks.remove(&3);
+        let (store, node) = test_store(node).await?;
+        assert!(store.get_block(1).await?.is_none());
+        assert!(store.get_block(2).await?.is_some());
+        assert!(store.get_block(3).await?.is_none());
+        assert!(store.get_block(6).await?.is_none());
+        // None of these should have needed retrying.
+        assert_eq!(node.lock().unwrap().requests.len(), 5);
+
+        // Streaming over the missing block should fail, rather than skipping it.
+        let heights = {
+            use tokio_stream::StreamExt as _;
+            let mut heights = Vec::new();
+            let mut stream = store.stream_blocks(None, None);
+            let err = loop {
+                match stream.next().await {
+                    Some(Ok((height, _))) => heights.push(height),
+                    Some(Err(e)) => break e,
+                    None => anyhow::bail!("stream should fail at the missing block"),
+                }
+            };
+            assert!(err.to_string().contains("height 3"), "{:#}", err);
+            heights
+        };
+        assert_eq!(heights, vec![2]);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_rejects_mismatched_hashes() -> anyhow::Result<()> {
+        let mut node = test_node().await?;
+        let other = node.blocks[&1].hash()?.to_vec();
+        node.forged_block_ids.insert(2, other.clone());
+        node.forged_commits.insert(3, other);
+        // Serve the wrong block entirely, which the node reports the hash of, at another height.
+        let wrong = node.blocks[&5].clone();
+        node.blocks.insert(4, wrong);
+        let (store, _) = test_store(node).await?;
+
+        let err = store
+            .get_block(2)
+            .await
+            .expect_err("a block not matching its id should be rejected");
+        assert!(err.to_string().contains("RPC reported"), "{:#}", err);
+        let err = store
+            .get_block(3)
+            .await
+            .expect_err("a commit for another block should be rejected");
+        assert!(err.to_string().contains("commit"), "{:#}", err);
+        let err = store
+            .get_block(4)
+            .await
+            .expect_err("a block at the wrong height should be rejected");
+        assert!(err.to_string().contains("asked for height 4"), "{:#}", err);
+        Ok(())
+    }
+}
@@ -0,0 +1,375 @@
+use anyhow::anyhow;
+use async_trait::async_trait;
+
+use super::{Block, Genesis, Store};
+
+/// One of the stores stitched together, with what's known about it when stitching.
+struct Part {
+    /// How the store is named in errors, say by its directory.
+    name: String,
+    store: Box<dyn Store>,
+    genesis: Genesis,
+    /// The first and last heights of the store, when it was stitched.
+    bounds: (u64, u64),
+}
+
+/// A store reading from several stores of the same chain, as if they were a single one.
+///
+/// After an upgrade, a node may keep the blocks from before it in a store of their own,
+/// so that its full history spans several stores. Each height is read from whichever of
+/// the stores has it, and a height several of them have must have the same block in each.
+pub struct StitchedStore {
+    /// The stores with blocks, in order of their first height.
+    parts: Vec<Part>,
+}
+
+impl StitchedStore {
+    /// Stitch stores together, checking that every height between them is in one of them.
+    ///
+    /// The stores can be given in any order, and overlap, but must be of the same chain.
+    /// Empty stores are left out, since there's nothing to read from them.
+    pub async fn new(stores: Vec<(String, Box<dyn Store>)>) -> anyhow::Result<Self> {
+        let mut parts = Vec::with_capacity(stores.len());
+        for (name, store) in stores {
+            let Some(bounds) = store.get_height_bounds().await? else {
+                tracing::warn!("store '{}' is empty, so no blocks are read from it", name);
+                continue;
+            };
+            let genesis = store.get_genesis().await?;
+            parts.push(Part {
+                name,
+                store,
+                genesis,
+                bounds,
+            });
+        }
+        parts.sort_by_key(|x| x.bounds);
+        let first = parts
+            .first()
+            .ok_or(anyhow!("none of the stores to read from have any blocks"))?;
+        for part in &parts[1..] {
+            anyhow::ensure!(
+                part.genesis.chain_id() == first.genesis.chain_id(),
+                "store '{}' is of chain '{}', but store '{}' is of chain '{}'",
+                part.name,
+                part.genesis.chain_id(),
+                first.name,
+                first.genesis.chain_id()
+            );
+        }
+        // The overlaps are checked as their blocks are read, but checking where each one
+        // starts catches stores which have nothing to do with each other before then.
+        let mut overlaps = Vec::new();
+        let mut covered = &parts[0];
+        for part in &parts[1..] {
+            let end = covered.bounds.1;
+            if part.bounds.0 > end + 1 {
+                anyhow::bail!(
+                    "heights {}..={} are in none of the stores, between store '{}', ending at height {}, and store '{}', starting at height {}",
+                    end + 1,
+                    part.bounds.0 - 1,
+                    covered.name,
+                    end,
+                    part.name,
+                    part.bounds.0
+                );
+            }
+            if part.bounds.0 <= end {
+                overlaps.push(part.bounds.0);
+            }
+            if part.bounds.1 > end {
+                covered = part;
+            }
+        }
+        let out = Self { parts };
+        for height in overlaps {
+            out.get_block(height).await?;
+        }
+        Ok(out)
+    }
+
+    /// The stores which have, or might have, the block at a height.
+    ///
+    /// The store ending last is read from for any height after it starts, since a node might
+    /// still be adding blocks to it.
+    fn covering(&self, height: u64) -> impl Iterator<Item = &Part> + '_ {
+        let last_end = self.parts.iter().map(|x| x.bounds.1).max().unwrap_or(0);
+        self.parts.iter().filter(move |x| {
+            x.bounds.0 <= height && (height <= x.bounds.1 || x.bounds.1 == last_end)
+        })
+    }
+}
+
+/// Merge ranges of heights, inclusive on both ends, which overlap or touch.
+fn merge_ranges(mut ranges: Vec<(u64, u64)>) -> Vec<(u64, u64)> {
+    ranges.sort();
+    let mut out: Vec<(u64, u64)> = Vec::with_capacity(ranges.len());
+    for (start, end) in ranges {
+        match out.last_mut() {
+            Some(last) if start <= last.1 + 1 => last.1 = last.1.max(end),
+            _ => out.push((start, end)),
+        }
+    }
+    out
+}
+
+#[async_trait]
+impl Store for StitchedStore {
+    async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+        Ok(self.parts[0].genesis.clone())
+    }
+
+    async fn get_geneses(&self) -> anyhow::Result<Vec<Genesis>> {
+        let mut out: Vec<Genesis> = Vec::new();
+        for part in &self.parts {
+            if !out
+                .iter()
+                .any(|x| x.initial_height() == part.genesis.initial_height())
+            {
+                out.push(part.genesis.clone());
+            }
+        }
+        out.sort_by_key(|x| x.initial_height());
+        Ok(out)
+    }
+
+    async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+        let mut out: Option<(u64, u64)> = None;
+        for part in &self.parts {
+            if let Some((first, last)) = part.store.get_height_bounds().await? {
+                out = Some(match out {
+                    None => (first, last),
+                    Some(x) => (x.0.min(first), x.1.max(last)),
+                });
+            }
+        }
+        Ok(out)
+    }
+
+    async fn get_gaps(&self) -> anyhow::Result<Option<Vec<(u64, u64)>>> {
+        // A height is only missing if it's missing from every store.
+        let mut present = Vec::new();
+        for part in &self.parts {
+            let Some((first, last)) = part.store.get_height_bounds().await? else {
+                continue;
+            };
+            let Some(gaps) = part.store.get_gaps().await? else {
+                return Ok(None);
+            };
+            let mut start = first;
+            for (from, to) in gaps {
+                if from > start {
+                    present.push((start, from - 1));
+                }
+                start = to + 1;
+            }
+            if start <= last {
+                present.push((start, last));
+            }
+        }
+        let present = merge_ranges(present);
+        Ok(Some(
+            present
+                .windows(2)
+                .map(|pair| (pair[0].1 + 1, pair[1].0 - 1))
+                .collect(),
+        ))
+    }
+
+    async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+        let mut found: Option<(&str, Block)> = None;
+        for part in self.covering(height) {
+            let Some(block) = part.store.get_block(height).await? else {
+                continue;
+            };
+            if let Some((name, x)) = &found {
+                anyhow::ensure!(
+                    *x == block,
+                    "stores '{}' and '{}' have different blocks at height {}, differing in {}",
+                    name,
+                    part.name,
+                    height,
+                    x.differing_fields(&block).join(", ")
+                );
+                continue;
+            }
+            found = Some((&part.name, block));
+        }
+        Ok(found.map(|x| x.1))
+    }
+
+    async fn get_extended_commit(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        for part in self.covering(height) {
+            if let Some(x) = part.store.get_extended_commit(height).await? {
+                return Ok(Some(x));
+            }
+        }
+        Ok(None)
+    }
+
+    async fn get_block_id(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        for part in self.covering(height) {
+            if let Some(x) = part.store.get_block_id(height).await? {
+                return Ok(Some(x));
+            }
+        }
+        Ok(None)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    /// A store holding the test block at every height between two bounds, but for some gaps.
+    struct TestStore {
+        first: u64,
+        last: u64,
+        gaps: Vec<(u64, u64)>,
+        /// The chain the genesis of the store is of.
+        chain_id: &'static str,
+        /// Blocks at these heights are made at another time, so differ from the other stores.
+        different: Vec<u64>,
+    }
+
+    impl TestStore {
+        fn new(first: u64, last: u64) -> Self {
+            Self {
+                first,
+                last,
+                gaps: Vec::new(),
+                chain_id: "penumbra-1",
+                different: Vec::new(),
+            }
+        }
+    }
+
+    #[async_trait]
+    impl Store for TestStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            let genesis = Genesis::test_value_at_height(self.first);
+            let mut value: serde_json::Value = serde_json::from_slice(&genesis.encode()?)?;
+            value["chain_id"] = self.chain_id.into();
+            Genesis::from_value(value)
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            Ok(Some((self.first, self.last)))
+        }
+
+        async fn get_gaps(&self) -> anyhow::Result<Option<Vec<(u64, u64)>>> {
+            Ok(Some(self.gaps.clone()))
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            let missing = self.gaps.iter().any(|x| x.0 <= height && height <= x.1);
+            if height < self.first || height > self.last || missing {
+                return Ok(None);
+            }
+            if self.different.contains(&height) {
+                return Ok(Some(Block::test_value_at_time(height, 1)));
+            }
+            Ok(Some(Block::test_value_at_height(height)))
+        }
+    }
+
+    fn parts(stores: Vec<TestStore>) -> Vec<(String, Box<dyn Store>)> {
+        stores
+            .into_iter()
+            .enumerate()
+            .map(|(i, x)| (format!("store{}", i), Box::new(x) as Box<dyn Store>))
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn test_stitched_stores_read_as_one() -> anyhow::Result<()> {
+        // The newer store is given first, and overlaps the older one at heights 8..=10.
+        let store =
+            StitchedStore::new(parts(vec![TestStore::new(8, 20), TestStore::new(1, 10)])).await?;
+        assert_eq!(store.get_height_bounds().await?, Some((1, 20)));
+        assert_eq!(store.get_gaps().await?, Some(vec![]));
+        for height in 1..=20 {
+            assert_eq!(
+                store.get_block(height).await?,
+                Some(Block::test_value_at_height(height))
+            );
+        }
+        assert_eq!(store.get_block(21).await?, None);
+        assert_eq!(store.get_genesis().await?.initial_height(), 1);
+        assert_eq!(
+            store
+                .get_geneses()
+                .await?
+                .iter()
+                .map(|x| x.initial_height())
+                .collect::<Vec<_>>(),
+            vec![1, 8]
+        );
+
+        // A gap in one store is filled by another, and a gap in every store is reported.
+        let store = StitchedStore::new(parts(vec![
+            TestStore {
+                gaps: vec![(3, 4), (8, 9)],
+                ..TestStore::new(1, 10)
+            },
+            TestStore::new(7, 12),
+        ]))
+        .await?;
+        assert_eq!(store.get_gaps().await?, Some(vec![(3, 4)]));
+        assert_eq!(
+            store.get_block(8).await?,
+            Some(Block::test_value_at_height(8))
+        );
+        assert_eq!(store.get_block(3).await?, None);
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_stitched_stores_are_checked() -> anyhow::Result<()> {
+        let err = StitchedStore::new(parts(vec![TestStore::new(1, 10), TestStore::new(15, 20)]))
+            .await
+            .err()
+            .expect("the stores leave a gap");
+        assert!(
+            err.to_string()
+                .contains("heights 11..=14 are in none of the stores"),
+            "{:#}",
+            err
+        );
+
+        let other_chain = TestStore {
+            chain_id: "penumbra-testnet-phobos-2",
+            ..TestStore::new(11, 20)
+        };
+        let err = StitchedStore::new(parts(vec![TestStore::new(1, 10), other_chain]))
+            .await
+            .err()
+            .expect("the stores are of different chains");
+        assert!(err.to_string().contains("is of chain"), "{:#}", err);
+
+        // Blocks the stores disagree about are caught, where the overlap starts or within it.
+        for different in [vec![8], vec![9]] {
+            let disagreeing = TestStore {
+                different: different.clone(),
+                ..TestStore::new(8, 20)
+            };
+            let store = StitchedStore::new(parts(vec![TestStore::new(1, 10), disagreeing])).await;
+            let err = match store {
+                Err(e) => e,
+                Ok(store) => store
+                    .get_block(different[0])
+                    .await
+                    .expect_err("the stores disagree about this block"),
+            };
+            assert!(
+                err.to_string().contains(&format!(
+                    "have different blocks at height {}, differing in header.time",
+                    different[0]
+                )),
+                "{:#}",
+                err
+            );
+        }
+        Ok(())
+    }
+}
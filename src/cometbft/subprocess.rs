@@ -0,0 +1,556 @@
+//! The block store reader, running the Go code as a separate process.
+//!
+//! Rather than linking against Go code, this runs the `store-server` command from go/cmd,
+//! which can be built without cgo, and talks to it over its stdin and stdout, using
+//! the protocol described in go/storeserver/server.go.
+use anyhow::{anyhow, Context};
+use std::io::{BufReader, BufWriter, Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::Mutex;
+
+use super::{
+    block_exceeds_limit, decode_gaps, decode_size_stats, BlockSizeStats, DbOptions,
+    BLOCK_HASH_SIZE, EXPECTED_BLOCK_PROTO_SIZE,
+};
+
+/// The variable overriding which store server binary to run.
+const SERVER_PATH_VAR: &str = "PENUMBRA_REINDEXER_STORE_SERVER";
+
+// Operations, mirroring the `Op` constants in go/storeserver/server.go.
+const OP_OPEN: u8 = 1;
+const OP_HEIGHT_RANGE: u8 = 2;
+const OP_BLOCK_BY_HEIGHT: u8 = 3;
+const OP_GENESIS_DOC: u8 = 4;
+const OP_GAPS: u8 = 5;
+const OP_SAVE_BLOCK: u8 = 6;
+const OP_VALIDATE: u8 = 7;
+const OP_DETECT_BACKEND: u8 = 8;
+const OP_BLOCK_HASH: u8 = 9;
+const OP_APP_HEIGHT: u8 = 10;
+const OP_SET_MAX_BLOCK_SIZE: u8 = 11;
+const OP_EXTENDED_COMMIT_BY_HEIGHT: u8 = 12;
+const OP_BACKEND: u8 = 13;
+const OP_CHAIN_ID: u8 = 14;
+const OP_EVIDENCE_BY_HEIGHT: u8 = 15;
+const OP_HASH_BY_HEIGHT: u8 = 16;
+const OP_VERIFY_BLOCK_HASHES: u8 = 17;
+const OP_SIZE_STATS: u8 = 18;
+const OP_BLOCK_BY_HEIGHT_COMPRESSED: u8 = 19;
+const OP_SEEN_COMMIT_BY_HEIGHT: u8 = 20;
+
+// Flags for opening a store, mirroring the `Flag` constants in go/storeserver/server.go.
+const FLAG_READ_ONLY: u8 = 1 << 0;
+const FLAG_CREATE: u8 = 1 << 1;
+const FLAG_DISABLE_COMPACTION: u8 = 1 << 2;
+const FLAG_BACKEND_FALLBACK: u8 = 1 << 3;
+
+// Statuses, mirroring the `Status` constants in go/storeserver/server.go.
+const STATUS_OK: u8 = 0;
+const STATUS_NOT_FOUND: u8 = 1;
+const STATUS_ERROR: u8 = 2;
+const STATUS_STORE_NOT_FOUND: u8 = 3;
+const STATUS_EXCEEDS_LIMIT: u8 = 4;
+const STATUS_BEYOND_RANGE: u8 = 5;
+
+/// The store server binary to run.
+///
+/// This is the one the build script built, unless overridden at runtime.
+fn server_path() -> PathBuf {
+    match std::env::var_os(SERVER_PATH_VAR) {
+        Some(path) => PathBuf::from(path),
+        None => PathBuf::from(env!("PENUMBRA_REINDEXER_STORE_SERVER_PATH")),
+    }
+}
+
+/// A request, built up from an operation and its arguments.
+struct Request(Vec<u8>);
+
+impl Request {
+    fn new(op: u8) -> Self {
+        Self(vec![op])
+    }
+
+    fn byte(mut self, x: u8) -> Self {
+        self.0.push(x);
+        self
+    }
+
+    fn int64(mut self, x: i64) -> Self {
+        self.0.extend_from_slice(&x.to_le_bytes());
+        self
+    }
+
+    fn bytes(mut self, x: &[u8]) -> anyhow::Result<Self> {
+        let len = u32::try_from(x.len()).context("argument should fit into a request")?;
+        self.0.extend_from_slice(&len.to_le_bytes());
+        self.0.extend_from_slice(x);
+        Ok(self)
+    }
+
+    fn path(self, x: &Path) -> anyhow::Result<Self> {
+        self.bytes(x.as_os_str().as_encoded_bytes())
+    }
+}
+
+/// A connection to a running store server.
+struct Client {
+    child: Child,
+    // This is an option so that dropping the client can close it first.
+    stdin: Option<BufWriter<ChildStdin>>,
+    stdout: BufReader<ChildStdout>,
+}
+
+impl Client {
+    fn spawn() -> anyhow::Result<Self> {
+        let path = server_path();
+        let mut child = Command::new(&path)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::inherit())
+            .spawn()
+            .with_context(|| {
+                format!(
+                    "failed to run the cometbft store server at '{}'; set {} to override it",
+                    path.display(),
+                    SERVER_PATH_VAR
+                )
+            })?;
+        let stdin = child.stdin.take().expect("stdin should be piped");
+        let stdout = child.stdout.take().expect("stdout should be piped");
+        Ok(Self {
+            child,
+            stdin: Some(BufWriter::new(stdin)),
+            stdout: BufReader::new(stdout),
+        })
+    }
+
+    /// Send a request, and read back the status of the response, with its body in `out`.
+    fn call(&mut self, request: Request, out: &mut Vec<u8>) -> anyhow::Result<u8> {
+        self.send(&request.0)
+            .and_then(|_| self.receive(out))
+            .context("failed to talk to the cometbft store server")
+    }
+
+    fn send(&mut self, request: &[u8]) -> anyhow::Result<()> {
+        let stdin = self
+            .stdin
+            .as_mut()
+            .expect("stdin should only be closed on drop");
+        let len = u32::try_from(request.len()).context("request should fit into a frame")?;
+        stdin.write_all(&len.to_le_bytes())?;
+        stdin.write_all(request)?;
+        stdin.flush()?;
+        Ok(())
+    }
+
+    fn receive(&mut self, out: &mut Vec<u8>) -> anyhow::Result<u8> {
+        let mut header = [0u8; 5];
+        self.stdout.read_exact(&mut header)?;
+        let len = u32::from_le_bytes(header[..4].try_into().expect("header should have a length"));
+        anyhow::ensure!(len > 0, "response is missing its status");
+        out.clear();
+        out.resize(usize::try_from(len - 1)?, 0);
+        self.stdout.read_exact(out)?;
+        Ok(header[4])
+    }
+
+    /// Send a request, returning the body of the response if it's there.
+    fn call_found(&mut self, request: Request, out: &mut Vec<u8>) -> anyhow::Result<bool> {
+        match self.call(request, out)? {
+            STATUS_OK => Ok(true),
+            STATUS_NOT_FOUND => Ok(false),
+            STATUS_ERROR | STATUS_STORE_NOT_FOUND => Err(server_error(out)),
+            x => anyhow::bail!("unexpected status {} from cometbft store server", x),
+        }
+    }
+
+    /// Send a request, returning the body of the response, which must be there.
+    fn call_ok(&mut self, request: Request) -> anyhow::Result<Vec<u8>> {
+        let mut out = Vec::new();
+        anyhow::ensure!(
+            self.call_found(request, &mut out)?,
+            "cometbft store server found nothing"
+        );
+        Ok(out)
+    }
+}
+
+impl Drop for Client {
+    fn drop(&mut self) {
+        // Closing its input makes the server close its store, and exit.
+        drop(self.stdin.take());
+        let _ = self.child.wait();
+    }
+}
+
+fn server_error(message: &[u8]) -> anyhow::Error {
+    anyhow!("cometbft store: {}", String::from_utf8_lossy(message))
+}
+
+/// A server for the requests that don't need a store, started on first use.
+static SHARED: Mutex<Option<Client>> = Mutex::new(None);
+
+/// Run a request which doesn't need a store, on the shared server.
+fn call_shared(request: Request) -> anyhow::Result<Vec<u8>> {
+    let mut shared = SHARED.lock().unwrap_or_else(|e| e.into_inner());
+    let client = match shared.as_mut() {
+        Some(client) => client,
+        None => shared.insert(Client::spawn()?),
+    };
+    let res = client.call_ok(request);
+    if res.is_err() && client.child.try_wait().ok().flatten().is_some() {
+        // Start afresh next time, rather than talking to a server that's gone.
+        *shared = None;
+    }
+    res
+}
+
+/// Guess which cometbft-db backend created the block store in a cometbft data directory.
+pub fn detect_backend(data_dir: &Path) -> anyhow::Result<String> {
+    let out = call_shared(Request::new(OP_DETECT_BACKEND).path(data_dir)?).context(format!(
+        "failed to detect the backend of the block store in '{}'",
+        data_dir.display()
+    ))?;
+    Ok(String::from_utf8(out)?)
+}
+
+/// Compute the hash of an encoded block.
+pub fn block_hash(data: &[u8]) -> anyhow::Result<[u8; BLOCK_HASH_SIZE]> {
+    let out = call_shared(Request::new(OP_BLOCK_HASH).bytes(data)?)?;
+    out.try_into().map_err(|x: Vec<u8>| {
+        anyhow!(
+            "block hash should be {} bytes, not {}",
+            BLOCK_HASH_SIZE,
+            x.len()
+        )
+    })
+}
+
+/// Check that an encoded block hashes to what its header claims, and to its ID, if given.
+pub fn verify_block_hashes(data: &[u8], block_id: Option<&[u8]>) -> anyhow::Result<()> {
+    call_shared(
+        Request::new(OP_VERIFY_BLOCK_HASHES)
+            .bytes(data)?
+            .bytes(block_id.unwrap_or_default())?,
+    )?;
+    Ok(())
+}
+
+/// A cometbft store, held by a store server of its own.
+///
+/// Each store runs its own server, keeping stores as independent as they'd be in process.
+pub struct RawStore {
+    client: Client,
+    buf: Vec<u8>,
+    /// The maximum block size given to the server, or 0 if there's none.
+    max_block_size: u64,
+}
+
+impl RawStore {
+    /// Open the existing store in a directory, failing if there's no store there.
+    ///
+    /// `db_name` is the name of the database holding the store, usually [super::DEFAULT_BLOCKSTORE_NAME].
+    pub fn new(backend: &str, dir: &Path, db_name: &str, read_only: bool) -> anyhow::Result<Self> {
+        Self::with_options(backend, dir, db_name, read_only, &DbOptions::default())
+    }
+
+    /// Open the existing store in a directory, like [Self::new], tuning its database with options.
+    pub fn with_options(
+        backend: &str,
+        dir: &Path,
+        db_name: &str,
+        read_only: bool,
+        options: &DbOptions,
+    ) -> anyhow::Result<Self> {
+        let flags = if read_only { FLAG_READ_ONLY } else { 0 };
+        Self::open(backend, dir, db_name, flags, options).context(format!(
+            "failed to open cometbft store at '{}'",
+            dir.display()
+        ))
+    }
+
+    /// Open the store in a directory for writing, creating an empty one if there's none there.
+    pub fn create(backend: &str, dir: &Path, db_name: &str) -> anyhow::Result<Self> {
+        Self::open(backend, dir, db_name, FLAG_CREATE, &DbOptions::default()).context(format!(
+            "failed to create cometbft store at '{}'",
+            dir.display()
+        ))
+    }
+
+    fn open(
+        backend: &str,
+        dir: &Path,
+        db_name: &str,
+        mut flags: u8,
+        options: &DbOptions,
+    ) -> anyhow::Result<Self> {
+        if options.disable_compaction {
+            flags |= FLAG_DISABLE_COMPACTION;
+        }
+        if !options.strict_backend {
+            flags |= FLAG_BACKEND_FALLBACK;
+        }
+        let block_cache_size = i64::try_from(options.block_cache_bytes.unwrap_or(0))
+            .context("block cache size should fit into an i64")?;
+        let request = Request::new(OP_OPEN)
+            .byte(flags)
+            .bytes(backend.as_bytes())?
+            .path(dir)?
+            .bytes(db_name.as_bytes())?
+            .int64(block_cache_size)
+            .bytes(options.compression.as_deref().unwrap_or("").as_bytes())?;
+        let mut client = Client::spawn()?;
+        let mut buf = Vec::with_capacity(EXPECTED_BLOCK_PROTO_SIZE);
+        match client.call(request, &mut buf)? {
+            STATUS_OK => {}
+            STATUS_STORE_NOT_FOUND => {
+                return Err(server_error(&buf)).context(format!(
+                    "no cometbft block store at '{}'; is this the right directory?",
+                    dir.display()
+                ));
+            }
+            _ => return Err(server_error(&buf)),
+        }
+        Ok(Self {
+            client,
+            buf,
+            max_block_size: 0,
+        })
+    }
+
+    /// Append an encoded block, and the encoded commit seen for it, to the store.
+    pub fn save_block(&mut self, block: &[u8], commit: &[u8]) -> anyhow::Result<()> {
+        let request = Request::new(OP_SAVE_BLOCK).bytes(block)?.bytes(commit)?;
+        self.client.call_ok(request)?;
+        Ok(())
+    }
+
+    /// Read the first and last heights of the store, consistently with each other.
+    pub fn height_range(&mut self) -> anyhow::Result<(i64, i64)> {
+        let out = self.client.call_ok(Request::new(OP_HEIGHT_RANGE))?;
+        anyhow::ensure!(out.len() == 16, "height range should be two heights");
+        let (first, last) = out.split_at(8);
+        Ok((
+            i64::from_le_bytes(first.try_into()?),
+            i64::from_le_bytes(last.try_into()?),
+        ))
+    }
+
+    /// Check that the blocks at the first and last heights of the store actually load.
+    pub fn validate(&mut self) -> anyhow::Result<()> {
+        self.client.call_ok(Request::new(OP_VALIDATE))?;
+        Ok(())
+    }
+
+    /// The type of the backend the store was opened with.
+    pub fn backend(&mut self) -> anyhow::Result<String> {
+        let out = self.client.call_ok(Request::new(OP_BACKEND))?;
+        Ok(String::from_utf8(out)?)
+    }
+
+    /// Read the chain id from the header of the first block in the store.
+    ///
+    /// This fails if the store has no blocks.
+    pub fn chain_id(&mut self) -> anyhow::Result<String> {
+        let out = self.client.call_ok(Request::new(OP_CHAIN_ID))?;
+        Ok(String::from_utf8(out)?)
+    }
+
+    /// Read the hash of the block at a given height, as recorded in its metadata, as its ID.
+    pub fn hash_by_height(&mut self, height: i64) -> anyhow::Result<Option<[u8; BLOCK_HASH_SIZE]>> {
+        let Some(out) = self.read_into_buf(Request::new(OP_HASH_BY_HEIGHT).int64(height))? else {
+            return Ok(None);
+        };
+        Ok(Some(out.try_into().map_err(|_| {
+            anyhow!(
+                "block hash should be {} bytes, not {}",
+                BLOCK_HASH_SIZE,
+                out.len()
+            )
+        })?))
+    }
+
+    /// Read the height of the last block applied to the application, if there's state recorded.
+    pub fn app_height(&mut self) -> anyhow::Result<Option<i64>> {
+        let Some(out) = self.read_into_buf(Request::new(OP_APP_HEIGHT))? else {
+            return Ok(None);
+        };
+        Ok(Some(i64::from_le_bytes(
+            out.try_into()
+                .context("app height should be a single height")?,
+        )))
+    }
+
+    /// Make reading blocks larger than a given size fail, rather than allocate for them.
+    ///
+    /// A size of 0 removes the limit.
+    pub fn set_max_block_size(&mut self, size: u64) -> anyhow::Result<()> {
+        let request = Request::new(OP_SET_MAX_BLOCK_SIZE)
+            .int64(i64::try_from(size).context("maximum block size should fit into an i64")?);
+        self.client.call_ok(request)?;
+        self.max_block_size = size;
+        Ok(())
+    }
+
+    pub fn block_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(Request::new(OP_BLOCK_BY_HEIGHT).int64(height))
+    }
+
+    pub fn block_by_height_compressed(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(Request::new(OP_BLOCK_BY_HEIGHT_COMPRESSED).int64(height))
+    }
+
+    /// Read the encoded blocks between two heights (inclusive), in order, with their heights.
+    ///
+    /// Like the cgo store, reading stops before the first height without a block. The server
+    /// answers one block per request, so the blocks are simply read in turn.
+    pub fn blocks_range(&mut self, start: i64, end: i64) -> anyhow::Result<Vec<(i64, Vec<u8>)>> {
+        let mut out = Vec::new();
+        for height in start..=end {
+            match self.block_by_height(height)? {
+                Some(data) => out.push((height, data.to_vec())),
+                None => break,
+            }
+        }
+        Ok(out)
+    }
+
+    /// Read the evidence committed in the block at a given height, if there's any.
+    pub fn evidence_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(Request::new(OP_EVIDENCE_BY_HEIGHT).int64(height))
+    }
+
+    /// Read the encoded commit the node saw for the block at a given height, if there is one.
+    ///
+    /// Only the last block of a store is guaranteed to have one.
+    pub fn seen_commit_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(Request::new(OP_SEEN_COMMIT_BY_HEIGHT).int64(height))
+    }
+
+    /// Read the extended commit, with vote extensions, for a given height, if there is one.
+    pub fn extended_commit_by_height(&mut self, height: i64) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(Request::new(OP_EXTENDED_COMMIT_BY_HEIGHT).int64(height))
+    }
+
+    /// Read the genesis saved by the node, if there is one.
+    pub fn genesis_doc(&mut self) -> anyhow::Result<Option<&[u8]>> {
+        self.read_into_buf(Request::new(OP_GENESIS_DOC))
+    }
+
+    /// Find the ranges of heights missing between the first and last heights of the store.
+    ///
+    /// Each range is inclusive on both ends.
+    pub fn gaps(&mut self) -> anyhow::Result<Vec<(i64, i64)>> {
+        let data = self
+            .read_into_buf(Request::new(OP_GAPS))?
+            .unwrap_or_default();
+        Ok(decode_gaps(data))
+    }
+
+    /// Sum up the sizes of the blocks in the store, from their metadata, without loading them.
+    pub fn size_stats(&mut self) -> anyhow::Result<BlockSizeStats> {
+        let data = self
+            .read_into_buf(Request::new(OP_SIZE_STATS))?
+            .unwrap_or_default();
+        decode_size_stats(data)
+    }
+
+    /// Run a request, reading the body of its response into our buffer, if there is one.
+    fn read_into_buf(&mut self, request: Request) -> anyhow::Result<Option<&[u8]>> {
+        match self.client.call(request, &mut self.buf)? {
+            STATUS_OK => Ok(Some(self.buf.as_slice())),
+            STATUS_NOT_FOUND | STATUS_BEYOND_RANGE => Ok(None),
+            STATUS_EXCEEDS_LIMIT => {
+                let size = i64::from_le_bytes(
+                    self.buf
+                        .as_slice()
+                        .try_into()
+                        .context("block size should be like a height")?,
+                );
+                Err(block_exceeds_limit(size, self.max_block_size))
+            }
+            _ => Err(server_error(&self.buf)),
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{DEFAULT_BLOCKSTORE_NAME, MEMORY_BACKEND};
+
+    #[test]
+    fn test_store_can_be_reopened() -> anyhow::Result<()> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-subprocess-reopen-{}",
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        let original =
+            Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft/data/blockstore.db");
+        std::fs::create_dir_all(dir.join("blockstore.db"))?;
+        for entry in std::fs::read_dir(original)? {
+            let entry = entry?;
+            std::fs::copy(
+                entry.path(),
+                dir.join("blockstore.db").join(entry.file_name()),
+            )?;
+        }
+        // Opening with write access locks the store, so this only works if the server let go of it.
+        for _ in 0..2 {
+            let mut store = RawStore::new("goleveldb", &dir, DEFAULT_BLOCKSTORE_NAME, false)?;
+            assert_eq!(store.height_range()?, (1, 5));
+        }
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_errors_are_reported() -> anyhow::Result<()> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-subprocess-errors-{}",
+            std::process::id()
+        ));
+        let mut store = RawStore::create(MEMORY_BACKEND, &dir, DEFAULT_BLOCKSTORE_NAME)?;
+        let err = store
+            .save_block(b"junk", b"junk")
+            .expect_err("garbage should not be saved");
+        assert!(
+            format!("{:#}", err).starts_with("cometbft store: "),
+            "{:#}",
+            err
+        );
+        // The server should carry on after a failed request.
+        assert_eq!(store.height_range()?, (0, 0));
+        assert!(store.block_by_height(1)?.is_none());
+
+        let mut client = Client::spawn()?;
+        let err = client
+            .call_ok(Request::new(0))
+            .expect_err("there is no operation 0");
+        assert!(
+            format!("{:#}", err).contains("unknown operation"),
+            "{:#}",
+            err
+        );
+        let err = client
+            .call_ok(Request::new(OP_HEIGHT_RANGE))
+            .expect_err("there is no store to read");
+        assert!(
+            format!("{:#}", err).contains("no store is open"),
+            "{:#}",
+            err
+        );
+
+        let err = block_hash(b"junk").expect_err("garbage should not hash");
+        assert!(
+            format!("{:#}", err).starts_with("cometbft store: "),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+}
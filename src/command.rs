@@ -1,13 +1,39 @@
 mod archive;
+mod bench;
 mod bootstrap;
 mod check;
+mod check_db;
+mod diff;
 mod export;
+mod export_blockstore;
+mod extract;
+mod import;
+mod merge;
 mod regen;
 mod regen_step;
+mod show_plan;
+mod stats;
+mod truncate;
+mod validate_genesis;
+mod verify;
+mod versions;
 
 pub use archive::Archive;
+pub use bench::Bench;
 pub use bootstrap::Bootstrap;
 pub use check::Check;
+pub use check_db::CheckDb;
+pub use diff::Diff;
 pub use export::Export;
+pub use export_blockstore::ExportBlockstore;
+pub use extract::Extract;
+pub use import::Import;
+pub use merge::Merge;
 pub use regen::RegenAuto;
 pub use regen_step::Regen;
+pub use show_plan::ShowPlan;
+pub use stats::Stats;
+pub use truncate::Truncate;
+pub use validate_genesis::ValidateGenesis;
+pub use verify::Verify;
+pub use versions::Versions;
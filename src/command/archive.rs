@@ -1,10 +1,29 @@
-use std::path::PathBuf;
+use anyhow::{anyhow, Context as _};
+use async_stream::try_stream;
+use futures_core::Stream;
+use std::{
+    io::Write as _,
+    net::SocketAddr,
+    path::{Path, PathBuf},
+    sync::Arc,
+    time::{Duration, Instant},
+};
 use tokio_stream::StreamExt as _;
 
 use crate::{
-    cometbft::{self, Genesis, LocalStoreGenesisLocation, Store},
-    files::default_penumbra_home,
-    storage::Storage,
+    check::check_starts_at_genesis,
+    cometbft::{
+        self, Block, BlockStream, DbOptions, Genesis, LocalStoreGenesisLocation, LocalStoreOpts,
+        Store,
+    },
+    files::{default_penumbra_home, default_reindexer_home, FileLock},
+    manifest,
+    object_store::ObjectStore,
+    penumbra::{RegenerationPlan, RegenerationStep},
+    progress::{format_duration, ProgressLog, DEFAULT_PROGRESS_INTERVAL},
+    shutdown::Shutdown,
+    storage::{block_evidence, without_commit_signatures, ArchiveKey, BlockBatch, Storage},
+    stream::{BlockWriter, StreamFormat},
 };
 
 // # Organization
@@ -28,10 +47,15 @@ pub struct Archive {
     /// - ./cometbft/config/config.toml, for reading cometbft configuration
     /// - ./cometbft/data/, for reading historical blocks
     ///
+    /// This can also be a cometbft home directory itself, with ./config/ and ./data/.
+    /// Without a config file, the standard cometbft layout is assumed: the genesis
+    /// in ./config/genesis.json, and the block store in ./data/, with its backend detected.
+    ///
     /// Defaults to `~/.penumbra/network_data/node0`, the same default used for `pd start`.
     ///
     /// The node state will be read from this directory, and saved inside
-    /// an sqlite3 database at ~/.local/share/penumbra-reindexer/<CHAIN_ID>/reindexer-archive.sqlite.
+    /// an sqlite3 database at ~/.local/share/penumbra-reindexer/<CHAIN_ID>/reindexer-archive.sqlite,
+    /// with the chain id read from the genesis, or else the blocks, unless given with --chain-id.
     ///
     /// Read usage can be overridden with --cometbft-dir.
     /// Write usage can be overridden with --archive-file.
@@ -49,180 +73,3754 @@ pub struct Archive {
 
     /// Override the path where CometBFT configuration is stored.
     /// Defaults to <HOME>/cometbft/.
+    ///
+    /// This can be given several times, to archive the block stores of several directories
+    /// as one, as when a node kept the blocks from before an upgrade in a store of their own.
+    /// Every height between the stores must be in one of them, and heights in several of
+    /// them must have the same block in each.
     #[clap(long)]
-    cometbft_dir: Option<PathBuf>,
+    cometbft_dir: Vec<PathBuf>,
 
-    /// Override the filepath for the sqlite3 database.
-    /// Defaults to <HOME>/reindexer_archive.bin.
+    /// Write the sqlite3 database to this path, wherever it is, rather than inside of --home.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite.
+    ///
+    /// Any directories leading to it which don't exist yet are created.
     #[clap(long)]
     archive_file: Option<PathBuf>,
 
+    /// The format to write archived blocks in.
+    ///
+    /// Other than sqlite, blocks are written as a stream, in order of height, to --output-file,
+    /// or to stdout. Streams only contain blocks, without the genesis or extended commits,
+    /// and can't be resumed, so each run writes every block of the range, replacing the file.
+    #[clap(long, value_enum, default_value_t = OutputFormat::Sqlite)]
+    output_format: OutputFormat,
+
+    /// Write the stream of blocks to this file, rather than stdout.
+    ///
+    /// This is only for formats other than sqlite, which is written to --archive-file.
+    #[clap(long)]
+    output_file: Option<PathBuf>,
+
     /// Use a remote CometBFT RPC URL to fetch block and genesis data.
     ///
     /// Setting this option will remove the need for on-disk cometbft data
-    /// for the reindexer to read from. The reindexer must still write to
-    /// a local sqlite3 database to store the results.
+    /// for the reindexer to read from. The reindexer must still write
+    /// the results locally, to an sqlite3 database, or a stream.
     #[clap(long)]
     remote_rpc: Option<String>,
 
+    /// Use a CometBFT RPC URL to fetch blocks one height at a time, checking each block's hash.
+    ///
+    /// Unlike --remote-rpc, this only uses the `/block` and `/commit` endpoints, so the node
+    /// doesn't need to index blocks. Each block must hash to the id the node reports for it,
+    /// and which the commit at that height is for. Requests that fail because of the connection,
+    /// or an overloaded or rate limiting node, are retried with a backoff.
+    ///
+    /// Blocks the node doesn't have, having pruned them, will fail archival.
+    #[clap(long, conflicts_with_all = ["node_home", "cometbft_dir", "remote_rpc", "read_only", "blockstore_name", "max_block_bytes", "blockstore_cache_bytes", "blockstore_disable_compaction", "blockstore_compression", "strict_backend"])]
+    rpc_url: Option<String>,
+
     /// Set a specific chain id
     #[clap(long)]
     chain_id: Option<String>,
+
+    /// Open the local CometBFT block store read-only.
+    ///
+    /// This avoids writing to the database of a node, but is only supported
+    /// by the goleveldb backend.
+    #[clap(long)]
+    read_only: bool,
+
+    /// Override the name of the CometBFT block store database. Defaults to `blockstore`.
+    ///
+    /// Some node setups name it differently: the store is read from `<NAME>.db`
+    /// inside of the CometBFT data directory.
+    ///
+    /// This can be given several times, to archive several block stores of the same directory
+    /// as one, like several --cometbft-dir, or once for each --cometbft-dir, to name each store.
+    #[clap(long)]
+    blockstore_name: Vec<String>,
+
+    /// Read the blocks of a node from a backup of its directory, rather than the directory itself.
+    ///
+    /// The backup is a tar archive, compressed with gzip or not at all, of a directory that
+    /// --node-home could point to. It's extracted into a directory inside of --home as it's
+    /// decompressed, which has to have room for the node, and is removed once archival is done.
+    /// Backups compressed with zstd need decompressing first.
+    #[clap(long, conflicts_with_all = ["node_home", "cometbft_dir", "remote_rpc", "rpc_url"])]
+    backup: Option<PathBuf>,
+
+    /// Fail on blocks in the local CometBFT block store larger than this many bytes, encoded.
+    ///
+    /// This bounds the memory needed to read a block, which is otherwise as large as the largest
+    /// block in the store. With --skip-errors, such blocks are skipped, and reported, instead.
+    #[clap(long)]
+    max_block_bytes: Option<u64>,
+
+    /// How many bytes of blocks the local CometBFT block store should cache in memory.
+    ///
+    /// Defaults to what the backend does by default, 8 MiB for goleveldb. Like the other
+    /// --blockstore-* tunables, this is only supported by the goleveldb backend.
+    #[clap(long)]
+    blockstore_cache_bytes: Option<u64>,
+
+    /// Stop reads from triggering compactions of the local CometBFT block store.
+    ///
+    /// Reading a whole store triggers a lot of these, which only slow archival down.
+    #[clap(long)]
+    blockstore_disable_compaction: bool,
+
+    /// Compress the tables the local CometBFT block store writes with this, instead of its default.
+    ///
+    /// Only affects writes the database makes while it's open, such as compactions,
+    /// so it can't be combined with --read-only.
+    #[clap(long, value_enum, conflicts_with = "read_only")]
+    blockstore_compression: Option<BlockstoreCompression>,
+
+    /// Fail if the local CometBFT block store doesn't open with the backend its config names.
+    ///
+    /// By default, a store which fails to open with that backend is opened with another
+    /// the files of the store point to, if one of those compiled in opens it, with a warning
+    /// naming the backend used, as for a config naming cleveldb, whose stores goleveldb reads.
+    #[clap(long)]
+    strict_backend: bool,
+
+    /// Report the blocks that would be archived, and any missing from the store, then exit.
+    ///
+    /// Nothing is written, and the archive file isn't even created.
+    #[clap(long)]
+    dry_run: bool,
+
+    /// Delete any existing archive, and archive every block from scratch.
+    ///
+    /// By default, archival resumes after the last block already in the archive.
+    #[clap(long)]
+    restart: bool,
+
+    /// Only archive blocks from this height on. Defaults to the first block in the store.
+    ///
+    /// Blocks already in the archive are still skipped, so archival resumes after them
+    /// if they reach past this height.
+    #[clap(long)]
+    start_height: Option<u64>,
+
+    /// Only archive blocks up to, and including, this height. Defaults to the last block in the store.
+    #[clap(long)]
+    end_height: Option<u64>,
+
+    /// Skip blocks that can't be read or decoded, instead of stopping at the first one.
+    ///
+    /// Each skipped height is logged, and recorded, along with the error, as a line
+    /// of JSON in a report next to the archive, at <ARCHIVE_FILE>.skipped.jsonl,
+    /// or next to the --output-file a stream is written to.
+    /// Blocks are then read one at a time, regardless of --parallelism,
+    /// so that every failure is tied to its height. Later runs into the same archive
+    /// retry the heights in the report first, archiving those which can be read by then,
+    /// and leaving only the rest in it.
+    #[clap(long)]
+    skip_errors: bool,
+
+    /// Recompute the hashes of each block, failing on any block which doesn't match them.
+    ///
+    /// The hashes of the transactions, evidence and last commit in a block must match those
+    /// in its header, and with a local store, the hash of the header must match the ID the
+    /// store has for the block. This catches blocks that decode, but were silently corrupted
+    /// on disk. With --skip-errors, such blocks are skipped, and reported, instead.
+    #[clap(long)]
+    verify_hashes: bool,
+
+    /// Encrypt the archive at rest with this key, using SQLCipher.
+    ///
+    /// The same key is needed to add to the archive, or to read it back, with `regen` and
+    /// `verify`. Prefer --key-file, or the PENUMBRA_REINDEXER_ARCHIVE_KEY variable, which keep
+    /// the key off of the command line. Needs a build with `--features sqlcipher`.
+    #[clap(long, conflicts_with = "key_file")]
+    encryption_key: Option<String>,
+
+    /// Read the key to encrypt the archive with from this file, ignoring a trailing newline.
+    #[clap(long)]
+    key_file: Option<PathBuf>,
+
+    /// Also write the summary printed at the end of archival to this file, as JSON.
+    #[clap(long)]
+    report: Option<PathBuf>,
+
+    /// How many workers should read blocks at once.
+    ///
+    /// Blocks are still written to the archive in order. With a local store, reading
+    /// from the database happens one block at a time, but decoding each block, which
+    /// dominates the cost of reading, happens on the workers in parallel.
+    /// For known chains, each batch a worker reads stays within one version of Penumbra.
+    #[clap(long, default_value_t = 1)]
+    parallelism: usize,
+
+    /// If set, serve Prometheus metrics about archival progress at this address.
+    #[clap(long)]
+    metrics_addr: Option<SocketAddr>,
+
+    /// Log progress, with an estimate of the time remaining, after archiving this many blocks.
+    ///
+    /// Progress is also logged at least once a minute, if archiving is slower than that.
+    #[clap(long, default_value_t = DEFAULT_PROGRESS_INTERVAL)]
+    progress_interval: u64,
+
+    /// Commit blocks to the archive in batches of this many.
+    ///
+    /// Committing fewer blocks at once loses less work if archival is killed, since the next
+    /// run resumes after the last batch committed, but committing is slow enough that doing it
+    /// for every block dominates archival. Stopping archival cleanly commits every block first.
+    #[clap(long, default_value_t = DEFAULT_COMMIT_BATCH, value_parser = clap::value_parser!(u64).range(1..))]
+    commit_batch: u64,
+
+    /// Allow an archive to start after the genesis of its chain, as from a node synced from a snapshot.
+    ///
+    /// By default, archiving into an archive of a known chain fails if the archive wouldn't
+    /// start at the genesis height of the chain, since it couldn't be regenerated in full.
+    /// An explicit --start-height already asks for part of the chain, so isn't checked.
+    ///
+    /// Resuming an archive from past the block after its last one, because the store was pruned
+    /// past there, or --start-height is, likewise fails, unless this allows leaving that gap.
+    #[clap(long)]
+    allow_partial: bool,
+
+    /// Only catch an existing archive up with the store, then exit, as when run periodically.
+    ///
+    /// This archives the blocks after the last one in the archive, up to the last block in the
+    /// store when archival starts, and does nothing if the archive is already caught up.
+    /// Unlike a plain run, this fails if there's no archive yet, rather than starting one,
+    /// or if the store no longer has the blocks right after the archive's last one.
+    #[clap(long, conflicts_with_all = ["restart", "start_height", "end_height"])]
+    incremental: bool,
+
+    /// Also record the evidence of misbehavior committed in each block, at the heights with any.
+    ///
+    /// Every block already contains its evidence, but this puts it in a table of its own,
+    /// so that it can be found by height without decoding the blocks around it.
+    /// Streams only ever contain the blocks.
+    #[clap(long)]
+    with_evidence: bool,
+
+    /// Don't write a manifest describing the archive next to it.
+    ///
+    /// By default, each run into an sqlite archive ends by writing `<ARCHIVE_FILE>.manifest.json`,
+    /// with the archive's chain id, heights, block count, and a hash of its contents,
+    /// which `verify` checks the archive against. Hashing reads the whole archive,
+    /// which may not be worth it for frequent incremental runs. Streams never get one.
+    #[clap(long)]
+    no_manifest: bool,
+
+    /// Leave the commits out, for uses of the archive which only need the blocks themselves.
+    ///
+    /// Each block carries the commit of the block before it, with a signature from every validator,
+    /// which on a chain with many validators can take more space than the block itself.
+    /// This keeps only what the commit is for, and no extended commits, making for a smaller archive,
+    /// but one that `regen` refuses, since it needs the signatures to replay each block.
+    /// An archive is made either entirely with commits, or entirely without them.
+    /// Streams have to keep the blocks as they are, so this is only for sqlite archives.
+    #[clap(long)]
+    no_commit: bool,
+
+    /// Upload the archive, along with its manifest, to an S3-compatible object store once done.
+    ///
+    /// Given as `s3://<BUCKET>/<PREFIX>`, each file is uploaded under the prefix, by its name,
+    /// where `verify --s3-url` and `regen --s3-url` read them back from. The archive is still
+    /// written locally first, then uploaded in full, in parts if it's large. This is configured
+    /// by the environment, as for the AWS tools: credentials with `AWS_ACCESS_KEY_ID` and
+    /// `AWS_SECRET_ACCESS_KEY`, the region with `AWS_REGION`, and for stores other than AWS,
+    /// their URL with `AWS_ENDPOINT_URL`. A stream is uploaded along with its index instead.
+    #[clap(long)]
+    s3_url: Option<String>,
+}
+
+/// The compressions the goleveldb backend can write tables with.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, clap::ValueEnum)]
+enum BlockstoreCompression {
+    Snappy,
+    None,
+}
+
+impl BlockstoreCompression {
+    /// The name of the compression, as the Go side knows it.
+    fn name(self) -> &'static str {
+        match self {
+            Self::Snappy => "snappy",
+            Self::None => "none",
+        }
+    }
 }
 
+/// How many blocks to commit to the archive at once, by default.
+const DEFAULT_COMMIT_BATCH: u64 = 256;
+
 impl Archive {
+    /// The options to open the database of a local block store with, given the command arguments.
+    fn db_options(&self) -> DbOptions {
+        DbOptions {
+            block_cache_bytes: self.blockstore_cache_bytes,
+            disable_compaction: self.blockstore_disable_compaction,
+            compression: self.blockstore_compression.map(|x| x.name().to_owned()),
+            strict_backend: self.strict_backend,
+        }
+    }
+
     /// Get the desired cometbft directory given the command arguments.
     ///
     /// This can fail if the arguments indicate that the home directory
     /// needs to be used, and the home directory cannot be found.
     fn cometbft_dir(&self) -> anyhow::Result<PathBuf> {
-        let out = match (self.node_home.as_ref(), self.cometbft_dir.as_ref()) {
+        let out = match (self.node_home.as_ref(), self.cometbft_dir.first()) {
             (_, Some(x)) => x.to_owned(),
-            (Some(x), None) => x.join("cometbft"),
-            (None, None) => default_penumbra_home()?.join("cometbft"),
+            (Some(x), None) => cometbft::find_cometbft_dir(x)?,
+            (None, None) => cometbft::find_cometbft_dir(&default_penumbra_home()?)?,
+        };
+        Ok(out)
+    }
+
+    /// Get the block stores to read from, as cometbft directories, each with the name of its store.
+    ///
+    /// These are the directories given, or else the one in `dir`, paired up with the names
+    /// given, if any. More than one of either means stitching several stores together.
+    fn store_sources(&self, dir: PathBuf) -> anyhow::Result<Vec<(PathBuf, Option<String>)>> {
+        let dirs = match self.cometbft_dir.len() {
+            0 => vec![dir],
+            _ => self.cometbft_dir.clone(),
+        };
+        let names = &self.blockstore_name;
+        let out = match (dirs.len(), names.len()) {
+            (_, 0) => dirs.into_iter().map(|x| (x, None)).collect(),
+            (1, _) => names
+                .iter()
+                .map(|x| (dirs[0].clone(), Some(x.clone())))
+                .collect(),
+            (_, 1) => dirs.into_iter().map(|x| (x, Some(names[0].clone()))).collect(),
+            (n, m) if n == m => dirs.into_iter().zip(names.iter().cloned().map(Some)).collect(),
+            (n, m) => anyhow::bail!(
+                "--blockstore-name was given {} times, for {} --cometbft-dir; give it once, for every directory, or once for each of them",
+                m,
+                n
+            ),
         };
         Ok(out)
     }
 
+    /// Extract the backup of a node to read blocks from, into a directory in the reindexer home.
+    fn extract_backup(&self, backup: &Path) -> anyhow::Result<cometbft::ExtractedBackup> {
+        let home = match self.home.as_ref() {
+            Some(x) => x.to_owned(),
+            None => default_reindexer_home()?,
+        };
+        let dir = home.join(format!("extracted-backup-{}", std::process::id()));
+        cometbft::ExtractedBackup::extract(backup, &dir)
+    }
+
+    /// Get the chain id the archive is for, reading it from the node if it wasn't given.
+    ///
+    /// Without a genesis file, this falls back to the headers of the blocks in the block store.
+    /// Failing to read it isn't fatal, since the block store might still have a genesis.
+    fn chain_id(&self, cometbft_dir: Option<&Path>) -> Option<String> {
+        if let Some(chain_id) = self.chain_id.as_ref() {
+            return Some(chain_id.to_owned());
+        }
+        let dir = cometbft_dir?;
+        let genesis_err = match cometbft::read_chain_id(dir) {
+            Ok(chain_id) => {
+                tracing::info!("using chain id '{}' from the genesis of the node", chain_id);
+                return Some(chain_id);
+            }
+            Err(e) => e,
+        };
+        // This store is closed once the chain id is read, before it's opened again to be archived.
+        let opts = LocalStoreOpts {
+            read_only: self.read_only,
+            db_name: self.blockstore_name.first().cloned(),
+            max_block_bytes: None,
+            db_options: self.db_options(),
+        };
+        match cometbft::read_block_store_chain_id(dir, &opts) {
+            Ok(chain_id) => {
+                tracing::debug!("failed to read the genesis of the node: {:#}", genesis_err);
+                tracing::info!("using chain id '{}' from the blocks of the node", chain_id);
+                Some(chain_id)
+            }
+            Err(e) => {
+                tracing::warn!(
+                    "failed to read the chain id from '{}', from either its genesis ({:#}) or its blocks ({:#}), try passing --chain-id",
+                    dir.display(),
+                    genesis_err,
+                    e
+                );
+                None
+            }
+        }
+    }
+
     /// Create or add to our full historical archive of blocks.
     pub async fn run(self) -> anyhow::Result<()> {
-        let archive_file = crate::files::archive_filepath_from_opts(
-            self.home.clone(),
-            self.archive_file.clone(),
-            self.chain_id.clone(),
-        )?;
-        let cmd = if let Some(base_url) = self.remote_rpc {
+        let _metrics = match self.metrics_addr {
+            Some(addr) => Some(crate::metrics::serve(addr).await?),
+            None => None,
+        };
+        let local = self.rpc_url.is_none() && self.remote_rpc.is_none();
+        // This is removed once dropped, after archival is done with the store inside of it.
+        let backup = match self.backup.as_deref() {
+            Some(x) => Some(self.extract_backup(x)?),
+            None => None,
+        };
+        let cometbft_dir = match (local, backup.as_ref()) {
+            (false, _) => None,
+            (true, Some(backup)) => Some(backup.cometbft_dir().to_owned()),
+            (true, None) => Some(self.cometbft_dir()?),
+        };
+        let destination = match (self.output_format, self.output_file.clone()) {
+            (OutputFormat::Sqlite, Some(_)) => {
+                anyhow::bail!("--output-file is only used to stream blocks; pass --archive-file to set where the sqlite archive is written")
+            }
+            (OutputFormat::Sqlite, None) => {
+                Destination::Archive(crate::files::archive_filepath_from_opts(
+                    self.home.clone(),
+                    self.archive_file.clone(),
+                    self.chain_id(cometbft_dir.as_deref()),
+                )?)
+            }
+            (OutputFormat::Ndproto, file) => Destination::Stream {
+                format: StreamFormat::Proto,
+                file,
+            },
+            (OutputFormat::Ndjson, file) => Destination::Stream {
+                format: StreamFormat::Json,
+                file,
+            },
+        };
+        if let Destination::Stream { .. } = &destination {
+            anyhow::ensure!(
+                !self.incremental,
+                "--incremental catches up an sqlite archive, so can't be used when streaming blocks"
+            );
+        }
+        if let Destination::Stream { .. } = &destination {
+            anyhow::ensure!(
+                self.encryption_key.is_none() && self.key_file.is_none(),
+                "--encryption-key and --key-file encrypt an sqlite archive, so can't be used when streaming blocks"
+            );
+        }
+        let key = match &destination {
+            Destination::Archive(_) => crate::files::archive_key_from_opts(
+                self.encryption_key.clone(),
+                self.key_file.as_deref(),
+            )?,
+            Destination::Stream { .. } => None,
+        };
+        if let Destination::Stream { file: None, .. } = &destination {
+            anyhow::ensure!(
+                !self.skip_errors,
+                "--skip-errors needs --output-file when streaming to stdout, to write its report next to"
+            );
+            anyhow::ensure!(
+                self.s3_url.is_none(),
+                "--s3-url needs --output-file when streaming, to upload the stream from"
+            );
+        }
+        let upload = self
+            .s3_url
+            .as_deref()
+            .map(ObjectStore::from_env)
+            .transpose()?;
+        let cmd = if let Some(base_url) = self.rpc_url {
+            ParsedCommand::Rpc {
+                base_url,
+                destination,
+            }
+        } else if let Some(base_url) = self.remote_rpc {
             ParsedCommand::Remote {
                 base_url,
-                archive_file,
+                destination,
             }
         } else {
-            ParsedCommand::Local {
-                archive_file,
-                cometbft_dir: self.cometbft_dir()?,
+            let cometbft_dir = cometbft_dir.expect("local stores should have a cometbft directory");
+            let opts = |db_name| LocalStoreOpts {
+                read_only: self.read_only,
+                db_name,
+                max_block_bytes: self.max_block_bytes,
+                db_options: self.db_options(),
+            };
+            let mut sources = self.store_sources(cometbft_dir)?;
+            if sources.len() > 1 {
+                ParsedCommand::Stitched {
+                    destination,
+                    stores: sources
+                        .into_iter()
+                        .map(|(dir, name)| (dir, opts(name)))
+                        .collect(),
+                }
+            } else {
+                let (cometbft_dir, name) = sources.remove(0);
+                ParsedCommand::Local {
+                    destination,
+                    cometbft_dir,
+                    opts: opts(name),
+                }
             }
         };
-        cmd.run().await
+        let opts = RunOpts {
+            dry_run: self.dry_run,
+            restart: self.restart,
+            start_height: self.start_height,
+            end_height: self.end_height,
+            skip_errors: self.skip_errors,
+            report: self.report,
+            parallelism: self.parallelism,
+            shutdown: Shutdown::on_signals()?,
+            progress_interval: self.progress_interval,
+            commit_batch: self.commit_batch,
+            allow_partial: self.allow_partial,
+            incremental: self.incremental,
+            with_evidence: self.with_evidence,
+            verify_hashes: self.verify_hashes,
+            no_manifest: self.no_manifest,
+            no_commit: self.no_commit,
+            key,
+            upload,
+        };
+        cmd.run(opts).await
     }
 }
 
+/// Options for how to archive, independent of where blocks are read from and written to.
+#[derive(Clone, Default)]
+struct RunOpts {
+    dry_run: bool,
+    restart: bool,
+    /// The first height to archive, if not the first in the store.
+    start_height: Option<u64>,
+    /// The last height to archive, if not the last in the store.
+    end_height: Option<u64>,
+    /// Skip unreadable blocks, reporting them next to the archive, rather than failing.
+    skip_errors: bool,
+    /// Where to write the summary of the run, as JSON, if anywhere.
+    report: Option<PathBuf>,
+    parallelism: usize,
+    /// Archival stops cleanly, between blocks, once this is requested.
+    shutdown: Shutdown,
+    /// How many blocks to archive between progress logs.
+    progress_interval: u64,
+    /// How many blocks to commit to an archive at once.
+    commit_batch: u64,
+    /// Allow an archive to start anywhere, rather than at the genesis height of its chain,
+    /// and to resume with a gap after its last block.
+    allow_partial: bool,
+    /// Only catch an existing archive up with the store.
+    incremental: bool,
+    /// Record the evidence in each block in an archive, apart from the block.
+    with_evidence: bool,
+    /// Check that each block hashes to what it claims to, before archiving it.
+    verify_hashes: bool,
+    /// Skip writing the manifest of an sqlite archive once done.
+    no_manifest: bool,
+    /// Archive blocks without the signatures of their commits, and without extended commits.
+    no_commit: bool,
+    /// The key to encrypt an sqlite archive with, if any.
+    key: Option<ArchiveKey>,
+    /// Where to upload the archive, or stream, and the files next to it, once done, if anywhere.
+    upload: Option<ObjectStore>,
+}
+
 /// This represents the result of performing a bit of parsing of the command.
 ///
 /// We need to reduce some of the redundant options into a more direct set of information.
 enum ParsedCommand {
     Local {
         cometbft_dir: PathBuf,
-        archive_file: PathBuf,
+        destination: Destination,
+        opts: LocalStoreOpts,
+    },
+    /// Several local stores, read as one, each given by its cometbft directory.
+    Stitched {
+        stores: Vec<(PathBuf, LocalStoreOpts)>,
+        destination: Destination,
     },
     Remote {
         base_url: String,
-        archive_file: PathBuf,
+        destination: Destination,
+    },
+    Rpc {
+        base_url: String,
+        destination: Destination,
+    },
+}
+
+/// The formats blocks can be archived in.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, clap::ValueEnum)]
+enum OutputFormat {
+    /// An sqlite3 database, which the other commands read from, the default.
+    #[default]
+    Sqlite,
+    /// Protobuf encoded blocks, each preceded by its length, as a varint.
+    Ndproto,
+    /// JSON encoded blocks, one per line, as the CometBFT RPC returns them.
+    Ndjson,
+}
+
+/// Where archived blocks are written.
+enum Destination {
+    /// An sqlite3 archive, which is resumed if it already exists.
+    Archive(PathBuf),
+    /// A stream of blocks, written to a file, or to stdout, if there isn't one.
+    Stream {
+        format: StreamFormat,
+        file: Option<PathBuf>,
     },
 }
 
 impl ParsedCommand {
     #[tracing::instrument(skip_all)]
-    pub async fn run(self) -> anyhow::Result<()> {
-        let (archive_file, store) = match self {
+    pub async fn run(self, opts: RunOpts) -> anyhow::Result<()> {
+        let (destination, store) = match self {
             ParsedCommand::Local {
                 cometbft_dir,
-                archive_file,
+                destination,
+                opts,
+            } => {
+                let store: Box<dyn Store> = Box::new(open_local_store(&cometbft_dir, opts).await?);
+                (destination, store)
+            }
+            ParsedCommand::Stitched {
+                stores,
+                destination,
             } => {
-                let store: Box<dyn Store> = Box::new(cometbft::LocalStore::init(
-                    &cometbft_dir,
-                    LocalStoreGenesisLocation::FromConfig,
-                )?);
-                (archive_file, store)
+                let mut parts = Vec::with_capacity(stores.len());
+                for (cometbft_dir, opts) in stores {
+                    let name = format!(
+                        "{}, {}",
+                        cometbft_dir.display(),
+                        opts.db_name
+                            .as_deref()
+                            .unwrap_or(cometbft::DEFAULT_BLOCKSTORE_NAME)
+                    );
+                    let store: Box<dyn Store> =
+                        Box::new(open_local_store(&cometbft_dir, opts).await?);
+                    parts.push((name, store));
+                }
+                let store: Box<dyn Store> = Box::new(cometbft::StitchedStore::new(parts).await?);
+                (destination, store)
             }
             ParsedCommand::Remote {
                 base_url,
-                archive_file,
+                destination,
             } => {
                 let store: Box<dyn Store> = Box::new(cometbft::RemoteStore::new(base_url));
-                (archive_file, store)
+                (destination, store)
+            }
+            ParsedCommand::Rpc {
+                base_url,
+                destination,
+            } => {
+                let store: Box<dyn Store> = Box::new(cometbft::RpcStore::new(base_url));
+                (destination, store)
             }
         };
 
+        if opts.dry_run {
+            return report_dry_run(store.as_ref()).await;
+        }
+
+        // Two runs writing the same archive, or stream, at once would corrupt it, so the
+        // lock is held until this run is done with it, summary and all.
+        let lock = match &destination {
+            Destination::Archive(file)
+            | Destination::Stream {
+                file: Some(file), ..
+            } => {
+                create_parent_dir(file)?;
+                Some(FileLock::acquire(file)?)
+            }
+            Destination::Stream { file: None, .. } => None,
+        };
         let genesis = store.get_genesis().await?;
-        let archive = Storage::new(Some(&archive_file), Some(&genesis.chain_id())).await?;
+        let mut manifest_for = None;
+        // The files written next to the output, which are uploaded along with it.
+        let mut next_to = Vec::new();
+        let (output, output_file, to_stdout): (ArchiveOutput, _, _) = match destination {
+            Destination::Archive(archive_file) => {
+                if opts.restart {
+                    remove_archive(&archive_file)?;
+                }
+                if opts.incremental {
+                    crate::files::ensure_archive_exists(&archive_file)?;
+                }
+                let archive = Storage::with_key(
+                    Some(&archive_file),
+                    Some(&genesis.chain_id()),
+                    opts.key.as_ref(),
+                )
+                .await?;
+                archive
+                    .prepare_for_writing(lock.as_ref().expect("an archive should be locked"))
+                    .await?;
+                archive
+                    .set_without_commits(opts.no_commit)
+                    .await
+                    .with_context(|| format!("can't archive into '{}'", archive_file.display()))?;
+                if !opts.no_manifest {
+                    manifest_for = Some(archive_file.clone());
+                }
+                next_to.push(manifest::manifest_path(&archive_file));
+                (archive.into(), Some(archive_file), false)
+            }
+            Destination::Stream { format, file } => {
+                anyhow::ensure!(
+                    !opts.no_commit,
+                    "--no-commit is only for sqlite archives, not streams"
+                );
+                // Streams are written from scratch every time, so there's never anything to
+                // restart, but a report of blocks skipped by an earlier run no longer applies.
+                if let Some(skip_report) = file.as_deref().map(skip_report_path) {
+                    if skip_report.exists() {
+                        std::fs::remove_file(&skip_report).with_context(|| {
+                            format!("failed to remove '{}'", skip_report.display())
+                        })?;
+                    }
+                }
+                let writer = BlockWriter::create(format, file.as_deref())?;
+                next_to.extend(file.as_deref().map(crate::stream::index_path));
+                let to_stdout = file.is_none();
+                (writer.into(), file, to_stdout)
+            }
+        };
 
-        Archiver::new(genesis, store, archive).run().await
+        let skip_errors = opts.skip_errors;
+        let report = opts.report.clone();
+        let key = opts.key.clone();
+        let upload = opts.upload.clone();
+        let chain_id = genesis.chain_id();
+        let mut archiver = Archiver::new(genesis, store, output, opts);
+        // Blocks skipped by earlier runs are retried by every run after, with --skip-errors or not.
+        archiver.retry_report = output_file.as_deref().map(skip_report_path);
+        if skip_errors {
+            let output_file = output_file
+                .as_deref()
+                .expect("skipping errors should have a file to report next to");
+            archiver.skip_report = Some(skip_report_path(output_file));
+        }
+        let summary = archiver.run().await?;
+        // The archiver is done with the archive by now, so this sees everything it committed.
+        if let Some(archive_file) = manifest_for {
+            let archive =
+                Storage::with_key(Some(&archive_file), Some(&chain_id), key.as_ref()).await?;
+            let written = manifest::write_manifest(&archive_file, &archive).await?;
+            tracing::info!(
+                path = manifest::manifest_path(&archive_file).display().to_string(),
+                content_hash = written.content_hash,
+                "wrote archive manifest"
+            );
+        }
+        // Everything's been closed by now, so the files are complete.
+        if let Some(store) = upload {
+            let output_file = output_file
+                .as_deref()
+                .expect("uploading should have a file to upload");
+            store.upload(output_file, &next_to).await?;
+        }
+        // Blocks streamed to stdout mustn't be mixed with the summary.
+        if to_stdout {
+            eprint!("{}", summary.to_text());
+        } else {
+            print!("{}", summary.to_text());
+        }
+        if let Some(report) = report {
+            std::fs::write(
+                &report,
+                serde_json::to_string_pretty(&summary.to_json())? + "\n",
+            )
+            .with_context(|| format!("failed to write report '{}'", report.display()))?;
+        }
+        Ok(())
     }
 }
 
-/// Responsible for actually running the archival process.
+/// The heights in a range at which a known chain upgraded, starting over with a new genesis.
+fn upgrades_within(chain_id: &str, start: u64, end: u64) -> Vec<u64> {
+    let Some(plan) = RegenerationPlan::from_known_chain_id(chain_id) else {
+        return Vec::new();
+    };
+    plan.steps
+        .iter()
+        .filter_map(|(_, step)| match step {
+            RegenerationStep::InitThenRunTo { genesis_height, .. } => Some(*genesis_height),
+            _ => None,
+        })
+        // Starting at the upgrade is fine; it's archiving blocks on both sides of it that isn't.
+        .filter(|x| start < *x && *x <= end)
+        .collect()
+}
+
+/// The heights at which a known chain starts running blocks with a new version of Penumbra.
 ///
-/// This is a bit of an OOP verb-object, but it serves the purpose of organizing
-/// the information needed
-struct Archiver {
-    genesis: Genesis,
-    store: Box<dyn Store>,
-    /// The place where our archive resides.
-    archive: Storage,
+/// Each of these starts a segment of blocks which regeneration runs with a single version,
+/// whether the chain upgraded with a new genesis there, or only migrated its state.
+fn version_boundaries(chain_id: &str) -> Vec<u64> {
+    let Some(plan) = RegenerationPlan::from_known_chain_id(chain_id) else {
+        return Vec::new();
+    };
+    let mut out: Vec<u64> = plan
+        .steps
+        .iter()
+        .filter_map(|(_, step)| match step {
+            RegenerationStep::InitThenRunTo { last_block, .. }
+            | RegenerationStep::RunTo { last_block, .. } => last_block.map(|x| x + 1),
+            RegenerationStep::Migrate { .. } => None,
+        })
+        .collect();
+    out.sort_unstable();
+    out.dedup();
+    out
 }
 
-impl Archiver {
-    pub fn new(genesis: Genesis, store: Box<dyn Store>, archive: Storage) -> Self {
-        Self {
-            genesis,
-            store,
-            archive,
-        }
+/// Split the heights between start and end, inclusive, at each boundary in between.
+///
+/// Each segment is inclusive on both ends, and the boundaries must be in ascending order.
+fn segments(start: u64, end: u64, boundaries: &[u64]) -> Vec<(u64, u64)> {
+    let mut out = Vec::new();
+    let mut segment_start = start;
+    for &boundary in boundaries.iter().filter(|x| start < **x && **x <= end) {
+        out.push((segment_start, boundary - 1));
+        segment_start = boundary;
     }
+    if segment_start <= end {
+        out.push((segment_start, end));
+    }
+    out
+}
 
-    /// Retreive the bounds we need to archive between
-    async fn bounds(&mut self) -> anyhow::Result<Option<(u64, u64)>> {
-        let (store_start, store_end) = match self.store.get_height_bounds().await? {
-            Some(x) => x,
-            None => return Ok(None),
-        };
+/// Split the heights between start and end, inclusive, into the chunks parallel workers read.
+///
+/// Chunks hold at most [PARALLEL_CHUNK_SIZE] heights, and never span a boundary.
+fn parallel_chunks(start: u64, end: u64, boundaries: &[u64]) -> Vec<(u64, u64)> {
+    segments(start, end, boundaries)
+        .into_iter()
+        .flat_map(|(segment_start, segment_end)| {
+            (segment_start..=segment_end)
+                .step_by(PARALLEL_CHUNK_SIZE as usize)
+                .map(move |x| (x, segment_end.min(x + PARALLEL_CHUNK_SIZE - 1)))
+        })
+        .collect()
+}
 
-        let archive_end = self.archive.last_height().await?;
+/// Create the directories leading to a file being archived to, if they don't exist yet.
+fn create_parent_dir(file: &Path) -> anyhow::Result<()> {
+    match file.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => std::fs::create_dir_all(dir)
+            .with_context(|| format!("failed to create directory '{}'", dir.display())),
+        _ => Ok(()),
+    }
+}
 
-        let start = std::cmp::max(store_start, archive_end.unwrap_or(0) + 1);
-        let end = store_end;
-        Ok(Some((start, end)))
+/// The report of the blocks skipped while archiving into an archive file.
+fn skip_report_path(archive_file: &Path) -> PathBuf {
+    let mut out = archive_file.as_os_str().to_owned();
+    out.push(".skipped.jsonl");
+    out.into()
+}
+
+/// Remove an archive file, along with any journal sqlite keeps next to it,
+/// the report of the blocks skipped while archiving, and its manifest.
+fn remove_archive(archive_file: &Path) -> anyhow::Result<()> {
+    let mut journal = archive_file.as_os_str().to_owned();
+    journal.push("-journal");
+    let skip_report = skip_report_path(archive_file);
+    let manifest_file = manifest::manifest_path(archive_file);
+    for path in [
+        archive_file,
+        Path::new(&journal),
+        &skip_report,
+        &manifest_file,
+    ] {
+        if path.exists() {
+            tracing::info!(
+                path = path.display().to_string(),
+                "removing existing archive"
+            );
+            std::fs::remove_file(path)
+                .with_context(|| format!("failed to remove '{}'", path.display()))?;
+        }
     }
+    Ok(())
+}
 
-    async fn archive_genesis(&self) -> anyhow::Result<()> {
-        tracing::info!(
-            initial_height = self.genesis.initial_height(),
-            "archiving genesis"
+/// Open the block store in a cometbft directory to archive from, checking that it's usable.
+async fn open_local_store(
+    cometbft_dir: &Path,
+    opts: LocalStoreOpts,
+) -> anyhow::Result<cometbft::LocalStore> {
+    let store =
+        cometbft::LocalStore::init(cometbft_dir, LocalStoreGenesisLocation::FromConfig, opts)?;
+    store.validate().await?;
+    if let Some((from, to)) = blocks_ahead_of_app(&store).await? {
+        tracing::warn!(
+            from,
+            to,
+            "the node saved blocks it never applied, likely having shut down abnormally; archiving them anyway, since they're committed"
         );
-        self.archive.put_genesis(&self.genesis).await?;
-        Ok(())
     }
+    Ok(store)
+}
 
-    pub async fn run(mut self) -> anyhow::Result<()> {
-        self.archive_genesis().await?;
+/// The range of blocks a node saved, but never applied to the application, if there are any.
+///
+/// cometbft only saves blocks with a commit, so these are part of the chain all the same.
+async fn blocks_ahead_of_app(store: &cometbft::LocalStore) -> anyhow::Result<Option<(u64, u64)>> {
+    let (Some(app_height), Some((_, last))) =
+        (store.app_height().await?, store.get_height_bounds().await?)
+    else {
+        return Ok(None);
+    };
+    Ok((app_height < last).then_some((app_height + 1, last)))
+}
 
-        let (start, end) = match self.bounds().await? {
-            None => {
-                tracing::info!("empty archival range, returning");
-                return Ok(());
-            }
-            Some((x, y)) if y < x => {
-                tracing::info!("empty archival range, returning");
-                return Ok(());
-            }
-            Some(x) => x,
+/// Print a summary of the blocks in a store, as available for archiving.
+async fn report_dry_run(store: &dyn Store) -> anyhow::Result<()> {
+    let genesis = store.get_genesis().await?;
+    println!("chain id: {}", genesis.chain_id());
+    let (first, last) = match store.get_height_bounds().await? {
+        None => {
+            println!("the store is empty; there are no blocks to archive");
+            return Ok(());
+        }
+        Some(x) => x,
+    };
+    println!("first height: {}", first);
+    println!("last height: {}", last);
+    let gaps = match store.get_gaps().await? {
+        None => {
+            println!("blocks present: unknown, this store can't report missing blocks cheaply");
+            return Ok(());
+        }
+        Some(x) => x,
+    };
+    let missing: u64 = gaps.iter().map(|(from, to)| to - from + 1).sum();
+    println!("blocks present: {}", last - first + 1 - missing);
+    if gaps.is_empty() {
+        println!("missing ranges: none");
+    } else {
+        println!("missing ranges:");
+        for (from, to) in gaps {
+            println!("  {}..={}", from, to);
+        }
+    }
+    Ok(())
+}
+
+/// What an archive run did, summarized once it's over.
+#[derive(Debug, Default, PartialEq)]
+struct ArchiveSummary {
+    /// The first and last heights the run was to archive, if there were any left to.
+    range: Option<(u64, u64)>,
+    /// How many blocks were written to the archive.
+    blocks: u64,
+    /// The size of the data of the blocks written, in total.
+    bytes: u64,
+    /// The heights of blocks which failed to be read, and were skipped.
+    skipped: Vec<u64>,
+    /// The heights of blocks which earlier runs skipped, and this one archived.
+    retried: Vec<u64>,
+    duration: Duration,
+    /// Whether the run was asked to stop before reaching the end of its range.
+    stopped_early: bool,
+    /// How many times blocks were committed to the archive, which streams never are.
+    commits: u64,
+}
+
+impl ArchiveSummary {
+    /// How many heights were processed, whether archived or skipped.
+    fn processed(&self) -> u64 {
+        self.blocks + self.skipped.len() as u64
+    }
+
+    /// The average number of blocks archived per second.
+    fn blocks_per_second(&self) -> f64 {
+        let secs = self.duration.as_secs_f64();
+        if secs > 0.0 {
+            self.blocks as f64 / secs
+        } else {
+            0.0
+        }
+    }
+
+    fn to_json(&self) -> serde_json::Value {
+        serde_json::json!({
+            "start_height": self.range.map(|x| x.0),
+            "end_height": self.range.map(|x| x.1),
+            "processed": self.processed(),
+            "blocks": self.blocks,
+            "bytes": self.bytes,
+            "skipped": self.skipped,
+            "retried": self.retried,
+            "duration_secs": self.duration.as_secs_f64(),
+            "blocks_per_second": self.blocks_per_second(),
+            "stopped_early": self.stopped_early,
+            "commits": self.commits,
+        })
+    }
+
+    fn to_text(&self) -> String {
+        let range = match self.range {
+            Some((start, end)) => format!("{}..={}", start, end),
+            None => "none, the archive was already up to date".to_owned(),
+        };
+        let heights = |heights: &[u64]| match heights.len() {
+            0 => "none".to_owned(),
+            n => format!(
+                "{}: {}",
+                n,
+                heights
+                    .iter()
+                    .map(|x| x.to_string())
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            ),
+        };
+        let stopped = if self.stopped_early {
+            ", stopped early"
+        } else {
+            ""
         };
+        format!(
+            "archival summary{}:
+  heights:      {}
+  processed:    {} heights
+  archived:     {} blocks, {} bytes
+  duration:     {}, averaging {:.1} blocks/s
+  skipped:      {}
+  retried:      {}
+",
+            stopped,
+            range,
+            self.processed(),
+            self.blocks,
+            self.bytes,
+            format_duration(self.duration),
+            self.blocks_per_second(),
+            heights(&self.skipped),
+            heights(&self.retried)
+        )
+    }
+}
 
-        tracing::info!("archiving blocks {}..{}", start, end);
-        let mut block_stream = self.store.stream_blocks(Some(start), Some(end));
-        while let Some((height, block)) = block_stream.try_next().await? {
-            use std::io::IsTerminal;
-            if (height - start) % 10_000 == 0 {
-                // If tty, there will be a progress bar, so skip info-level logging
-                if !std::io::stderr().is_terminal() {
-                    tracing::info!("archiving block {}", height);
-                }
-            } else {
-                tracing::debug!("archiving block {}", height);
-            }
-            self.archive.put_block(&block).await?;
+/// Where the archiver writes the blocks it reads.
+enum ArchiveOutput {
+    Archive(Storage),
+    Stream(BlockWriter),
+}
+
+impl From<Storage> for ArchiveOutput {
+    fn from(value: Storage) -> Self {
+        Self::Archive(value)
+    }
+}
+
+impl From<BlockWriter> for ArchiveOutput {
+    fn from(value: BlockWriter) -> Self {
+        Self::Stream(value)
+    }
+}
+
+impl ArchiveOutput {
+    /// The first block the archive starts at, once archival adds blocks from a given height on.
+    ///
+    /// Streams are only ever part of a chain, so this is only ever set for an archive.
+    async fn first_height_from(&self, start: u64) -> anyhow::Result<Option<u64>> {
+        match self {
+            Self::Archive(archive) => Ok(Some(
+                archive
+                    .first_height()
+                    .await?
+                    .map_or(start, |x| x.min(start)),
+            )),
+            Self::Stream(_) => Ok(None),
         }
+    }
+
+    /// The last block already written, which archival resumes after.
+    ///
+    /// Streams are always written from scratch, so this is only ever set for an archive.
+    async fn last_height(&self) -> anyhow::Result<Option<u64>> {
+        match self {
+            Self::Archive(archive) => archive.last_height().await,
+            Self::Stream(_) => Ok(None),
+        }
+    }
+
+    /// Record the genesis of the chain, which streams don't contain.
+    async fn put_genesis(&self, genesis: &Genesis) -> anyhow::Result<()> {
+        match self {
+            Self::Archive(archive) => archive.put_genesis(genesis).await,
+            Self::Stream(_) => Ok(()),
+        }
+    }
 
+    /// Make sure everything written so far has reached the output.
+    ///
+    /// Blocks are committed to an archive by the archiver, in batches, but streams are buffered.
+    fn flush(&mut self) -> anyhow::Result<()> {
+        match self {
+            Self::Archive(_) => Ok(()),
+            Self::Stream(writer) => writer.flush(),
+        }
+    }
+}
+
+/// Responsible for actually running the archival process.
+///
+/// This is a bit of an OOP verb-object, but it serves the purpose of organizing
+/// the information needed
+struct Archiver {
+    genesis: Genesis,
+    store: Arc<dyn Store>,
+    /// The blocks put into the archive since the last commit.
+    ///
+    /// This comes before the archive, so that it's dropped first: closing the archive waits
+    /// for the connection this holds.
+    batch: Option<BlockBatch>,
+    /// The place where our archive resides, or the stream blocks are written to.
+    archive: ArchiveOutput,
+    /// How many workers read blocks at once.
+    parallelism: usize,
+    shutdown: Shutdown,
+    progress_interval: u64,
+    start_height: Option<u64>,
+    end_height: Option<u64>,
+    /// If set, blocks that can't be read are skipped, and recorded in this file,
+    /// rather than failing archival.
+    skip_report: Option<PathBuf>,
+    /// If set, the blocks which earlier runs skipped, as recorded in this file, are tried again
+    /// before anything else.
+    retry_report: Option<PathBuf>,
+    /// The heights starting a new version of Penumbra, in ascending order.
+    ///
+    /// Blocks are read in batches which never span one of these, so that each batch
+    /// only holds blocks run with a single version.
+    boundaries: Vec<u64>,
+    /// How many blocks to put into the archive before committing them.
+    commit_batch: u64,
+    /// Allow the archive to start anywhere, rather than at the genesis height of its chain,
+    /// and to resume with a gap after its last block.
+    allow_partial: bool,
+    /// Only catch the archive up with the store, without leaving a gap after its last block.
+    incremental: bool,
+    /// Record the evidence in each block in the archive, apart from the block.
+    with_evidence: bool,
+    /// Check that each block hashes to what it claims to, treating those that don't as unreadable.
+    verify_hashes: bool,
+    /// Leave the signatures out of the commit in each block, and skip extended commits.
+    no_commit: bool,
+}
+
+/// A stream of blocks, with their heights, where reading each block can fail on its own.
+type SkippingBlockStream<'a> =
+    std::pin::Pin<Box<dyn Stream<Item = anyhow::Result<(u64, anyhow::Result<Block>)>> + 'a + Send>>;
+
+/// How many heights each worker reads at a time, when archiving in parallel.
+const PARALLEL_CHUNK_SIZE: u64 = 1_000;
+
+impl Archiver {
+    /// Create an archiver, using the options about how to archive, rather than where.
+    fn new(
+        genesis: Genesis,
+        store: Box<dyn Store>,
+        archive: impl Into<ArchiveOutput>,
+        opts: RunOpts,
+    ) -> Self {
+        Self {
+            boundaries: version_boundaries(&genesis.chain_id()),
+            genesis,
+            store: store.into(),
+            archive: archive.into(),
+            parallelism: opts.parallelism.max(1),
+            shutdown: opts.shutdown,
+            progress_interval: opts.progress_interval,
+            start_height: opts.start_height,
+            end_height: opts.end_height,
+            skip_report: None,
+            retry_report: None,
+            commit_batch: opts.commit_batch.max(1),
+            allow_partial: opts.allow_partial,
+            incremental: opts.incremental,
+            with_evidence: opts.with_evidence,
+            verify_hashes: opts.verify_hashes,
+            no_commit: opts.no_commit,
+            batch: None,
+        }
+    }
+
+    /// Retreive the bounds we need to archive between, failing if the store is empty.
+    async fn bounds(&mut self) -> anyhow::Result<Option<(u64, u64)>> {
+        // An empty store is most likely the wrong one, or a node that hasn't synced yet,
+        // neither of which should leave behind an archive with a genesis, but no blocks.
+        let (store_start, store_end) = self.store.get_height_bounds().await?.ok_or(anyhow!(
+            "the store is empty, so there are no blocks to archive"
+        ))?;
+        let requested_start = self.start_height.unwrap_or(store_start);
+        let end = self.end_height.unwrap_or(store_end);
+        anyhow::ensure!(
+            requested_start >= store_start,
+            "the start height {} is before the first block in the store, at height {}",
+            requested_start,
+            store_start
+        );
+        anyhow::ensure!(
+            end <= store_end,
+            "the end height {} is after the last block in the store, at height {}",
+            end,
+            store_end
+        );
+        anyhow::ensure!(
+            requested_start <= end,
+            "the start height {} is after the end height {}",
+            requested_start,
+            end
+        );
+        if self.start_height.is_some() || self.end_height.is_some() {
+            for height in upgrades_within(&self.genesis.chain_id(), requested_start, end) {
+                tracing::warn!(
+                    "the requested range {}..={} crosses the upgrade at height {}, so some of it belongs to another generation of the chain",
+                    requested_start,
+                    end,
+                    height
+                );
+            }
+        }
+
+        let archive_end = self.archive.last_height().await?;
+        if let Some(x) = archive_end {
+            tracing::info!(
+                "archive already contains blocks up to {}, resuming after it",
+                x
+            );
+        }
+
+        if self.incremental {
+            match archive_end {
+                Some(x) if x > end => {
+                    tracing::warn!(
+                        "the archive ends at height {}, ahead of the store, which ends at height {}; there's nothing to catch up on",
+                        x,
+                        end
+                    );
+                    return Ok(None);
+                }
+                Some(x) if x == end => {
+                    tracing::info!("the archive is caught up with the store, at height {}", x);
+                    return Ok(None);
+                }
+                _ => {}
+            }
+        }
+
+        // Resuming from past the block after the end of the archive would leave a gap in it,
+        // whether the store was pruned past there, or a later start height was asked for.
+        if let Some(x) = archive_end.filter(|x| requested_start > x + 1) {
+            let reason = match self.start_height {
+                Some(_) => format!("the start height {}", requested_start),
+                None => format!("the store starts at height {}", requested_start),
+            };
+            anyhow::ensure!(
+                self.allow_partial,
+                "{} is past the end of the archive, at height {}, so archiving from it would leave blocks {}..={} out; pass --allow-partial to leave that gap",
+                reason,
+                x,
+                x + 1,
+                requested_start - 1
+            );
+            tracing::warn!(
+                "{} is past the end of the archive, at height {}, leaving blocks {}..={} out of it",
+                reason,
+                x,
+                x + 1,
+                requested_start - 1
+            );
+        }
+
+        let start = std::cmp::max(requested_start, archive_end.unwrap_or(0) + 1);
+        if !self.allow_partial && self.start_height.is_none() {
+            if let Some(first) = self.archive.first_height_from(start).await? {
+                check_starts_at_genesis(&self.genesis.chain_id(), first)?;
+            }
+        }
+        Ok(Some((start, end)))
+    }
+
+    /// Archive the genesis of the store, along with any others it has, when stitched together.
+    async fn archive_genesis(&self) -> anyhow::Result<()> {
+        for genesis in self.store.get_geneses().await? {
+            tracing::info!(
+                initial_height = genesis.initial_height(),
+                "archiving genesis"
+            );
+            self.archive.put_genesis(&genesis).await?;
+        }
+        Ok(())
+    }
+
+    /// Read the blocks between start and end, inclusive, on several workers, in order of height.
+    ///
+    /// Each worker reads a disjoint chunk of heights, within a single segment between boundaries.
+    /// Only around `parallelism` chunks are read ahead of the consumer of the stream,
+    /// so a slow consumer doesn't cause blocks to pile up in memory.
+    fn stream_blocks_parallel(
+        store: Arc<dyn Store>,
+        start: u64,
+        end: u64,
+        boundaries: &[u64],
+        parallelism: usize,
+    ) -> BlockStream<'static> {
+        let (tx, mut rx) = tokio::sync::mpsc::channel(parallelism);
+        let chunks = parallel_chunks(start, end, boundaries);
+        tokio::spawn(async move {
+            for (chunk_start, chunk_end) in chunks {
+                let store = store.clone();
+                let worker = tokio::spawn(async move {
+                    // Stores which can fetch several blocks at once read the whole chunk together.
+                    let out = store.get_blocks(chunk_start, chunk_end).await?;
+                    let next = out.last().map_or(chunk_start, |x| x.0 + 1);
+                    anyhow::ensure!(next > chunk_end, "expected block at height {}", next);
+                    anyhow::Ok(out)
+                });
+                // If the receiver is gone, the stream was dropped, and there's no point continuing.
+                if tx.send(worker).await.is_err() {
+                    break;
+                }
+            }
+        });
+        Box::pin(try_stream! {
+            while let Some(worker) = rx.recv().await {
+                for (height, block) in worker.await?? {
+                    yield (height, block);
+                }
+            }
+        })
+    }
+
+    /// Read the blocks between start and end, inclusive, through the store's own streaming.
+    ///
+    /// The store is asked for each segment between boundaries on its own, so that stores
+    /// fetching several blocks at once never fetch across a boundary.
+    fn stream_blocks_segmented(
+        store: Arc<dyn Store>,
+        start: u64,
+        end: u64,
+        boundaries: &[u64],
+    ) -> BlockStream<'static> {
+        let segments = segments(start, end, boundaries);
+        Box::pin(try_stream! {
+            for (segment_start, segment_end) in segments {
+                let mut blocks = store.stream_blocks(Some(segment_start), Some(segment_end));
+                while let Some(x) = blocks.try_next().await? {
+                    yield x;
+                }
+            }
+        })
+    }
+
+    /// Read the blocks between start and end, inclusive, one at a time.
+    ///
+    /// Failing to read a block doesn't end the stream: the error is passed along
+    /// with the height of that block, and reading continues with the next one.
+    fn stream_blocks_skipping(
+        store: Arc<dyn Store>,
+        start: u64,
+        end: u64,
+    ) -> SkippingBlockStream<'static> {
+        Box::pin(async_stream::stream! {
+            for height in start..=end {
+                let block = match store.get_block(height).await {
+                    Ok(Some(block)) => Ok(block),
+                    Ok(None) => Err(anyhow!("expected block at height {}", height)),
+                    Err(e) => Err(e),
+                };
+                yield anyhow::Ok((height, block));
+            }
+        })
+    }
+
+    /// Check that a block hashes to what it claims to, and to the ID the store has for it, if any.
+    async fn verify_block(&self, height: u64, block: Block) -> anyhow::Result<Block> {
+        let block_id = self.store.get_block_id(height).await?;
+        block.verify_hashes(block_id.as_deref())?;
+        Ok(block)
+    }
+
+    /// Record a block that couldn't be read in the skip report, so that archival can go on.
+    ///
+    /// This fails instead if the block was pruned, since archiving the rest is then pointless.
+    async fn skip_block(&self, report: &Path, height: u64, e: anyhow::Error) -> anyhow::Result<()> {
+        if let Ok(Some((first, _))) = self.store.get_height_bounds().await {
+            if first > height {
+                return Err(self.explain_pruning(height, e).await);
+            }
+        }
+        tracing::warn!(height, "skipping block which failed to be read: {:#}", e);
+        let line = serde_json::json!({
+            "height": height,
+            "error": format!("{:#}", e),
+        });
+        let mut file = std::fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(report)
+            .with_context(|| format!("failed to open skip report '{}'", report.display()))?;
+        writeln!(file, "{}", line)
+            .with_context(|| format!("failed to write to skip report '{}'", report.display()))?;
+        Ok(())
+    }
+
+    pub async fn run(mut self) -> anyhow::Result<ArchiveSummary> {
+        let started = Instant::now();
+        // Check the range first, so that a bad request leaves the archive untouched.
+        let bounds = self.bounds().await?;
+        self.archive_genesis().await?;
+
+        let mut summary = ArchiveSummary::default();
+        if let Some(report) = self.retry_report.clone() {
+            let result = self.retry_skipped(&report, &mut summary).await;
+            let committed = self.commit_pending(&mut summary).await;
+            result?;
+            committed?;
+        }
+        let (start, end) = match bounds {
+            Some((x, y)) if y >= x => (x, y),
+            _ => {
+                tracing::info!("empty archival range, returning");
+                summary.duration = started.elapsed();
+                return Ok(summary);
+            }
+        };
+        summary.range = Some((start, end));
+
+        let result = self.archive_range(start, end, &mut summary).await;
+        // Blocks archived before a failure are kept, since the store might not have them next time.
+        let committed = self.commit_pending(&mut summary).await;
+        result?;
+        committed?;
+        self.archive.flush()?;
+        if summary.stopped_early {
+            summary.duration = started.elapsed();
+            return Ok(summary);
+        }
+
+        if let Some(report) = self
+            .skip_report
+            .as_deref()
+            .filter(|_| !summary.skipped.is_empty())
+        {
+            tracing::warn!(
+                "skipped {} blocks which failed to be read, listed in '{}'",
+                summary.skipped.len(),
+                report.display()
+            );
+        }
+
+        if let Some((first, _)) = self.store.get_height_bounds().await? {
+            if first > start {
+                tracing::warn!(
+                    "the store was pruned up to height {} while archiving, starting from height {}; every block was archived before being pruned",
+                    first - 1,
+                    start
+                );
+            }
+        }
+
+        summary.duration = started.elapsed();
+        Ok(summary)
+    }
+
+    /// Archive the blocks between start and end, inclusive, stopping early if asked to.
+    ///
+    /// Blocks archived since the last commit are left in the pending batch, for the caller
+    /// to commit, even if this fails.
+    async fn archive_range(
+        &mut self,
+        start: u64,
+        end: u64,
+        summary: &mut ArchiveSummary,
+    ) -> anyhow::Result<()> {
+        // The store may still be growing, if a node is writing to it, but the end was fixed
+        // before starting, so whatever the node adds in the meantime is left for the next run.
+        tracing::info!("archiving blocks {}..{}", start, end);
+        let mut block_stream: SkippingBlockStream<'_> = if self.skip_report.is_some() {
+            Self::stream_blocks_skipping(self.store.clone(), start, end)
+        } else if self.parallelism > 1 {
+            Box::pin(
+                Self::stream_blocks_parallel(
+                    self.store.clone(),
+                    start,
+                    end,
+                    &self.boundaries,
+                    self.parallelism,
+                )
+                .map(|x| x.map(|(height, block)| (height, anyhow::Ok(block)))),
+            )
+        } else {
+            Box::pin(
+                Self::stream_blocks_segmented(self.store.clone(), start, end, &self.boundaries)
+                    .map(|x| x.map(|(height, block)| (height, anyhow::Ok(block)))),
+            )
+        };
+        let mut expected = start;
+        let mut progress = ProgressLog::new("archiving", start, Some(end), self.progress_interval);
+        loop {
+            // Stopping between blocks commits every block archived so far, leaving an archive
+            // that the next run resumes from. If the process dies instead, the blocks since the
+            // last commit are rolled back, and the next run resumes after the last batch committed.
+            let next = tokio::select! {
+                _ = self.shutdown.requested() => {
+                    tracing::info!(
+                        "stopping early; the next run will resume archiving from block {}",
+                        expected
+                    );
+                    progress.finish();
+                    summary.stopped_early = true;
+                    return Ok(());
+                }
+                next = block_stream.try_next() => match next {
+                    Ok(x) => x,
+                    Err(e) => return Err(self.explain_pruning(expected, e).await),
+                },
+            };
+            let Some((height, block)) = next else {
+                break;
+            };
+            if height != expected {
+                let e = anyhow!(
+                    "expected to archive block {} next, but got block {}",
+                    expected,
+                    height
+                );
+                return Err(self.explain_pruning(expected, e).await);
+            }
+            expected += 1;
+            let block = match block {
+                Ok(block) if self.verify_hashes => self.verify_block(height, block).await,
+                x => x,
+            };
+            let block = match (block, self.skip_report.as_deref()) {
+                (Ok(block), _) => block,
+                (Err(e), Some(report)) => {
+                    self.skip_block(report, height, e).await?;
+                    summary.skipped.push(height);
+                    continue;
+                }
+                (Err(e), None) => return Err(self.explain_pruning(height, e).await),
+            };
+            self.write_block(height, &block, summary).await?;
+            progress.record(height);
+        }
+        progress.finish();
+        Ok(())
+    }
+
+    /// Write a block into the archive, or the stream, committing the batch once it's full.
+    async fn write_block(
+        &mut self,
+        height: u64,
+        block: &Block,
+        summary: &mut ArchiveSummary,
+    ) -> anyhow::Result<()> {
+        tracing::debug!("archiving block {}", height);
+        let mut data = block.encode();
+        match &mut self.archive {
+            ArchiveOutput::Archive(archive) => {
+                let extended_commit = if self.no_commit {
+                    data = without_commit_signatures(&data)
+                        .ok_or(anyhow!("block {} is malformed", height))?;
+                    None
+                } else {
+                    self.store.get_extended_commit(height).await?
+                };
+                if self.batch.is_none() {
+                    self.batch = Some(archive.begin_batch().await?);
+                }
+                let evidence = block_evidence(&data).filter(|_| self.with_evidence);
+                // A block which fails to go in is left out of the batch entirely, so that
+                // committing the blocks before it, as is done on failure, is safe.
+                self.batch
+                    .as_mut()
+                    .expect("a batch should have just been started")
+                    .put_encoded_block(
+                        height,
+                        &data,
+                        block.num_txs(),
+                        block.time()?,
+                        extended_commit.as_deref(),
+                        evidence,
+                    )
+                    .await?;
+            }
+            ArchiveOutput::Stream(writer) => writer.write(block, &data)?,
+        }
+        if self
+            .batch
+            .as_ref()
+            .is_some_and(|x| x.len() as u64 >= self.commit_batch)
+        {
+            self.commit_pending(summary).await?;
+        }
+        summary.blocks += 1;
+        summary.bytes += data.len() as u64;
+        crate::metrics::record_block(height);
+        Ok(())
+    }
+
+    /// Try again to archive the blocks which earlier runs skipped, as listed in their report.
+    ///
+    /// Blocks which can be read now are archived, and left out of the report. The others stay
+    /// in it, with the error they failed with this time, and are counted as skipped again.
+    async fn retry_skipped(
+        &mut self,
+        report: &Path,
+        summary: &mut ArchiveSummary,
+    ) -> anyhow::Result<()> {
+        let ArchiveOutput::Archive(archive) = &self.archive else {
+            return Ok(());
+        };
+        let contents = match std::fs::read_to_string(report) {
+            Ok(x) => x,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+            Err(e) => {
+                return Err(e)
+                    .with_context(|| format!("failed to read skip report '{}'", report.display()))
+            }
+        };
+        let mut heights = contents
+            .lines()
+            .filter(|x| !x.trim().is_empty())
+            .map(|line| {
+                let entry: serde_json::Value = serde_json::from_str(line)?;
+                entry["height"]
+                    .as_u64()
+                    .ok_or(anyhow!("the line '{}' has no height", line))
+            })
+            .collect::<anyhow::Result<Vec<u64>>>()
+            .with_context(|| format!("failed to read skip report '{}'", report.display()))?;
+        heights.sort_unstable();
+        heights.dedup();
+        let mut missing = Vec::new();
+        for height in heights {
+            // A block archived since, as by a run starting over, needs no retrying.
+            if !archive.block_does_exist(height).await? {
+                missing.push(height);
+            }
+        }
+        if !missing.is_empty() {
+            tracing::info!(
+                "retrying {} blocks which earlier runs skipped, listed in '{}'",
+                missing.len(),
+                report.display()
+            );
+        }
+
+        let mut lines = Vec::new();
+        for height in missing {
+            let block = match self.store.get_block(height).await {
+                Ok(Some(block)) => Ok(block),
+                Ok(None) => Err(anyhow!("expected block at height {}", height)),
+                Err(e) => Err(e),
+            };
+            let block = match block {
+                Ok(block) if self.verify_hashes => self.verify_block(height, block).await,
+                x => x,
+            };
+            match block {
+                Ok(block) => {
+                    self.write_block(height, &block, summary).await?;
+                    summary.retried.push(height);
+                }
+                Err(e) => {
+                    tracing::warn!(
+                        height,
+                        "block which was skipped still fails to be read: {:#}",
+                        e
+                    );
+                    lines.push(serde_json::json!({
+                        "height": height,
+                        "error": format!("{:#}", e),
+                    }));
+                    summary.skipped.push(height);
+                }
+            }
+        }
+        // The report only changes once every block retried is in, so that failing before then
+        // leaves it listing them all, to retry again.
+        self.commit_pending(summary).await?;
+        if lines.is_empty() {
+            std::fs::remove_file(report)
+                .with_context(|| format!("failed to remove '{}'", report.display()))?;
+        } else {
+            let data: String = lines.iter().map(|x| format!("{}\n", x)).collect();
+            crate::files::write_atomically(report, data.as_bytes())
+                .with_context(|| format!("failed to write skip report '{}'", report.display()))?;
+        }
+        Ok(())
+    }
+
+    /// Commit the blocks put into the archive since the last commit, if there are any.
+    async fn commit_pending(&mut self, summary: &mut ArchiveSummary) -> anyhow::Result<()> {
+        let Some(batch) = self.batch.take() else {
+            return Ok(());
+        };
+        let len = batch.len();
+        batch.commit().await?;
+        summary.commits += 1;
+        tracing::debug!("committed {} blocks to the archive", len);
+        Ok(())
+    }
+
+    /// Add an explanation to an error reading a block, if it happened because the store
+    /// was pruned past that block while archiving.
+    async fn explain_pruning(&self, expected: u64, e: anyhow::Error) -> anyhow::Error {
+        match self.store.get_height_bounds().await {
+            Ok(Some((first, _))) if first > expected => e.context(format!(
+                "the store was pruned up to height {} while archiving, removing blocks from height {} on before they were archived",
+                first - 1,
+                expected
+            )),
+            _ => e,
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use async_trait::async_trait;
+    use std::sync::atomic::{AtomicU64, Ordering};
+
+    use super::*;
+    use crate::stream::{index_path, StreamReader};
+
+    /// A store containing copies of the test block, at every height between two bounds.
+    struct TestStore {
+        first: u64,
+        last: u64,
+    }
+
+    #[async_trait]
+    impl Store for TestStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            Ok(Genesis::test_value())
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            Ok(Some((self.first, self.last)))
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            Ok(Some(Block::test_value_at_height(height))
+                .filter(|_| (self.first..=self.last).contains(&height)))
+        }
+    }
+
+    /// A store without any blocks, as a node has before it syncs.
+    struct EmptyStore;
+
+    #[async_trait]
+    impl Store for EmptyStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            Ok(Genesis::test_value())
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            Ok(None)
+        }
+
+        async fn get_block(&self, _height: u64) -> anyhow::Result<Option<Block>> {
+            Ok(None)
+        }
+    }
+
+    /// A store which asks archival to stop, as a signal would, when serving a given height,
+    /// then stalls.
+    struct InterruptedStore {
+        inner: TestStore,
+        interrupt_at: u64,
+        shutdown: Shutdown,
+    }
+
+    #[async_trait]
+    impl Store for InterruptedStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            self.inner.get_genesis().await
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            self.inner.get_height_bounds().await
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            if height > self.interrupt_at {
+                std::future::pending::<()>().await;
+            }
+            if height == self.interrupt_at {
+                self.shutdown.request();
+            }
+            self.inner.get_block(height).await
+        }
+    }
+
+    /// A store where the block at one height is corrupt, and fails to decode.
+    struct CorruptStore {
+        inner: TestStore,
+        corrupt: u64,
+    }
+
+    #[async_trait]
+    impl Store for CorruptStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            self.inner.get_genesis().await
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            self.inner.get_height_bounds().await
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            if height == self.corrupt {
+                return Block::decode(b"not a block")
+                    .map(Some)
+                    .with_context(|| format!("failed to decode block at height {}", height));
+            }
+            self.inner.get_block(height).await
+        }
+    }
+
+    /// A store where one block was tampered with, and another is stored under the wrong ID.
+    struct TamperedStore {
+        inner: TestStore,
+        tampered: u64,
+        wrong_id: u64,
+    }
+
+    #[async_trait]
+    impl Store for TamperedStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            self.inner.get_genesis().await
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            self.inner.get_height_bounds().await
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            if height == self.tampered {
+                // The transactions change, but the hash of them in the header doesn't.
+                return Ok(Some(Block::test_value_with_transactions(
+                    height,
+                    vec![b"tampered".to_vec()],
+                )));
+            }
+            self.inner.get_block(height).await
+        }
+
+        async fn get_block_id(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+            if height == self.wrong_id {
+                return Ok(Some(vec![0u8; 32]));
+            }
+            Ok(Some(Block::test_value_at_height(height).hash()?.to_vec()))
+        }
+    }
+
+    /// A store whose blocks have extended commits from a given height on, as after an upgrade.
+    struct ExtendedCommitStore {
+        inner: TestStore,
+        from: u64,
+    }
+
+    impl ExtendedCommitStore {
+        fn extended_commit(height: u64) -> Vec<u8> {
+            format!("extended commit {}", height).into_bytes()
+        }
+    }
+
+    #[async_trait]
+    impl Store for ExtendedCommitStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            self.inner.get_genesis().await
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            self.inner.get_height_bounds().await
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            self.inner.get_block(height).await
+        }
+
+        async fn get_extended_commit(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+            Ok(Some(Self::extended_commit(height)).filter(|_| height >= self.from))
+        }
+    }
+
+    /// A store which records the ranges of heights it's asked to stream.
+    struct RecordingStore {
+        inner: TestStore,
+        streamed: Arc<std::sync::Mutex<Vec<(Option<u64>, Option<u64>)>>>,
+    }
+
+    #[async_trait]
+    impl Store for RecordingStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            self.inner.get_genesis().await
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            self.inner.get_height_bounds().await
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            self.inner.get_block(height).await
+        }
+
+        fn stream_blocks(&self, start: Option<u64>, end: Option<u64>) -> BlockStream<'_> {
+            self.streamed.lock().unwrap().push((start, end));
+            self.inner.stream_blocks(start, end)
+        }
+    }
+
+    /// A store a node keeps writing to while it's archived, appending a block after each read.
+    ///
+    /// After reading a given height, the node can also prune the store up to another height.
+    struct LiveStore {
+        first: Arc<AtomicU64>,
+        last: Arc<AtomicU64>,
+        prune: Option<(u64, u64)>,
+    }
+
+    impl LiveStore {
+        fn new(first: u64, last: u64, prune: Option<(u64, u64)>) -> Self {
+            Self {
+                first: Arc::new(AtomicU64::new(first)),
+                last: Arc::new(AtomicU64::new(last)),
+                prune,
+            }
+        }
+    }
+
+    #[async_trait]
+    impl Store for LiveStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            Ok(Genesis::test_value())
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            Ok(Some((
+                self.first.load(Ordering::SeqCst),
+                self.last.load(Ordering::SeqCst),
+            )))
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            let first = self.first.load(Ordering::SeqCst);
+            let last = self.last.fetch_add(1, Ordering::SeqCst);
+            if let Some((at, to)) = self.prune {
+                if height == at {
+                    self.first.store(to + 1, Ordering::SeqCst);
+                }
+            }
+            Ok(Some(Block::test_value_at_height(height))
+                .filter(|_| (first..=last).contains(&height)))
+        }
+    }
+
+    fn test_archive_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-{}-{}.sqlite",
+            name,
+            std::process::id()
+        ))
+    }
+
+    /// Check that an archive contains exactly the blocks from 1 to last.
+    async fn assert_archive_complete(path: &Path, last: u64) -> anyhow::Result<()> {
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(last));
+        for height in 1..=last {
+            let block = archive.get_block(height).await?;
+            assert_eq!(block.map(|x| x.height()), Some(height));
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_resumes_after_existing_blocks() -> anyhow::Result<()> {
+        let path = test_archive_path("resume");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        // Simulate an earlier run which archived some blocks, but stopped before finishing.
+        {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            for height in 1..=4 {
+                archive
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+        }
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await?;
+        assert_archive_complete(&path, 10).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_parallel_archive_is_ordered_and_complete() -> anyhow::Result<()> {
+        let path = test_archive_path("parallel");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let last = 3 * PARALLEL_CHUNK_SIZE + 17;
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last });
+        // The archiver fails if blocks arrive out of order.
+        Archiver::new(
+            genesis.clone(),
+            store,
+            archive,
+            RunOpts {
+                parallelism: 4,
+                ..Default::default()
+            },
+        )
+        .run()
+        .await?;
+        assert_archive_complete(&path, last).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_chunks_never_cross_boundaries() {
+        let boundaries = [5, 1500, 5000];
+        assert_eq!(
+            segments(1, 2600, &boundaries),
+            vec![(1, 4), (5, 1499), (1500, 2600)]
+        );
+        let chunks = parallel_chunks(1, 2600, &boundaries);
+        assert_eq!(
+            chunks,
+            vec![(1, 4), (5, 1004), (1005, 1499), (1500, 2499), (2500, 2600)]
+        );
+        for (start, end) in chunks {
+            assert!(end - start < PARALLEL_CHUNK_SIZE);
+            for boundary in boundaries {
+                assert!(
+                    !(start < boundary && boundary <= end),
+                    "chunk {}..={} crosses the boundary at {}",
+                    start,
+                    end,
+                    boundary
+                );
+            }
+        }
+        // Starting right at a boundary, or ending right before one, splits nothing.
+        assert_eq!(segments(5, 1499, &boundaries), vec![(5, 1499)]);
+        assert_eq!(segments(3, 3, &boundaries), vec![(3, 3)]);
+    }
+
+    #[test]
+    fn test_version_boundaries() {
+        let boundaries = version_boundaries("penumbra-1");
+        assert_eq!(boundaries, vec![501975, 2611800, 4378762, 5480873]);
+        assert!(version_boundaries("penumbra-devnet").is_empty());
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_batches_stay_within_boundaries() -> anyhow::Result<()> {
+        let genesis = Genesis::test_value();
+        for parallelism in [1, 4] {
+            let path = test_archive_path(&format!("boundaries-{}", parallelism));
+            remove_archive(&path)?;
+            let last = 2 * PARALLEL_CHUNK_SIZE + 10;
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let streamed = Arc::new(std::sync::Mutex::new(Vec::new()));
+            let store = Box::new(RecordingStore {
+                inner: TestStore { first: 1, last },
+                streamed: streamed.clone(),
+            });
+            let opts = RunOpts {
+                parallelism,
+                ..Default::default()
+            };
+            let mut archiver = Archiver::new(genesis.clone(), store, archive, opts);
+            archiver.boundaries = vec![4, PARALLEL_CHUNK_SIZE + 500];
+            archiver.run().await?;
+            assert_archive_complete(&path, last).await?;
+            if parallelism == 1 {
+                assert_eq!(
+                    *streamed.lock().unwrap(),
+                    vec![
+                        (Some(1), Some(3)),
+                        (Some(4), Some(PARALLEL_CHUNK_SIZE + 499)),
+                        (Some(PARALLEL_CHUNK_SIZE + 500), Some(last)),
+                    ]
+                );
+            }
+            remove_archive(&path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_interrupted_archive_is_resumable() -> anyhow::Result<()> {
+        let path = test_archive_path("interrupted");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let shutdown = Shutdown::default();
+        let store = Box::new(InterruptedStore {
+            inner: TestStore { first: 1, last: 10 },
+            interrupt_at: 5,
+            shutdown: shutdown.clone(),
+        });
+        // Without the request stopping it, this would wait forever for block 6.
+        Archiver::new(
+            genesis.clone(),
+            store,
+            archive,
+            RunOpts {
+                shutdown,
+                ..Default::default()
+            },
+        )
+        .run()
+        .await?;
+        // The request may be seen before or after block 5 is written, but never in the middle.
+        let last = {
+            let archive = Storage::new(Some(&path), None).await?;
+            archive.last_height().await?.unwrap_or(0)
+        };
+        assert!(last == 4 || last == 5, "unexpected last height {}", last);
+        assert_archive_complete(&path, last).await?;
+
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await?;
+        assert_archive_complete(&path, 10).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_blocks_are_committed_in_batches() -> anyhow::Result<()> {
+        let genesis = Genesis::test_value();
+        for (commit_batch, commits) in [(1, 10), (4, 3), (10, 1), (256, 1)] {
+            let path = test_archive_path(&format!("commit-batch-{}", commit_batch));
+            remove_archive(&path)?;
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let opts = RunOpts {
+                commit_batch,
+                ..Default::default()
+            };
+            let summary = Archiver::new(
+                genesis.clone(),
+                Box::new(TestStore { first: 1, last: 10 }),
+                archive,
+                opts,
+            )
+            .run()
+            .await?;
+            assert_eq!(summary.commits, commits, "batches of {}", commit_batch);
+            assert_eq!(summary.to_json()["commits"], commits);
+            assert_archive_complete(&path, 10).await?;
+            remove_archive(&path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_failure_partway_through_batch_is_resumable() -> anyhow::Result<()> {
+        let path = test_archive_path("partial-batch");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let opts = RunOpts {
+            commit_batch: 4,
+            ..Default::default()
+        };
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(CorruptStore {
+            inner: TestStore { first: 1, last: 10 },
+            corrupt: 7,
+        });
+        Archiver::new(genesis.clone(), store, archive, opts.clone())
+            .run()
+            .await
+            .expect_err("a corrupt block should fail archival");
+        // The blocks after the last full batch were committed before failing, rather than lost.
+        assert_archive_complete(&path, 6).await?;
+
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        let summary = Archiver::new(genesis.clone(), store, archive, opts)
+            .run()
+            .await?;
+        assert_eq!(summary.range, Some((7, 10)));
+        assert_eq!(summary.commits, 1);
+        assert_archive_complete(&path, 10).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    /// Check that an archive contains exactly the blocks from first to last.
+    async fn assert_archive_range(path: &Path, first: u64, last: u64) -> anyhow::Result<()> {
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.first_height().await?, Some(first));
+        assert_eq!(archive.last_height().await?, Some(last));
+        for height in first..=last {
+            let block = archive.get_block(height).await?;
+            assert_eq!(block.map(|x| x.height()), Some(height));
+        }
+        Ok(())
+    }
+
+    fn range_opts(start_height: Option<u64>, end_height: Option<u64>) -> RunOpts {
+        RunOpts {
+            start_height,
+            end_height,
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_height_range() -> anyhow::Result<()> {
+        let path = test_archive_path("range");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        Archiver::new(
+            genesis.clone(),
+            store,
+            archive,
+            range_opts(Some(3), Some(6)),
+        )
+        .run()
+        .await?;
+        assert_archive_range(&path, 3, 6).await?;
+
+        // Leaving out the end archives up to the last block in the store.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        Archiver::new(genesis.clone(), store, archive, range_opts(Some(3), None))
+            .run()
+            .await?;
+        assert_archive_range(&path, 3, 10).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_incremental_archive_catches_up() -> anyhow::Result<()> {
+        let path = test_archive_path("incremental");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let incremental = RunOpts {
+            incremental: true,
+            ..Default::default()
+        };
+        {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            for height in 1..=4 {
+                archive
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+        }
+
+        // Behind the store, the archive is caught up to the last block in it.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        let summary = Archiver::new(genesis.clone(), store, archive, incremental.clone())
+            .run()
+            .await?;
+        assert_eq!(summary.range, Some((5, 10)));
+        assert_eq!(summary.blocks, 6);
+        assert_archive_complete(&path, 10).await?;
+
+        // Caught up, nothing is archived.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        let summary = Archiver::new(genesis.clone(), store, archive, incremental.clone())
+            .run()
+            .await?;
+        assert_eq!(summary.range, None);
+        assert_eq!(summary.blocks, 0);
+        assert_archive_complete(&path, 10).await?;
+
+        // Ahead of the store, as when the node was restored from an older backup, neither.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 7 });
+        let summary = Archiver::new(genesis.clone(), store, archive, incremental.clone())
+            .run()
+            .await?;
+        assert_eq!(summary.range, None);
+        assert_archive_complete(&path, 10).await?;
+
+        // A store pruned past the end of the archive can't catch it up without a gap.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore {
+            first: 15,
+            last: 20,
+        });
+        let err = Archiver::new(genesis.clone(), store, archive, incremental)
+            .run()
+            .await
+            .expect_err("blocks 11..=14 are missing from the store");
+        assert!(err.to_string().contains("11..=14"), "{:#}", err);
+        assert_archive_complete(&path, 10).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_summary() -> anyhow::Result<()> {
+        let path = test_archive_path("summary");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let summary = Archiver::new(
+            genesis.clone(),
+            Box::new(TestStore { first: 1, last: 10 }),
+            archive,
+            range_opts(Some(3), Some(7)),
+        )
+        .run()
+        .await?;
+        let bytes: u64 = (3..=7)
+            .map(|height| Block::test_value_at_height(height).encode().len() as u64)
+            .sum();
+        assert_eq!(
+            summary,
+            ArchiveSummary {
+                range: Some((3, 7)),
+                blocks: 5,
+                bytes,
+                skipped: Vec::new(),
+                retried: Vec::new(),
+                duration: summary.duration,
+                stopped_early: false,
+                commits: 5,
+            }
+        );
+        assert_eq!(summary.processed(), 5);
+
+        let json = summary.to_json();
+        assert_eq!(json["start_height"], 3);
+        assert_eq!(json["end_height"], 7);
+        assert_eq!(json["processed"], 5);
+        assert_eq!(json["blocks"], 5);
+        assert_eq!(json["bytes"], bytes);
+        assert_eq!(json["skipped"], serde_json::json!([]));
+        let text = summary.to_text();
+        assert!(text.contains("heights:      3..=7\n"), "{}", text);
+        assert!(
+            text.contains(&format!("archived:     5 blocks, {} bytes\n", bytes)),
+            "{}",
+            text
+        );
+
+        // Running again finds nothing left to archive.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let summary = Archiver::new(
+            genesis.clone(),
+            Box::new(TestStore { first: 1, last: 10 }),
+            archive,
+            range_opts(Some(3), Some(7)),
+        )
+        .run()
+        .await?;
+        assert_eq!(summary.range, None);
+        assert_eq!(summary.blocks, 0);
+        assert_eq!(summary.to_json()["start_height"], serde_json::Value::Null);
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_writes_report() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-report", false)?;
+        let path = test_archive_path("report");
+        remove_archive(&path)?;
+        let report = home.join("report.json");
+        let cmd = ParsedCommand::Local {
+            cometbft_dir: home.clone(),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        };
+        let opts = RunOpts {
+            report: Some(report.clone()),
+            ..RunOpts::default()
+        };
+        cmd.run(opts).await?;
+        let json: serde_json::Value = serde_json::from_str(&std::fs::read_to_string(&report)?)?;
+        assert_eq!(json["start_height"], 1);
+        assert_eq!(json["end_height"], 5);
+        assert_eq!(json["blocks"], 5);
+        let archive = Storage::new(Some(&path), None).await?;
+        let (_, bytes, _) = archive.block_sizes().await?;
+        assert_eq!(json["bytes"], bytes);
+        drop(archive);
+        remove_archive(&path)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_writes_manifest() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-manifest", false)?;
+        let path = test_archive_path("manifest");
+        remove_archive(&path)?;
+        let cmd = || ParsedCommand::Local {
+            cometbft_dir: home.clone(),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        };
+        cmd()
+            .run(RunOpts {
+                end_height: Some(3),
+                ..RunOpts::default()
+            })
+            .await?;
+        let first = manifest::Manifest::read(&manifest::manifest_path(&path))?
+            .expect("archiving should write a manifest");
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(
+            first,
+            manifest::Manifest::of(&archive, Some(first.created_at.clone())).await?
+        );
+        assert_eq!(first.heights, Some((1, 3)));
+        assert_eq!(first.block_count, 3);
+        drop(archive);
+
+        // Adding to the archive describes it anew, but it was still created at the same time.
+        cmd().run(RunOpts::default()).await?;
+        let second = manifest::Manifest::read(&manifest::manifest_path(&path))?
+            .expect("archiving should write a manifest");
+        assert_eq!(second.heights, Some((1, 5)));
+        assert_eq!(second.block_count, 5);
+        assert_eq!(second.created_at, first.created_at);
+        assert_ne!(second.content_hash, first.content_hash);
+
+        // Restarting removes the manifest along with the archive, and it can be left out.
+        cmd()
+            .run(RunOpts {
+                restart: true,
+                no_manifest: true,
+                ..RunOpts::default()
+            })
+            .await?;
+        assert!(!manifest::manifest_path(&path).exists());
+        remove_archive(&path)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_is_uploaded() -> anyhow::Result<()> {
+        use crate::object_store::mock::{self, MockS3};
+
+        let home = cometbft::test_node_home("archive-upload", false)?;
+        let path = test_archive_path("upload");
+        remove_archive(&path)?;
+        let s3 = Arc::new(std::sync::Mutex::new(MockS3::default()));
+        let store = mock::store(&mock::serve(s3.clone()).await?, "s3://archives/penumbra-1")?;
+        ParsedCommand::Local {
+            cometbft_dir: home.clone(),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        }
+        .run(RunOpts {
+            upload: Some(store),
+            ..RunOpts::default()
+        })
+        .await?;
+        let name = path
+            .file_name()
+            .and_then(|x| x.to_str())
+            .expect("test path should be valid UTF-8");
+        let s3 = s3.lock().unwrap();
+        assert_eq!(
+            s3.objects.get(&format!("archives/penumbra-1/{}", name)),
+            Some(&std::fs::read(&path)?)
+        );
+        assert_eq!(
+            s3.objects
+                .get(&format!("archives/penumbra-1/{}.manifest.json", name)),
+            Some(&std::fs::read(manifest::manifest_path(&path))?)
+        );
+        remove_archive(&path)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_without_commits() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-no-commit", false)?;
+        let cmd = |path: &Path| ParsedCommand::Local {
+            cometbft_dir: home.clone(),
+            destination: Destination::Archive(path.to_owned()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        };
+        let with = test_archive_path("with-commits");
+        let without = test_archive_path("without-commits");
+        remove_archive(&with)?;
+        remove_archive(&without)?;
+        cmd(&with).run(RunOpts::default()).await?;
+        cmd(&without)
+            .run(RunOpts {
+                no_commit: true,
+                ..RunOpts::default()
+            })
+            .await?;
+
+        let with_archive = Storage::new(Some(&with), None).await?;
+        let without_archive = Storage::new(Some(&without), None).await?;
+        assert!(!with_archive.without_commits().await?);
+        assert!(without_archive.without_commits().await?);
+        let (with_count, with_bytes, _) = with_archive.block_sizes().await?;
+        let (without_count, without_bytes, _) = without_archive.block_sizes().await?;
+        assert_eq!((with_count, without_count), (5, 5));
+        assert!(
+            without_bytes < with_bytes,
+            "{} bytes without commits, {} with them",
+            without_bytes,
+            with_bytes
+        );
+        // The blocks are the same, other than the signatures in their last commits.
+        for height in 1..=5 {
+            let block = with_archive.get_encoded_block(height).await?;
+            let stripped = without_archive.get_encoded_block(height).await?;
+            assert_eq!(
+                block.as_deref().and_then(without_commit_signatures),
+                stripped
+            );
+            assert_eq!(without_archive.get_extended_commit(height).await?, None);
+        }
+        drop(with_archive);
+        drop(without_archive);
+
+        // Neither archive can be added to with blocks kept the other way.
+        assert!(cmd(&without).run(RunOpts::default()).await.is_err());
+        assert!(cmd(&with)
+            .run(RunOpts {
+                no_commit: true,
+                ..RunOpts::default()
+            })
+            .await
+            .is_err());
+        remove_archive(&with)?;
+        remove_archive(&without)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_from_backup() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-backup", true)?;
+        let backup = home.with_extension("tar.gz");
+        let mut builder = tar::Builder::new(flate2::write::GzEncoder::new(
+            std::fs::File::create(&backup)?,
+            flate2::Compression::fast(),
+        ));
+        builder.append_dir_all(".", &home)?;
+        builder.into_inner()?.finish()?;
+        let reindexer_home = home.with_extension("reindexer");
+        let args = Archive::try_parse_from([
+            "archive",
+            "--backup",
+            backup.to_str().expect("test path should be valid unicode"),
+            "--home",
+            reindexer_home
+                .to_str()
+                .expect("test path should be valid unicode"),
+        ])?;
+        assert!(Archive::try_parse_from([
+            "archive",
+            "--backup",
+            "backup.tar.gz",
+            "--node-home",
+            "/elsewhere"
+        ])
+        .is_err());
+
+        let extracted = args.extract_backup(args.backup.as_deref().expect("a backup was given"))?;
+        assert!(extracted.cometbft_dir().starts_with(&reindexer_home));
+        let path = test_archive_path("backup");
+        remove_archive(&path)?;
+        let cmd = ParsedCommand::Local {
+            cometbft_dir: extracted.cometbft_dir().to_owned(),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        };
+        cmd.run(RunOpts::default()).await?;
+        drop(extracted);
+        // Nothing extracted from the backup is left behind.
+        assert_eq!(std::fs::read_dir(&reindexer_home)?.count(), 0);
+
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(5));
+        drop(archive);
+        remove_archive(&path)?;
+        std::fs::remove_dir_all(&reindexer_home)?;
+        std::fs::remove_file(&backup)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_file_is_written_where_given() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-file", false)?;
+        let reindexer_home = home.with_extension("reindexer");
+        let central = home.with_extension("central");
+        let path = central.join("archives").join("penumbra-1.sqlite");
+        let args = Archive::try_parse_from([
+            "archive",
+            "--node-home",
+            home.to_str().expect("test path should be valid unicode"),
+            "--home",
+            reindexer_home
+                .to_str()
+                .expect("test path should be valid unicode"),
+            "--archive-file",
+            path.to_str().expect("test path should be valid unicode"),
+        ])?;
+        args.run().await?;
+
+        // The directories leading to the archive were created, and nothing went in the home.
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(5));
+        drop(archive);
+        assert!(!reindexer_home.exists());
+        std::fs::remove_dir_all(&central)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_is_locked_while_running() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-locked", false)?;
+        let path = test_archive_path("locked");
+        remove_archive(&path)?;
+        let cmd = || ParsedCommand::Local {
+            cometbft_dir: home.clone(),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        };
+
+        // Another run holding the lock keeps this one from touching the archive.
+        let held = FileLock::acquire(&path)?;
+        let err = cmd()
+            .run(RunOpts::default())
+            .await
+            .expect_err("a locked archive should fail archival");
+        assert!(
+            format!("{:#}", err).contains(&format!("in use by process {}", std::process::id())),
+            "{:#}",
+            err
+        );
+        assert!(!path.exists());
+
+        // Once that run is over, this one goes ahead, and lets go of the lock itself.
+        drop(held);
+        cmd().run(RunOpts::default()).await?;
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(5));
+        drop(archive);
+        drop(FileLock::acquire(&path)?);
+        remove_archive(&path)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_height_range_is_clamped_to_existing_blocks() -> anyhow::Result<()> {
+        let path = test_archive_path("range-clamped");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            for height in 1..=4 {
+                archive
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+        }
+        // The start is inside what's already archived, so archival resumes after block 4.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let mut archiver = Archiver::new(
+            genesis.clone(),
+            Box::new(TestStore { first: 1, last: 10 }),
+            archive,
+            range_opts(Some(2), Some(8)),
+        );
+        assert_eq!(archiver.bounds().await?, Some((5, 8)));
+        archiver.run().await?;
+        assert_archive_complete(&path, 8).await?;
+
+        // A range that's entirely archived already has nothing left to do.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        Archiver::new(
+            genesis.clone(),
+            Box::new(TestStore { first: 1, last: 10 }),
+            archive,
+            range_opts(Some(2), Some(6)),
+        )
+        .run()
+        .await?;
+        assert_archive_complete(&path, 8).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_resuming_past_archive_end_needs_allow_partial() -> anyhow::Result<()> {
+        let path = test_archive_path("resume-gap");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            for height in 1..=4 {
+                archive
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+        }
+        // Resuming from a store pruned past the end of the archive, or from a later start
+        // height, would leave blocks 5 and 6 out.
+        for (first, opts, expected) in [
+            (7, RunOpts::default(), "the store starts at height 7"),
+            (1, range_opts(Some(7), None), "the start height 7"),
+        ] {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let store = Box::new(TestStore { first, last: 10 });
+            let err = Archiver::new(genesis.clone(), store, archive, opts)
+                .run()
+                .await
+                .expect_err("a gap after the end of the archive should be rejected");
+            let err = err.to_string();
+            assert!(err.contains(expected), "{}", err);
+            assert!(err.contains("leave blocks 5..=6 out"), "{}", err);
+            assert_archive_complete(&path, 4).await?;
+        }
+
+        // Unless leaving the gap is what's wanted.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 7, last: 10 });
+        let opts = RunOpts {
+            allow_partial: true,
+            ..RunOpts::default()
+        };
+        Archiver::new(genesis.clone(), store, archive, opts)
+            .run()
+            .await?;
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(10));
+        assert_eq!(archive.gaps().await?, vec![(5, 6)]);
+        drop(archive);
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_height_range_out_of_store() -> anyhow::Result<()> {
+        let path = test_archive_path("range-out");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        for (start, end, expected) in [
+            (Some(2), None, "before the first block"),
+            (None, Some(11), "after the last block"),
+            (Some(4), Some(12), "after the last block"),
+            (Some(8), Some(6), "after the end height"),
+        ] {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let store = Box::new(TestStore { first: 3, last: 10 });
+            let err = Archiver::new(genesis.clone(), store, archive, range_opts(start, end))
+                .run()
+                .await
+                .expect_err("a range outside of the store should be rejected");
+            assert!(err.to_string().contains(expected), "{:#}", err);
+        }
+        // Nothing should have been archived by any of these.
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, None);
+        assert!(archive.genesis_initial_heights().await?.is_empty());
+        drop(archive);
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_from_empty_store() -> anyhow::Result<()> {
+        let path = test_archive_path("empty-store");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        for (start, end) in [(None, None), (Some(1), None), (None, Some(5))] {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let err = Archiver::new(
+                genesis.clone(),
+                Box::new(EmptyStore),
+                archive,
+                range_opts(start, end),
+            )
+            .run()
+            .await
+            .expect_err("archiving an empty store should fail");
+            assert!(err.to_string().contains("the store is empty"), "{:#}", err);
+        }
+        // Not even the genesis was archived, since there's nothing to go with it.
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, None);
+        assert!(archive.genesis_initial_heights().await?.is_empty());
+        drop(archive);
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_must_start_at_genesis() -> anyhow::Result<()> {
+        let path = test_archive_path("partial");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        // A store with every block from the genesis of the chain on archives as usual.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 1, last: 10 });
+        Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await?;
+        assert_archive_complete(&path, 10).await?;
+        remove_archive(&path)?;
+
+        // One starting later, as after syncing from a snapshot, can't be regenerated in full.
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(TestStore { first: 3, last: 10 });
+        let err = Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await
+            .expect_err("an archive starting above genesis should be rejected");
+        assert_eq!(crate::error::exit_code(&err), 7);
+        assert!(err.to_string().contains("starts at height 3"), "{:#}", err);
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, None);
+        drop(archive);
+
+        // Unless that's what's wanted.
+        for opts in [
+            RunOpts {
+                allow_partial: true,
+                ..RunOpts::default()
+            },
+            range_opts(Some(3), None),
+        ] {
+            remove_archive(&path)?;
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let store = Box::new(TestStore { first: 3, last: 10 });
+            Archiver::new(genesis.clone(), store, archive, opts)
+                .run()
+                .await?;
+            let archive = Storage::new(Some(&path), None).await?;
+            assert_eq!(archive.first_height().await?, Some(3));
+            assert_eq!(archive.last_height().await?, Some(10));
+        }
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_upgrades_within() {
+        // The first upgrade of penumbra-1 started over at height 501975.
+        assert_eq!(upgrades_within("penumbra-1", 501000, 502000), vec![501975]);
+        assert_eq!(
+            upgrades_within("penumbra-1", 501975, 502000),
+            Vec::<u64>::new()
+        );
+        assert_eq!(
+            upgrades_within("penumbra-1", 501000, 501974),
+            Vec::<u64>::new()
+        );
+        // The genesis at the very start isn't an upgrade.
+        assert_eq!(upgrades_within("penumbra-1", 1, 100), Vec::<u64>::new());
+        assert_eq!(
+            upgrades_within("penumbra-testnet-deimos-8", 1, 10_000_000),
+            Vec::<u64>::new()
+        );
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_ignores_blocks_appended_while_running() -> anyhow::Result<()> {
+        for parallelism in [1, 4] {
+            let path = test_archive_path(&format!("live-{}", parallelism));
+            remove_archive(&path)?;
+            let genesis = Genesis::test_value();
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let store = LiveStore::new(1, 10, None);
+            let last = store.last.clone();
+            Archiver::new(
+                genesis.clone(),
+                Box::new(store),
+                archive,
+                RunOpts {
+                    parallelism,
+                    ..Default::default()
+                },
+            )
+            .run()
+            .await?;
+            assert!(last.load(Ordering::SeqCst) > 10);
+            assert_archive_complete(&path, 10).await?;
+            remove_archive(&path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_pruned_behind_while_running() -> anyhow::Result<()> {
+        let path = test_archive_path("pruned-behind");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        // Blocks 1 to 3 are pruned only once they've already been archived.
+        let store = Box::new(LiveStore::new(1, 10, Some((5, 3))));
+        Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await?;
+        assert_archive_complete(&path, 10).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_pruned_ahead_while_running() -> anyhow::Result<()> {
+        let path = test_archive_path("pruned-ahead");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        // Blocks 4 to 6 are pruned before they can be archived.
+        let store = Box::new(LiveStore::new(1, 10, Some((3, 6))));
+        let err = Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await
+            .expect_err("blocks pruned before being archived should fail archival");
+        assert!(
+            format!("{:#}", err).contains("pruned up to height 6"),
+            "{:#}",
+            err
+        );
+        // What was archived before the pruning is kept, and can be resumed from.
+        assert_archive_complete(&path, 3).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_node_home_discovery() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let home = cometbft::test_node_home("archive-discovery", true)?;
+        let node_home = home.to_str().expect("test path should be valid unicode");
+        let cmd = Archive::try_parse_from(["archive", "--node-home", node_home])?;
+        let cometbft_dir = cmd.cometbft_dir()?;
+        assert_eq!(cometbft_dir, home.join("cometbft"));
+        assert_eq!(
+            cmd.chain_id(Some(&cometbft_dir)).as_deref(),
+            Some("penumbra-1")
+        );
+
+        // Explicit flags take precedence over what's found in the node home.
+        let cmd = Archive::try_parse_from([
+            "archive",
+            "--node-home",
+            node_home,
+            "--cometbft-dir",
+            "/elsewhere/cometbft",
+            "--chain-id",
+            "penumbra-testnet-phobos-2",
+        ])?;
+        assert_eq!(cmd.cometbft_dir()?, PathBuf::from("/elsewhere/cometbft"));
+        assert_eq!(
+            cmd.chain_id(Some(&cometbft_dir)).as_deref(),
+            Some("penumbra-testnet-phobos-2")
+        );
+
+        std::fs::remove_dir_all(&home)?;
+        let cmd = Archive::try_parse_from(["archive", "--node-home", node_home])?;
+        assert!(cmd.cometbft_dir().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_stitched_store_sources() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let sources = |args: &[&str]| {
+            Archive::try_parse_from(["archive"].iter().chain(args))?
+                .store_sources(PathBuf::from("/node/cometbft"))
+        };
+        let dir = |x: &str| PathBuf::from(x);
+        let name = |x: &str| Some(x.to_owned());
+        assert_eq!(sources(&[])?, vec![(dir("/node/cometbft"), None)]);
+        assert_eq!(
+            sources(&[
+                "--blockstore-name",
+                "old",
+                "--blockstore-name",
+                "blockstore"
+            ])?,
+            vec![
+                (dir("/node/cometbft"), name("old")),
+                (dir("/node/cometbft"), name("blockstore"))
+            ]
+        );
+        assert_eq!(
+            sources(&["--cometbft-dir", "/a", "--cometbft-dir", "/b"])?,
+            vec![(dir("/a"), None), (dir("/b"), None)]
+        );
+        assert_eq!(
+            sources(&[
+                "--cometbft-dir",
+                "/a",
+                "--cometbft-dir",
+                "/b",
+                "--blockstore-name",
+                "blocks"
+            ])?,
+            vec![(dir("/a"), name("blocks")), (dir("/b"), name("blocks"))]
+        );
+        assert_eq!(
+            sources(&[
+                "--cometbft-dir",
+                "/a",
+                "--blockstore-name",
+                "x",
+                "--cometbft-dir",
+                "/b",
+                "--blockstore-name",
+                "y"
+            ])?,
+            vec![(dir("/a"), name("x")), (dir("/b"), name("y"))]
+        );
+        assert!(sources(&[
+            "--cometbft-dir",
+            "/a",
+            "--cometbft-dir",
+            "/b",
+            "--cometbft-dir",
+            "/c",
+            "--blockstore-name",
+            "x",
+            "--blockstore-name",
+            "y"
+        ])
+        .is_err());
+        Ok(())
+    }
+
+    /// Lay out a cometbft directory with a block store of the test store's blocks between two heights.
+    ///
+    /// Saving a block takes the one after it, for its commit, so `last` must be below the last
+    /// height of the test store.
+    async fn test_partial_store(
+        name: &str,
+        original: &cometbft::LocalStore,
+        first: u64,
+        last: u64,
+    ) -> anyhow::Result<PathBuf> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-{}-{}",
+            name,
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        std::fs::create_dir_all(dir.join("config"))?;
+        std::fs::copy(
+            Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/genesis.json"),
+            dir.join("config/genesis.json"),
+        )?;
+        let mut writer = cometbft::BlockStoreWriter::create(&dir.join("data"), "goleveldb")?;
+        for height in first..=last {
+            let block = original.get_block(height).await?;
+            let next = original.get_block(height + 1).await?;
+            writer.save_block(
+                &block.expect("test store should contain block"),
+                &next.expect("test store should contain block"),
+            )?;
+        }
+        Ok(dir)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_stitches_stores() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("archive-stitched", true)?;
+        let original = cometbft::LocalStore::init(
+            &home.join("cometbft"),
+            LocalStoreGenesisLocation::FromConfig,
+            LocalStoreOpts {
+                read_only: true,
+                ..Default::default()
+            },
+        )?;
+        // An older store, of the blocks before an upgrade, overlapping a newer one at height 3.
+        let older = test_partial_store("archive-stitched-older", &original, 1, 3).await?;
+        let newer = test_partial_store("archive-stitched-newer", &original, 3, 4).await?;
+        let later = test_partial_store("archive-stitched-later", &original, 4, 4).await?;
+        let opts = LocalStoreOpts {
+            read_only: true,
+            ..Default::default()
+        };
+
+        let path = test_archive_path("stitched");
+        remove_archive(&path)?;
+        // The stores are read in order of height, whatever order they're given in.
+        let cmd = ParsedCommand::Stitched {
+            stores: vec![(newer.clone(), opts.clone()), (older.clone(), opts.clone())],
+            destination: Destination::Archive(path.clone()),
+        };
+        cmd.run(RunOpts::default()).await?;
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.first_height().await?, Some(1));
+        assert_eq!(archive.last_height().await?, Some(4));
+        assert_eq!(archive.gaps().await?, Vec::<(u64, u64)>::new());
+        for height in 1..=4 {
+            assert_eq!(
+                archive.get_block(height).await?,
+                original.get_block(height).await?
+            );
+        }
+        assert_eq!(
+            archive.genesis_initial_heights().await?,
+            vec![Genesis::test_value().initial_height()]
+        );
+        drop(archive);
+        remove_archive(&path)?;
+
+        // Leaving height 3 out of every store is a gap, which archives nothing.
+        let gapped = test_partial_store("archive-stitched-gapped", &original, 1, 2).await?;
+        let cmd = ParsedCommand::Stitched {
+            stores: vec![(gapped.clone(), opts.clone()), (later.clone(), opts)],
+            destination: Destination::Archive(path.clone()),
+        };
+        let err = cmd
+            .run(RunOpts::default())
+            .await
+            .expect_err("the stores leave a gap");
+        assert!(
+            format!("{:#}", err).contains("heights 3..=3 are in none of the stores"),
+            "{:#}",
+            err
+        );
+        assert!(!path.exists());
+
+        drop(original);
+        for dir in [home, older, newer, later, gapped] {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_rejects_inconsistent_store() -> anyhow::Result<()> {
+        let path = test_archive_path("inconsistent");
+        remove_archive(&path)?;
+        let cmd = ParsedCommand::Local {
+            cometbft_dir: Path::new(env!("CARGO_MANIFEST_DIR"))
+                .join("test_data/cometbft-truncated"),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                max_block_bytes: None,
+                db_options: Default::default(),
+            },
+        };
+        let err = cmd
+            .run(RunOpts::default())
+            .await
+            .expect_err("a store missing its last block should fail archival");
+        assert!(
+            format!("{:#}", err).contains("no block at that height"),
+            "{:#}",
+            err
+        );
+        // This is caught before anything gets archived.
+        assert!(!path.exists());
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_store_ahead_of_app() -> anyhow::Result<()> {
+        let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("test_data/cometbft-behind");
+        let opts = LocalStoreOpts {
+            read_only: true,
+            db_name: None,
+            max_block_bytes: None,
+            db_options: Default::default(),
+        };
+        let store =
+            cometbft::LocalStore::init(&dir, LocalStoreGenesisLocation::FromConfig, opts.clone())?;
+        assert_eq!(blocks_ahead_of_app(&store).await?, Some((5, 5)));
+        drop(store);
+
+        // The block that was never applied is still archived.
+        let path = test_archive_path("ahead-of-app");
+        remove_archive(&path)?;
+        let cmd = ParsedCommand::Local {
+            cometbft_dir: dir,
+            destination: Destination::Archive(path.clone()),
+            opts,
+        };
+        cmd.run(RunOpts::default()).await?;
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(5));
+        drop(archive);
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_max_block_bytes() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("max-block-bytes", false)?;
+        let path = test_archive_path("max-block-bytes");
+        let cmd = || ParsedCommand::Local {
+            cometbft_dir: home.clone(),
+            destination: Destination::Archive(path.clone()),
+            opts: LocalStoreOpts {
+                read_only: true,
+                db_name: None,
+                // Every block is larger than this.
+                max_block_bytes: Some(1),
+                db_options: Default::default(),
+            },
+        };
+
+        remove_archive(&path)?;
+        let err = cmd()
+            .run(RunOpts::default())
+            .await
+            .expect_err("blocks over the limit should fail archival");
+        assert!(
+            format!("{:#}", err).contains("more than the maximum block size of 1 bytes"),
+            "{:#}",
+            err
+        );
+
+        remove_archive(&path)?;
+        let opts = RunOpts {
+            skip_errors: true,
+            ..RunOpts::default()
+        };
+        cmd().run(opts).await?;
+        let report = std::fs::read_to_string(skip_report_path(&path))?;
+        assert_eq!(report.lines().count(), 5, "{}", report);
+
+        remove_archive(&path)?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_fails_on_corrupt_block() -> anyhow::Result<()> {
+        for parallelism in [1, 4] {
+            let path = test_archive_path("corrupt-fail");
+            remove_archive(&path)?;
+            let genesis = Genesis::test_value();
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let store = Box::new(CorruptStore {
+                inner: TestStore { first: 1, last: 10 },
+                corrupt: 4,
+            });
+            let opts = RunOpts {
+                parallelism,
+                ..RunOpts::default()
+            };
+            let err = Archiver::new(genesis, store, archive, opts)
+                .run()
+                .await
+                .expect_err("a corrupt block should fail archival by default");
+            assert!(
+                format!("{:#}", err).contains("failed to decode block at height 4"),
+                "{:#}",
+                err
+            );
+            if parallelism == 1 {
+                assert_archive_complete(&path, 3).await?;
+            }
+            assert!(!skip_report_path(&path).exists());
+            remove_archive(&path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_extended_commits() -> anyhow::Result<()> {
+        let path = test_archive_path("extended-commits");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(ExtendedCommitStore {
+            inner: TestStore { first: 1, last: 6 },
+            from: 4,
+        });
+        Archiver::new(genesis.clone(), store, archive, RunOpts::default())
+            .run()
+            .await?;
+
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        for height in 1..=3 {
+            assert_eq!(archive.get_extended_commit(height).await?, None);
+        }
+        for height in 4..=6 {
+            assert_eq!(
+                archive.get_extended_commit(height).await?,
+                Some(ExtendedCommitStore::extended_commit(height))
+            );
+        }
+        drop(archive);
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    /// A store whose blocks at some heights carry evidence of misbehavior.
+    struct EvidenceStore {
+        inner: TestStore,
+        evidence_at: Vec<u64>,
+    }
+
+    #[async_trait]
+    impl Store for EvidenceStore {
+        async fn get_genesis(&self) -> anyhow::Result<Genesis> {
+            self.inner.get_genesis().await
+        }
+
+        async fn get_height_bounds(&self) -> anyhow::Result<Option<(u64, u64)>> {
+            self.inner.get_height_bounds().await
+        }
+
+        async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
+            if self.evidence_at.contains(&height) {
+                return Ok(Some(Block::test_value_with_evidence(height)));
+            }
+            self.inner.get_block(height).await
+        }
+    }
+
+    #[test]
+    fn test_blockstore_options_are_parsed() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let cmd = Archive::try_parse_from([
+            "archive",
+            "--blockstore-cache-bytes",
+            "67108864",
+            "--blockstore-disable-compaction",
+            "--blockstore-compression",
+            "none",
+            "--strict-backend",
+        ])?;
+        assert_eq!(
+            cmd.db_options(),
+            DbOptions {
+                block_cache_bytes: Some(64 << 20),
+                disable_compaction: true,
+                compression: Some("none".to_owned()),
+                strict_backend: true,
+            }
+        );
+        assert_eq!(
+            Archive::try_parse_from(["archive"])?.db_options(),
+            DbOptions::default()
+        );
+
+        // Compression only applies to writes, and an RPC has no database to tune.
+        for args in [
+            &[
+                "archive",
+                "--read-only",
+                "--blockstore-compression",
+                "snappy",
+            ][..],
+            &[
+                "archive",
+                "--rpc-url",
+                "http://localhost:26657",
+                "--blockstore-cache-bytes",
+                "1",
+            ],
+            &["archive", "--blockstore-compression", "zstd"],
+        ] {
+            assert!(Archive::try_parse_from(args).is_err(), "{:?}", args);
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_with_evidence() -> anyhow::Result<()> {
+        let genesis = Genesis::test_value();
+        let expected = Block::test_value_with_evidence(3).encode();
+        let expected = block_evidence(&expected).expect("test block should have evidence");
+        for with_evidence in [true, false] {
+            let path = test_archive_path(&format!("evidence-{}", with_evidence));
+            remove_archive(&path)?;
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let store = Box::new(EvidenceStore {
+                inner: TestStore { first: 1, last: 6 },
+                evidence_at: vec![3, 5],
+            });
+            let opts = RunOpts {
+                with_evidence,
+                ..RunOpts::default()
+            };
+            Archiver::new(genesis.clone(), store, archive, opts)
+                .run()
+                .await?;
+
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            for height in 1..=6 {
+                let evidence = archive.get_evidence(height).await?;
+                if with_evidence && [3, 5].contains(&height) {
+                    assert_eq!(evidence.as_deref(), Some(expected), "height {}", height);
+                } else {
+                    assert_eq!(evidence, None, "height {}", height);
+                }
+                // The blocks carry their evidence either way.
+                let block = archive
+                    .get_block(height)
+                    .await?
+                    .expect("block should exist");
+                assert_eq!(
+                    block_evidence(&block.encode()).is_some(),
+                    [3, 5].contains(&height)
+                );
+            }
+            drop(archive);
+            remove_archive(&path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_skips_corrupt_block() -> anyhow::Result<()> {
+        let path = test_archive_path("corrupt-skip");
+        remove_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let store = Box::new(CorruptStore {
+            inner: TestStore { first: 1, last: 10 },
+            corrupt: 4,
+        });
+        let opts = RunOpts {
+            // Skipping reads one block at a time anyways.
+            parallelism: 4,
+            ..RunOpts::default()
+        };
+        let mut archiver = Archiver::new(genesis.clone(), store, archive, opts);
+        archiver.skip_report = Some(skip_report_path(&path));
+        let summary = archiver.run().await?;
+        assert_eq!(summary.skipped, vec![4]);
+        assert_eq!(summary.processed(), 10);
+
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        assert_eq!(archive.first_height().await?, Some(1));
+        assert_eq!(archive.last_height().await?, Some(10));
+        assert_eq!(archive.gaps().await?, vec![(4, 4)]);
+        drop(archive);
+
+        let report = std::fs::read_to_string(skip_report_path(&path))?;
+        let lines = report
+            .lines()
+            .map(serde_json::from_str)
+            .collect::<Result<Vec<serde_json::Value>, _>>()?;
+        assert_eq!(lines.len(), 1, "{}", report);
+        assert_eq!(lines[0]["height"], 4);
+        assert!(
+            lines[0]["error"]
+                .as_str()
+                .is_some_and(|x| x.contains("failed to decode block at height 4")),
+            "{}",
+            report
+        );
+        remove_archive(&path)?;
+        assert!(!skip_report_path(&path).exists());
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_skipped_blocks_are_retried() -> anyhow::Result<()> {
+        async fn run(
+            path: &Path,
+            store: Box<dyn Store>,
+            skip_errors: bool,
+        ) -> anyhow::Result<ArchiveSummary> {
+            let genesis = Genesis::test_value();
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            let mut archiver = Archiver::new(genesis, store, archive, RunOpts::default());
+            archiver.retry_report = Some(skip_report_path(path));
+            if skip_errors {
+                archiver.skip_report = Some(skip_report_path(path));
+            }
+            archiver.run().await
+        }
+        fn reported(path: &Path) -> anyhow::Result<Vec<u64>> {
+            let report = std::fs::read_to_string(skip_report_path(path))?;
+            report
+                .lines()
+                .map(|x| {
+                    let line: serde_json::Value = serde_json::from_str(x)?;
+                    line["height"]
+                        .as_u64()
+                        .ok_or(anyhow!("no height in '{}'", x))
+                })
+                .collect()
+        }
+        let path = test_archive_path("skipped-retry");
+        remove_archive(&path)?;
+        let corrupt = |last| {
+            Box::new(CorruptStore {
+                inner: TestStore { first: 1, last },
+                corrupt: 4,
+            })
+        };
+
+        let summary = run(&path, corrupt(10), true).await?;
+        assert_eq!(summary.skipped, vec![4]);
+        assert_eq!(reported(&path)?, vec![4]);
+
+        // A block which still can't be read stays skipped, even without --skip-errors,
+        // and the blocks after the archive are archived as ever.
+        let summary = run(&path, corrupt(12), false).await?;
+        assert_eq!(summary.range, Some((11, 12)));
+        assert_eq!(summary.skipped, vec![4]);
+        assert_eq!(summary.retried, Vec::<u64>::new());
+        assert_eq!(summary.blocks, 2);
+        assert_eq!(reported(&path)?, vec![4]);
+
+        // Once it can be read, it fills the gap, and leaves the report.
+        let summary = run(&path, Box::new(TestStore { first: 1, last: 12 }), false).await?;
+        assert_eq!(summary.range, None);
+        assert_eq!(summary.skipped, Vec::<u64>::new());
+        assert_eq!(summary.retried, vec![4]);
+        assert_eq!(summary.blocks, 1);
+        assert!(
+            summary.to_text().contains("retried:      1: 4\n"),
+            "{}",
+            summary.to_text()
+        );
+        assert_eq!(summary.to_json()["retried"], serde_json::json!([4]));
+        assert!(!skip_report_path(&path).exists());
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        assert_eq!(archive.gaps().await?, Vec::<(u64, u64)>::new());
+        assert_eq!(
+            archive.get_block(4).await?,
+            Some(Block::test_value_at_height(4))
+        );
+        drop(archive);
+        assert_archive_complete(&path, 12).await?;
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_verifies_hashes() -> anyhow::Result<()> {
+        let path = test_archive_path("verify-hashes");
+        let genesis = Genesis::test_value();
+        let tampered_store = || {
+            Box::new(TamperedStore {
+                inner: TestStore { first: 1, last: 10 },
+                tampered: 4,
+                wrong_id: 7,
+            })
+        };
+
+        // Tampered blocks still decode, so nothing notices them without checking.
+        remove_archive(&path)?;
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        Archiver::new(
+            genesis.clone(),
+            tampered_store(),
+            archive,
+            RunOpts::default(),
+        )
+        .run()
+        .await?;
+        assert_archive_complete(&path, 10).await?;
+
+        remove_archive(&path)?;
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let opts = RunOpts {
+            verify_hashes: true,
+            ..RunOpts::default()
+        };
+        let err = Archiver::new(genesis.clone(), tampered_store(), archive, opts.clone())
+            .run()
+            .await
+            .expect_err("a tampered block should fail archival");
+        let message = format!("{:#}", err);
+        assert!(
+            message.contains("block at height 4 is corrupt")
+                && message.contains("hash mismatch at height 4: the header has data hash"),
+            "{}",
+            message
+        );
+        assert_archive_complete(&path, 3).await?;
+
+        // Skipping them archives everything else, reporting the height of each one skipped.
+        remove_archive(&path)?;
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        let mut archiver = Archiver::new(genesis.clone(), tampered_store(), archive, opts);
+        archiver.skip_report = Some(skip_report_path(&path));
+        let summary = archiver.run().await?;
+        assert_eq!(summary.skipped, vec![4, 7]);
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        assert_eq!(archive.gaps().await?, vec![(4, 4), (7, 7)]);
+        drop(archive);
+        let report = std::fs::read_to_string(skip_report_path(&path))?;
+        let lines = report
+            .lines()
+            .map(serde_json::from_str)
+            .collect::<Result<Vec<serde_json::Value>, _>>()?;
+        assert_eq!(lines.len(), 2, "{}", report);
+        assert_eq!(lines[1]["height"], 7);
+        assert!(
+            lines[1]["error"]
+                .as_str()
+                .is_some_and(|x| x.contains("hash mismatch at height 7: the block ID is")),
+            "{}",
+            report
+        );
+        remove_archive(&path)?;
+        Ok(())
+    }
+
+    /// Read back the blocks in a stream, in the order they were written.
+    fn read_stream(format: StreamFormat, data: &[u8]) -> anyhow::Result<Vec<Block>> {
+        match format {
+            StreamFormat::Proto => {
+                let mut rest = data;
+                let mut out = Vec::new();
+                while !rest.is_empty() {
+                    let len = prost::encoding::decode_varint(&mut rest)? as usize;
+                    anyhow::ensure!(
+                        len <= rest.len(),
+                        "the stream ends in the middle of a block"
+                    );
+                    let (block, tail) = rest.split_at(len);
+                    out.push(Block::decode(block)?);
+                    rest = tail;
+                }
+                Ok(out)
+            }
+            StreamFormat::Json => std::str::from_utf8(data)?
+                .lines()
+                .map(|line| Block::from_value(serde_json::from_str(line)?))
+                .collect(),
+        }
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_stream_decodes_into_original_blocks() -> anyhow::Result<()> {
+        for (name, format) in [("proto", StreamFormat::Proto), ("json", StreamFormat::Json)] {
+            let path = std::env::temp_dir().join(format!(
+                "penumbra-reindexer-test-stream-{}-{}",
+                name,
+                std::process::id()
+            ));
+            let writer = BlockWriter::create(format, Some(&path))?;
+            let store = Box::new(TestStore { first: 3, last: 12 });
+            let summary = Archiver::new(
+                Genesis::test_value(),
+                store,
+                writer,
+                RunOpts {
+                    parallelism: 2,
+                    ..RunOpts::default()
+                },
+            )
+            .run()
+            .await?;
+            assert_eq!(summary.blocks, 10);
+
+            let blocks = read_stream(format, &std::fs::read(&path)?)?;
+            // Archival leaves an index next to the stream, which reads can use as it is.
+            let index = std::fs::read(index_path(&path))?;
+            let mut reader = StreamReader::open(&path)?;
+            assert_eq!(reader.get_encoded_block(7)?, Some(blocks[4].encode()));
+            drop(reader);
+            assert_eq!(std::fs::read(index_path(&path))?, index);
+            std::fs::remove_file(index_path(&path))?;
+            std::fs::remove_file(&path)?;
+            assert_eq!(
+                blocks,
+                (3..=12)
+                    .map(Block::test_value_at_height)
+                    .collect::<Vec<_>>(),
+                "{}",
+                name
+            );
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_stream_starts_over_each_run() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-stream-rerun-{}",
+            std::process::id()
+        ));
+        for last in [8, 5] {
+            let writer = BlockWriter::create(StreamFormat::Proto, Some(&path))?;
+            let store = Box::new(TestStore { first: 1, last });
+            Archiver::new(Genesis::test_value(), store, writer, RunOpts::default())
+                .run()
+                .await?;
+        }
+        let blocks = read_stream(StreamFormat::Proto, &std::fs::read(&path)?)?;
+        std::fs::remove_file(index_path(&path))?;
+        std::fs::remove_file(&path)?;
+        assert_eq!(
+            blocks.iter().map(|x| x.height()).collect::<Vec<_>>(),
+            (1..=5).collect::<Vec<_>>()
+        );
         Ok(())
     }
 }
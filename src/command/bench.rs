@@ -0,0 +1,494 @@
+use clap::{Args, Parser, Subcommand};
+use serde_json::{json, Value};
+use std::hash::{BuildHasher as _, Hasher as _};
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+use crate::cometbft::{self, DbOptions, EncodedBlockReader, LocalStoreOpts};
+use crate::files::default_penumbra_home;
+
+use super::verify::SplitMix64;
+
+/// Measure how fast things can be read, for comparing backends and tuning.
+#[derive(Parser)]
+pub struct Bench {
+    #[command(subcommand)]
+    command: BenchCommands,
+}
+
+#[derive(Subcommand)]
+enum BenchCommands {
+    /// Measure how fast blocks are read from the block store of a node.
+    Read(ReadCmd),
+    /// Measure how many bytes reading blocks compressed saves, and what decompressing them costs.
+    Compression(CompressionCmd),
+}
+
+/// Measure how fast blocks are read from the block store of a node.
+///
+/// This reads --count blocks at random heights, each read on its own, then the first --count
+/// blocks in order, as archival reads them, and reports, for each, the blocks and bytes read
+/// per second, and the median and 99th percentile time it took to read a block.
+/// Blocks are read as the store encodes them, without decoding, so only the store is measured.
+///
+/// Run this against copies of the same store kept with different backends, or tuned differently,
+/// to decide between them. The random reads come first, so that they aren't served from what
+/// the sequential ones left in caches, but reading the same store again is faster either way.
+#[derive(Args)]
+#[command(group(clap::ArgGroup::new("node").args(["node_home", "cometbft_dir"])))]
+struct ReadCmd {
+    /// The home directory of the node to read from, its cometbft home, or a `pd` home.
+    ///
+    /// Defaults to `~/.penumbra/network_data/node0`.
+    #[clap(long)]
+    node_home: Option<PathBuf>,
+
+    /// The cometbft home directory of the node to read from.
+    #[clap(long)]
+    cometbft_dir: Option<PathBuf>,
+
+    /// The name of the database holding the block store of the node, if not `blockstore`.
+    #[clap(long)]
+    blockstore_name: Option<String>,
+
+    /// How many bytes of blocks the goleveldb backend caches in memory, if not its default.
+    #[clap(long)]
+    blockstore_cache_bytes: Option<u64>,
+
+    /// How many blocks to read, both at random, and in order.
+    #[clap(long, default_value_t = 1000, value_parser = clap::value_parser!(u64).range(1..))]
+    count: u64,
+
+    /// The seed for choosing the random heights, to read the same ones against another store.
+    ///
+    /// Defaults to a different one each run, which gets printed.
+    #[clap(long)]
+    seed: Option<u64>,
+
+    /// Print the results as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+/// Measure how many bytes reading blocks compressed saves, and what decompressing them costs.
+///
+/// This reads the first --count blocks in order, both as the store encodes them, and as the Go
+/// side compresses them, which is what crosses into Rust, then decompresses each, checking that
+/// it's the same block. It reports the bytes of each, the bytes saved, and the time spent
+/// decompressing, to decide whether reading blocks compressed is worth it for a store.
+#[derive(Args)]
+#[command(group(clap::ArgGroup::new("node").args(["node_home", "cometbft_dir"])))]
+struct CompressionCmd {
+    /// The home directory of the node to read from, its cometbft home, or a `pd` home.
+    ///
+    /// Defaults to `~/.penumbra/network_data/node0`.
+    #[clap(long)]
+    node_home: Option<PathBuf>,
+
+    /// The cometbft home directory of the node to read from.
+    #[clap(long)]
+    cometbft_dir: Option<PathBuf>,
+
+    /// The name of the database holding the block store of the node, if not `blockstore`.
+    #[clap(long)]
+    blockstore_name: Option<String>,
+
+    /// How many blocks to read, from the first one.
+    #[clap(long, default_value_t = 1000, value_parser = clap::value_parser!(u64).range(1..))]
+    count: u64,
+
+    /// Print the results as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+/// Measurements of reading a series of blocks compressed.
+#[derive(Debug, Default, PartialEq)]
+struct CompressionStats {
+    blocks: u64,
+    /// The bytes of the blocks, as the store encodes them.
+    bytes: u64,
+    /// The bytes of the blocks, as compressed by the Go side.
+    compressed_bytes: u64,
+    /// How long decompressing every block took, in total.
+    decompression: Duration,
+}
+
+impl CompressionStats {
+    /// Read the block at each height, plainly and compressed, checking that they match.
+    fn measure(
+        store: &mut EncodedBlockReader,
+        heights: impl IntoIterator<Item = u64>,
+    ) -> anyhow::Result<Self> {
+        let mut out = Self::default();
+        for height in heights {
+            let (Some(block), Some(compressed)) = (
+                store.encoded_block(height)?,
+                store.compressed_block(height)?,
+            ) else {
+                continue;
+            };
+            let start = Instant::now();
+            let decompressed = EncodedBlockReader::decompress(&compressed)?;
+            out.decompression += start.elapsed();
+            anyhow::ensure!(
+                decompressed == block,
+                "the block at height {} doesn't decompress to its encoding",
+                height
+            );
+            out.blocks += 1;
+            out.bytes += block.len() as u64;
+            out.compressed_bytes += compressed.len() as u64;
+        }
+        Ok(out)
+    }
+
+    fn saved_bytes(&self) -> u64 {
+        self.bytes - self.compressed_bytes
+    }
+
+    /// The fraction of the bytes of the blocks that compression saves.
+    fn saved_fraction(&self) -> f64 {
+        if self.bytes > 0 {
+            self.saved_bytes() as f64 / self.bytes as f64
+        } else {
+            0.0
+        }
+    }
+
+    fn to_json(&self) -> Value {
+        json!({
+            "blocks": self.blocks,
+            "bytes": self.bytes,
+            "compressed_bytes": self.compressed_bytes,
+            "saved_bytes": self.saved_bytes(),
+            "saved_fraction": self.saved_fraction(),
+            "decompression_secs": self.decompression.as_secs_f64(),
+        })
+    }
+
+    fn to_text(&self) -> String {
+        format!(
+            "{} blocks, {} bytes, {} bytes compressed
+  saved:        {} bytes, {:.1}%
+  decompressed: in {:.3}s
+",
+            self.blocks,
+            self.bytes,
+            self.compressed_bytes,
+            self.saved_bytes(),
+            100.0 * self.saved_fraction(),
+            self.decompression.as_secs_f64(),
+        )
+    }
+}
+
+/// Measurements of reading a series of blocks.
+#[derive(Debug, Default)]
+struct ReadStats {
+    /// How long each block present took to read.
+    latencies: Vec<Duration>,
+    bytes: u64,
+    /// The heights read which had no block, and aren't in the other measurements.
+    missing: u64,
+    /// How long reading the whole series took.
+    duration: Duration,
+}
+
+impl ReadStats {
+    /// Read the block at each height, one after the other, timing each read.
+    fn measure(
+        store: &mut EncodedBlockReader,
+        heights: impl IntoIterator<Item = u64>,
+    ) -> anyhow::Result<Self> {
+        let mut out = Self::default();
+        let start = Instant::now();
+        for height in heights {
+            let read_start = Instant::now();
+            let block = store.encoded_block(height)?;
+            let latency = read_start.elapsed();
+            match block {
+                Some(data) => {
+                    out.latencies.push(latency);
+                    out.bytes += data.len() as u64;
+                }
+                None => out.missing += 1,
+            }
+        }
+        out.duration = start.elapsed();
+        out.latencies.sort_unstable();
+        Ok(out)
+    }
+
+    fn blocks(&self) -> u64 {
+        self.latencies.len() as u64
+    }
+
+    fn per_second(&self, amount: u64) -> f64 {
+        let secs = self.duration.as_secs_f64();
+        if secs > 0.0 {
+            amount as f64 / secs
+        } else {
+            0.0
+        }
+    }
+
+    /// The time within which the given fraction of reads finished, by nearest rank.
+    fn percentile(&self, fraction: f64) -> Duration {
+        let rank = (fraction * self.latencies.len() as f64).ceil() as usize;
+        self.latencies
+            .get(rank.saturating_sub(1))
+            .copied()
+            .unwrap_or_default()
+    }
+
+    fn to_json(&self) -> Value {
+        json!({
+            "blocks": self.blocks(),
+            "bytes": self.bytes,
+            "missing": self.missing,
+            "duration_secs": self.duration.as_secs_f64(),
+            "blocks_per_second": self.per_second(self.blocks()),
+            "bytes_per_second": self.per_second(self.bytes),
+            "p50_micros": self.percentile(0.5).as_micros() as u64,
+            "p99_micros": self.percentile(0.99).as_micros() as u64,
+        })
+    }
+
+    fn to_text(&self, name: &str) -> String {
+        let mut out = format!(
+            "{} reads: {} blocks, {} bytes, in {:.3}s
+  throughput:   {:.1} blocks/s, {:.0} bytes/s
+  latency:      p50 {}us, p99 {}us
+",
+            name,
+            self.blocks(),
+            self.bytes,
+            self.duration.as_secs_f64(),
+            self.per_second(self.blocks()),
+            self.per_second(self.bytes),
+            self.percentile(0.5).as_micros(),
+            self.percentile(0.99).as_micros(),
+        );
+        if self.missing > 0 {
+            out.push_str(&format!("  missing:      {} heights\n", self.missing));
+        }
+        out
+    }
+}
+
+impl Bench {
+    pub async fn run(self) -> anyhow::Result<()> {
+        match self.command {
+            BenchCommands::Read(cmd) => cmd.run(),
+            BenchCommands::Compression(cmd) => cmd.run(),
+        }
+    }
+}
+
+impl ReadCmd {
+    fn cometbft_dir(&self) -> anyhow::Result<PathBuf> {
+        let out = match (self.node_home.as_ref(), self.cometbft_dir.as_ref()) {
+            (_, Some(x)) => x.to_owned(),
+            (Some(x), None) => cometbft::find_cometbft_dir(x)?,
+            (None, None) => cometbft::find_cometbft_dir(&default_penumbra_home()?)?,
+        };
+        Ok(out)
+    }
+
+    fn run(self) -> anyhow::Result<()> {
+        let dir = self.cometbft_dir()?;
+        let opts = LocalStoreOpts {
+            read_only: true,
+            db_name: self.blockstore_name.clone(),
+            db_options: DbOptions {
+                block_cache_bytes: self.blockstore_cache_bytes,
+                ..Default::default()
+            },
+            ..Default::default()
+        };
+        let mut store = EncodedBlockReader::open(&dir, &opts)?;
+        let backend = store.backend()?;
+        let (first, last) = store
+            .height_bounds()?
+            .ok_or(anyhow::anyhow!("the block store has no blocks to read"))?;
+        let seed = self.seed.unwrap_or_else(|| {
+            std::collections::hash_map::RandomState::new()
+                .build_hasher()
+                .finish()
+        });
+        let span = last - first + 1;
+        let mut rng = SplitMix64(seed);
+        let random = ReadStats::measure(
+            &mut store,
+            (0..self.count).map(|_| first + rng.next() % span),
+        )?;
+        let sequential = ReadStats::measure(
+            &mut store,
+            first..=last.min(first.saturating_add(self.count - 1)),
+        )?;
+        if self.json {
+            let json = json!({
+                "cometbft_dir": dir.display().to_string(),
+                "backend": backend,
+                "first_height": first,
+                "last_height": last,
+                "seed": seed,
+                "random": random.to_json(),
+                "sequential": sequential.to_json(),
+            });
+            println!("{}", serde_json::to_string_pretty(&json)?);
+        } else {
+            print!(
+                "block store in '{}', with {}, heights {}..={}, random heights from seed {}:\n{}{}",
+                dir.display(),
+                backend,
+                first,
+                last,
+                seed,
+                random.to_text("random"),
+                sequential.to_text("sequential")
+            );
+        }
+        Ok(())
+    }
+}
+
+impl CompressionCmd {
+    fn run(self) -> anyhow::Result<()> {
+        let dir = match (self.node_home.as_ref(), self.cometbft_dir.as_ref()) {
+            (_, Some(x)) => x.to_owned(),
+            (Some(x), None) => cometbft::find_cometbft_dir(x)?,
+            (None, None) => cometbft::find_cometbft_dir(&default_penumbra_home()?)?,
+        };
+        let opts = LocalStoreOpts {
+            read_only: true,
+            db_name: self.blockstore_name.clone(),
+            ..Default::default()
+        };
+        let mut store = EncodedBlockReader::open(&dir, &opts)?;
+        let (first, last) = store
+            .height_bounds()?
+            .ok_or(anyhow::anyhow!("the block store has no blocks to read"))?;
+        let last = last.min(first.saturating_add(self.count - 1));
+        let stats = CompressionStats::measure(&mut store, first..=last)?;
+        if self.json {
+            let json = json!({
+                "cometbft_dir": dir.display().to_string(),
+                "first_height": first,
+                "last_height": last,
+                "compression": stats.to_json(),
+            });
+            println!("{}", serde_json::to_string_pretty(&json)?);
+        } else {
+            print!(
+                "block store in '{}', heights {}..={}:\n{}",
+                dir.display(),
+                first,
+                last,
+                stats.to_text()
+            );
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn test_percentiles() {
+        let stats = ReadStats {
+            latencies: (1..=100).map(Duration::from_micros).collect(),
+            ..Default::default()
+        };
+        assert_eq!(stats.percentile(0.5), Duration::from_micros(50));
+        assert_eq!(stats.percentile(0.99), Duration::from_micros(99));
+        assert_eq!(ReadStats::default().percentile(0.5), Duration::ZERO);
+    }
+
+    #[test]
+    fn test_bench_reads_block_store() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("bench-read", true)?;
+        let opts = LocalStoreOpts {
+            read_only: true,
+            ..Default::default()
+        };
+        let mut store = EncodedBlockReader::open(&home.join("cometbft"), &opts)?;
+        assert_eq!(store.height_bounds()?, Some((1, 5)));
+        let mut rng = SplitMix64(7);
+        let random = ReadStats::measure(&mut store, (0..20).map(|_| 1 + rng.next() % 5))?;
+        assert_eq!(random.blocks(), 20);
+        assert_eq!(random.missing, 0);
+        // Only the first 5 blocks exist to be read in order.
+        let sequential = ReadStats::measure(&mut store, 1..=5)?;
+        assert_eq!(sequential.blocks(), 5);
+        for stats in [&random, &sequential] {
+            assert!(stats.bytes > 0);
+            assert!(stats.percentile(0.5) <= stats.percentile(0.99));
+            assert!(stats.percentile(0.99) <= stats.duration);
+            let json = stats.to_json();
+            assert!(json["blocks_per_second"].as_f64() > Some(0.0), "{}", json);
+            assert!(json["bytes_per_second"].as_f64() > Some(0.0), "{}", json);
+        }
+        // Heights past the store are counted apart from the blocks read.
+        let past = ReadStats::measure(&mut store, 5..=7)?;
+        assert_eq!((past.blocks(), past.missing), (1, 2));
+        assert!(past.to_text("past").contains("missing:      2 heights\n"));
+        drop(store);
+
+        let node_home = home.to_str().expect("test path should be valid UTF-8");
+        let cmd =
+            Bench::try_parse_from(["bench", "read", "--node-home", node_home, "--count", "3"])?;
+        let BenchCommands::Read(read) = cmd.command else {
+            panic!("expected the read benchmark");
+        };
+        assert_eq!(read.count, 3);
+        read.run()?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_bench_measures_compression() -> anyhow::Result<()> {
+        let home = cometbft::test_node_home("bench-compression", true)?;
+        let opts = LocalStoreOpts {
+            read_only: true,
+            ..Default::default()
+        };
+        let mut store = EncodedBlockReader::open(&home.join("cometbft"), &opts)?;
+        let stats = CompressionStats::measure(&mut store, 1..=7)?;
+        // Heights past the store are skipped, and compression never makes a block larger.
+        assert_eq!(stats.blocks, 5);
+        let plain: u64 = (1..=5)
+            .map(|height| Ok(store.encoded_block(height)?.map_or(0, |x| x.len() as u64)))
+            .sum::<anyhow::Result<u64>>()?;
+        assert_eq!(stats.bytes, plain);
+        assert!(stats.compressed_bytes <= stats.bytes);
+        assert_eq!(stats.saved_bytes(), stats.bytes - stats.compressed_bytes);
+        let json = stats.to_json();
+        assert_eq!(json["saved_bytes"].as_u64(), Some(stats.saved_bytes()));
+        assert!(stats.to_text().starts_with("5 blocks, "));
+        assert_eq!(CompressionStats::default().saved_fraction(), 0.0);
+        drop(store);
+
+        let node_home = home.to_str().expect("test path should be valid UTF-8");
+        let cmd = Bench::try_parse_from([
+            "bench",
+            "compression",
+            "--node-home",
+            node_home,
+            "--count",
+            "3",
+            "--json",
+        ])?;
+        let BenchCommands::Compression(compression) = cmd.command else {
+            panic!("expected the compression benchmark");
+        };
+        assert_eq!(compression.count, 3);
+        compression.run()?;
+        std::fs::remove_dir_all(&home)?;
+        Ok(())
+    }
+}
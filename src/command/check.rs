@@ -1,6 +1,7 @@
 use std::path::PathBuf;
 
 use crate::check;
+use crate::error::{ErrorKind, Failure};
 use crate::files::archive_filepath_from_opts;
 
 #[derive(clap::Parser)]
@@ -52,7 +53,7 @@ impl Check {
         if !archive_file.exists() {
             let msg = "archive file does not exist; specify one with `--archive-file`, or run `penumbra-reindexer bootstrap`";
             tracing::error!(archive_file = archive_file.display().to_string(), msg);
-            anyhow::bail!(msg);
+            anyhow::bail!(Failure::new(ErrorKind::MissingArchive, msg));
         }
 
         tracing::info!(
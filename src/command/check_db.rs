@@ -0,0 +1,120 @@
+use serde_json::{json, Value};
+
+use crate::indexer::{check_database, SchemaCheck};
+
+#[derive(clap::Parser)]
+/// Check that a database has the tables and indexes `regen` indexes into, without changing it.
+///
+/// Rows are inserted into the tables by position, so a table that was altered by hand, or
+/// created by another version of the reindexer, can take the wrong values, or none at all.
+/// This compares every table, column, index, and view with what the reindexer expects,
+/// and reports on each of them.
+pub struct CheckDb {
+    /// The URL of the database to check.
+    #[clap(long)]
+    database_url: String,
+
+    /// Print the results as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+fn checks_json(checks: &[SchemaCheck]) -> Value {
+    json!({
+        "valid": checks.iter().all(|x| x.problems.is_empty()),
+        "empty": checks.iter().all(|x| !x.exists),
+        "objects": checks
+            .iter()
+            .map(|x| json!({
+                "name": x.name,
+                "exists": x.exists,
+                "problems": x.problems,
+            }))
+            .collect::<Vec<_>>(),
+    })
+}
+
+fn checks_text(checks: &[SchemaCheck]) -> String {
+    let mut out = "schema of the database:\n".to_owned();
+    for check in checks {
+        let status = match check.problems.is_empty() {
+            true => "ok".to_owned(),
+            false => check.problems.join("; "),
+        };
+        out.push_str(&format!("  {}: {}\n", check.name, status));
+    }
+    out
+}
+
+impl CheckDb {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let checks = check_database(&self.database_url).await?;
+        if self.json {
+            println!("{}", serde_json::to_string_pretty(&checks_json(&checks))?);
+        } else {
+            print!("{}", checks_text(&checks));
+        }
+        // A database without any of the tables is fine, since regen creates them.
+        if checks.iter().all(|x| !x.exists) {
+            if !self.json {
+                println!("the database has none of the tables yet, which regen will create");
+            }
+            return Ok(());
+        }
+        let bad: Vec<&str> = checks
+            .iter()
+            .filter(|x| !x.problems.is_empty())
+            .map(|x| x.name.as_str())
+            .collect();
+        if !bad.is_empty() {
+            anyhow::bail!(
+                "the database doesn't match the schema the reindexer expects, in {}",
+                bad.join(", ")
+            );
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn test_checks_are_reported_by_name() {
+        let checks = vec![
+            SchemaCheck {
+                name: "blocks".to_owned(),
+                exists: true,
+                problems: vec![],
+            },
+            SchemaCheck {
+                name: "tx_results".to_owned(),
+                exists: true,
+                problems: vec![
+                    "column 'tx_hash' is text, rather than character varying".to_owned(),
+                    "missing unique index on (block_id, index)".to_owned(),
+                ],
+            },
+            SchemaCheck {
+                name: "debug.app_hash".to_owned(),
+                exists: false,
+                problems: vec!["missing".to_owned()],
+            },
+        ];
+        let json = checks_json(&checks);
+        assert_eq!(json["valid"], false);
+        assert_eq!(json["empty"], false);
+        assert_eq!(json["objects"][0]["problems"], json!([]));
+        assert_eq!(json["objects"][2]["exists"], false);
+
+        assert_eq!(
+            checks_text(&checks),
+            "schema of the database:
+  blocks: ok
+  tx_results: column 'tx_hash' is text, rather than character varying; missing unique index on (block_id, index)
+  debug.app_hash: missing
+"
+        );
+    }
+}
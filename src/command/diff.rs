@@ -0,0 +1,354 @@
+use serde_json::{json, Value};
+use std::path::{Path, PathBuf};
+use tokio_stream::StreamExt as _;
+
+use crate::cometbft::Block;
+use crate::error::{ErrorKind, Failure};
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+/// Compare two archives, finding the first height where their blocks differ.
+///
+/// This walks both archives in height order. Blocks are compared by hash first, and then
+/// field by field, to say what about them differs. Heights which only one of the archives
+/// has are reported too.
+pub struct Diff {
+    /// The first archive to compare.
+    #[clap(long)]
+    left: PathBuf,
+
+    /// The second archive to compare.
+    #[clap(long)]
+    right: PathBuf,
+
+    /// Print the differences as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+/// The first height where two archives have different blocks.
+#[derive(Debug, PartialEq)]
+struct Divergence {
+    height: u64,
+    /// The hashes of the two blocks, in hex, if both of them decode.
+    hashes: Option<(String, String)>,
+    /// What differs about the two blocks.
+    fields: Vec<String>,
+}
+
+/// What we report about the differences between two archives.
+#[derive(Debug, Default, PartialEq)]
+struct ArchiveDiff {
+    chain_ids: (String, String),
+    /// The lowest and highest blocks of each archive, if they have any.
+    heights: (Option<(u64, u64)>, Option<(u64, u64)>),
+    /// The inclusive ranges of heights only the left archive has blocks at.
+    only_left: Vec<(u64, u64)>,
+    /// The inclusive ranges of heights only the right archive has blocks at.
+    only_right: Vec<(u64, u64)>,
+    /// How many heights both archives have, but differ at.
+    differing: u64,
+    first_divergence: Option<Divergence>,
+}
+
+/// Add a height to a list of inclusive ranges, with heights added in ascending order.
+fn push_height(ranges: &mut Vec<(u64, u64)>, height: u64) {
+    match ranges.last_mut() {
+        Some((_, end)) if *end + 1 == height => *end = height,
+        _ => ranges.push((height, height)),
+    }
+}
+
+/// Compare the data of two blocks at the same height, returning how they differ, if they do.
+///
+/// Blocks with different encodings, but the same hash and fields, are considered the same.
+fn compare_blocks(height: u64, left: &[u8], right: &[u8]) -> anyhow::Result<Option<Divergence>> {
+    if left == right {
+        return Ok(None);
+    }
+    let (left, right) = match (Block::decode(left), Block::decode(right)) {
+        (Ok(left), Ok(right)) => (left, right),
+        (left, right) => {
+            let side = match (left.is_err(), right.is_err()) {
+                (true, true) => "both archives",
+                (true, false) => "the left archive",
+                _ => "the right archive",
+            };
+            return Ok(Some(Divergence {
+                height,
+                hashes: None,
+                fields: vec![format!("the block fails to decode in {}", side)],
+            }));
+        }
+    };
+    let hashes = (hex::encode(left.hash()?), hex::encode(right.hash()?));
+    let fields = left.differing_fields(&right);
+    if hashes.0 == hashes.1 && fields.is_empty() {
+        return Ok(None);
+    }
+    Ok(Some(Divergence {
+        height,
+        hashes: Some(hashes),
+        fields: fields.into_iter().map(|x| x.to_owned()).collect(),
+    }))
+}
+
+impl ArchiveDiff {
+    async fn collect(left: &Storage, right: &Storage) -> anyhow::Result<Self> {
+        async fn heights(archive: &Storage) -> anyhow::Result<Option<(u64, u64)>> {
+            Ok(
+                match (archive.first_height().await?, archive.last_height().await?) {
+                    (Some(first), Some(last)) => Some((first, last)),
+                    _ => None,
+                },
+            )
+        }
+
+        let mut out = Self {
+            chain_ids: (left.chain_id().await?, right.chain_id().await?),
+            heights: (heights(left).await?, heights(right).await?),
+            ..Default::default()
+        };
+        let mut left_blocks = left.stream_encoded_blocks();
+        let mut right_blocks = right.stream_encoded_blocks();
+        let mut next_left = left_blocks.try_next().await?;
+        let mut next_right = right_blocks.try_next().await?;
+        loop {
+            match (&next_left, &next_right) {
+                (None, None) => break,
+                (Some((height, _)), None) => {
+                    push_height(&mut out.only_left, *height);
+                    next_left = left_blocks.try_next().await?;
+                }
+                (None, Some((height, _))) => {
+                    push_height(&mut out.only_right, *height);
+                    next_right = right_blocks.try_next().await?;
+                }
+                (Some((left_height, _)), Some((right_height, _))) if left_height < right_height => {
+                    push_height(&mut out.only_left, *left_height);
+                    next_left = left_blocks.try_next().await?;
+                }
+                (Some((left_height, _)), Some((right_height, _))) if right_height < left_height => {
+                    push_height(&mut out.only_right, *right_height);
+                    next_right = right_blocks.try_next().await?;
+                }
+                (Some((height, left_data)), Some((_, right_data))) => {
+                    if let Some(divergence) = compare_blocks(*height, left_data, right_data)? {
+                        out.differing += 1;
+                        if out.first_divergence.is_none() {
+                            out.first_divergence = Some(divergence);
+                        }
+                    }
+                    if *height % 100_000 == 0 {
+                        tracing::info!("compared blocks up to height {}", height);
+                    }
+                    next_left = left_blocks.try_next().await?;
+                    next_right = right_blocks.try_next().await?;
+                }
+            }
+        }
+        Ok(out)
+    }
+
+    /// Whether the archives hold the same blocks, for the same chain.
+    fn is_same(&self) -> bool {
+        self.chain_ids.0 == self.chain_ids.1
+            && self.only_left.is_empty()
+            && self.only_right.is_empty()
+            && self.first_divergence.is_none()
+    }
+
+    fn to_json(&self) -> Value {
+        let heights = |x: Option<(u64, u64)>| {
+            json!({
+                "first_height": x.map(|x| x.0),
+                "last_height": x.map(|x| x.1),
+            })
+        };
+        let ranges = |x: &[(u64, u64)]| {
+            x.iter()
+                .map(|(start, end)| json!({ "start": start, "end": end }))
+                .collect::<Vec<_>>()
+        };
+        json!({
+            "same": self.is_same(),
+            "left": {
+                "chain_id": self.chain_ids.0,
+                "heights": heights(self.heights.0),
+            },
+            "right": {
+                "chain_id": self.chain_ids.1,
+                "heights": heights(self.heights.1),
+            },
+            "only_left": ranges(&self.only_left),
+            "only_right": ranges(&self.only_right),
+            "differing": self.differing,
+            "first_divergence": self.first_divergence.as_ref().map(|x| json!({
+                "height": x.height,
+                "left_hash": x.hashes.as_ref().map(|x| &x.0),
+                "right_hash": x.hashes.as_ref().map(|x| &x.1),
+                "fields": x.fields,
+            })),
+        })
+    }
+
+    fn to_text(&self, left: &Path, right: &Path) -> String {
+        let heights = |x: Option<(u64, u64)>| match x {
+            Some((first, last)) => format!("{}..={}", first, last),
+            None => "none".to_owned(),
+        };
+        let ranges = |x: &[(u64, u64)]| match x.len() {
+            0 => "none".to_owned(),
+            n => format!(
+                "{}: {}",
+                n,
+                x.iter()
+                    .map(|(start, end)| format!("{}..={}", start, end))
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            ),
+        };
+        let divergence = match &self.first_divergence {
+            None => "none".to_owned(),
+            Some(x) => {
+                let mut out = format!("at height {}", x.height);
+                if let Some((left_hash, right_hash)) = &x.hashes {
+                    out.push_str(&format!(
+                        "\n    left hash:  {}\n    right hash: {}",
+                        left_hash, right_hash
+                    ));
+                }
+                out.push_str(&format!("\n    differs in: {}", x.fields.join(", ")));
+                out
+            }
+        };
+        format!(
+            "left:  '{}', for '{}', at heights {}
+right: '{}', for '{}', at heights {}
+  only in left:     {}
+  only in right:    {}
+  differing blocks: {}
+  first divergence: {}
+",
+            left.display(),
+            self.chain_ids.0,
+            heights(self.heights.0),
+            right.display(),
+            self.chain_ids.1,
+            heights(self.heights.1),
+            ranges(&self.only_left),
+            ranges(&self.only_right),
+            self.differing,
+            divergence
+        )
+    }
+}
+
+impl Diff {
+    pub async fn run(self) -> anyhow::Result<()> {
+        for path in [&self.left, &self.right] {
+            if !path.exists() {
+                anyhow::bail!(Failure::new(
+                    ErrorKind::MissingArchive,
+                    format!("archive file '{}' does not exist", path.display())
+                ));
+            }
+        }
+        let left = Storage::new(Some(&self.left), None).await?;
+        let right = Storage::new(Some(&self.right), None).await?;
+        let diff = ArchiveDiff::collect(&left, &right).await?;
+        if self.json {
+            println!("{}", serde_json::to_string_pretty(&diff.to_json())?);
+        } else {
+            print!("{}", diff.to_text(&self.left, &self.right));
+        }
+        if !diff.is_same() {
+            anyhow::bail!("the archives differ");
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::Genesis;
+
+    const CHAIN_ID: &str = "penumbra-test";
+
+    async fn make_archive(blocks: impl IntoIterator<Item = Block>) -> anyhow::Result<Storage> {
+        let archive = Storage::new(None, Some(CHAIN_ID)).await?;
+        archive.put_genesis(&Genesis::test_value()).await?;
+        for block in blocks {
+            archive.put_block(&block).await?;
+        }
+        Ok(archive)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_identical_archives() -> anyhow::Result<()> {
+        let left = make_archive((1..=5).map(Block::test_value_at_height)).await?;
+        let right = make_archive((1..=5).map(Block::test_value_at_height)).await?;
+        let diff = ArchiveDiff::collect(&left, &right).await?;
+        assert!(diff.is_same(), "{:?}", diff);
+        assert_eq!(diff.heights, (Some((1, 5)), Some((1, 5))));
+        assert_eq!(diff.differing, 0);
+        assert_eq!(diff.to_json()["same"], true);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_single_divergent_block() -> anyhow::Result<()> {
+        let original = Block::test_value_at_height(3);
+        let divergent = Block::test_value_at_time(3, original.time()? + 1_000_000_000);
+        let left = make_archive((1..=5).map(Block::test_value_at_height)).await?;
+        let right = make_archive((1..=5).map(|height| match height {
+            3 => divergent.clone(),
+            _ => Block::test_value_at_height(height),
+        }))
+        .await?;
+        let diff = ArchiveDiff::collect(&left, &right).await?;
+        assert!(!diff.is_same());
+        assert_eq!(diff.differing, 1);
+        assert!(diff.only_left.is_empty() && diff.only_right.is_empty());
+        assert_eq!(
+            diff.first_divergence,
+            Some(Divergence {
+                height: 3,
+                hashes: Some((
+                    hex::encode(original.hash()?),
+                    hex::encode(divergent.hash()?)
+                )),
+                fields: vec!["header.time".to_owned()],
+            })
+        );
+        let json = diff.to_json();
+        assert_eq!(json["first_divergence"]["height"], 3);
+        assert_eq!(json["first_divergence"]["fields"], json!(["header.time"]));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_range_mismatch() -> anyhow::Result<()> {
+        let left = make_archive((1..=8).map(Block::test_value_at_height)).await?;
+        let right = make_archive(
+            [2, 3, 4, 5, 10]
+                .into_iter()
+                .map(Block::test_value_at_height),
+        )
+        .await?;
+        let diff = ArchiveDiff::collect(&left, &right).await?;
+        assert!(!diff.is_same());
+        assert_eq!(diff.heights, (Some((1, 8)), Some((2, 10))));
+        assert_eq!(diff.only_left, vec![(1, 1), (6, 8)]);
+        assert_eq!(diff.only_right, vec![(10, 10)]);
+        assert_eq!(diff.first_divergence, None);
+        let text = diff.to_text(Path::new("left.sqlite"), Path::new("right.sqlite"));
+        assert!(
+            text.contains("only in left:     2: 1..=1, 6..=8\n"),
+            "{}",
+            text
+        );
+        Ok(())
+    }
+}
@@ -3,6 +3,8 @@ use std::path::PathBuf;
 use anyhow::Result;
 use clap::{Args, Parser, Subcommand};
 
+use crate::error::{ErrorKind, Failure};
+
 /// Export data from the archive.
 #[derive(Debug, Parser)]
 pub struct Export {
@@ -49,15 +51,18 @@ impl Export {
 impl GenesisCmd {
     /// Run the genesis export command.
     pub async fn run(&self) -> Result<()> {
-        // Initialize storage from the archive file.
+        // Initialize storage from the archive file, which opening would otherwise create.
         // We make no assumption about the chain id, and this will fail if the archive is empty,
         // which is what we want.
+        crate::files::ensure_archive_exists(&self.archive_file)?;
         let archive = crate::storage::Storage::new(Some(&self.archive_file), None).await?;
 
-        let genesis = archive
-            .get_genesis(self.height)
-            .await?
-            .ok_or_else(|| anyhow::anyhow!("Genesis not found for height {}", self.height))?;
+        let genesis = archive.get_genesis(self.height).await?.ok_or_else(|| {
+            Failure::new(
+                ErrorKind::GenesisNotFound,
+                format!("Genesis not found for height {}", self.height),
+            )
+        })?;
 
         // This could be done more efficiently by adding methods to the underlying type here.
         let encoded = genesis.encode()?;
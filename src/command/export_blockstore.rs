@@ -0,0 +1,334 @@
+use anyhow::Context as _;
+use std::path::{Path, PathBuf};
+use tokio_stream::StreamExt as _;
+
+use crate::cometbft::{
+    Block, BlockStoreWriter, LocalStore, LocalStoreGenesisLocation, LocalStoreOpts,
+};
+use crate::error::{ErrorKind, Failure};
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+/// Write the blocks in an archive out into a new CometBFT block store.
+///
+/// This is the inverse of `archive`, and can be used to seed a fresh node with
+/// historical blocks, without it having to sync them from the network.
+///
+/// The archive doesn't contain commits directly, so the commit for each block is taken
+/// from the block after it. The last block has none after it, so its commit is the one
+/// the node the archive was made from saw, read from `--seen-commit-from`; without that,
+/// exporting fails, unless `--leave-out-last-block` is passed.
+pub struct ExportBlockstore {
+    /// Path to the archive file to read from.
+    #[clap(long)]
+    archive_file: PathBuf,
+
+    /// The CometBFT data directory to create the block store in.
+    ///
+    /// The block store ends up at <OUTPUT_DIR>/blockstore.db, which must not already exist.
+    #[clap(long)]
+    output_dir: PathBuf,
+
+    /// The CometBFT database backend to write the block store with.
+    #[clap(long, default_value = "goleveldb")]
+    backend: String,
+
+    /// The CometBFT directory of a node with the seen commit of the last block in the archive.
+    ///
+    /// This is usually the node the archive was made from, as long as it hasn't synced past it.
+    #[clap(
+        long,
+        value_name = "COMETBFT_DIR",
+        conflicts_with = "leave_out_last_block"
+    )]
+    seen_commit_from: Option<PathBuf>,
+
+    /// Export every block but the last, when there's no node with its seen commit.
+    #[clap(long)]
+    leave_out_last_block: bool,
+}
+
+impl ExportBlockstore {
+    pub async fn run(self) -> anyhow::Result<()> {
+        if !self.archive_file.exists() {
+            anyhow::bail!(Failure::new(
+                ErrorKind::MissingArchive,
+                format!(
+                    "archive file '{}' does not exist",
+                    self.archive_file.display()
+                )
+            ));
+        }
+        let archive = Storage::new(Some(&self.archive_file), None).await?;
+        let last_commit = match &self.seen_commit_from {
+            Some(cometbft_dir) => LastCommit::SeenBy(
+                LocalStore::init(
+                    cometbft_dir,
+                    LocalStoreGenesisLocation::FromConfig,
+                    LocalStoreOpts {
+                        read_only: true,
+                        ..Default::default()
+                    },
+                )
+                .with_context(|| {
+                    format!(
+                        "failed to open the node in '{}' for the seen commit",
+                        cometbft_dir.display()
+                    )
+                })?,
+            ),
+            None if self.leave_out_last_block => LastCommit::LeaveOut,
+            None => LastCommit::Missing,
+        };
+        match export_blockstore(&archive, &self.output_dir, &self.backend, &last_commit).await? {
+            None => println!(
+                "✅ archive has too few blocks to export, leaving an empty block store in '{}'",
+                self.output_dir.display()
+            ),
+            Some((first, last)) => println!(
+                "✅ exported blocks from height {} to height {} into '{}'",
+                first,
+                last,
+                self.output_dir.display()
+            ),
+        }
+        Ok(())
+    }
+}
+
+/// Where the commit of the last block in an archive comes from, since no block after it has it.
+enum LastCommit {
+    /// The seen commit of a node's block store.
+    SeenBy(LocalStore),
+    /// Nowhere, leaving the last block out.
+    LeaveOut,
+    /// Nowhere, failing to export.
+    Missing,
+}
+
+/// Write every block in an archive into a new block store.
+///
+/// The last block is saved with the commit from `last_commit`, if that has one.
+/// This returns the heights of the first and last blocks in the block store afterwards.
+async fn export_blockstore(
+    archive: &Storage,
+    output_dir: &Path,
+    backend: &str,
+    last_commit: &LastCommit,
+) -> anyhow::Result<Option<(u64, u64)>> {
+    // The commit of the last block is looked for first, so as not to leave half an export behind.
+    let last_height = archive.last_height().await?;
+    let seen_commit = match (last_commit, last_height) {
+        (_, None) | (LastCommit::LeaveOut, _) => None,
+        (LastCommit::SeenBy(store), Some(height)) => {
+            Some(store.seen_commit(height).await?.ok_or_else(|| {
+                anyhow::anyhow!(
+                    "the node has no seen commit for the last block in the archive, at height {}",
+                    height
+                )
+            })?)
+        }
+        (LastCommit::Missing, Some(height)) => anyhow::bail!(
+            "the archive has no commit for its last block, at height {}; pass --seen-commit-from with the directory of a node which saw it, or --leave-out-last-block",
+            height
+        ),
+    };
+    let mut writer = BlockStoreWriter::create(output_dir, backend)?;
+    let mut blocks = archive.stream_encoded_blocks();
+    let mut previous: Option<Block> = None;
+    while let Some((height, data)) = blocks.try_next().await? {
+        let block = Block::decode(&data)
+            .with_context(|| format!("failed to decode block at height {}", height))?;
+        if let Some(previous) = previous {
+            anyhow::ensure!(
+                height == previous.height() + 1,
+                "the archive is missing blocks from height {} to height {}",
+                previous.height() + 1,
+                height - 1
+            );
+            writer.save_block(&previous, &block)?;
+        }
+        if height % 100_000 == 0 {
+            tracing::info!("exporting block {}", height);
+        }
+        previous = Some(block);
+    }
+    if let Some(last) = previous {
+        match &seen_commit {
+            Some(commit) => writer.save_last_block(&last, commit)?,
+            None => tracing::info!(
+                "leaving out the last block, at height {}, since the archive has no commit for it",
+                last.height()
+            ),
+        }
+    }
+    writer.height_bounds()
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::Store;
+
+    /// The blocks in the block store under test_data/cometbft.
+    const TEST_STORE_HEIGHTS: std::ops::RangeInclusive<u64> = 1..=5;
+
+    fn test_data(path: &str) -> PathBuf {
+        Path::new(env!("CARGO_MANIFEST_DIR"))
+            .join("test_data")
+            .join(path)
+    }
+
+    /// Open the block store in a cometbft directory, without writing to it.
+    fn open_store(cometbft_dir: &Path) -> anyhow::Result<LocalStore> {
+        LocalStore::init(
+            cometbft_dir,
+            LocalStoreGenesisLocation::DirectFile(&test_data("genesis.json")),
+            LocalStoreOpts {
+                read_only: true,
+                ..Default::default()
+            },
+        )
+    }
+
+    /// Archive the blocks of the test store up to a height, in an archive inside of tmp.
+    async fn archive_test_store(tmp: &Path, last: u64) -> anyhow::Result<Storage> {
+        let original = open_store(&test_data("cometbft"))?;
+        let archive = Storage::new(Some(&tmp.join("archive.sqlite")), Some("penumbra-1")).await?;
+        for height in *TEST_STORE_HEIGHTS.start()..=last {
+            let block = original
+                .get_block(height)
+                .await?
+                .expect("test store should contain block");
+            archive.put_block(&block).await?;
+        }
+        Ok(archive)
+    }
+
+    fn test_dir(name: &str) -> anyhow::Result<PathBuf> {
+        let tmp = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-export-blockstore-{}-{}",
+            name,
+            std::process::id()
+        ));
+        if tmp.exists() {
+            std::fs::remove_dir_all(&tmp)?;
+        }
+        std::fs::create_dir_all(tmp.join("config"))?;
+        Ok(tmp)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_export_round_trip() -> anyhow::Result<()> {
+        let tmp = test_dir("round-trip")?;
+        let archive = archive_test_store(&tmp, *TEST_STORE_HEIGHTS.end()).await?;
+
+        // The node the archive was made from saw the commit of its last block.
+        let seen_by = LastCommit::SeenBy(open_store(&test_data("cometbft"))?);
+        let bounds = export_blockstore(&archive, &tmp.join("data"), "goleveldb", &seen_by).await?;
+        assert_eq!(
+            bounds,
+            Some((*TEST_STORE_HEIGHTS.start(), *TEST_STORE_HEIGHTS.end()))
+        );
+        drop(seen_by);
+
+        // Reading the export back in needs a config, like any other node would have.
+        std::fs::copy(
+            test_data("cometbft/config/config.toml"),
+            tmp.join("config/config.toml"),
+        )?;
+        let original = open_store(&test_data("cometbft"))?;
+        let exported = open_store(&tmp)?;
+        assert_eq!(
+            exported.get_height_bounds().await?,
+            Some((*TEST_STORE_HEIGHTS.start(), *TEST_STORE_HEIGHTS.end()))
+        );
+        for height in TEST_STORE_HEIGHTS {
+            assert_eq!(
+                exported.get_block(height).await?,
+                original.get_block(height).await?,
+                "block at height {} differs after exporting",
+                height
+            );
+        }
+        let last = *TEST_STORE_HEIGHTS.end();
+        assert_eq!(
+            exported.seen_commit(last).await?,
+            original.seen_commit(last).await?
+        );
+        drop(exported);
+        drop(archive);
+        std::fs::remove_dir_all(&tmp)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_export_without_last_commit() -> anyhow::Result<()> {
+        let tmp = test_dir("without-last-commit")?;
+        let archive = archive_test_store(&tmp, *TEST_STORE_HEIGHTS.end()).await?;
+
+        // Without anywhere to take the commit of the last block from, nothing is written.
+        let err = export_blockstore(
+            &archive,
+            &tmp.join("data"),
+            "goleveldb",
+            &LastCommit::Missing,
+        )
+        .await
+        .expect_err("exporting without the last commit should fail");
+        assert!(
+            err.to_string()
+                .starts_with("the archive has no commit for its last block, at height 5"),
+            "{:#}",
+            err
+        );
+        assert!(!tmp.join("data").exists());
+
+        // Unless it's fine to leave the last block out.
+        let bounds = export_blockstore(
+            &archive,
+            &tmp.join("data"),
+            "goleveldb",
+            &LastCommit::LeaveOut,
+        )
+        .await?;
+        assert_eq!(
+            bounds,
+            Some((*TEST_STORE_HEIGHTS.start(), *TEST_STORE_HEIGHTS.end() - 1))
+        );
+        drop(archive);
+        std::fs::remove_dir_all(&tmp)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_export_with_node_past_the_archive() -> anyhow::Result<()> {
+        let tmp = test_dir("node-past-the-archive")?;
+        let archive = archive_test_store(&tmp, *TEST_STORE_HEIGHTS.end() - 1).await?;
+
+        // A node which synced past the end of the archive only saw the commit of its own last block.
+        let seen_by = LastCommit::SeenBy(open_store(&test_data("cometbft"))?);
+        let err = export_blockstore(&archive, &tmp.join("data"), "goleveldb", &seen_by)
+            .await
+            .expect_err("exporting without the last commit should fail");
+        assert!(err.to_string().contains("no seen commit"), "{:#}", err);
+        assert!(!tmp.join("data").exists());
+        drop(archive);
+        std::fs::remove_dir_all(&tmp)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_export_refuses_existing_store() -> anyhow::Result<()> {
+        let archive = Storage::new(None, Some("penumbra-1")).await?;
+        let result = export_blockstore(
+            &archive,
+            &test_data("cometbft/data"),
+            "goleveldb",
+            &LastCommit::Missing,
+        )
+        .await;
+        assert!(result.is_err());
+        Ok(())
+    }
+}
@@ -0,0 +1,457 @@
+use anyhow::{anyhow, Context as _};
+use std::path::{Path, PathBuf};
+
+use crate::cometbft::{
+    self, Block, LocalStore, LocalStoreGenesisLocation, LocalStoreOpts, Store as _,
+};
+use crate::files::archive_filepath_from_opts;
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+#[command(group(clap::ArgGroup::new("node").args(["node_home", "cometbft_dir"])))]
+#[command(group(clap::ArgGroup::new("at").args(["height", "time"]).required(true)))]
+/// Write the block at a single height out to a file, as protobuf, to inspect it offline.
+///
+/// The block is read from an archive, or, with --node-home or --cometbft-dir, from the block
+/// store of a node. Neither keeps the commit for a block alongside it, so, as with
+/// `export-blockstore`, the commit is taken from the block after it, which must be there too.
+pub struct Extract {
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id of the archive to read from. Defaults to `penumbra-1` for mainnet.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// Read the block from the block store of the node with this home directory, rather than an archive.
+    ///
+    /// This is the node's cometbft home, or a `pd` home with a cometbft directory in it.
+    #[clap(long, conflicts_with_all = ["home", "archive_file", "chain_id"])]
+    node_home: Option<PathBuf>,
+
+    /// Read the block from the block store in this cometbft home directory, rather than an archive.
+    #[clap(long, conflicts_with_all = ["home", "archive_file", "chain_id", "node_home"])]
+    cometbft_dir: Option<PathBuf>,
+
+    /// The name of the database holding the block store of the node, if not `blockstore`.
+    #[clap(long, requires = "node")]
+    blockstore_name: Option<String>,
+
+    /// The height of the block to extract.
+    #[clap(long)]
+    height: Option<u64>,
+
+    /// Extract the block from the archive whose time is closest to this one, given in RFC 3339,
+    /// like `2024-05-13T18:00:00Z`, rather than the block at a height.
+    #[clap(long, value_parser = parse_time, conflicts_with = "node")]
+    time: Option<i64>,
+
+    /// The file to write the encoded block to.
+    #[clap(long)]
+    out: PathBuf,
+
+    /// Also write the encoded commit for the block to this file.
+    #[clap(long)]
+    commit_out: Option<PathBuf>,
+}
+
+/// Parse a time given in RFC 3339 into nanoseconds since the unix epoch, like [`Block::time`].
+fn parse_time(value: &str) -> anyhow::Result<i64> {
+    chrono::DateTime::parse_from_rfc3339(value)
+        .context("the time should be in RFC 3339, like `2024-05-13T18:00:00Z`")?
+        .timestamp_nanos_opt()
+        .ok_or_else(|| anyhow!("the time '{}' is out of range", value))
+}
+
+/// What's extracted at a height: the encoded block, along with its commit, if asked for.
+#[derive(Debug)]
+struct Extracted {
+    block: Vec<u8>,
+    commit: Option<Vec<u8>>,
+}
+
+/// Encode the commit for the block at a height, taking it from the block after it.
+fn commit_from_next(height: u64, next: Option<Block>) -> anyhow::Result<Vec<u8>> {
+    let next = next.ok_or_else(|| {
+        anyhow!(
+            "there's no block at height {} to take the commit for height {} from",
+            height + 1,
+            height
+        )
+    })?;
+    let (commit_height, commit) = next.encoded_last_commit().ok_or_else(|| {
+        anyhow!(
+            "block at height {} contains no commit for the block before it",
+            next.height()
+        )
+    })?;
+    anyhow::ensure!(
+        commit_height == height,
+        "block at height {} contains a commit for height {}, rather than height {}",
+        next.height(),
+        commit_height,
+        height
+    );
+    Ok(commit)
+}
+
+/// Extract the block at a height from an archive, exactly as the archive has it.
+async fn extract_from_archive(
+    archive: &Storage,
+    height: u64,
+    commit: bool,
+) -> anyhow::Result<Extracted> {
+    let block = archive
+        .get_encoded_block(height)
+        .await?
+        .ok_or_else(|| anyhow!("there's no block at height {} in the archive", height))?;
+    let commit = match commit {
+        true => Some(commit_from_next(
+            height,
+            archive.get_block(height + 1).await?,
+        )?),
+        false => None,
+    };
+    Ok(Extracted { block, commit })
+}
+
+/// Extract the block at a height from the block store of a node.
+async fn extract_from_store(
+    store: &LocalStore,
+    height: u64,
+    commit: bool,
+) -> anyhow::Result<Extracted> {
+    let block = store
+        .get_block(height)
+        .await?
+        .ok_or_else(|| anyhow!("there's no block at height {} in the block store", height))?;
+    let commit = match commit {
+        true => Some(commit_from_next(
+            height,
+            store.get_block(height + 1).await?,
+        )?),
+        false => None,
+    };
+    Ok(Extracted {
+        block: block.encode(),
+        commit,
+    })
+}
+
+fn write_file(path: &Path, what: &str, data: &[u8]) -> anyhow::Result<()> {
+    std::fs::write(path, data)
+        .with_context(|| format!("failed to write the {} to '{}'", what, path.display()))?;
+    println!(
+        "✅ wrote the {} ({} bytes) to '{}'",
+        what,
+        data.len(),
+        path.display()
+    );
+    Ok(())
+}
+
+impl Extract {
+    /// Get the cometbft directory of the node to read from, if one was given.
+    fn cometbft_dir(&self) -> anyhow::Result<Option<PathBuf>> {
+        let out = match (self.node_home.as_ref(), self.cometbft_dir.as_ref()) {
+            (_, Some(x)) => Some(x.to_owned()),
+            (Some(x), None) => Some(cometbft::find_cometbft_dir(x)?),
+            (None, None) => None,
+        };
+        Ok(out)
+    }
+
+    pub async fn run(self) -> anyhow::Result<()> {
+        let with_commit = self.commit_out.is_some();
+        // Everything is read before anything is written, so that a missing commit doesn't
+        // leave the block written out without it.
+        let (height, extracted) = match self.cometbft_dir()? {
+            Some(dir) => {
+                let store = LocalStore::init(
+                    &dir,
+                    LocalStoreGenesisLocation::FromConfig,
+                    LocalStoreOpts {
+                        read_only: true,
+                        db_name: self.blockstore_name.clone(),
+                        ..Default::default()
+                    },
+                )?;
+                let height = self
+                    .height
+                    .expect("a height should be given when reading from a node");
+                (
+                    height,
+                    extract_from_store(&store, height, with_commit).await?,
+                )
+            }
+            None => {
+                let archive_file = archive_filepath_from_opts(
+                    self.home.clone(),
+                    self.archive_file.clone(),
+                    self.chain_id.clone(),
+                )?;
+                crate::files::ensure_archive_exists(&archive_file)?;
+                let archive = Storage::new(Some(&archive_file), self.chain_id.as_deref()).await?;
+                let height = match (self.height, self.time) {
+                    (Some(height), _) => height,
+                    (None, time) => {
+                        let time = time.expect("either a height or a time should be given");
+                        archive.nearest_height(time).await?.ok_or_else(|| {
+                            anyhow!("no block in the archive has a known time to look up")
+                        })?
+                    }
+                };
+                (
+                    height,
+                    extract_from_archive(&archive, height, with_commit).await?,
+                )
+            }
+        };
+        write_file(
+            &self.out,
+            &format!("block at height {}", height),
+            &extracted.block,
+        )?;
+        if let (Some(path), Some(commit)) = (&self.commit_out, &extracted.commit) {
+            write_file(path, &format!("commit for height {}", height), commit)?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::test_node_home;
+    use clap::Parser as _;
+
+    fn test_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-extract-{}-{}",
+            name,
+            std::process::id()
+        ))
+    }
+
+    /// Open the block store of a node home laid out by [test_node_home].
+    fn open_store(home: &Path) -> anyhow::Result<LocalStore> {
+        LocalStore::init(
+            &home.join("cometbft"),
+            LocalStoreGenesisLocation::FromConfig,
+            LocalStoreOpts {
+                read_only: true,
+                ..Default::default()
+            },
+        )
+    }
+
+    fn extract(args: &[&str]) -> anyhow::Result<Extract> {
+        Ok(Extract::try_parse_from(
+            std::iter::once("extract").chain(args.iter().copied()),
+        )?)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_extract_from_archive() -> anyhow::Result<()> {
+        let home = test_node_home("extract-archive", true)?;
+        let path = test_path("archive.sqlite");
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        // The test blocks all carry the same commit, so blocks with real commits are needed.
+        let store = open_store(&home)?;
+        let mut blocks = Vec::new();
+        {
+            let archive = Storage::new(Some(&path), Some("penumbra-1")).await?;
+            for height in 1..=5 {
+                let block = store
+                    .get_block(height)
+                    .await?
+                    .expect("test store should contain block");
+                archive.put_block(&block).await?;
+                blocks.push(block);
+            }
+        }
+        drop(store);
+        std::fs::remove_dir_all(&home)?;
+
+        let (out, commit_out) = (test_path("block.pb"), test_path("commit.pb"));
+        let archive_file = path.to_str().expect("test path should be valid UTF-8");
+        let out_file = out.to_str().expect("test path should be valid UTF-8");
+        let commit_file = commit_out
+            .to_str()
+            .expect("test path should be valid UTF-8");
+        extract(&[
+            "--archive-file",
+            archive_file,
+            "--height",
+            "2",
+            "--out",
+            out_file,
+            "--commit-out",
+            commit_file,
+        ])?
+        .run()
+        .await?;
+        assert_eq!(Block::decode(&std::fs::read(&out)?)?, blocks[1]);
+        assert_eq!(
+            Some((2, std::fs::read(&commit_out)?)),
+            blocks[2].encoded_last_commit()
+        );
+        std::fs::remove_file(&out)?;
+        std::fs::remove_file(&commit_out)?;
+
+        // The last block has no block after it to take a commit from, so nothing is written.
+        let err = extract(&[
+            "--archive-file",
+            archive_file,
+            "--height",
+            "5",
+            "--out",
+            out_file,
+            "--commit-out",
+            commit_file,
+        ])?
+        .run()
+        .await
+        .expect_err("there's no commit for the last block");
+        assert!(
+            err.to_string().contains("no block at height 6"),
+            "{:#}",
+            err
+        );
+        assert!(!out.exists());
+        // Without its commit, it's written all the same, but a missing block isn't.
+        for (height, ok) in [("5", true), ("6", false)] {
+            let result = extract(&[
+                "--archive-file",
+                archive_file,
+                "--height",
+                height,
+                "--out",
+                out_file,
+            ])?
+            .run()
+            .await;
+            assert_eq!(result.is_ok(), ok, "{}", height);
+        }
+        assert_eq!(Block::decode(&std::fs::read(&out)?)?, blocks[4]);
+        std::fs::remove_file(&out)?;
+
+        // By time, the block closest to it is extracted, however far off, and however precise.
+        for (time, expected) in [
+            (blocks[2].time()?, 2),
+            (blocks[2].time()? + 1, 2),
+            (blocks[0].time()? - 1_000_000_000_000, 0),
+            (blocks[4].time()? + 1_000_000_000_000, 4),
+        ] {
+            let time = chrono::DateTime::from_timestamp_nanos(time).to_rfc3339();
+            extract(&[
+                "--archive-file",
+                archive_file,
+                "--time",
+                &time,
+                "--out",
+                out_file,
+            ])?
+            .run()
+            .await?;
+            assert_eq!(
+                Block::decode(&std::fs::read(&out)?)?,
+                blocks[expected],
+                "{}",
+                time
+            );
+            std::fs::remove_file(&out)?;
+        }
+        // A time is looked up in an archive, and is given instead of a height, not as well.
+        for args in [
+            &["--archive-file", archive_file, "--time", "yesterday"][..],
+            &[
+                "--archive-file",
+                archive_file,
+                "--height",
+                "1",
+                "--time",
+                "2024-05-13T18:00:00Z",
+            ],
+            &["--node-home", "node", "--time", "2024-05-13T18:00:00Z"],
+            &["--archive-file", archive_file],
+        ] {
+            assert!(
+                Extract::try_parse_from(
+                    ["extract"]
+                        .into_iter()
+                        .chain(args.iter().copied())
+                        .chain(["--out", out_file]),
+                )
+                .is_err(),
+                "{:?}",
+                args
+            );
+        }
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_extract_from_store() -> anyhow::Result<()> {
+        let home = test_node_home("extract", true)?;
+        let out = test_path("store-block.pb");
+        let commit_out = test_path("store-commit.pb");
+        extract(&[
+            "--node-home",
+            home.to_str().expect("test path should be valid UTF-8"),
+            "--height",
+            "4",
+            "--out",
+            out.to_str().expect("test path should be valid UTF-8"),
+            "--commit-out",
+            commit_out
+                .to_str()
+                .expect("test path should be valid UTF-8"),
+        ])?
+        .run()
+        .await?;
+
+        let store = open_store(&home)?;
+        let block = Block::decode(&std::fs::read(&out)?)?;
+        assert_eq!(block.height(), 4);
+        assert_eq!(Some(block), store.get_block(4).await?);
+        let next = store
+            .get_block(5)
+            .await?
+            .expect("test store should contain block");
+        assert_eq!(
+            Some((4, std::fs::read(&commit_out)?)),
+            next.encoded_last_commit()
+        );
+        drop(store);
+        std::fs::remove_file(&out)?;
+        std::fs::remove_file(&commit_out)?;
+        std::fs::remove_dir_all(&home)?;
+
+        // Where to read from is either an archive or a node, never both.
+        let both = extract(&[
+            "--node-home",
+            "node",
+            "--archive-file",
+            "archive.sqlite",
+            "--height",
+            "1",
+            "--out",
+            "block.pb",
+        ]);
+        assert!(both.is_err());
+        Ok(())
+    }
+}
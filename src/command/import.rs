@@ -0,0 +1,456 @@
+use anyhow::Context as _;
+use hex::ToHex as _;
+use sha2::Digest as _;
+use sqlx::{PgPool, Postgres, Transaction};
+use std::{collections::HashMap, fmt, path::PathBuf};
+use tokio_stream::StreamExt as _;
+
+use crate::cometbft::Block;
+use crate::error::{ErrorKind, Failure};
+use crate::files::archive_filepath_from_opts;
+use crate::storage::Storage;
+
+/// How many blocks to import in each Postgres transaction.
+///
+/// Each batch is committed on its own, so an interrupted import keeps every batch before it.
+const BATCH_SIZE: usize = 1_000;
+
+#[derive(clap::Parser)]
+/// Copy the blocks in a local SQLite3 archive into Postgres.
+///
+/// Blocks go into a `blocks` table, and their transactions into a `tx_results` table,
+/// inside a separate schema, so that they don't collide with the tables of the same name
+/// which regeneration indexes events into. The archive contains no execution results,
+/// so the transaction rows only contain the transactions themselves.
+///
+/// Importing is idempotent: rows already in Postgres are skipped, so an interrupted
+/// import can be resumed by running it again. Existing rows which differ from the
+/// archive are reported, and fail the import once everything else has been copied.
+pub struct Import {
+    /// The URL for the Postgres database to import into.
+    #[clap(long)]
+    database_url: String,
+
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Downloaded large files will be stored within this directory.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id of the archive to import. Defaults to `penumbra-1` for mainnet.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// The Postgres schema to create the tables in, if they don't exist already.
+    #[clap(long, default_value = "archive")]
+    schema: String,
+}
+
+impl Import {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let archive_file = archive_filepath_from_opts(self.home, self.archive_file, self.chain_id)?;
+        crate::files::ensure_archive_exists(&archive_file)?;
+        let archive = Storage::new(Some(&archive_file), None).await?;
+        let pool = PgPool::connect(&self.database_url)
+            .await
+            .context(Failure::new(
+                ErrorKind::DbConnection,
+                "failed to connect to the database",
+            ))?;
+        let result = import_archive(&archive, &pool, &self.schema).await;
+        pool.close().await;
+        let summary = result?;
+
+        println!(
+            "✅ imported {} new blocks and {} new transactions from '{}' into schema '{}', skipping {} blocks already there",
+            summary.blocks_imported,
+            summary.txs_imported,
+            archive_file.display(),
+            self.schema,
+            summary.blocks_existing
+        );
+        if !summary.conflicts.is_empty() {
+            println!("rows in Postgres which differ from the archive:");
+            for conflict in &summary.conflicts {
+                println!("  {}", conflict);
+            }
+            anyhow::bail!(
+                "found {} rows in Postgres which differ from the archive",
+                summary.conflicts.len()
+            );
+        }
+        Ok(())
+    }
+}
+
+/// A row already in Postgres which doesn't match the archive.
+#[derive(Clone, Debug, PartialEq)]
+enum Conflict {
+    Block { height: u64 },
+    Transaction { height: u64, index: usize },
+}
+
+impl fmt::Display for Conflict {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Conflict::Block { height } => write!(f, "block at height {}", height),
+            Conflict::Transaction { height, index } => {
+                write!(f, "transaction {} of block at height {}", index, height)
+            }
+        }
+    }
+}
+
+/// What an import did.
+#[derive(Clone, Debug, Default, PartialEq)]
+struct ImportSummary {
+    blocks_imported: u64,
+    blocks_existing: u64,
+    txs_imported: u64,
+    conflicts: Vec<Conflict>,
+}
+
+/// Check that a schema name can be used in a statement without quoting.
+fn check_schema_name(schema: &str) -> anyhow::Result<()> {
+    let valid = schema
+        .chars()
+        .next()
+        .is_some_and(|x| x.is_ascii_lowercase() || x == '_')
+        && schema
+            .chars()
+            .all(|x| x.is_ascii_lowercase() || x.is_ascii_digit() || x == '_');
+    anyhow::ensure!(
+        valid,
+        "schema name '{}' should only contain lowercase letters, digits, and underscores",
+        schema
+    );
+    Ok(())
+}
+
+async fn create_tables(pool: &PgPool, schema: &str) -> anyhow::Result<()> {
+    let statements = [
+        format!("CREATE SCHEMA IF NOT EXISTS {schema}"),
+        format!(
+            "CREATE TABLE IF NOT EXISTS {schema}.blocks (
+               rowid      BIGSERIAL PRIMARY KEY,
+               height     BIGINT NOT NULL,
+               chain_id   VARCHAR NOT NULL,
+               created_at TIMESTAMPTZ NOT NULL,
+               data       BYTEA NOT NULL,
+
+               UNIQUE (height, chain_id)
+             )"
+        ),
+        format!(
+            "CREATE TABLE IF NOT EXISTS {schema}.tx_results (
+               rowid      BIGSERIAL PRIMARY KEY,
+               block_id   BIGINT NOT NULL REFERENCES {schema}.blocks(rowid),
+               index      INTEGER NOT NULL,
+               created_at TIMESTAMPTZ NOT NULL,
+               tx_hash    VARCHAR NOT NULL,
+               tx         BYTEA NOT NULL,
+
+               UNIQUE (block_id, index)
+             )"
+        ),
+    ];
+    let mut dbtx = pool.begin().await?;
+    for statement in &statements {
+        sqlx::query(statement).execute(dbtx.as_mut()).await?;
+    }
+    dbtx.commit().await?;
+    Ok(())
+}
+
+/// Import every block in an archive into Postgres, creating the tables if necessary.
+async fn import_archive(
+    archive: &Storage,
+    pool: &PgPool,
+    schema: &str,
+) -> anyhow::Result<ImportSummary> {
+    check_schema_name(schema)?;
+    create_tables(pool, schema).await?;
+    let chain_id = archive.chain_id().await?;
+
+    let mut summary = ImportSummary::default();
+    let mut blocks = archive.stream_encoded_blocks();
+    let mut batch = Vec::with_capacity(BATCH_SIZE);
+    loop {
+        let next = blocks.try_next().await?;
+        let done = next.is_none();
+        if let Some((height, data)) = next {
+            batch.push((height, data));
+        }
+        if batch.len() >= BATCH_SIZE || (done && !batch.is_empty()) {
+            let mut dbtx = pool.begin().await?;
+            import_batch(&mut dbtx, schema, &chain_id, &batch, &mut summary).await?;
+            dbtx.commit().await?;
+            tracing::info!(
+                "imported blocks up to height {}",
+                batch.last().expect("batch should not be empty").0
+            );
+            batch.clear();
+        }
+        if done {
+            break;
+        }
+    }
+    Ok(summary)
+}
+
+/// Import a batch of blocks, in ascending order of height, inside a Postgres transaction.
+async fn import_batch(
+    dbtx: &mut Transaction<'static, Postgres>,
+    schema: &str,
+    chain_id: &str,
+    batch: &[(u64, Vec<u8>)],
+    summary: &mut ImportSummary,
+) -> anyhow::Result<()> {
+    let (Some((first, _)), Some((last, _))) = (batch.first(), batch.last()) else {
+        return Ok(());
+    };
+    let (first, last) = (i64::try_from(*first)?, i64::try_from(*last)?);
+
+    // Fetch whatever's there already up front, rather than a block at a time.
+    let existing_blocks: HashMap<i64, (i64, Vec<u8>)> =
+        sqlx::query_as::<_, (i64, i64, Vec<u8>)>(&format!(
+            "SELECT height, rowid, data FROM {schema}.blocks
+             WHERE chain_id = $1 AND height BETWEEN $2 AND $3"
+        ))
+        .bind(chain_id)
+        .bind(first)
+        .bind(last)
+        .fetch_all(dbtx.as_mut())
+        .await?
+        .into_iter()
+        .map(|(height, rowid, data)| (height, (rowid, data)))
+        .collect();
+    let existing_txs: HashMap<(i64, i32), (String, Vec<u8>)> =
+        sqlx::query_as::<_, (i64, i32, String, Vec<u8>)>(&format!(
+            "SELECT height, index, tx_hash, tx FROM {schema}.tx_results
+             JOIN {schema}.blocks ON {schema}.blocks.rowid = block_id
+             WHERE chain_id = $1 AND height BETWEEN $2 AND $3"
+        ))
+        .bind(chain_id)
+        .bind(first)
+        .bind(last)
+        .fetch_all(dbtx.as_mut())
+        .await?
+        .into_iter()
+        .map(|(height, index, tx_hash, tx)| ((height, index), (tx_hash, tx)))
+        .collect();
+
+    for (height, data) in batch {
+        let block = Block::decode(data)
+            .with_context(|| format!("failed to decode block at height {}", height))?;
+        let block = block.tendermint_v040()?;
+        let created_at = block.header.time.to_rfc3339();
+        let height_i64 = i64::try_from(*height)?;
+
+        let block_id = match existing_blocks.get(&height_i64) {
+            Some((rowid, existing)) => {
+                summary.blocks_existing += 1;
+                if existing != data {
+                    tracing::warn!("block at height {} differs from the archive", height);
+                    summary.conflicts.push(Conflict::Block { height: *height });
+                    // The transactions can't be trusted to belong to this block either.
+                    continue;
+                }
+                *rowid
+            }
+            None => {
+                let (rowid,): (i64,) = sqlx::query_as(&format!(
+                    "INSERT INTO {schema}.blocks VALUES (DEFAULT, $1, $2, $3::timestamptz, $4) RETURNING rowid"
+                ))
+                .bind(height_i64)
+                .bind(chain_id)
+                .bind(&created_at)
+                .bind(data)
+                .fetch_one(dbtx.as_mut())
+                .await?;
+                summary.blocks_imported += 1;
+                rowid
+            }
+        };
+
+        for (index, tx) in block.data.iter().enumerate() {
+            let tx_hash: String = sha2::Sha256::digest(tx).encode_hex_upper();
+            let index_i32 = i32::try_from(index)?;
+            match existing_txs.get(&(height_i64, index_i32)) {
+                Some((existing_hash, existing)) => {
+                    if *existing_hash != tx_hash || existing != tx {
+                        tracing::warn!(
+                            "transaction {} at height {} differs from the archive",
+                            index,
+                            height
+                        );
+                        summary.conflicts.push(Conflict::Transaction {
+                            height: *height,
+                            index,
+                        });
+                    }
+                }
+                None => {
+                    sqlx::query(&format!(
+                        "INSERT INTO {schema}.tx_results VALUES (DEFAULT, $1, $2, $3::timestamptz, $4, $5)"
+                    ))
+                    .bind(block_id)
+                    .bind(index_i32)
+                    .bind(&created_at)
+                    .bind(&tx_hash)
+                    .bind(tx)
+                    .execute(dbtx.as_mut())
+                    .await?;
+                    summary.txs_imported += 1;
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    /// The database to run these tests against, which they're skipped without.
+    ///
+    /// Each test works in its own schema, which it drops afterwards.
+    const TEST_DATABASE_URL_VAR: &str = "PENUMBRA_REINDEXER_TEST_DATABASE_URL";
+
+    async fn test_pool(name: &str) -> anyhow::Result<Option<(PgPool, String)>> {
+        let Ok(url) = std::env::var(TEST_DATABASE_URL_VAR) else {
+            eprintln!("skipping test, as {} isn't set", TEST_DATABASE_URL_VAR);
+            return Ok(None);
+        };
+        let pool = PgPool::connect(&url).await?;
+        let schema = format!("test_import_{}_{}", name, std::process::id());
+        drop_schema(&pool, &schema).await?;
+        Ok(Some((pool, schema)))
+    }
+
+    async fn drop_schema(pool: &PgPool, schema: &str) -> anyhow::Result<()> {
+        sqlx::query(&format!("DROP SCHEMA IF EXISTS {} CASCADE", schema))
+            .execute(pool)
+            .await?;
+        Ok(())
+    }
+
+    /// An archive of a few blocks, some of which contain transactions.
+    async fn test_archive() -> anyhow::Result<Storage> {
+        let archive = Storage::new(None, Some("penumbra-1")).await?;
+        for height in 1..=5 {
+            let transactions = (0..height % 3)
+                .map(|i| format!("transaction {} at {}", i, height).into_bytes())
+                .collect();
+            archive
+                .put_block(&Block::test_value_with_transactions(height, transactions))
+                .await?;
+        }
+        Ok(archive)
+    }
+
+    /// How many transactions there are in [test_archive].
+    const TEST_ARCHIVE_TXS: u64 = 1 + 2 + 0 + 1 + 2;
+
+    async fn count_rows(pool: &PgPool, schema: &str, table: &str) -> anyhow::Result<i64> {
+        let (count,) = sqlx::query_as(&format!("SELECT COUNT(*) FROM {}.{}", schema, table))
+            .fetch_one(pool)
+            .await?;
+        Ok(count)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_import_then_rerun() -> anyhow::Result<()> {
+        let Some((pool, schema)) = test_pool("rerun").await? else {
+            return Ok(());
+        };
+        let archive = test_archive().await?;
+
+        let summary = import_archive(&archive, &pool, &schema).await?;
+        assert_eq!(
+            summary,
+            ImportSummary {
+                blocks_imported: 5,
+                blocks_existing: 0,
+                txs_imported: TEST_ARCHIVE_TXS,
+                conflicts: Vec::new(),
+            }
+        );
+        assert_eq!(count_rows(&pool, &schema, "blocks").await?, 5);
+        assert_eq!(
+            count_rows(&pool, &schema, "tx_results").await?,
+            TEST_ARCHIVE_TXS as i64
+        );
+
+        let summary = import_archive(&archive, &pool, &schema).await?;
+        assert_eq!(
+            summary,
+            ImportSummary {
+                blocks_imported: 0,
+                blocks_existing: 5,
+                txs_imported: 0,
+                conflicts: Vec::new(),
+            }
+        );
+        assert_eq!(count_rows(&pool, &schema, "blocks").await?, 5);
+
+        drop_schema(&pool, &schema).await?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_import_resumes_and_reports_conflicts() -> anyhow::Result<()> {
+        let Some((pool, schema)) = test_pool("conflicts").await? else {
+            return Ok(());
+        };
+        let archive = test_archive().await?;
+        import_archive(&archive, &pool, &schema).await?;
+
+        // Lose the last block, as if the import had been interrupted, and tamper with others.
+        for statement in [
+            format!("DELETE FROM {schema}.tx_results WHERE block_id IN (SELECT rowid FROM {schema}.blocks WHERE height = 5)"),
+            format!("DELETE FROM {schema}.blocks WHERE height = 5"),
+            format!("UPDATE {schema}.blocks SET data = 'tampered' WHERE height = 2"),
+            format!("UPDATE {schema}.tx_results SET tx = 'tampered' WHERE index = 0 AND block_id IN (SELECT rowid FROM {schema}.blocks WHERE height = 4)"),
+        ] {
+            sqlx::query(&statement).execute(&pool).await?;
+        }
+
+        let summary = import_archive(&archive, &pool, &schema).await?;
+        assert_eq!(summary.blocks_imported, 1);
+        assert_eq!(summary.blocks_existing, 4);
+        assert_eq!(summary.txs_imported, 2);
+        assert_eq!(
+            summary.conflicts,
+            vec![
+                Conflict::Block { height: 2 },
+                Conflict::Transaction {
+                    height: 4,
+                    index: 0
+                },
+            ]
+        );
+        assert_eq!(count_rows(&pool, &schema, "blocks").await?, 5);
+
+        drop_schema(&pool, &schema).await?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_schema_names() {
+        assert!(check_schema_name("archive").is_ok());
+        assert!(check_schema_name("test_import_1").is_ok());
+        assert!(check_schema_name("").is_err());
+        assert!(check_schema_name("1archive").is_err());
+        assert!(check_schema_name("archive; DROP TABLE blocks").is_err());
+    }
+}
@@ -0,0 +1,360 @@
+use anyhow::Context as _;
+use std::path::{Path, PathBuf};
+use tokio_stream::StreamExt as _;
+
+use crate::cometbft::Block;
+use crate::error::{ErrorKind, Failure};
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+/// Combine several archives, each covering some range of heights, into a single archive.
+///
+/// The archives must all be for the same chain, and together cover a contiguous range
+/// of heights. Archives may overlap, but only if they agree on every block they share.
+pub struct Merge {
+    /// An archive to merge. Pass this once for each archive, in any order.
+    #[clap(long = "input", required = true)]
+    inputs: Vec<PathBuf>,
+
+    /// Where to write the merged archive. This file must not already exist.
+    #[clap(long)]
+    output: PathBuf,
+}
+
+impl Merge {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let (chain_id, range) = merge_archives(&self.inputs, &self.output).await?;
+        match range {
+            None => println!(
+                "✅ merged {} archives for '{}', containing no blocks, into '{}'",
+                self.inputs.len(),
+                chain_id,
+                self.output.display()
+            ),
+            Some((first, last)) => println!(
+                "✅ merged {} archives for '{}', from height {} to height {}, into '{}'",
+                self.inputs.len(),
+                chain_id,
+                first,
+                last,
+                self.output.display()
+            ),
+        }
+        Ok(())
+    }
+}
+
+/// Merge several archives into a new one, returning its chain id and the range of heights it covers.
+async fn merge_archives(
+    inputs: &[PathBuf],
+    output: &Path,
+) -> anyhow::Result<(String, Option<(u64, u64)>)> {
+    anyhow::ensure!(
+        !output.exists(),
+        "output archive '{}' already exists",
+        output.display()
+    );
+    let result = merge_into(inputs, output).await;
+    // Don't leave a partial archive behind, which would look like a successful merge.
+    if result.is_err() && output.exists() {
+        std::fs::remove_file(output)?;
+    }
+    result
+}
+
+async fn merge_into(
+    inputs: &[PathBuf],
+    output: &Path,
+) -> anyhow::Result<(String, Option<(u64, u64)>)> {
+    let mut archives = Vec::with_capacity(inputs.len());
+    for path in inputs {
+        if !path.exists() {
+            anyhow::bail!(Failure::new(
+                ErrorKind::MissingArchive,
+                format!("input archive '{}' does not exist", path.display())
+            ));
+        }
+        let archive = Storage::new(Some(path), None).await?;
+        let first = archive.first_height().await?;
+        archives.push((path, archive, first));
+    }
+    let chain_id = archives
+        .first()
+        .ok_or(anyhow::anyhow!("no archives to merge"))?
+        .1
+        .chain_id()
+        .await?;
+    for (path, archive, _) in &archives {
+        let other = archive.chain_id().await?;
+        anyhow::ensure!(
+            other == chain_id,
+            "archive '{}' is for chain '{}', but '{}' is for '{}'",
+            path.display(),
+            other,
+            inputs[0].display(),
+            chain_id
+        );
+    }
+    // Blocks archived without their commits can't be told apart from those in an archive
+    // with them, once merged, so an archive can only be merged with others like it.
+    let commits = |without: bool| {
+        if without {
+            "without commits, by `archive --no-commit`"
+        } else {
+            "with commits"
+        }
+    };
+    let without_commits = archives[0].1.without_commits().await?;
+    for (path, archive, _) in &archives {
+        let other = archive.without_commits().await?;
+        anyhow::ensure!(
+            other == without_commits,
+            "archive '{}' was made {}, but '{}' was made {}",
+            path.display(),
+            commits(other),
+            inputs[0].display(),
+            commits(without_commits)
+        );
+    }
+    // Going through the archives by their first block means that each block is
+    // either new, and should come right after what's been merged so far, or overlaps.
+    archives.sort_by_key(|(_, _, first)| *first);
+
+    let out = Storage::new(Some(&output), Some(&chain_id)).await?;
+    out.set_without_commits(without_commits).await?;
+    for (path, archive, _) in &archives {
+        for initial_height in archive.genesis_initial_heights().await? {
+            let genesis = archive
+                .get_genesis(initial_height)
+                .await?
+                .ok_or(anyhow::anyhow!(
+                    "genesis at initial height {} disappeared",
+                    initial_height
+                ))?;
+            match out.get_genesis(initial_height).await? {
+                Some(existing) => anyhow::ensure!(
+                    existing.encode()? == genesis.encode()?,
+                    "archive '{}' has a different genesis at initial height {} than an earlier archive",
+                    path.display(),
+                    initial_height
+                ),
+                None => out.put_genesis(&genesis).await?,
+            }
+        }
+    }
+
+    let mut range: Option<(u64, u64)> = None;
+    for (path, archive, _) in &archives {
+        tracing::info!("merging blocks from '{}'", path.display());
+        let mut blocks = archive.stream_encoded_blocks();
+        while let Some((height, data)) = blocks.try_next().await? {
+            match range {
+                Some((_, last)) if height <= last => {
+                    let existing = out.get_encoded_block(height).await?;
+                    anyhow::ensure!(
+                        existing.as_deref() == Some(data.as_slice()),
+                        "archive '{}' has a different block at height {} than an earlier archive",
+                        path.display(),
+                        height
+                    );
+                    continue;
+                }
+                Some((_, last)) => anyhow::ensure!(
+                    height == last + 1,
+                    "no archive contains the blocks from height {} to height {}",
+                    last + 1,
+                    height - 1
+                ),
+                None => {}
+            }
+            let fields = (
+                archive.get_num_txs(height).await?,
+                archive.get_block_time(height).await?,
+            );
+            let (num_txs, time) = match fields {
+                (Some(num_txs), Some(time)) => (num_txs, time),
+                _ => {
+                    let block = Block::decode(&data).with_context(|| {
+                        format!(
+                            "failed to decode block at height {} in archive '{}'",
+                            height,
+                            path.display()
+                        )
+                    })?;
+                    (block.num_txs(), block.time()?)
+                }
+            };
+            let extended_commit = archive.get_extended_commit(height).await?;
+            out.put_encoded_block(height, &data, num_txs, time, extended_commit.as_deref())
+                .await?;
+            if let Some(evidence) = archive.get_evidence(height).await? {
+                out.put_evidence(height, &evidence).await?;
+            }
+            range = Some((range.map(|x| x.0).unwrap_or(height), height));
+        }
+    }
+    Ok((chain_id, range))
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{Block, Genesis};
+
+    fn test_archive_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-merge-{}-{}.sqlite",
+            name,
+            std::process::id()
+        ))
+    }
+
+    /// Create an archive at a fresh path, containing the test genesis and the given blocks.
+    async fn make_archive(
+        name: &str,
+        blocks: impl IntoIterator<Item = u64>,
+    ) -> anyhow::Result<PathBuf> {
+        let path = test_archive_path(name);
+        remove_test_archive(&path)?;
+        let genesis = Genesis::test_value();
+        let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+        archive.put_genesis(&genesis).await?;
+        for height in blocks {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        Ok(path)
+    }
+
+    fn remove_test_archive(path: &Path) -> anyhow::Result<()> {
+        if path.exists() {
+            std::fs::remove_file(path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_merge_adjacent_archives() -> anyhow::Result<()> {
+        // Inputs are deliberately out of order.
+        let inputs = [
+            make_archive("adjacent-b", 6..=10).await?,
+            make_archive("adjacent-a", 1..=5).await?,
+        ];
+        let output = test_archive_path("adjacent-out");
+        remove_test_archive(&output)?;
+        let (_, range) = merge_archives(&inputs, &output).await?;
+        assert_eq!(range, Some((1, 10)));
+        let merged = Storage::new(Some(&output), None).await?;
+        for height in 1..=10 {
+            let block = merged.get_block(height).await?;
+            assert_eq!(block.map(|x| x.height()), Some(height));
+        }
+        assert_eq!(
+            merged.genesis_initial_heights().await?,
+            vec![Genesis::test_value().initial_height()]
+        );
+        for path in inputs.iter().chain([&output]) {
+            remove_test_archive(path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_merge_keeps_extended_commits_and_evidence() -> anyhow::Result<()> {
+        let a = make_archive("extended-a", 1..=3).await?;
+        let b = make_archive("extended-b", []).await?;
+        let block = Block::test_value_at_height(4);
+        let archive = Storage::new(Some(&b), None).await?;
+        archive
+            .put_encoded_block(
+                4,
+                &block.encode(),
+                block.num_txs(),
+                block.time()?,
+                Some(b"extended commit"),
+            )
+            .await?;
+        archive.put_evidence(4, b"evidence").await?;
+        drop(archive);
+        let output = test_archive_path("extended-out");
+        remove_test_archive(&output)?;
+        let (_, range) = merge_archives(&[a.clone(), b.clone()], &output).await?;
+        assert_eq!(range, Some((1, 4)));
+        let merged = Storage::new(Some(&output), None).await?;
+        assert_eq!(merged.get_extended_commit(3).await?, None);
+        assert_eq!(
+            merged.get_extended_commit(4).await?.as_deref(),
+            Some(b"extended commit".as_slice())
+        );
+        assert_eq!(merged.get_evidence(3).await?, None);
+        assert_eq!(
+            merged.get_evidence(4).await?.as_deref(),
+            Some(b"evidence".as_slice())
+        );
+        drop(merged);
+        for path in [&a, &b, &output] {
+            remove_test_archive(path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_merge_consistent_overlap() -> anyhow::Result<()> {
+        let inputs = [
+            make_archive("overlap-a", 1..=7).await?,
+            make_archive("overlap-b", 4..=10).await?,
+        ];
+        let output = test_archive_path("overlap-out");
+        remove_test_archive(&output)?;
+        let (_, range) = merge_archives(&inputs, &output).await?;
+        assert_eq!(range, Some((1, 10)));
+        for path in inputs.iter().chain([&output]) {
+            remove_test_archive(path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_merge_rejects_conflicting_overlap() -> anyhow::Result<()> {
+        let a = make_archive("conflict-a", 1..=5).await?;
+        let b = make_archive("conflict-b", 6..=8).await?;
+        // Give the second archive a different block at a height the first one also has.
+        Storage::new(Some(&b), None)
+            .await?
+            .put_encoded_block(5, b"not the same block", 0, 0, None)
+            .await?;
+        let output = test_archive_path("conflict-out");
+        remove_test_archive(&output)?;
+        let err = merge_archives(&[a.clone(), b.clone()], &output)
+            .await
+            .expect_err("merging conflicting archives should fail");
+        assert!(err.to_string().contains("height 5"), "{}", err);
+        for path in [&a, &b, &output] {
+            remove_test_archive(path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_merge_rejects_gap() -> anyhow::Result<()> {
+        let inputs = [
+            make_archive("gap-a", 1..=3).await?,
+            make_archive("gap-b", 6..=8).await?,
+        ];
+        let output = test_archive_path("gap-out");
+        remove_test_archive(&output)?;
+        let err = merge_archives(&inputs, &output)
+            .await
+            .expect_err("merging archives with a gap should fail");
+        assert!(
+            err.to_string().contains("from height 4 to height 5"),
+            "{}",
+            err
+        );
+        for path in inputs.iter().chain([&output]) {
+            remove_test_archive(path)?;
+        }
+        Ok(())
+    }
+}
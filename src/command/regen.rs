@@ -1,7 +1,22 @@
-use std::path::PathBuf;
+use anyhow::Context as _;
+use async_trait::async_trait;
+use serde_json::Value;
+use std::future::Future;
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
 use std::process::Command;
 
-use crate::penumbra::RegenerationPlan;
+use super::regen_step::{ensure_archive_has_commits, StepStatus};
+use crate::error::{ErrorKind, Failure};
+use crate::files::ARCHIVE_KEY_VAR;
+use crate::indexer::{
+    DEFAULT_CONNECT_TIMEOUT_SECS, DEFAULT_HEARTBEAT_INTERVAL_SECS, DEFAULT_MAX_ATTEMPTS,
+    DEFAULT_MAX_CONNECTIONS,
+};
+use crate::logging::{LogFormat, Verbosity};
+use crate::penumbra::{RegenerationPlan, RegenerationStep};
+use crate::progress::DEFAULT_PROGRESS_INTERVAL;
+use crate::storage::{ArchiveKey, Storage};
 
 #[derive(clap::Parser)]
 pub struct RegenAuto {
@@ -37,6 +52,31 @@ pub struct RegenAuto {
     #[clap(long)]
     allow_existing_data: bool,
 
+    /// How many times to try writing to the indexing database, including the first attempt.
+    ///
+    /// Only failures that might not happen again, like the connection being reset,
+    /// or a deadlock with another writer, are tried again, backing off in between.
+    #[clap(long, default_value_t = DEFAULT_MAX_ATTEMPTS)]
+    db_max_attempts: u32,
+
+    /// The most connections to the indexing database to keep open at once.
+    ///
+    /// Blocks are written one at a time, so more than the default only helps if connections
+    /// are often replaced. Lower this if the server is short on connections.
+    #[clap(long, default_value_t = DEFAULT_MAX_CONNECTIONS, value_parser = clap::value_parser!(u32).range(1..))]
+    db_max_connections: u32,
+
+    /// How many seconds to wait for a connection to the indexing database, before failing.
+    ///
+    /// A connection that times out is tried again, like other transient failures.
+    #[clap(long, default_value_t = DEFAULT_CONNECT_TIMEOUT_SECS)]
+    db_connect_timeout: u64,
+
+    /// How many seconds a write to the indexing database can take before it's logged as still
+    /// going, and how often it's logged again after that.
+    #[clap(long, default_value_t = DEFAULT_HEARTBEAT_INTERVAL_SECS, value_parser = clap::value_parser!(u64).range(1..))]
+    db_heartbeat_interval: u64,
+
     #[clap(long)]
     /// Specify a network for which events should be regenerated.
     ///
@@ -51,6 +91,90 @@ pub struct RegenAuto {
     /// existing regeneration progress.
     #[clap(long)]
     clean: bool,
+
+    /// If set, serve Prometheus metrics about regeneration progress at this address.
+    ///
+    /// Each step of the regeneration serves metrics in turn, so the endpoint is briefly
+    /// unavailable in between steps.
+    #[clap(long)]
+    metrics_addr: Option<SocketAddr>,
+
+    /// Log progress, with an estimate of the time remaining, after regenerating this many blocks.
+    ///
+    /// Progress is also logged at least once a minute, if regeneration is slower than that.
+    /// This only applies when not running in a terminal, which shows a progress bar instead.
+    #[clap(long, default_value_t = DEFAULT_PROGRESS_INTERVAL)]
+    progress_interval: u64,
+
+    /// Start at this step of the regeneration, numbered from 1, rather than after the last one completed.
+    ///
+    /// Which steps have completed is recorded in the working directory, and by default,
+    /// regeneration resumes at the first step that hasn't. Either way, the state in the
+    /// working directory has to have reached the end of the step before.
+    #[clap(long, conflicts_with = "seed_snapshot")]
+    from_step: Option<usize>,
+
+    /// Start from a copy of an existing working directory, rather than from genesis.
+    ///
+    /// The state in that directory has to be at the height where a step of the plan ends,
+    /// and regeneration starts at the step after it. The directory is copied into the working
+    /// directory, which must not hold any state yet, so the snapshot itself is left untouched.
+    #[clap(long)]
+    seed_snapshot: Option<PathBuf>,
+
+    /// Read the regeneration plan from a file, rather than using the built-in plan for the chain.
+    ///
+    /// This is for networks without a built-in plan, or whose upgrade boundaries differ.
+    /// The file is TOML with a `.toml` extension, and JSON otherwise, in the format that
+    /// `show-plan --json` prints. Its boundaries must lie within the blocks of the archive.
+    #[clap(long)]
+    plan_file: Option<PathBuf>,
+
+    /// The key the archive is encrypted with, if it's encrypted, as given to `archive`.
+    ///
+    /// Prefer --key-file, or the PENUMBRA_REINDEXER_ARCHIVE_KEY variable, which keep the key
+    /// off of the command line. The key is passed on to each step in that variable.
+    #[clap(long, conflicts_with = "key_file")]
+    encryption_key: Option<String>,
+
+    /// Read the key the archive is encrypted with from this file, ignoring a trailing newline.
+    #[clap(long)]
+    key_file: Option<PathBuf>,
+
+    /// Stop regenerating after this height, even if it's in the middle of a step.
+    ///
+    /// Every step before the one containing this height runs in full, and that step runs
+    /// up to this height, after which regeneration halts. The height must lie within the
+    /// blocks of the archive. Running again without this carries on from where it stopped.
+    #[clap(long)]
+    stop_height: Option<u64>,
+
+    /// Run each step in a copy of the working directory, which replaces it only once the step succeeds.
+    ///
+    /// A step which fails then leaves the working directory as it was after the step before,
+    /// so that running again retries the step from a clean state. The copy the step failed in
+    /// is kept beside the working directory, as `<WORKING_DIR>.failed`, to look into.
+    /// This copies the whole state before every step, which takes time and space to match.
+    #[clap(long)]
+    isolate_steps: bool,
+
+    /// Cache the blocks each step reads from the archive, and read them from the cache on later runs.
+    ///
+    /// The cache is kept beside the working directory, as `<WORKING_DIR>.block-cache`, and isn't
+    /// removed by --clean, so that regenerating over the same blocks again, say while working on
+    /// regeneration itself, skips reading and decoding them out of the archive. Blocks are only
+    /// read from the cache if it's of the same chain as the archive, has every block a step needs,
+    /// and the archive still has the same blocks at those heights; otherwise they're cached anew.
+    #[clap(long)]
+    reuse_cache: bool,
+
+    /// Download the archive, with its manifest, from an S3-compatible object store first.
+    ///
+    /// Given as `s3://<BUCKET>/<PREFIX>`, as to `archive --s3-url`, and configured the same way,
+    /// by the environment. The archive is downloaded to --archive-file, or where it would
+    /// otherwise be, replacing what's there, and regenerated from there.
+    #[clap(long)]
+    s3_url: Option<String>,
 }
 
 impl RegenAuto {
@@ -66,6 +190,14 @@ impl RegenAuto {
             self.archive_file.clone(),
             self.chain_id.clone(),
         )?;
+        if let Some(url) = &self.s3_url {
+            crate::object_store::ObjectStore::from_env(url)?
+                .download(
+                    &archive_file,
+                    &[crate::manifest::manifest_path(&archive_file)],
+                )
+                .await?;
+        }
 
         // Determine working dir
         let working_dir = self
@@ -86,10 +218,52 @@ impl RegenAuto {
             }
         }
 
+        let key = crate::files::archive_key_from_opts(
+            self.encryption_key.clone(),
+            self.key_file.as_deref(),
+        )?;
+
         // Get the regeneration plan for this chain
-        let plan = RegenerationPlan::from_known_chain_id(chain_id).ok_or_else(|| {
-            anyhow::anyhow!("no regeneration plan known for chain id '{}'", chain_id)
-        })?;
+        let plan = RegenerationPlan::load(chain_id, self.plan_file.as_deref())?;
+
+        // Catch a plan that disagrees with the archive now, rather than several steps into regeneration.
+        if !archive_file.exists() {
+            anyhow::bail!(Failure::new(
+                ErrorKind::MissingArchive,
+                format!("no archive found at '{}'", archive_file.display())
+            ));
+        }
+        {
+            let archive =
+                Storage::with_key(Some(&archive_file), Some(chain_id), key.as_ref()).await?;
+            ensure_archive_has_commits(&archive, &archive_file).await?;
+            plan.check_geneses_against_archive(&archive).await??;
+            if self.plan_file.is_some() {
+                plan.check_within_archive_range(&archive).await??;
+            }
+            plan.check_boundaries_against_archive(&archive).await??;
+            if let Some(height) = self.stop_height {
+                let range = archive
+                    .first_height()
+                    .await?
+                    .zip(archive.last_height().await?);
+                if !range.is_some_and(|(first, last)| (first..=last).contains(&height)) {
+                    anyhow::bail!(Failure::new(
+                        ErrorKind::BoundaryNotFound,
+                        format!(
+                            "--stop-height {} isn't within the archive, which has blocks {}",
+                            height,
+                            range
+                                .map(|(first, last)| format!(
+                                    "from height {} to height {}",
+                                    first, last
+                                ))
+                                .unwrap_or("at no heights".to_owned())
+                        )
+                    ));
+                }
+            }
+        }
 
         tracing::info!("starting automatic regeneration for chain: {}", chain_id);
         tracing::debug!(
@@ -97,18 +271,14 @@ impl RegenAuto {
             plan.steps.len()
         );
 
-        // Get current executable path
-        let current_exe = std::env::current_exe()?;
+        let regen_invocations = stop_heights(&plan);
 
-        // Extract stop heights from InitThenRunTo steps that have a last_block
-        // The RegenerationPlan already handles the proper sequencing of migrate and run steps
-        let mut regen_invocations = Vec::new();
-
-        for (_, step) in &plan.steps {
-            if let crate::penumbra::RegenerationStep::InitThenRunTo { last_block, .. } = step {
-                regen_invocations.push(*last_block);
+        let from_step = match &self.seed_snapshot {
+            None => self.from_step,
+            Some(snapshot) => {
+                Some(seed_working_dir(snapshot, &working_dir, &regen_invocations).await?)
             }
-        }
+        };
 
         tracing::info!(
             "will execute {} regen commands with stop heights: {:?}",
@@ -116,57 +286,1143 @@ impl RegenAuto {
             regen_invocations
         );
 
-        for (i, stop_height) in regen_invocations.iter().enumerate() {
-            let mut cmd = Command::new(&current_exe);
-            // Shell out to the internal "regen-step" command, so that the "sys::exit" calls in
-            // upstream Penumbra deps don't cause the current penumbra-reindexer process to exit.
-            cmd.arg("regen-step")
-                .arg("--chain-id")
-                .arg(chain_id)
-                .arg("--home")
-                .arg(&home)
-                .arg("--working-dir")
-                .arg(&working_dir)
-                .arg("--archive-file")
-                .arg(&archive_file)
-                .arg("--database-url")
-                .arg(&self.database_url);
-
-            if self.allow_existing_data {
-                cmd.arg("--allow-existing-data");
+        let mut runner = ChildProcessRunner {
+            current_exe: std::env::current_exe()?,
+            chain_id: chain_id.to_owned(),
+            home,
+            working_dir: working_dir.clone(),
+            archive_file,
+            database_url: self.database_url.clone(),
+            allow_existing_data: self.allow_existing_data,
+            db_max_attempts: self.db_max_attempts,
+            db_max_connections: self.db_max_connections,
+            db_connect_timeout: self.db_connect_timeout,
+            db_heartbeat_interval: self.db_heartbeat_interval,
+            metrics_addr: self.metrics_addr,
+            progress_interval: self.progress_interval,
+            log_format: LogFormat::current(),
+            verbosity: Verbosity::current(),
+            plan_file: self.plan_file.clone(),
+            key,
+            isolate_steps: self.isolate_steps,
+            block_cache_dir: self
+                .reuse_cache
+                .then(|| beside(&working_dir, ".block-cache")),
+            total: regen_invocations.len(),
+        };
+        run_steps(
+            &working_dir,
+            chain_id,
+            &regen_invocations,
+            from_step,
+            self.stop_height,
+            &mut runner,
+        )
+        .await?;
+
+        match self.stop_height {
+            Some(height) => tracing::info!("regeneration stopped at height {}", height),
+            None => tracing::info!("all regeneration steps completed successfully"),
+        }
+        Ok(())
+    }
+}
+
+/// The stop height of each step of a regeneration, in order.
+///
+/// Each step that runs blocks is a step of the regeneration, with the migrations
+/// before it happening at the start of that step.
+fn stop_heights(plan: &RegenerationPlan) -> Vec<Option<u64>> {
+    plan.steps
+        .iter()
+        .filter_map(|(_, step)| match step {
+            RegenerationStep::InitThenRunTo { last_block, .. }
+            | RegenerationStep::RunTo { last_block, .. } => Some(*last_block),
+            RegenerationStep::Migrate { .. } => None,
+        })
+        .collect()
+}
+
+/// The stop heights of the steps to run to stop at a given height, ending with the step containing it.
+///
+/// That step stops at the given height, rather than where it would have.
+fn stop_heights_until(
+    stop_heights: &[Option<u64>],
+    height: u64,
+) -> anyhow::Result<Vec<Option<u64>>> {
+    let Some(last) = stop_heights
+        .iter()
+        .position(|x| x.map_or(true, |stop| height <= stop))
+    else {
+        anyhow::bail!(
+            "the stop height {} is after the end of the last step of the plan, at height {:?}",
+            height,
+            stop_heights.last().copied().flatten()
+        );
+    };
+    let mut out = stop_heights[..=last].to_vec();
+    out[last] = Some(height);
+    Ok(out)
+}
+
+/// Populate the working directory with a snapshot of the state, returning the step to start at.
+///
+/// The state is read from the copy, so that the snapshot itself is never opened for writing.
+/// If it doesn't end where a step of the plan does, the copy is removed again.
+async fn seed_working_dir(
+    snapshot: &Path,
+    working_dir: &Path,
+    stop_heights: &[Option<u64>],
+) -> anyhow::Result<usize> {
+    anyhow::ensure!(
+        snapshot.is_dir(),
+        "no seed snapshot found at '{}'",
+        snapshot.display()
+    );
+    if working_dir.exists() {
+        anyhow::ensure!(
+            std::fs::read_dir(working_dir)?.next().is_none(),
+            "the working directory '{}' isn't empty, so it can't be seeded with a snapshot; use --clean to start over",
+            working_dir.display()
+        );
+        std::fs::remove_dir(working_dir)?;
+    }
+    if let Some(parent) = working_dir.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+    tracing::info!(
+        "seeding the working directory with the snapshot at '{}'",
+        snapshot.display()
+    );
+    crate::files::copy_dir(snapshot, working_dir)?;
+    let step = async {
+        let height = crate::penumbra::current_height(working_dir)
+            .await
+            .context("failed to read the state in the snapshot")?;
+        seed_step(stop_heights, height)
+    }
+    .await;
+    let step = match step {
+        Ok(step) => step,
+        Err(e) => {
+            std::fs::remove_dir_all(working_dir)?;
+            return Err(e.context(format!(
+                "can't seed regeneration with '{}'",
+                snapshot.display()
+            )));
+        }
+    };
+    // Whatever the snapshot recorded about earlier regenerations doesn't apply to this one.
+    let checkpoint = Checkpoint::path(working_dir);
+    if checkpoint.exists() {
+        std::fs::remove_file(checkpoint)?;
+    }
+    StepStatus::remove(working_dir)?;
+    tracing::info!("starting at step {}, after the state in the snapshot", step);
+    Ok(step)
+}
+
+/// The step to start at for state that has reached a given height.
+///
+/// The height has to be where one of the steps ends, so that the step after it
+/// can pick up exactly where the state left off.
+fn seed_step(stop_heights: &[Option<u64>], height: Option<u64>) -> anyhow::Result<usize> {
+    let Some(height) = height else {
+        anyhow::bail!("the snapshot contains no state; regenerate from genesis instead");
+    };
+    let boundaries: Vec<u64> = stop_heights.iter().filter_map(|x| *x).collect();
+    match stop_heights.iter().position(|x| *x == Some(height)) {
+        Some(i) => Ok(i + 2),
+        None => anyhow::bail!(
+            "the snapshot is at height {}, which isn't where any step of the plan ends; steps end at heights {:?}, so use a snapshot taken at one of them, or regenerate from genesis",
+            height,
+            boundaries
+        ),
+    }
+}
+
+/// Runs a single step of a regeneration.
+#[async_trait]
+trait StepRunner {
+    /// Run a step, numbered from 1, returning its status, only if it succeeded.
+    async fn run_step(
+        &mut self,
+        step: usize,
+        stop_height: Option<u64>,
+    ) -> anyhow::Result<StepStatus>;
+
+    /// The last height indexed by the state in the working directory, if any.
+    async fn state_height(&mut self) -> anyhow::Result<Option<u64>>;
+}
+
+/// Runs each step as a child `regen-step` process.
+struct ChildProcessRunner {
+    current_exe: PathBuf,
+    chain_id: String,
+    home: PathBuf,
+    working_dir: PathBuf,
+    archive_file: PathBuf,
+    database_url: String,
+    allow_existing_data: bool,
+    db_max_attempts: u32,
+    db_max_connections: u32,
+    db_connect_timeout: u64,
+    db_heartbeat_interval: u64,
+    metrics_addr: Option<SocketAddr>,
+    progress_interval: u64,
+    log_format: LogFormat,
+    verbosity: Verbosity,
+    plan_file: Option<PathBuf>,
+    /// The key the archive is encrypted with, if any, passed on in [ARCHIVE_KEY_VAR].
+    key: Option<ArchiveKey>,
+    /// Whether to run each step in a copy of the working directory, with [run_isolated].
+    isolate_steps: bool,
+    /// Where steps cache the blocks they read from the archive, if they do.
+    block_cache_dir: Option<PathBuf>,
+    /// How many steps there are in total, for logging.
+    total: usize,
+}
+
+impl ChildProcessRunner {
+    /// Run a step as a child process, with a given working directory.
+    async fn run_step_in(
+        &self,
+        working_dir: &Path,
+        step: usize,
+        stop_height: Option<u64>,
+    ) -> anyhow::Result<StepStatus> {
+        let mut cmd = Command::new(&self.current_exe);
+        // Shell out to the internal "regen-step" command, so that the "sys::exit" calls in
+        // upstream Penumbra deps don't cause the current penumbra-reindexer process to exit.
+        cmd.arg("regen-step")
+            .arg("--chain-id")
+            .arg(&self.chain_id)
+            .arg("--home")
+            .arg(&self.home)
+            .arg("--working-dir")
+            .arg(working_dir)
+            .arg("--archive-file")
+            .arg(&self.archive_file)
+            .arg("--database-url")
+            .arg(&self.database_url)
+            .arg("--progress-interval")
+            .arg(self.progress_interval.to_string())
+            .arg("--log-format")
+            .arg(self.log_format.as_str())
+            .args(self.verbosity.args())
+            .arg("--db-max-attempts")
+            .arg(self.db_max_attempts.to_string())
+            .arg("--db-max-connections")
+            .arg(self.db_max_connections.to_string())
+            .arg("--db-connect-timeout")
+            .arg(self.db_connect_timeout.to_string())
+            .arg("--db-heartbeat-interval")
+            .arg(self.db_heartbeat_interval.to_string());
+
+        if self.allow_existing_data {
+            cmd.arg("--allow-existing-data");
+        }
+
+        if let Some(plan_file) = &self.plan_file {
+            cmd.arg("--plan-file").arg(plan_file);
+        }
+
+        if let Some(dir) = &self.block_cache_dir {
+            cmd.arg("--block-cache-dir").arg(dir);
+        }
+
+        if let Some(key) = &self.key {
+            cmd.env(ARCHIVE_KEY_VAR, key.passphrase());
+        }
+
+        if let Some(addr) = self.metrics_addr {
+            cmd.arg("--metrics-addr")
+                .arg(addr.to_string())
+                .arg("--metrics-step")
+                .arg(step.to_string());
+        }
+
+        // Add stop height if present
+        if let Some(height) = stop_height {
+            cmd.arg("--stop-height").arg(height.to_string());
+            tracing::info!(
+                "executing regen command {} of {} (stop-height: {})",
+                step,
+                self.total,
+                height
+            );
+        } else {
+            tracing::info!(
+                "executing final regen command {} of {} (no stop-height)",
+                step,
+                self.total
+            );
+        }
+        tracing::debug!("regen command is: {:?}", cmd);
+        // Each step reports how it went in the working directory, which is more reliable
+        // than its exit code, so make sure not to read the report of an earlier step.
+        StepStatus::remove(working_dir)?;
+        let exit_status = cmd.status()?;
+
+        let Some(status) = StepStatus::read(working_dir)? else {
+            anyhow::bail!(
+                "regen command {} exited with code {:?}, without reporting whether it succeeded",
+                step,
+                exit_status.code()
+            );
+        };
+        if status.success && !exit_status.success() {
+            tracing::warn!(
+                "regen command {} reported success, but exited with code {:?}",
+                step,
+                exit_status.code()
+            );
+        }
+        status
+            .check(stop_height)
+            .with_context(|| format!("regen command {} failed", step))?;
+
+        tracing::info!("regen command {} completed successfully", step);
+        Ok(status)
+    }
+}
+
+#[async_trait]
+impl StepRunner for ChildProcessRunner {
+    async fn run_step(
+        &mut self,
+        step: usize,
+        stop_height: Option<u64>,
+    ) -> anyhow::Result<StepStatus> {
+        if !self.isolate_steps {
+            return self.run_step_in(&self.working_dir, step, stop_height).await;
+        }
+        let this = &*self;
+        run_isolated(&this.working_dir, |dir| async move {
+            this.run_step_in(&dir, step, stop_height).await
+        })
+        .await
+    }
+
+    async fn state_height(&mut self) -> anyhow::Result<Option<u64>> {
+        crate::penumbra::current_height(&self.working_dir).await
+    }
+}
+
+/// The path beside the working directory with a suffix added to its name, like `regen.failed`.
+fn beside(working_dir: &Path, suffix: &str) -> PathBuf {
+    let mut path = working_dir.as_os_str().to_owned();
+    path.push(suffix);
+    path.into()
+}
+
+/// Run a step in a copy of the working directory, putting the copy in its place only if the step succeeds.
+///
+/// The copy is made at `<WORKING_DIR>.tmp`. Once the step succeeds, the working directory is
+/// moved aside, to `<WORKING_DIR>.old`, the copy renamed into its place, and the old one removed,
+/// so the working directory only ever holds the state as it was before or after a whole step.
+/// Being interrupted between the two renames is recovered from the next time this runs.
+/// If the step fails, the working directory is left untouched, and its copy is kept at
+/// `<WORKING_DIR>.failed`, replacing any kept from an earlier failure.
+async fn run_isolated<T, F, Fut>(working_dir: &Path, run: F) -> anyhow::Result<T>
+where
+    F: FnOnce(PathBuf) -> Fut,
+    Fut: Future<Output = anyhow::Result<T>>,
+{
+    let (tmp, old, failed) = (
+        beside(working_dir, ".tmp"),
+        beside(working_dir, ".old"),
+        beside(working_dir, ".failed"),
+    );
+    if old.exists() {
+        if working_dir.exists() {
+            std::fs::remove_dir_all(&old)?;
+        } else {
+            tracing::warn!(
+                "putting back '{}', which was moved aside by an interrupted step",
+                working_dir.display()
+            );
+            std::fs::rename(&old, working_dir)?;
+        }
+    }
+    // A copy left behind by a step which was killed, rather than failing, is of no use.
+    if tmp.exists() {
+        std::fs::remove_dir_all(&tmp)?;
+    }
+    if working_dir.exists() {
+        crate::files::copy_dir(working_dir, &tmp)?;
+    } else {
+        std::fs::create_dir_all(&tmp)?;
+    }
+
+    let out = match run(tmp.clone()).await {
+        Ok(x) => x,
+        Err(e) => {
+            if failed.exists() {
+                std::fs::remove_dir_all(&failed)?;
+            }
+            std::fs::rename(&tmp, &failed)?;
+            tracing::warn!(
+                "the step failed, so '{}' was left as it was; the copy it failed in is kept at '{}'",
+                working_dir.display(),
+                failed.display()
+            );
+            return Err(e);
+        }
+    };
+    if working_dir.exists() {
+        std::fs::rename(working_dir, &old)?;
+    }
+    std::fs::rename(&tmp, working_dir)?;
+    if old.exists() {
+        std::fs::remove_dir_all(&old)?;
+    }
+    Ok(out)
+}
+
+/// The file in the working directory recording which steps of a regeneration have completed.
+const CHECKPOINT_FILE_NAME: &str = "regen-checkpoint.json";
+
+/// A step of a regeneration which has completed, along with where it stopped.
+#[derive(Clone, Debug, PartialEq)]
+struct CompletedStep {
+    /// The step, numbered from 1.
+    step: usize,
+    /// The height the step was told to stop at.
+    stop_height: Option<u64>,
+    /// The height the step actually reached.
+    final_height: Option<u64>,
+    /// The version of Penumbra the state was left at.
+    version: Option<String>,
+}
+
+/// Which steps of a regeneration have completed, so that a later regeneration can skip them.
+///
+/// This lives in the working directory, alongside the state these steps produced,
+/// so that cleaning the working directory also removes it.
+#[derive(Clone, Debug, Default, PartialEq)]
+struct Checkpoint {
+    chain_id: String,
+    completed: Vec<CompletedStep>,
+}
+
+impl Checkpoint {
+    fn path(working_dir: &Path) -> PathBuf {
+        working_dir.join(CHECKPOINT_FILE_NAME)
+    }
+
+    /// Read the checkpoint in a working directory, if there is one.
+    fn read(working_dir: &Path) -> anyhow::Result<Option<Self>> {
+        let path = Self::path(working_dir);
+        if !path.exists() {
+            return Ok(None);
+        }
+        let parse = || -> anyhow::Result<Self> {
+            let value: Value = serde_json::from_slice(&std::fs::read(&path)?)?;
+            let chain_id = value
+                .get("chain_id")
+                .and_then(|x| x.as_str())
+                .ok_or(anyhow::anyhow!("expected string `chain_id`"))?
+                .to_owned();
+            let mut completed = Vec::new();
+            for step in value
+                .get("completed")
+                .and_then(|x| x.as_array())
+                .ok_or(anyhow::anyhow!("expected array `completed`"))?
+            {
+                completed.push(CompletedStep {
+                    step: step
+                        .get("step")
+                        .and_then(|x| x.as_u64())
+                        .ok_or(anyhow::anyhow!("expected number `step`"))?
+                        .try_into()?,
+                    stop_height: step.get("stop_height").and_then(|x| x.as_u64()),
+                    final_height: step.get("final_height").and_then(|x| x.as_u64()),
+                    version: step
+                        .get("version")
+                        .and_then(|x| Some(x.as_str()?.to_owned())),
+                });
             }
+            Ok(Self {
+                chain_id,
+                completed,
+            })
+        };
+        parse()
+            .map(Some)
+            .with_context(|| format!("failed to read regen checkpoint at '{}'", path.display()))
+    }
 
-            // Add stop height if present
-            if let Some(height) = stop_height {
-                cmd.arg("--stop-height").arg(height.to_string());
-                tracing::info!(
-                    "executing regen command {} of {} (stop-height: {})",
-                    i + 1,
-                    regen_invocations.len(),
-                    height
-                );
-            } else {
-                tracing::info!(
-                    "executing final regen command {} of {} (no stop-height)",
-                    i + 1,
-                    regen_invocations.len()
-                );
+    fn write(&self, working_dir: &Path) -> anyhow::Result<()> {
+        let completed: Vec<Value> = self
+            .completed
+            .iter()
+            .map(|x| {
+                serde_json::json!({
+                    "step": x.step,
+                    "stop_height": x.stop_height,
+                    "final_height": x.final_height,
+                    "version": x.version,
+                })
+            })
+            .collect();
+        let value = serde_json::json!({ "chain_id": self.chain_id, "completed": completed });
+        std::fs::create_dir_all(working_dir)?;
+        crate::files::write_atomically(
+            &Self::path(working_dir),
+            &serde_json::to_vec_pretty(&value)?,
+        )
+    }
+
+    /// How many steps, from the first, have completed without a break.
+    fn completed_steps(&self) -> usize {
+        self.completed
+            .iter()
+            .enumerate()
+            .take_while(|(i, x)| x.step == i + 1)
+            .count()
+    }
+}
+
+/// Run the steps of a regeneration, resuming after the steps a previous regeneration completed.
+///
+/// `stop_heights` contains the stop height for each step, in order.
+/// With `from_step`, the checkpoint is ignored, and steps are run starting at that one.
+/// Either way, the state in the working directory has to have reached the end of the step
+/// before the one we start at, without having gone past the step we start at.
+///
+/// With `stop_height`, the steps after the one containing that height are left out, and that
+/// step stops at it. A step cut short like this isn't recorded as completed, so that running
+/// the whole plan later carries on with it.
+async fn run_steps(
+    working_dir: &Path,
+    chain_id: &str,
+    stop_heights: &[Option<u64>],
+    from_step: Option<usize>,
+    stop_height: Option<u64>,
+    runner: &mut dyn StepRunner,
+) -> anyhow::Result<()> {
+    let plan_stop_heights = stop_heights;
+    let stop_heights = match stop_height {
+        Some(height) => stop_heights_until(plan_stop_heights, height)?,
+        None => plan_stop_heights.to_vec(),
+    };
+
+    let mut checkpoint = match Checkpoint::read(working_dir)? {
+        Some(checkpoint) => {
+            anyhow::ensure!(
+                checkpoint.chain_id == chain_id,
+                "the regen checkpoint in '{}' is for chain '{}', not '{}'; use --clean to start over",
+                working_dir.display(),
+                checkpoint.chain_id,
+                chain_id
+            );
+            for completed in &checkpoint.completed {
+                if completed
+                    .step
+                    .checked_sub(1)
+                    .and_then(|i| plan_stop_heights.get(i))
+                    != Some(&completed.stop_height)
+                {
+                    anyhow::bail!(Failure::new(
+                        ErrorKind::PlanMismatch,
+                        format!(
+                            "the regen checkpoint in '{}' says step {} stopped at {:?}, which doesn't match the plan; use --clean to start over",
+                            working_dir.display(),
+                            completed.step,
+                            completed.stop_height
+                        )
+                    ));
+                }
             }
-            tracing::debug!("regen command is: {:?}", cmd);
-            let status = cmd.status()?;
-
-            if !status.success() {
-                return Err(anyhow::anyhow!(
-                    "regen command {} failed with exit code: {:?}",
-                    i + 1,
-                    status.code()
-                ));
+            checkpoint
+        }
+        None => Checkpoint {
+            chain_id: chain_id.to_owned(),
+            completed: Vec::new(),
+        },
+    };
+
+    let first = match from_step {
+        Some(step) => {
+            anyhow::ensure!(
+                (1..=stop_heights.len()).contains(&step),
+                "--from-step must be between 1 and {}, the number of steps",
+                stop_heights.len()
+            );
+            step
+        }
+        None => checkpoint.completed_steps() + 1,
+    };
+    // Whatever the checkpoint says about the steps we're about to run no longer applies.
+    checkpoint.completed.retain(|x| x.step < first);
+
+    if first > stop_heights.len() {
+        if let Some(height) = stop_height {
+            anyhow::bail!(
+                "height {} is in step {}, which completed in an earlier run; use --clean to start over",
+                height,
+                stop_heights.len()
+            );
+        }
+        tracing::info!(
+            "all {} regen commands completed in an earlier run, nothing to do",
+            stop_heights.len()
+        );
+        return Ok(());
+    }
+    if first > 1 {
+        let prior_end = stop_heights[first - 2].ok_or(anyhow::anyhow!(
+            "step {} has no stop height, so it must be the last step",
+            first - 1
+        ))?;
+        let state_height = runner.state_height().await?;
+        anyhow::ensure!(
+            state_height.is_some_and(|x| x >= prior_end),
+            "starting at step {} needs the state in '{}' to have reached height {}, where step {} ends, but it's at height {:?}",
+            first,
+            working_dir.display(),
+            prior_end,
+            first - 1,
+            state_height
+        );
+        if let (Some(height), Some(stop)) = (state_height, stop_heights[first - 1]) {
+            anyhow::ensure!(
+                height <= stop,
+                "starting at step {} needs the state in '{}' to be at most at height {}, where step {} ends, but it's at height {}",
+                first,
+                working_dir.display(),
+                stop,
+                first,
+                height
+            );
+        }
+        tracing::info!(
+            "skipping regen commands 1 to {}, which completed in an earlier run",
+            first - 1
+        );
+    }
+
+    for (i, stop_height) in stop_heights.iter().enumerate().skip(first - 1) {
+        let step = i + 1;
+        let status = runner.run_step(step, *stop_height).await?;
+        if *stop_height != plan_stop_heights[i] {
+            tracing::info!(
+                "halting after regen command {}, at height {:?}, short of where it ends",
+                step,
+                stop_height
+            );
+            break;
+        }
+        checkpoint.completed.push(CompletedStep {
+            step,
+            stop_height: *stop_height,
+            final_height: status.final_height,
+            version: status.version,
+        });
+        checkpoint.write(working_dir)?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    const TEST_STOP_HEIGHTS: [Option<u64>; 4] = [Some(10), Some(20), Some(30), None];
+
+    /// Pretends to run steps, by moving the height of a pretend state along.
+    #[derive(Default)]
+    struct FakeRunner {
+        height: Option<u64>,
+        /// The step to fail at, after getting partway through it.
+        fail_at: Option<usize>,
+        /// Every step run, in order.
+        ran: Vec<usize>,
+        /// The stop height of every step run, in order.
+        stops: Vec<Option<u64>>,
+    }
+
+    #[async_trait]
+    impl StepRunner for FakeRunner {
+        async fn run_step(
+            &mut self,
+            step: usize,
+            stop_height: Option<u64>,
+        ) -> anyhow::Result<StepStatus> {
+            self.ran.push(step);
+            self.stops.push(stop_height);
+            if self.fail_at == Some(step) {
+                self.height = Some(self.height.unwrap_or(0) + 1);
+                anyhow::bail!("step {} failed", step);
             }
+            self.height = Some(stop_height.unwrap_or(100));
+            Ok(StepStatus {
+                success: true,
+                final_height: self.height,
+                version: Some("V2".to_owned()),
+                error: None,
+                kind: None,
+            })
+        }
 
-            tracing::info!("regen command {} completed successfully", i + 1);
+        async fn state_height(&mut self) -> anyhow::Result<Option<u64>> {
+            Ok(self.height)
+        }
+    }
+
+    fn test_working_dir(name: &str) -> anyhow::Result<PathBuf> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-regen-{}-{}",
+            name,
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        Ok(dir)
+    }
+
+    fn read_state(dir: &Path) -> Option<String> {
+        std::fs::read_to_string(dir.join("state")).ok()
+    }
+
+    #[tokio::test]
+    async fn test_isolated_step_is_only_promoted_on_success() -> anyhow::Result<()> {
+        let dir = test_working_dir("isolated")?;
+        let (tmp, old, failed) = (
+            beside(&dir, ".tmp"),
+            beside(&dir, ".old"),
+            beside(&dir, ".failed"),
+        );
+        for path in [&tmp, &old, &failed] {
+            if path.exists() {
+                std::fs::remove_dir_all(path)?;
+            }
         }
 
-        tracing::info!("all regeneration steps completed successfully");
+        // The first step creates the working directory, which doesn't exist yet.
+        let expected = tmp.clone();
+        run_isolated(&dir, |step_dir| async move {
+            assert_eq!(step_dir, expected);
+            std::fs::write(step_dir.join("state"), "1")?;
+            Ok::<_, anyhow::Error>(())
+        })
+        .await?;
+        assert_eq!(read_state(&dir).as_deref(), Some("1"));
+        assert!(!tmp.exists() && !old.exists());
+
+        // A step failing partway leaves the working directory as the step before left it.
+        let err = run_isolated::<(), _, _>(&dir, |step_dir| async move {
+            assert_eq!(read_state(&step_dir).as_deref(), Some("1"));
+            std::fs::write(step_dir.join("state"), "2, corrupt")?;
+            anyhow::bail!("step 2 failed")
+        })
+        .await
+        .expect_err("the step should fail");
+        assert!(err.to_string().contains("step 2 failed"), "{:#}", err);
+        assert_eq!(read_state(&dir).as_deref(), Some("1"));
+        assert_eq!(read_state(&failed).as_deref(), Some("2, corrupt"));
+        assert!(!tmp.exists());
+
+        // So retrying it starts from a clean state, and, once it succeeds, it's promoted.
+        run_isolated(&dir, |step_dir| async move {
+            assert_eq!(read_state(&step_dir).as_deref(), Some("1"));
+            std::fs::write(step_dir.join("state"), "2")?;
+            Ok::<_, anyhow::Error>(())
+        })
+        .await?;
+        assert_eq!(read_state(&dir).as_deref(), Some("2"));
+        assert!(!tmp.exists() && !old.exists());
+
+        // Being interrupted between moving the working directory aside and promoting the copy
+        // leaves only the old one, which is put back.
+        std::fs::rename(&dir, &old)?;
+        std::fs::create_dir(&tmp)?;
+        let seen = run_isolated(&dir, |step_dir| async move {
+            Ok::<_, anyhow::Error>(read_state(&step_dir))
+        })
+        .await?;
+        assert_eq!(seen.as_deref(), Some("2"));
+        assert_eq!(read_state(&dir).as_deref(), Some("2"));
+
+        std::fs::remove_dir_all(&dir)?;
+        std::fs::remove_dir_all(&failed)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_built_in_stop_heights() {
+        assert_eq!(
+            stop_heights(&RegenerationPlan::penumbra_1()),
+            vec![
+                Some(501974),
+                Some(2611799),
+                Some(4378761),
+                Some(5480872),
+                None
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_plan_file_steps_run_in_order() -> anyhow::Result<()> {
+        let dir = test_working_dir("plan-file")?;
+        std::fs::create_dir_all(&dir)?;
+        let plan_file = dir.join("plan.json");
+        std::fs::write(
+            &plan_file,
+            r#"{"chain_id": "penumbra-devnet", "steps": [
+                {"kind": "init_then_run_to", "height": 0, "genesis_height": 1, "version": "V1o3", "last_block": 40},
+                {"kind": "migrate", "height": 40, "from": "V1o3", "to": "V1o4"},
+                {"kind": "init_then_run_to", "height": 40, "genesis_height": 41, "version": "V1o4", "last_block": 70},
+                {"kind": "run_to", "height": 70, "version": "V2", "last_block": 90},
+                {"kind": "init_then_run_to", "height": 90, "genesis_height": 91, "version": "V2"}
+            ]}"#,
+        )?;
+        let plan = RegenerationPlan::load("penumbra-devnet", Some(&plan_file))?;
+        let stops = stop_heights(&plan);
+        assert_eq!(stops, vec![Some(40), Some(70), Some(90), None]);
+
+        let mut runner = FakeRunner::default();
+        run_steps(&dir, "penumbra-devnet", &stops, None, None, &mut runner).await?;
+        assert_eq!(runner.ran, vec![1, 2, 3, 4]);
+        assert_eq!(runner.stops, stops);
+
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_rerun_skips_completed_steps() -> anyhow::Result<()> {
+        let dir = test_working_dir("resume")?;
+        let mut runner = FakeRunner {
+            fail_at: Some(3),
+            ..Default::default()
+        };
+        let err = run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            None,
+            &mut runner,
+        )
+        .await
+        .expect_err("the third step should fail");
+        assert!(err.to_string().contains("step 3"), "{:#}", err);
+        assert_eq!(runner.ran, vec![1, 2, 3]);
+        let checkpoint = Checkpoint::read(&dir)?.expect("checkpoint should have been written");
+        assert_eq!(checkpoint.completed_steps(), 2);
+        assert_eq!(checkpoint.completed[1].final_height, Some(20));
+
+        runner.fail_at = None;
+        runner.ran.clear();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            None,
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![3, 4]);
+        assert_eq!(Checkpoint::read(&dir)?.unwrap().completed_steps(), 4);
+
+        // With everything done, nothing should run again.
+        runner.ran.clear();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            None,
+            &mut runner,
+        )
+        .await?;
+        assert!(runner.ran.is_empty());
+
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_from_step_checks_state() -> anyhow::Result<()> {
+        let dir = test_working_dir("from-step")?;
+        // Without a checkpoint, as if the earlier steps were run some other way.
+        let mut runner = FakeRunner {
+            height: Some(20),
+            ..Default::default()
+        };
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            Some(3),
+            None,
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![3, 4]);
+
+        // The state is past the end of these steps, so they can't be run again.
+        runner.ran.clear();
+        let err = run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            Some(2),
+            None,
+            &mut runner,
+        )
+        .await
+        .expect_err("the state should be too far along");
+        assert!(
+            err.to_string().contains("at most at height 20"),
+            "{:#}",
+            err
+        );
+
+        // And the state can't be behind where the previous step should have ended.
+        runner.height = Some(15);
+        let err = run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            Some(3),
+            None,
+            &mut runner,
+        )
+        .await
+        .expect_err("the state should not be far enough along");
+        assert!(err.to_string().contains("reached height 20"), "{:#}", err);
+        assert!(runner.ran.is_empty());
+
+        assert!(run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            Some(5),
+            None,
+            &mut runner
+        )
+        .await
+        .is_err());
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_stop_height_ends_within_its_step() -> anyhow::Result<()> {
+        let dir = test_working_dir("stop-height")?;
+        let mut runner = FakeRunner::default();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            Some(25),
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![1, 2, 3]);
+        assert_eq!(runner.stops, vec![Some(10), Some(20), Some(25)]);
+        assert_eq!(runner.height, Some(25));
+        // The step that was cut short still has to be run in full.
+        assert_eq!(Checkpoint::read(&dir)?.unwrap().completed_steps(), 2);
+
+        runner.ran.clear();
+        runner.stops.clear();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            None,
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![3, 4]);
+        assert_eq!(runner.stops, vec![Some(30), None]);
+
+        // Heights in the last step, which has no end, stop it as well.
+        std::fs::remove_dir_all(&dir)?;
+        let mut runner = FakeRunner::default();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            Some(45),
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![1, 2, 3, 4]);
+        assert_eq!(runner.stops.last(), Some(&Some(45)));
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_stop_height_at_end_of_step_completes_it() -> anyhow::Result<()> {
+        let dir = test_working_dir("stop-height-boundary")?;
+        let mut runner = FakeRunner::default();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            Some(20),
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![1, 2]);
+        assert_eq!(Checkpoint::read(&dir)?.unwrap().completed_steps(), 2);
+
+        // The state is already past a height in a step that's done.
+        let err = run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            Some(15),
+            &mut runner,
+        )
+        .await
+        .expect_err("a height in a completed step should be rejected");
+        assert!(err.to_string().contains("step 2"), "{:#}", err);
+        assert_eq!(runner.ran, vec![1, 2]);
+
+        assert!(stop_heights_until(&[Some(10), Some(20)], 21).is_err());
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_aligned_seed_starts_after_its_step() -> anyhow::Result<()> {
+        assert_eq!(seed_step(&TEST_STOP_HEIGHTS, Some(10))?, 2);
+        assert_eq!(seed_step(&TEST_STOP_HEIGHTS, Some(30))?, 4);
+
+        // The seeded state then carries on as if the earlier steps had run here.
+        let dir = test_working_dir("seed")?;
+        let step = seed_step(&TEST_STOP_HEIGHTS, Some(20))?;
+        let mut runner = FakeRunner {
+            height: Some(20),
+            ..Default::default()
+        };
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            Some(step),
+            None,
+            &mut runner,
+        )
+        .await?;
+        assert_eq!(runner.ran, vec![3, 4]);
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_misaligned_seed_is_rejected() {
+        let err = seed_step(&TEST_STOP_HEIGHTS, Some(15))
+            .expect_err("a seed in the middle of a step should be rejected");
+        assert!(err.to_string().contains("height 15"), "{:#}", err);
+        assert!(err.to_string().contains("[10, 20, 30]"), "{:#}", err);
+        assert!(seed_step(&TEST_STOP_HEIGHTS, Some(40)).is_err());
+        assert!(seed_step(&TEST_STOP_HEIGHTS, None).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_seed_needs_empty_working_dir() -> anyhow::Result<()> {
+        let dir = test_working_dir("seed-existing")?;
+        let snapshot = test_working_dir("seed-snapshot")?;
+        std::fs::create_dir_all(&dir)?;
+        std::fs::create_dir_all(&snapshot)?;
+        std::fs::write(dir.join("leftover"), b"state")?;
+        let err = seed_working_dir(&snapshot, &dir, &TEST_STOP_HEIGHTS)
+            .await
+            .expect_err("a working directory with state should not be seeded");
+        assert!(err.to_string().contains("--clean"), "{:#}", err);
+        // Nothing was copied over what's there.
+        assert_eq!(std::fs::read_dir(&dir)?.count(), 1);
+        std::fs::remove_dir_all(&dir)?;
+        std::fs::remove_dir_all(&snapshot)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_rejects_archive_without_commits() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let dir = test_working_dir("no-commit")?;
+        std::fs::create_dir_all(&dir)?;
+        let archive_file = dir.join("archive.sqlite");
+        let archive = Storage::new(Some(&archive_file), Some("penumbra-1")).await?;
+        archive.set_without_commits(true).await?;
+        drop(archive);
+
+        let path = |x: &Path| {
+            x.to_str()
+                .expect("test path should be valid UTF-8")
+                .to_owned()
+        };
+        let regen = RegenAuto::try_parse_from([
+            "regen".to_owned(),
+            "--database-url".to_owned(),
+            "postgresql://localhost/unused".to_owned(),
+            "--chain-id".to_owned(),
+            "penumbra-1".to_owned(),
+            "--archive-file".to_owned(),
+            path(&archive_file),
+            "--working-dir".to_owned(),
+            path(&dir.join("working")),
+        ])?;
+        let err = regen
+            .run()
+            .await
+            .expect_err("regeneration needs the commits left out of the archive");
+        assert!(
+            format!("{:#}", err).contains("was made with `archive --no-commit`"),
+            "{:#}",
+            err
+        );
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_rejects_mismatched_checkpoint() -> anyhow::Result<()> {
+        let dir = test_working_dir("mismatch")?;
+        let mut runner = FakeRunner::default();
+        run_steps(
+            &dir,
+            "penumbra-1",
+            &TEST_STOP_HEIGHTS,
+            None,
+            None,
+            &mut runner,
+        )
+        .await?;
+
+        let other_plan = [Some(10), Some(25), None];
+        let err = run_steps(&dir, "penumbra-1", &other_plan, None, None, &mut runner)
+            .await
+            .expect_err("the checkpoint doesn't match the plan");
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::PlanMismatch));
+        assert!(run_steps(
+            &dir,
+            "penumbra-testnet",
+            &TEST_STOP_HEIGHTS,
+            None,
+            None,
+            &mut runner
+        )
+        .await
+        .is_err());
+        std::fs::remove_dir_all(&dir)?;
         Ok(())
     }
 }
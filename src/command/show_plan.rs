@@ -0,0 +1,233 @@
+use anyhow::anyhow;
+use serde_json::{json, Value};
+
+use crate::penumbra::{RegenerationPlan, RegenerationStep};
+
+/// Print the regeneration plan known for a chain id, without running anything.
+#[derive(clap::Parser)]
+pub struct ShowPlan {
+    /// The chain id to show the plan for.
+    #[clap(long)]
+    chain_id: String,
+
+    /// Print the plan as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+impl ShowPlan {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let plan = RegenerationPlan::from_known_chain_id(&self.chain_id)
+            .ok_or(anyhow!("no plan known for chain id '{}'", &self.chain_id))?;
+        if self.json {
+            println!(
+                "{}",
+                serde_json::to_string_pretty(&plan_json(&self.chain_id, &plan))?
+            );
+        } else {
+            print!("{}", plan_text(&self.chain_id, &plan));
+        }
+        Ok(())
+    }
+}
+
+/// The first block a step processes, if it processes blocks at all.
+///
+/// This matches how the regenerator runs a plan: blocks start right after the height of the step.
+fn first_block(start: u64, step: &RegenerationStep) -> Option<u64> {
+    match step {
+        RegenerationStep::Migrate { .. } => None,
+        RegenerationStep::InitThenRunTo { .. } | RegenerationStep::RunTo { .. } => Some(start + 1),
+    }
+}
+
+fn plan_json(chain_id: &str, plan: &RegenerationPlan) -> Value {
+    let steps: Vec<Value> = plan
+        .steps
+        .iter()
+        .enumerate()
+        .map(|(i, (start, step))| {
+            let mut out = match step {
+                RegenerationStep::Migrate { from, to } => json!({
+                    "kind": "migrate",
+                    "from": format!("{:?}", from),
+                    "to": format!("{:?}", to),
+                }),
+                RegenerationStep::InitThenRunTo {
+                    genesis_height,
+                    version,
+                    last_block,
+                } => json!({
+                    "kind": "init_then_run_to",
+                    "genesis_height": genesis_height,
+                    "version": format!("{:?}", version),
+                    "last_block": last_block,
+                }),
+                RegenerationStep::RunTo {
+                    version,
+                    last_block,
+                } => json!({
+                    "kind": "run_to",
+                    "version": format!("{:?}", version),
+                    "last_block": last_block,
+                }),
+            };
+            out["step"] = json!(i + 1);
+            out["height"] = json!(start);
+            if let Some(first) = first_block(*start, step) {
+                out["first_block"] = json!(first);
+            }
+            out
+        })
+        .collect();
+    json!({
+        "chain_id": chain_id,
+        "steps": steps,
+    })
+}
+
+fn plan_text(chain_id: &str, plan: &RegenerationPlan) -> String {
+    let mut out = format!("regeneration plan for {}:\n", chain_id);
+    for (i, (start, step)) in plan.steps.iter().enumerate() {
+        let blocks = |last_block: &Option<u64>| match last_block {
+            Some(last) => format!("blocks {}..={}", start + 1, last),
+            None => format!("blocks from {}, with no last block", start + 1),
+        };
+        let line = match step {
+            RegenerationStep::Migrate { from, to } => {
+                format!("migrate {:?} to {:?}, after block {}", from, to, start)
+            }
+            RegenerationStep::InitThenRunTo {
+                genesis_height,
+                version,
+                last_block,
+            } => format!(
+                "init {:?} with the genesis at height {}, then run {}",
+                version,
+                genesis_height,
+                blocks(last_block)
+            ),
+            RegenerationStep::RunTo {
+                version,
+                last_block,
+            } => format!("run {:?} over {}", version, blocks(last_block)),
+        };
+        out.push_str(&format!("  {}. {}\n", i + 1, line));
+    }
+    out
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn test_penumbra_1_json_matches_plan() {
+        let plan =
+            RegenerationPlan::from_known_chain_id("penumbra-1").expect("the plan should be known");
+        let out = plan_json("penumbra-1", &plan);
+        assert_eq!(out["chain_id"], "penumbra-1");
+        let steps = out["steps"].as_array().expect("steps should be an array");
+        assert_eq!(steps.len(), plan.steps.len());
+        for (i, ((start, step), json)) in plan.steps.iter().zip(steps).enumerate() {
+            assert_eq!(json["step"], i + 1);
+            assert_eq!(json["height"], *start);
+            match step {
+                RegenerationStep::Migrate { from, to } => {
+                    assert_eq!(json["kind"], "migrate");
+                    assert_eq!(json["from"], format!("{:?}", from));
+                    assert_eq!(json["to"], format!("{:?}", to));
+                    assert!(json.get("first_block").is_none());
+                }
+                RegenerationStep::InitThenRunTo {
+                    genesis_height,
+                    version,
+                    last_block,
+                } => {
+                    assert_eq!(json["kind"], "init_then_run_to");
+                    assert_eq!(json["genesis_height"], *genesis_height);
+                    assert_eq!(json["version"], format!("{:?}", version));
+                    assert_eq!(json["first_block"], start + 1);
+                    assert_eq!(json["last_block"], json!(last_block));
+                }
+                RegenerationStep::RunTo { .. } => panic!("penumbra-1 has no plain run steps"),
+            }
+        }
+        // Spot check a boundary, in case the comparison above is broken in the same way.
+        assert_eq!(
+            steps[2],
+            json!({
+                "step": 3,
+                "kind": "init_then_run_to",
+                "height": 501974,
+                "genesis_height": 501975,
+                "version": "V0o80",
+                "first_block": 501975,
+                "last_block": 2611799,
+            })
+        );
+        assert_eq!(
+            steps[7],
+            json!({
+                "step": 8,
+                "kind": "init_then_run_to",
+                "height": 5480872,
+                "genesis_height": 5480873,
+                "version": "V2",
+                "first_block": 5480873,
+                "last_block": null,
+            })
+        );
+    }
+
+    #[test]
+    fn test_json_can_be_read_back() -> anyhow::Result<()> {
+        for chain_id in [
+            "penumbra-1",
+            "penumbra-testnet-phobos-2",
+            "penumbra-testnet-phobos-3",
+        ] {
+            let plan =
+                RegenerationPlan::from_known_chain_id(chain_id).expect("the plan should be known");
+            let read = RegenerationPlan::from_value(&plan_json(chain_id, &plan), chain_id)?;
+            assert_eq!(read.steps, plan.steps);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_text() {
+        let plan = RegenerationPlan::from_known_chain_id("penumbra-testnet-phobos-2")
+            .expect("the plan should be known");
+        assert_eq!(
+            plan_text("penumbra-testnet-phobos-2", &plan),
+            "regeneration plan for penumbra-testnet-phobos-2:
+  1. init V0o80 with the genesis at height 1, then run blocks 1..=1459799
+  2. migrate V0o80 to V1o3, after block 1459799
+  3. init V1o3 with the genesis at height 1459800, then run blocks 1459800..=2358329
+  4. migrate V1o3 to V2, after block 2358329
+  5. init V2 with the genesis at height 2358330, then run blocks from 2358330, with no last block
+"
+        );
+    }
+
+    #[test]
+    fn test_run_to_text() {
+        let plan = RegenerationPlan::penumbra_1().truncate(Some(600000), Some(700000));
+        assert_eq!(
+            plan_text("penumbra-1", &plan),
+            "regeneration plan for penumbra-1:
+  1. run V0o80 over blocks 600001..=700000
+"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_unknown_chain_id() {
+        let cmd = ShowPlan {
+            chain_id: "penumbra-testnet-deimos-8".to_owned(),
+            json: false,
+        };
+        assert!(cmd.run().await.is_err());
+    }
+}
@@ -0,0 +1,412 @@
+use serde_json::{json, Value};
+use std::path::PathBuf;
+
+use crate::cometbft::{self, BlockStoreSizes, LocalStoreOpts};
+use crate::files::archive_filepath_from_opts;
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+#[command(group(clap::ArgGroup::new("node").args(["node_home", "cometbft_dir"])))]
+/// Summarize the size and contents of a local SQLite3 database for Penumbra Reindexer.
+///
+/// This only looks at what the archive says about its blocks, without decoding them,
+/// so it's quick even on a full archive. Use `verify` to check the blocks themselves.
+///
+/// With --node-home or --cometbft-dir, this summarizes the block store of a node instead,
+/// with a histogram of the sizes of its blocks, for sizing the archive made from them.
+pub struct Stats {
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Downloaded large files will be stored within this directory.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id of the archive to summarize. Defaults to `penumbra-1` for mainnet.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// Summarize the block store of the node with this home directory, rather than an archive.
+    ///
+    /// This is the node's cometbft home, or a `pd` home with a cometbft directory in it.
+    #[clap(long, conflicts_with_all = ["home", "archive_file", "chain_id"])]
+    node_home: Option<PathBuf>,
+
+    /// Summarize the block store in this cometbft home directory, rather than an archive.
+    #[clap(long, conflicts_with_all = ["home", "archive_file", "chain_id", "node_home"])]
+    cometbft_dir: Option<PathBuf>,
+
+    /// The name of the database holding the block store of the node, if not `blockstore`.
+    #[clap(long, requires = "node")]
+    blockstore_name: Option<String>,
+
+    /// Print the summary as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+/// What we report about an archive.
+#[derive(Debug, PartialEq)]
+struct ArchiveStats {
+    chain_id: String,
+    /// The lowest and highest blocks, if there are any.
+    heights: Option<(u64, u64)>,
+    block_count: u64,
+    /// The initial heights of the geneses, in ascending order.
+    geneses: Vec<u64>,
+    /// The size of the archive file on disk.
+    file_bytes: u64,
+    /// The size of the data of all blocks together.
+    block_bytes: u64,
+    max_block_bytes: u64,
+    /// The inclusive ranges of heights missing between the lowest and highest blocks.
+    gaps: Vec<(u64, u64)>,
+}
+
+impl ArchiveStats {
+    async fn collect(archive: &Storage, file_bytes: u64) -> anyhow::Result<Self> {
+        let (block_count, block_bytes, max_block_bytes) = archive.block_sizes().await?;
+        let heights = match (archive.first_height().await?, archive.last_height().await?) {
+            (Some(first), Some(last)) => Some((first, last)),
+            _ => None,
+        };
+        Ok(Self {
+            chain_id: archive.chain_id().await?,
+            heights,
+            block_count,
+            geneses: archive.genesis_initial_heights().await?,
+            file_bytes,
+            block_bytes,
+            max_block_bytes,
+            gaps: archive.gaps().await?,
+        })
+    }
+
+    /// The average size of the data of a block, rounded down.
+    fn average_block_bytes(&self) -> u64 {
+        self.block_bytes.checked_div(self.block_count).unwrap_or(0)
+    }
+
+    fn to_json(&self) -> Value {
+        json!({
+            "chain_id": self.chain_id,
+            "first_height": self.heights.map(|x| x.0),
+            "last_height": self.heights.map(|x| x.1),
+            "block_count": self.block_count,
+            "geneses": self.geneses,
+            "file_bytes": self.file_bytes,
+            "block_bytes": self.block_bytes,
+            "average_block_bytes": self.average_block_bytes(),
+            "max_block_bytes": self.max_block_bytes,
+            "gaps": self
+                .gaps
+                .iter()
+                .map(|(start, end)| json!({ "start": start, "end": end }))
+                .collect::<Vec<_>>(),
+        })
+    }
+
+    fn to_text(&self) -> String {
+        let heights = match self.heights {
+            Some((first, last)) => format!("{}..={}", first, last),
+            None => "none".to_owned(),
+        };
+        let list = |items: Vec<String>| match items.len() {
+            0 => "none".to_owned(),
+            n => format!("{}: {}", n, items.join(", ")),
+        };
+        let geneses = list(self.geneses.iter().map(|x| x.to_string()).collect());
+        let gaps = list(
+            self.gaps
+                .iter()
+                .map(|(start, end)| format!("{}..={}", start, end))
+                .collect(),
+        );
+        format!(
+            "archive for '{}':
+  heights:      {}
+  blocks:       {}
+  geneses:      {}
+  file size:    {} bytes
+  block data:   {} bytes in total, {} bytes on average, {} bytes at most
+  gaps:         {}
+",
+            self.chain_id,
+            heights,
+            self.block_count,
+            geneses,
+            self.file_bytes,
+            self.block_bytes,
+            self.average_block_bytes(),
+            self.max_block_bytes,
+            gaps
+        )
+    }
+}
+
+/// What we report about the block store of a node.
+#[derive(Debug, PartialEq)]
+struct BlockStoreStats {
+    /// The cometbft home directory of the node.
+    dir: PathBuf,
+    sizes: BlockStoreSizes,
+}
+
+impl BlockStoreStats {
+    fn average_block_bytes(&self) -> u64 {
+        let blocks = &self.sizes.blocks;
+        blocks
+            .total_bytes
+            .checked_div(blocks.block_count())
+            .unwrap_or(0)
+    }
+
+    fn to_json(&self) -> Value {
+        let blocks = &self.sizes.blocks;
+        json!({
+            "cometbft_dir": self.dir.display().to_string(),
+            "first_height": self.sizes.heights.map(|x| x.0),
+            "last_height": self.sizes.heights.map(|x| x.1),
+            "block_count": blocks.block_count(),
+            "disk_bytes": self.sizes.disk_bytes,
+            "block_bytes": blocks.total_bytes,
+            "average_block_bytes": self.average_block_bytes(),
+            "max_block_bytes": blocks.max_block_bytes,
+            "histogram": blocks
+                .histogram()
+                .into_iter()
+                .map(|(min, max, count)| json!({ "min_bytes": min, "max_bytes": max, "count": count }))
+                .collect::<Vec<_>>(),
+        })
+    }
+
+    fn to_text(&self) -> String {
+        let blocks = &self.sizes.blocks;
+        let heights = match self.sizes.heights {
+            Some((first, last)) => format!("{}..={}", first, last),
+            None => "none".to_owned(),
+        };
+        let disk = match self.sizes.disk_bytes {
+            Some(x) => format!("{} bytes", x),
+            None => "none, the store isn't on disk".to_owned(),
+        };
+        let histogram = blocks.histogram();
+        let mut out = format!(
+            "block store in '{}':
+  heights:      {}
+  blocks:       {}
+  disk size:    {}
+  block data:   {} bytes in total, {} bytes on average, {} bytes at most
+  block sizes:{}
+",
+            self.dir.display(),
+            heights,
+            blocks.block_count(),
+            disk,
+            blocks.total_bytes,
+            self.average_block_bytes(),
+            blocks.max_block_bytes,
+            if histogram.is_empty() { "  none" } else { "" },
+        );
+        // The bars are scaled to the largest bucket, so that it fills them.
+        let largest = histogram.iter().map(|x| x.2).max().unwrap_or(0);
+        for (min, max, count) in histogram {
+            let range = format!("{}..{}", min, max);
+            let bar = "#".repeat((count * 40).div_ceil(largest.max(1)) as usize);
+            let line = format!("    {:>22} bytes: {:>8} {}", range, count, bar);
+            out.push_str(line.trim_end());
+            out.push('\n');
+        }
+        out
+    }
+}
+
+impl Stats {
+    /// Get the cometbft directory of the node to summarize, if one was given.
+    fn cometbft_dir(&self) -> anyhow::Result<Option<PathBuf>> {
+        let out = match (self.node_home.as_ref(), self.cometbft_dir.as_ref()) {
+            (_, Some(x)) => Some(x.to_owned()),
+            (Some(x), None) => Some(cometbft::find_cometbft_dir(x)?),
+            (None, None) => None,
+        };
+        Ok(out)
+    }
+
+    pub async fn run(self) -> anyhow::Result<()> {
+        if let Some(dir) = self.cometbft_dir()? {
+            let opts = LocalStoreOpts {
+                read_only: true,
+                db_name: self.blockstore_name.clone(),
+                ..Default::default()
+            };
+            let stats = BlockStoreStats {
+                sizes: cometbft::read_block_store_sizes(&dir, &opts)?,
+                dir,
+            };
+            if self.json {
+                println!("{}", serde_json::to_string_pretty(&stats.to_json())?);
+            } else {
+                print!("{}", stats.to_text());
+            }
+            return Ok(());
+        }
+        let archive_file = archive_filepath_from_opts(self.home, self.archive_file, self.chain_id)?;
+        crate::files::ensure_archive_exists(&archive_file)?;
+        let archive = Storage::new(Some(&archive_file), None).await?;
+        let stats = ArchiveStats::collect(&archive, archive_file.metadata()?.len()).await?;
+        if self.json {
+            println!("{}", serde_json::to_string_pretty(&stats.to_json())?);
+        } else {
+            print!("{}", stats.to_text());
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{Block, Genesis};
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_stats_match_archive() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-stats-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        let genesis = Genesis::test_value();
+        let mut sizes = Vec::new();
+        {
+            let archive = Storage::new(Some(&path), Some(&genesis.chain_id())).await?;
+            archive.put_genesis(&genesis).await?;
+            archive
+                .put_genesis(&Genesis::test_value_at_height(6))
+                .await?;
+            for (height, count) in [(1, 0), (2, 3), (3, 1), (6, 0), (8, 2), (9, 0)] {
+                let transactions = (0..count).map(|i| vec![i as u8; 100]).collect();
+                let block = Block::test_value_with_transactions(height, transactions);
+                sizes.push(block.encode().len() as u64);
+                archive.put_block(&block).await?;
+            }
+        }
+
+        let archive = Storage::new(Some(&path), None).await?;
+        let stats = ArchiveStats::collect(&archive, 4096).await?;
+        let total: u64 = sizes.iter().sum();
+        let max = *sizes.iter().max().unwrap();
+        assert_eq!(
+            stats,
+            ArchiveStats {
+                chain_id: genesis.chain_id(),
+                heights: Some((1, 9)),
+                block_count: 6,
+                geneses: vec![6, genesis.initial_height()],
+                file_bytes: 4096,
+                block_bytes: total,
+                max_block_bytes: max,
+                gaps: vec![(4, 5), (7, 7)],
+            }
+        );
+        assert_eq!(stats.average_block_bytes(), total / 6);
+
+        let json = stats.to_json();
+        assert_eq!(json["block_count"], 6);
+        assert_eq!(json["first_height"], 1);
+        assert_eq!(json["last_height"], 9);
+        assert_eq!(json["block_bytes"], total);
+        assert_eq!(json["max_block_bytes"], max);
+        assert_eq!(
+            json["gaps"],
+            json!([{ "start": 4, "end": 5 }, { "start": 7, "end": 7 }])
+        );
+        assert!(stats.to_text().contains("gaps:         2: 4..=5, 7..=7\n"));
+
+        drop(archive);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_stats_of_empty_archive() -> anyhow::Result<()> {
+        let archive = Storage::new(None, Some("penumbra-test")).await?;
+        let stats = ArchiveStats::collect(&archive, 0).await?;
+        assert_eq!(stats.heights, None);
+        assert_eq!(stats.block_count, 0);
+        assert_eq!(stats.average_block_bytes(), 0);
+        assert!(stats.gaps.is_empty());
+        let json = stats.to_json();
+        assert_eq!(json["first_height"], Value::Null);
+        assert_eq!(json["gaps"], json!([]));
+        assert!(stats.to_text().contains("heights:      none\n"));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_stats_of_block_store() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let home = cometbft::test_node_home("stats-block-store", true)?;
+        let node_home = home.to_str().expect("test path should be valid UTF-8");
+        let cmd = Stats::try_parse_from(["stats", "--node-home", node_home])?;
+        let dir = cmd.cometbft_dir()?.expect("a node was given");
+        assert_eq!(dir, home.join("cometbft"));
+        cmd.run().await?;
+
+        let opts = LocalStoreOpts {
+            read_only: true,
+            ..Default::default()
+        };
+        let stats = BlockStoreStats {
+            sizes: cometbft::read_block_store_sizes(&dir, &opts)?,
+            dir,
+        };
+        let blocks = &stats.sizes.blocks;
+        assert_eq!(blocks.block_count(), 5);
+        let json = stats.to_json();
+        assert_eq!(json["first_height"], 1);
+        assert_eq!(json["last_height"], 5);
+        assert_eq!(json["block_count"], 5);
+        assert_eq!(json["block_bytes"], blocks.total_bytes);
+        assert_eq!(json["average_block_bytes"], blocks.total_bytes / 5);
+        assert_eq!(json["max_block_bytes"], blocks.max_block_bytes);
+        let histogram = json["histogram"].as_array().expect("histogram is a list");
+        assert_eq!(
+            histogram
+                .iter()
+                .map(|x| x["count"].as_u64().unwrap())
+                .sum::<u64>(),
+            5
+        );
+        // The largest block is in the last bucket.
+        let last = histogram.last().expect("there are blocks");
+        assert!(last["count"].as_u64() > Some(0));
+        assert!(last["min_bytes"].as_u64() <= Some(blocks.max_block_bytes));
+        assert!(last["max_bytes"].as_u64() > Some(blocks.max_block_bytes));
+
+        let text = stats.to_text();
+        assert!(text.contains("  blocks:       5\n"), "{}", text);
+        assert!(text.contains("  block sizes:\n"), "{}", text);
+        assert_eq!(
+            text.lines().filter(|x| x.ends_with('#')).count(),
+            histogram.len() - histogram.iter().filter(|x| x["count"] == 0).count()
+        );
+        std::fs::remove_dir_all(&home)?;
+
+        // The name of the block store only makes sense for a node.
+        assert!(Stats::try_parse_from(["stats", "--blockstore-name", "blocks"]).is_err());
+        assert!(
+            Stats::try_parse_from(["stats", "--node-home", node_home, "--chain-id", "x"]).is_err()
+        );
+        Ok(())
+    }
+}
@@ -0,0 +1,172 @@
+use std::path::PathBuf;
+
+use crate::files::{archive_filepath_from_opts, FileLock};
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+/// Cut an archive down to a maximum height, removing every block above it.
+///
+/// The result is a valid archive, as if archival had stopped at that height, which can be
+/// archived onto again later. Geneses of chains starting above the height are removed too.
+pub struct Truncate {
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id of the archive to truncate. Defaults to `penumbra-1` for mainnet.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// The highest block to keep in the archive.
+    #[clap(long)]
+    max_height: u64,
+}
+
+impl Truncate {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let archive_file =
+            archive_filepath_from_opts(self.home, self.archive_file, self.chain_id.clone())?;
+        crate::files::ensure_archive_exists(&archive_file)?;
+        // Truncating an archive while it's being archived to would leave it with a gap.
+        let lock = FileLock::acquire(&archive_file)?;
+        let archive = Storage::new(Some(&archive_file), self.chain_id.as_deref()).await?;
+        archive.prepare_for_writing(&lock).await?;
+        let removed = archive.truncate(self.max_height).await?;
+        match archive.last_height().await? {
+            None => println!(
+                "✅ removed {} blocks from '{}', which has no blocks left",
+                removed,
+                archive_file.display()
+            ),
+            Some(last) => println!(
+                "✅ removed {} blocks from '{}', which now ends at height {}",
+                removed,
+                archive_file.display(),
+                last
+            ),
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{Block, Genesis};
+    use clap::Parser as _;
+
+    fn test_archive_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-truncate-{}-{}.sqlite",
+            name,
+            std::process::id()
+        ))
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_truncate_archive() -> anyhow::Result<()> {
+        let path = test_archive_path("blocks");
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let archive = Storage::new(Some(&path), Some("penumbra-1")).await?;
+            archive
+                .put_genesis(&Genesis::test_value_at_height(1))
+                .await?;
+            archive
+                .put_genesis(&Genesis::test_value_at_height(6))
+                .await?;
+            for height in 1..=10 {
+                let block = Block::test_value_at_height(height);
+                archive
+                    .put_encoded_block(
+                        height,
+                        &block.encode(),
+                        block.num_txs(),
+                        block.time()?,
+                        Some(format!("extended commit {}", height).as_bytes()),
+                    )
+                    .await?;
+            }
+        }
+
+        let cmd = Truncate::try_parse_from([
+            "truncate",
+            "--archive-file",
+            path.to_str().expect("test path should be valid UTF-8"),
+            "--max-height",
+            "5",
+        ])?;
+        cmd.run().await?;
+
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.first_height().await?, Some(1));
+        assert_eq!(archive.last_height().await?, Some(5));
+        assert_eq!(archive.gaps().await?, vec![]);
+        // What's left reads back intact, with nothing of the removed heights lingering.
+        for height in 1..=5 {
+            assert_eq!(
+                archive.get_block(height).await?,
+                Some(Block::test_value_at_height(height))
+            );
+            assert!(archive.get_extended_commit(height).await?.is_some());
+        }
+        for height in 6..=10 {
+            assert_eq!(archive.get_block(height).await?, None);
+            assert_eq!(archive.get_extended_commit(height).await?, None);
+        }
+        assert_eq!(archive.genesis_initial_heights().await?, vec![1]);
+        let (count, _, _) = archive.block_sizes().await?;
+        assert_eq!(count, 5);
+
+        // The shorter archive can be archived onto again, right after where it now ends.
+        archive.put_block(&Block::test_value_at_height(6)).await?;
+        assert_eq!(archive.last_height().await?, Some(6));
+        drop(archive);
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, Some(6));
+        drop(archive);
+
+        // Truncating below every block empties the archive, but leaves it readable.
+        Truncate::try_parse_from([
+            "truncate",
+            "--archive-file",
+            path.to_str().expect("test path should be valid UTF-8"),
+            "--max-height",
+            "0",
+        ])?
+        .run()
+        .await?;
+        let archive = Storage::new(Some(&path), None).await?;
+        assert_eq!(archive.last_height().await?, None);
+        assert_eq!(archive.chain_id().await?, "penumbra-1");
+        drop(archive);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_missing_archive_is_not_truncated() -> anyhow::Result<()> {
+        let path = test_archive_path("missing");
+        let cmd = Truncate::try_parse_from([
+            "truncate",
+            "--archive-file",
+            path.to_str().expect("test path should be valid UTF-8"),
+            "--max-height",
+            "5",
+        ])?;
+        let err = cmd.run().await.expect_err("there's no archive to truncate");
+        assert_eq!(crate::error::exit_code(&err), 3);
+        assert!(!path.exists());
+        Ok(())
+    }
+}
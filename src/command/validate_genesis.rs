@@ -0,0 +1,138 @@
+use serde_json::{json, Value};
+use std::path::PathBuf;
+
+use crate::files::archive_filepath_from_opts;
+use crate::penumbra::{GenesisCheck, RegenerationPlan};
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+/// Check that an archive has the genesis every step of a regeneration needs, without regenerating.
+///
+/// Each step starting the chain with a genesis needs it to be in the archive, and to be
+/// readable by the version of Penumbra the step runs. `regen` checks this before running
+/// its first step; this reports on every step, including the ones that are fine.
+pub struct ValidateGenesis {
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id whose plan to check. Defaults to the chain id of the archive.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// Read the regeneration plan from a file, rather than using the built-in plan for the chain.
+    #[clap(long)]
+    plan_file: Option<PathBuf>,
+
+    /// Print the results as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+fn checks_json(chain_id: &str, checks: &[GenesisCheck]) -> Value {
+    json!({
+        "chain_id": chain_id,
+        "valid": checks.iter().all(|x| x.problem.is_none()),
+        "steps": checks
+            .iter()
+            .map(|x| json!({
+                "step": x.step,
+                "version": format!("{:?}", x.version),
+                "genesis_height": x.genesis_height,
+                "problem": x.problem,
+            }))
+            .collect::<Vec<_>>(),
+    })
+}
+
+fn checks_text(chain_id: &str, checks: &[GenesisCheck]) -> String {
+    let mut out = format!("geneses for the regeneration plan of {}:\n", chain_id);
+    for check in checks {
+        out.push_str(&format!(
+            "  step {}, starting {:?} at height {}: {}\n",
+            check.step,
+            check.version,
+            check.genesis_height,
+            check.problem.as_deref().unwrap_or("ok")
+        ));
+    }
+    out
+}
+
+impl ValidateGenesis {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let archive_file =
+            archive_filepath_from_opts(self.home, self.archive_file, self.chain_id.clone())?;
+        crate::files::ensure_archive_exists(&archive_file)?;
+        let archive = Storage::new(Some(&archive_file), self.chain_id.as_deref()).await?;
+        let chain_id = archive.chain_id().await?;
+        let plan = RegenerationPlan::load(&chain_id, self.plan_file.as_deref())?;
+        let checks = plan.check_geneses(&archive).await?;
+        if self.json {
+            println!(
+                "{}",
+                serde_json::to_string_pretty(&checks_json(&chain_id, &checks))?
+            );
+        } else {
+            print!("{}", checks_text(&chain_id, &checks));
+        }
+        let bad: Vec<String> = checks
+            .iter()
+            .filter(|x| x.problem.is_some())
+            .map(|x| x.step.to_string())
+            .collect();
+        if !bad.is_empty() {
+            anyhow::bail!(
+                "the archive lacks a usable genesis for step(s) {}",
+                bad.join(", ")
+            );
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::Genesis;
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_absent_genesis_is_reported_by_step() -> anyhow::Result<()> {
+        let archive = Storage::new(None, Some("penumbra-testnet-phobos-2")).await?;
+        for height in [1, 2358330] {
+            archive
+                .put_genesis(&Genesis::test_value_at_height(height))
+                .await?;
+        }
+        let plan = RegenerationPlan::penumbra_testnet_phobos_2();
+        let checks = plan.check_geneses(&archive).await?;
+
+        let json = checks_json("penumbra-testnet-phobos-2", &checks);
+        assert_eq!(json["valid"], false);
+        assert_eq!(json["steps"][0]["problem"], Value::Null);
+        assert_eq!(json["steps"][1]["step"], 3);
+        assert_eq!(
+            json["steps"][1]["problem"],
+            "the archive has no genesis at that height"
+        );
+
+        let text = checks_text("penumbra-testnet-phobos-2", &checks);
+        assert_eq!(
+            text,
+            "geneses for the regeneration plan of penumbra-testnet-phobos-2:
+  step 1, starting V0o80 at height 1: ok
+  step 3, starting V1o3 at height 1459800: the archive has no genesis at that height
+  step 5, starting V2 at height 2358330: ok
+"
+        );
+        Ok(())
+    }
+}
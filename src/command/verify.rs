@@ -0,0 +1,1032 @@
+use anyhow::Context as _;
+use std::collections::{BTreeSet, HashMap};
+use std::hash::{BuildHasher as _, Hasher as _};
+use std::path::{Path, PathBuf};
+use tokio_stream::StreamExt as _;
+
+use crate::cometbft::Block;
+use crate::files::archive_filepath_from_opts;
+use crate::indexer::{Indexer, IndexerOpts};
+use crate::manifest::{manifest_path, ContentHasher, Manifest};
+use crate::object_store::ObjectStore;
+use crate::storage::Storage;
+use crate::stream::{index_path, StreamReader};
+
+#[derive(clap::Parser)]
+/// Walk every block in a local SQLite3 database for Penumbra Reindexer, decoding each one.
+///
+/// Unlike `check`, which only looks at which heights are present, this reads the archive
+/// in full, failing at the height of the first missing or broken block, or the first
+/// block or genesis for a different chain.
+///
+/// With `--sample`, only some of the blocks are decoded: that many heights chosen at random,
+/// along with the first and last blocks, and those on either side of each genesis. Contiguity
+/// is still checked for every height, from what the archive records, without reading the blocks.
+///
+/// If the archive has a manifest next to it, as `archive` writes, the archive is also checked
+/// against it, failing if they disagree. With `--sample`, the manifest's content hash isn't
+/// checked, since that means reading every block.
+///
+/// With `--stream-file`, this verifies a stream written by `archive` instead, reading the blocks
+/// at sampled heights through the index next to the stream.
+///
+/// With `--database-url`, the database `regen` indexes into is checked against the archive too,
+/// failing at the first block it has indexed without a row in `tx_results` for each of the
+/// transactions of the block, as a block only partly inserted would be.
+///
+/// With `--s3-url`, what's verified is first downloaded from where `archive --s3-url` uploaded it,
+/// to the archive file, or stream file, given, replacing what's there.
+pub struct Verify {
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Downloaded large files will be stored within this directory.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id of the archive to verify. Defaults to `penumbra-1` for mainnet.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// Verify a stream of blocks, as written by `archive --output-format ndproto` or `ndjson`.
+    ///
+    /// Streams have no geneses, so their blocks are checked against --chain-id, if given,
+    /// or else the chain of their first block.
+    #[clap(long, conflicts_with_all = ["home", "archive_file"])]
+    stream_file: Option<PathBuf>,
+
+    /// Only decode this many randomly chosen blocks, besides the first, last, and upgrade boundaries.
+    #[clap(long)]
+    sample: Option<u64>,
+
+    /// The seed for choosing the heights of --sample, to check the same ones again.
+    ///
+    /// Defaults to a different one each run, which gets printed.
+    #[clap(long, requires = "sample")]
+    sample_seed: Option<u64>,
+
+    /// Allow the archive to start after the genesis of its chain, for an intentionally partial archive.
+    ///
+    /// By default, the blocks of an archive of a known chain must start at the genesis height
+    /// of the chain, so that it can be regenerated in full. With this, they may start anywhere
+    /// from the first genesis in the archive on, and must be contiguous from there.
+    #[clap(long, conflicts_with = "stream_file")]
+    allow_partial: bool,
+
+    /// The key the archive is encrypted with, if it's encrypted, as given to `archive`.
+    #[clap(long, conflicts_with_all = ["key_file", "stream_file"])]
+    encryption_key: Option<String>,
+
+    /// Read the key the archive is encrypted with from this file, ignoring a trailing newline.
+    #[clap(long, conflicts_with = "stream_file")]
+    key_file: Option<PathBuf>,
+
+    /// The URL of a database `regen` has indexed the archive into, to check against the archive.
+    ///
+    /// Each block the database has must have as many rows in `tx_results` as the archived
+    /// block has transactions. Blocks the database hasn't indexed yet are left out, so that
+    /// this can check a database partway through regeneration. The database isn't changed.
+    #[clap(long, conflicts_with_all = ["stream_file", "sample"])]
+    database_url: Option<String>,
+
+    /// Download the archive, with its manifest, from an S3-compatible object store first.
+    ///
+    /// Given as `s3://<BUCKET>/<PREFIX>`, as to `archive --s3-url`, and configured the same way,
+    /// by the environment. With --stream-file, the stream is downloaded, with its index.
+    #[clap(long)]
+    s3_url: Option<String>,
+}
+
+/// How many blocks to compare with the database at once, when checking their transactions.
+const TX_COUNT_BATCH: usize = 10_000;
+
+/// Check that a block decodes, claims to be at the height it's stored at, and is for our chain,
+/// returning it.
+fn check_block(height: u64, data: &[u8], chain_id: &str) -> anyhow::Result<Block> {
+    let block = Block::decode(data)
+        .with_context(|| format!("failed to decode block at height {}", height))?;
+    anyhow::ensure!(
+        block.height() == height,
+        "block stored at height {} is actually for height {}",
+        height,
+        block.height()
+    );
+    anyhow::ensure!(
+        block.chain_id() == chain_id,
+        "block at height {} is for chain '{}', but the archive is for '{}'",
+        height,
+        block.chain_id(),
+        chain_id
+    );
+    Ok(block)
+}
+
+/// Find the first block the database has indexed a different number of transactions for
+/// than the archived block has, given how many each has, by height, in order.
+///
+/// This returns the height, with the number of transactions archived, and indexed.
+/// Heights only one side has are left out.
+fn first_tx_count_mismatch(
+    archived: &[(u64, u64)],
+    indexed: &[(u64, u64)],
+) -> Option<(u64, u64, u64)> {
+    let archived: HashMap<u64, u64> = archived.iter().copied().collect();
+    indexed.iter().find_map(|&(height, count)| {
+        let expected = *archived.get(&height)?;
+        (expected != count).then_some((height, expected, count))
+    })
+}
+
+/// Check a batch of archived blocks, with how many transactions each has, against what
+/// the database has indexed for them, emptying it, and returning how many it has indexed.
+async fn check_tx_counts(indexer: &Indexer, batch: &mut Vec<(u64, u64)>) -> anyhow::Result<u64> {
+    let (Some(&(first, _)), Some(&(last, _))) = (batch.first(), batch.last()) else {
+        return Ok(0);
+    };
+    let indexed = indexer.tx_counts(first, last).await?;
+    if let Some((height, archived, count)) = first_tx_count_mismatch(batch, &indexed) {
+        anyhow::bail!(
+            "the database has {} rows in tx_results for the block at height {}, but the block has {} transactions",
+            count,
+            height,
+            archived
+        );
+    }
+    batch.clear();
+    Ok(indexed.len() as u64)
+}
+
+/// Check an archive against its manifest, if it has one, printing that it matches.
+///
+/// The content hash of the archive is only compared if it's given, having been computed
+/// while reading the archive in full.
+async fn check_manifest(
+    manifest: Option<&Manifest>,
+    archive: &Storage,
+    content_hash: Option<String>,
+) -> anyhow::Result<()> {
+    let Some(expected) = manifest else {
+        return Ok(());
+    };
+    let mut actual = Manifest::without_content_hash(archive, None).await?;
+    if let Some(content_hash) = content_hash {
+        actual.content_hash = content_hash;
+    }
+    let mismatches = expected.mismatches(&actual);
+    anyhow::ensure!(
+        mismatches.is_empty(),
+        "the archive doesn't match its manifest: {}",
+        mismatches.join("; ")
+    );
+    if actual.content_hash.is_empty() {
+        println!("✅ archive matches its manifest, leaving out the content hash");
+    } else {
+        println!(
+            "✅ archive matches its manifest, with content hash {}",
+            actual.content_hash
+        );
+    }
+    Ok(())
+}
+
+/// A small generator of pseudo-random numbers, which is plenty for picking heights.
+///
+/// This is splitmix64.
+pub(super) struct SplitMix64(pub(super) u64);
+
+impl SplitMix64 {
+    pub(super) fn next(&mut self) -> u64 {
+        self.0 = self.0.wrapping_add(0x9e3779b97f4a7c15);
+        let mut z = self.0;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58476d1ce4e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d049bb133111eb);
+        z ^ (z >> 31)
+    }
+}
+
+/// Choose the heights to check between two heights, inclusive: `count` of them at random,
+/// and every boundary in the range, along with the heights just before them.
+///
+/// The first and last heights are always included, as are all heights, if there are no more
+/// of them than we'd choose anyway.
+fn sample_heights(first: u64, last: u64, boundaries: &[u64], count: u64, seed: u64) -> Vec<u64> {
+    let mut out = BTreeSet::from([first, last]);
+    for &boundary in boundaries {
+        for height in [boundary.saturating_sub(1), boundary] {
+            if (first..=last).contains(&height) {
+                out.insert(height);
+            }
+        }
+    }
+    let span = last - first + 1;
+    if span <= count.saturating_add(out.len() as u64) {
+        return (first..=last).collect();
+    }
+    let mut rng = SplitMix64(seed);
+    let target = out.len() as u64 + count;
+    while (out.len() as u64) < target {
+        out.insert(first + rng.next() % span);
+    }
+    out.into_iter().collect()
+}
+
+/// Where the blocks being verified are read from.
+enum BlockSource<'a> {
+    Archive(&'a Storage),
+    Stream(&'a mut StreamReader),
+}
+
+impl BlockSource<'_> {
+    async fn get_encoded_block(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        match self {
+            Self::Archive(archive) => archive.get_encoded_block(height).await,
+            Self::Stream(stream) => stream.get_encoded_block(height),
+        }
+    }
+
+    async fn gaps(&mut self) -> anyhow::Result<Vec<(u64, u64)>> {
+        match self {
+            Self::Archive(archive) => archive.gaps().await,
+            Self::Stream(stream) => stream.gaps(),
+        }
+    }
+}
+
+/// What checking a sample of the blocks in an archive found.
+#[derive(Debug)]
+struct SampleReport {
+    heights: Vec<u64>,
+    /// The inclusive ranges of heights missing from the archive, found without reading blocks.
+    gaps: Vec<(u64, u64)>,
+    /// The sampled heights which failed their checks, and why.
+    failures: Vec<(u64, String)>,
+}
+
+impl SampleReport {
+    async fn collect(
+        source: &mut BlockSource<'_>,
+        chain_id: &str,
+        first: u64,
+        last: u64,
+        boundaries: &[u64],
+        count: u64,
+        seed: u64,
+    ) -> anyhow::Result<Self> {
+        let heights = sample_heights(first, last, boundaries, count, seed);
+        let mut failures = Vec::new();
+        for &height in &heights {
+            let problem = match source.get_encoded_block(height).await? {
+                None => Some("the block is missing".to_owned()),
+                Some(data) => check_block(height, &data, chain_id)
+                    .err()
+                    .map(|e| format!("{:#}", e)),
+            };
+            if let Some(problem) = problem {
+                failures.push((height, problem));
+            }
+        }
+        Ok(Self {
+            heights,
+            gaps: source.gaps().await?,
+            failures,
+        })
+    }
+
+    fn is_ok(&self) -> bool {
+        self.gaps.is_empty() && self.failures.is_empty()
+    }
+
+    fn to_text(&self) -> String {
+        let mut out = format!(
+            "sampled {} heights: {}\n",
+            self.heights.len(),
+            self.heights
+                .iter()
+                .map(|x| x.to_string())
+                .collect::<Vec<_>>()
+                .join(", ")
+        );
+        for (start, end) in &self.gaps {
+            out.push_str(&format!(
+                "  blocks are missing from height {} to height {}\n",
+                start, end
+            ));
+        }
+        for (height, problem) in &self.failures {
+            out.push_str(&format!("  height {}: {}\n", height, problem));
+        }
+        out
+    }
+}
+
+impl Verify {
+    /// Download what this verifies, and the files next to it, from an object store.
+    async fn download(&self, store: &ObjectStore) -> anyhow::Result<()> {
+        if let Some(stream_file) = &self.stream_file {
+            return store
+                .download(stream_file, &[index_path(stream_file)])
+                .await;
+        }
+        let archive_file = archive_filepath_from_opts(
+            self.home.clone(),
+            self.archive_file.clone(),
+            self.chain_id.clone(),
+        )?;
+        store
+            .download(&archive_file, &[manifest_path(&archive_file)])
+            .await
+    }
+
+    pub async fn run(self) -> anyhow::Result<()> {
+        if let Some(url) = &self.s3_url {
+            self.download(&ObjectStore::from_env(url)?).await?;
+        }
+        if let Some(stream_file) = &self.stream_file {
+            return Self::run_stream(
+                stream_file,
+                self.chain_id.as_deref(),
+                self.sample,
+                self.sample_seed,
+            )
+            .await;
+        }
+        let archive_file = archive_filepath_from_opts(self.home, self.archive_file, self.chain_id)?;
+        crate::files::ensure_archive_exists(&archive_file)?;
+        tracing::info!("verifying archive: {}", archive_file.display());
+
+        let key =
+            crate::files::archive_key_from_opts(self.encryption_key, self.key_file.as_deref())?;
+        let archive = Storage::with_key(Some(&archive_file), None, key.as_ref()).await?;
+        if let Some(version) = archive.reindexer_version().await? {
+            tracing::info!("archive was created by penumbra-reindexer {}", version);
+        }
+        let manifest = Manifest::read(&manifest_path(&archive_file))?;
+        let indexer = match &self.database_url {
+            Some(url) => Some(Indexer::connect(url, IndexerOpts::default()).await?),
+            None => None,
+        };
+        // The content hash is only worth computing when there's a manifest to compare it to.
+        let mut hasher = manifest.as_ref().map(|_| ContentHasher::default());
+        let chain_id = archive.chain_id().await?;
+        let lowest = archive.first_height().await?;
+        if let Some(lowest) = lowest.filter(|_| !self.allow_partial) {
+            crate::check::check_starts_at_genesis(&chain_id, lowest)?;
+        }
+
+        let initial_heights = archive.genesis_initial_heights().await?;
+        let first_genesis = *initial_heights
+            .first()
+            .ok_or(anyhow::anyhow!("archive contains no genesis"))?;
+        // Blocks before the first genesis have nothing to run them, even in a partial archive.
+        if let Some(lowest) = lowest {
+            anyhow::ensure!(
+                lowest >= first_genesis,
+                "block at height {} precedes the first genesis, at height {}",
+                lowest,
+                first_genesis
+            );
+        }
+        let first_height = match lowest {
+            Some(lowest) if self.allow_partial => lowest,
+            _ => first_genesis,
+        };
+        for &initial_height in &initial_heights {
+            let genesis = archive
+                .get_genesis(initial_height)
+                .await?
+                .ok_or(anyhow::anyhow!(
+                    "genesis at initial height {} disappeared",
+                    initial_height
+                ))?;
+            anyhow::ensure!(
+                genesis.chain_id() == chain_id,
+                "genesis at initial height {} is for chain '{}', but the archive is for '{}'",
+                initial_height,
+                genesis.chain_id(),
+                chain_id
+            );
+            if let Some(hasher) = hasher.as_mut() {
+                hasher.add(initial_height, &genesis.encode()?);
+            }
+        }
+
+        if let Some(count) = self.sample {
+            check_manifest(manifest.as_ref(), &archive, None).await?;
+            let Some(last_height) = archive.last_height().await? else {
+                println!(
+                    "✅ archive for '{}' is valid, but contains no blocks",
+                    chain_id
+                );
+                return Ok(());
+            };
+            return Self::run_sample(
+                &mut BlockSource::Archive(&archive),
+                &chain_id,
+                (first_height, last_height),
+                &initial_heights,
+                count,
+                self.sample_seed,
+            )
+            .await;
+        }
+
+        let mut expected = first_height;
+        let mut tx_counts = Vec::new();
+        let mut indexed = 0;
+        let mut blocks = archive.stream_encoded_blocks();
+        while let Some((height, data)) = blocks.try_next().await? {
+            anyhow::ensure!(
+                height == expected,
+                "blocks are missing from height {} to height {}",
+                expected,
+                height - 1
+            );
+            let block = check_block(height, &data, &chain_id)?;
+            if let Some(hasher) = hasher.as_mut() {
+                hasher.add(height, &data);
+            }
+            if let Some(indexer) = &indexer {
+                tx_counts.push((height, block.num_txs() as u64));
+                if tx_counts.len() >= TX_COUNT_BATCH {
+                    indexed += check_tx_counts(indexer, &mut tx_counts).await?;
+                }
+            }
+            if (height - first_height) % 100_000 == 0 {
+                tracing::info!("verified block {}", height);
+            }
+            expected = height + 1;
+        }
+        drop(blocks);
+        check_manifest(
+            manifest.as_ref(),
+            &archive,
+            hasher.map(ContentHasher::finish),
+        )
+        .await?;
+        if let Some(indexer) = &indexer {
+            indexed += check_tx_counts(indexer, &mut tx_counts).await?;
+            println!(
+                "✅ the database has the transactions of each of the {} blocks it has indexed",
+                indexed
+            );
+        }
+
+        if expected == first_height {
+            println!(
+                "✅ archive for '{}' is valid, but contains no blocks",
+                chain_id
+            );
+        } else {
+            println!(
+                "✅ verified {} blocks for '{}', from height {} to height {}",
+                expected - first_height,
+                chain_id,
+                first_height,
+                expected - 1
+            );
+        }
+        Ok(())
+    }
+
+    async fn run_stream(
+        stream_file: &Path,
+        chain_id: Option<&str>,
+        sample: Option<u64>,
+        seed: Option<u64>,
+    ) -> anyhow::Result<()> {
+        tracing::info!("verifying stream: {}", stream_file.display());
+        let mut stream = StreamReader::open(stream_file)?;
+        let Some((first_height, last_height)) = stream.height_range()? else {
+            println!(
+                "✅ stream '{}' is valid, but contains no blocks",
+                stream_file.display()
+            );
+            return Ok(());
+        };
+        let chain_id = match chain_id {
+            Some(chain_id) => chain_id.to_owned(),
+            None => {
+                let data = stream
+                    .get_encoded_block(first_height)?
+                    .ok_or(anyhow::anyhow!("the first block of the stream disappeared"))?;
+                Block::decode(&data)
+                    .with_context(|| format!("failed to decode block at height {}", first_height))?
+                    .chain_id()
+            }
+        };
+
+        if let Some(count) = sample {
+            return Self::run_sample(
+                &mut BlockSource::Stream(&mut stream),
+                &chain_id,
+                (first_height, last_height),
+                &[],
+                count,
+                seed,
+            )
+            .await;
+        }
+
+        let mut expected = first_height;
+        for block in stream.blocks() {
+            let (height, data) = block?;
+            anyhow::ensure!(
+                height >= expected,
+                "block at height {} comes after the block at height {}",
+                height,
+                expected - 1
+            );
+            anyhow::ensure!(
+                height == expected,
+                "blocks are missing from height {} to height {}",
+                expected,
+                height - 1
+            );
+            check_block(height, &data, &chain_id)?;
+            if (height - first_height) % 100_000 == 0 {
+                tracing::info!("verified block {}", height);
+            }
+            expected = height + 1;
+        }
+        println!(
+            "✅ verified {} blocks for '{}', from height {} to height {}",
+            expected - first_height,
+            chain_id,
+            first_height,
+            expected - 1
+        );
+        Ok(())
+    }
+
+    async fn run_sample(
+        source: &mut BlockSource<'_>,
+        chain_id: &str,
+        (first_height, last_height): (u64, u64),
+        boundaries: &[u64],
+        count: u64,
+        seed: Option<u64>,
+    ) -> anyhow::Result<()> {
+        let seed = seed.unwrap_or_else(|| {
+            std::collections::hash_map::RandomState::new()
+                .build_hasher()
+                .finish()
+        });
+        println!("sampling with seed {}", seed);
+        let report = SampleReport::collect(
+            source,
+            chain_id,
+            first_height,
+            last_height,
+            boundaries,
+            count,
+            seed,
+        )
+        .await?;
+        print!("{}", report.to_text());
+        anyhow::ensure!(
+            report.is_ok(),
+            "the sample failed verification, at {} heights, with {} gaps",
+            report.failures.len(),
+            report.gaps.len()
+        );
+        println!(
+            "✅ verified a sample of {} blocks for '{}', from height {} to height {}, with no gaps",
+            report.heights.len(),
+            chain_id,
+            first_height,
+            last_height
+        );
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::Genesis;
+    use crate::stream::{index_path, BlockWriter, StreamFormat};
+
+    const CHAIN_ID: &str = "penumbra-1";
+
+    #[test]
+    fn test_sample_always_includes_boundaries() {
+        let boundaries = [1, 501975, 2611800];
+        for seed in 0..100 {
+            for count in [0, 1, 10] {
+                let heights = sample_heights(1, 3_000_000, &boundaries, count, seed);
+                for height in [1, 501974, 501975, 2611799, 2611800, 3_000_000] {
+                    assert!(
+                        heights.contains(&height),
+                        "height {} missing with seed {} and count {}",
+                        height,
+                        seed,
+                        count
+                    );
+                }
+                assert_eq!(heights.len() as u64, 6 + count);
+                assert!(heights.windows(2).all(|x| x[0] < x[1]));
+            }
+        }
+    }
+
+    #[test]
+    fn test_sample_of_small_range_is_everything() {
+        assert_eq!(
+            sample_heights(3, 8, &[5], 2, 0),
+            (3..=8).collect::<Vec<_>>()
+        );
+        assert_eq!(sample_heights(3, 3, &[1], 0, 0), vec![3]);
+        // Boundaries outside the range don't sneak in.
+        assert_eq!(sample_heights(10, 20, &[1, 30], 0, 0), vec![10, 20]);
+    }
+
+    #[test]
+    fn test_sample_is_reproducible_from_its_seed() {
+        let a = sample_heights(1, 1_000_000, &[], 20, 42);
+        assert_eq!(a, sample_heights(1, 1_000_000, &[], 20, 42));
+        assert_ne!(a, sample_heights(1, 1_000_000, &[], 20, 43));
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_sample_finds_broken_boundary_and_gap() -> anyhow::Result<()> {
+        let archive = Storage::new(None, Some(CHAIN_ID)).await?;
+        for height in [1, 11] {
+            archive
+                .put_genesis(&Genesis::test_value_at_height(height))
+                .await?;
+        }
+        for height in (1..=20).filter(|x| *x != 15) {
+            let data = match height {
+                // The first block after the upgrade is for the wrong height.
+                11 => Block::test_value_at_height(12).encode(),
+                _ => Block::test_value_at_height(height).encode(),
+            };
+            archive.put_encoded_block(height, &data, 0, 0, None).await?;
+        }
+        let report = SampleReport::collect(
+            &mut BlockSource::Archive(&archive),
+            CHAIN_ID,
+            1,
+            20,
+            &[1, 11],
+            0,
+            7,
+        )
+        .await?;
+        assert_eq!(report.heights, vec![1, 10, 11, 20]);
+        assert_eq!(report.gaps, vec![(15, 15)]);
+        assert_eq!(
+            report.failures,
+            vec![(
+                11,
+                "block stored at height 11 is actually for height 12".to_owned()
+            )]
+        );
+        assert!(!report.is_ok());
+        let text = report.to_text();
+        assert!(
+            text.starts_with("sampled 4 heights: 1, 10, 11, 20\n"),
+            "{}",
+            text
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_sample_of_stream_reads_through_its_index() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-verify-stream-{}",
+            std::process::id()
+        ));
+        let mut writer = BlockWriter::create(StreamFormat::Proto, Some(&path))?;
+        for height in (1..=20).filter(|x| *x != 15) {
+            let block = Block::test_value_at_height(height);
+            writer.write(&block, &block.encode())?;
+        }
+        writer.flush()?;
+        drop(writer);
+
+        let mut stream = StreamReader::open(&path)?;
+        let report = SampleReport::collect(
+            &mut BlockSource::Stream(&mut stream),
+            CHAIN_ID,
+            1,
+            20,
+            &[],
+            3,
+            7,
+        )
+        .await?;
+        assert_eq!(report.heights.len(), 5);
+        assert_eq!(report.gaps, vec![(15, 15)]);
+        // The missing height is the only one which can fail.
+        assert!(report
+            .failures
+            .iter()
+            .all(|(height, problem)| *height == 15 && problem == "the block is missing"));
+        drop(stream);
+        std::fs::remove_file(index_path(&path))?;
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_tx_count_mismatch_is_found_at_first_height() {
+        let archived = [(1, 0), (2, 3), (3, 1), (4, 2), (5, 0)];
+        assert_eq!(first_tx_count_mismatch(&archived, &archived), None);
+        // Blocks the database hasn't indexed are left out.
+        assert_eq!(first_tx_count_mismatch(&archived, &[(1, 0), (2, 3)]), None);
+        assert_eq!(first_tx_count_mismatch(&archived, &[]), None);
+        // As are those it indexed beyond the archive.
+        assert_eq!(first_tx_count_mismatch(&archived, &[(5, 0), (6, 4)]), None);
+        let indexed = [(1, 0), (2, 3), (3, 0), (4, 2), (5, 1)];
+        assert_eq!(
+            first_tx_count_mismatch(&archived, &indexed),
+            Some((3, 1, 0))
+        );
+    }
+
+    /// The database to run the tests needing Postgres against, which they're skipped without.
+    ///
+    /// These tests drop the indexing tables, so this shouldn't point at anything important.
+    const TEST_DATABASE_URL_VAR: &str = "PENUMBRA_REINDEXER_TEST_DATABASE_URL";
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_database_is_checked_for_partly_indexed_block() -> anyhow::Result<()> {
+        use crate::tendermint_compat::ResponseDeliverTx;
+        use clap::Parser as _;
+
+        let Ok(url) = std::env::var(TEST_DATABASE_URL_VAR) else {
+            eprintln!("skipping test, as {} isn't set", TEST_DATABASE_URL_VAR);
+            return Ok(());
+        };
+        let clear = || async {
+            let pool = sqlx::PgPool::connect(&url).await?;
+            sqlx::query(
+                "DROP TABLE IF EXISTS blocks, tx_results, events, attributes, debug.app_hash CASCADE",
+            )
+            .execute(&pool)
+            .await?;
+            pool.close().await;
+            anyhow::Ok(())
+        };
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-verify-tx-counts-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        let archive = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        archive
+            .put_genesis(&Genesis::test_value_at_height(1))
+            .await?;
+        clear().await?;
+        let mut indexer = Indexer::init(&url, CHAIN_ID, IndexerOpts::default()).await?;
+        for height in 1..=5 {
+            let transactions: Vec<Vec<u8>> = (0..height % 3)
+                .map(|i| format!("transaction {} at {}", i, height).into_bytes())
+                .collect();
+            // The last block is archived, but not indexed yet.
+            if height < 5 {
+                indexer.enter_block(height, CHAIN_ID).await?;
+                for (i, tx) in transactions.iter().enumerate() {
+                    indexer
+                        .events(
+                            height,
+                            Vec::new(),
+                            Some((i, tx, ResponseDeliverTx::default())),
+                        )
+                        .await?;
+                }
+                indexer.end_block(b"app hash").await?;
+            }
+            archive
+                .put_block(&Block::test_value_with_transactions(height, transactions))
+                .await?;
+        }
+        drop(indexer);
+        let verify = || {
+            Verify::try_parse_from([
+                "verify",
+                "--archive-file",
+                path.to_str().expect("test path should be valid UTF-8"),
+                "--database-url",
+                url.as_str(),
+            ])
+        };
+        verify()?.run().await?;
+
+        // Lose one of the transactions of a block, as a partial insert would.
+        let pool = sqlx::PgPool::connect(&url).await?;
+        sqlx::query(
+            "DELETE FROM tx_results WHERE index = 1 AND block_id IN (SELECT rowid FROM blocks WHERE height = 2)",
+        )
+        .execute(&pool)
+        .await?;
+        pool.close().await;
+        let err = verify()?
+            .run()
+            .await
+            .expect_err("a block missing a transaction in the database should fail verification");
+        assert!(
+            err.to_string().contains(
+                "the database has 1 rows in tx_results for the block at height 2, but the block has 2 transactions"
+            ),
+            "{:#}",
+            err
+        );
+
+        drop(archive);
+        clear().await?;
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    /// Verify an archive with a genesis at height 1, and blocks between two heights.
+    async fn verify_archive(
+        name: &str,
+        first: u64,
+        last: u64,
+        args: &[&str],
+    ) -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-verify-{}-{}.sqlite",
+            name,
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let archive = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            archive
+                .put_genesis(&Genesis::test_value_at_height(1))
+                .await?;
+            for height in first..=last {
+                archive
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+        }
+        let mut argv = vec![
+            "verify",
+            "--archive-file",
+            path.to_str().expect("test path should be valid UTF-8"),
+        ];
+        argv.extend_from_slice(args);
+        let out = Verify::try_parse_from(argv)?.run().await;
+        std::fs::remove_file(&path)?;
+        out
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_must_start_at_genesis() -> anyhow::Result<()> {
+        verify_archive("aligned", 1, 10, &[]).await?;
+        verify_archive("aligned-sample", 1, 10, &["--sample", "3"]).await?;
+
+        // An archive starting mid-history can't be regenerated in full.
+        let cases: [&[&str]; 2] = [&[], &["--sample", "3"]];
+        for args in cases {
+            let err = verify_archive("partial", 5, 10, args)
+                .await
+                .expect_err("an archive starting above genesis should fail verification");
+            assert_eq!(crate::error::exit_code(&err), 7);
+            assert!(err.to_string().contains("starts at height 5"), "{:#}", err);
+        }
+
+        // Unless it's meant to be partial, in which case it's checked from its first block on.
+        verify_archive("partial-allowed", 5, 10, &["--allow-partial"]).await?;
+        verify_archive(
+            "partial-allowed-sample",
+            5,
+            10,
+            &["--allow-partial", "--sample", "3"],
+        )
+        .await?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_is_checked_against_its_manifest() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-verify-manifest-{}.sqlite",
+            std::process::id()
+        ));
+        for x in [path.clone(), manifest_path(&path)] {
+            if x.exists() {
+                std::fs::remove_file(&x)?;
+            }
+        }
+        let archive = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        archive
+            .put_genesis(&Genesis::test_value_at_height(1))
+            .await?;
+        for height in 1..=5 {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        crate::manifest::write_manifest(&path, &archive).await?;
+        let verify = |args: &[&str]| {
+            let mut argv = vec![
+                "verify",
+                "--archive-file",
+                path.to_str().expect("test path should be valid UTF-8"),
+            ];
+            argv.extend_from_slice(args);
+            Verify::try_parse_from(argv)
+        };
+        verify(&[])?.run().await?;
+        verify(&["--sample", "1"])?.run().await?;
+
+        // A block replaced by a different one only changes the content hash,
+        // which a sample doesn't check.
+        archive.truncate(4).await?;
+        archive.put_block(&Block::test_value_at_time(5, 1)).await?;
+        let err = verify(&[])?
+            .run()
+            .await
+            .expect_err("an archive differing from its manifest should fail verification");
+        assert!(err.to_string().contains("content hash"), "{:#}", err);
+        verify(&["--sample", "1"])?.run().await?;
+
+        // Extra blocks are caught either way.
+        crate::manifest::write_manifest(&path, &archive).await?;
+        archive.put_block(&Block::test_value_at_height(6)).await?;
+        for args in [&[][..], &["--sample", "1"]] {
+            let err = verify(args)?
+                .run()
+                .await
+                .expect_err("an archive differing from its manifest should fail verification");
+            assert!(
+                err.to_string()
+                    .contains("the manifest has 5 blocks, but the archive has 6"),
+                "{:#}",
+                err
+            );
+        }
+        drop(archive);
+        std::fs::remove_file(manifest_path(&path))?;
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_is_read_back_from_object_store() -> anyhow::Result<()> {
+        use crate::object_store::mock::{self, MockS3};
+        use clap::Parser as _;
+        use std::sync::{Arc, Mutex};
+
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-verify-s3-{}",
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        let uploaded = dir.join("uploaded").join("archive.sqlite");
+        std::fs::create_dir_all(dir.join("uploaded"))?;
+        let archive = Storage::new(Some(&uploaded), Some(CHAIN_ID)).await?;
+        archive
+            .put_genesis(&Genesis::test_value_at_height(1))
+            .await?;
+        for height in 1..=5 {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        crate::manifest::write_manifest(&uploaded, &archive).await?;
+        drop(archive);
+        let s3 = Arc::new(Mutex::new(MockS3::default()));
+        let store = mock::store(&mock::serve(s3.clone()).await?, "s3://archives/penumbra-1")?;
+        store.upload(&uploaded, &[manifest_path(&uploaded)]).await?;
+
+        // The archive is downloaded by its name, into a directory which doesn't exist yet.
+        let downloaded = dir.join("downloaded").join("archive.sqlite");
+        let verify = Verify::try_parse_from([
+            "verify",
+            "--archive-file",
+            downloaded
+                .to_str()
+                .expect("test path should be valid UTF-8"),
+        ])?;
+        verify.download(&store).await?;
+        assert_eq!(std::fs::read(&downloaded)?, std::fs::read(&uploaded)?);
+        assert!(manifest_path(&downloaded).exists());
+        verify.run().await?;
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+}
@@ -0,0 +1,271 @@
+use serde_json::{json, Value};
+use std::path::PathBuf;
+
+use crate::files::archive_filepath_from_opts;
+use crate::penumbra::{RegenerationPlan, RegenerationStep, Version};
+use crate::storage::Storage;
+
+#[derive(clap::Parser)]
+/// List the versions of Penumbra the blocks of an archive span, and which heights each one runs.
+///
+/// This follows the regeneration plan for the chain, so each version listed is a step that
+/// `regen` runs over the archive, and the heights are those of the archive within that step.
+pub struct Versions {
+    /// The home directory for the penumbra-reindexer.
+    ///
+    /// Defaults to `~/.local/share/penumbra-reindexer`.
+    /// Can be overridden with --archive-file.
+    #[clap(long)]
+    home: Option<PathBuf>,
+
+    /// Override the filepath for the sqlite3 database.
+    /// Defaults to <HOME>/<CHAIN_ID>/reindexer-archive.sqlite
+    #[clap(long)]
+    archive_file: Option<PathBuf>,
+
+    /// The chain id whose plan to follow. Defaults to the chain id of the archive.
+    #[clap(long)]
+    chain_id: Option<String>,
+
+    /// Read the regeneration plan from a file, rather than using the built-in plan for the chain.
+    #[clap(long)]
+    plan_file: Option<PathBuf>,
+
+    /// Print the segments as JSON, rather than for humans.
+    #[clap(long)]
+    json: bool,
+}
+
+/// The heights of an archive that a single version of Penumbra runs, in one step of a plan.
+#[derive(Debug, PartialEq)]
+struct VersionSegment {
+    /// The step of the plan running these heights, numbered from 1, as `show-plan` does.
+    step: usize,
+    version: Version,
+    first_height: u64,
+    last_height: u64,
+}
+
+/// The segments of the steps of a plan running blocks between two heights, inclusive.
+///
+/// Steps only running blocks outside of these heights are left out, and the others are
+/// cut down to the heights within them.
+fn version_segments(plan: &RegenerationPlan, first: u64, last: u64) -> Vec<VersionSegment> {
+    plan.steps
+        .iter()
+        .enumerate()
+        .filter_map(|(i, (start, step))| {
+            let (version, last_block) = match step {
+                RegenerationStep::Migrate { .. } => return None,
+                RegenerationStep::InitThenRunTo {
+                    version,
+                    last_block,
+                    ..
+                }
+                | RegenerationStep::RunTo {
+                    version,
+                    last_block,
+                } => (*version, *last_block),
+            };
+            // Blocks start right after the height of the step, as the regenerator runs them.
+            let first_height = first.max(start + 1);
+            let last_height = last_block.map_or(last, |x| x.min(last));
+            (first_height <= last_height).then_some(VersionSegment {
+                step: i + 1,
+                version,
+                first_height,
+                last_height,
+            })
+        })
+        .collect()
+}
+
+fn segments_json(
+    chain_id: &str,
+    heights: Option<(u64, u64)>,
+    segments: &[VersionSegment],
+) -> Value {
+    json!({
+        "chain_id": chain_id,
+        "first_height": heights.map(|x| x.0),
+        "last_height": heights.map(|x| x.1),
+        "segments": segments
+            .iter()
+            .map(|x| json!({
+                "step": x.step,
+                "version": format!("{:?}", x.version),
+                "first_height": x.first_height,
+                "last_height": x.last_height,
+            }))
+            .collect::<Vec<_>>(),
+    })
+}
+
+fn segments_text(
+    chain_id: &str,
+    heights: Option<(u64, u64)>,
+    segments: &[VersionSegment],
+) -> String {
+    let Some((first, last)) = heights else {
+        return format!(
+            "the archive of {} has no blocks, so spans no versions\n",
+            chain_id
+        );
+    };
+    let mut out = format!(
+        "versions spanned by the archive of {}, from height {} to height {}:\n",
+        chain_id, first, last
+    );
+    for segment in segments {
+        out.push_str(&format!(
+            "  step {}, {:?}: heights {}..={}\n",
+            segment.step, segment.version, segment.first_height, segment.last_height
+        ));
+    }
+    out.push_str(&format!(
+        "{} steps of the plan run over blocks of the archive\n",
+        segments.len()
+    ));
+    out
+}
+
+impl Versions {
+    pub async fn run(self) -> anyhow::Result<()> {
+        let archive_file =
+            archive_filepath_from_opts(self.home, self.archive_file, self.chain_id.clone())?;
+        crate::files::ensure_archive_exists(&archive_file)?;
+        let archive = Storage::new(Some(&archive_file), self.chain_id.as_deref()).await?;
+        let chain_id = archive.chain_id().await?;
+        let plan = RegenerationPlan::load(&chain_id, self.plan_file.as_deref())?;
+        let heights = archive
+            .first_height()
+            .await?
+            .zip(archive.last_height().await?);
+        let segments = match heights {
+            Some((first, last)) => version_segments(&plan, first, last),
+            None => Vec::new(),
+        };
+        if self.json {
+            println!(
+                "{}",
+                serde_json::to_string_pretty(&segments_json(&chain_id, heights, &segments))?
+            );
+        } else {
+            print!("{}", segments_text(&chain_id, heights, &segments));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::Block;
+
+    #[test]
+    fn test_segments_match_plan() {
+        let plan = RegenerationPlan::penumbra_1();
+        let segments = version_segments(&plan, 1, 3_000_000);
+        assert_eq!(
+            segments,
+            vec![
+                VersionSegment {
+                    step: 1,
+                    version: Version::V0o79,
+                    first_height: 1,
+                    last_height: 501974,
+                },
+                VersionSegment {
+                    step: 3,
+                    version: Version::V0o80,
+                    first_height: 501975,
+                    last_height: 2611799,
+                },
+                VersionSegment {
+                    step: 5,
+                    version: Version::V1o3,
+                    first_height: 2611800,
+                    last_height: 3_000_000,
+                },
+            ]
+        );
+
+        // A range within a single step, and one reaching into the last step, which has no end.
+        let within = version_segments(&plan, 600_000, 700_000);
+        assert_eq!(within.len(), 1);
+        assert_eq!(
+            (within[0].first_height, within[0].last_height),
+            (600_000, 700_000)
+        );
+        let last = version_segments(&plan, 5_480_872, 6_000_000);
+        assert_eq!(
+            last.iter()
+                .map(|x| (x.version, x.first_height, x.last_height))
+                .collect::<Vec<_>>(),
+            vec![
+                (Version::V1o4, 5_480_872, 5_480_872),
+                (Version::V2, 5_480_873, 6_000_000)
+            ]
+        );
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_segments_of_archive() -> anyhow::Result<()> {
+        let archive = Storage::new(None, Some("penumbra-testnet-phobos-2")).await?;
+        for height in [1459798, 1459799, 1459800, 1459801] {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        let heights = archive
+            .first_height()
+            .await?
+            .zip(archive.last_height().await?);
+        assert_eq!(heights, Some((1459798, 1459801)));
+        let plan = RegenerationPlan::penumbra_testnet_phobos_2();
+        let segments = version_segments(&plan, 1459798, 1459801);
+
+        let json = segments_json("penumbra-testnet-phobos-2", heights, &segments);
+        assert_eq!(json["first_height"], 1459798);
+        assert_eq!(
+            json["segments"],
+            json!([
+                {"step": 1, "version": "V0o80", "first_height": 1459798, "last_height": 1459799},
+                {"step": 3, "version": "V1o3", "first_height": 1459800, "last_height": 1459801},
+            ])
+        );
+        assert_eq!(
+            segments_text("penumbra-testnet-phobos-2", heights, &segments),
+            "versions spanned by the archive of penumbra-testnet-phobos-2, from height 1459798 to height 1459801:
+  step 1, V0o80: heights 1459798..=1459799
+  step 3, V1o3: heights 1459800..=1459801
+2 steps of the plan run over blocks of the archive
+"
+        );
+        assert_eq!(
+            segments_text("penumbra-testnet-phobos-2", None, &[]),
+            "the archive of penumbra-testnet-phobos-2 has no blocks, so spans no versions\n"
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_missing_archive_has_its_own_exit_code() -> anyhow::Result<()> {
+        use clap::Parser as _;
+
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-versions-missing-{}.sqlite",
+            std::process::id()
+        ));
+        let cmd = Versions::try_parse_from([
+            "versions",
+            "--archive-file",
+            path.to_str().expect("test path should be valid UTF-8"),
+        ])?;
+        let err = cmd.run().await.expect_err("there's no archive to read");
+        assert_eq!(crate::error::exit_code(&err), 3);
+        // Nor is one created by looking for it.
+        assert!(!path.exists());
+        Ok(())
+    }
+}
@@ -0,0 +1,162 @@
+use std::fmt;
+
+/// The kinds of failure that end a run with an exit code of their own.
+///
+/// Scripts running the reindexer can tell these apart by exit code alone, where any other
+/// failure exits with [`GENERIC_EXIT_CODE`]. The codes are part of the interface of the
+/// reindexer, documented in the README, so they shouldn't change once released.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ErrorKind {
+    /// The archive to read from doesn't exist.
+    MissingArchive,
+    /// The archive exists, but isn't a readable archive, or holds data that doesn't decode.
+    CorruptArchive,
+    /// The database to index events into couldn't be connected to.
+    DbConnection,
+    /// The regeneration plan disagrees with the archive, or with the working directory.
+    PlanMismatch,
+    /// A block the plan starts or stops a step at isn't in the archive.
+    BoundaryNotFound,
+    /// A genesis the plan starts the chain from isn't in the archive, or isn't usable.
+    GenesisNotFound,
+    /// The archive is encrypted with a different key than the one given, or isn't encrypted.
+    WrongArchiveKey,
+    /// The archive is in a version of the archive format this build doesn't read.
+    IncompatibleArchive,
+}
+
+/// The exit code of a failure which isn't of any particular kind.
+pub const GENERIC_EXIT_CODE: u8 = 1;
+
+impl ErrorKind {
+    /// Every kind of failure, in order of exit code.
+    pub const ALL: [ErrorKind; 8] = [
+        ErrorKind::MissingArchive,
+        ErrorKind::CorruptArchive,
+        ErrorKind::DbConnection,
+        ErrorKind::PlanMismatch,
+        ErrorKind::BoundaryNotFound,
+        ErrorKind::GenesisNotFound,
+        ErrorKind::WrongArchiveKey,
+        ErrorKind::IncompatibleArchive,
+    ];
+
+    /// The code to exit with after a failure of this kind.
+    ///
+    /// Code 2 is left out, being what clap exits with when the arguments are wrong.
+    pub fn exit_code(self) -> u8 {
+        match self {
+            ErrorKind::MissingArchive => 3,
+            ErrorKind::CorruptArchive => 4,
+            ErrorKind::DbConnection => 5,
+            ErrorKind::PlanMismatch => 6,
+            ErrorKind::BoundaryNotFound => 7,
+            ErrorKind::GenesisNotFound => 8,
+            ErrorKind::WrongArchiveKey => 9,
+            ErrorKind::IncompatibleArchive => 10,
+        }
+    }
+
+    /// The name of this kind, as `regen-step` reports it to `regen`.
+    pub fn name(self) -> &'static str {
+        match self {
+            ErrorKind::MissingArchive => "missing-archive",
+            ErrorKind::CorruptArchive => "corrupt-archive",
+            ErrorKind::DbConnection => "db-connection",
+            ErrorKind::PlanMismatch => "plan-mismatch",
+            ErrorKind::BoundaryNotFound => "boundary-not-found",
+            ErrorKind::GenesisNotFound => "genesis-not-found",
+            ErrorKind::WrongArchiveKey => "wrong-archive-key",
+            ErrorKind::IncompatibleArchive => "incompatible-archive",
+        }
+    }
+
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL.into_iter().find(|x| x.name() == name)
+    }
+
+    /// The kind of failure an error is, if any.
+    ///
+    /// This looks through the context added to the error, finding the outermost kind.
+    pub fn of(e: &anyhow::Error) -> Option<Self> {
+        e.downcast_ref::<Failure>().map(|x| x.kind)
+    }
+}
+
+/// An error of a given kind, with a message saying what went wrong.
+///
+/// This is raised like any other error, with `anyhow::bail!(Failure::new(...))`, or added
+/// as context to one, with `.with_context(|| Failure::new(...))`, and displays as its message.
+#[derive(Debug)]
+pub struct Failure {
+    kind: ErrorKind,
+    message: String,
+}
+
+impl Failure {
+    pub fn new(kind: ErrorKind, message: impl fmt::Display) -> Self {
+        Self {
+            kind,
+            message: message.to_string(),
+        }
+    }
+}
+
+impl fmt::Display for Failure {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl std::error::Error for Failure {}
+
+/// The code to exit with after an error.
+pub fn exit_code(e: &anyhow::Error) -> u8 {
+    ErrorKind::of(e).map_or(GENERIC_EXIT_CODE, |x| x.exit_code())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use anyhow::Context as _;
+
+    #[test]
+    fn test_exit_codes_are_distinct() {
+        let mut codes: Vec<u8> = ErrorKind::ALL.iter().map(|x| x.exit_code()).collect();
+        codes.push(GENERIC_EXIT_CODE);
+        // What clap exits with.
+        codes.push(2);
+        codes.sort();
+        codes.dedup();
+        assert_eq!(codes.len(), ErrorKind::ALL.len() + 2);
+        for kind in ErrorKind::ALL {
+            assert_eq!(ErrorKind::from_name(kind.name()), Some(kind));
+        }
+        assert_eq!(ErrorKind::from_name("something else"), None);
+    }
+
+    #[test]
+    fn test_kind_is_found_through_context() {
+        let raised: anyhow::Result<()> =
+            Err(Failure::new(ErrorKind::GenesisNotFound, "no genesis at height 1").into());
+        let e = raised
+            .context("failed to check the plan")
+            .context("regeneration failed")
+            .unwrap_err();
+        assert_eq!(ErrorKind::of(&e), Some(ErrorKind::GenesisNotFound));
+        assert_eq!(exit_code(&e), 8);
+        assert_eq!(
+            format!("{:#}", e),
+            "regeneration failed: failed to check the plan: no genesis at height 1"
+        );
+
+        // As context, the kind applies to whatever error it's added to.
+        let io: Result<(), _> = Err(std::io::Error::other("connection refused"));
+        let e = io
+            .with_context(|| Failure::new(ErrorKind::DbConnection, "failed to connect"))
+            .unwrap_err();
+        assert_eq!(exit_code(&e), 5);
+
+        assert_eq!(exit_code(&anyhow::anyhow!("something else")), 1);
+    }
+}
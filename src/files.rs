@@ -2,6 +2,9 @@ use anyhow::{anyhow, Context};
 use directories::ProjectDirs;
 use std::path::{Path, PathBuf};
 
+use crate::error::{ErrorKind, Failure};
+use crate::storage::ArchiveKey;
+
 /// Retrieve the home directory for the user running this program.
 ///
 /// This may not exist on certain platforms, hence the error.
@@ -45,6 +48,110 @@ pub fn default_regen_working_dir(home: &Path, chain_id: &str) -> PathBuf {
     home.join(chain_id).join("regen-working-dir")
 }
 
+/// Check that the archive a command reads from exists, since opening it would create it.
+pub(crate) fn ensure_archive_exists(archive_file: &Path) -> anyhow::Result<()> {
+    if !archive_file.exists() {
+        anyhow::bail!(Failure::new(
+            ErrorKind::MissingArchive,
+            format!(
+                "archive file '{}' does not exist; specify one with `--archive-file`",
+                archive_file.display()
+            )
+        ));
+    }
+    Ok(())
+}
+
+/// Write a file in full before it appears at a path, so that a reader never sees half of it.
+///
+/// This replaces any file already at that path.
+pub(crate) fn write_atomically(path: &Path, data: &[u8]) -> anyhow::Result<()> {
+    let mut tmp = path.as_os_str().to_owned();
+    tmp.push(".tmp");
+    std::fs::write(&tmp, data)?;
+    std::fs::rename(&tmp, path)?;
+    Ok(())
+}
+
+/// Copy a directory, and everything inside of it, to a path which must not exist yet.
+pub(crate) fn copy_dir(from: &Path, to: &Path) -> anyhow::Result<()> {
+    std::fs::create_dir(to)
+        .with_context(|| format!("failed to create directory '{}'", to.display()))?;
+    for entry in std::fs::read_dir(from)? {
+        let entry = entry?;
+        let target = to.join(entry.file_name());
+        if entry.file_type()?.is_dir() {
+            copy_dir(&entry.path(), &target)?;
+        } else {
+            std::fs::copy(entry.path(), &target)
+                .with_context(|| format!("failed to copy '{}'", entry.path().display()))?;
+        }
+    }
+    Ok(())
+}
+
+/// A lock on a file, held by this process for as long as the lock is alive.
+///
+/// The lock is an advisory lock, taken with `flock`, on a file beside the one it locks.
+/// The OS releases it once it's dropped, or once the process exits, however it does, so
+/// a lock is never left behind. The file itself stays, holding the id of the process which
+/// last took the lock, for saying which one holds it. It's never removed, since a process
+/// waiting to lock it could otherwise end up holding a lock on a file no other process sees.
+#[derive(Debug)]
+pub(crate) struct FileLock {
+    path: PathBuf,
+    /// Closing this releases the lock.
+    _file: std::fs::File,
+}
+
+impl FileLock {
+    /// Lock a file, failing if another process holds the lock.
+    pub(crate) fn acquire(locked: &Path) -> anyhow::Result<Self> {
+        use std::io::Write as _;
+        use std::os::unix::io::AsRawFd as _;
+
+        let mut path = locked.as_os_str().to_owned();
+        path.push(".lock");
+        let path = PathBuf::from(path);
+        let mut file = std::fs::OpenOptions::new()
+            .read(true)
+            .write(true)
+            .create(true)
+            .truncate(false)
+            .open(&path)
+            .with_context(|| format!("failed to open lock '{}'", path.display()))?;
+        // Safety: flock only takes the descriptor, which stays open for as long as the file.
+        if unsafe { libc::flock(file.as_raw_fd(), libc::LOCK_EX | libc::LOCK_NB) } != 0 {
+            let e = std::io::Error::last_os_error();
+            if e.kind() != std::io::ErrorKind::WouldBlock {
+                return Err(e).with_context(|| format!("failed to lock '{}'", path.display()));
+            }
+            // The holder writes its id once it has the lock, so it may not be there yet.
+            let holder = std::fs::read_to_string(&path)
+                .ok()
+                .and_then(|x| x.trim().parse::<u32>().ok())
+                .map_or("another process".to_owned(), |x| format!("process {}", x));
+            anyhow::bail!(
+                "'{}' is in use by {}, which holds the lock '{}'; wait for it to exit, or stop it",
+                locked.display(),
+                holder,
+                path.display()
+            );
+        }
+        // Only the holder writes to the file, so this replaces the id of the last one.
+        file.set_len(0)
+            .and_then(|_| write!(file, "{}", std::process::id()))
+            .with_context(|| format!("failed to write lock '{}'", path.display()))?;
+        Ok(Self { path, _file: file })
+    }
+
+    /// The path of the lock file itself.
+    #[cfg(test)]
+    pub(crate) fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
 /// Get the archive file, based on optional overrides to reindexer home directory,
 /// or an explicit path to the archive sqlite3 db. Reused by several subcommands.
 pub fn archive_filepath_from_opts(
@@ -69,5 +176,148 @@ pub fn archive_filepath_from_opts(
     Ok(out)
 }
 
+/// The variable to read the key of an encrypted archive from, if neither flag gives one.
+///
+/// `regen` passes the key on to its steps in this, keeping it off of their command lines.
+pub const ARCHIVE_KEY_VAR: &str = "PENUMBRA_REINDEXER_ARCHIVE_KEY";
+
+/// Get the key of an encrypted archive given the command arguments, or `None` if it isn't encrypted.
+///
+/// The key is given directly, read from a file, without its trailing newline, or else read from
+/// [ARCHIVE_KEY_VAR].
+pub fn archive_key_from_opts(
+    encryption_key: Option<String>,
+    key_file: Option<&Path>,
+) -> anyhow::Result<Option<ArchiveKey>> {
+    let key = match (encryption_key, key_file) {
+        (Some(x), _) => x,
+        (None, Some(path)) => {
+            let data = std::fs::read_to_string(path)
+                .with_context(|| format!("failed to read key file '{}'", path.display()))?;
+            data.strip_suffix('\n')
+                .map(|x| x.strip_suffix('\r').unwrap_or(x))
+                .unwrap_or(&data)
+                .to_owned()
+        }
+        (None, None) => match std::env::var(ARCHIVE_KEY_VAR) {
+            Ok(x) => x,
+            Err(_) => return Ok(None),
+        },
+    };
+    ArchiveKey::new(key).map(Some)
+}
+
 /// The name of the reindexer archive file.
 pub const REINDEXER_FILE_NAME: &str = "reindexer-archive.sqlite";
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn test_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-{}-{}",
+            name,
+            std::process::id()
+        ))
+    }
+
+    #[test]
+    fn test_second_lock_fails_until_first_is_dropped() -> anyhow::Result<()> {
+        let locked = test_path("lock-held");
+        let first = FileLock::acquire(&locked)?;
+        assert_eq!(
+            std::fs::read_to_string(first.path())?,
+            std::process::id().to_string()
+        );
+
+        let err = FileLock::acquire(&locked).unwrap_err().to_string();
+        assert!(
+            err.contains(&format!("in use by process {}", std::process::id())),
+            "{}",
+            err
+        );
+
+        drop(first);
+        let second = FileLock::acquire(&locked)?;
+        drop(second);
+        Ok(())
+    }
+
+    #[test]
+    fn test_lock_left_by_exited_process_is_taken() -> anyhow::Result<()> {
+        let locked = test_path("lock-stale");
+        let mut lock_path = locked.as_os_str().to_owned();
+        lock_path.push(".lock");
+        // A process which has exited, and so can't be holding the lock anymore.
+        let mut exited = std::process::Command::new("true").spawn()?;
+        exited.wait()?;
+        std::fs::write(&lock_path, exited.id().to_string())?;
+
+        let lock = FileLock::acquire(&locked)?;
+        assert_eq!(
+            std::fs::read_to_string(lock.path())?,
+            std::process::id().to_string()
+        );
+        drop(lock);
+
+        // As is an empty lock file, whose holder hadn't written to it yet.
+        std::fs::write(&lock_path, "")?;
+        drop(FileLock::acquire(&locked)?);
+        Ok(())
+    }
+
+    #[test]
+    fn test_concurrent_locks_exclude_each_other() -> anyhow::Result<()> {
+        let locked = test_path("lock-concurrent");
+        const THREADS: usize = 8;
+        for _ in 0..200 {
+            // Every thread tries at once, and those which get the lock hold it until every
+            // other thread has tried too, so that only one of them can get it.
+            let barrier = std::sync::Barrier::new(THREADS);
+            let acquired = std::thread::scope(|scope| {
+                let handles: Vec<_> = (0..THREADS)
+                    .map(|_| {
+                        scope.spawn(|| {
+                            barrier.wait();
+                            let lock = FileLock::acquire(&locked);
+                            barrier.wait();
+                            lock.is_ok()
+                        })
+                    })
+                    .collect();
+                handles
+                    .into_iter()
+                    .map(|x| x.join().expect("locking thread should not panic"))
+                    .filter(|x| *x)
+                    .count()
+            });
+            assert_eq!(acquired, 1);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_archive_key_from_file() -> anyhow::Result<()> {
+        let path = test_path("archive-key");
+        std::fs::write(&path, "correct horse\n")?;
+        let key = archive_key_from_opts(None, Some(&path))?;
+        assert_eq!(key, Some(ArchiveKey::new("correct horse")?));
+        // A key given directly takes precedence, and is used as is.
+        let key = archive_key_from_opts(Some("battery staple\n".to_owned()), Some(&path))?;
+        assert_eq!(key, Some(ArchiveKey::new("battery staple\n")?));
+        // The key isn't written out with the rest of whatever holds it.
+        assert_eq!(format!("{:?}", key), "Some(ArchiveKey(..))");
+
+        std::fs::write(&path, "\n")?;
+        assert!(archive_key_from_opts(None, Some(&path)).is_err());
+        std::fs::remove_file(&path)?;
+        let err = archive_key_from_opts(None, Some(&path)).unwrap_err();
+        assert!(
+            err.to_string().contains("failed to read key file"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+}
@@ -1,9 +1,17 @@
+use anyhow::Context as _;
 use hex::ToHex;
 use sha2::Digest;
-use sqlx::{PgPool, Postgres, Transaction};
+use sqlx::{postgres::PgPoolOptions, PgPool, Postgres, Transaction};
+use std::future::Future;
+use std::time::Duration;
 
+use crate::error::{ErrorKind, Failure};
 use crate::tendermint_compat::{Event, ResponseDeliverTx};
 
+mod schema;
+
+pub use schema::{check_database, SchemaCheck};
+
 async fn fetch_block_id(
     dbtx: &mut Transaction<'static, Postgres>,
     height: u64,
@@ -44,16 +52,178 @@ async fn tx_exists(
     .await?)
 }
 
+/// Check that the chain ids already in a database are all the chain we're about to index.
+fn check_existing_chain_ids(chain_id: &str, existing: &[String]) -> anyhow::Result<()> {
+    let others: Vec<&str> = existing
+        .iter()
+        .map(|x| x.as_str())
+        .filter(|x| *x != chain_id)
+        .collect();
+    anyhow::ensure!(
+        others.is_empty(),
+        "the database already contains blocks for chain id {}, but the archive is for '{}'; refusing to mix data from different chains",
+        others
+            .iter()
+            .map(|x| format!("'{}'", x))
+            .collect::<Vec<_>>()
+            .join(", "),
+        chain_id
+    );
+    Ok(())
+}
+
+/// The SQLSTATE codes of errors which might not happen again, if the work is tried again.
+///
+/// These are the connection being lost or refused while the server is busy, and transactions
+/// being rolled back by the server because they conflicted with others. Anything else,
+/// like failing to log in, or the schema not matching, is permanent.
+const TRANSIENT_SQLSTATES: &[&str] = &[
+    "08000", // connection_exception
+    "08001", // sqlclient_unable_to_establish_sqlconnection
+    "08003", // connection_does_not_exist
+    "08004", // sqlserver_rejected_establishment_of_sqlconnection
+    "08006", // connection_failure
+    "40001", // serialization_failure
+    "40P01", // deadlock_detected
+    "53300", // too_many_connections
+    "57P01", // admin_shutdown
+    "57P02", // crash_shutdown
+    "57P03", // cannot_connect_now
+];
+
+fn is_transient_sqlstate(code: &str) -> bool {
+    TRANSIENT_SQLSTATES.contains(&code)
+}
+
+/// Whether an error from database work might not happen again, if the work is tried again.
+fn is_transient(e: &anyhow::Error) -> bool {
+    let Some(e) = e.chain().find_map(|x| x.downcast_ref::<sqlx::Error>()) else {
+        return false;
+    };
+    match e {
+        sqlx::Error::Io(_) | sqlx::Error::PoolTimedOut => true,
+        sqlx::Error::Database(e) => e.code().is_some_and(|x| is_transient_sqlstate(&x)),
+        _ => false,
+    }
+}
+
+/// The longest the indexer will wait between attempts at some database work.
+const MAX_BACKOFF: Duration = Duration::from_secs(30);
+
+/// Do some database work, trying it again, backing off between attempts, if it fails transiently.
+///
+/// The work should be a single transaction, so that a failed attempt leaves nothing behind.
+async fn with_retries<T, F, Fut>(opts: &IndexerOpts, what: &str, mut work: F) -> anyhow::Result<T>
+where
+    F: FnMut() -> Fut,
+    Fut: Future<Output = anyhow::Result<T>>,
+{
+    let mut backoff = opts.initial_backoff;
+    let mut attempt = 1;
+    loop {
+        let e = match with_heartbeat(opts.heartbeat_interval, what, work()).await {
+            Ok(x) => return Ok(x),
+            Err(e) => e,
+        };
+        if !is_transient(&e) {
+            return Err(e);
+        }
+        if attempt >= opts.max_attempts {
+            return Err(e.context(format!("{}, giving up after {} attempts", what, attempt)));
+        }
+        tracing::warn!("{} failed, retrying in {:?}: {:#}", what, backoff, e);
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+        attempt += 1;
+    }
+}
+
+/// Wait for some database work, logging that it's still going, if it's taking a while.
+///
+/// Once the work has been going for an interval, and after every interval from then on,
+/// this logs what the work is, so that a long write doesn't look like the indexer hanging.
+async fn with_heartbeat<T>(interval: Duration, what: &str, work: impl Future<Output = T>) -> T {
+    let start = tokio::time::Instant::now();
+    let mut heartbeat = tokio::time::interval_at(start + interval, interval);
+    tokio::pin!(work);
+    loop {
+        tokio::select! {
+            out = &mut work => return out,
+            _ = heartbeat.tick() => {
+                tracing::info!("still {}, after {}s", what, start.elapsed().as_secs());
+            }
+        }
+    }
+}
+
+/// A transaction of the block we're in, with what it produced.
+struct PendingTx {
+    index: usize,
+    hash: String,
+    result: Vec<u8>,
+}
+
+/// The block we're in, with everything to index for it, which is written out when it ends.
+///
+/// Buffering the block like this means that it can be written in a single database transaction,
+/// which can be tried again in full if it fails.
 struct Context {
-    block_id: i64,
-    dbtx: Transaction<'static, Postgres>,
+    height: u64,
+    chain_id: String,
+    events: Vec<(Vec<Event>, Option<PendingTx>)>,
 }
 
-#[derive(Clone, Debug, Default)]
+#[derive(Clone, Debug)]
 pub struct IndexerOpts {
     /// If set, will allow there to be existing data in the database, with the behavior
     /// of not overwriting that data, and instead continuing silently.
     pub allow_existing_data: bool,
+    /// How many times to try database work, including the first attempt, when it fails
+    /// in a way that might not happen again, like the connection being reset.
+    pub max_attempts: u32,
+    /// How long to wait before trying failed database work again, doubling with each attempt.
+    pub initial_backoff: Duration,
+    /// The most connections to the database to keep open at once.
+    pub max_connections: u32,
+    /// How long to wait for a connection to the database, including establishing it.
+    pub connect_timeout: Duration,
+    /// How long database work can go for before it's logged as still going, and how often after.
+    pub heartbeat_interval: Duration,
+}
+
+/// How many times database work is attempted, unless configured otherwise.
+pub const DEFAULT_MAX_ATTEMPTS: u32 = 5;
+
+/// How many connections to the database are kept open at most, unless configured otherwise.
+///
+/// The indexer writes a block at a time, in a single transaction, so it only ever uses one
+/// connection at once, with the other there to take over if that one is being replaced.
+pub const DEFAULT_MAX_CONNECTIONS: u32 = 2;
+
+/// How many seconds to wait for a connection to the database, unless configured otherwise.
+pub const DEFAULT_CONNECT_TIMEOUT_SECS: u64 = 30;
+
+/// How many seconds database work can go for before it's logged, unless configured otherwise.
+pub const DEFAULT_HEARTBEAT_INTERVAL_SECS: u64 = 30;
+
+impl Default for IndexerOpts {
+    fn default() -> Self {
+        Self {
+            allow_existing_data: false,
+            max_attempts: DEFAULT_MAX_ATTEMPTS,
+            initial_backoff: Duration::from_millis(500),
+            max_connections: DEFAULT_MAX_CONNECTIONS,
+            connect_timeout: Duration::from_secs(DEFAULT_CONNECT_TIMEOUT_SECS),
+            heartbeat_interval: Duration::from_secs(DEFAULT_HEARTBEAT_INTERVAL_SECS),
+        }
+    }
+}
+
+/// The options for the pool of connections to the database, following the indexer's options.
+fn pool_options(opts: &IndexerOpts) -> PgPoolOptions {
+    PgPoolOptions::new()
+        .max_connections(opts.max_connections)
+        .acquire_timeout(opts.connect_timeout)
 }
 
 /// Represents an indexer for raw ABCI events.
@@ -76,19 +246,196 @@ impl Drop for Indexer {
     }
 }
 
+/// Create the tables of the indexer, if they're missing, checking the chain of what's already there.
+async fn init_schema(pool: &PgPool, chain_id: &str) -> anyhow::Result<()> {
+    let mut dbtx = pool.begin().await?;
+    for statement in include_str!("indexer/schema.sql").split(";") {
+        sqlx::query(statement).execute(dbtx.as_mut()).await?;
+    }
+    let existing: Vec<String> = sqlx::query_scalar("SELECT DISTINCT chain_id FROM blocks")
+        .fetch_all(dbtx.as_mut())
+        .await?;
+    check_existing_chain_ids(chain_id, &existing)?;
+    dbtx.commit().await?;
+    Ok(())
+}
+
+/// Write out everything for a block, committing it along with the app hash after it.
+async fn write_block(
+    pool: &PgPool,
+    context: &Context,
+    app_hash: &[u8],
+    allow_existing_data: bool,
+) -> anyhow::Result<()> {
+    let height = context.height;
+    let mut dbtx = pool.begin().await?;
+    let block_id: i64 = match fetch_block_id(&mut dbtx, height).await? {
+        None => {
+            let (block_id,): (i64,) = sqlx::query_as(
+                "INSERT INTO blocks VALUES (DEFAULT, $1, $2, CURRENT_TIMESTAMP) RETURNING rowid",
+            )
+            .bind(i64::try_from(height)?)
+            .bind(&context.chain_id)
+            .fetch_one(dbtx.as_mut())
+            .await?;
+            block_id
+        }
+        Some(id) if allow_existing_data => id,
+        Some(_) => {
+            anyhow::bail!("block at height {} has already been indexed", height)
+        }
+    };
+    for (events, tx) in &context.events {
+        write_events(
+            &mut dbtx,
+            block_id,
+            height,
+            events,
+            tx.as_ref(),
+            allow_existing_data,
+        )
+        .await?;
+    }
+    let skip = if allow_existing_data {
+        sqlx::query_scalar(
+            "
+            SELECT EXISTS(
+                SELECT 1
+                FROM debug.app_hash       
+                WHERE block_id =  $1
+            )",
+        )
+        .bind(block_id)
+        .fetch_one(dbtx.as_mut())
+        .await?
+    } else {
+        false
+    };
+    if !skip {
+        sqlx::query("INSERT INTO debug.app_hash VALUES (DEFAULT, $1, $2)")
+            .bind(block_id)
+            .bind(app_hash)
+            .execute(dbtx.as_mut())
+            .await?;
+    }
+    dbtx.commit().await?;
+    Ok(())
+}
+
+/// Write out the events for a block, or for a transaction within it.
+async fn write_events(
+    dbtx: &mut Transaction<'static, Postgres>,
+    block_id: i64,
+    height: u64,
+    events: &[Event],
+    tx: Option<&PendingTx>,
+    allow_existing_data: bool,
+) -> anyhow::Result<()> {
+    if allow_existing_data {
+        // We want to skip indexing these events if the relevant generator (i.e. the block, or the tx)
+        // has already been indexed. We do this at this level of granularity, because the underlying
+        // cometbft impl https://github.com/cometbft/cometbft/blob/e820315631a81c230e4abe9bcede8e29382e8af5/state/txindex/indexer_service.go
+        // does the same. It doesn't do one transaction per block, but rather one transaction for the events
+        // tied to the block itself, and another for each transaction.
+        if let Some(tx) = tx {
+            if tx_exists(dbtx, height, tx.index).await? {
+                tracing::debug!("tx ({}, {}) exists; skipping", height, tx.index);
+                return Ok(());
+            }
+        } else if block_exists(dbtx, height).await? {
+            tracing::debug!("block {} exists; skipping", height);
+            return Ok(());
+        }
+    }
+    let (pseudo_events, tx_id): (Vec<Event>, Option<i64>) = match tx {
+        None => (Vec::new(), None),
+        Some(tx) => {
+            let (tx_id,): (i64,) = sqlx::query_as(
+                "INSERT INTO tx_results VALUES (DEFAULT, $1, $2, CURRENT_TIMESTAMP, $3, $4) RETURNING rowid",
+            )
+            .bind(block_id)
+            .bind(i32::try_from(tx.index)?)
+            .bind(&tx.hash)
+            .bind(&tx.result)
+            .fetch_one(dbtx.as_mut())
+            .await?;
+            let pseudo_events = vec![
+                Event {
+                    kind: "tx".to_string(),
+                    attributes: vec![(
+                        "hash".as_bytes().to_vec(),
+                        tx.hash.as_bytes().to_vec(),
+                        true,
+                    )],
+                },
+                Event {
+                    kind: "tx".to_string(),
+                    attributes: vec![(
+                        "height".as_bytes().to_vec(),
+                        height.to_string().into_bytes(),
+                        true,
+                    )],
+                },
+            ];
+            (pseudo_events, Some(tx_id))
+        }
+    };
+    for event in pseudo_events.iter().chain(events.iter()) {
+        let (event_id,): (i64,) =
+            sqlx::query_as("INSERT INTO events VALUES (DEFAULT, $1, $2, $3) RETURNING rowid")
+                .bind(block_id)
+                .bind(tx_id)
+                .bind(&event.kind)
+                .fetch_one(dbtx.as_mut())
+                .await?;
+        for (key, value, _) in &event.attributes {
+            let key = std::str::from_utf8(key)?;
+            let value = std::str::from_utf8(value)?;
+            sqlx::query("INSERT INTO attributes VALUES ($1, $2, $3, $4)")
+                .bind(event_id)
+                .bind(key)
+                .bind(format!("{}.{}", &event.kind, key))
+                .bind(value)
+                .execute(dbtx.as_mut())
+                .await?;
+        }
+    }
+    Ok(())
+}
+
 #[allow(dead_code)]
 impl Indexer {
-    /// Initialize the indexer with a given database url.
+    /// Initialize the indexer with a given database url, for the chain with a given id.
+    ///
+    /// This fails if the database already has blocks from any other chain.
     #[tracing::instrument]
-    pub async fn init(database_url: &str, opts: IndexerOpts) -> anyhow::Result<Self> {
+    pub async fn init(
+        database_url: &str,
+        chain_id: &str,
+        opts: IndexerOpts,
+    ) -> anyhow::Result<Self> {
         tracing::info!("initializing database");
 
-        let pool = PgPool::connect(database_url).await?;
-        let mut dbtx = pool.begin().await?;
-        for statement in include_str!("indexer/schema.sql").split(";") {
-            sqlx::query(statement).execute(dbtx.as_mut()).await?;
-        }
-        dbtx.commit().await?;
+        let indexer = Self::connect(database_url, opts).await?;
+        with_retries(&indexer.opts, "initializing the database", || {
+            init_schema(&indexer.pool, chain_id)
+        })
+        .await?;
+        Ok(indexer)
+    }
+
+    /// Connect to a database, only to read what's already been indexed into it.
+    ///
+    /// Unlike [Self::init], this leaves the database as it is, without creating any tables.
+    pub async fn connect(database_url: &str, opts: IndexerOpts) -> anyhow::Result<Self> {
+        let pool = with_retries(&opts, "connecting to the database", || async {
+            Ok(pool_options(&opts).connect(database_url).await?)
+        })
+        .await
+        .context(Failure::new(
+            ErrorKind::DbConnection,
+            "failed to connect to the database",
+        ))?;
         Ok(Self {
             pool,
             context: None,
@@ -98,29 +445,16 @@ impl Indexer {
 
     /// Signal the start of a new block.
     ///
-    /// This will index whatever information about the block we need, and also
-    /// set a context for the current block for subsequent events.
+    /// This sets a context for the current block for subsequent events, which, along
+    /// with whatever information about the block we need, are indexed once it ends.
     pub async fn enter_block(&mut self, height: u64, chain_id: &str) -> anyhow::Result<()> {
         tracing::debug!(height, "indexing block");
         assert!(self.context.is_none());
-        let mut dbtx = self.pool.begin().await?;
-        let block_id: i64 = match fetch_block_id(&mut dbtx, height).await? {
-            None => {
-                let (block_id,): (i64,) = sqlx::query_as(
-                "INSERT INTO blocks VALUES (DEFAULT, $1, $2, CURRENT_TIMESTAMP) RETURNING rowid",
-            )
-            .bind(i64::try_from(height)?)
-            .bind(chain_id)
-            .fetch_one(dbtx.as_mut())
-            .await?;
-                block_id
-            }
-            Some(id) if self.opts.allow_existing_data => id,
-            Some(_) => {
-                anyhow::bail!("block at height {} has already been indexed", height)
-            }
-        };
-        self.context = Some(Context { block_id, dbtx });
+        self.context = Some(Context {
+            height,
+            chain_id: chain_id.to_owned(),
+            events: Vec::new(),
+        });
         self.events(
             height,
             vec![Event {
@@ -139,40 +473,95 @@ impl Indexer {
 
     /// Signal the end of the block.
     ///
-    /// This allows our changes to be committed.
+    /// This allows our changes to be committed, which happens in a single transaction,
+    /// tried again if it fails in a way that might not happen again.
     pub async fn end_block(&mut self, app_hash: &[u8]) -> anyhow::Result<()> {
-        let old_context = self.context.take();
-        let mut context = match old_context {
+        let context = match self.context.take() {
             None => panic!("we should be inside a block before ending it"),
             Some(ctx) => ctx,
         };
-        let skip = if self.opts.allow_existing_data {
-            sqlx::query_scalar(
+        let what = format!("indexing block {}", context.height);
+        let allow_existing_data = self.opts.allow_existing_data;
+        with_retries(&self.opts, &what, || {
+            write_block(&self.pool, &context, app_hash, allow_existing_data)
+        })
+        .await
+    }
+
+    /// Whether this indexer allows the database to have data already, leaving it be.
+    pub fn allows_existing_data(&self) -> bool {
+        self.opts.allow_existing_data
+    }
+
+    /// The highest height of the blocks committed to the database between two heights, inclusive.
+    ///
+    /// Without a last height, this includes every block from the first height on.
+    pub async fn last_height(&self, first: u64, last: Option<u64>) -> anyhow::Result<Option<u64>> {
+        let first = i64::try_from(first)?;
+        let last = last.map_or(Ok(i64::MAX), i64::try_from)?;
+        let height: Option<i64> =
+            with_retries(&self.opts, "reading the last indexed height", || async {
+                Ok(sqlx::query_scalar(
+                    "SELECT MAX(height) FROM blocks WHERE height >= $1 AND height <= $2",
+                )
+                .bind(first)
+                .bind(last)
+                .fetch_one(&self.pool)
+                .await?)
+            })
+            .await?;
+        Ok(height.map(u64::try_from).transpose()?)
+    }
+
+    /// The app hash committed to the database along with the block at a given height, if any.
+    pub async fn app_hash(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        let height = i64::try_from(height)?;
+        with_retries(&self.opts, "reading an indexed app hash", || async {
+            Ok(sqlx::query_scalar(
                 "
-                SELECT EXISTS(
-                    SELECT 1
-                    FROM debug.app_hash       
-                    WHERE block_id =  $1
-                )",
+                SELECT hash
+                FROM debug.app_hash
+                JOIN blocks ON blocks.rowid = debug.app_hash.block_id
+                WHERE height = $1",
             )
-            .bind(context.block_id)
-            .fetch_one(context.dbtx.as_mut())
-            .await?
-        } else {
-            false
-        };
-        if !skip {
-            sqlx::query("INSERT INTO debug.app_hash VALUES (DEFAULT, $1, $2)")
-                .bind(context.block_id)
-                .bind(app_hash)
-                .execute(context.dbtx.as_mut())
-                .await?;
-        }
-        context.dbtx.commit().await?;
-        Ok(())
+            .bind(height)
+            .fetch_optional(&self.pool)
+            .await?)
+        })
+        .await
+    }
+
+    /// The number of transactions indexed for each block committed between two heights, inclusive.
+    ///
+    /// This counts the rows in `tx_results` for each block in `blocks`, in order of height,
+    /// including the blocks with none.
+    pub async fn tx_counts(&self, first: u64, last: u64) -> anyhow::Result<Vec<(u64, u64)>> {
+        let first = i64::try_from(first)?;
+        let last = i64::try_from(last)?;
+        let counts: Vec<(i64, i64)> =
+            with_retries(&self.opts, "counting indexed transactions", || async {
+                Ok(sqlx::query_as(
+                    "
+                    SELECT height, COUNT(tx_results.rowid)
+                    FROM blocks
+                    LEFT JOIN tx_results ON tx_results.block_id = blocks.rowid
+                    WHERE height >= $1 AND height <= $2
+                    GROUP BY height
+                    ORDER BY height",
+                )
+                .bind(first)
+                .bind(last)
+                .fetch_all(&self.pool)
+                .await?)
+            })
+            .await?;
+        counts
+            .into_iter()
+            .map(|(height, count)| anyhow::Ok((u64::try_from(height)?, u64::try_from(count)?)))
+            .collect()
     }
 
-    /// Deliver events, and have them indexed.
+    /// Deliver events, to be indexed when the block ends.
     ///
     /// We can optionally provide a transaction to exist as context for the events.
     /// This should only be called once per transaction.
@@ -187,81 +576,272 @@ impl Indexer {
             None => panic!("we should be inside a block before indexing events"),
             Some(ctx) => ctx,
         };
-        if self.opts.allow_existing_data {
-            // We want to skip indexing these events if the relevant generator (i.e. the block, or the tx)
-            // has already been indexed. We do this at this level of granularity, because the underlying
-            // cometbft impl https://github.com/cometbft/cometbft/blob/e820315631a81c230e4abe9bcede8e29382e8af5/state/txindex/indexer_service.go
-            // does the same. It doesn't do one transaction per block, but rather one transaction for the events
-            // tied to the block itself, and another for each transaction.
-            if let Some((index, _, _)) = tx {
-                if tx_exists(&mut context.dbtx, height, index).await? {
-                    tracing::debug!("tx ({}, {}) exists; skipping", height, index);
-                    return Ok(());
+        let tx = tx.map(|(index, raw_tx, exec_result)| PendingTx {
+            index,
+            hash: sha2::Sha256::digest(raw_tx).encode_hex_upper(),
+            result: exec_result.encode_to_latest_tx_result(height as i64, index as u32, raw_tx),
+        });
+        context.events.push((events, tx));
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use std::io;
+    use std::sync::atomic::{AtomicU32, Ordering};
+
+    #[test]
+    fn test_check_existing_chain_ids() {
+        assert!(check_existing_chain_ids("penumbra-1", &[]).is_ok());
+        assert!(check_existing_chain_ids("penumbra-1", &["penumbra-1".to_owned()]).is_ok());
+        let err = check_existing_chain_ids(
+            "penumbra-1",
+            &[
+                "penumbra-1".to_owned(),
+                "penumbra-testnet-phobos-2".to_owned(),
+            ],
+        )
+        .expect_err("a different chain in the database should be rejected");
+        assert!(
+            err.to_string().contains("'penumbra-testnet-phobos-2'"),
+            "{:#}",
+            err
+        );
+    }
+
+    fn test_opts(max_attempts: u32) -> IndexerOpts {
+        IndexerOpts {
+            max_attempts,
+            initial_backoff: Duration::from_millis(1),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_pool_options_follow_opts() {
+        let options = pool_options(&IndexerOpts::default());
+        assert_eq!(options.get_max_connections(), DEFAULT_MAX_CONNECTIONS);
+        assert_eq!(
+            options.get_acquire_timeout(),
+            Duration::from_secs(DEFAULT_CONNECT_TIMEOUT_SECS)
+        );
+        let options = pool_options(&IndexerOpts {
+            max_connections: 7,
+            connect_timeout: Duration::from_secs(3),
+            ..Default::default()
+        });
+        assert_eq!(options.get_max_connections(), 7);
+        assert_eq!(options.get_acquire_timeout(), Duration::from_secs(3));
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_pool_respects_max_connections() -> anyhow::Result<()> {
+        // Connecting lazily needs no server, but the pool is still bounded as it will be.
+        let pool = pool_options(&IndexerOpts {
+            max_connections: 3,
+            ..Default::default()
+        })
+        .connect_lazy("postgresql://localhost:5432/penumbra_raw")?;
+        assert_eq!(pool.options().get_max_connections(), 3);
+        Ok(())
+    }
+
+    #[test]
+    fn test_transient_sqlstates() {
+        for code in ["08006", "40001", "40P01", "57P01"] {
+            assert!(is_transient_sqlstate(code), "{}", code);
+        }
+        // Failing to log in, a missing table, and a unique violation won't fix themselves.
+        for code in ["28P01", "42P01", "23505"] {
+            assert!(!is_transient_sqlstate(code), "{}", code);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_transient_failures_are_retried() -> anyhow::Result<()> {
+        let attempts = AtomicU32::new(0);
+        let out =
+            with_retries(&test_opts(5), "testing", || {
+                let attempt = attempts.fetch_add(1, Ordering::SeqCst) + 1;
+                async move {
+                    match attempt {
+                        1 => Err(
+                            sqlx::Error::Io(io::Error::from(io::ErrorKind::ConnectionReset)).into(),
+                        ),
+                        // Context on the way up shouldn't hide what the error is.
+                        2 => Err(anyhow::Error::from(sqlx::Error::PoolTimedOut)
+                            .context("writing a block")),
+                        _ => Ok(attempt),
+                    }
                 }
-            } else if block_exists(&mut context.dbtx, height).await? {
-                tracing::debug!("block {} exists; skipping", height);
-                return Ok(());
-            }
+            })
+            .await?;
+        assert_eq!(out, 3);
+        assert_eq!(attempts.load(Ordering::SeqCst), 3);
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn test_permanent_failures_are_not_retried() {
+        let permanent: [fn() -> anyhow::Error; 2] = [
+            || sqlx::Error::RowNotFound.into(),
+            || anyhow::anyhow!("block at height 1 has already been indexed"),
+        ];
+        for make_error in permanent {
+            let attempts = AtomicU32::new(0);
+            let out: anyhow::Result<()> = with_retries(&test_opts(5), "testing", || {
+                attempts.fetch_add(1, Ordering::SeqCst);
+                async move { Err(make_error()) }
+            })
+            .await;
+            assert!(out.is_err());
+            assert_eq!(attempts.load(Ordering::SeqCst), 1);
         }
-        let block_id = context.block_id;
-        let (pseudo_events, tx_id): (Vec<Event>, Option<i64>) = match tx {
-            None => (Vec::new(), None),
-            Some((index, raw_tx, exec_result)) => {
-                let tx_hash: String = sha2::Sha256::digest(raw_tx).encode_hex_upper();
-                let tx_result_bytes =
-                    exec_result.encode_to_latest_tx_result(height as i64, index as u32, raw_tx);
-
-                let (tx_id,): (i64,) = sqlx::query_as(
-                    "INSERT INTO tx_results VALUES (DEFAULT, $1, $2, CURRENT_TIMESTAMP, $3, $4) RETURNING rowid",
-                )
-                .bind(block_id)
-                .bind(i32::try_from(index)?)
-                .bind(&tx_hash)
-                .bind(tx_result_bytes)
-                .fetch_one(context.dbtx.as_mut())
-                .await?;
-                let pseudo_events = vec![
-                    Event {
-                        kind: "tx".to_string(),
-                        attributes: vec![(
-                            "hash".as_bytes().to_vec(),
-                            tx_hash.as_bytes().to_vec(),
-                            true,
-                        )],
-                    },
-                    Event {
-                        kind: "tx".to_string(),
-                        attributes: vec![(
-                            "height".as_bytes().to_vec(),
-                            height.to_string().into_bytes(),
-                            true,
-                        )],
-                    },
-                ];
-                (pseudo_events, Some(tx_id))
-            }
-        };
-        for event in pseudo_events.into_iter().chain(events.into_iter()) {
-            let (event_id,): (i64,) =
-                sqlx::query_as("INSERT INTO events VALUES (DEFAULT, $1, $2, $3) RETURNING rowid")
-                    .bind(block_id)
-                    .bind(tx_id)
-                    .bind(&event.kind)
-                    .fetch_one(context.dbtx.as_mut())
-                    .await?;
-            for (key, value, _) in event.attributes {
-                let key = String::from_utf8(key)?;
-                let value = String::from_utf8(value)?;
-                sqlx::query("INSERT INTO attributes VALUES ($1, $2, $3, $4)")
-                    .bind(event_id)
-                    .bind(&key)
-                    .bind(format!("{}.{}", &event.kind, &key))
-                    .bind(value)
-                    .execute(context.dbtx.as_mut())
-                    .await?;
-            }
+    }
+
+    #[tokio::test]
+    async fn test_retries_give_up() {
+        let attempts = AtomicU32::new(0);
+        let err = with_retries(&test_opts(3), "testing", || {
+            attempts.fetch_add(1, Ordering::SeqCst);
+            async { anyhow::Result::<()>::Err(sqlx::Error::PoolTimedOut.into()) }
+        })
+        .await
+        .expect_err("retries should run out");
+        assert_eq!(attempts.load(Ordering::SeqCst), 3);
+        assert!(
+            err.to_string().contains("giving up after 3 attempts"),
+            "{:#}",
+            err
+        );
+    }
+
+    #[derive(Clone, Default)]
+    struct Buffer(std::sync::Arc<std::sync::Mutex<Vec<u8>>>);
+
+    impl io::Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
         }
 
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_slow_work_logs_heartbeats() -> anyhow::Result<()> {
+        let buffer = Buffer::default();
+        let subscriber = tracing_subscriber::fmt()
+            .with_ansi(false)
+            .with_writer({
+                let buffer = buffer.clone();
+                move || buffer.clone()
+            })
+            .finish();
+        // The test runs on a single thread, so this covers everything polled along the way.
+        let _guard = tracing::subscriber::set_default(subscriber);
+        let opts = IndexerOpts {
+            heartbeat_interval: Duration::from_millis(20),
+            ..test_opts(1)
+        };
+
+        let out = with_retries(&opts, "indexing block 7", || async {
+            tokio::time::sleep(Duration::from_millis(110)).await;
+            anyhow::Ok(7)
+        })
+        .await?;
+        assert_eq!(out, 7);
+        let output = String::from_utf8(buffer.0.lock().unwrap().clone())?;
+        let heartbeats = output
+            .lines()
+            .filter(|x| x.contains("still indexing block 7, after"))
+            .count();
+        assert!(heartbeats >= 3, "{}", output);
+
+        // Work finishing within the interval goes by without any.
+        buffer.0.lock().unwrap().clear();
+        with_retries(&opts, "indexing block 8", || async { anyhow::Ok(()) }).await?;
+        let output = String::from_utf8(buffer.0.lock().unwrap().clone())?;
+        assert!(!output.contains("still indexing"), "{}", output);
+        Ok(())
+    }
+
+    /// The database to run the tests needing Postgres against, which they're skipped without.
+    ///
+    /// These tests drop the indexing tables, so this shouldn't point at anything important.
+    pub(super) const TEST_DATABASE_URL_VAR: &str = "PENUMBRA_REINDEXER_TEST_DATABASE_URL";
+
+    /// Drop the tables of the indexer, so that a test starts from an empty database.
+    pub(super) async fn clear_tables(url: &str) -> anyhow::Result<()> {
+        let pool = PgPool::connect(url).await?;
+        sqlx::query(
+            "DROP TABLE IF EXISTS blocks, tx_results, events, attributes, debug.app_hash CASCADE",
+        )
+        .execute(&pool)
+        .await?;
+        pool.close().await;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_init_checks_chain_id() -> anyhow::Result<()> {
+        let Ok(url) = std::env::var(TEST_DATABASE_URL_VAR) else {
+            eprintln!("skipping test, as {} isn't set", TEST_DATABASE_URL_VAR);
+            return Ok(());
+        };
+        let clear = || clear_tables(&url);
+
+        // An empty database is fine for any chain.
+        clear().await?;
+        let mut indexer = Indexer::init(&url, "penumbra-1", IndexerOpts::default()).await?;
+        indexer.enter_block(1, "penumbra-1").await?;
+        indexer.end_block(b"app hash").await?;
+        drop(indexer);
+
+        // Blocks for the same chain are fine too.
+        drop(Indexer::init(&url, "penumbra-1", IndexerOpts::default()).await?);
+
+        let err = Indexer::init(&url, "penumbra-testnet-phobos-2", IndexerOpts::default())
+            .await
+            .err()
+            .expect("a database with another chain should be rejected");
+        assert!(err.to_string().contains("'penumbra-1'"), "{:#}", err);
+
+        clear().await?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_last_height_of_interrupted_step() -> anyhow::Result<()> {
+        let Ok(url) = std::env::var(TEST_DATABASE_URL_VAR) else {
+            eprintln!("skipping test, as {} isn't set", TEST_DATABASE_URL_VAR);
+            return Ok(());
+        };
+        clear_tables(&url).await?;
+        let mut indexer = Indexer::init(&url, "penumbra-1", IndexerOpts::default()).await?;
+        assert_eq!(indexer.last_height(1, None).await?, None);
+        // A step which committed up to height 3 before dying, and a later step, which got to 10.
+        for height in [1, 2, 3, 10] {
+            indexer.enter_block(height, "penumbra-1").await?;
+            indexer
+                .end_block(format!("app hash {}", height).as_bytes())
+                .await?;
+        }
+        assert_eq!(indexer.last_height(1, Some(5)).await?, Some(3));
+        assert_eq!(indexer.last_height(2, Some(3)).await?, Some(3));
+        assert_eq!(indexer.last_height(4, Some(5)).await?, None);
+        assert_eq!(indexer.last_height(6, None).await?, Some(10));
+        assert_eq!(
+            indexer.app_hash(2).await?.as_deref(),
+            Some(b"app hash 2".as_slice())
+        );
+        assert_eq!(indexer.app_hash(4).await?, None);
+        drop(indexer);
+        clear_tables(&url).await?;
         Ok(())
     }
 }
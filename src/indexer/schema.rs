@@ -0,0 +1,420 @@
+//! Checking that a database has the tables the indexer writes to, as it expects them.
+//!
+//! This mirrors what `schema.sql` creates, as Postgres reports it, so the two need to be
+//! changed together.
+use anyhow::Context as _;
+use sqlx::PgPool;
+
+use super::{pool_options, IndexerOpts};
+use crate::error::{ErrorKind, Failure};
+
+/// A column of a table, as `information_schema.columns` describes it.
+#[derive(Clone, Debug, PartialEq, Eq)]
+struct Column {
+    name: String,
+    data_type: String,
+    nullable: bool,
+}
+
+/// A table which `schema.sql` creates.
+struct ExpectedTable {
+    schema: &'static str,
+    name: &'static str,
+    /// The name, type, and nullability of each column, in order, since rows are inserted
+    /// by position.
+    columns: &'static [(&'static str, &'static str, bool)],
+    /// Whether each index on the table is unique, and the columns it covers, in order.
+    indexes: &'static [(bool, &'static [&'static str])],
+}
+
+const VARCHAR: &str = "character varying";
+const TIMESTAMPTZ: &str = "timestamp with time zone";
+
+const EXPECTED_TABLES: &[ExpectedTable] = &[
+    ExpectedTable {
+        schema: "public",
+        name: "blocks",
+        columns: &[
+            ("rowid", "bigint", false),
+            ("height", "bigint", false),
+            ("chain_id", VARCHAR, false),
+            ("created_at", TIMESTAMPTZ, false),
+        ],
+        indexes: &[
+            (true, &["rowid"]),
+            (true, &["height", "chain_id"]),
+            (false, &["height", "chain_id"]),
+        ],
+    },
+    ExpectedTable {
+        schema: "public",
+        name: "tx_results",
+        columns: &[
+            ("rowid", "bigint", false),
+            ("block_id", "bigint", false),
+            ("index", "integer", false),
+            ("created_at", TIMESTAMPTZ, false),
+            ("tx_hash", VARCHAR, false),
+            ("tx_result", "bytea", false),
+        ],
+        indexes: &[(true, &["rowid"]), (true, &["block_id", "index"])],
+    },
+    ExpectedTable {
+        schema: "public",
+        name: "events",
+        columns: &[
+            ("rowid", "bigint", false),
+            ("block_id", "bigint", false),
+            ("tx_id", "bigint", true),
+            ("type", VARCHAR, false),
+        ],
+        indexes: &[(true, &["rowid"])],
+    },
+    ExpectedTable {
+        schema: "public",
+        name: "attributes",
+        columns: &[
+            ("event_id", "bigint", false),
+            ("key", VARCHAR, false),
+            ("composite_key", VARCHAR, false),
+            ("value", VARCHAR, true),
+        ],
+        indexes: &[(true, &["event_id", "key"]), (false, &["event_id"])],
+    },
+    ExpectedTable {
+        schema: "debug",
+        name: "app_hash",
+        columns: &[
+            ("rowid", "integer", false),
+            ("block_id", "bigint", false),
+            ("hash", "bytea", false),
+        ],
+        indexes: &[(true, &["rowid"])],
+    },
+];
+
+/// The views which `schema.sql` creates, all in the public schema.
+const EXPECTED_VIEWS: &[&str] = &["event_attributes", "block_events", "tx_events"];
+
+/// How a table, or a view, the indexer expects compares with the one in the database.
+#[derive(Debug, PartialEq, Eq)]
+pub struct SchemaCheck {
+    /// The name of the table or view, qualified by its schema, unless that's `public`.
+    pub name: String,
+    /// Whether it's in the database at all.
+    pub exists: bool,
+    /// What doesn't match what the indexer expects, which is empty if everything does.
+    pub problems: Vec<String>,
+}
+
+impl SchemaCheck {
+    fn missing(name: String) -> Self {
+        Self {
+            name,
+            exists: false,
+            problems: vec!["missing".to_owned()],
+        }
+    }
+}
+
+fn qualified_name(schema: &str, name: &str) -> String {
+    match schema {
+        "public" => name.to_owned(),
+        _ => format!("{}.{}", schema, name),
+    }
+}
+
+/// Describe how the actual columns and indexes of a table differ from the expected ones.
+fn table_problems(
+    expected: &ExpectedTable,
+    columns: &[Column],
+    indexes: &[(bool, Vec<String>)],
+) -> Vec<String> {
+    let mut out = Vec::new();
+    for (name, data_type, nullable) in expected.columns {
+        let Some(actual) = columns.iter().find(|x| x.name == *name) else {
+            out.push(format!("missing column '{}'", name));
+            continue;
+        };
+        if actual.data_type != *data_type {
+            out.push(format!(
+                "column '{}' is {}, rather than {}",
+                name, actual.data_type, data_type
+            ));
+        }
+        if actual.nullable != *nullable {
+            out.push(format!(
+                "column '{}' is {}, rather than {}",
+                name,
+                if actual.nullable {
+                    "nullable"
+                } else {
+                    "NOT NULL"
+                },
+                if *nullable { "nullable" } else { "NOT NULL" }
+            ));
+        }
+    }
+    for column in columns {
+        if !expected.columns.iter().any(|x| x.0 == column.name) {
+            out.push(format!("unexpected column '{}'", column.name));
+        }
+    }
+    // Rows are inserted by position, so columns in another order get the wrong values.
+    let expected_order: Vec<&str> = expected.columns.iter().map(|x| x.0).collect();
+    let order: Vec<&str> = columns.iter().map(|x| x.name.as_str()).collect();
+    if out.is_empty() && order != expected_order {
+        out.push(format!(
+            "columns are in the order ({}), rather than ({})",
+            order.join(", "),
+            expected_order.join(", ")
+        ));
+    }
+    for (unique, index_columns) in expected.indexes {
+        let found = indexes.iter().any(|(x, y)| {
+            x == unique
+                && y.iter()
+                    .map(String::as_str)
+                    .eq(index_columns.iter().copied())
+        });
+        if !found {
+            out.push(format!(
+                "missing {}index on ({})",
+                if *unique { "unique " } else { "" },
+                index_columns.join(", ")
+            ));
+        }
+    }
+    out
+}
+
+/// Compare the tables and views in a database with those the indexer expects, changing nothing.
+///
+/// Everything is read in a read only transaction, so this is safe to point at a database
+/// which is in use.
+async fn check_schema(pool: &PgPool) -> anyhow::Result<Vec<SchemaCheck>> {
+    let mut dbtx = pool.begin().await?;
+    sqlx::query("SET TRANSACTION READ ONLY")
+        .execute(dbtx.as_mut())
+        .await?;
+    let mut out = Vec::new();
+    for expected in EXPECTED_TABLES {
+        let name = qualified_name(expected.schema, expected.name);
+        let columns: Vec<(String, String, bool)> = sqlx::query_as(
+            "SELECT column_name::text, data_type::text, is_nullable = 'YES'
+             FROM information_schema.columns
+             WHERE table_schema = $1 AND table_name = $2
+             ORDER BY ordinal_position",
+        )
+        .bind(expected.schema)
+        .bind(expected.name)
+        .fetch_all(dbtx.as_mut())
+        .await?;
+        if columns.is_empty() {
+            out.push(SchemaCheck::missing(name));
+            continue;
+        }
+        let columns: Vec<Column> = columns
+            .into_iter()
+            .map(|(name, data_type, nullable)| Column {
+                name,
+                data_type,
+                nullable,
+            })
+            .collect();
+        let indexes: Vec<(bool, Vec<String>)> = sqlx::query_as(
+            "SELECT i.indisunique, array_agg(a.attname::text ORDER BY k.ord)
+             FROM pg_index i
+             JOIN pg_class t ON t.oid = i.indrelid
+             JOIN pg_namespace n ON n.oid = t.relnamespace
+             CROSS JOIN LATERAL unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord)
+             JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+             WHERE n.nspname = $1 AND t.relname = $2
+             GROUP BY i.indexrelid, i.indisunique",
+        )
+        .bind(expected.schema)
+        .bind(expected.name)
+        .fetch_all(dbtx.as_mut())
+        .await?;
+        out.push(SchemaCheck {
+            name,
+            exists: true,
+            problems: table_problems(expected, &columns, &indexes),
+        });
+    }
+    let views: Vec<String> = sqlx::query_scalar(
+        "SELECT table_name::text FROM information_schema.views WHERE table_schema = 'public'",
+    )
+    .fetch_all(dbtx.as_mut())
+    .await?;
+    for view in EXPECTED_VIEWS {
+        out.push(match views.iter().any(|x| x == view) {
+            true => SchemaCheck {
+                name: view.to_string(),
+                exists: true,
+                problems: Vec::new(),
+            },
+            false => SchemaCheck::missing(view.to_string()),
+        });
+    }
+    dbtx.rollback().await?;
+    Ok(out)
+}
+
+/// Connect to a database, and compare its tables and views with those the indexer expects.
+///
+/// Unlike [super::Indexer::init], this creates nothing, and doesn't retry connecting.
+pub async fn check_database(database_url: &str) -> anyhow::Result<Vec<SchemaCheck>> {
+    let pool = pool_options(&IndexerOpts::default())
+        .connect(database_url)
+        .await
+        .context(Failure::new(
+            ErrorKind::DbConnection,
+            "failed to connect to the database",
+        ))?;
+    let out = check_schema(&pool).await;
+    pool.close().await;
+    out
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::indexer::test::{clear_tables, TEST_DATABASE_URL_VAR};
+    use crate::indexer::Indexer;
+
+    /// The columns of a table, as expected.
+    fn columns_of(table: &ExpectedTable) -> Vec<Column> {
+        table
+            .columns
+            .iter()
+            .map(|(name, data_type, nullable)| Column {
+                name: name.to_string(),
+                data_type: data_type.to_string(),
+                nullable: *nullable,
+            })
+            .collect()
+    }
+
+    fn indexes_of(table: &ExpectedTable) -> Vec<(bool, Vec<String>)> {
+        table
+            .indexes
+            .iter()
+            .map(|(unique, columns)| (*unique, columns.iter().map(|x| x.to_string()).collect()))
+            .collect()
+    }
+
+    #[test]
+    fn test_table_problems() {
+        let table = &EXPECTED_TABLES[1];
+        assert_eq!(table.name, "tx_results");
+        let (columns, indexes) = (columns_of(table), indexes_of(table));
+        assert_eq!(
+            table_problems(table, &columns, &indexes),
+            Vec::<String>::new()
+        );
+
+        let mut drifted = columns.clone();
+        drifted[4].data_type = "text".to_owned();
+        drifted[2].nullable = true;
+        drifted.push(Column {
+            name: "extra".to_owned(),
+            data_type: "integer".to_owned(),
+            nullable: true,
+        });
+        drifted.remove(5);
+        assert_eq!(
+            table_problems(table, &drifted, &indexes[..1]),
+            vec![
+                "column 'index' is nullable, rather than NOT NULL",
+                "column 'tx_hash' is text, rather than character varying",
+                "missing column 'tx_result'",
+                "unexpected column 'extra'",
+                "missing unique index on (block_id, index)",
+            ]
+        );
+
+        // The same columns in another order are a problem of their own.
+        let mut reordered = columns.clone();
+        reordered.swap(4, 5);
+        assert_eq!(
+            table_problems(table, &reordered, &indexes),
+            vec!["columns are in the order (rowid, block_id, index, created_at, tx_result, tx_hash), rather than (rowid, block_id, index, created_at, tx_hash, tx_result)"]
+        );
+    }
+
+    /// Check the schema of the test database, as it is after running some statements on it.
+    async fn check_after(url: &str, statements: &[&str]) -> anyhow::Result<Vec<SchemaCheck>> {
+        clear_tables(url).await?;
+        drop(Indexer::init(url, "penumbra-1", IndexerOpts::default()).await?);
+        let pool = PgPool::connect(url).await?;
+        for statement in statements {
+            sqlx::query(statement).execute(&pool).await?;
+        }
+        let out = check_schema(&pool).await?;
+        pool.close().await;
+        Ok(out)
+    }
+
+    fn problems_of<'a>(checks: &'a [SchemaCheck], name: &str) -> &'a [String] {
+        &checks
+            .iter()
+            .find(|x| x.name == name)
+            .expect("every table should be checked")
+            .problems
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_check_schema() -> anyhow::Result<()> {
+        let Ok(url) = std::env::var(TEST_DATABASE_URL_VAR) else {
+            eprintln!("skipping test, as {} isn't set", TEST_DATABASE_URL_VAR);
+            return Ok(());
+        };
+
+        // The schema the indexer creates is exactly what's expected.
+        let checks = check_after(&url, &[]).await?;
+        assert_eq!(checks.len(), EXPECTED_TABLES.len() + EXPECTED_VIEWS.len());
+        for check in &checks {
+            assert!(check.exists, "{}", check.name);
+            assert!(check.problems.is_empty(), "{:?}", check);
+        }
+
+        // Dropping a table takes the views over it along with it.
+        let checks = check_after(&url, &["DROP TABLE attributes CASCADE"]).await?;
+        assert_eq!(problems_of(&checks, "attributes"), ["missing"]);
+        assert_eq!(problems_of(&checks, "event_attributes"), ["missing"]);
+        assert!(problems_of(&checks, "blocks").is_empty());
+
+        let checks = check_after(
+            &url,
+            &[
+                "ALTER TABLE tx_results ALTER COLUMN tx_hash TYPE TEXT",
+                "ALTER TABLE events ALTER COLUMN type DROP NOT NULL",
+                "DROP INDEX idx_blocks_height_chain",
+            ],
+        )
+        .await?;
+        assert_eq!(
+            problems_of(&checks, "tx_results"),
+            ["column 'tx_hash' is text, rather than character varying"]
+        );
+        assert_eq!(
+            problems_of(&checks, "events"),
+            ["column 'type' is nullable, rather than NOT NULL"]
+        );
+        assert_eq!(
+            problems_of(&checks, "blocks"),
+            ["missing index on (height, chain_id)"]
+        );
+        assert!(problems_of(&checks, "debug.app_hash").is_empty());
+
+        // Checking changes nothing, even in an empty database.
+        clear_tables(&url).await?;
+        let pool = PgPool::connect(&url).await?;
+        let checks = check_schema(&pool).await?;
+        assert!(checks.iter().all(|x| !x.exists));
+        assert!(check_schema(&pool).await?.iter().all(|x| !x.exists));
+        pool.close().await;
+        Ok(())
+    }
+}
@@ -1,20 +1,53 @@
 use std::io::{stderr, IsTerminal as _};
 use tracing_subscriber::EnvFilter;
 
+pub use logging::{LogFormat, Verbosity};
+
 pub mod check;
 mod cometbft;
 mod command;
+pub mod error;
 pub mod files;
 pub mod history;
 mod indexer;
+mod logging;
+mod manifest;
+mod metrics;
+mod object_store;
 mod penumbra;
+mod progress;
+mod shutdown;
 pub mod storage;
+mod stream;
 pub mod tendermint_compat;
 
 /// This is a utility around re-indexing historical Penumbra events.
 #[derive(clap::Parser)]
 #[command(version)]
-pub enum Opt {
+pub struct Opt {
+    /// The format to write logs in.
+    ///
+    /// `json` writes one JSON object per line, with the level, target, message, and fields
+    /// of each event, along with the spans it's in.
+    #[clap(long, global = true, value_enum, default_value = "pretty")]
+    pub log_format: LogFormat,
+    /// Log more: debug logs with one, and trace logs with two.
+    ///
+    /// `RUST_LOG`, if set, overrides this.
+    #[clap(short, long, global = true, action = clap::ArgAction::Count, conflicts_with = "quiet")]
+    pub verbose: u8,
+    /// Log less: only warnings with one, and only errors with two.
+    ///
+    /// Errors are always logged, and printed on failure, however quiet.
+    /// `RUST_LOG`, if set, overrides this.
+    #[clap(short, long, global = true, action = clap::ArgAction::Count)]
+    pub quiet: u8,
+    #[command(subcommand)]
+    pub command: Command,
+}
+
+#[derive(clap::Subcommand)]
+pub enum Command {
     /// Create or add to our full historical archive.
     Archive(command::Archive),
     /// Regenerate an index of events, given a historical archive.
@@ -25,54 +58,91 @@ pub enum Opt {
     RegenStep(command::Regen),
     /// Export data from the archive.
     Export(command::Export),
+    /// Write the blocks in the archive out into a new CometBFT block store.
+    ExportBlockstore(command::ExportBlockstore),
+    /// Write a single block, and optionally its commit, to a file, as protobuf.
+    Extract(command::Extract),
+    /// Copy the blocks in the archive into Postgres.
+    Import(command::Import),
     /// Bootstrap initial config for the reindexer.
     Bootstrap(command::Bootstrap),
     /// Inspect local reindexer archive and perform healthchecks on it.
     Check(command::Check),
+    /// Check that a database has the tables regen indexes into, as this version expects them.
+    CheckDb(command::CheckDb),
+    /// Walk every block in a local reindexer archive, ensuring the archive is usable for regen.
+    Verify(command::Verify),
+    /// Summarize the size and contents of a local reindexer archive, without decoding blocks.
+    Stats(command::Stats),
+    /// Combine several archives, covering different ranges of heights, into one.
+    Merge(command::Merge),
+    /// Compare two archives, reporting the first height where their blocks differ.
+    Diff(command::Diff),
+    /// Print the regeneration plan known for a chain id.
+    ShowPlan(command::ShowPlan),
+    /// Check that an archive has a usable genesis for every step of a regeneration plan.
+    ValidateGenesis(command::ValidateGenesis),
+    /// List the versions of Penumbra an archive spans, and the heights each one runs.
+    Versions(command::Versions),
+    /// Cut an archive down to a maximum height, removing every block above it.
+    Truncate(command::Truncate),
+    /// Measure how fast blocks are read from a block store, for comparing backends and tuning.
+    Bench(command::Bench),
 }
 
 impl Opt {
     /// Run this command.
     pub async fn run(self) -> anyhow::Result<()> {
-        match self {
-            Opt::Archive(x) => x.run().await,
-            Opt::Regen(x) => x.run().await,
-            Opt::RegenStep(x) => x.run().await,
-            Opt::Export(x) => x.run().await,
-            Opt::Bootstrap(x) => x.run().await,
-            Opt::Check(x) => x.run().await,
+        match self.command {
+            Command::Archive(x) => x.run().await,
+            Command::Regen(x) => x.run().await,
+            Command::RegenStep(x) => x.run().await,
+            Command::Export(x) => x.run().await,
+            Command::ExportBlockstore(x) => x.run().await,
+            Command::Extract(x) => x.run().await,
+            Command::Import(x) => x.run().await,
+            Command::Bootstrap(x) => x.run().await,
+            Command::Check(x) => x.run().await,
+            Command::CheckDb(x) => x.run().await,
+            Command::Verify(x) => x.run().await,
+            Command::Stats(x) => x.run().await,
+            Command::Merge(x) => x.run().await,
+            Command::Diff(x) => x.run().await,
+            Command::ShowPlan(x) => x.run().await,
+            Command::ValidateGenesis(x) => x.run().await,
+            Command::Versions(x) => x.run().await,
+            Command::Truncate(x) => x.run().await,
+            Command::Bench(x) => x.run().await,
         }
     }
 
-    /// Initialize tracing for the console.
+    /// The verbosity selected by the `--verbose` and `--quiet` flags.
+    pub fn verbosity(&self) -> Verbosity {
+        Verbosity::new(self.verbose, self.quiet)
+    }
+
+    /// Initialize tracing for the console, with the pretty format.
     pub fn init_console_tracing() {
+        Self::init_tracing(LogFormat::Pretty, Verbosity::default())
+    }
+
+    /// Initialize tracing for the console, writing logs in a given format, at a given verbosity.
+    pub fn init_tracing(format: LogFormat, verbosity: Verbosity) {
         let is_terminal = stderr().is_terminal();
+        format.set_current();
+        verbosity.set_current();
 
-        tracing_subscriber::fmt()
-            .with_ansi(is_terminal)
-            .with_target(true)
-            .with_env_filter(
-                EnvFilter::try_from_default_env()
-                    .or_else(|_| {
-                        // If we're in an interactive terminal, use a cleaner default filter
-                        // that reduces noise from dependencies, especially for progress watching
-                        if is_terminal {
-                            EnvFilter::try_new("info,penumbra_=error,cnidarium=warn,sqlx=warn,penumbra_reindexer=info")
-                        } else {
-                            // For non-interactive use (logs, CI, etc.), keep more verbose logging
-                            EnvFilter::try_new("info")
-                        }
-                    })
-                    .expect("failed to initialize logging")
-                    // Without explicitly disabling the `r1cs` target, the ZK proof implementations
-                    // will spend an enormous amount of CPU and memory building useless tracing output.
-                    .add_directive(
-                        "r1cs=off"
-                            .parse()
-                            .expect("rics=off is a valid filter directive"),
-                    ),
-            )
-            .with_writer(stderr)
-            .init();
+        let rust_log = std::env::var(EnvFilter::DEFAULT_ENV).ok();
+        let builder = tracing_subscriber::fmt()
+            .with_env_filter(verbosity.env_filter(is_terminal, rust_log.as_deref()))
+            .with_writer(stderr);
+        match format {
+            LogFormat::Pretty => builder.with_ansi(is_terminal).with_target(true).init(),
+            LogFormat::Json => builder
+                .with_ansi(false)
+                .fmt_fields(logging::JsonFields)
+                .event_format(logging::JsonFormat)
+                .init(),
+        }
     }
 }
@@ -0,0 +1,419 @@
+//! Formats for the log output of the reindexer.
+use serde_json::{json, Map, Number, Value};
+use std::fmt;
+use std::sync::OnceLock;
+use tracing::field::{Field, Visit};
+use tracing::{Event, Subscriber};
+use tracing_subscriber::field::RecordFields;
+use tracing_subscriber::filter::{EnvFilter, LevelFilter};
+use tracing_subscriber::fmt::{
+    format::Writer,
+    time::{FormatTime as _, SystemTime},
+    FmtContext, FormatEvent, FormatFields, FormattedFields,
+};
+use tracing_subscriber::registry::LookupSpan;
+
+/// The format to write log events in.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum LogFormat {
+    /// Human readable lines, the default.
+    #[default]
+    Pretty,
+    /// One JSON object per line, for consumption by log aggregators.
+    Json,
+}
+
+/// The format logging was initialized with, so that child processes can log like us.
+static CURRENT: OnceLock<LogFormat> = OnceLock::new();
+
+impl LogFormat {
+    /// The value of the `--log-format` flag selecting this format.
+    pub fn as_str(self) -> &'static str {
+        match self {
+            LogFormat::Pretty => "pretty",
+            LogFormat::Json => "json",
+        }
+    }
+
+    /// The format logging was initialized with, defaulting to pretty output.
+    pub fn current() -> Self {
+        CURRENT.get().copied().unwrap_or_default()
+    }
+
+    pub(crate) fn set_current(self) {
+        // Only the first initialization of tracing takes effect, so the same goes here.
+        let _ = CURRENT.set(self);
+    }
+}
+
+/// How much to log, raised by each `--verbose` and lowered by each `--quiet` from info.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub struct Verbosity(i8);
+
+/// The verbosity logging was initialized with, so that child processes can log as much as us.
+static CURRENT_VERBOSITY: OnceLock<Verbosity> = OnceLock::new();
+
+impl Verbosity {
+    /// The verbosity given by the number of `--verbose` and `--quiet` flags.
+    pub fn new(verbose: u8, quiet: u8) -> Self {
+        Self(verbose.min(2) as i8 - quiet.min(2) as i8)
+    }
+
+    /// The level the reindexer logs at.
+    ///
+    /// This never goes below errors, however quiet, so that failures are always logged.
+    pub fn level(self) -> LevelFilter {
+        match self.0 {
+            ..=-2 => LevelFilter::ERROR,
+            -1 => LevelFilter::WARN,
+            0 => LevelFilter::INFO,
+            1 => LevelFilter::DEBUG,
+            _ => LevelFilter::TRACE,
+        }
+    }
+
+    /// The flags selecting this verbosity, to pass on to a child process.
+    pub fn args(self) -> Vec<&'static str> {
+        if self.0 < 0 {
+            vec!["--quiet"; self.0.unsigned_abs() as usize]
+        } else {
+            vec!["--verbose"; self.0 as usize]
+        }
+    }
+
+    /// The verbosity logging was initialized with, defaulting to info.
+    pub fn current() -> Self {
+        CURRENT_VERBOSITY.get().copied().unwrap_or_default()
+    }
+
+    pub(crate) fn set_current(self) {
+        let _ = CURRENT_VERBOSITY.set(self);
+    }
+
+    /// The filter to log with when `RUST_LOG` isn't set.
+    ///
+    /// Dependencies log at this level too, but never more than info, since their debug output
+    /// would drown out ours. In a terminal, the noisiest of them are held back further still.
+    fn default_filter(self, is_terminal: bool) -> String {
+        let level = self.level();
+        let deps = level.min(LevelFilter::INFO);
+        if is_terminal {
+            format!(
+                "{},penumbra_={},cnidarium={},sqlx={},penumbra_reindexer={}",
+                deps,
+                level.min(LevelFilter::ERROR),
+                level.min(LevelFilter::WARN),
+                level.min(LevelFilter::WARN),
+                level
+            )
+        } else {
+            format!("{},penumbra_reindexer={}", deps, level)
+        }
+        .to_lowercase()
+    }
+
+    /// The filter to log with, given the value of `RUST_LOG`, which overrides this verbosity.
+    pub(crate) fn env_filter(self, is_terminal: bool, rust_log: Option<&str>) -> EnvFilter {
+        let filter = match rust_log.map(EnvFilter::try_new) {
+            Some(Ok(x)) => x,
+            // A `RUST_LOG` that doesn't parse is ignored, as if it weren't set.
+            _ => EnvFilter::try_new(self.default_filter(is_terminal))
+                .expect("failed to initialize logging"),
+        };
+        filter
+            // Without explicitly disabling the `r1cs` target, the ZK proof implementations
+            // will spend an enormous amount of CPU and memory building useless tracing output.
+            .add_directive(
+                "r1cs=off"
+                    .parse()
+                    .expect("rics=off is a valid filter directive"),
+            )
+    }
+}
+
+/// Collects the fields of an event or span into a JSON object.
+#[derive(Default)]
+struct JsonVisitor(Map<String, Value>);
+
+impl Visit for JsonVisitor {
+    fn record_f64(&mut self, field: &Field, value: f64) {
+        let value = Number::from_f64(value)
+            .map(Value::Number)
+            .unwrap_or_else(|| Value::String(value.to_string()));
+        self.0.insert(field.name().to_owned(), value);
+    }
+
+    fn record_i64(&mut self, field: &Field, value: i64) {
+        self.0.insert(field.name().to_owned(), value.into());
+    }
+
+    fn record_u64(&mut self, field: &Field, value: u64) {
+        self.0.insert(field.name().to_owned(), value.into());
+    }
+
+    fn record_bool(&mut self, field: &Field, value: bool) {
+        self.0.insert(field.name().to_owned(), value.into());
+    }
+
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.insert(field.name().to_owned(), value.into());
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn fmt::Debug) {
+        self.0
+            .insert(field.name().to_owned(), format!("{:?}", value).into());
+    }
+}
+
+/// Formats the fields of spans as a JSON object, so that [JsonFormat] can nest them.
+pub struct JsonFields;
+
+impl<'writer> FormatFields<'writer> for JsonFields {
+    fn format_fields<R: RecordFields>(
+        &self,
+        mut writer: Writer<'writer>,
+        fields: R,
+    ) -> fmt::Result {
+        let mut visitor = JsonVisitor::default();
+        fields.record(&mut visitor);
+        write!(writer, "{}", Value::Object(visitor.0))
+    }
+
+    fn add_fields(
+        &self,
+        current: &'writer mut FormattedFields<Self>,
+        fields: &tracing::span::Record<'_>,
+    ) -> fmt::Result {
+        let mut visitor = JsonVisitor(parse_fields(&current.fields));
+        fields.record(&mut visitor);
+        current.fields = Value::Object(visitor.0).to_string();
+        Ok(())
+    }
+}
+
+fn parse_fields(fields: &str) -> Map<String, Value> {
+    match serde_json::from_str(fields) {
+        Ok(Value::Object(map)) => map,
+        _ => Map::new(),
+    }
+}
+
+/// Writes each event as a single line JSON object.
+///
+/// The object has the `timestamp`, `level`, `target`, and `message` of the event,
+/// its other `fields`, and the `spans` it's in, outermost first, each having a `name`
+/// alongside the fields of that span.
+pub struct JsonFormat;
+
+impl<S, N> FormatEvent<S, N> for JsonFormat
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+    N: for<'w> FormatFields<'w> + 'static,
+{
+    fn format_event(
+        &self,
+        ctx: &FmtContext<'_, S, N>,
+        mut writer: Writer<'_>,
+        event: &Event<'_>,
+    ) -> fmt::Result {
+        let metadata = event.metadata();
+        let mut timestamp = String::new();
+        SystemTime.format_time(&mut Writer::new(&mut timestamp))?;
+        let mut visitor = JsonVisitor::default();
+        event.record(&mut visitor);
+        let mut fields = visitor.0;
+        let message = fields.remove("message").unwrap_or(Value::Null);
+        let spans: Vec<Value> = ctx
+            .event_scope()
+            .into_iter()
+            .flat_map(|scope| scope.from_root())
+            .map(|span| {
+                let mut object = span
+                    .extensions()
+                    .get::<FormattedFields<N>>()
+                    .map(|x| parse_fields(&x.fields))
+                    .unwrap_or_default();
+                object.insert("name".to_owned(), span.name().into());
+                Value::Object(object)
+            })
+            .collect();
+        let line = json!({
+            "timestamp": timestamp,
+            "level": metadata.level().as_str(),
+            "target": metadata.target(),
+            "message": message,
+            "fields": fields,
+            "spans": spans,
+        });
+        writeln!(writer, "{}", line)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use clap::Parser as _;
+    use std::io;
+    use std::sync::{Arc, Mutex};
+
+    #[derive(Clone, Default)]
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl io::Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[derive(Debug)]
+    #[allow(dead_code)]
+    enum Version {
+        V2,
+    }
+
+    #[test]
+    fn test_json_lines() -> anyhow::Result<()> {
+        let buffer = Buffer::default();
+        let subscriber = tracing_subscriber::fmt()
+            .with_ansi(false)
+            .fmt_fields(JsonFields)
+            .event_format(JsonFormat)
+            .with_writer({
+                let buffer = buffer.clone();
+                move || buffer.clone()
+            })
+            .finish();
+        tracing::subscriber::with_default(subscriber, || {
+            let outer = tracing::info_span!(
+                "init_then_run_to",
+                genesis_height = 501975u64,
+                version = ?Version::V2,
+                last_block = tracing::field::Empty,
+            );
+            let _outer = outer.enter();
+            outer.record("last_block", 501980u64);
+            let inner = tracing::info_span!("process_block", height = 501976u64);
+            let _inner = inner.enter();
+            tracing::info!(stop_height = 501980u64, "processing \"block\"");
+            tracing::warn!("no fields");
+        });
+
+        let output = String::from_utf8(buffer.0.lock().unwrap().clone())?;
+        let lines = output
+            .lines()
+            .map(serde_json::from_str)
+            .collect::<Result<Vec<Value>, _>>()?;
+        assert_eq!(lines.len(), 2, "{}", output);
+
+        let line = &lines[0];
+        assert_eq!(line["level"], "INFO");
+        assert_eq!(line["target"], module_path!());
+        assert_eq!(line["message"], "processing \"block\"");
+        assert_eq!(line["fields"], json!({ "stop_height": 501980 }));
+        assert!(line["timestamp"].is_string());
+        assert_eq!(
+            line["spans"],
+            json!([
+                {
+                    "name": "init_then_run_to",
+                    "genesis_height": 501975,
+                    "version": "V2",
+                    "last_block": 501980,
+                },
+                { "name": "process_block", "height": 501976 },
+            ])
+        );
+
+        assert_eq!(lines[1]["level"], "WARN");
+        assert_eq!(lines[1]["message"], "no fields");
+        assert_eq!(lines[1]["fields"], json!({}));
+        Ok(())
+    }
+
+    /// The verbosity and most verbose level logged, given the flags and `RUST_LOG`.
+    fn effective(
+        args: &[&str],
+        rust_log: Option<&str>,
+    ) -> anyhow::Result<(Verbosity, LevelFilter)> {
+        let opt = crate::Opt::try_parse_from(
+            ["penumbra-reindexer"]
+                .into_iter()
+                .chain(args.iter().copied())
+                .chain(["versions"]),
+        )?;
+        let verbosity = opt.verbosity();
+        let level = verbosity
+            .env_filter(false, rust_log)
+            .max_level_hint()
+            .expect("the filter has a level");
+        Ok((verbosity, level))
+    }
+
+    #[test]
+    fn test_verbosity_flags() -> anyhow::Result<()> {
+        for (args, level) in [
+            (&[][..], LevelFilter::INFO),
+            (&["-v"][..], LevelFilter::DEBUG),
+            (&["--verbose"][..], LevelFilter::DEBUG),
+            (&["-vv"][..], LevelFilter::TRACE),
+            (&["-v", "--verbose", "-v"][..], LevelFilter::TRACE),
+            (&["-q"][..], LevelFilter::WARN),
+            (&["--quiet"][..], LevelFilter::WARN),
+            (&["-qq"][..], LevelFilter::ERROR),
+            // However quiet, errors are still logged.
+            (&["-qqq"][..], LevelFilter::ERROR),
+        ] {
+            let (verbosity, logged) = effective(args, None)?;
+            assert_eq!(verbosity.level(), level, "{:?}", args);
+            assert_eq!(logged, level, "{:?}", args);
+            // Child processes are passed flags logging at the same level.
+            assert_eq!(effective(&verbosity.args(), None)?.1, level, "{:?}", args);
+        }
+
+        // The flags can come after the subcommand too.
+        let opt = crate::Opt::try_parse_from(["penumbra-reindexer", "versions", "-vv"])?;
+        assert_eq!(opt.verbosity().level(), LevelFilter::TRACE);
+
+        // Being quiet and verbose at once makes no sense.
+        assert!(effective(&["-q", "-v"], None).is_err());
+
+        // `RUST_LOG` overrides the flags, either way, unless it doesn't parse.
+        assert_eq!(effective(&["-qq"], Some("trace"))?.1, LevelFilter::TRACE);
+        assert_eq!(effective(&["-vv"], Some("warn"))?.1, LevelFilter::WARN);
+        assert_eq!(
+            effective(&["-q"], Some("penumbra_reindexer=loud"))?.1,
+            LevelFilter::WARN
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_verbosity_of_dependencies() {
+        // Dependencies are quieted along with the reindexer, but aren't made more verbose.
+        assert_eq!(
+            Verbosity::new(0, 0).default_filter(true),
+            "info,penumbra_=error,cnidarium=warn,sqlx=warn,penumbra_reindexer=info"
+        );
+        assert_eq!(
+            Verbosity::new(2, 0).default_filter(true),
+            "info,penumbra_=error,cnidarium=warn,sqlx=warn,penumbra_reindexer=trace"
+        );
+        assert_eq!(
+            Verbosity::new(0, 2).default_filter(true),
+            "error,penumbra_=error,cnidarium=error,sqlx=error,penumbra_reindexer=error"
+        );
+        assert_eq!(
+            Verbosity::new(1, 0).default_filter(false),
+            "info,penumbra_reindexer=debug"
+        );
+        assert_eq!(
+            Verbosity::new(0, 1).default_filter(false),
+            "warn,penumbra_reindexer=warn"
+        );
+    }
+}
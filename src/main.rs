@@ -1,8 +1,17 @@
 use clap::Parser;
+use std::process::ExitCode;
 
 #[tokio::main]
-async fn main() -> anyhow::Result<()> {
+async fn main() -> ExitCode {
     let opt = penumbra_reindexer::Opt::parse();
-    penumbra_reindexer::Opt::init_console_tracing();
-    opt.run().await
+    penumbra_reindexer::Opt::init_tracing(opt.log_format, opt.verbosity());
+    match opt.run().await {
+        Ok(()) => ExitCode::SUCCESS,
+        // This reports the error as returning it from main would, but exits with a code
+        // saying what kind of error it was.
+        Err(e) => {
+            eprintln!("Error: {:?}", e);
+            ExitCode::from(penumbra_reindexer::error::exit_code(&e))
+        }
+    }
 }
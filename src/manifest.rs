@@ -0,0 +1,277 @@
+//! Manifests, small JSON files kept next to archives, describing what's in each one.
+//!
+//! These let many archives be catalogued without opening them, and let `verify` check that
+//! an archive still holds what it held when its manifest was written.
+use anyhow::{anyhow, Context as _};
+use serde_json::Value;
+use sha2::{Digest as _, Sha256};
+use std::path::{Path, PathBuf};
+use tokio_stream::StreamExt as _;
+use tracing_subscriber::fmt::{
+    format::Writer,
+    time::{FormatTime as _, SystemTime},
+};
+
+use crate::storage::Storage;
+
+/// The path of the manifest kept next to an archive.
+pub fn manifest_path(archive_file: &Path) -> PathBuf {
+    let mut out = archive_file.as_os_str().to_owned();
+    out.push(".manifest.json");
+    out.into()
+}
+
+/// The time now, as an RFC 3339 timestamp in UTC, like the timestamps of JSON logs.
+fn now() -> anyhow::Result<String> {
+    let mut out = String::new();
+    SystemTime
+        .format_time(&mut Writer::new(&mut out))
+        .map_err(|_| anyhow!("failed to format the current time"))?;
+    Ok(out)
+}
+
+/// A hash of what an archive holds: its geneses, then its blocks, in order of height.
+///
+/// Each is hashed along with its height and length, as the archive gives it back, so that
+/// archives with the same contents hash the same, however they happen to be stored.
+#[derive(Default)]
+pub struct ContentHasher(Sha256);
+
+impl ContentHasher {
+    /// Add a genesis, by its initial height, or a block, by its height, to the hash.
+    pub fn add(&mut self, height: u64, data: &[u8]) {
+        self.0.update(height.to_le_bytes());
+        self.0.update((data.len() as u64).to_le_bytes());
+        self.0.update(data);
+    }
+
+    pub fn finish(self) -> String {
+        hex::encode(self.0.finalize())
+    }
+
+    /// Hash everything in an archive, reading it in full.
+    pub async fn of(archive: &Storage) -> anyhow::Result<String> {
+        let mut hasher = Self::default();
+        for height in archive.genesis_initial_heights().await? {
+            let genesis = archive
+                .get_genesis(height)
+                .await?
+                .ok_or(anyhow!("genesis at initial height {} disappeared", height))?;
+            hasher.add(height, &genesis.encode()?);
+        }
+        let mut blocks = archive.stream_encoded_blocks();
+        while let Some((height, data)) = blocks.try_next().await? {
+            hasher.add(height, &data);
+        }
+        Ok(hasher.finish())
+    }
+}
+
+/// What an archive holds, as written to its manifest.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Manifest {
+    pub chain_id: String,
+    /// The first and last heights of the blocks in the archive, if it has any.
+    pub heights: Option<(u64, u64)>,
+    pub block_count: u64,
+    /// When the archive was first written to, as an RFC 3339 timestamp.
+    pub created_at: String,
+    /// The version of the reindexer which last wrote to the archive.
+    pub reindexer_version: String,
+    /// The SHA-256 hash of the geneses and blocks in the archive, in hex.
+    pub content_hash: String,
+}
+
+impl Manifest {
+    /// Describe an archive as it is now, reading it in full to hash its contents.
+    ///
+    /// `created_at` is when the archive was created, if that's known, and now otherwise.
+    pub async fn of(archive: &Storage, created_at: Option<String>) -> anyhow::Result<Self> {
+        let mut out = Self::without_content_hash(archive, created_at).await?;
+        out.content_hash = ContentHasher::of(archive).await?;
+        Ok(out)
+    }
+
+    /// Describe an archive as it is now, from what it records, without reading its blocks.
+    ///
+    /// The content hash is left empty, for [Manifest::mismatches] to skip.
+    pub async fn without_content_hash(
+        archive: &Storage,
+        created_at: Option<String>,
+    ) -> anyhow::Result<Self> {
+        let (block_count, _, _) = archive.block_sizes().await?;
+        Ok(Self {
+            chain_id: archive.chain_id().await?,
+            heights: archive
+                .first_height()
+                .await?
+                .zip(archive.last_height().await?),
+            block_count,
+            created_at: created_at.map_or_else(now, Ok)?,
+            reindexer_version: env!("CARGO_PKG_VERSION").to_owned(),
+            content_hash: String::new(),
+        })
+    }
+
+    pub fn to_value(&self) -> Value {
+        serde_json::json!({
+            "chain_id": self.chain_id,
+            "first_height": self.heights.map(|x| x.0),
+            "last_height": self.heights.map(|x| x.1),
+            "block_count": self.block_count,
+            "created_at": self.created_at,
+            "reindexer_version": self.reindexer_version,
+            "content_hash": self.content_hash,
+        })
+    }
+
+    pub fn from_value(value: &Value) -> anyhow::Result<Self> {
+        let string = |key: &str| -> anyhow::Result<String> {
+            Ok(value
+                .get(key)
+                .and_then(|x| x.as_str())
+                .ok_or(anyhow!("expected string `{}`", key))?
+                .to_owned())
+        };
+        let height = |key: &str| value.get(key).and_then(|x| x.as_u64());
+        Ok(Self {
+            chain_id: string("chain_id")?,
+            heights: height("first_height").zip(height("last_height")),
+            block_count: value
+                .get("block_count")
+                .and_then(|x| x.as_u64())
+                .ok_or(anyhow!("expected integer `block_count`"))?,
+            created_at: string("created_at")?,
+            reindexer_version: string("reindexer_version")?,
+            content_hash: string("content_hash")?,
+        })
+    }
+
+    /// Read a manifest from a file, if there's one there.
+    pub fn read(path: &Path) -> anyhow::Result<Option<Self>> {
+        if !path.exists() {
+            return Ok(None);
+        }
+        let parse = || -> anyhow::Result<Self> {
+            Self::from_value(&serde_json::from_slice(&std::fs::read(path)?)?)
+        };
+        parse()
+            .map(Some)
+            .with_context(|| format!("failed to read manifest '{}'", path.display()))
+    }
+
+    /// Write this manifest to a file, replacing whatever's there.
+    pub fn write(&self, path: &Path) -> anyhow::Result<()> {
+        let mut data = serde_json::to_vec_pretty(&self.to_value())?;
+        data.push(b'\n');
+        crate::files::write_atomically(path, &data)
+            .with_context(|| format!("failed to write manifest '{}'", path.display()))
+    }
+
+    /// Describe how an archive, as described by `actual`, differs from this manifest.
+    ///
+    /// Only what's in the archive is compared, not when or by which version it was written.
+    /// The content hash is left out if `actual` has none, as when it wasn't worth reading
+    /// the whole archive to hash it.
+    pub fn mismatches(&self, actual: &Self) -> Vec<String> {
+        let heights = |x: Option<(u64, u64)>| match x {
+            Some((first, last)) => format!("{}..={}", first, last),
+            None => "none".to_owned(),
+        };
+        let mut out = Vec::new();
+        if self.chain_id != actual.chain_id {
+            out.push(format!(
+                "the manifest is for chain '{}', but the archive is for '{}'",
+                self.chain_id, actual.chain_id
+            ));
+        }
+        if self.heights != actual.heights {
+            out.push(format!(
+                "the manifest has blocks at heights {}, but the archive has them at heights {}",
+                heights(self.heights),
+                heights(actual.heights)
+            ));
+        }
+        if self.block_count != actual.block_count {
+            out.push(format!(
+                "the manifest has {} blocks, but the archive has {}",
+                self.block_count, actual.block_count
+            ));
+        }
+        if !actual.content_hash.is_empty() && self.content_hash != actual.content_hash {
+            out.push(format!(
+                "the manifest has content hash {}, but the archive hashes to {}",
+                self.content_hash, actual.content_hash
+            ));
+        }
+        out
+    }
+}
+
+/// Write the manifest of an archive file next to it, describing it as it is now.
+///
+/// The creation time is carried over from the manifest already there, if it's for the same
+/// chain, since the archive was added to, rather than created anew.
+pub async fn write_manifest(archive_file: &Path, archive: &Storage) -> anyhow::Result<Manifest> {
+    let path = manifest_path(archive_file);
+    let chain_id = archive.chain_id().await?;
+    let created_at = match Manifest::read(&path) {
+        Ok(Some(x)) if x.chain_id == chain_id => Some(x.created_at),
+        Ok(_) => None,
+        Err(e) => {
+            tracing::warn!("replacing an unreadable manifest: {:#}", e);
+            None
+        }
+    };
+    let manifest = Manifest::of(archive, created_at).await?;
+    manifest.write(&path)?;
+    Ok(manifest)
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::{Block, Genesis};
+
+    async fn test_archive(last: u64) -> anyhow::Result<Storage> {
+        let archive = Storage::new(None, Some("penumbra-test")).await?;
+        archive
+            .put_genesis(&Genesis::test_value_at_height(1))
+            .await?;
+        for height in 1..=last {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        Ok(archive)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_manifest_describes_archive() -> anyhow::Result<()> {
+        let archive = test_archive(5).await?;
+        let manifest = Manifest::of(&archive, None).await?;
+        assert_eq!(manifest.chain_id, "penumbra-test");
+        assert_eq!(manifest.heights, Some((1, 5)));
+        assert_eq!(manifest.block_count, 5);
+        assert_eq!(manifest.content_hash.len(), 64);
+        assert!(manifest.mismatches(&manifest).is_empty());
+        assert_eq!(Manifest::from_value(&manifest.to_value())?, manifest);
+
+        // The same contents hash the same, and different ones don't.
+        let same = Manifest::of(&test_archive(5).await?, None).await?;
+        assert_eq!(same.content_hash, manifest.content_hash);
+        let archive = test_archive(4).await?;
+        archive.put_block(&Block::test_value_at_time(5, 1)).await?;
+        let changed = Manifest::of(&archive, None).await?;
+        assert_eq!(
+            manifest.mismatches(&changed),
+            vec![format!(
+                "the manifest has content hash {}, but the archive hashes to {}",
+                manifest.content_hash, changed.content_hash
+            )]
+        );
+        let shorter = Manifest::of(&test_archive(4).await?, None).await?;
+        assert_eq!(manifest.mismatches(&shorter).len(), 3);
+        Ok(())
+    }
+}
@@ -0,0 +1,127 @@
+//! A minimal Prometheus endpoint, for watching the progress of long-running commands.
+//!
+//! There's only ever one command running per process, so the metrics are global,
+//! which lets the code processing blocks record them without threading anything through.
+use std::{
+    net::SocketAddr,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        OnceLock,
+    },
+    time::Instant,
+};
+
+use anyhow::Context as _;
+use tokio::{
+    io::{AsyncReadExt as _, AsyncWriteExt as _},
+    net::TcpListener,
+    task::JoinHandle,
+};
+
+struct Metrics {
+    blocks_processed: AtomicU64,
+    current_height: AtomicU64,
+    regen_step: AtomicU64,
+    /// When the first block was processed, for calculating a rate.
+    started: OnceLock<Instant>,
+}
+
+static METRICS: Metrics = Metrics {
+    blocks_processed: AtomicU64::new(0),
+    current_height: AtomicU64::new(0),
+    regen_step: AtomicU64::new(0),
+    started: OnceLock::new(),
+};
+
+/// Record that a block at a given height has been processed.
+pub fn record_block(height: u64) {
+    METRICS.started.get_or_init(Instant::now);
+    METRICS.blocks_processed.fetch_add(1, Ordering::Relaxed);
+    METRICS.current_height.store(height, Ordering::Relaxed);
+}
+
+/// Record which step of a regeneration is running.
+pub fn set_regen_step(step: u64) {
+    METRICS.regen_step.store(step, Ordering::Relaxed);
+}
+
+/// Render the metrics in the Prometheus text format.
+fn render() -> String {
+    let blocks_processed = METRICS.blocks_processed.load(Ordering::Relaxed);
+    let blocks_per_second = match METRICS.started.get() {
+        Some(started) if started.elapsed().as_secs_f64() > 0.0 => {
+            blocks_processed as f64 / started.elapsed().as_secs_f64()
+        }
+        _ => 0.0,
+    };
+    format!(
+        "# HELP reindexer_blocks_processed_total Blocks processed by this command.\n\
+         # TYPE reindexer_blocks_processed_total counter\n\
+         reindexer_blocks_processed_total {}\n\
+         # HELP reindexer_current_height Height of the last block processed.\n\
+         # TYPE reindexer_current_height gauge\n\
+         reindexer_current_height {}\n\
+         # HELP reindexer_regen_step Regeneration step currently running, starting from 1.\n\
+         # TYPE reindexer_regen_step gauge\n\
+         reindexer_regen_step {}\n\
+         # HELP reindexer_blocks_per_second Average rate of processing blocks.\n\
+         # TYPE reindexer_blocks_per_second gauge\n\
+         reindexer_blocks_per_second {}\n",
+        blocks_processed,
+        METRICS.current_height.load(Ordering::Relaxed),
+        METRICS.regen_step.load(Ordering::Relaxed),
+        blocks_per_second,
+    )
+}
+
+/// A running metrics endpoint, which stops when dropped.
+pub struct MetricsServer {
+    task: JoinHandle<()>,
+}
+
+impl Drop for MetricsServer {
+    fn drop(&mut self) {
+        self.task.abort();
+    }
+}
+
+/// Start serving metrics over HTTP at a given address.
+///
+/// Every request gets the metrics in response, regardless of its path.
+pub async fn serve(addr: SocketAddr) -> anyhow::Result<MetricsServer> {
+    let listener = TcpListener::bind(addr)
+        .await
+        .with_context(|| format!("failed to bind metrics endpoint to {}", addr))?;
+    tracing::info!("serving metrics at http://{}/metrics", addr);
+    let task = tokio::spawn(async move {
+        loop {
+            let mut stream = match listener.accept().await {
+                Ok((stream, _)) => stream,
+                Err(e) => {
+                    tracing::warn!("failed to accept metrics connection: {}", e);
+                    continue;
+                }
+            };
+            tokio::spawn(async move {
+                // We don't care what was requested, but we should read the request before responding.
+                let mut request = [0u8; 1024];
+                if stream.read(&mut request).await.is_err() {
+                    return;
+                }
+                let body = render();
+                let response = format!(
+                    "HTTP/1.1 200 OK\r\n\
+                     Content-Type: text/plain; version=0.0.4\r\n\
+                     Content-Length: {}\r\n\
+                     Connection: close\r\n\r\n{}",
+                    body.len(),
+                    body
+                );
+                if let Err(e) = stream.write_all(response.as_bytes()).await {
+                    tracing::debug!("failed to write metrics response: {}", e);
+                }
+            });
+        }
+    });
+    Ok(MetricsServer { task })
+}
@@ -0,0 +1,748 @@
+//! Copying archives to and from S3-compatible object stores.
+//!
+//! Archives are still written to local disk, since sqlite needs a file to work in, and are
+//! uploaded once finished, then downloaded again before being read. Requests are signed by
+//! `rusty-s3`, as URLs which are good for a while, then sent with `reqwest`. Buckets are
+//! addressed by path, so that this works with the stores compatible with S3, not just AWS.
+use anyhow::{anyhow, Context as _};
+use reqwest::{Client, Method, Response, StatusCode};
+use rusty_s3::{actions::CreateMultipartUpload, Bucket, Credentials, S3Action as _, UrlStyle};
+use std::fmt;
+use std::io::{Read as _, Write as _};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use tokio_stream::StreamExt as _;
+use url::Url;
+
+/// The variable with the URL of the object store, if not AWS itself, as the AWS tools name it.
+const ENDPOINT_VAR: &str = "AWS_ENDPOINT_URL";
+/// The variables with the region of the object store, in order of preference.
+const REGION_VARS: [&str; 2] = ["AWS_REGION", "AWS_DEFAULT_REGION"];
+const ACCESS_KEY_ID_VAR: &str = "AWS_ACCESS_KEY_ID";
+const SECRET_ACCESS_KEY_VAR: &str = "AWS_SECRET_ACCESS_KEY";
+const SESSION_TOKEN_VAR: &str = "AWS_SESSION_TOKEN";
+
+/// The region requests are signed for, unless configured otherwise.
+const DEFAULT_REGION: &str = "us-east-1";
+
+/// The largest file uploaded in a single request, and the size of the parts of larger ones.
+///
+/// S3 takes at most 10,000 parts, so this can upload files of up to 640 GiB.
+const DEFAULT_PART_SIZE: usize = 64 << 20;
+
+/// How long a signed URL is good for, which it only has to be until the request is sent.
+const SIGNED_FOR: Duration = Duration::from_secs(60 * 60);
+
+/// A location in an object store: a bucket, and the prefix of the keys within it.
+#[derive(Clone, Debug, PartialEq)]
+pub struct S3Url {
+    bucket: String,
+    prefix: String,
+}
+
+impl S3Url {
+    /// Parse a location given as `s3://<BUCKET>/<PREFIX>`, where the prefix can be left out.
+    pub fn parse(url: &str) -> anyhow::Result<Self> {
+        let rest = url
+            .strip_prefix("s3://")
+            .ok_or_else(|| anyhow!("'{}' isn't a URL like s3://<BUCKET>/<PREFIX>", url))?;
+        let (bucket, prefix) = rest.split_once('/').unwrap_or((rest, ""));
+        anyhow::ensure!(!bucket.is_empty(), "'{}' has no bucket", url);
+        Ok(Self {
+            bucket: bucket.to_owned(),
+            prefix: prefix.trim_matches('/').to_owned(),
+        })
+    }
+
+    /// The key a file of a given name is kept at.
+    fn key(&self, name: &str) -> String {
+        match self.prefix.as_str() {
+            "" => name.to_owned(),
+            prefix => format!("{}/{}", prefix, name),
+        }
+    }
+}
+
+impl fmt::Display for S3Url {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.prefix.as_str() {
+            "" => write!(f, "s3://{}", self.bucket),
+            prefix => write!(f, "s3://{}/{}", self.bucket, prefix),
+        }
+    }
+}
+
+/// A location in an object store, with what's needed to upload files to it, and download them back.
+#[derive(Clone)]
+pub struct ObjectStore {
+    client: Client,
+    bucket: Bucket,
+    credentials: Credentials,
+    location: S3Url,
+    part_size: usize,
+}
+
+impl ObjectStore {
+    /// Reach a location in the object store at an endpoint, signing requests for a region.
+    pub fn new(
+        location: S3Url,
+        endpoint: &str,
+        region: &str,
+        credentials: Credentials,
+    ) -> anyhow::Result<Self> {
+        let mut endpoint = Url::parse(endpoint)
+            .with_context(|| format!("invalid object store endpoint '{}'", endpoint))?;
+        anyhow::ensure!(
+            endpoint.host_str().is_some(),
+            "the object store endpoint '{}' has no host",
+            endpoint
+        );
+        // Buckets are addressed by path under that of the endpoint, which has to end in a slash
+        // to be kept, rather than replaced.
+        if !endpoint.path().ends_with('/') {
+            let path = format!("{}/", endpoint.path());
+            endpoint.set_path(&path);
+        }
+        let bucket = Bucket::new(
+            endpoint,
+            UrlStyle::Path,
+            location.bucket.clone(),
+            region.to_owned(),
+        )
+        .with_context(|| format!("invalid bucket '{}'", location.bucket))?;
+        Ok(Self {
+            client: Client::new(),
+            bucket,
+            credentials,
+            location,
+            part_size: DEFAULT_PART_SIZE,
+        })
+    }
+
+    /// Reach a location, given as `s3://<BUCKET>/<PREFIX>`, as configured by the environment.
+    ///
+    /// This reads the same variables as the AWS tools: the credentials from `AWS_ACCESS_KEY_ID`,
+    /// `AWS_SECRET_ACCESS_KEY`, and `AWS_SESSION_TOKEN`, if set, the region from `AWS_REGION`,
+    /// or `AWS_DEFAULT_REGION`, and, for stores other than AWS, their URL from `AWS_ENDPOINT_URL`.
+    pub fn from_env(url: &str) -> anyhow::Result<Self> {
+        let var = |name: &str| std::env::var(name).ok().filter(|x| !x.is_empty());
+        let required = |name: &str| {
+            var(name).ok_or_else(|| anyhow!("{} must be set to use the object store", name))
+        };
+        let location = S3Url::parse(url)?;
+        let region = REGION_VARS
+            .iter()
+            .find_map(|x| var(x))
+            .unwrap_or_else(|| DEFAULT_REGION.to_owned());
+        let endpoint =
+            var(ENDPOINT_VAR).unwrap_or_else(|| format!("https://s3.{}.amazonaws.com", region));
+        let (key, secret) = (
+            required(ACCESS_KEY_ID_VAR)?,
+            required(SECRET_ACCESS_KEY_VAR)?,
+        );
+        let credentials = match var(SESSION_TOKEN_VAR) {
+            Some(token) => Credentials::new_with_token(key, secret, token),
+            None => Credentials::new(key, secret),
+        };
+        Self::new(location, &endpoint, &region, credentials)
+    }
+
+    /// Send a request to a signed URL, for the object at a key, failing unless it succeeds,
+    /// or is not found.
+    async fn send(
+        &self,
+        method: Method,
+        key: &str,
+        url: Url,
+        body: Vec<u8>,
+    ) -> anyhow::Result<Response> {
+        let response = self
+            .client
+            .request(method.clone(), url)
+            .body(body)
+            .send()
+            .await
+            .with_context(|| {
+                format!(
+                    "failed to reach the object store at {}",
+                    self.bucket.base_url()
+                )
+            })?;
+        let status = response.status();
+        if status.is_success() || status == StatusCode::NOT_FOUND {
+            return Ok(response);
+        }
+        let text = response.text().await.unwrap_or_default();
+        anyhow::bail!(
+            "the object store refused {} of '{}' in bucket '{}', with {}: {}",
+            method,
+            key,
+            self.location.bucket,
+            status,
+            text.trim()
+        )
+    }
+
+    /// Send a request, failing if what it's for isn't found.
+    async fn send_found(
+        &self,
+        method: Method,
+        key: &str,
+        url: Url,
+        body: Vec<u8>,
+    ) -> anyhow::Result<Response> {
+        let response = self.send(method.clone(), key, url, body).await?;
+        if response.status() == StatusCode::NOT_FOUND {
+            let text = response.text().await.unwrap_or_default();
+            anyhow::bail!(
+                "the object store found nothing for {} of '{}' in bucket '{}': {}",
+                method,
+                key,
+                self.location.bucket,
+                text.trim()
+            );
+        }
+        Ok(response)
+    }
+
+    /// The name of a file, which it's kept under in the object store.
+    fn name(file: &Path) -> anyhow::Result<&str> {
+        file.file_name()
+            .and_then(|x| x.to_str())
+            .ok_or_else(|| anyhow!("'{}' has no file name to upload it as", file.display()))
+    }
+
+    /// Upload a file, along with those kept next to it, to the prefix, each by its name.
+    ///
+    /// Those kept next to it which don't exist are removed from the object store, so that
+    /// stale copies there aren't taken for what goes with this file.
+    pub async fn upload(&self, file: &Path, next_to: &[PathBuf]) -> anyhow::Result<()> {
+        self.upload_file(file).await?;
+        for other in next_to {
+            if other.exists() {
+                self.upload_file(other).await?;
+            } else {
+                let key = self.location.key(Self::name(other)?);
+                let url = self
+                    .bucket
+                    .delete_object(Some(&self.credentials), &key)
+                    .sign(SIGNED_FOR);
+                self.send(Method::DELETE, &key, url, Vec::new()).await?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Download a file, along with those kept next to it, from where [Self::upload] put them.
+    ///
+    /// This replaces the files already there. Those kept next to it which aren't in the object
+    /// store are removed, so that stale local copies aren't taken for what goes with this file.
+    pub async fn download(&self, file: &Path, next_to: &[PathBuf]) -> anyhow::Result<()> {
+        anyhow::ensure!(
+            self.download_file(file).await?,
+            "'{}' isn't in the object store at {}",
+            Self::name(file)?,
+            self.location
+        );
+        for other in next_to {
+            if !self.download_file(other).await? && other.exists() {
+                std::fs::remove_file(other)
+                    .with_context(|| format!("failed to remove '{}'", other.display()))?;
+            }
+        }
+        Ok(())
+    }
+
+    async fn upload_file(&self, file: &Path) -> anyhow::Result<()> {
+        let key = self.location.key(Self::name(file)?);
+        let mut f = std::fs::File::open(file)
+            .with_context(|| format!("failed to open '{}'", file.display()))?;
+        let len = f.metadata()?.len();
+        if len <= self.part_size as u64 {
+            let mut body = Vec::with_capacity(len as usize);
+            f.read_to_end(&mut body)?;
+            let url = self
+                .bucket
+                .put_object(Some(&self.credentials), &key)
+                .sign(SIGNED_FOR);
+            self.send_found(Method::PUT, &key, url, body).await?;
+        } else {
+            let url = self
+                .bucket
+                .create_multipart_upload(Some(&self.credentials), &key)
+                .sign(SIGNED_FOR);
+            let response = self.send_found(Method::POST, &key, url, Vec::new()).await?;
+            let text = response.text().await?;
+            let upload_id = CreateMultipartUpload::parse_response(&text)
+                .with_context(|| {
+                    format!("the object store started an upload without an id: {}", text)
+                })?
+                .upload_id()
+                .to_owned();
+            let out = self.upload_parts(&key, &upload_id, &mut f).await;
+            if out.is_err() {
+                // Parts left behind by an upload that can't be finished take up space until aborted.
+                let url = self
+                    .bucket
+                    .abort_multipart_upload(Some(&self.credentials), &key, &upload_id)
+                    .sign(SIGNED_FOR);
+                let _ = self.send(Method::DELETE, &key, url, Vec::new()).await;
+            }
+            out?;
+        }
+        tracing::info!(
+            "uploaded '{}' to s3://{}/{}",
+            file.display(),
+            self.location.bucket,
+            key
+        );
+        Ok(())
+    }
+
+    /// Upload a file in parts, as part of an upload that's been started, finishing it.
+    async fn upload_parts(
+        &self,
+        key: &str,
+        upload_id: &str,
+        f: &mut std::fs::File,
+    ) -> anyhow::Result<()> {
+        let mut etags = Vec::new();
+        loop {
+            let mut part = Vec::with_capacity(self.part_size);
+            f.by_ref()
+                .take(self.part_size as u64)
+                .read_to_end(&mut part)?;
+            if part.is_empty() {
+                break;
+            }
+            let number = u16::try_from(etags.len() + 1)
+                .map_err(|_| anyhow!("'{}' is too large to upload in parts", key))?;
+            let url = self
+                .bucket
+                .upload_part(Some(&self.credentials), key, number, upload_id)
+                .sign(SIGNED_FOR);
+            let response = self.send_found(Method::PUT, key, url, part).await?;
+            let etag = response
+                .headers()
+                .get("etag")
+                .and_then(|x| x.to_str().ok())
+                .ok_or_else(|| anyhow!("the object store took part {} without an ETag", number))?;
+            etags.push(etag.to_owned());
+        }
+        let action = self.bucket.complete_multipart_upload(
+            Some(&self.credentials),
+            key,
+            upload_id,
+            etags.iter().map(|x| x.as_str()),
+        );
+        let url = action.sign(SIGNED_FOR);
+        let response = self
+            .send_found(Method::POST, key, url, action.body().into_bytes())
+            .await?;
+        // Finishing an upload can fail after the response has started, which is then a success,
+        // with the error in its body.
+        let text = response.text().await?;
+        anyhow::ensure!(
+            xml_element(&text, "Error").is_none(),
+            "the object store failed to finish uploading '{}': {}",
+            key,
+            text
+        );
+        Ok(())
+    }
+
+    /// Download the object for a file, replacing the file, if the object exists.
+    async fn download_file(&self, file: &Path) -> anyhow::Result<bool> {
+        let key = self.location.key(Self::name(file)?);
+        let url = self
+            .bucket
+            .get_object(Some(&self.credentials), &key)
+            .sign(SIGNED_FOR);
+        let response = self.send(Method::GET, &key, url, Vec::new()).await?;
+        if response.status() == StatusCode::NOT_FOUND {
+            return Ok(false);
+        }
+        if let Some(parent) = file.parent().filter(|x| !x.as_os_str().is_empty()) {
+            std::fs::create_dir_all(parent)?;
+        }
+        // The file is only replaced once the whole object is in, so a failure leaves it be.
+        let mut partial = file.as_os_str().to_owned();
+        partial.push(".download");
+        let partial = PathBuf::from(partial);
+        let mut f = std::fs::File::create(&partial)
+            .with_context(|| format!("failed to create '{}'", partial.display()))?;
+        let mut stream = response.bytes_stream();
+        while let Some(chunk) = stream.next().await {
+            f.write_all(&chunk?)?;
+        }
+        f.flush()?;
+        drop(f);
+        std::fs::rename(&partial, file)
+            .with_context(|| format!("failed to move '{}' into place", partial.display()))?;
+        tracing::info!(
+            "downloaded '{}' from s3://{}/{}",
+            file.display(),
+            self.location.bucket,
+            key
+        );
+        Ok(true)
+    }
+}
+
+/// The text of the first element with a given name in an XML document, as S3 responds with.
+fn xml_element<'a>(xml: &'a str, name: &str) -> Option<&'a str> {
+    let open = format!("<{}>", name);
+    let close = format!("</{}>", name);
+    let start = xml.find(&open)? + open.len();
+    let end = start + xml[start..].find(&close)?;
+    Some(&xml[start..end])
+}
+
+/// An object store, served locally, for testing against.
+#[cfg(test)]
+pub mod mock {
+    use super::xml_element;
+    use std::collections::BTreeMap;
+    use std::sync::{Arc, Mutex};
+    use tokio::{
+        io::{AsyncReadExt as _, AsyncWriteExt as _},
+        net::TcpListener,
+    };
+
+    /// The access key id the mock expects requests to be signed with.
+    pub const ACCESS_KEY_ID: &str = "test-access-key";
+
+    /// What a mock object store holds.
+    #[derive(Default)]
+    pub struct MockS3 {
+        /// The objects stored, by bucket and key, as `<BUCKET>/<KEY>`.
+        pub objects: BTreeMap<String, Vec<u8>>,
+        /// The parts of the uploads in progress, by upload id.
+        uploads: BTreeMap<String, BTreeMap<u32, Vec<u8>>>,
+        /// Every request received, as its method and target.
+        pub requests: Vec<String>,
+    }
+
+    impl MockS3 {
+        fn respond(
+            &mut self,
+            method: &str,
+            target: &str,
+            body: Vec<u8>,
+        ) -> (u16, Vec<(&'static str, String)>, Vec<u8>) {
+            self.requests.push(format!("{} {}", method, target));
+            let (path, query) = target.split_once('?').unwrap_or((target, ""));
+            let object = path.trim_start_matches('/').to_owned();
+            // A parameter given without a value, like `?uploads`, is taken as an empty one.
+            let param = |name: &str| {
+                url::form_urlencoded::parse(query.as_bytes())
+                    .find(|(k, _)| k == name)
+                    .map(|(_, v)| v.into_owned())
+            };
+            // Signed URLs carry the credential they're signed with.
+            let credential = format!("{}/", ACCESS_KEY_ID);
+            if !param("X-Amz-Credential").is_some_and(|x| x.starts_with(&credential)) {
+                return (
+                    403,
+                    Vec::new(),
+                    b"<Error><Code>AccessDenied</Code></Error>".to_vec(),
+                );
+            }
+            let not_found = (
+                404,
+                Vec::new(),
+                b"<Error><Code>NoSuchKey</Code></Error>".to_vec(),
+            );
+            match (method, param("uploadId")) {
+                ("POST", None) if param("uploads").is_some() => {
+                    let id = format!("upload-{}", self.requests.len());
+                    self.uploads.insert(id.clone(), BTreeMap::new());
+                    let xml = format!(
+                        "<InitiateMultipartUploadResult><UploadId>{}</UploadId></InitiateMultipartUploadResult>",
+                        id
+                    );
+                    (200, Vec::new(), xml.into_bytes())
+                }
+                ("PUT", Some(id)) => {
+                    let number: u32 = param("partNumber")
+                        .and_then(|x| x.parse().ok())
+                        .unwrap_or_default();
+                    let Some(parts) = self.uploads.get_mut(&id) else {
+                        return not_found;
+                    };
+                    parts.insert(number, body);
+                    (
+                        200,
+                        vec![("ETag", format!("\"etag-{}\"", number))],
+                        Vec::new(),
+                    )
+                }
+                ("POST", Some(id)) => {
+                    let Some(parts) = self.uploads.remove(&id) else {
+                        return not_found;
+                    };
+                    let text = String::from_utf8_lossy(&body).into_owned();
+                    let mut data = Vec::new();
+                    for (i, part) in text.split("<Part>").skip(1).enumerate() {
+                        let number: u32 = xml_element(part, "PartNumber")
+                            .and_then(|x| x.parse().ok())
+                            .unwrap_or_default();
+                        let etag = format!("\"etag-{}\"", number);
+                        let invalid = (
+                            400,
+                            Vec::new(),
+                            b"<Error><Code>InvalidPart</Code></Error>".to_vec(),
+                        );
+                        // The quotes ETags come in may be escaped, as XML allows them to be.
+                        let given = xml_element(part, "ETag").map(|x| x.replace("&quot;", "\""));
+                        if number != i as u32 + 1 || given.as_deref() != Some(etag.as_str()) {
+                            return invalid;
+                        }
+                        let Some(part) = parts.get(&number) else {
+                            return invalid;
+                        };
+                        data.extend_from_slice(part);
+                    }
+                    self.objects.insert(object, data);
+                    (
+                        200,
+                        Vec::new(),
+                        b"<CompleteMultipartUploadResult></CompleteMultipartUploadResult>".to_vec(),
+                    )
+                }
+                ("DELETE", Some(id)) => {
+                    self.uploads.remove(&id);
+                    (204, Vec::new(), Vec::new())
+                }
+                ("PUT", None) => {
+                    self.objects.insert(object, body);
+                    (200, vec![("ETag", "\"etag\"".to_owned())], Vec::new())
+                }
+                ("GET", None) => match self.objects.get(&object) {
+                    Some(data) => (200, Vec::new(), data.clone()),
+                    None => not_found,
+                },
+                ("DELETE", None) => {
+                    self.objects.remove(&object);
+                    (204, Vec::new(), Vec::new())
+                }
+                _ => (405, Vec::new(), Vec::new()),
+            }
+        }
+    }
+
+    /// An object store for the given location, signing requests as the mock expects.
+    pub fn store(endpoint: &str, url: &str) -> anyhow::Result<super::ObjectStore> {
+        super::ObjectStore::new(
+            super::S3Url::parse(url)?,
+            endpoint,
+            super::DEFAULT_REGION,
+            super::Credentials::new(ACCESS_KEY_ID, "test-secret"),
+        )
+    }
+
+    /// Serve a mock object store over HTTP, returning the URL to reach it.
+    pub async fn serve(s3: Arc<Mutex<MockS3>>) -> anyhow::Result<String> {
+        let listener = TcpListener::bind("127.0.0.1:0").await?;
+        let addr = listener.local_addr()?;
+        tokio::spawn(async move {
+            loop {
+                let Ok((mut socket, _)) = listener.accept().await else {
+                    return;
+                };
+                let s3 = s3.clone();
+                tokio::spawn(async move {
+                    let mut buf = Vec::new();
+                    let mut chunk = [0u8; 4096];
+                    let head_len = loop {
+                        if let Some(i) = buf.windows(4).position(|x| x == b"\r\n\r\n") {
+                            break i + 4;
+                        }
+                        match socket.read(&mut chunk).await {
+                            Ok(0) | Err(_) => return,
+                            Ok(n) => buf.extend_from_slice(&chunk[..n]),
+                        }
+                    };
+                    let head = String::from_utf8_lossy(&buf[..head_len]).into_owned();
+                    let header = |name: &str| {
+                        head.lines().find_map(|x| {
+                            let (k, v) = x.split_once(':')?;
+                            k.eq_ignore_ascii_case(name).then(|| v.trim().to_owned())
+                        })
+                    };
+                    let content_length: usize = header("content-length")
+                        .and_then(|x| x.parse().ok())
+                        .unwrap_or_default();
+                    while buf.len() < head_len + content_length {
+                        match socket.read(&mut chunk).await {
+                            Ok(0) | Err(_) => return,
+                            Ok(n) => buf.extend_from_slice(&chunk[..n]),
+                        }
+                    }
+                    let body = buf[head_len..head_len + content_length].to_vec();
+                    let mut request_line = head.split(' ');
+                    let method = request_line.next().unwrap_or_default();
+                    let target = request_line.next().unwrap_or("/");
+                    let (status, headers, body) = s3.lock().unwrap().respond(method, target, body);
+                    let mut head = format!(
+                        "HTTP/1.1 {} MOCK\r\nContent-Length: {}\r\nConnection: close\r\n",
+                        status,
+                        body.len()
+                    );
+                    for (k, v) in headers {
+                        head.push_str(&format!("{}: {}\r\n", k, v));
+                    }
+                    head.push_str("\r\n");
+                    let _ = socket.write_all(head.as_bytes()).await;
+                    let _ = socket.write_all(&body).await;
+                });
+            }
+        });
+        Ok(format!("http://{}", addr))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::mock::{self, serve, store, MockS3};
+    use super::*;
+    use std::sync::{Arc, Mutex};
+
+    #[test]
+    fn test_s3_urls() -> anyhow::Result<()> {
+        let url = S3Url::parse("s3://archives/penumbra-1/")?;
+        assert_eq!(
+            url.key("reindexer-archive.sqlite"),
+            "penumbra-1/reindexer-archive.sqlite"
+        );
+        assert_eq!(url.to_string(), "s3://archives/penumbra-1");
+        let url = S3Url::parse("s3://archives")?;
+        assert_eq!(
+            url.key("reindexer-archive.sqlite"),
+            "reindexer-archive.sqlite"
+        );
+        assert!(S3Url::parse("s3:///penumbra-1").is_err());
+        assert!(S3Url::parse("https://archives/penumbra-1").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_signed_urls_are_by_path() -> anyhow::Result<()> {
+        // The bucket goes under the path of the endpoint, if it has one.
+        for (endpoint, path) in [
+            (
+                "http://127.0.0.1:9000",
+                "/archives/penumbra%201/archive.sqlite",
+            ),
+            (
+                "http://127.0.0.1:9000/s3",
+                "/s3/archives/penumbra%201/archive.sqlite",
+            ),
+        ] {
+            let store = store(endpoint, "s3://archives/penumbra 1")?;
+            let url = store
+                .bucket
+                .upload_part(
+                    Some(&store.credentials),
+                    &store.location.key("archive.sqlite"),
+                    2,
+                    "a/b",
+                )
+                .sign(SIGNED_FOR);
+            assert_eq!(url.host_str(), Some("127.0.0.1"), "{}", url);
+            assert_eq!(url.path(), path, "{}", url);
+            let query: Vec<(String, String)> = url
+                .query_pairs()
+                .map(|(k, v)| (k.into_owned(), v.into_owned()))
+                .collect();
+            assert!(query.contains(&("partNumber".to_owned(), "2".to_owned())));
+            assert!(query.contains(&("uploadId".to_owned(), "a/b".to_owned())));
+            assert!(query
+                .iter()
+                .any(|(k, v)| k == "X-Amz-Credential" && v.starts_with(mock::ACCESS_KEY_ID)));
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_upload_then_download() -> anyhow::Result<()> {
+        let s3 = Arc::new(Mutex::new(MockS3::default()));
+        let mut store = store(&serve(s3.clone()).await?, "s3://archives/penumbra-1")?;
+        // Small parts, so that the archive is uploaded in several of them.
+        store.part_size = 10;
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-object-store-{}",
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        std::fs::create_dir_all(&dir)?;
+        let archive = dir.join("archive.sqlite");
+        let manifest = dir.join("archive.sqlite.manifest.json");
+        let missing = dir.join("archive.sqlite.other");
+        let data: Vec<u8> = (0..25).collect();
+        std::fs::write(&archive, &data)?;
+        std::fs::write(&manifest, b"{}")?;
+        // A stale copy of the missing file, from some earlier upload.
+        s3.lock().unwrap().objects.insert(
+            "archives/penumbra-1/archive.sqlite.other".to_owned(),
+            b"stale".to_vec(),
+        );
+
+        store
+            .upload(&archive, &[manifest.clone(), missing.clone()])
+            .await?;
+        {
+            let s3 = s3.lock().unwrap();
+            assert_eq!(
+                s3.objects.keys().collect::<Vec<_>>(),
+                vec![
+                    "archives/penumbra-1/archive.sqlite",
+                    "archives/penumbra-1/archive.sqlite.manifest.json"
+                ]
+            );
+            assert_eq!(s3.objects["archives/penumbra-1/archive.sqlite"], data);
+            let parts = s3
+                .requests
+                .iter()
+                .filter(|x| x.starts_with("PUT ") && x.contains("partNumber="))
+                .count();
+            assert_eq!(parts, 3);
+        }
+
+        // Reading back replaces what's there, and removes what isn't in the store.
+        std::fs::write(&archive, b"something else")?;
+        std::fs::remove_file(&manifest)?;
+        std::fs::write(&missing, b"stale")?;
+        store
+            .download(&archive, &[manifest.clone(), missing.clone()])
+            .await?;
+        assert_eq!(std::fs::read(&archive)?, data);
+        assert_eq!(std::fs::read(&manifest)?, b"{}");
+        assert!(!missing.exists());
+
+        // A file which was never uploaded can't be downloaded.
+        let err = store
+            .download(&dir.join("other.sqlite"), &[])
+            .await
+            .expect_err("a missing object shouldn't download");
+        assert!(
+            err.to_string().contains("isn't in the object store"),
+            "{:#}",
+            err
+        );
+
+        // Nor can anything be done with the wrong credentials.
+        let mut wrong = store.clone();
+        wrong.credentials = Credentials::new("someone-else", "test-secret");
+        let err = wrong
+            .upload(&archive, &[])
+            .await
+            .expect_err("a request with the wrong credentials should be refused");
+        assert!(err.to_string().contains("403"), "{:#}", err);
+
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+}
@@ -1,16 +1,23 @@
 use crate::cometbft::Store;
 use crate::tendermint_compat::{BeginBlock, Block, DeliverTx, EndBlock, Event, ResponseDeliverTx};
-use crate::{cometbft::Genesis, indexer::Indexer, storage::Storage as Archive};
-use anyhow::anyhow;
+use crate::{
+    cometbft::Genesis,
+    error::{ErrorKind, Failure},
+    indexer::Indexer,
+    progress::ProgressLog,
+    storage::Storage as Archive,
+};
+use anyhow::{anyhow, Context as _};
 use async_trait::async_trait;
+use block_cache::BlockCache;
 use indicatif::{ProgressBar, ProgressStyle};
 use std::io::IsTerminal;
 use std::path::{Path, PathBuf};
 use std::sync::Arc;
-use std::time::{Duration, Instant};
 use tokio::task::JoinHandle;
 use tokio_stream::StreamExt as _;
 
+mod block_cache;
 mod v0o79;
 mod v0o80;
 mod v1o3;
@@ -47,6 +54,43 @@ async fn make_a_penumbra(version: Version, working_dir: &Path) -> anyhow::Result
     }
 }
 
+/// Check that a genesis can be used to start the chain with a given version of Penumbra.
+fn parse_genesis(version: Version, genesis: &Genesis) -> anyhow::Result<()> {
+    match version {
+        Version::V0o79 => v0o79::parse_genesis(genesis),
+        Version::V0o80 => v0o80::parse_genesis(genesis),
+        Version::V1o3 => v1o3::parse_genesis(genesis),
+        Version::V1o4 => v1o4::parse_genesis(genesis),
+        Version::V2 => v2::parse_genesis(genesis),
+    }
+}
+
+/// Find the height and chain id of the state in a working directory, along with the version that could read it.
+async fn find_current_metadata(
+    working_dir: &Path,
+) -> anyhow::Result<Option<(u64, String, Version)>> {
+    let mut out = None;
+    for version in Version::ALL {
+        if out.is_some() {
+            break;
+        }
+        let penumbra = make_a_penumbra(version, working_dir).await?;
+        match penumbra.metadata().await {
+            Err(error) => {
+                tracing::debug!(?version, "error while fetching current metadata: {}", error);
+            }
+            Ok((height, chain_id)) => out = Some((height, chain_id, version)),
+        }
+        penumbra.release().await;
+    }
+    Ok(out)
+}
+
+/// The last height indexed by the state in a working directory, if any.
+pub async fn current_height(working_dir: &Path) -> anyhow::Result<Option<u64>> {
+    Ok(find_current_metadata(working_dir).await?.map(|x| x.0))
+}
+
 #[derive(Debug, Clone, Copy, PartialEq)]
 pub enum Version {
     V0o79,
@@ -56,6 +100,22 @@ pub enum Version {
     V2,
 }
 
+impl Version {
+    /// Every version, from oldest to newest.
+    const ALL: [Version; 5] = [
+        Version::V0o79,
+        Version::V0o80,
+        Version::V1o3,
+        Version::V1o4,
+        Version::V2,
+    ];
+
+    /// Parse a version from the name it's printed with, e.g. `V0o80`.
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL.into_iter().find(|x| format!("{:?}", x) == name)
+    }
+}
+
 #[derive(Debug, Clone, Copy, PartialEq)]
 pub enum RegenerationStep {
     /// Represents a migration, as would be performed by `pd migrate`,
@@ -167,17 +227,18 @@ impl RegenerationStep {
                 ..
             } => {
                 if !archive.genesis_does_exist(*genesis_height).await? {
-                    return Err(anyhow!(
-                        "genesis at height {} does not exist",
-                        genesis_height,
-                    ));
+                    return Err(Failure::new(
+                        ErrorKind::GenesisNotFound,
+                        format!("genesis at height {} does not exist", genesis_height),
+                    )
+                    .into());
                 }
                 if start > 0 && !archive.block_does_exist(start).await? {
-                    return Err(anyhow!("missing block at height {}", start));
+                    return Err(missing_boundary(start));
                 }
                 if let Some(block) = last_block {
                     if !archive.block_does_exist(*block).await? {
-                        return Err(anyhow!("missing block at height {}", block));
+                        return Err(missing_boundary(*block));
                     }
                 }
                 Ok(Ok(()))
@@ -185,11 +246,11 @@ impl RegenerationStep {
             // To run from a start block to a last block, both blocks should exist.
             RegenerationStep::RunTo { last_block, .. } => {
                 if start > 0 && !archive.block_does_exist(start).await? {
-                    return Err(anyhow!("missing block at height {}", start));
+                    return Err(missing_boundary(start));
                 }
                 if let Some(block) = last_block {
                     if !archive.block_does_exist(*block).await? {
-                        return Err(anyhow!("missing block at height {}", block));
+                        return Err(missing_boundary(*block));
                     }
                 }
                 Ok(Ok(()))
@@ -198,6 +259,26 @@ impl RegenerationStep {
     }
 }
 
+/// The error for a block that a step of a plan starts or stops at not being in the archive.
+fn missing_boundary(height: u64) -> anyhow::Error {
+    Failure::new(
+        ErrorKind::BoundaryNotFound,
+        format!("missing block at height {}", height),
+    )
+    .into()
+}
+
+/// What was found of the genesis a step of a plan starts the chain from.
+#[derive(Clone, Debug, PartialEq)]
+pub struct GenesisCheck {
+    /// The step, numbered from 1, among all the steps of the plan.
+    pub step: usize,
+    pub version: Version,
+    pub genesis_height: u64,
+    /// What's wrong with the genesis, if it can't be used.
+    pub problem: Option<String>,
+}
+
 /// Represents a series of steps to regenerate events.
 ///
 /// This is useful to provide a concise overview of what we intend to regenerate and how,
@@ -205,12 +286,37 @@ impl RegenerationStep {
 ///
 /// This also makes the resulting logic in terms of creating and destroying penumbra applications
 /// easier, because we know the given lifecycle of a version of the penumbra logic.
-#[derive(Debug)]
+#[derive(Clone, Debug)]
 pub struct RegenerationPlan {
     pub steps: Vec<(u64, RegenerationStep)>,
 }
 
 impl RegenerationPlan {
+    /// The height of the genesis the chain starts from, where its full history begins.
+    pub fn genesis_height(&self) -> Option<u64> {
+        self.steps.iter().find_map(|(_, step)| match step {
+            RegenerationStep::InitThenRunTo { genesis_height, .. } => Some(*genesis_height),
+            _ => None,
+        })
+    }
+
+    /// The first and last blocks of the step running the block after a height, if any step does.
+    ///
+    /// Without a height, this is the first step running blocks. The last block is `None` for
+    /// a step running for as long as there are blocks.
+    pub fn segment_after(&self, height: Option<u64>) -> Option<(u64, Option<u64>)> {
+        self.steps.iter().find_map(|(start, step)| {
+            let last_block = match step {
+                RegenerationStep::Migrate { .. } => return None,
+                RegenerationStep::InitThenRunTo { last_block, .. }
+                | RegenerationStep::RunTo { last_block, .. } => *last_block,
+            };
+            let first = start + 1;
+            let next = height.map_or(first, |x| x + 1);
+            (first <= next && last_block.map_or(true, |x| next <= x)).then_some((first, last_block))
+        })
+    }
+
     /// Truncate a regeneration plan, removing unnecessary actions for a given set of bounds.
     ///
     /// If present, `start` indicates the block we'll have *already* indexed.
@@ -248,6 +354,38 @@ impl RegenerationPlan {
         Self { steps }
     }
 
+    /// Give the final step of this plan a last block, if it has none, from the last block in an archive.
+    ///
+    /// Without this, the final step runs for as long as the archive has blocks, but there's
+    /// no way to tell ahead of time where that is, or whether it's where it should be.
+    pub async fn infer_stop_from_archive(mut self, archive: &Archive) -> anyhow::Result<Self> {
+        let archive_last = match archive.last_height().await? {
+            None => return Ok(self),
+            Some(x) => x,
+        };
+        if let Some((start, step)) = self.steps.last_mut() {
+            // A step that already ends, or starts after the archive does, is left as is;
+            // the latter will fail the check against the archive.
+            if *start >= archive_last {
+                return Ok(self);
+            }
+            match step {
+                RegenerationStep::InitThenRunTo { last_block, .. }
+                | RegenerationStep::RunTo { last_block, .. }
+                    if last_block.is_none() =>
+                {
+                    tracing::info!(
+                        "inferred stop height {} for the final step, from the end of the archive",
+                        archive_last
+                    );
+                    *last_block = Some(archive_last);
+                }
+                _ => {}
+            }
+        }
+        Ok(self)
+    }
+
     /// Check the integrity of this plan against an archive.
     ///
     /// This avoids running a plan which can't possibly succeed against an archive.
@@ -265,6 +403,437 @@ impl RegenerationPlan {
         Ok(good)
     }
 
+    /// Look for the genesis of every step of this plan which starts the chain, in an archive.
+    ///
+    /// Each genesis has to be there, and hold an app state the version of its step can parse.
+    pub async fn check_geneses(&self, archive: &Archive) -> anyhow::Result<Vec<GenesisCheck>> {
+        let mut out = Vec::new();
+        for (i, (_, step)) in self.steps.iter().enumerate() {
+            let RegenerationStep::InitThenRunTo {
+                genesis_height,
+                version,
+                ..
+            } = step
+            else {
+                continue;
+            };
+            let problem = match archive.get_genesis(*genesis_height).await {
+                Ok(None) => Some("the archive has no genesis at that height".to_owned()),
+                Ok(Some(genesis)) => parse_genesis(*version, &genesis)
+                    .err()
+                    .map(|e| format!("the genesis isn't valid for {:?}: {:#}", version, e)),
+                // The genesis is stored as JSON, and decoding it is what fails if that's broken.
+                Err(e) => Some(format!("the genesis fails to parse: {:#}", e)),
+            };
+            out.push(GenesisCheck {
+                step: i + 1,
+                version: *version,
+                genesis_height: *genesis_height,
+                problem,
+            });
+        }
+        Ok(out)
+    }
+
+    /// Check that every genesis this plan needs is in an archive, before running anything.
+    ///
+    /// Otherwise, a missing genesis is only noticed once regeneration reaches its step.
+    ///
+    /// Like [`Self::check_against_archive`], this returns `Ok(Err(_))` if the plan won't work.
+    pub async fn check_geneses_against_archive(
+        &self,
+        archive: &Archive,
+    ) -> anyhow::Result<anyhow::Result<()>> {
+        let problems: Vec<String> = self
+            .check_geneses(archive)
+            .await?
+            .into_iter()
+            .filter_map(|x| {
+                Some(format!(
+                    "step {}, starting {:?} with the genesis at height {}: {}",
+                    x.step, x.version, x.genesis_height, x.problem?
+                ))
+            })
+            .collect();
+        if problems.is_empty() {
+            return Ok(Ok(()));
+        }
+        Ok(Err(Failure::new(
+            ErrorKind::GenesisNotFound,
+            format!(
+                "the archive lacks a usable genesis for some steps of the regeneration plan:\n  {}",
+                problems.join("\n  ")
+            ),
+        )
+        .into()))
+    }
+
+    /// Check that the upgrade boundaries in this plan line up with those in an archive.
+    ///
+    /// Unlike [`Self::check_against_archive`], this looks at the whole plan at once, so that
+    /// a plan which disagrees with the archive about the history of the chain is rejected
+    /// before anything runs, with an error naming the boundary in question.
+    ///
+    /// Like that method, this returns `Ok(Err(_))` if the plan won't work with the archive.
+    pub async fn check_boundaries_against_archive(
+        &self,
+        archive: &Archive,
+    ) -> anyhow::Result<anyhow::Result<()>> {
+        let mut mismatches = Vec::new();
+        let mut plan_geneses = Vec::new();
+        for (i, (step_start, step)) in self.steps.iter().enumerate() {
+            let previous = i.checked_sub(1).map(|j| self.steps[j].1);
+            match step {
+                RegenerationStep::Migrate { from, to } => {
+                    let boundary = format!("migration from {:?} to {:?}", from, to);
+                    match self.steps.get(i + 1).map(|x| x.1) {
+                        Some(RegenerationStep::InitThenRunTo {
+                            genesis_height,
+                            version,
+                            ..
+                        }) if version == *to => {
+                            if genesis_height != step_start + 1 {
+                                mismatches.push((ErrorKind::PlanMismatch, format!(
+                                    "{} is planned at height {}, but the upgrade genesis is at height {}",
+                                    boundary, step_start, genesis_height
+                                )));
+                            }
+                        }
+                        _ => mismatches.push((
+                            ErrorKind::PlanMismatch,
+                            format!(
+                                "{} at height {} isn't followed by a genesis for {:?}",
+                                boundary, step_start, to
+                            ),
+                        )),
+                    }
+                }
+                RegenerationStep::InitThenRunTo {
+                    genesis_height,
+                    version,
+                    ..
+                } => {
+                    plan_geneses.push(*genesis_height);
+                    let boundary = match previous {
+                        None => format!("genesis of {:?} at height {}", version, genesis_height),
+                        Some(_) => format!("upgrade to {:?} at height {}", version, genesis_height),
+                    };
+                    if !archive.genesis_does_exist(*genesis_height).await? {
+                        mismatches.push((
+                            ErrorKind::GenesisNotFound,
+                            format!("{}: the archive has no genesis at that height", boundary),
+                        ));
+                    }
+                    if !archive.block_does_exist(*genesis_height).await? {
+                        mismatches.push((
+                            ErrorKind::BoundaryNotFound,
+                            format!("{}: the archive has no block at that height", boundary),
+                        ));
+                    }
+                    // The step before the upgrade should end right before it.
+                    let before = self.steps[..i].iter().rev().find_map(|(_, x)| match x {
+                        RegenerationStep::InitThenRunTo { last_block, .. }
+                        | RegenerationStep::RunTo { last_block, .. } => Some(*last_block),
+                        RegenerationStep::Migrate { .. } => None,
+                    });
+                    match before {
+                        None => {}
+                        Some(Some(last)) if last + 1 == *genesis_height => {
+                            if !archive.block_does_exist(last).await? {
+                                mismatches.push((ErrorKind::BoundaryNotFound, format!(
+                                    "{}: the archive has no block at height {}, the last before the upgrade",
+                                    boundary, last
+                                )));
+                            }
+                        }
+                        Some(last) => mismatches.push((ErrorKind::PlanMismatch, format!(
+                            "{}: the previous step stops at height {:?}, rather than right before it",
+                            boundary, last
+                        ))),
+                    }
+                }
+                RegenerationStep::RunTo { .. } => {}
+            }
+        }
+        for height in archive.genesis_initial_heights().await? {
+            if !plan_geneses.contains(&height) {
+                mismatches.push((
+                    ErrorKind::PlanMismatch,
+                    format!(
+                        "the archive has a genesis at height {}, but the plan has no upgrade there",
+                        height
+                    ),
+                ));
+            }
+        }
+        // The plan disagreeing with the archive is the problem to fix first, if there's one,
+        // since a missing boundary or genesis might only be missing where the plan is wrong.
+        let Some(kind) = [
+            ErrorKind::PlanMismatch,
+            ErrorKind::BoundaryNotFound,
+            ErrorKind::GenesisNotFound,
+        ]
+        .into_iter()
+        .find(|x| mismatches.iter().any(|(kind, _)| kind == x)) else {
+            return Ok(Ok(()));
+        };
+        Ok(Err(Failure::new(
+            kind,
+            format!(
+                "the regeneration plan doesn't match the archive:\n  {}",
+                mismatches
+                    .iter()
+                    .map(|(_, x)| x.as_str())
+                    .collect::<Vec<_>>()
+                    .join("\n  ")
+            ),
+        )
+        .into()))
+    }
+
+    /// Check that the heights in this plan lie within the blocks of an archive.
+    ///
+    /// Built-in plans are written with the full history of a chain in mind, but a plan
+    /// from a file is for the archive at hand, so a boundary outside of it is a mistake.
+    ///
+    /// Like [`Self::check_against_archive`], this returns `Ok(Err(_))` if the plan won't work.
+    pub async fn check_within_archive_range(
+        &self,
+        archive: &Archive,
+    ) -> anyhow::Result<anyhow::Result<()>> {
+        let (Some(first), Some(last)) =
+            (archive.first_height().await?, archive.last_height().await?)
+        else {
+            return Ok(Err(Failure::new(
+                ErrorKind::BoundaryNotFound,
+                "the archive has no blocks",
+            )
+            .into()));
+        };
+        let mut problems = Vec::new();
+        for (i, (_, step)) in self.steps.iter().enumerate() {
+            let (genesis_height, last_block) = match step {
+                RegenerationStep::Migrate { .. } => continue,
+                RegenerationStep::InitThenRunTo {
+                    genesis_height,
+                    last_block,
+                    ..
+                } => (Some(*genesis_height), *last_block),
+                RegenerationStep::RunTo { last_block, .. } => (None, *last_block),
+            };
+            if let Some(height) = genesis_height.filter(|x| !(first..=last).contains(x)) {
+                problems.push(format!(
+                    "step {} has a genesis at height {}, outside of the archive's blocks {}..={}",
+                    i + 1,
+                    height,
+                    first,
+                    last
+                ));
+            }
+            if let Some(height) = last_block.filter(|x| *x > last) {
+                problems.push(format!(
+                    "step {} stops at height {}, after the archive's last block {}",
+                    i + 1,
+                    height,
+                    last
+                ));
+            }
+        }
+        if problems.is_empty() {
+            return Ok(Ok(()));
+        }
+        Ok(Err(Failure::new(
+            ErrorKind::BoundaryNotFound,
+            format!(
+                "the regeneration plan doesn't fit the archive:\n  {}",
+                problems.join("\n  ")
+            ),
+        )
+        .into()))
+    }
+
+    /// Get the plan to regenerate a chain with: the one in a file if there is one,
+    /// or else the built-in plan for the chain.
+    pub fn load(chain_id: &str, plan_file: Option<&Path>) -> anyhow::Result<Self> {
+        match plan_file {
+            Some(path) => Self::read_file(path, chain_id),
+            None => Self::from_known_chain_id(chain_id).ok_or(anyhow!(
+                "no regeneration plan known for chain id '{}'",
+                chain_id
+            )),
+        }
+    }
+
+    /// Read a plan for a chain from a file.
+    ///
+    /// The file is TOML if it has a `.toml` extension, and JSON otherwise, in the same shape
+    /// as the output of `show-plan --json`: a list of `steps`, each with a `kind`, which is one
+    /// of `init_then_run_to`, `run_to`, or `migrate`, and the `height` it happens at.
+    /// Migrations have the versions they go `from` and `to`; the others have a `version`,
+    /// an optional `last_block`, and, for `init_then_run_to`, the `genesis_height` right after
+    /// the height of the step. A `chain_id`, if present, must match the chain being regenerated.
+    pub fn read_file(path: &Path, chain_id: &str) -> anyhow::Result<Self> {
+        let read = || -> anyhow::Result<Self> {
+            let data = std::fs::read_to_string(path)?;
+            let value: serde_json::Value = if path.extension().is_some_and(|x| x == "toml") {
+                serde_json::to_value(toml::from_str::<toml::Value>(&data)?)?
+            } else {
+                serde_json::from_str(&data)?
+            };
+            Self::from_value(&value, chain_id)
+        };
+        read().map_err(|e| e.context(format!("failed to read plan file '{}'", path.display())))
+    }
+
+    pub(crate) fn from_value(value: &serde_json::Value, chain_id: &str) -> anyhow::Result<Self> {
+        if let Some(file_chain_id) = value.get("chain_id") {
+            if file_chain_id.as_str() != Some(chain_id) {
+                anyhow::bail!(Failure::new(
+                    ErrorKind::PlanMismatch,
+                    format!(
+                        "the plan is for chain id {}, not '{}'",
+                        file_chain_id, chain_id
+                    )
+                ));
+            }
+        }
+        let mut steps = Vec::new();
+        for (i, step) in value
+            .get("steps")
+            .and_then(|x| x.as_array())
+            .ok_or(anyhow!("expected array `steps`"))?
+            .iter()
+            .enumerate()
+        {
+            let parse = || -> anyhow::Result<(u64, RegenerationStep)> {
+                let height = |key: &str| {
+                    step.get(key)
+                        .and_then(|x| x.as_u64())
+                        .ok_or(anyhow!("expected height `{}`", key))
+                };
+                let version = |key: &str| {
+                    let name = step
+                        .get(key)
+                        .and_then(|x| x.as_str())
+                        .ok_or(anyhow!("expected version `{}`", key))?;
+                    Version::from_name(name).ok_or(anyhow!(
+                        "unknown version '{}', expected one of {:?}",
+                        name,
+                        Version::ALL
+                    ))
+                };
+                let last_block = match step.get("last_block") {
+                    None | Some(serde_json::Value::Null) => None,
+                    Some(_) => Some(height("last_block")?),
+                };
+                let out = match step.get("kind").and_then(|x| x.as_str()) {
+                    Some("migrate") => RegenerationStep::Migrate {
+                        from: version("from")?,
+                        to: version("to")?,
+                    },
+                    Some("init_then_run_to") => RegenerationStep::InitThenRunTo {
+                        genesis_height: height("genesis_height")?,
+                        version: version("version")?,
+                        last_block,
+                    },
+                    Some("run_to") => RegenerationStep::RunTo {
+                        version: version("version")?,
+                        last_block,
+                    },
+                    _ => anyhow::bail!(
+                        "expected `kind` to be one of init_then_run_to, run_to, or migrate"
+                    ),
+                };
+                Ok((height("height")?, out))
+            };
+            steps.push(parse().map_err(|e| e.context(format!("invalid step {}", i + 1)))?);
+        }
+        let out = Self { steps };
+        out.check_order()?;
+        Ok(out)
+    }
+
+    /// Check that the steps of this plan follow on from one another, as the regenerator expects.
+    fn check_order(&self) -> anyhow::Result<()> {
+        anyhow::ensure!(!self.steps.is_empty(), "the plan has no steps");
+        // The last block, and version, of the step before.
+        let mut previous: Option<(Option<u64>, Version)> = None;
+        for (i, (height, step)) in self.steps.iter().enumerate() {
+            let n = i + 1;
+            let previous_end = previous.and_then(|x| x.0);
+            match (step, previous) {
+                (RegenerationStep::Migrate { .. }, None) => {
+                    anyhow::bail!("step 1 is a migration, with no state to migrate")
+                }
+                (RegenerationStep::Migrate { from, to }, Some((_, version))) => {
+                    anyhow::ensure!(
+                        *from == version,
+                        "step {} migrates from {:?}, but the step before it uses {:?}",
+                        n,
+                        from,
+                        version
+                    );
+                    anyhow::ensure!(
+                        previous_end == Some(*height),
+                        "step {} migrates at height {}, but the step before it stops at {:?}",
+                        n,
+                        height,
+                        previous_end
+                    );
+                    previous = Some((Some(*height), *to));
+                    continue;
+                }
+                _ => {}
+            }
+            if previous.is_some() {
+                anyhow::ensure!(
+                    previous_end.is_some(),
+                    "step {} comes after a step with no last block",
+                    n
+                );
+                anyhow::ensure!(
+                    Some(*height) == previous_end,
+                    "step {} starts at height {}, but the step before it stops at {:?}",
+                    n,
+                    height,
+                    previous_end
+                );
+            }
+            let (version, last_block) = match step {
+                RegenerationStep::InitThenRunTo {
+                    genesis_height,
+                    version,
+                    last_block,
+                } => {
+                    anyhow::ensure!(
+                        *genesis_height == height + 1,
+                        "step {} has a genesis at height {}, rather than right after its height {}",
+                        n,
+                        genesis_height,
+                        height
+                    );
+                    (*version, *last_block)
+                }
+                RegenerationStep::RunTo {
+                    version,
+                    last_block,
+                } => (*version, *last_block),
+                RegenerationStep::Migrate { .. } => unreachable!("migrations are handled above"),
+            };
+            if let Some(last) = last_block {
+                anyhow::ensure!(
+                    last > *height,
+                    "step {} stops at height {}, without running any blocks after its height {}",
+                    n,
+                    last,
+                    height
+                );
+            }
+            previous = Some((last_block, version));
+        }
+        Ok(())
+    }
+
     /// Some regeneration plans are pre-specified, by a chain id.
     pub fn from_known_chain_id(chain_id: &str) -> Option<Self> {
         match chain_id {
@@ -305,7 +874,7 @@ impl RegenerationPlan {
                         last_block: Some(2358329),
                     },
                 ),
-                (23583289, Migrate { from: V1o3, to: V2 }),
+                (2358329, Migrate { from: V1o3, to: V2 }),
                 (
                     2358329,
                     InitThenRunTo {
@@ -407,6 +976,33 @@ impl RegenerationPlan {
     }
 }
 
+/// How far the database has committed the blocks of a step past the state, if it has.
+///
+/// `first` is the first block of the step the state carries on with. The state and the
+/// database only disagree after a step dies partway, and only the database being ahead can
+/// be recovered from, by running the blocks it has into the state, without indexing them again.
+/// The state being ahead means the events of the blocks in between are lost, since the state
+/// can't run them again.
+fn committed_past_state(
+    first: u64,
+    state: Option<u64>,
+    indexed: Option<u64>,
+) -> anyhow::Result<Option<u64>> {
+    let before = first.saturating_sub(1);
+    let (state, indexed) = (state.unwrap_or(before), indexed.unwrap_or(before));
+    if indexed < state {
+        anyhow::bail!(
+            "the state is at height {}, but the database has only committed the blocks of this step up to height {}, so the events of blocks {}..={} are missing, and can't be regenerated from this state; start this step over, from a state at height {}, or regenerate with --clean",
+            state,
+            indexed,
+            indexed + 1,
+            state,
+            before
+        );
+    }
+    Ok(Some(indexed).filter(|x| *x > state))
+}
+
 /// A utility to regenerate a raw events database given an archive of Penumbra data.
 ///
 /// https://www.imdb.com/title/tt0089885/
@@ -416,6 +1012,17 @@ pub struct Regenerator {
     archive: Archive,
     indexer: Indexer,
     store: Option<Arc<dyn Store>>,
+    /// How many blocks to process between progress logs, when there's no progress bar.
+    progress_interval: u64,
+    /// The last height indexed, and the version of Penumbra the state was last used with.
+    reached: (Option<u64>, Option<Version>),
+    /// The plan to use instead of the built-in one for the chain, if any.
+    plan: Option<RegenerationPlan>,
+    /// Blocks up to this height were committed to the database before the state, so they're
+    /// only run into the state, checking that it comes to the same app hash, and not indexed.
+    replay_through: Option<u64>,
+    /// Where to cache the blocks read from the archive, to read them from there when run again.
+    block_cache: Option<BlockCache>,
 }
 
 impl Regenerator {
@@ -425,6 +1032,7 @@ impl Regenerator {
         archive: Archive,
         indexer: Indexer,
         store: Option<Box<dyn Store>>,
+        progress_interval: u64,
     ) -> anyhow::Result<Self> {
         let chain_id = archive.chain_id().await?;
         Ok(Self {
@@ -433,11 +1041,34 @@ impl Regenerator {
             archive,
             indexer,
             store: store.map(|x| x.into()),
+            progress_interval,
+            reached: (None, None),
+            plan: None,
+            replay_through: None,
+            block_cache: None,
         })
     }
 
+    /// Regenerate using a given plan, rather than the built-in plan for the chain.
+    pub fn use_plan(&mut self, plan: RegenerationPlan) {
+        self.plan = Some(plan);
+    }
+
+    /// Cache the blocks read from the archive in a directory, reading them from there instead,
+    /// if they're already cached there, and the archive still has the same blocks.
+    pub fn use_block_cache(&mut self, dir: &Path) {
+        self.block_cache = Some(BlockCache::new(dir));
+    }
+
+    /// The last height indexed, and the version of Penumbra used for the state, if known.
+    ///
+    /// This survives [Self::run] failing, reporting how far regeneration got before that.
+    pub fn reached(&self) -> (Option<u64>, Option<Version>) {
+        self.reached
+    }
+
     pub async fn run(
-        self,
+        &mut self,
         start_height: Option<u64>,
         stop_height: Option<u64>,
     ) -> anyhow::Result<()> {
@@ -449,47 +1080,73 @@ impl Regenerator {
         //  2.3 Retrieve the block that needs to fed in, and then index the resulting events.
         //
         // It's regeneratin' time.
-        let metadata = self.find_current_metadata().await?;
-        if let Some((_, chain_id)) = &metadata {
+        let metadata = find_current_metadata(&self.working_dir).await?;
+        if let Some((height, chain_id, version)) = &metadata {
             anyhow::ensure!(
                 chain_id == &self.chain_id,
                 "archive chain_id is '{}' but state is '{}'",
                 self.chain_id,
                 chain_id
             );
+            self.reached = (Some(*height), Some(*version));
         }
-        self.run_from(start_height.or(metadata.map(|x| x.0)), stop_height)
+        let state_height = metadata.map(|x| x.0);
+        // An explicit start height says where to carry on, whatever the database has.
+        if start_height.is_none() {
+            self.replay_through = self.check_resume(state_height).await?;
+        }
+        self.run_from(start_height.or(state_height), stop_height)
             .await
     }
 
-    async fn find_current_metadata(&self) -> anyhow::Result<Option<(u64, String)>> {
-        let mut out = None;
-        for version in [
-            Version::V0o79,
-            Version::V0o80,
-            Version::V1o3,
-            Version::V1o4,
-            Version::V2,
-        ] {
-            if out.is_some() {
-                break;
-            }
-            let penumbra = make_a_penumbra(version, &self.working_dir).await?;
-            match penumbra.metadata().await {
-                Err(error) => {
-                    tracing::debug!(?version, "error while fetching current metadata: {}", error);
-                }
-                Ok(x) => out = Some(x),
-            }
-            penumbra.release().await;
+    fn plan(&self) -> anyhow::Result<RegenerationPlan> {
+        match &self.plan {
+            Some(plan) => Ok(plan.clone()),
+            None => RegenerationPlan::from_known_chain_id(&self.chain_id)
+                .ok_or(anyhow!("no plan known for chain id '{}'", &self.chain_id)),
         }
-        Ok(out)
     }
 
-    async fn run_from(mut self, start: Option<u64>, stop: Option<u64>) -> anyhow::Result<()> {
-        let plan = RegenerationPlan::from_known_chain_id(&self.chain_id)
-            .map(|x| x.truncate(start, stop))
-            .ok_or(anyhow!("no plan known for chain id '{}'", &self.chain_id))?;
+    /// Check that the database agrees with the state about how far the step it's in got,
+    /// returning the height the database has committed its blocks through, past the state.
+    ///
+    /// With existing data allowed, blocks already in the database are indexed again anyways,
+    /// skipping whatever's already there, so nothing is returned.
+    async fn check_resume(&self, state_height: Option<u64>) -> anyhow::Result<Option<u64>> {
+        let Some((first, last)) = self.plan()?.segment_after(state_height) else {
+            return Ok(None);
+        };
+        let indexed = self.indexer.last_height(first, last).await?;
+        let through = committed_past_state(first, state_height, indexed).with_context(|| {
+            format!(
+                "can't resume regenerating in '{}'",
+                self.working_dir.display()
+            )
+        })?;
+        let Some(through) = through else {
+            return Ok(None);
+        };
+        if self.indexer.allows_existing_data() {
+            tracing::info!(
+                "the database has committed blocks up to height {}, past the state; indexing them again, keeping what's there",
+                through
+            );
+            return Ok(None);
+        }
+        tracing::info!(
+            "the database has committed blocks up to height {}, past the state at height {:?}; running them without indexing them again",
+            through,
+            state_height
+        );
+        Ok(Some(through))
+    }
+
+    async fn run_from(&mut self, start: Option<u64>, stop: Option<u64>) -> anyhow::Result<()> {
+        let mut plan = self.plan()?.truncate(start, stop);
+        // With a remote store, the archive grows as we go, so its current end says nothing.
+        if stop.is_none() && self.store.is_none() {
+            plan = plan.infer_stop_from_archive(&self.archive).await?;
+        }
         tracing::info!(
             "plan for {} truncated between {:?}..={:?}: {:?}",
             &self.chain_id,
@@ -533,6 +1190,7 @@ impl Regenerator {
             Version::V2 => v2::migrate(from, &self.working_dir).await?,
             v => anyhow::bail!("impossible version {:?} to migrate to", v),
         }
+        self.reached.1 = Some(to);
         Ok(())
     }
 
@@ -550,7 +1208,10 @@ impl Regenerator {
             Some(g) => g,
             None => {
                 let Some(store) = self.store.as_mut() else {
-                    anyhow::bail!("expected genesis at height {}", genesis_height);
+                    anyhow::bail!(Failure::new(
+                        ErrorKind::GenesisNotFound,
+                        format!("expected genesis at height {}", genesis_height)
+                    ));
                 };
                 let g = store.get_genesis().await?;
                 self.archive.put_genesis(&g).await?;
@@ -559,6 +1220,7 @@ impl Regenerator {
         };
         let mut penumbra = make_a_penumbra(version, &self.working_dir).await?;
         penumbra.genesis(genesis).await?;
+        self.reached.1 = Some(version);
 
         let res = self
             .run_to_inner(&mut penumbra, first_block, last_block)
@@ -576,6 +1238,7 @@ impl Regenerator {
     ) -> anyhow::Result<()> {
         tracing::info!("regeneration step");
         let mut penumbra = make_a_penumbra(version, &self.working_dir).await?;
+        self.reached.1 = Some(version);
         let res = self
             .run_to_inner(&mut penumbra, first_block, last_block)
             .await;
@@ -626,16 +1289,28 @@ impl Regenerator {
         };
 
         // For headless mode, setup periodic logging
-        let mut last_log_time = Instant::now();
-        let log_interval = Duration::from_secs(30);
-        let start_time = Instant::now();
+        let mut progress_log = (!use_progress_bar).then(|| {
+            ProgressLog::new(
+                "regenerating from archive",
+                first_block,
+                Some(end),
+                self.progress_interval,
+            )
+        });
 
-        // Process blocks from archive
+        // Process blocks from archive, or from the cache of them, if there's one.
+        let mut segment = match &self.block_cache {
+            Some(cache) if archive_total_blocks > 0 => {
+                Some(cache.open(&self.archive, first_block, end).await?)
+            }
+            _ => None,
+        };
         for height in first_block..=end {
-            let block: Block = self
-                .archive
-                .get_block(height)
-                .await?
+            let block = match segment.as_mut() {
+                Some(segment) => segment.get_block(&self.archive, height).await?,
+                None => self.archive.get_block(height).await?,
+            };
+            let block: Block = block
                 .ok_or(anyhow!("missing block at height {}", height))?
                 .try_into()?;
             self.process_block(penumbra, height, block).await?;
@@ -648,53 +1323,20 @@ impl Regenerator {
                     "Regenerating events from archive (block {})",
                     height
                 ));
-            } else if !use_progress_bar && last_log_time.elapsed() >= log_interval {
-                let elapsed = start_time.elapsed();
-                let rate = if elapsed.as_secs() > 0 {
-                    blocks_processed as f64 / elapsed.as_secs_f64()
-                } else {
-                    0.0
-                };
-
-                let percentage = (blocks_processed as f64 / archive_total_blocks as f64) * 100.0;
-                let remaining_blocks = archive_total_blocks - blocks_processed;
-                let eta = if rate > 0.0 {
-                    Duration::from_secs((remaining_blocks as f64 / rate) as u64)
-                } else {
-                    Duration::from_secs(0)
-                };
-
-                tracing::info!(
-                    "regen progress: {:.1}% ({} / {} blocks) at {:.1} blocks/s, ETA: {}m{}s (block {})",
-                    percentage,
-                    blocks_processed,
-                    archive_total_blocks,
-                    rate,
-                    eta.as_secs() / 60,
-                    eta.as_secs() % 60,
-                    height
-                );
-
-                last_log_time = Instant::now();
+            } else if let Some(progress_log) = progress_log.as_mut() {
+                progress_log.record(height);
             }
         }
 
+        if let Some(segment) = segment {
+            segment.finish()?;
+        }
+
         // Finish archive progress reporting
         if let Some(pb) = &progress_bar {
             pb.finish_with_message("Archive processing completed");
-        } else if !use_progress_bar && archive_total_blocks > 0 {
-            let elapsed = start_time.elapsed();
-            let avg_rate = if elapsed.as_secs() > 0 {
-                archive_total_blocks as f64 / elapsed.as_secs_f64()
-            } else {
-                0.0
-            };
-            tracing::info!(
-                "archive processing completed: {} blocks in {:.1}s (avg {:.1} blocks/s)",
-                archive_total_blocks,
-                elapsed.as_secs_f64(),
-                avg_rate
-            );
+        } else if let Some(progress_log) = &progress_log {
+            progress_log.finish();
         }
 
         let next_height = last_height_in_archive + 1;
@@ -742,9 +1384,14 @@ impl Regenerator {
             None
         };
 
-        // Reset timing for remote processing
-        let mut last_log_time = Instant::now();
-        let start_time = Instant::now();
+        let mut remote_progress_log = (!use_progress_bar).then(|| {
+            ProgressLog::new(
+                "regenerating from remote stream",
+                next_height,
+                last_block,
+                self.progress_interval,
+            )
+        });
         let mut remote_blocks_processed = 0u64;
 
         while let Some((height, block)) = rx.recv().await {
@@ -761,67 +1408,16 @@ impl Regenerator {
                     "Regenerating events from remote stream (block {})",
                     height
                 ));
-            } else if !use_progress_bar && last_log_time.elapsed() >= log_interval {
-                let elapsed = start_time.elapsed();
-                let rate = if elapsed.as_secs() > 0 {
-                    remote_blocks_processed as f64 / elapsed.as_secs_f64()
-                } else {
-                    0.0
-                };
-
-                if let Some(last) = last_block {
-                    let total_remote = if last >= next_height {
-                        last - next_height + 1
-                    } else {
-                        0
-                    };
-                    let percentage = (remote_blocks_processed as f64 / total_remote as f64) * 100.0;
-                    let remaining = total_remote - remote_blocks_processed;
-                    let eta = if rate > 0.0 {
-                        Duration::from_secs((remaining as f64 / rate) as u64)
-                    } else {
-                        Duration::from_secs(0)
-                    };
-
-                    tracing::info!(
-                        "remote stream progress: {:.1}% ({} / {} blocks) at {:.1} blocks/s, ETA: {}m{}s (block {})",
-                        percentage,
-                        remote_blocks_processed,
-                        total_remote,
-                        rate,
-                        eta.as_secs() / 60,
-                        eta.as_secs() % 60,
-                        height
-                    );
-                } else {
-                    tracing::info!(
-                        "remote stream progress: {} blocks processed at {:.1} blocks/s (block {})",
-                        remote_blocks_processed,
-                        rate,
-                        height
-                    );
-                }
-
-                last_log_time = Instant::now();
+            } else if let Some(progress_log) = remote_progress_log.as_mut() {
+                progress_log.record(height);
             }
         }
 
         // Finish remote progress reporting
         if let Some(pb) = remote_progress_bar {
             pb.finish_with_message("Remote stream processing completed");
-        } else if !use_progress_bar && remote_blocks_processed > 0 {
-            let elapsed = start_time.elapsed();
-            let avg_rate = if elapsed.as_secs() > 0 {
-                remote_blocks_processed as f64 / elapsed.as_secs_f64()
-            } else {
-                0.0
-            };
-            tracing::info!(
-                "remote stream processing completed: {} blocks in {:.1}s (avg {:.1} blocks/s)",
-                remote_blocks_processed,
-                elapsed.as_secs_f64(),
-                avg_rate
-            );
+        } else if let Some(progress_log) = &remote_progress_log {
+            progress_log.finish();
         }
 
         // Make sure the producer hasn't created some kind of error.
@@ -842,6 +1438,11 @@ impl Regenerator {
         }
         let block_tendermint: tendermint_v0o40::Block = block.clone().into();
         let begin_block = BeginBlock::from(block);
+        if self.replay_through.is_some_and(|x| height <= x) {
+            return self
+                .replay_block(penumbra, height, &begin_block, block_tendermint)
+                .await;
+        }
         self.indexer
             .enter_block(height, block_tendermint.header.chain_id.as_str())
             .await?;
@@ -867,7 +1468,517 @@ impl Regenerator {
         self.indexer.events(height, events, None).await?;
         let hash = penumbra.commit().await?;
         self.indexer.end_block(&hash).await?;
+        crate::metrics::record_block(height);
+        self.reached.0 = Some(height);
+
+        Ok(())
+    }
+
+    /// Run a block the database already committed into the state, without indexing it again.
+    ///
+    /// The state has to come to the app hash the database recorded for the block,
+    /// since otherwise the database holds the events of some other state, and the database
+    /// has to have a row in `tx_results` for each transaction, or the block was only partly
+    /// indexed, by something that didn't write it in one transaction.
+    async fn replay_block(
+        &mut self,
+        penumbra: &mut APenumbra,
+        height: u64,
+        begin_block: &BeginBlock,
+        block: tendermint_v0o40::Block,
+    ) -> anyhow::Result<()> {
+        tracing::debug!(
+            height,
+            "running block committed to the database before the state"
+        );
+        let txs = block.data.len() as u64;
+        if let Some(&(_, indexed)) = self.indexer.tx_counts(height, height).await?.first() {
+            anyhow::ensure!(
+                indexed == txs,
+                "the database has {} rows in tx_results for the block at height {}, but the block has {} transactions; the database only has part of the block, so regenerate with --clean",
+                indexed,
+                height,
+                txs
+            );
+        }
+        penumbra.begin_block(begin_block).await;
+        for tx in block.data {
+            // A failing transaction is part of the block, and was indexed as such.
+            let _ = penumbra.deliver_tx(&DeliverTx { tx }).await;
+        }
+        penumbra
+            .end_block(&EndBlock {
+                height: height.try_into()?,
+            })
+            .await;
+        let hash = penumbra.commit().await?;
+        if let Some(recorded) = self.indexer.app_hash(height).await? {
+            anyhow::ensure!(
+                recorded == hash,
+                "running the block at height {} into the state came to app hash {}, but the database recorded app hash {} for it; the state disagrees with what's indexed, so regenerate with --clean",
+                height,
+                hex::encode(hash),
+                hex::encode(&recorded)
+            );
+        }
+        crate::metrics::record_block(height);
+        self.reached.0 = Some(height);
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cometbft::Block as ArchiveBlock;
+
+    /// An archive with blocks only up to a given height, as if archival stopped there.
+    async fn truncated_archive(heights: &[u64]) -> anyhow::Result<Archive> {
+        let archive = Archive::new(None, Some("penumbra-test")).await?;
+        for height in heights {
+            archive
+                .put_block(&ArchiveBlock::test_value_at_height(*height))
+                .await?;
+        }
+        Ok(archive)
+    }
+
+    /// An archive with geneses and blocks at exactly the given heights.
+    async fn archive_with(geneses: &[u64], blocks: &[u64]) -> anyhow::Result<Archive> {
+        let archive = truncated_archive(blocks).await?;
+        for height in geneses {
+            archive
+                .put_genesis(&Genesis::test_value_at_height(*height))
+                .await?;
+        }
+        Ok(archive)
+    }
+
+    /// An archive with everything needed around the upgrade boundaries of phobos-2.
+    async fn phobos_2_archive(skip_block: Option<u64>) -> anyhow::Result<Archive> {
+        let blocks: Vec<u64> = [1, 1459799, 1459800, 2358329, 2358330]
+            .into_iter()
+            .filter(|x| Some(*x) != skip_block)
+            .collect();
+        archive_with(&[1, 1459800, 2358330], &blocks).await
+    }
+
+    fn last_block(plan: &RegenerationPlan) -> Option<u64> {
+        match plan.steps.last() {
+            Some((_, RegenerationStep::InitThenRunTo { last_block, .. }))
+            | Some((_, RegenerationStep::RunTo { last_block, .. })) => *last_block,
+            _ => None,
+        }
+    }
+
+    #[test]
+    fn test_segment_after_state() {
+        let plan = RegenerationPlan::penumbra_1();
+        assert_eq!(plan.segment_after(None), Some((1, Some(501974))));
+        assert_eq!(plan.segment_after(Some(1000)), Some((1, Some(501974))));
+        // State at the end of a step carries on with the next one.
+        assert_eq!(
+            plan.segment_after(Some(501974)),
+            Some((501975, Some(2611799)))
+        );
+        assert_eq!(
+            plan.segment_after(Some(501975)),
+            Some((501975, Some(2611799)))
+        );
+        assert_eq!(plan.segment_after(Some(6_000_000)), Some((5480873, None)));
+        let plan = plan.truncate(None, Some(5_000_000));
+        assert_eq!(plan.segment_after(Some(5_000_000)), None);
+    }
+
+    #[test]
+    fn test_resuming_an_interrupted_step() -> anyhow::Result<()> {
+        // The state and the database agree, whether nothing of the step ran yet, or some of it.
+        assert_eq!(committed_past_state(501975, Some(501974), None)?, None);
+        assert_eq!(committed_past_state(1, None, None)?, None);
+        assert_eq!(
+            committed_past_state(501975, Some(600_000), Some(600_000))?,
+            None
+        );
+        // The step died after committing blocks to the database, but before the state had them.
+        assert_eq!(
+            committed_past_state(501975, Some(600_000), Some(600_003))?,
+            Some(600_003)
+        );
+        assert_eq!(
+            committed_past_state(501975, Some(501974), Some(501980))?,
+            Some(501980)
+        );
+        assert_eq!(committed_past_state(1, None, Some(10))?, Some(10));
+        // The step died after the state had a block, but before the database committed it.
+        let err = committed_past_state(501975, Some(600_000), Some(599_999))
+            .expect_err("the events of the last block are lost");
+        assert!(
+            err.to_string()
+                .contains("blocks 600000..=600000 are missing"),
+            "{:#}",
+            err
+        );
+        let err = committed_past_state(501975, Some(501980), None)
+            .expect_err("none of the step is in the database");
+        assert!(
+            err.to_string()
+                .contains("only committed the blocks of this step up to height 501974"),
+            "{:#}",
+            err
+        );
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_inferred_stop_is_last_archived_block() -> anyhow::Result<()> {
+        let archive = truncated_archive(&[1, 2, 3, 4, 5, 6, 7]).await?;
+        let plan = RegenerationPlan::penumbra_testnet_phobos_3()
+            .truncate(None, None)
+            .infer_stop_from_archive(&archive)
+            .await?;
+        assert_eq!(last_block(&plan), Some(7));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_inferred_stop_only_changes_final_step() -> anyhow::Result<()> {
+        let archive = truncated_archive(&[5_500_000]).await?;
+        let plan = RegenerationPlan::penumbra_1()
+            .infer_stop_from_archive(&archive)
+            .await?;
+        assert_eq!(last_block(&plan), Some(5_500_000));
+        let expected = RegenerationPlan::penumbra_1();
+        let n = expected.steps.len();
+        assert_eq!(plan.steps[..n - 1], expected.steps[..n - 1]);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_explicit_stop_is_kept() -> anyhow::Result<()> {
+        let archive = truncated_archive(&[1, 2, 3]).await?;
+        let plan = RegenerationPlan::penumbra_testnet_phobos_3()
+            .truncate(None, Some(2))
+            .infer_stop_from_archive(&archive)
+            .await?;
+        assert_eq!(last_block(&plan), Some(2));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_boundaries_match_archive() -> anyhow::Result<()> {
+        let archive = phobos_2_archive(None).await?;
+        RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_boundaries_against_archive(&archive)
+            .await??;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_boundary_on_missing_block_is_reported() -> anyhow::Result<()> {
+        let archive = phobos_2_archive(Some(1459800)).await?;
+        let err = RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_boundaries_against_archive(&archive)
+            .await?
+            .expect_err("check should fail with a missing block");
+        let message = err.to_string();
+        assert!(
+            message.contains("upgrade to V1o3 at height 1459800"),
+            "{}",
+            message
+        );
+        assert!(message.contains("no block at that height"), "{}", message);
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::BoundaryNotFound));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_boundary_before_missing_block_is_reported() -> anyhow::Result<()> {
+        let archive = phobos_2_archive(Some(2358329)).await?;
+        let err = RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_boundaries_against_archive(&archive)
+            .await?
+            .expect_err("check should fail with a missing block");
+        let message = err.to_string();
+        assert!(
+            message.contains("upgrade to V2 at height 2358330"),
+            "{}",
+            message
+        );
+        assert!(
+            message.contains("no block at height 2358329"),
+            "{}",
+            message
+        );
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::BoundaryNotFound));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_unexpected_archive_genesis_is_reported() -> anyhow::Result<()> {
+        let archive = archive_with(
+            &[1, 1459800, 2000000, 2358330],
+            &[1, 1459799, 1459800, 2358329, 2358330],
+        )
+        .await?;
+        let err = RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_boundaries_against_archive(&archive)
+            .await?
+            .expect_err("check should fail with an unplanned genesis");
+        assert!(
+            err.to_string().contains("genesis at height 2000000"),
+            "{}",
+            err
+        );
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::PlanMismatch));
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_geneses_present() -> anyhow::Result<()> {
+        let archive = phobos_2_archive(None).await?;
+        let checks = RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_geneses(&archive)
+            .await?;
+        assert_eq!(
+            checks
+                .iter()
+                .map(|x| (x.step, x.genesis_height))
+                .collect::<Vec<_>>(),
+            vec![(1, 1), (3, 1459800), (5, 2358330)]
+        );
+        assert!(checks.iter().all(|x| x.problem.is_none()), "{:?}", checks);
+        RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_geneses_against_archive(&archive)
+            .await??;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_missing_genesis_names_its_step() -> anyhow::Result<()> {
+        let archive = archive_with(&[1, 2358330], &[1, 1459799, 1459800, 2358329]).await?;
+        let plan = RegenerationPlan::penumbra_testnet_phobos_2();
+        let checks = plan.check_geneses(&archive).await?;
+        let missing: Vec<_> = checks.iter().filter(|x| x.problem.is_some()).collect();
+        assert_eq!(missing.len(), 1, "{:?}", checks);
+        assert_eq!(missing[0].step, 3);
+        assert_eq!(missing[0].version, Version::V1o3);
+        let err = plan
+            .check_geneses_against_archive(&archive)
+            .await?
+            .expect_err("check should fail with a missing genesis");
+        let message = err.to_string();
+        assert!(
+            message.contains("step 3, starting V1o3 with the genesis at height 1459800: the archive has no genesis"),
+            "{}",
+            message
+        );
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::GenesisNotFound));
+        Ok(())
+    }
 
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_missing_mainnet_genesis_has_its_own_exit_code() -> anyhow::Result<()> {
+        // An archive of penumbra-1 without the genesis of the upgrade to V1o3.
+        let archive = archive_with(&[1, 501975, 5480873], &[1, 501974, 501975]).await?;
+        let err = RegenerationPlan::penumbra_1()
+            .check_geneses_against_archive(&archive)
+            .await?
+            .expect_err("check should fail with a missing genesis");
+        let message = err.to_string();
+        assert!(
+            message.contains(
+                "starting V1o3 with the genesis at height 2611800: the archive has no genesis"
+            ),
+            "{}",
+            message
+        );
+        assert_eq!(crate::error::exit_code(&err), 8);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_unparseable_genesis_is_reported() -> anyhow::Result<()> {
+        let archive = archive_with(&[1, 2358330], &[]).await?;
+        let mut value: serde_json::Value =
+            serde_json::from_slice(&Genesis::test_value_at_height(1459800).encode()?)?;
+        value["app_state"] = serde_json::json!("not an app state");
+        archive.put_genesis(&Genesis::from_value(value)?).await?;
+        let checks = RegenerationPlan::penumbra_testnet_phobos_2()
+            .check_geneses(&archive)
+            .await?;
+        let problems: Vec<_> = checks
+            .iter()
+            .filter_map(|x| Some((x.step, x.problem.clone()?)))
+            .collect();
+        assert_eq!(problems.len(), 1, "{:?}", checks);
+        assert_eq!(problems[0].0, 3);
+        assert!(
+            problems[0].1.contains("isn't valid for V1o3"),
+            "{}",
+            problems[0].1
+        );
+        Ok(())
+    }
+
+    /// Write a plan file into the temporary directory, returning its path.
+    fn write_plan_file(name: &str, contents: &str) -> anyhow::Result<PathBuf> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-plan-{}-{}",
+            std::process::id(),
+            name
+        ));
+        std::fs::write(&path, contents)?;
+        Ok(path)
+    }
+
+    const DEVNET_PLAN_TOML: &str = r#"
+chain_id = "penumbra-devnet"
+
+[[steps]]
+kind = "init_then_run_to"
+height = 0
+genesis_height = 1
+version = "V1o4"
+last_block = 100
+
+[[steps]]
+kind = "migrate"
+height = 100
+from = "V1o4"
+to = "V2"
+
+[[steps]]
+kind = "init_then_run_to"
+height = 100
+genesis_height = 101
+version = "V2"
+"#;
+
+    #[test]
+    fn test_read_plan_file() -> anyhow::Result<()> {
+        use RegenerationStep::*;
+        use Version::*;
+
+        let expected = vec![
+            (
+                0,
+                InitThenRunTo {
+                    genesis_height: 1,
+                    version: V1o4,
+                    last_block: Some(100),
+                },
+            ),
+            (100, Migrate { from: V1o4, to: V2 }),
+            (
+                100,
+                InitThenRunTo {
+                    genesis_height: 101,
+                    version: V2,
+                    last_block: None,
+                },
+            ),
+        ];
+        let toml = write_plan_file("devnet.toml", DEVNET_PLAN_TOML)?;
+        assert_eq!(
+            RegenerationPlan::read_file(&toml, "penumbra-devnet")?.steps,
+            expected
+        );
+        let json = write_plan_file(
+            "devnet.json",
+            r#"{"steps": [
+                {"kind": "init_then_run_to", "height": 0, "genesis_height": 1, "version": "V1o4", "last_block": 100},
+                {"kind": "migrate", "height": 100, "from": "V1o4", "to": "V2"},
+                {"kind": "init_then_run_to", "height": 100, "genesis_height": 101, "version": "V2", "last_block": null}
+            ]}"#,
+        )?;
+        assert_eq!(
+            RegenerationPlan::read_file(&json, "penumbra-devnet")?.steps,
+            expected
+        );
+        // The file takes precedence over the built-in plan.
+        assert_eq!(
+            RegenerationPlan::load("penumbra-1", Some(&json))?.steps,
+            expected
+        );
+        assert_eq!(
+            RegenerationPlan::load("penumbra-1", None)?.steps,
+            RegenerationPlan::penumbra_1().steps
+        );
+
+        let err = RegenerationPlan::read_file(&toml, "penumbra-1")
+            .expect_err("the chain id in the file should be checked");
+        assert!(
+            format!("{:#}", err).contains("not 'penumbra-1'"),
+            "{:#}",
+            err
+        );
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::PlanMismatch));
+
+        std::fs::remove_file(toml)?;
+        std::fs::remove_file(json)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_plan_file_must_be_in_order() -> anyhow::Result<()> {
+        let cases = [
+            (
+                DEVNET_PLAN_TOML.replace("version = \"V2\"", "version = \"V3\""),
+                "unknown version 'V3'",
+            ),
+            (
+                DEVNET_PLAN_TOML.replace("genesis_height = 101", "genesis_height = 102"),
+                "rather than right after its height 100",
+            ),
+            (
+                DEVNET_PLAN_TOML.replace("from = \"V1o4\"", "from = \"V0o80\""),
+                "migrates from V0o80",
+            ),
+            (
+                DEVNET_PLAN_TOML.replace("last_block = 100", "last_block = 90"),
+                "migrates at height 100, but the step before it stops at Some(90)",
+            ),
+            (
+                DEVNET_PLAN_TOML.replace("kind = \"migrate\"", "kind = \"upgrade\""),
+                "invalid step 2",
+            ),
+        ];
+        for (i, (contents, expected)) in cases.iter().enumerate() {
+            let path = write_plan_file(&format!("bad-{}.toml", i), contents)?;
+            let err = RegenerationPlan::read_file(&path, "penumbra-devnet")
+                .expect_err("the plan should be rejected");
+            assert!(format!("{:#}", err).contains(expected), "{:#}", err);
+            std::fs::remove_file(path)?;
+        }
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_plan_within_archive_range() -> anyhow::Result<()> {
+        let path = write_plan_file("range.toml", DEVNET_PLAN_TOML)?;
+        let plan = RegenerationPlan::read_file(&path, "penumbra-devnet")?;
+        std::fs::remove_file(path)?;
+
+        let archive = truncated_archive(&[1, 100, 101, 150]).await?;
+        plan.check_within_archive_range(&archive).await??;
+
+        let short = truncated_archive(&[1, 50]).await?;
+        let err = plan
+            .check_within_archive_range(&short)
+            .await?
+            .expect_err("the plan goes past the archive");
+        let message = err.to_string();
+        assert!(
+            message.contains("step 1 stops at height 100, after the archive's last block 50"),
+            "{}",
+            message
+        );
+        assert!(
+            message.contains("step 3 has a genesis at height 101"),
+            "{}",
+            message
+        );
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::BoundaryNotFound));
         Ok(())
     }
 }
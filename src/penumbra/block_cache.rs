@@ -0,0 +1,399 @@
+//! A cache of the blocks regenerated from, so that running regeneration again over the same
+//! blocks reads them from a plain stream, rather than out of the archive.
+use anyhow::Context as _;
+use serde_json::Value;
+use std::path::{Path, PathBuf};
+
+use crate::cometbft::Block;
+use crate::storage::Storage as Archive;
+use crate::stream::{index_path, BlockWriter, StreamFormat, StreamReader};
+
+/// The archive, and the blocks in it, that a segment in the cache was taken from.
+///
+/// A cached segment is only read from while the archive still matches this.
+#[derive(Clone, Debug, PartialEq)]
+struct Origin {
+    chain_id: String,
+    first: u64,
+    last: u64,
+    /// The [Archive::fingerprint] of the blocks, when they were cached.
+    fingerprint: String,
+}
+
+impl Origin {
+    async fn of(archive: &Archive, first: u64, last: u64) -> anyhow::Result<Self> {
+        Ok(Self {
+            chain_id: archive.chain_id().await?,
+            first,
+            last,
+            fingerprint: archive.fingerprint(first, last).await?,
+        })
+    }
+
+    fn to_value(&self) -> Value {
+        serde_json::json!({
+            "chain_id": self.chain_id,
+            "first": self.first,
+            "last": self.last,
+            "fingerprint": self.fingerprint,
+        })
+    }
+
+    fn from_value(value: &Value) -> Option<Self> {
+        Some(Self {
+            chain_id: value.get("chain_id")?.as_str()?.to_owned(),
+            first: value.get("first")?.as_u64()?,
+            last: value.get("last")?.as_u64()?,
+            fingerprint: value.get("fingerprint")?.as_str()?.to_owned(),
+        })
+    }
+
+    /// Read where a cached segment was taken from, if it was cached in full.
+    ///
+    /// An origin which doesn't read back is treated like a missing one, leaving the segment
+    /// to be cached again.
+    fn read(path: &Path) -> anyhow::Result<Option<Self>> {
+        let data = match std::fs::read(path) {
+            Ok(data) => data,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => return Err(e).context(format!("failed to read '{}'", path.display())),
+        };
+        let origin = serde_json::from_slice::<Value>(&data)
+            .ok()
+            .and_then(|x| Self::from_value(&x));
+        if origin.is_none() {
+            tracing::warn!(
+                "ignoring the unreadable block cache record '{}'",
+                path.display()
+            );
+        }
+        Ok(origin)
+    }
+}
+
+fn remove_if_exists(path: &Path) -> anyhow::Result<()> {
+    match std::fs::remove_file(path) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+            Err(e).context(format!("failed to remove '{}'", path.display()))
+        }
+        _ => Ok(()),
+    }
+}
+
+/// A directory of the segments of blocks regenerated from, each decoded out of the archive once.
+///
+/// Each segment is a stream of blocks, with its index, and a record of the archive it was
+/// taken from, written only once the whole segment is. A segment is keyed by the height it
+/// starts at, and read from again later if it reaches at least as far as asked for, and the
+/// archive is of the same chain, with the same blocks at its heights as when it was cached.
+/// Otherwise, it's taken from the archive anew, replacing what's cached.
+pub struct BlockCache {
+    dir: PathBuf,
+}
+
+impl BlockCache {
+    pub fn new(dir: &Path) -> Self {
+        Self {
+            dir: dir.to_owned(),
+        }
+    }
+
+    fn stream_path(&self, first: u64) -> PathBuf {
+        self.dir.join(format!("segment-{}.ndproto", first))
+    }
+
+    fn origin_path(&self, first: u64) -> PathBuf {
+        self.dir.join(format!("segment-{}.json", first))
+    }
+
+    /// Open the segment of the blocks from `first` to `last`, inclusive, in an archive.
+    ///
+    /// If the cache has those blocks, as the archive has them now, they're read from there,
+    /// and otherwise from the archive, caching them as they're read.
+    pub async fn open(&self, archive: &Archive, first: u64, last: u64) -> anyhow::Result<Segment> {
+        let chain_id = archive.chain_id().await?;
+        if let Some(reader) = self.find(archive, &chain_id, first, last).await? {
+            tracing::info!(
+                "reading blocks {}..={} from the block cache in '{}'",
+                first,
+                last,
+                self.dir.display()
+            );
+            return Ok(Segment::Cached(reader));
+        }
+        tracing::info!(
+            "caching blocks {}..={} in '{}' as they're read from the archive",
+            first,
+            last,
+            self.dir.display()
+        );
+        std::fs::create_dir_all(&self.dir)
+            .with_context(|| format!("failed to create '{}'", self.dir.display()))?;
+        // So that the cache never claims to have the segment while its stream is being replaced.
+        let origin_path = self.origin_path(first);
+        remove_if_exists(&origin_path)?;
+        let path = self.stream_path(first);
+        let mut tmp = path.as_os_str().to_owned();
+        tmp.push(".tmp");
+        let tmp = PathBuf::from(tmp);
+        Ok(Segment::Caching(SegmentWriter {
+            writer: BlockWriter::create(StreamFormat::Proto, Some(&tmp))?,
+            tmp,
+            path,
+            origin_path,
+            origin: Origin::of(archive, first, last).await?,
+        }))
+    }
+
+    /// Find the cached segment starting at a height, if it's there, and still matches the archive.
+    async fn find(
+        &self,
+        archive: &Archive,
+        chain_id: &str,
+        first: u64,
+        last: u64,
+    ) -> anyhow::Result<Option<StreamReader>> {
+        let Some(cached) = Origin::read(&self.origin_path(first))? else {
+            return Ok(None);
+        };
+        let stale = if cached.chain_id != chain_id {
+            Some(format!(
+                "they're of chain '{}', rather than '{}'",
+                cached.chain_id, chain_id
+            ))
+        } else if cached.last < last {
+            Some(format!(
+                "they end at height {}, before height {}",
+                cached.last, last
+            ))
+        } else if cached.fingerprint != archive.fingerprint(first, cached.last).await? {
+            Some("the archive's blocks at their heights have changed since".to_owned())
+        } else {
+            None
+        };
+        if let Some(why) = stale {
+            tracing::info!(
+                "not reusing the cached blocks {}..={}: {}",
+                first,
+                cached.last,
+                why
+            );
+            return Ok(None);
+        }
+        let mut reader = match StreamReader::open(&self.stream_path(first)) {
+            Ok(reader) => reader,
+            Err(e) => {
+                tracing::warn!(
+                    "not reusing the cached blocks {}..={}: {:#}",
+                    first,
+                    cached.last,
+                    e
+                );
+                return Ok(None);
+            }
+        };
+        let complete = reader.height_range()? == Some((first, cached.last))
+            && reader.block_count() == cached.last - first + 1;
+        if !complete {
+            tracing::warn!(
+                "not reusing the cached blocks {}..={}: the cached stream doesn't have all of them",
+                first,
+                cached.last
+            );
+            return Ok(None);
+        }
+        Ok(Some(reader))
+    }
+}
+
+/// Writes the blocks of a segment into the cache, as they're read from the archive.
+pub struct SegmentWriter {
+    writer: BlockWriter,
+    /// Where the stream is written, until it's complete.
+    tmp: PathBuf,
+    path: PathBuf,
+    origin_path: PathBuf,
+    origin: Origin,
+}
+
+/// A segment of blocks to regenerate from, opened with [BlockCache::open].
+pub enum Segment {
+    /// The blocks are read from the cache.
+    Cached(StreamReader),
+    /// The blocks are read from the archive, and cached.
+    Caching(SegmentWriter),
+}
+
+impl Segment {
+    /// Whether the blocks of this segment are read from the cache.
+    #[allow(dead_code)]
+    pub fn is_cached(&self) -> bool {
+        matches!(self, Self::Cached(_))
+    }
+
+    /// Get the block at a height in this segment.
+    ///
+    /// This will return [Option::None] if there's no such block.
+    pub async fn get_block(
+        &mut self,
+        archive: &Archive,
+        height: u64,
+    ) -> anyhow::Result<Option<Block>> {
+        match self {
+            Self::Cached(reader) => reader
+                .get_encoded_block(height)?
+                .map(|data| {
+                    Block::decode(&data).with_context(|| {
+                        format!("the cached block at height {} doesn't decode", height)
+                    })
+                })
+                .transpose(),
+            Self::Caching(segment) => {
+                let block = archive.get_block(height).await?;
+                if let Some(block) = &block {
+                    segment.writer.write(block, &block.encode())?;
+                }
+                Ok(block)
+            }
+        }
+    }
+
+    /// Finish reading this segment, once every block in it has been read, keeping what's cached.
+    pub fn finish(self) -> anyhow::Result<()> {
+        let Self::Caching(mut segment) = self else {
+            return Ok(());
+        };
+        segment.writer.flush()?;
+        drop(segment.writer);
+        std::fs::rename(&segment.tmp, &segment.path)?;
+        std::fs::rename(index_path(&segment.tmp), index_path(&segment.path))?;
+        crate::files::write_atomically(
+            &segment.origin_path,
+            &serde_json::to_vec_pretty(&segment.origin.to_value())?,
+        )
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn test_dir(name: &str) -> anyhow::Result<PathBuf> {
+        let dir = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-block-cache-{}-{}",
+            name,
+            std::process::id()
+        ));
+        if dir.exists() {
+            std::fs::remove_dir_all(&dir)?;
+        }
+        Ok(dir)
+    }
+
+    async fn test_archive(chain_id: &str, last: u64) -> anyhow::Result<Archive> {
+        let archive = Archive::new(None, Some(chain_id)).await?;
+        for height in 1..=last {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        Ok(archive)
+    }
+
+    /// Read every block of a segment, finishing it, and tell whether it came from the cache.
+    async fn read_segment(
+        cache: &BlockCache,
+        archive: &Archive,
+        first: u64,
+        last: u64,
+    ) -> anyhow::Result<(bool, Vec<Block>)> {
+        let mut segment = cache.open(archive, first, last).await?;
+        let cached = segment.is_cached();
+        let mut blocks = Vec::new();
+        for height in first..=last {
+            blocks.push(
+                segment
+                    .get_block(archive, height)
+                    .await?
+                    .expect("test archive should contain block"),
+            );
+        }
+        segment.finish()?;
+        Ok((cached, blocks))
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_cached_blocks_are_reused() -> anyhow::Result<()> {
+        let dir = test_dir("reuse")?;
+        let cache = BlockCache::new(&dir);
+        let archive = test_archive("penumbra-test", 10).await?;
+        let expected: Vec<Block> = (1..=8).map(Block::test_value_at_height).collect();
+
+        assert_eq!(
+            read_segment(&cache, &archive, 1, 8).await?,
+            (false, expected.clone())
+        );
+        assert_eq!(
+            read_segment(&cache, &archive, 1, 8).await?,
+            (true, expected.clone())
+        );
+        // A segment ending earlier is read from the one cached, which is kept as it is.
+        assert_eq!(
+            read_segment(&cache, &archive, 1, 5).await?,
+            (true, expected[..5].to_vec())
+        );
+        assert_eq!(
+            read_segment(&cache, &archive, 1, 8).await?,
+            (true, expected.clone())
+        );
+        // A segment left unfinished, say because regenerating failed, caches nothing.
+        let mut segment = cache.open(&archive, 9, 10).await?;
+        segment.get_block(&archive, 9).await?;
+        drop(segment);
+        assert!(!cache.open(&archive, 9, 10).await?.is_cached());
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_cached_blocks_are_invalidated() -> anyhow::Result<()> {
+        let dir = test_dir("invalidate")?;
+        let cache = BlockCache::new(&dir);
+        let archive = test_archive("penumbra-test", 10).await?;
+        read_segment(&cache, &archive, 1, 8).await?;
+
+        // Reaching past what's cached needs blocks the cache doesn't have.
+        assert!(!read_segment(&cache, &archive, 1, 9).await?.0);
+        assert!(read_segment(&cache, &archive, 1, 9).await?.0);
+
+        // Blocks after the segment changing leaves it as it is.
+        archive.truncate(9).await?;
+        assert!(read_segment(&cache, &archive, 1, 9).await?.0);
+
+        // A block in the segment being replaced means the cache is stale.
+        archive.truncate(4).await?;
+        archive.put_block(&Block::test_value_at_time(5, 1)).await?;
+        for height in 6..=9 {
+            archive
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        let (cached, blocks) = read_segment(&cache, &archive, 1, 9).await?;
+        assert!(!cached);
+        assert_eq!(blocks[4], Block::test_value_at_time(5, 1));
+        let (cached, blocks) = read_segment(&cache, &archive, 1, 9).await?;
+        assert!(cached);
+        assert_eq!(blocks[4], Block::test_value_at_time(5, 1));
+
+        // As is an archive of another chain.
+        let other = test_archive("penumbra-other", 9).await?;
+        assert!(!read_segment(&cache, &other, 1, 9).await?.0);
+
+        // And a cache whose stream has gone missing.
+        std::fs::remove_file(cache.stream_path(1))?;
+        assert!(!read_segment(&cache, &other, 1, 9).await?.0);
+        assert!(read_segment(&cache, &other, 1, 9).await?.0);
+        std::fs::remove_dir_all(&dir)?;
+        Ok(())
+    }
+}
@@ -10,6 +10,12 @@ use tendermint_v0o34 as tendermint;
 use crate::cometbft::Genesis;
 use crate::tendermint_compat::{BeginBlock, DeliverTx, EndBlock, Event};
 
+/// Check that a genesis holds an app state this version can start the chain from.
+pub fn parse_genesis(genesis: &Genesis) -> anyhow::Result<()> {
+    serde_json::from_value::<penumbra_app_v0o80::genesis::AppState>(genesis.app_state().clone())?;
+    Ok(())
+}
+
 pub struct Penumbra {
     storage: Storage,
     app: App,
@@ -10,6 +10,14 @@ use tendermint_v0o40 as tendermint;
 use crate::cometbft::Genesis;
 use crate::tendermint_compat::{BeginBlock, DeliverTx, EndBlock, Event};
 
+/// Check that a genesis holds an app state this version can start the chain from.
+pub fn parse_genesis(genesis: &Genesis) -> anyhow::Result<()> {
+    serde_json::from_value::<penumbra_sdk_app_v1o4::genesis::AppState>(
+        genesis.app_state().clone(),
+    )?;
+    Ok(())
+}
+
 pub struct Penumbra {
     storage: Storage,
     app: App,
@@ -0,0 +1,155 @@
+//! Periodic progress logs, for long-running commands.
+//!
+//! These are meant for runs whose output ends up in a log file, rather than a terminal,
+//! where a line every so often is much more useful than a progress bar.
+use std::time::{Duration, Instant};
+
+/// By default, how many blocks to process between each progress log.
+pub const DEFAULT_PROGRESS_INTERVAL: u64 = 10_000;
+
+/// The longest we go without logging progress, even if the interval hasn't been reached.
+///
+/// Blocks full of transactions can be slow enough that reaching the interval takes a long time,
+/// and logging on a timer as well keeps the logs useful then, without logging more often.
+const MAX_QUIET_PERIOD: Duration = Duration::from_secs(60);
+
+/// Logs how far along some range of heights a command is, along with a rate, and time remaining.
+pub struct ProgressLog {
+    /// What's being done to the blocks, which starts each log line.
+    what: &'static str,
+    /// The last height we expect to process, if known.
+    last: Option<u64>,
+    /// How many blocks to process between logs.
+    interval: u64,
+    started: Instant,
+    last_logged: Instant,
+    since_last_log: u64,
+    processed: u64,
+    /// How many blocks there are to process in total, if known.
+    total: Option<u64>,
+}
+
+impl ProgressLog {
+    /// Start tracking progress through the blocks from `first` to `last`, inclusive.
+    ///
+    /// An interval of 0 is treated as 1, logging every block.
+    pub fn new(what: &'static str, first: u64, last: Option<u64>, interval: u64) -> Self {
+        let now = Instant::now();
+        Self {
+            what,
+            last,
+            interval: interval.max(1),
+            started: now,
+            last_logged: now,
+            since_last_log: 0,
+            processed: 0,
+            total: last.map(|last| (last + 1).saturating_sub(first)),
+        }
+    }
+
+    /// Record that the block at a given height has been processed, logging if it's time to.
+    pub fn record(&mut self, height: u64) {
+        self.processed += 1;
+        self.since_last_log += 1;
+        if self.since_last_log < self.interval && self.last_logged.elapsed() < MAX_QUIET_PERIOD {
+            return;
+        }
+        self.since_last_log = 0;
+        self.last_logged = Instant::now();
+
+        let rate = self.rate();
+        match (self.last, self.total) {
+            (Some(last), Some(total)) if total > 0 => {
+                let remaining = total.saturating_sub(self.processed);
+                let eta = if rate > 0.0 {
+                    format_duration(Duration::from_secs_f64(remaining as f64 / rate))
+                } else {
+                    "unknown".to_string()
+                };
+                tracing::info!(
+                    "{}: block {} of {}, {:.1}% done, at {:.1} blocks/s, ETA {}",
+                    self.what,
+                    height,
+                    last,
+                    100.0 * self.processed as f64 / total as f64,
+                    rate,
+                    eta
+                );
+            }
+            _ => tracing::info!(
+                "{}: block {}, {} blocks done, at {:.1} blocks/s",
+                self.what,
+                height,
+                self.processed,
+                rate
+            ),
+        }
+    }
+
+    /// Log a summary of all the blocks processed.
+    pub fn finish(&self) {
+        if self.processed == 0 {
+            return;
+        }
+        tracing::info!(
+            "{}: done with {} blocks in {}, averaging {:.1} blocks/s",
+            self.what,
+            self.processed,
+            format_duration(self.started.elapsed()),
+            self.rate()
+        );
+    }
+
+    fn rate(&self) -> f64 {
+        let elapsed = self.started.elapsed().as_secs_f64();
+        if elapsed > 0.0 {
+            self.processed as f64 / elapsed
+        } else {
+            0.0
+        }
+    }
+}
+
+/// Format a duration to the second, like `1h02m03s`.
+pub fn format_duration(duration: Duration) -> String {
+    let secs = duration.as_secs();
+    if secs >= 3600 {
+        format!(
+            "{}h{:02}m{:02}s",
+            secs / 3600,
+            (secs % 3600) / 60,
+            secs % 60
+        )
+    } else {
+        format!("{}m{:02}s", secs / 60, secs % 60)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn test_format_duration() {
+        assert_eq!(format_duration(Duration::from_secs(59)), "0m59s");
+        assert_eq!(format_duration(Duration::from_secs(61)), "1m01s");
+        assert_eq!(format_duration(Duration::from_secs(3723)), "1h02m03s");
+        assert_eq!(
+            format_duration(Duration::from_secs(100 * 3600)),
+            "100h00m00s"
+        );
+    }
+
+    #[test]
+    fn test_logs_every_interval() {
+        let mut progress = ProgressLog::new("testing", 1, Some(25), 10);
+        for height in 1..=9 {
+            progress.record(height);
+            assert_eq!(progress.since_last_log, height);
+        }
+        progress.record(10);
+        assert_eq!(progress.since_last_log, 0);
+        assert_eq!(progress.total, Some(25));
+        assert_eq!(progress.processed, 10);
+    }
+}
@@ -0,0 +1,110 @@
+//! Stopping long-running commands cleanly when the process is asked to.
+//!
+//! Commands check for a shutdown request between units of work, so that whatever
+//! they've written so far is left in a consistent state they can resume from.
+use std::sync::Arc;
+
+use tokio::{
+    signal::unix::{signal, SignalKind},
+    sync::{mpsc, watch},
+};
+
+/// A request to stop, shared between whoever makes it and whoever should stop.
+#[derive(Clone)]
+pub struct Shutdown {
+    tx: Arc<watch::Sender<bool>>,
+}
+
+impl Default for Shutdown {
+    fn default() -> Self {
+        Self {
+            tx: Arc::new(watch::channel(false).0),
+        }
+    }
+}
+
+impl Shutdown {
+    /// Create a shutdown request, triggered by the first SIGINT or SIGTERM the process receives.
+    ///
+    /// A second signal doesn't wait for anything to stop, and quits immediately.
+    pub fn on_signals() -> anyhow::Result<Self> {
+        let mut interrupt = signal(SignalKind::interrupt())?;
+        let mut terminate = signal(SignalKind::terminate())?;
+        let (tx, rx) = mpsc::unbounded_channel();
+        tokio::spawn(async move {
+            loop {
+                tokio::select! {
+                    _ = interrupt.recv() => {}
+                    _ = terminate.recv() => {}
+                }
+                if tx.send(()).is_err() {
+                    return;
+                }
+            }
+        });
+        Ok(Self::on_received(rx, || std::process::exit(130)))
+    }
+
+    /// Like [Self::on_signals], but with the signals coming from a channel, and quitting
+    /// calling a function, so that neither needs the process itself.
+    fn on_received(
+        mut signals: mpsc::UnboundedReceiver<()>,
+        quit: impl FnOnce() + Send + 'static,
+    ) -> Self {
+        let shutdown = Self::default();
+        let out = shutdown.clone();
+        tokio::spawn(async move {
+            if signals.recv().await.is_none() {
+                return;
+            }
+            tracing::warn!(
+                "received a signal, stopping once the current block is done; send another to quit immediately"
+            );
+            shutdown.request();
+            if signals.recv().await.is_none() {
+                return;
+            }
+            tracing::warn!("received a second signal, quitting immediately");
+            quit();
+        });
+        out
+    }
+
+    /// Ask to stop.
+    pub fn request(&self) {
+        self.tx.send_replace(true);
+    }
+
+    /// Wait until stopping has been requested, returning immediately if it already was.
+    pub async fn requested(&self) {
+        let mut rx = self.tx.subscribe();
+        // The sender lives as long as self, so this can't fail.
+        let _ = rx.wait_for(|x| *x).await;
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use tokio::sync::oneshot;
+
+    use super::*;
+
+    #[tokio::test]
+    async fn test_second_signal_quits() -> anyhow::Result<()> {
+        let (signals, rx) = mpsc::unbounded_channel();
+        let (quit, mut quitted) = oneshot::channel();
+        let shutdown = Shutdown::on_received(rx, move || {
+            let _ = quit.send(());
+        });
+
+        // The first signal only asks to stop.
+        signals.send(())?;
+        shutdown.requested().await;
+        assert!(quitted.try_recv().is_err());
+
+        // The second doesn't wait for anything to stop.
+        signals.send(())?;
+        quitted.await?;
+        Ok(())
+    }
+}
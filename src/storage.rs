@@ -1,14 +1,126 @@
-use std::{path::Path, str::FromStr};
+use std::{borrow::Cow, fmt, io::Read as _, path::Path, str::FromStr};
 
-use anyhow::anyhow;
+use anyhow::{anyhow, Context as _};
+use futures_core::Stream;
 use sqlx::{sqlite::SqliteConnectOptions, SqlitePool};
+use tokio_stream::StreamExt as _;
 
 use crate::cometbft::{Block, Genesis};
+use crate::error::{ErrorKind, Failure};
+use crate::files::FileLock;
 
 /// The current version of the storage
-const VERSION: &str = "penumbra-reindexer-archive-v1";
+const VERSION: &str = "penumbra-reindexer-archive-v2";
 
-async fn create_pool(path: Option<&Path>) -> anyhow::Result<SqlitePool> {
+/// What the version of the storage starts with, before the version of the archive format.
+const VERSION_PREFIX: &str = "penumbra-reindexer-archive-v";
+
+/// The version of the archive format this build reads and writes, as in `VERSION`.
+///
+/// This goes up whenever archives change in a way that builds from before would misread,
+/// so that each build refuses the archives of the others, rather than reading them wrong.
+/// v2 stores empty blocks compactly.
+const FORMAT_VERSION: u32 = 2;
+
+/// The earliest version of the archive format this build still reads.
+///
+/// v1 archives store every block in full, which reads back the same as in v2. Writing to one
+/// moves it to `VERSION` first, since builds only reading v1 would misread its compact blocks.
+const MIN_FORMAT_VERSION: u32 = 1;
+
+/// The version of the reindexer, recorded in the archives it creates.
+const REINDEXER_VERSION: &str = env!("CARGO_PKG_VERSION");
+
+/// Check that an archive, with a given version, is in the format of this build.
+///
+/// Which reindexer wrote the archive, if it's known, goes into the error, to tell which
+/// build reads it.
+fn check_format_version(version: &str, written_by: Option<&str>) -> anyhow::Result<()> {
+    let Some(format) = version
+        .strip_prefix(VERSION_PREFIX)
+        .and_then(|x| x.parse::<u32>().ok())
+    else {
+        anyhow::bail!(Failure::new(
+            ErrorKind::CorruptArchive,
+            format!("the archive has an unknown version '{}'", version)
+        ));
+    };
+    if (MIN_FORMAT_VERSION..=FORMAT_VERSION).contains(&format) {
+        return Ok(());
+    }
+    let written_by = written_by
+        .map(|x| format!(" (the archive was written by penumbra-reindexer {})", x))
+        .unwrap_or_default();
+    let advice = if format > FORMAT_VERSION {
+        "upgrade the reindexer to read it"
+    } else {
+        "archive it again with this build to read it"
+    };
+    anyhow::bail!(Failure::new(
+        ErrorKind::IncompatibleArchive,
+        format!(
+            "archive format v{}, this build supports v{} to v{}{}; {}",
+            format, MIN_FORMAT_VERSION, FORMAT_VERSION, written_by, advice
+        )
+    ))
+}
+
+/// The key an archive is encrypted at rest with, using SQLCipher.
+///
+/// This is a passphrase, which SQLCipher derives the actual key of the database from.
+#[derive(Clone, PartialEq, Eq)]
+pub struct ArchiveKey(String);
+
+impl ArchiveKey {
+    pub fn new(passphrase: impl Into<String>) -> anyhow::Result<Self> {
+        let passphrase = passphrase.into();
+        anyhow::ensure!(
+            !passphrase.is_empty(),
+            "the key of an archive can't be empty"
+        );
+        Ok(Self(passphrase))
+    }
+
+    pub fn passphrase(&self) -> &str {
+        &self.0
+    }
+
+    /// The passphrase as an sqlite string literal, for `PRAGMA key`.
+    fn pragma_value(&self) -> String {
+        format!("'{}'", self.0.replace('\'', "''"))
+    }
+}
+
+impl fmt::Debug for ArchiveKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        // Keys end up in logs otherwise, along with whatever holds them.
+        f.write_str("ArchiveKey(..)")
+    }
+}
+
+/// The first bytes of every sqlite database which isn't encrypted.
+const SQLITE_HEADER: &[u8] = b"SQLite format 3\0";
+
+/// Whether a file is there, but doesn't start like a plain sqlite database, as an encrypted one doesn't.
+fn looks_encrypted(path: &Path) -> bool {
+    let mut header = [0u8; SQLITE_HEADER.len()];
+    match std::fs::File::open(path).and_then(|mut x| x.read_exact(&mut header)) {
+        Ok(()) => header != SQLITE_HEADER,
+        Err(_) => false,
+    }
+}
+
+/// Whether an error is sqlite failing to read a file as a database, as with the wrong key.
+fn is_not_a_database(e: &anyhow::Error) -> bool {
+    // SQLITE_NOTADB, which SQLCipher also fails with when decrypting with the wrong key.
+    const NOT_A_DATABASE: &str = "26";
+    e.chain().any(|x| match x.downcast_ref::<sqlx::Error>() {
+        Some(sqlx::Error::Database(e)) => e.code().as_deref() == Some(NOT_A_DATABASE),
+        _ => false,
+    })
+}
+
+async fn create_pool(path: Option<&Path>, key: Option<&ArchiveKey>) -> anyhow::Result<SqlitePool> {
     let url = match path {
         None => "sqlite://:memory:".to_string(),
         Some(path) => {
@@ -19,11 +131,381 @@ async fn create_pool(path: Option<&Path>) -> anyhow::Result<SqlitePool> {
             )
         }
     };
-    let options = SqliteConnectOptions::from_str(&url)?
+    let mut options = SqliteConnectOptions::from_str(&url)?
         .create_if_missing(true)
         // This is ok because we only write during archival, and if you crash: rearchive
         .synchronous(sqlx::sqlite::SqliteSynchronous::Off);
-    SqlitePool::connect_with(options).await.map_err(Into::into)
+    if let Some(key) = key {
+        // sqlx sets this before any other pragma, on every connection, as SQLCipher needs.
+        options = options.pragma("key", key.pragma_value());
+    }
+    let pool = SqlitePool::connect_with(options).await?;
+    if key.is_some() {
+        // Without SQLCipher, setting a key does nothing, which would leave the archive in the clear,
+        // so this makes sure that sqlite really was built as SQLCipher.
+        let cipher: Option<(String,)> = sqlx::query_as("PRAGMA cipher_version")
+            .fetch_optional(&pool)
+            .await?;
+        anyhow::ensure!(
+            cipher.is_some(),
+            "this build of the reindexer can't encrypt archives; build it with `--features sqlcipher`"
+        );
+    }
+    Ok(pool)
+}
+
+/// Blocks without transactions are stored behind this marker, in a compact form.
+///
+/// No encoded block starts with it, as protobuf has no field 0.
+const COMPACT_EMPTY_BLOCK: u8 = 0;
+
+/// The fields of a block, and of its header, that an empty block has no choice about,
+/// and which the compact form leaves out: the data and evidence, with nothing in them,
+/// and their hashes, which are the hash of nothing.
+const BLOCK_HEADER_FIELD: u64 = 1;
+const BLOCK_EMPTY_FIELDS: [u64; 2] = [2, 3];
+const HEADER_EMPTY_HASH_FIELDS: [u64; 2] = [7, 13];
+
+/// The field of a block holding the evidence of misbehavior committed in it.
+const BLOCK_EVIDENCE_FIELD: u64 = 3;
+
+/// The field of a block holding the commit of the block before it,
+/// and the field of a commit holding the signatures of the validators.
+const BLOCK_LAST_COMMIT_FIELD: u64 = 4;
+const COMMIT_SIGNATURES_FIELD: u64 = 4;
+
+fn read_varint(data: &[u8], at: &mut usize) -> Option<u64> {
+    let mut out = 0u64;
+    for shift in (0..64).step_by(7) {
+        let byte = *data.get(*at)?;
+        *at += 1;
+        out |= u64::from(byte & 0x7f) << shift;
+        if byte < 0x80 {
+            return Some(out);
+        }
+    }
+    None
+}
+
+fn push_varint(out: &mut Vec<u8>, mut x: u64) {
+    while x >= 0x80 {
+        out.push((x as u8) | 0x80);
+        x >>= 7;
+    }
+    out.push(x as u8);
+}
+
+fn length_delimited(number: u64, payload: &[u8]) -> Vec<u8> {
+    let mut out = Vec::with_capacity(payload.len() + 4);
+    push_varint(&mut out, (number << 3) | 2);
+    push_varint(&mut out, payload.len() as u64);
+    out.extend_from_slice(payload);
+    out
+}
+
+/// Split an encoded protobuf message into its fields, as they appear, without decoding them.
+///
+/// Each field comes with its number, its whole encoding, and for length-delimited fields, what's inside.
+fn split_fields(data: &[u8]) -> Option<Vec<(u64, &[u8], Option<&[u8]>)>> {
+    let mut out = Vec::new();
+    let mut at = 0;
+    while at < data.len() {
+        let start = at;
+        let tag = read_varint(data, &mut at)?;
+        let payload = match tag & 7 {
+            0 => {
+                read_varint(data, &mut at)?;
+                None
+            }
+            1 => {
+                at = at.checked_add(8)?;
+                None
+            }
+            2 => {
+                let len = usize::try_from(read_varint(data, &mut at)?).ok()?;
+                let payload = data.get(at..at.checked_add(len)?)?;
+                at += len;
+                Some(payload)
+            }
+            5 => {
+                at = at.checked_add(4)?;
+                None
+            }
+            _ => return None,
+        };
+        out.push((tag >> 3, data.get(start..at)?, payload));
+    }
+    Some(out)
+}
+
+/// Put fields back into a message they were left out of, each before the first field after it.
+fn with_implied_fields<'a>(
+    fields: impl IntoIterator<Item = (u64, Cow<'a, [u8]>)>,
+    implied: &[(u64, Vec<u8>)],
+) -> Vec<u8> {
+    let mut out = Vec::new();
+    let mut implied = implied.iter().peekable();
+    for (number, field) in fields {
+        while let Some((_, x)) = implied.next_if(|(x, _)| *x < number) {
+            out.extend_from_slice(x);
+        }
+        out.extend_from_slice(&field);
+    }
+    for (_, x) in implied {
+        out.extend_from_slice(x);
+    }
+    out
+}
+
+fn empty_hash() -> Vec<u8> {
+    use sha2::{Digest, Sha256};
+    Sha256::digest(b"").to_vec()
+}
+
+/// Encode an empty block compactly, with only its header, minus what being empty implies,
+/// and its last commit.
+///
+/// This is only done if the block can be reconstructed exactly from that, returning
+/// [Option::None] otherwise, such that the block gets stored as it is instead.
+fn compact_empty_block(data: &[u8]) -> Option<Vec<u8>> {
+    let empty_hash = empty_hash();
+    let mut out = vec![COMPACT_EMPTY_BLOCK];
+    for (number, field, payload) in split_fields(data)? {
+        match (number, payload) {
+            (BLOCK_HEADER_FIELD, Some(header)) => {
+                let mut compact = Vec::new();
+                for (number, field, payload) in split_fields(header)? {
+                    let implied = HEADER_EMPTY_HASH_FIELDS.contains(&number)
+                        && payload == Some(empty_hash.as_slice());
+                    if !implied {
+                        compact.extend_from_slice(field);
+                    }
+                }
+                out.extend(length_delimited(BLOCK_HEADER_FIELD, &compact));
+            }
+            (number, Some([])) if BLOCK_EMPTY_FIELDS.contains(&number) => {}
+            _ => out.extend_from_slice(field),
+        }
+    }
+    (expand_empty_block(&out[1..])?.as_slice() == data).then_some(out)
+}
+
+/// Find the evidence of misbehavior committed in an encoded block, as an encoded `EvidenceList`.
+///
+/// This returns [Option::None] if the block carries no evidence, as most blocks don't.
+pub fn block_evidence(data: &[u8]) -> Option<&[u8]> {
+    split_fields(data)?
+        .into_iter()
+        .find_map(|(number, _, payload)| payload.filter(|_| number == BLOCK_EVIDENCE_FIELD))
+        .filter(|x| !x.is_empty())
+}
+
+/// Leave the signatures out of the last commit of an encoded block, as `archive --no-commit` does.
+///
+/// The commit keeps its height, round, and the id of the block it's for, so that the block
+/// still decodes, with its header untouched, but the commit no longer says who voted for it,
+/// which regeneration needs. This returns [Option::None] if the block is malformed.
+pub fn without_commit_signatures(data: &[u8]) -> Option<Vec<u8>> {
+    let mut out = Vec::with_capacity(data.len());
+    for (number, field, payload) in split_fields(data)? {
+        match (number, payload) {
+            (BLOCK_LAST_COMMIT_FIELD, Some(commit)) => {
+                let mut stripped = Vec::new();
+                for (number, field, _) in split_fields(commit)? {
+                    if number != COMMIT_SIGNATURES_FIELD {
+                        stripped.extend_from_slice(field);
+                    }
+                }
+                out.extend(length_delimited(BLOCK_LAST_COMMIT_FIELD, &stripped));
+            }
+            _ => out.extend_from_slice(field),
+        }
+    }
+    Some(out)
+}
+
+/// Reconstruct the exact encoding of an empty block from its compact form, without the marker.
+fn expand_empty_block(compact: &[u8]) -> Option<Vec<u8>> {
+    let empty_hash = empty_hash();
+    let header_implied: Vec<_> = HEADER_EMPTY_HASH_FIELDS
+        .iter()
+        .map(|&x| (x, length_delimited(x, &empty_hash)))
+        .collect();
+    let block_implied: Vec<_> = BLOCK_EMPTY_FIELDS
+        .iter()
+        .map(|&x| (x, length_delimited(x, &[])))
+        .collect();
+    let mut fields = Vec::new();
+    for (number, field, payload) in split_fields(compact)? {
+        let field: Cow<[u8]> = match (number, payload) {
+            (BLOCK_HEADER_FIELD, Some(header)) => {
+                let header = split_fields(header)?
+                    .into_iter()
+                    .map(|(number, field, _)| (number, Cow::Borrowed(field)));
+                length_delimited(
+                    BLOCK_HEADER_FIELD,
+                    &with_implied_fields(header, &header_implied),
+                )
+                .into()
+            }
+            _ => field.into(),
+        };
+        fields.push((number, field));
+    }
+    Some(with_implied_fields(fields, &block_implied))
+}
+
+/// Get the encoding of a block back from how it's stored, which is only different for empty blocks.
+fn expand_stored_block(data: Vec<u8>) -> anyhow::Result<Vec<u8>> {
+    match data.split_first() {
+        Some((&COMPACT_EMPTY_BLOCK, compact)) => expand_empty_block(compact).ok_or_else(|| {
+            Failure::new(
+                ErrorKind::CorruptArchive,
+                "the compactly stored empty block is malformed",
+            )
+            .into()
+        }),
+        _ => Ok(data),
+    }
+}
+
+/// Insert an encoded block, along with its extended commit, recording it as committed.
+///
+/// The caller commits the transaction this is part of, along with whatever else is in it.
+async fn insert_block(
+    conn: &mut sqlx::SqliteConnection,
+    height: u64,
+    data: &[u8],
+    num_txs: usize,
+    time: i64,
+    extended_commit: Option<&[u8]>,
+) -> anyhow::Result<()> {
+    let exists: Option<_> = sqlx::query("SELECT 1 FROM blocks WHERE height = ?")
+        .bind(i64::try_from(height)?)
+        .fetch_optional(&mut *conn)
+        .await?;
+    anyhow::ensure!(
+        exists.is_none(),
+        "block at height {} already exists",
+        height
+    );
+
+    // Much of a chain's history is empty blocks, which don't need all of their encoding kept.
+    let compact = match num_txs {
+        0 => compact_empty_block(data),
+        _ => None,
+    };
+    let (data_id,): (i64,) = sqlx::query_as("INSERT INTO blobs(data) VALUES (?) RETURNING rowid")
+        .bind(compact.as_deref().unwrap_or(data))
+        .fetch_one(&mut *conn)
+        .await?;
+    sqlx::query("INSERT INTO blocks(height, data_id, num_txs, time) VALUES (?, ?, ?, ?)")
+        .bind(i64::try_from(height)?)
+        .bind(data_id)
+        .bind(i64::try_from(num_txs)?)
+        .bind(time)
+        .execute(&mut *conn)
+        .await?;
+    if let Some(extended_commit) = extended_commit {
+        let (data_id,): (i64,) =
+            sqlx::query_as("INSERT INTO blobs(data) VALUES (?) RETURNING rowid")
+                .bind(extended_commit)
+                .fetch_one(&mut *conn)
+                .await?;
+        sqlx::query("INSERT INTO extended_commits(height, data_id) VALUES (?, ?)")
+            .bind(i64::try_from(height)?)
+            .bind(data_id)
+            .execute(&mut *conn)
+            .await?;
+    }
+    sqlx::query(
+        "INSERT INTO committed (id, height) VALUES (0, ?) ON CONFLICT (id) DO UPDATE SET height = MAX(height, excluded.height)",
+    )
+    .bind(i64::try_from(height)?)
+    .execute(&mut *conn)
+    .await?;
+    Ok(())
+}
+
+/// Blocks being put into storage in a single transaction, started with [`Storage::begin_batch`].
+pub struct BlockBatch {
+    tx: sqlx::Transaction<'static, sqlx::Sqlite>,
+    len: usize,
+}
+
+/// Insert the encoded evidence committed in a block, which must be put into storage as well.
+async fn insert_evidence(
+    conn: &mut sqlx::SqliteConnection,
+    height: u64,
+    evidence: &[u8],
+) -> anyhow::Result<()> {
+    let (data_id,): (i64,) = sqlx::query_as("INSERT INTO blobs(data) VALUES (?) RETURNING rowid")
+        .bind(evidence)
+        .fetch_one(&mut *conn)
+        .await?;
+    sqlx::query("INSERT INTO evidence(height, data_id) VALUES (?, ?)")
+        .bind(i64::try_from(height)?)
+        .bind(data_id)
+        .execute(&mut *conn)
+        .await?;
+    Ok(())
+}
+
+impl BlockBatch {
+    /// Put an encoded block into the batch, like [`Storage::put_encoded_block`], along with
+    /// the evidence committed in it, like [`Storage::put_evidence`], if there's any.
+    ///
+    /// The block goes in under a savepoint, so if any of it fails to, none of it does,
+    /// and the batch can still be committed with the blocks put into it before.
+    pub async fn put_encoded_block(
+        &mut self,
+        height: u64,
+        data: &[u8],
+        num_txs: usize,
+        time: i64,
+        extended_commit: Option<&[u8]>,
+        evidence: Option<&[u8]>,
+    ) -> anyhow::Result<()> {
+        sqlx::query("SAVEPOINT block")
+            .execute(self.tx.as_mut())
+            .await?;
+        let conn = self.tx.as_mut();
+        let result = async {
+            insert_block(&mut *conn, height, data, num_txs, time, extended_commit).await?;
+            if let Some(evidence) = evidence {
+                insert_evidence(&mut *conn, height, evidence).await?;
+            }
+            anyhow::Ok(())
+        }
+        .await;
+        if result.is_err() {
+            // Rolling back leaves the savepoint in place, for releasing as if it had worked.
+            sqlx::query("ROLLBACK TO block")
+                .execute(self.tx.as_mut())
+                .await?;
+        }
+        sqlx::query("RELEASE block")
+            .execute(self.tx.as_mut())
+            .await?;
+        result?;
+        self.len += 1;
+        Ok(())
+    }
+
+    /// How many blocks are in the batch.
+    pub fn len(&self) -> usize {
+        self.len
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len == 0
+    }
+
+    /// Commit every block in the batch to storage at once.
+    pub async fn commit(self) -> anyhow::Result<()> {
+        self.tx.commit().await?;
+        Ok(())
+    }
 }
 
 /// Storage used for the archive format.
@@ -52,12 +534,29 @@ impl Storage {
                 r#"CREATE TABLE IF NOT EXISTS metadata (
                     id INTEGER PRIMARY KEY CHECK (id = 0),
                     version TEXT NOT NULL UNIQUE,
-                    chain_id TEXT NOT NULL UNIQUE
+                    chain_id TEXT NOT NULL UNIQUE,
+                    without_commits INTEGER NOT NULL DEFAULT 0,
+                    reindexer_version TEXT
                 );"#,
             )
             .execute(pool)
             .await?;
 
+            // Archives from before commits could be left out all have them.
+            if !has_metadata_column(pool, "without_commits").await? {
+                sqlx::query(
+                    "ALTER TABLE metadata ADD COLUMN without_commits INTEGER NOT NULL DEFAULT 0",
+                )
+                .execute(pool)
+                .await?;
+            }
+            // Nor is it known which reindexer created archives from before it was recorded.
+            if !has_metadata_column(pool, "reindexer_version").await? {
+                sqlx::query("ALTER TABLE metadata ADD COLUMN reindexer_version TEXT")
+                    .execute(pool)
+                    .await?;
+            }
+
             // This table exists to store large blobs outside of tables.
             // This allows us to scan, e.g. for querying the max height,
             // without having to traverse the big blobs.
@@ -70,21 +569,85 @@ impl Storage {
             .execute(pool)
             .await?;
 
+            // num_txs and time are only null for blocks archived before the columns existed,
+            // until they're backfilled, or if they can't be decoded.
+            // The time is that of the block header, in nanoseconds since the unix epoch.
             sqlx::query(
                 r#"CREATE TABLE IF NOT EXISTS blocks (
                     height INTEGER NOT NULL PRIMARY KEY,
-                    data_id INTEGER NOT NULL
+                    data_id INTEGER NOT NULL,
+                    num_txs INTEGER,
+                    time INTEGER
                 )
                 "#,
             )
             .execute(pool)
             .await?;
 
+            for (column, what) in [("num_txs", "a transaction count"), ("time", "a timestamp")] {
+                let exists: bool = sqlx::query_scalar(
+                    "SELECT EXISTS(SELECT 1 FROM pragma_table_info('blocks') WHERE name = ?)",
+                )
+                .bind(column)
+                .fetch_one(pool)
+                .await?;
+                if !exists {
+                    tracing::info!("adding {} to the blocks in the archive", what);
+                    sqlx::query(&format!("ALTER TABLE blocks ADD COLUMN {} INTEGER", column))
+                        .execute(pool)
+                        .await?;
+                }
+            }
+
             // For efficient joins between blocks and the data inside.
             sqlx::query("CREATE UNIQUE INDEX IF NOT EXISTS idx_blocks_data_id ON blocks(data_id)")
                 .execute(pool)
                 .await?;
 
+            // For looking up blocks by when they were made.
+            sqlx::query("CREATE INDEX IF NOT EXISTS idx_blocks_time ON blocks(time)")
+                .execute(pool)
+                .await?;
+
+            // Extended commits carry the vote extensions of a height, from cometbft 0.38 on.
+            // Archives of older chains simply have none, which is also how archives from
+            // before this table existed read.
+            sqlx::query(
+                r#"CREATE TABLE IF NOT EXISTS extended_commits (
+                    height INTEGER NOT NULL PRIMARY KEY,
+                    data_id INTEGER NOT NULL
+                )
+                "#,
+            )
+            .execute(pool)
+            .await?;
+
+            // For efficient joins between extended commits and the data inside.
+            sqlx::query(
+                "CREATE UNIQUE INDEX IF NOT EXISTS idx_extended_commits_data_id ON extended_commits(data_id)",
+            )
+            .execute(pool)
+            .await?;
+
+            // Evidence of misbehavior is part of the block it was committed in, but is also put
+            // here, when archival is asked to, so that it can be found without decoding blocks.
+            // Only heights with evidence have a row.
+            sqlx::query(
+                r#"CREATE TABLE IF NOT EXISTS evidence (
+                    height INTEGER NOT NULL PRIMARY KEY,
+                    data_id INTEGER NOT NULL
+                )
+                "#,
+            )
+            .execute(pool)
+            .await?;
+
+            sqlx::query(
+                "CREATE UNIQUE INDEX IF NOT EXISTS idx_evidence_data_id ON evidence(data_id)",
+            )
+            .execute(pool)
+            .await?;
+
             sqlx::query(
                 r#"CREATE TABLE IF NOT EXISTS geneses (
                     initial_height INTEGER NOT NULL PRIMARY KEY,
@@ -102,10 +665,59 @@ impl Storage {
             .execute(pool)
             .await?;
 
+            // The highest block whose insert has fully committed, kept in the same transaction
+            // as the insert. Blocks above it are suspect when the archive is next opened.
+            sqlx::query(
+                r#"CREATE TABLE IF NOT EXISTS committed (
+                    id INTEGER PRIMARY KEY CHECK (id = 0),
+                    height INTEGER NOT NULL
+                )
+                "#,
+            )
+            .execute(pool)
+            .await?;
+
             Ok(())
         }
 
-        /// Attempt to populate metadata, failing on version mismatches.
+        async fn has_metadata_column(pool: &SqlitePool, name: &str) -> anyhow::Result<bool> {
+            let out = sqlx::query_scalar(
+                "SELECT EXISTS(SELECT 1 FROM pragma_table_info('metadata') WHERE name = ?)",
+            )
+            .bind(name)
+            .fetch_one(pool)
+            .await?;
+            Ok(out)
+        }
+
+        /// Check that an existing archive is in the format of this build, before changing it.
+        async fn check_format(pool: &SqlitePool) -> anyhow::Result<()> {
+            let exists: bool = sqlx::query_scalar(
+                "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'metadata')",
+            )
+            .fetch_one(pool)
+            .await?;
+            if !exists {
+                return Ok(());
+            }
+            let version: Option<String> = sqlx::query_scalar("SELECT version FROM metadata")
+                .fetch_optional(pool)
+                .await?;
+            let Some(version) = version else {
+                return Ok(());
+            };
+            let written_by: Option<String> =
+                if has_metadata_column(pool, "reindexer_version").await? {
+                    sqlx::query_scalar("SELECT reindexer_version FROM metadata")
+                        .fetch_one(pool)
+                        .await?
+                } else {
+                    None
+                };
+            check_format_version(&version, written_by.as_deref())
+        }
+
+        /// Attempt to populate metadata, failing on a different chain.
         async fn populate_metadata(
             pool: &SqlitePool,
             chain_id: Option<&str>,
@@ -118,16 +730,13 @@ impl Storage {
             // to populate the chain id, in which case we expect it to already have been
             // initialized.
             if chain_id.is_none() && existing_metadata.is_none() {
-                anyhow::bail!("expected archive database to already be initialized");
+                anyhow::bail!(Failure::new(
+                    ErrorKind::CorruptArchive,
+                    "expected archive database to already be initialized"
+                ));
             }
             match existing_metadata {
                 Some((version, archive_chain_id)) => {
-                    anyhow::ensure!(
-                        version == VERSION,
-                        "expected version '{}' found '{}'",
-                        VERSION,
-                        version
-                    );
                     if let Some(chain_id) = chain_id {
                         anyhow::ensure!(
                             archive_chain_id == chain_id,
@@ -135,46 +744,277 @@ impl Storage {
                             chain_id,
                             archive_chain_id
                         );
+                        // Blocks are only ever written in the current format, which the
+                        // archive has to say before any are.
+                        if version != VERSION {
+                            sqlx::query("UPDATE metadata SET version = ?")
+                                .bind(VERSION)
+                                .execute(pool)
+                                .await?;
+                        }
                     }
                 }
                 None => {
-                    sqlx::query("INSERT INTO metadata (id, version, chain_id) VALUES (0, ?, ?)")
-                        .bind(VERSION)
-                        .bind(chain_id)
-                        .execute(pool)
-                        .await?;
+                    sqlx::query(
+                        "INSERT INTO metadata (id, version, chain_id, reindexer_version) VALUES (0, ?, ?, ?)",
+                    )
+                    .bind(VERSION)
+                    .bind(chain_id)
+                    .bind(REINDEXER_VERSION)
+                    .execute(pool)
+                    .await?;
                 }
             }
 
             Ok(())
         }
 
-        create_tables(&self.pool).await?;
+        // Checking the format is the first thing to read the file, and fails if it isn't sqlite.
+        // An archive of another format is left as it is, rather than having tables added to it.
+        check_format(&self.pool)
+            .await
+            .map_err(|e| match ErrorKind::of(&e) {
+                Some(_) => e,
+                None => e.context(Failure::new(
+                    ErrorKind::CorruptArchive,
+                    "failed to read the version of the archive, which may not be an archive at all",
+                )),
+            })?;
+        create_tables(&self.pool).await.context(Failure::new(
+            ErrorKind::CorruptArchive,
+            "failed to set up the tables of the archive, which may not be an archive at all",
+        ))?;
         populate_metadata(&self.pool, chain_id).await?;
 
         Ok(())
     }
 
     /// Create a new storage instance.
-    #[tracing::instrument(skip_all)]
     pub async fn new(
         path: Option<&dyn AsRef<Path>>,
         chain_id: Option<&str>,
+    ) -> anyhow::Result<Self> {
+        Self::with_key(path, chain_id, None).await
+    }
+
+    /// Create a new storage instance, encrypted at rest with a key, if one is given.
+    ///
+    /// A new archive is encrypted with the key, and an existing one has to have been encrypted
+    /// with the same key, failing with [ErrorKind::WrongArchiveKey] otherwise.
+    #[tracing::instrument(skip_all)]
+    pub async fn with_key(
+        path: Option<&dyn AsRef<Path>>,
+        chain_id: Option<&str>,
+        key: Option<&ArchiveKey>,
     ) -> anyhow::Result<Self> {
         let path = path.map(|x| x.as_ref());
         tracing::debug!(
             path = path.map(|x| x.to_string_lossy().to_string()),
+            encrypted = key.is_some(),
             "initializing archive database"
         );
-        let out = Self {
-            pool: create_pool(path).await?,
+        anyhow::ensure!(
+            key.is_none() || cfg!(feature = "sqlcipher"),
+            "this build of the reindexer can't encrypt archives; build it with `--features sqlcipher`"
+        );
+        // A database that won't decrypt reads like one that isn't a database at all, so that's
+        // told apart by whether there's a key, and whether it starts like a plain database.
+        let undecryptable = |e: anyhow::Error| match path {
+            Some(path) if path.is_file() && is_not_a_database(&e) => match key {
+                Some(_) => e.context(Failure::new(
+                    ErrorKind::WrongArchiveKey,
+                    format!(
+                        "failed to decrypt the archive '{}': \
+                         the key is wrong, or the archive isn't encrypted",
+                        path.display()
+                    ),
+                )),
+                None if looks_encrypted(path) => e.context(Failure::new(
+                    ErrorKind::CorruptArchive,
+                    format!(
+                        "the archive '{}' isn't a plain sqlite database; \
+                         if it's encrypted, pass its key with --encryption-key or --key-file",
+                        path.display()
+                    ),
+                )),
+                None => e,
+            },
+            _ => e,
         };
+        // Connecting may already read a file which is there, failing if it isn't sqlite.
+        let pool = create_pool(path, key)
+            .await
+            .map_err(|e| match path {
+                Some(path) if path.is_file() => e.context(Failure::new(
+                    ErrorKind::CorruptArchive,
+                    format!("failed to open the archive '{}'", path.display()),
+                )),
+                _ => e,
+            })
+            .map_err(undecryptable)?;
+        let out = Self { pool };
 
-        out.init(chain_id).await?;
+        out.init(chain_id).await.map_err(undecryptable)?;
 
         Ok(out)
     }
 
+    /// Get the archive ready to be written to, which its lock has to be held for.
+    ///
+    /// This rolls back what a crash left half-written, and fills in what older versions didn't
+    /// keep, so that merely reading an archive never changes it, nor races the run holding the lock.
+    pub(crate) async fn prepare_for_writing(&self, _lock: &FileLock) -> anyhow::Result<()> {
+        /// Fill in the transaction count and time of blocks archived before we kept track of them.
+        async fn backfill_block_fields(pool: &SqlitePool) -> anyhow::Result<()> {
+            const BATCH_SIZE: i64 = 1000;
+
+            let mut after = -1i64;
+            loop {
+                let rows: Vec<(i64, Vec<u8>)> = sqlx::query_as(
+                    "SELECT height, data FROM blocks JOIN blobs ON data_id = blobs.rowid WHERE (num_txs IS NULL OR time IS NULL) AND height > ? ORDER BY height LIMIT ?",
+                )
+                .bind(after)
+                .bind(BATCH_SIZE)
+                .fetch_all(pool)
+                .await?;
+                let Some((last, _)) = rows.last() else {
+                    return Ok(());
+                };
+                after = *last;
+                let mut tx = pool.begin().await?;
+                for (height, data) in rows {
+                    // A broken block shouldn't make the archive impossible to open, or to verify.
+                    let fields = expand_stored_block(data)
+                        .and_then(|data| Block::decode(&data))
+                        .and_then(|block| Ok((i64::try_from(block.num_txs())?, block.time()?)));
+                    let (num_txs, time) = match fields {
+                        Ok(fields) => fields,
+                        Err(e) => {
+                            tracing::warn!(
+                                height,
+                                "failed to read the transactions and time of block: {:#}",
+                                e
+                            );
+                            continue;
+                        }
+                    };
+                    sqlx::query("UPDATE blocks SET num_txs = ?, time = ? WHERE height = ?")
+                        .bind(num_txs)
+                        .bind(time)
+                        .bind(height)
+                        .execute(tx.as_mut())
+                        .await?;
+                }
+                tx.commit().await?;
+                tracing::debug!(
+                    "backfilled transaction counts and times up to height {}",
+                    after
+                );
+            }
+        }
+
+        /// Roll back blocks whose insert didn't make it into the archive intact.
+        ///
+        /// Writes aren't synchronous, so a crash can leave the last block of an archive
+        /// half-written: a block row without its data, or with data that's been cut short.
+        /// Archival then fails on that block, or worse, resumes after it.
+        async fn recover_incomplete_blocks(pool: &SqlitePool) -> anyhow::Result<()> {
+            let committed: Option<i64> = sqlx::query_scalar("SELECT height FROM committed")
+                .fetch_optional(pool)
+                .await?;
+            let last: Option<i64> = sqlx::query_scalar("SELECT MAX(height) FROM blocks")
+                .fetch_one(pool)
+                .await?;
+            let Some(last) = last else {
+                return Ok(());
+            };
+            // Archives from before the committed height was kept can only have a broken final block.
+            let after = committed.unwrap_or(last - 1);
+
+            let rows: Vec<(i64, i64, Option<i64>, Option<Vec<u8>>)> = sqlx::query_as(
+                "SELECT height, data_id, num_txs, data FROM blocks LEFT JOIN blobs ON data_id = blobs.rowid WHERE height > ? ORDER BY height",
+            )
+            .bind(after)
+            .fetch_all(pool)
+            .await?;
+            let mut tx = pool.begin().await?;
+            for (height, data_id, num_txs, data) in rows {
+                let problem = match data.map(|x| Block::decode(&expand_stored_block(x)?)) {
+                    None => Some("its data is missing".to_owned()),
+                    Some(Err(e)) => Some(format!("its data doesn't decode: {:#}", e)),
+                    Some(Ok(block)) if i64::try_from(block.height())? != height => {
+                        Some(format!("its data is for height {}", block.height()))
+                    }
+                    Some(Ok(block)) if num_txs.is_some_and(|x| x != block.num_txs() as i64) => {
+                        Some("its transaction count doesn't match its data".to_owned())
+                    }
+                    Some(Ok(_)) => None,
+                };
+                let Some(problem) = problem else {
+                    continue;
+                };
+                tracing::warn!(
+                    height,
+                    "rolling back incompletely archived block, as {}",
+                    problem
+                );
+                sqlx::query("DELETE FROM blocks WHERE height = ?")
+                    .bind(height)
+                    .execute(tx.as_mut())
+                    .await?;
+                sqlx::query("DELETE FROM blobs WHERE rowid = ?")
+                    .bind(data_id)
+                    .execute(tx.as_mut())
+                    .await?;
+                sqlx::query("DELETE FROM blobs WHERE rowid IN (SELECT data_id FROM extended_commits WHERE height = ?)")
+                    .bind(height)
+                    .execute(tx.as_mut())
+                    .await?;
+                sqlx::query("DELETE FROM extended_commits WHERE height = ?")
+                    .bind(height)
+                    .execute(tx.as_mut())
+                    .await?;
+                sqlx::query("DELETE FROM blobs WHERE rowid IN (SELECT data_id FROM evidence WHERE height = ?)")
+                    .bind(height)
+                    .execute(tx.as_mut())
+                    .await?;
+                sqlx::query("DELETE FROM evidence WHERE height = ?")
+                    .bind(height)
+                    .execute(tx.as_mut())
+                    .await?;
+            }
+
+            // Data is inserted before the row pointing to it, so data past what any row points to
+            // was left behind by an insert that never finished.
+            let orphans = sqlx::query(
+                "DELETE FROM blobs WHERE rowid > (SELECT COALESCE(MAX(data_id), 0) FROM (SELECT data_id FROM blocks UNION ALL SELECT data_id FROM geneses UNION ALL SELECT data_id FROM extended_commits UNION ALL SELECT data_id FROM evidence))",
+            )
+            .execute(tx.as_mut())
+            .await?
+            .rows_affected();
+            if orphans > 0 {
+                tracing::warn!("removed {} incompletely archived blobs", orphans);
+            }
+
+            let last: Option<i64> = sqlx::query_scalar("SELECT MAX(height) FROM blocks")
+                .fetch_one(tx.as_mut())
+                .await?;
+            if let Some(last) = last {
+                sqlx::query(
+                    "INSERT INTO committed (id, height) VALUES (0, ?) ON CONFLICT (id) DO UPDATE SET height = excluded.height",
+                )
+                .bind(last)
+                .execute(tx.as_mut())
+                .await?;
+            }
+            tx.commit().await?;
+            Ok(())
+        }
+
+        recover_incomplete_blocks(&self.pool).await?;
+        backfill_block_fields(&self.pool).await
+    }
+
     /// The version of the storage.
     ///
     /// Different versions will be incompatible, requiring a data migration.
@@ -186,6 +1026,16 @@ impl Storage {
         Ok(out)
     }
 
+    /// The version of the reindexer which created this archive, if that's known.
+    ///
+    /// Archives created before this was recorded don't know it.
+    pub async fn reindexer_version(&self) -> anyhow::Result<Option<String>> {
+        let (out,) = sqlx::query_as("SELECT reindexer_version FROM metadata")
+            .fetch_one(&self.pool)
+            .await?;
+        Ok(out)
+    }
+
     /// Get the chain id embedded in this archive format.
     pub async fn chain_id(&self) -> anyhow::Result<String> {
         let (out,) = sqlx::query_as("SELECT chain_id FROM metadata")
@@ -194,49 +1044,134 @@ impl Storage {
         Ok(out)
     }
 
-    /// Put a block into storage.
-    ///
-    /// This will fail if a block at that height already exists.
-    pub async fn put_block(&self, block: &Block) -> anyhow::Result<()> {
-        let height = block.height();
-
-        let mut tx = self.pool.begin().await?;
-
-        let exists: Option<_> = sqlx::query("SELECT 1 FROM blocks WHERE height = ?")
-            .bind(i64::try_from(height)?)
-            .fetch_optional(tx.as_mut())
+    /// Whether the blocks in this archive were archived without the signatures of their commits,
+    /// as by `archive --no-commit`, which leaves the archive unusable for regeneration.
+    pub async fn without_commits(&self) -> anyhow::Result<bool> {
+        let (out,) = sqlx::query_as("SELECT without_commits FROM metadata")
+            .fetch_one(&self.pool)
             .await?;
-        anyhow::ensure!(
-            exists.is_none(),
-            "block at height {} already exists",
-            height
-        );
+        Ok(out)
+    }
 
-        let (data_id,): (i64,) =
-            sqlx::query_as("INSERT INTO blobs(data) VALUES (?) RETURNING rowid")
-                .bind(block.encode())
-                .fetch_one(tx.as_mut())
-                .await?;
-        sqlx::query("INSERT INTO blocks(height, data_id) VALUES (?, ?)")
-            .bind(i64::try_from(height)?)
-            .bind(data_id)
-            .execute(tx.as_mut())
+    /// Record whether the blocks in this archive are kept without the signatures of their commits.
+    ///
+    /// This can only change while the archive has no blocks, so that its blocks are either
+    /// all with their commits, or all without them.
+    pub async fn set_without_commits(&self, without_commits: bool) -> anyhow::Result<()> {
+        if self.without_commits().await? == without_commits {
+            return Ok(());
+        }
+        if self.last_height().await?.is_some() {
+            anyhow::bail!(if without_commits {
+                "the archive has blocks with their commits, which blocks without them can't be added to"
+            } else {
+                "the archive has blocks without their commits, as made by `archive --no-commit`, which blocks with them can't be added to"
+            });
+        }
+        sqlx::query("UPDATE metadata SET without_commits = ?")
+            .bind(without_commits)
+            .execute(&self.pool)
             .await?;
+        Ok(())
+    }
+
+    /// Put a block into storage.
+    ///
+    /// This will fail if a block at that height already exists.
+    pub async fn put_block(&self, block: &Block) -> anyhow::Result<()> {
+        self.put_encoded_block(
+            block.height(),
+            &block.encode(),
+            block.num_txs(),
+            block.time()?,
+            None,
+        )
+        .await
+    }
 
+    /// Put an already encoded block into storage, at a given height, with the number
+    /// of transactions it contains, and its time, as given by [`Block::time`].
+    ///
+    /// The encoded extended commit for the height, with its vote extensions, is stored
+    /// along with the block, if given.
+    ///
+    /// Blocks without transactions are stored compactly, but read back exactly as given.
+    ///
+    /// Like [`Self::put_block`], this will fail if a block at that height already exists.
+    pub async fn put_encoded_block(
+        &self,
+        height: u64,
+        data: &[u8],
+        num_txs: usize,
+        time: i64,
+        extended_commit: Option<&[u8]>,
+    ) -> anyhow::Result<()> {
+        let mut tx = self.pool.begin().await?;
+        insert_block(tx.as_mut(), height, data, num_txs, time, extended_commit).await?;
         tx.commit().await?;
         Ok(())
     }
 
+    /// Start a batch of blocks, to be put into storage together, in a single transaction.
+    ///
+    /// Committing each block on its own is slow, so archival puts blocks in batches instead.
+    /// None of the blocks in a batch are visible until it's committed, and dropping a batch
+    /// without committing it leaves the archive as it was before the batch started.
+    pub async fn begin_batch(&self) -> anyhow::Result<BlockBatch> {
+        Ok(BlockBatch {
+            tx: self.pool.begin().await?,
+            len: 0,
+        })
+    }
+
+    /// Get the encoded extended commit archived for a given height.
+    ///
+    /// This will return `None` if there's none, as for any height before cometbft 0.38.
+    pub async fn get_extended_commit(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        let data: Option<(Vec<u8>,)> = sqlx::query_as(
+            "SELECT (data) FROM extended_commits JOIN blobs ON data_id = blobs.rowid WHERE height = ?",
+        )
+        .bind(i64::try_from(height)?)
+        .fetch_optional(&self.pool)
+        .await?;
+        Ok(data.map(|x| x.0))
+    }
+
+    /// Put the encoded evidence committed in the block at a given height into storage.
+    ///
+    /// The block stays the authority on its evidence, which it contains as well.
+    pub async fn put_evidence(&self, height: u64, evidence: &[u8]) -> anyhow::Result<()> {
+        let mut tx = self.pool.begin().await?;
+        insert_evidence(tx.as_mut(), height, evidence).await?;
+        tx.commit().await?;
+        Ok(())
+    }
+
+    /// Get the encoded evidence archived for a given height, as an `EvidenceList`.
+    ///
+    /// This will return `None` if there's none, as for most heights, or if the archive was
+    /// made without `--with-evidence`, in which case the block is the only place to look.
+    pub async fn get_evidence(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        let data: Option<(Vec<u8>,)> = sqlx::query_as(
+            "SELECT (data) FROM evidence JOIN blobs ON data_id = blobs.rowid WHERE height = ?",
+        )
+        .bind(i64::try_from(height)?)
+        .fetch_optional(&self.pool)
+        .await?;
+        Ok(data.map(|x| x.0))
+    }
+
     /// Put a genesis into storage.
     pub async fn put_genesis(&self, genesis: &Genesis) -> anyhow::Result<()> {
         let initial_height = genesis.initial_height();
 
         let mut tx = self.pool.begin().await?;
 
-        let exists: Option<_> = sqlx::query("SELECT 1 FROM geneses WHERE initial_height = ?")
-            .bind(i64::try_from(initial_height)?)
-            .fetch_optional(tx.as_mut())
-            .await?;
+        let exists: Option<_> =
+            sqlx::query("SELECT 1 FROM geneses WHERE max(initial_height, 1) = ?")
+                .bind(i64::try_from(initial_height)?)
+                .fetch_optional(tx.as_mut())
+                .await?;
         if exists.is_some() {
             tracing::info!(
                 "genesis with initial_height {} already exists, skipping archival",
@@ -264,7 +1199,7 @@ impl Storage {
     #[allow(dead_code)]
     pub async fn get_genesis(&self, initial_height: u64) -> anyhow::Result<Option<Genesis>> {
         let data: Option<(Vec<u8>,)> = sqlx::query_as(
-            "SELECT (data) FROM geneses JOIN blobs ON data_id = blobs.rowid WHERE initial_height = ?",
+            "SELECT (data) FROM geneses JOIN blobs ON data_id = blobs.rowid WHERE max(initial_height, 1) = ?",
         )
         .bind(i64::try_from(initial_height)?)
         .fetch_optional(&self.pool)
@@ -272,19 +1207,36 @@ impl Storage {
         data.map(|x| Genesis::decode(&x.0)).transpose()
     }
 
+    /// Get the initial heights of every genesis in storage, in ascending order.
+    ///
+    /// Archives written before initial heights were normalized, as [Genesis::initial_height]
+    /// does, can hold a genesis under 0, for a chain starting at 1. Geneses are looked up by
+    /// their normalized heights, so such a genesis is found at 1, as it would be today.
+    pub async fn genesis_initial_heights(&self) -> anyhow::Result<Vec<u64>> {
+        let heights: Vec<(i64,)> = sqlx::query_as(
+            "SELECT DISTINCT max(initial_height, 1) AS height FROM geneses ORDER BY height",
+        )
+        .fetch_all(&self.pool)
+        .await?;
+        heights
+            .into_iter()
+            .map(|(x,)| u64::try_from(x).map_err(Into::into))
+            .collect()
+    }
+
     pub async fn genesis_does_exist(&self, initial_height: u64) -> anyhow::Result<bool> {
-        let exists: bool =
-            sqlx::query_scalar("SELECT EXISTS(SELECT 1 FROM geneses WHERE initial_height = ?)")
-                .bind(i64::try_from(initial_height)?)
-                .fetch_one(&self.pool)
-                .await?;
+        let exists: bool = sqlx::query_scalar(
+            "SELECT EXISTS(SELECT 1 FROM geneses WHERE max(initial_height, 1) = ?)",
+        )
+        .bind(i64::try_from(initial_height)?)
+        .fetch_one(&self.pool)
+        .await?;
         Ok(exists)
     }
 
     /// Get a block from storage.
     ///
     /// This will return [Option::None] if there's no such block.
-    #[allow(dead_code)]
     pub async fn get_block(&self, height: u64) -> anyhow::Result<Option<Block>> {
         let data: Option<(Vec<u8>,)> = sqlx::query_as(
             "SELECT (data) FROM blocks JOIN blobs ON data_id = blobs.rowid WHERE height = ?",
@@ -292,7 +1244,106 @@ impl Storage {
         .bind(i64::try_from(height)?)
         .fetch_optional(&self.pool)
         .await?;
-        data.map(|x| Block::decode(&x.0)).transpose()
+        data.map(|x| {
+            Block::decode(&expand_stored_block(x.0)?).with_context(|| {
+                Failure::new(
+                    ErrorKind::CorruptArchive,
+                    format!(
+                        "the block at height {} in the archive doesn't decode",
+                        height
+                    ),
+                )
+            })
+        })
+        .transpose()
+    }
+
+    /// Get a block from storage, without decoding it.
+    pub async fn get_encoded_block(&self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        let data: Option<(Vec<u8>,)> = sqlx::query_as(
+            "SELECT (data) FROM blocks JOIN blobs ON data_id = blobs.rowid WHERE height = ?",
+        )
+        .bind(i64::try_from(height)?)
+        .fetch_optional(&self.pool)
+        .await?;
+        data.map(|x| expand_stored_block(x.0)).transpose()
+    }
+
+    /// Get the number of transactions in the block at a given height, without decoding it.
+    ///
+    /// This will return [Option::None] if there's no such block, or if its count isn't known,
+    /// because it couldn't be decoded when the count was backfilled.
+    pub async fn get_num_txs(&self, height: u64) -> anyhow::Result<Option<usize>> {
+        let num_txs: Option<(Option<i64>,)> =
+            sqlx::query_as("SELECT num_txs FROM blocks WHERE height = ?")
+                .bind(i64::try_from(height)?)
+                .fetch_optional(&self.pool)
+                .await?;
+        Ok(num_txs
+            .and_then(|x| x.0)
+            .map(|x| x.try_into())
+            .transpose()?)
+    }
+
+    /// Get the time of the block at a given height, as given by [`Block::time`], without decoding it.
+    ///
+    /// Like [`Self::get_num_txs`], this will return [Option::None] if there's no such block,
+    /// or if its time isn't known.
+    pub async fn get_block_time(&self, height: u64) -> anyhow::Result<Option<i64>> {
+        let time: Option<(Option<i64>,)> =
+            sqlx::query_as("SELECT time FROM blocks WHERE height = ?")
+                .bind(i64::try_from(height)?)
+                .fetch_optional(&self.pool)
+                .await?;
+        Ok(time.and_then(|x| x.0))
+    }
+
+    /// Find the height of the block whose time is closest to a given time.
+    ///
+    /// Times are in nanoseconds since the unix epoch, like [`Block::time`].
+    /// Between two blocks equally close, the lower one is chosen.
+    /// This will return [Option::None] if no block has a known time.
+    pub async fn nearest_height(&self, time: i64) -> anyhow::Result<Option<u64>> {
+        // Only the closest block on either side is a candidate, which the index finds quickly.
+        let height: Option<i64> = sqlx::query_scalar(
+            r#"
+            SELECT height FROM (
+                SELECT * FROM (
+                    SELECT height, time FROM blocks WHERE time <= ?
+                    ORDER BY time DESC, height LIMIT 1
+                )
+                UNION ALL
+                SELECT * FROM (
+                    SELECT height, time FROM blocks WHERE time >= ?
+                    ORDER BY time, height LIMIT 1
+                )
+            )
+            ORDER BY ABS(time - ?), height
+            LIMIT 1
+            "#,
+        )
+        .bind(time)
+        .bind(time)
+        .bind(time)
+        .fetch_optional(&self.pool)
+        .await?;
+        Ok(height.map(|x| x.try_into()).transpose()?)
+    }
+
+    /// Stream every block in storage, in ascending order of height, along with its height.
+    ///
+    /// The blocks aren't decoded, so that callers can decide what to do with broken ones.
+    pub fn stream_encoded_blocks(
+        &self,
+    ) -> impl Stream<Item = anyhow::Result<(u64, Vec<u8>)>> + Send + Unpin + '_ {
+        sqlx::query_as::<_, (i64, Vec<u8>)>(
+            "SELECT height, data FROM blocks JOIN blobs ON data_id = blobs.rowid ORDER BY height",
+        )
+        .fetch(&self.pool)
+        .map(|row| {
+            let (height, data) = row?;
+            Ok((u64::try_from(height)?, expand_stored_block(data)?))
+        })
     }
 
     pub async fn block_does_exist(&self, height: u64) -> anyhow::Result<bool> {
@@ -304,8 +1355,130 @@ impl Storage {
         Ok(exists)
     }
 
+    /// Get the number of blocks in storage, along with the total and largest size of their data.
+    ///
+    /// This is the size of the data as stored, which is smaller than their encoding for empty blocks.
+    pub async fn block_sizes(&self) -> anyhow::Result<(u64, u64, u64)> {
+        let (count, total, max): (i64, i64, i64) = sqlx::query_as(
+            "SELECT COUNT(*), COALESCE(SUM(LENGTH(data)), 0), COALESCE(MAX(LENGTH(data)), 0) FROM blocks JOIN blobs ON data_id = blobs.rowid",
+        )
+        .fetch_one(&self.pool)
+        .await?;
+        Ok((count.try_into()?, total.try_into()?, max.try_into()?))
+    }
+
+    /// Get a fingerprint of the blocks between two heights, inclusive, without reading their data.
+    ///
+    /// This changes whenever a block in that range is added, removed, or stored again, so it's
+    /// a cheap way to tell whether a copy of those blocks taken earlier is still up to date.
+    pub async fn fingerprint(&self, first: u64, last: u64) -> anyhow::Result<String> {
+        use sha2::{Digest, Sha256};
+        let mut rows = sqlx::query_as::<_, (i64, i64, i64, Option<i64>, Option<i64>)>(
+            "SELECT height, data_id, LENGTH(data), num_txs, time FROM blocks JOIN blobs ON data_id = blobs.rowid WHERE height BETWEEN ? AND ? ORDER BY height",
+        )
+        .bind(i64::try_from(first)?)
+        .bind(i64::try_from(last)?)
+        .fetch(&self.pool);
+        let mut hasher = Sha256::new();
+        while let Some((height, data_id, len, num_txs, time)) = rows.try_next().await? {
+            for x in [
+                height,
+                data_id,
+                len,
+                num_txs.unwrap_or(-1),
+                time.unwrap_or(-1),
+            ] {
+                hasher.update(x.to_le_bytes());
+            }
+        }
+        Ok(hex::encode(hasher.finalize()))
+    }
+
+    /// Get the ranges of heights missing between the lowest and highest blocks in storage.
+    ///
+    /// Each range is inclusive, in ascending order.
+    pub async fn gaps(&self) -> anyhow::Result<Vec<(u64, u64)>> {
+        let gaps: Vec<(i64, i64)> = sqlx::query_as(
+            r#"
+            WITH numbered_blocks AS (
+                SELECT height, LEAD(height) OVER (ORDER BY height) AS next_height
+                FROM blocks
+            )
+            SELECT height + 1, next_height - 1
+            FROM numbered_blocks
+            WHERE next_height - height > 1
+            ORDER BY height
+            "#,
+        )
+        .fetch_all(&self.pool)
+        .await?;
+        gaps.into_iter()
+            .map(|(start, end)| Ok((start.try_into()?, end.try_into()?)))
+            .collect()
+    }
+
+    /// Remove every block above a height, leaving a shorter archive ending at or below it.
+    ///
+    /// Extended commits and evidence above the height go along with their blocks, as do geneses of chains
+    /// starting above it, which no longer have any blocks to start. The committed height is
+    /// brought down to the new last block, so the archive reads as if archival stopped there.
+    /// This all happens in a single transaction, returning how many blocks were removed.
+    pub async fn truncate(&self, max_height: u64) -> anyhow::Result<u64> {
+        let max_height = i64::try_from(max_height)?;
+        let mut tx = self.pool.begin().await?;
+        sqlx::query("DELETE FROM blobs WHERE rowid IN (SELECT data_id FROM blocks WHERE height > ? UNION ALL SELECT data_id FROM extended_commits WHERE height > ? UNION ALL SELECT data_id FROM evidence WHERE height > ? UNION ALL SELECT data_id FROM geneses WHERE initial_height > ?)")
+            .bind(max_height)
+            .bind(max_height)
+            .bind(max_height)
+            .bind(max_height)
+            .execute(tx.as_mut())
+            .await?;
+        let removed = sqlx::query("DELETE FROM blocks WHERE height > ?")
+            .bind(max_height)
+            .execute(tx.as_mut())
+            .await?
+            .rows_affected();
+        sqlx::query("DELETE FROM extended_commits WHERE height > ?")
+            .bind(max_height)
+            .execute(tx.as_mut())
+            .await?;
+        sqlx::query("DELETE FROM evidence WHERE height > ?")
+            .bind(max_height)
+            .execute(tx.as_mut())
+            .await?;
+        sqlx::query("DELETE FROM geneses WHERE initial_height > ?")
+            .bind(max_height)
+            .execute(tx.as_mut())
+            .await?;
+        let last: Option<i64> = sqlx::query_scalar("SELECT MAX(height) FROM blocks")
+            .fetch_one(tx.as_mut())
+            .await?;
+        match last {
+            Some(last) => {
+                sqlx::query("UPDATE committed SET height = ?")
+                    .bind(last)
+                    .execute(tx.as_mut())
+                    .await?;
+            }
+            None => {
+                sqlx::query("DELETE FROM committed")
+                    .execute(tx.as_mut())
+                    .await?;
+            }
+        }
+        tx.commit().await?;
+        Ok(removed)
+    }
+
+    /// Get the lowest known block in the storage.
+    pub async fn first_height(&self) -> anyhow::Result<Option<u64>> {
+        let height: Option<(Option<i64>,)> = sqlx::query_as("SELECT MIN(height) FROM blocks")
+            .fetch_optional(&self.pool)
+            .await?;
+        Ok(height.and_then(|x| x.0).map(|x| x.try_into()).transpose()?)
+    }
+
     /// Get the highest known block in the storage.
-    #[allow(dead_code)]
     pub async fn last_height(&self) -> anyhow::Result<Option<u64>> {
         let height: Option<(i64,)> = sqlx::query_as("SELECT MAX(height) FROM blocks")
             .fetch_optional(&self.pool)
@@ -333,6 +1506,193 @@ mod test {
         Ok(())
     }
 
+    #[test]
+    fn test_format_versions() {
+        check_format_version(VERSION, None).expect("this build should read its own archives");
+        check_format_version("penumbra-reindexer-archive-v1", None)
+            .expect("this build should read archives from before empty blocks were compact");
+        let err = check_format_version("penumbra-reindexer-archive-v3", Some("9.9.9"))
+            .expect_err("an archive of a later format shouldn't be read");
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::IncompatibleArchive));
+        assert_eq!(
+            err.to_string(),
+            "archive format v3, this build supports v1 to v2 (the archive was written by penumbra-reindexer 9.9.9); upgrade the reindexer to read it"
+        );
+        let err = check_format_version("penumbra-reindexer-archive-v0", None)
+            .expect_err("an archive of an earlier format shouldn't be read");
+        assert!(
+            err.to_string()
+                .starts_with("archive format v0, this build supports v1 to v2;"),
+            "{:#}",
+            err
+        );
+        for version in [
+            "penumbra-reindexer-archive-v",
+            "penumbra-reindexer-archive-vx",
+            "",
+        ] {
+            let err = check_format_version(version, None)
+                .expect_err("an archive of an unknown version shouldn't be read");
+            assert_eq!(ErrorKind::of(&err), Some(ErrorKind::CorruptArchive));
+        }
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_of_future_format_is_refused() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-format-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        // An archive of the current format opens, and records what created it.
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            storage.put_block(&Block::test_value_at_height(1)).await?;
+        }
+        let storage = Storage::new(Some(&path), None).await?;
+        assert_eq!(
+            storage.reindexer_version().await?.as_deref(),
+            Some(REINDEXER_VERSION)
+        );
+        assert_eq!(storage.last_height().await?, Some(1));
+        sqlx::query(
+            "UPDATE metadata SET version = 'penumbra-reindexer-archive-v3', reindexer_version = '9.9.9'",
+        )
+        .execute(&storage.pool)
+        .await?;
+        drop(storage);
+
+        for chain_id in [None, Some(CHAIN_ID)] {
+            let err = Storage::new(Some(&path), chain_id)
+                .await
+                .expect_err("an archive of a later format shouldn't open");
+            assert_eq!(crate::error::exit_code(&err), 10);
+            assert!(
+                err.to_string()
+                    .starts_with("archive format v3, this build supports v1 to v2 (the archive was written by penumbra-reindexer 9.9.9)"),
+                "{:#}",
+                err
+            );
+        }
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    /// The version in the header of the archive at a path, read straight from the file.
+    async fn archive_header(path: &Path) -> anyhow::Result<String> {
+        let pool = SqlitePool::connect_with(SqliteConnectOptions::new().filename(path)).await?;
+        let version = sqlx::query_scalar("SELECT version FROM metadata")
+            .fetch_one(&pool)
+            .await?;
+        pool.close().await;
+        Ok(version)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_formats_on_disk() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-format-on-disk-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        let blocks = [
+            Block::test_value_at_height(1),
+            Block::test_value_with_transactions(2, vec![vec![1, 2, 3]]),
+        ];
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            for block in &blocks {
+                storage.put_block(block).await?;
+            }
+        }
+        assert_eq!(
+            archive_header(&path).await?,
+            "penumbra-reindexer-archive-v2"
+        );
+
+        // A v2 archive reads back, compact empty blocks and all.
+        {
+            let storage = Storage::new(Some(&path), None).await?;
+            for block in &blocks {
+                assert_eq!(
+                    storage.get_block(block.height()).await?.as_ref(),
+                    Some(block)
+                );
+            }
+        }
+
+        // One whose header says v3 is refused, and left as it is.
+        {
+            let pool =
+                SqlitePool::connect_with(SqliteConnectOptions::new().filename(&path)).await?;
+            sqlx::query("UPDATE metadata SET version = 'penumbra-reindexer-archive-v3'")
+                .execute(&pool)
+                .await?;
+            pool.close().await;
+        }
+        for chain_id in [None, Some(CHAIN_ID)] {
+            let err = Storage::new(Some(&path), chain_id)
+                .await
+                .expect_err("an archive of format v3 shouldn't open");
+            assert_eq!(ErrorKind::of(&err), Some(ErrorKind::IncompatibleArchive));
+            assert!(
+                err.to_string()
+                    .starts_with("archive format v3, this build supports v1 to v2"),
+                "{:#}",
+                err
+            );
+        }
+        assert_eq!(
+            archive_header(&path).await?,
+            "penumbra-reindexer-archive-v3"
+        );
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_v1_archive_moves_to_v2_when_written() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-format-v1-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        // A v1 archive has every block in full, which is a block with transactions here.
+        let full = Block::test_value_with_transactions(1, vec![vec![1, 2, 3]]);
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            storage.put_block(&full).await?;
+            sqlx::query("UPDATE metadata SET version = 'penumbra-reindexer-archive-v1'")
+                .execute(&storage.pool)
+                .await?;
+        }
+
+        // Reading it leaves it as it is.
+        {
+            let storage = Storage::new(Some(&path), None).await?;
+            assert_eq!(storage.version().await?, "penumbra-reindexer-archive-v1");
+            assert_eq!(storage.get_block(1).await?.as_ref(), Some(&full));
+        }
+
+        // Writing to it moves it to v2, before any compact block goes in.
+        let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        assert_eq!(storage.version().await?, VERSION);
+        let empty = Block::test_value_at_height(2);
+        storage.put_block(&empty).await?;
+        assert!(usize::try_from(stored_size(&storage, 2).await?)? < empty.encode().len());
+        assert_eq!(storage.get_block(1).await?.as_ref(), Some(&full));
+        assert_eq!(storage.get_block(2).await?.as_ref(), Some(&empty));
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
     #[tokio::test(flavor = "multi_thread")]
     async fn test_storage_can_get_chain_id() -> anyhow::Result<()> {
         assert_eq!(
@@ -376,6 +1736,273 @@ mod test {
         Ok(())
     }
 
+    #[test]
+    fn test_block_evidence_is_found() {
+        let block = Block::test_value_with_evidence(3);
+        let evidence = block_evidence(&block.encode()).expect("test block should have evidence");
+        assert!(!evidence.is_empty());
+        assert_eq!(
+            block_evidence(&Block::test_value_at_height(3).encode()),
+            None
+        );
+        assert_eq!(block_evidence(b"not a block"), None);
+    }
+
+    #[test]
+    fn test_commit_signatures_are_left_out() -> anyhow::Result<()> {
+        use prost::Message as _;
+        use tendermint_proto::v0_37::types::Commit as ProtoCommit;
+
+        let block = Block::test_value_at_height(2).encode();
+        // A message field appearing again is merged into it, so this adds three absent votes
+        // to the last commit, which the test block has no signatures in.
+        let mut data = block.clone();
+        for _ in 0..3 {
+            data.extend([(4 << 3) | 2, 4, (4 << 3) | 2, 2, 0x08, 0x01]);
+        }
+        let signatures = |data: &[u8]| -> anyhow::Result<(u64, usize)> {
+            let (height, commit) = Block::decode(data)?
+                .encoded_last_commit()
+                .expect("test block should have a last commit");
+            Ok((
+                height,
+                ProtoCommit::decode(commit.as_slice())?.signatures.len(),
+            ))
+        };
+        let (height, count) = signatures(&data)?;
+        assert_eq!(count, 3);
+
+        let stripped = without_commit_signatures(&data).expect("test block should be well formed");
+        assert!(stripped.len() < data.len());
+        assert_eq!(signatures(&stripped)?, (height, 0));
+        assert_eq!(Block::decode(&stripped)?.height(), 2);
+        assert_eq!(
+            without_commit_signatures(&block).as_deref(),
+            Some(block.as_slice())
+        );
+        assert_eq!(without_commit_signatures(b"not a block"), None);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_without_commits_is_kept_for_whole_archive() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        assert!(!storage.without_commits().await?);
+        storage.set_without_commits(true).await?;
+        assert!(storage.without_commits().await?);
+        storage.put_block(&Block::test_value_at_height(1)).await?;
+        // Saying the same thing again is fine, but blocks with commits can't join them.
+        storage.set_without_commits(true).await?;
+        assert!(storage.set_without_commits(false).await.is_err());
+        assert!(storage.without_commits().await?);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_evidence_is_truncated_with_blocks() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        for height in 1..=4 {
+            storage
+                .put_block(&Block::test_value_at_height(height))
+                .await?;
+        }
+        storage.put_evidence(2, b"evidence at 2").await?;
+        storage.put_evidence(4, b"evidence at 4").await?;
+        assert_eq!(
+            storage.get_evidence(2).await?.as_deref(),
+            Some(b"evidence at 2".as_slice())
+        );
+        assert_eq!(storage.get_evidence(3).await?, None);
+        storage.truncate(3).await?;
+        assert!(storage.get_evidence(2).await?.is_some());
+        assert_eq!(storage.get_evidence(4).await?, None);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_extended_commit_round_trip() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-extended-commit-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        let with = Block::test_value_at_height(1);
+        let without = Block::test_value_at_height(2);
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            storage
+                .put_encoded_block(
+                    1,
+                    &with.encode(),
+                    with.num_txs(),
+                    with.time()?,
+                    Some(b"extended commit"),
+                )
+                .await?;
+            storage.put_block(&without).await?;
+        }
+
+        let storage = Storage::new(Some(&path), None).await?;
+        assert_eq!(storage.get_block(1).await?, Some(with));
+        assert_eq!(storage.get_block(2).await?, Some(without));
+        assert_eq!(
+            storage.get_extended_commit(1).await?.as_deref(),
+            Some(b"extended commit".as_slice())
+        );
+        assert_eq!(storage.get_extended_commit(2).await?, None);
+        assert_eq!(storage.get_extended_commit(3).await?, None);
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[cfg(feature = "sqlcipher")]
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_encrypted_archive_needs_its_key() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-encrypted-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        let key = ArchiveKey::new("correct horse battery staple")?;
+        {
+            let storage = Storage::with_key(Some(&path), Some(CHAIN_ID), Some(&key)).await?;
+            storage.put_genesis(&Genesis::test_value()).await?;
+            storage.put_block(&Block::test_value_at_height(1)).await?;
+        }
+        // Nothing of the archive is left in the clear, not even the header of the database.
+        assert!(looks_encrypted(&path));
+
+        let storage = Storage::with_key(Some(&path), None, Some(&key)).await?;
+        assert_eq!(storage.chain_id().await?, CHAIN_ID);
+        assert_eq!(
+            storage.get_block(1).await?,
+            Some(Block::test_value_at_height(1))
+        );
+        drop(storage);
+
+        let wrong = ArchiveKey::new("incorrect horse")?;
+        let err = Storage::with_key(Some(&path), None, Some(&wrong))
+            .await
+            .expect_err("the wrong key shouldn't decrypt the archive");
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::WrongArchiveKey));
+        assert!(err.to_string().contains("the key is wrong"), "{:#}", err);
+
+        let err = Storage::new(Some(&path), None)
+            .await
+            .expect_err("the archive shouldn't open without its key");
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::CorruptArchive));
+        assert!(err.to_string().contains("--encryption-key"), "{:#}", err);
+        std::fs::remove_file(&path)?;
+
+        // An archive which isn't encrypted doesn't open with a key either.
+        Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        let err = Storage::with_key(Some(&path), None, Some(&key))
+            .await
+            .expect_err("a plain archive shouldn't open with a key");
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::WrongArchiveKey));
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[cfg(not(feature = "sqlcipher"))]
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_encryption_needs_sqlcipher() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-no-sqlcipher-{}.sqlite",
+            std::process::id()
+        ));
+        let key = ArchiveKey::new("correct horse battery staple")?;
+        let err = Storage::with_key(Some(&path), Some(CHAIN_ID), Some(&key))
+            .await
+            .expect_err("this build can't encrypt");
+        assert!(
+            err.to_string().contains("--features sqlcipher"),
+            "{:#}",
+            err
+        );
+        // Nothing was written in the clear instead.
+        assert!(!path.exists());
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_unreadable_archive_is_corrupt() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-corrupt-{}.sqlite",
+            std::process::id()
+        ));
+        std::fs::write(&path, "not an archive\n".repeat(1000))?;
+        let err = Storage::new(Some(&path), None)
+            .await
+            .expect_err("a file which isn't sqlite shouldn't open");
+        assert_eq!(crate::error::exit_code(&err), 4);
+        std::fs::remove_file(&path)?;
+
+        // Nor should an archive of a version we don't know.
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            sqlx::query("UPDATE metadata SET version = 'something-else'")
+                .execute(&storage.pool)
+                .await?;
+        }
+        let err = Storage::new(Some(&path), None)
+            .await
+            .expect_err("an archive of another version shouldn't open");
+        assert_eq!(ErrorKind::of(&err), Some(ErrorKind::CorruptArchive));
+        std::fs::remove_file(&path)?;
+
+        // A block which doesn't decode is a corrupt archive too, once it's read.
+        let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        storage.put_block(&Block::test_value_at_height(1)).await?;
+        sqlx::query("UPDATE blobs SET data = x'ffff' WHERE rowid = (SELECT data_id FROM blocks WHERE height = 1)")
+            .execute(&storage.pool)
+            .await?;
+        let err = storage
+            .get_block(1)
+            .await
+            .expect_err("a block which doesn't decode shouldn't be read");
+        assert_eq!(crate::error::exit_code(&err), 4);
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_archive_without_extended_commits_table() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-no-extended-commits-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        let block = Block::test_value();
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            storage.put_block(&block).await?;
+            // Make this look like an archive from before extended commits were kept.
+            sqlx::query("DROP TABLE extended_commits")
+                .execute(&storage.pool)
+                .await?;
+        }
+
+        let storage = Storage::new(Some(&path), None).await?;
+        assert_eq!(
+            storage.get_block(block.height()).await?,
+            Some(block.clone())
+        );
+        assert_eq!(storage.get_extended_commit(block.height()).await?, None);
+        assert_eq!(count_blobs(&storage).await?, 1);
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
     #[tokio::test(flavor = "multi_thread")]
     async fn test_put_then_get_genesis() -> anyhow::Result<()> {
         let storage = Storage::new(None, Some(CHAIN_ID)).await?;
@@ -389,4 +2016,511 @@ mod test {
         assert_eq!(out.initial_height(), genesis.initial_height());
         Ok(())
     }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_genesis_at_height_0_is_at_height_1() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        let mut value: serde_json::Value =
+            serde_json::from_slice(&Genesis::test_value().encode()?)?;
+        value["initial_height"] = "0".into();
+        let genesis = Genesis::from_value(value)?;
+        assert_eq!(genesis.initial_height(), 1);
+        storage.put_genesis(&genesis).await?;
+        assert!(storage.genesis_does_exist(1).await?);
+        assert!(!storage.genesis_does_exist(0).await?);
+        assert_eq!(storage.genesis_initial_heights().await?, vec![1]);
+
+        // An archive written before heights were normalized has the genesis under 0.
+        sqlx::query("UPDATE geneses SET initial_height = 0")
+            .execute(&storage.pool)
+            .await?;
+        assert_eq!(storage.genesis_initial_heights().await?, vec![1]);
+        assert!(storage.get_genesis(1).await?.is_some());
+        // Archiving the genesis again finds it there, rather than adding it twice.
+        storage.put_genesis(&genesis).await?;
+        assert_eq!(storage.genesis_initial_heights().await?, vec![1]);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_num_txs_matches_block() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        for (height, count) in [(1, 0), (2, 1), (3, 5), (10, 2)] {
+            let transactions = (0..count).map(|i| vec![i as u8; 16]).collect();
+            storage
+                .put_block(&Block::test_value_with_transactions(height, transactions))
+                .await?;
+        }
+        for height in [1, 2, 3, 10] {
+            let block = storage
+                .get_block(height)
+                .await?
+                .expect("block should exist");
+            assert_eq!(storage.get_num_txs(height).await?, Some(block.num_txs()));
+        }
+        assert_eq!(storage.get_num_txs(3).await?, Some(5));
+        assert_eq!(storage.get_num_txs(4).await?, None);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_num_txs_backfilled() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-backfill-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            for (height, count) in [(1, 3), (2, 0), (3, 1)] {
+                let transactions = (0..count).map(|i| vec![i as u8; 8]).collect();
+                storage
+                    .put_block(&Block::test_value_with_transactions(height, transactions))
+                    .await?;
+            }
+            storage
+                .put_encoded_block(4, b"not a block", 0, 0, None)
+                .await?;
+            // Make this look like an archive from before the transaction count was kept.
+            sqlx::query("ALTER TABLE blocks DROP COLUMN num_txs")
+                .execute(&storage.pool)
+                .await?;
+        }
+
+        // Reading the archive leaves it as it is, without the counts.
+        let storage = Storage::new(Some(&path), None).await?;
+        assert_eq!(storage.get_num_txs(1).await?, None);
+        drop(storage);
+
+        let (storage, _lock) = open_for_writing(&path).await?;
+        for height in [1, 2, 3] {
+            let block = storage
+                .get_block(height)
+                .await?
+                .expect("block should exist");
+            assert_eq!(storage.get_num_txs(height).await?, Some(block.num_txs()));
+        }
+        assert_eq!(storage.get_num_txs(1).await?, Some(3));
+        // The broken block doesn't stop the archive from being written to, but has no count.
+        assert_eq!(storage.get_num_txs(4).await?, None);
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_time_matches_block() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        let block = Block::test_value();
+        storage.put_block(&block).await?;
+        storage
+            .put_block(&Block::test_value_at_time(2, 1_700_000_000_123_456_789))
+            .await?;
+        for height in [block.height(), 2] {
+            let decoded = storage
+                .get_block(height)
+                .await?
+                .expect("block should exist");
+            assert_eq!(storage.get_block_time(height).await?, Some(decoded.time()?));
+        }
+        assert_eq!(
+            storage.get_block_time(2).await?,
+            Some(1_700_000_000_123_456_789)
+        );
+        assert_eq!(storage.get_block_time(3).await?, None);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_time_backfilled() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-backfill-time-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            for height in 1..=3 {
+                storage
+                    .put_block(&Block::test_value_at_time(height, height as i64 * 1000))
+                    .await?;
+            }
+            // Make this look like an archive from before the time was kept.
+            sqlx::query("DROP INDEX idx_blocks_time")
+                .execute(&storage.pool)
+                .await?;
+            sqlx::query("ALTER TABLE blocks DROP COLUMN time")
+                .execute(&storage.pool)
+                .await?;
+        }
+
+        let (storage, _lock) = open_for_writing(&path).await?;
+        for height in 1..=3 {
+            assert_eq!(
+                storage.get_block_time(height).await?,
+                Some(height as i64 * 1000)
+            );
+        }
+        assert_eq!(storage.nearest_height(2400).await?, Some(2));
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_nearest_height() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        assert_eq!(storage.nearest_height(0).await?, None);
+        for (height, time) in [(1, 1000), (2, 2000), (3, 4000), (7, 5000)] {
+            storage
+                .put_block(&Block::test_value_at_time(height, time))
+                .await?;
+        }
+        for (time, expected) in [
+            // Before the first block, and after the last.
+            (i64::MIN, 1),
+            (0, 1),
+            (6000, 7),
+            (i64::MAX, 7),
+            // Exactly at a block.
+            (1000, 1),
+            (4000, 3),
+            (5000, 7),
+            // Between blocks, closer to one side, or right in the middle.
+            (1499, 1),
+            (1500, 1),
+            (1501, 2),
+            (3001, 3),
+            (4600, 7),
+        ] {
+            assert_eq!(
+                storage.nearest_height(time).await?,
+                Some(expected),
+                "nearest to {}",
+                time
+            );
+        }
+        Ok(())
+    }
+
+    /// Insert a block the way an insert interrupted by a crash might have left it:
+    /// without recording it as committed.
+    async fn put_uncommitted_block(
+        storage: &Storage,
+        height: i64,
+        data: Option<&[u8]>,
+    ) -> anyhow::Result<()> {
+        let data_id: i64 = match data {
+            Some(data) => {
+                sqlx::query_scalar("INSERT INTO blobs(data) VALUES (?) RETURNING rowid")
+                    .bind(data)
+                    .fetch_one(&storage.pool)
+                    .await?
+            }
+            // Not the id of any data.
+            None => 1_000_000,
+        };
+        sqlx::query("INSERT INTO blocks(height, data_id) VALUES (?, ?)")
+            .bind(height)
+            .bind(data_id)
+            .execute(&storage.pool)
+            .await?;
+        Ok(())
+    }
+
+    async fn count_blobs(storage: &Storage) -> anyhow::Result<i64> {
+        Ok(sqlx::query_scalar("SELECT COUNT(*) FROM blobs")
+            .fetch_one(&storage.pool)
+            .await?)
+    }
+
+    async fn committed_height(storage: &Storage) -> anyhow::Result<Option<i64>> {
+        Ok(sqlx::query_scalar("SELECT height FROM committed")
+            .fetch_optional(&storage.pool)
+            .await?)
+    }
+
+    /// Open an archive to write to it, the way archival does.
+    async fn open_for_writing(path: &Path) -> anyhow::Result<(Storage, FileLock)> {
+        let lock = FileLock::acquire(path)?;
+        let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        storage.prepare_for_writing(&lock).await?;
+        Ok((storage, lock))
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_half_written_final_block_is_rolled_back() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-recover-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            for height in 1..=3 {
+                storage
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+            assert_eq!(committed_height(&storage).await?, Some(3));
+            // An intact block that just wasn't recorded as committed is kept.
+            let intact = Block::test_value_at_height(4).encode();
+            put_uncommitted_block(&storage, 4, Some(&intact)).await?;
+            // The data of the final block was cut short.
+            let encoded = Block::test_value_at_height(5).encode();
+            put_uncommitted_block(&storage, 5, Some(&encoded[..encoded.len() / 2])).await?;
+            // And the data for the block after that made it in, but not its row.
+            sqlx::query("INSERT INTO blobs(data) VALUES (?)")
+                .bind(Block::test_value_at_height(6).encode())
+                .execute(&storage.pool)
+                .await?;
+        }
+
+        // Only opening the archive to write to it rolls anything back.
+        let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+        assert_eq!(storage.last_height().await?, Some(5));
+        assert_eq!(count_blobs(&storage).await?, 6);
+        drop(storage);
+
+        let (storage, lock) = open_for_writing(&path).await?;
+        assert_eq!(storage.last_height().await?, Some(4));
+        assert_eq!(committed_height(&storage).await?, Some(4));
+        assert_eq!(count_blobs(&storage).await?, 4);
+        for height in 1..=4 {
+            let block = storage.get_block(height).await?;
+            assert_eq!(block.map(|x| x.height()), Some(height));
+        }
+        // Archival can pick up where the archive really left off.
+        storage.put_block(&Block::test_value_at_height(5)).await?;
+        assert_eq!(
+            storage.get_block(5).await?,
+            Some(Block::test_value_at_height(5))
+        );
+        assert_eq!(committed_height(&storage).await?, Some(5));
+
+        // A final block missing its data altogether is rolled back too.
+        put_uncommitted_block(&storage, 6, None).await?;
+        drop(storage);
+        drop(lock);
+        let (storage, _lock) = open_for_writing(&path).await?;
+        assert_eq!(storage.last_height().await?, Some(5));
+        assert_eq!(count_blobs(&storage).await?, 5);
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    async fn put_test_block(batch: &mut BlockBatch, height: u64) -> anyhow::Result<()> {
+        let block = Block::test_value_at_height(height);
+        batch
+            .put_encoded_block(
+                height,
+                &block.encode(),
+                block.num_txs(),
+                block.time()?,
+                None,
+                None,
+            )
+            .await
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_failed_block_is_left_out_of_batch() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        // Evidence goes in after its block, so failing to put it fails halfway through the block.
+        sqlx::query(
+            "CREATE TRIGGER no_evidence BEFORE INSERT ON evidence BEGIN SELECT RAISE(ABORT, 'no evidence'); END",
+        )
+        .execute(&storage.pool)
+        .await?;
+        let mut batch = storage.begin_batch().await?;
+        put_test_block(&mut batch, 1).await?;
+        let block = Block::test_value_with_evidence(2);
+        let data = block.encode();
+        let err = batch
+            .put_encoded_block(
+                2,
+                &data,
+                block.num_txs(),
+                block.time()?,
+                None,
+                block_evidence(&data),
+            )
+            .await
+            .expect_err("a block whose evidence fails to go in should fail");
+        assert!(format!("{:#}", err).contains("no evidence"), "{:#}", err);
+        assert_eq!(batch.len(), 1);
+
+        // What went in before is committed, without any of the block which failed.
+        batch.commit().await?;
+        assert_eq!(storage.last_height().await?, Some(1));
+        assert_eq!(committed_height(&storage).await?, Some(1));
+        assert_eq!(count_blobs(&storage).await?, 1);
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_uncommitted_batch_is_rolled_back() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-batch-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            let mut batch = storage.begin_batch().await?;
+            for height in 1..=3 {
+                put_test_block(&mut batch, height).await?;
+            }
+            assert_eq!(batch.len(), 3);
+            // Nothing in a batch is visible before it's committed.
+            assert_eq!(storage.last_height().await?, None);
+            batch.commit().await?;
+            assert_eq!(storage.last_height().await?, Some(3));
+
+            // As if archival died partway through the next batch.
+            let mut batch = storage.begin_batch().await?;
+            for height in 4..=5 {
+                put_test_block(&mut batch, height).await?;
+            }
+            drop(batch);
+            assert_eq!(storage.last_height().await?, Some(3));
+        }
+
+        let (storage, _lock) = open_for_writing(&path).await?;
+        assert_eq!(storage.last_height().await?, Some(3));
+        assert_eq!(committed_height(&storage).await?, Some(3));
+        assert_eq!(count_blobs(&storage).await?, 3);
+        // The blocks of the lost batch can be put again.
+        let mut batch = storage.begin_batch().await?;
+        for height in 4..=5 {
+            put_test_block(&mut batch, height).await?;
+        }
+        batch.commit().await?;
+        assert_eq!(committed_height(&storage).await?, Some(5));
+        for height in 1..=5 {
+            let block = storage.get_block(height).await?;
+            assert_eq!(block, Some(Block::test_value_at_height(height)));
+        }
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_half_written_final_block_without_committed_height() -> anyhow::Result<()> {
+        let path = std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-storage-recover-old-{}.sqlite",
+            std::process::id()
+        ));
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        {
+            let storage = Storage::new(Some(&path), Some(CHAIN_ID)).await?;
+            for height in 1..=3 {
+                storage
+                    .put_block(&Block::test_value_at_height(height))
+                    .await?;
+            }
+            let encoded = Block::test_value_at_height(4).encode();
+            put_uncommitted_block(&storage, 4, Some(&encoded[..encoded.len() / 2])).await?;
+            // Make this look like an archive from before the committed height was kept.
+            sqlx::query("DROP TABLE committed")
+                .execute(&storage.pool)
+                .await?;
+        }
+
+        let (storage, _lock) = open_for_writing(&path).await?;
+        assert_eq!(storage.last_height().await?, Some(3));
+        assert_eq!(committed_height(&storage).await?, Some(3));
+        assert_eq!(count_blobs(&storage).await?, 3);
+        drop(storage);
+        std::fs::remove_file(&path)?;
+        Ok(())
+    }
+
+    async fn stored_size(storage: &Storage, height: i64) -> anyhow::Result<i64> {
+        Ok(sqlx::query_scalar(
+            "SELECT LENGTH(data) FROM blocks JOIN blobs ON data_id = blobs.rowid WHERE height = ?",
+        )
+        .bind(height)
+        .fetch_one(&storage.pool)
+        .await?)
+    }
+
+    #[tokio::test(flavor = "multi_thread")]
+    async fn test_empty_and_full_blocks_round_trip() -> anyhow::Result<()> {
+        let storage = Storage::new(None, Some(CHAIN_ID)).await?;
+        // Runs of empty blocks, broken up by blocks with transactions.
+        let blocks: Vec<Block> = (1..=10)
+            .map(|height| match height {
+                4 | 8 => Block::test_value_with_transactions(height, vec![vec![1, 2, 3], vec![4]]),
+                _ => Block::test_value_at_height(height),
+            })
+            .collect();
+        for block in &blocks {
+            storage.put_block(block).await?;
+        }
+
+        for block in &blocks {
+            let height = block.height();
+            let encoded = block.encode();
+            assert_eq!(
+                storage.get_encoded_block(height).await?,
+                Some(encoded.clone())
+            );
+            assert_eq!(storage.get_block(height).await?.as_ref(), Some(block));
+            let size = usize::try_from(stored_size(&storage, height.try_into()?).await?)?;
+            if block.num_txs() == 0 {
+                assert!(
+                    size < encoded.len(),
+                    "empty block at {} isn't compact",
+                    height
+                );
+            } else {
+                assert_eq!(size, encoded.len());
+            }
+        }
+        let streamed: Vec<(u64, Vec<u8>)> = storage
+            .stream_encoded_blocks()
+            .collect::<Result<_, _>>()
+            .await?;
+        assert_eq!(
+            streamed,
+            blocks
+                .iter()
+                .map(|x| (x.height(), x.encode()))
+                .collect::<Vec<_>>()
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_empty_block_not_reconstructible_is_stored_as_is() -> anyhow::Result<()> {
+        let encoded = Block::test_value().encode();
+        let compact = compact_empty_block(&encoded).expect("test block should compact");
+        assert_eq!(compact[0], COMPACT_EMPTY_BLOCK);
+        assert_eq!(expand_stored_block(compact)?, encoded);
+
+        // Without its empty data, the block would come back with some.
+        let without_data: Vec<u8> = split_fields(&encoded)
+            .expect("test block should split")
+            .into_iter()
+            .filter(|(number, _, _)| *number != 2)
+            .flat_map(|(_, field, _)| field.to_vec())
+            .collect();
+        assert_eq!(compact_empty_block(&without_data), None);
+        // What isn't stored compactly reads back as it is.
+        assert_eq!(expand_stored_block(without_data.clone())?, without_data);
+        Ok(())
+    }
 }
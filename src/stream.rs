@@ -0,0 +1,557 @@
+//! Streams of blocks, as written by `archive` with `--output-format ndproto` or `ndjson`.
+//!
+//! Next to a stream written to a file is an index, with where each block starts in it,
+//! so that a block at any height can be read without going through those before it.
+use anyhow::{anyhow, Context as _};
+use std::fs::File;
+use std::io::{BufRead as _, BufReader, BufWriter, Read as _, Seek as _, SeekFrom, Write};
+use std::path::{Path, PathBuf};
+
+use crate::cometbft::Block;
+
+/// The formats blocks can be streamed in.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum StreamFormat {
+    /// Length delimited protobuf, as written by `--output-format ndproto`.
+    Proto,
+    /// Newline delimited JSON, as written by `--output-format ndjson`.
+    Json,
+}
+
+impl StreamFormat {
+    fn to_byte(self) -> u8 {
+        match self {
+            Self::Proto => 0,
+            Self::Json => 1,
+        }
+    }
+
+    /// Guess the format of a stream from its first byte.
+    ///
+    /// A block in JSON is an object, starting with a brace, which as the length prefix of
+    /// a block in protobuf would announce one of 123 bytes, which is too small for any block.
+    fn detect(first: u8) -> Self {
+        match first {
+            b'{' => Self::Json,
+            _ => Self::Proto,
+        }
+    }
+}
+
+/// Identifies an index file, and the version of its layout.
+const INDEX_MAGIC: &[u8; 8] = b"PRXSIDX1";
+/// The magic, the format of the stream, its length, and the number of entries.
+const INDEX_HEADER_SIZE: u64 = 32;
+/// The height of a block, and where it starts in the stream.
+const INDEX_ENTRY_SIZE: u64 = 16;
+
+/// The path of the index kept next to a stream of blocks.
+pub fn index_path(stream: &Path) -> PathBuf {
+    let mut out = stream.as_os_str().to_owned();
+    out.push(".index");
+    PathBuf::from(out)
+}
+
+/// Writes the index of a stream, as the blocks in it are written.
+struct IndexWriter {
+    format: StreamFormat,
+    file: BufWriter<File>,
+    count: u64,
+}
+
+impl IndexWriter {
+    fn create(path: &Path, format: StreamFormat) -> anyhow::Result<Self> {
+        let file =
+            File::create(path).with_context(|| format!("failed to create '{}'", path.display()))?;
+        let mut out = Self {
+            format,
+            file: BufWriter::new(file),
+            count: 0,
+        };
+        // Until it's finished, the index is for an empty stream, which is never the right one.
+        out.write_header(0)?;
+        Ok(out)
+    }
+
+    fn write_header(&mut self, stream_len: u64) -> anyhow::Result<()> {
+        let mut header = [0u8; INDEX_HEADER_SIZE as usize];
+        header[..8].copy_from_slice(INDEX_MAGIC);
+        header[8] = self.format.to_byte();
+        header[16..24].copy_from_slice(&stream_len.to_le_bytes());
+        header[24..32].copy_from_slice(&self.count.to_le_bytes());
+        self.file.write_all(&header)?;
+        Ok(())
+    }
+
+    fn push(&mut self, height: u64, offset: u64) -> anyhow::Result<()> {
+        self.file.write_all(&height.to_le_bytes())?;
+        self.file.write_all(&offset.to_le_bytes())?;
+        self.count += 1;
+        Ok(())
+    }
+
+    /// Make the index valid for a stream with the blocks pushed so far, and a given length.
+    fn finish(&mut self, stream_len: u64) -> anyhow::Result<()> {
+        self.file.seek(SeekFrom::Start(0))?;
+        self.write_header(stream_len)?;
+        self.file.seek(SeekFrom::End(0))?;
+        self.file.flush()?;
+        Ok(())
+    }
+}
+
+/// Writes blocks one after another, as a stream, in a given format.
+pub struct BlockWriter {
+    format: StreamFormat,
+    out: Box<dyn Write + Send>,
+    /// How much has been written to the stream so far.
+    offset: u64,
+    /// The index of the stream, which only streams written to files have.
+    index: Option<IndexWriter>,
+}
+
+impl BlockWriter {
+    fn new(format: StreamFormat, out: impl Write + Send + 'static) -> Self {
+        Self {
+            format,
+            out: Box::new(BufWriter::new(out)),
+            offset: 0,
+            index: None,
+        }
+    }
+
+    /// Create a writer to a file, replacing it and its index if they exist, or to stdout, without a file.
+    pub fn create(format: StreamFormat, file: Option<&Path>) -> anyhow::Result<Self> {
+        Ok(match file {
+            None => Self::new(format, std::io::stdout()),
+            Some(path) => Self {
+                index: Some(IndexWriter::create(&index_path(path), format)?),
+                ..Self::new(
+                    format,
+                    File::create(path)
+                        .with_context(|| format!("failed to create '{}'", path.display()))?,
+                )
+            },
+        })
+    }
+
+    /// Write a block, given along with its protobuf encoding.
+    pub fn write(&mut self, block: &Block, data: &[u8]) -> anyhow::Result<()> {
+        let start = self.offset;
+        match self.format {
+            StreamFormat::Proto => {
+                let mut prefix = Vec::with_capacity(10);
+                prost::encoding::encode_varint(data.len() as u64, &mut prefix);
+                self.out.write_all(&prefix)?;
+                self.out.write_all(data)?;
+                self.offset += (prefix.len() + data.len()) as u64;
+            }
+            StreamFormat::Json => {
+                let mut line = serde_json::to_vec(&block.to_value()?)?;
+                line.push(b'\n');
+                self.out.write_all(&line)?;
+                self.offset += line.len() as u64;
+            }
+        }
+        if let Some(index) = &mut self.index {
+            index.push(block.height(), start)?;
+        }
+        Ok(())
+    }
+
+    /// Make sure everything written so far has reached the output, along with its index.
+    pub fn flush(&mut self) -> anyhow::Result<()> {
+        self.out.flush()?;
+        if let Some(index) = &mut self.index {
+            index.finish(self.offset)?;
+        }
+        Ok(())
+    }
+}
+
+fn read_proto_block(stream: &mut BufReader<File>) -> anyhow::Result<(Block, Vec<u8>)> {
+    let mut len = 0u64;
+    for shift in (0..64).step_by(7) {
+        let mut byte = [0u8];
+        stream.read_exact(&mut byte)?;
+        len |= u64::from(byte[0] & 0x7f) << shift;
+        if byte[0] < 0x80 {
+            break;
+        }
+    }
+    // Reading only what's there, rather than allocating whatever a broken prefix claims.
+    let mut data = Vec::new();
+    stream.by_ref().take(len).read_to_end(&mut data)?;
+    anyhow::ensure!(
+        data.len() as u64 == len,
+        "the stream ends in the middle of a block"
+    );
+    Ok((Block::decode(&data)?, data))
+}
+
+fn read_json_block(stream: &mut BufReader<File>) -> anyhow::Result<(Block, Vec<u8>)> {
+    let mut line = String::new();
+    stream.read_line(&mut line)?;
+    let block = Block::from_value(serde_json::from_str(&line)?)?;
+    let data = block.encode();
+    Ok((block, data))
+}
+
+/// Read the block starting where a stream is at, returning its protobuf encoding along with it.
+///
+/// This returns [Option::None] at the end of the stream.
+fn read_block(
+    stream: &mut BufReader<File>,
+    format: StreamFormat,
+) -> anyhow::Result<Option<(Block, Vec<u8>)>> {
+    let offset = stream.stream_position()?;
+    if stream.fill_buf()?.is_empty() {
+        return Ok(None);
+    }
+    match format {
+        StreamFormat::Proto => read_proto_block(stream),
+        StreamFormat::Json => read_json_block(stream),
+    }
+    .map(Some)
+    .with_context(|| format!("failed to read the block at byte {} of the stream", offset))
+}
+
+/// The index of a stream, read from its file as needed, rather than all at once.
+struct StreamIndex {
+    file: BufReader<File>,
+    count: u64,
+}
+
+impl StreamIndex {
+    /// Open the index at a path, if there's one there, and it's for a stream like the one given.
+    fn open(path: &Path, format: StreamFormat, stream_len: u64) -> anyhow::Result<Option<Self>> {
+        let mut file = match File::open(path) {
+            Ok(file) => BufReader::new(file),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => return Err(e).context(format!("failed to open '{}'", path.display())),
+        };
+        let len = file.get_ref().metadata()?.len();
+        let mut header = [0u8; INDEX_HEADER_SIZE as usize];
+        if len < INDEX_HEADER_SIZE {
+            return Ok(None);
+        }
+        file.read_exact(&mut header)?;
+        let field = |i: usize| u64::from_le_bytes(header[i..i + 8].try_into().expect("8 bytes"));
+        let count = field(24);
+        let valid = &header[..8] == INDEX_MAGIC
+            && header[8] == format.to_byte()
+            && field(16) == stream_len
+            && count.checked_mul(INDEX_ENTRY_SIZE) == len.checked_sub(INDEX_HEADER_SIZE);
+        Ok(valid.then_some(Self { file, count }))
+    }
+
+    /// Read the entry at a given position, with the height of a block, and where it starts.
+    fn entry(&mut self, i: u64) -> anyhow::Result<(u64, u64)> {
+        self.file
+            .seek(SeekFrom::Start(INDEX_HEADER_SIZE + i * INDEX_ENTRY_SIZE))?;
+        let mut entry = [0u8; INDEX_ENTRY_SIZE as usize];
+        self.file.read_exact(&mut entry)?;
+        let (height, offset) = entry.split_at(8);
+        Ok((
+            u64::from_le_bytes(height.try_into()?),
+            u64::from_le_bytes(offset.try_into()?),
+        ))
+    }
+
+    /// Find where the block at a given height starts in the stream.
+    ///
+    /// Streams usually have every height in their range, in which case the entry for a height
+    /// is at a known position. Streams with heights skipped fall back to a binary search.
+    fn find(&mut self, height: u64) -> anyhow::Result<Option<u64>> {
+        if self.count == 0 {
+            return Ok(None);
+        }
+        let (first, _) = self.entry(0)?;
+        let Some(guess) = height.checked_sub(first) else {
+            return Ok(None);
+        };
+        if guess < self.count {
+            let (at, offset) = self.entry(guess)?;
+            if at == height {
+                return Ok(Some(offset));
+            }
+        }
+        let (mut low, mut high) = (0, self.count.min(guess + 1));
+        while low < high {
+            let mid = low + (high - low) / 2;
+            let (at, offset) = self.entry(mid)?;
+            match at.cmp(&height) {
+                std::cmp::Ordering::Equal => return Ok(Some(offset)),
+                std::cmp::Ordering::Less => low = mid + 1,
+                std::cmp::Ordering::Greater => high = mid,
+            }
+        }
+        Ok(None)
+    }
+
+    /// Read every entry, in order.
+    fn entries(&mut self) -> anyhow::Result<Vec<(u64, u64)>> {
+        (0..self.count).map(|i| self.entry(i)).collect()
+    }
+}
+
+/// Reads the blocks in a stream, in order, or at any height, through its index.
+///
+/// The index is checked against the stream when opening it, and written anew if it's missing,
+/// or if it's for a different stream, say because the stream was written again since.
+pub struct StreamReader {
+    format: StreamFormat,
+    stream: BufReader<File>,
+    index: StreamIndex,
+}
+
+impl StreamReader {
+    pub fn open(path: &Path) -> anyhow::Result<Self> {
+        let mut stream = BufReader::new(
+            File::open(path).with_context(|| format!("failed to open '{}'", path.display()))?,
+        );
+        let stream_len = stream.get_ref().metadata()?.len();
+        let format = stream
+            .fill_buf()?
+            .first()
+            .map_or(StreamFormat::Proto, |&x| StreamFormat::detect(x));
+        let index_path = index_path(path);
+        let mut index = StreamIndex::open(&index_path, format, stream_len)?;
+        if let Some(existing) = &mut index {
+            if !Self::index_matches(&mut stream, format, existing, stream_len)? {
+                index = None;
+            }
+        }
+        let index = match index {
+            Some(index) => index,
+            None => {
+                tracing::info!(
+                    "the index of '{}' is missing or stale, regenerating it",
+                    path.display()
+                );
+                Self::regenerate_index(&mut stream, format, &index_path, stream_len)?;
+                StreamIndex::open(&index_path, format, stream_len)?.ok_or(anyhow!(
+                    "the regenerated index '{}' doesn't match its stream",
+                    index_path.display()
+                ))?
+            }
+        };
+        Ok(Self {
+            format,
+            stream,
+            index,
+        })
+    }
+
+    /// Check that the first and last entries of an index point at blocks of their heights,
+    /// and that the last block ends the stream.
+    fn index_matches(
+        stream: &mut BufReader<File>,
+        format: StreamFormat,
+        index: &mut StreamIndex,
+        stream_len: u64,
+    ) -> anyhow::Result<bool> {
+        if index.count == 0 {
+            return Ok(stream_len == 0);
+        }
+        for i in [0, index.count - 1] {
+            let (height, offset) = index.entry(i)?;
+            stream.seek(SeekFrom::Start(offset))?;
+            match read_block(stream, format) {
+                Ok(Some((block, _))) if block.height() == height => {}
+                _ => return Ok(false),
+            }
+        }
+        Ok(stream.stream_position()? == stream_len)
+    }
+
+    fn regenerate_index(
+        stream: &mut BufReader<File>,
+        format: StreamFormat,
+        index_path: &Path,
+        stream_len: u64,
+    ) -> anyhow::Result<()> {
+        let mut index = IndexWriter::create(index_path, format)?;
+        stream.seek(SeekFrom::Start(0))?;
+        loop {
+            let offset = stream.stream_position()?;
+            let Some((block, _)) = read_block(stream, format)? else {
+                break;
+            };
+            index.push(block.height(), offset)?;
+        }
+        index.finish(stream_len)
+    }
+
+    #[allow(dead_code)]
+    pub fn format(&self) -> StreamFormat {
+        self.format
+    }
+
+    /// Get the number of blocks in the stream.
+    pub fn block_count(&self) -> u64 {
+        self.index.count
+    }
+
+    /// Get the heights of the first and last blocks in the stream, if it has any.
+    pub fn height_range(&mut self) -> anyhow::Result<Option<(u64, u64)>> {
+        if self.index.count == 0 {
+            return Ok(None);
+        }
+        let (first, _) = self.index.entry(0)?;
+        let (last, _) = self.index.entry(self.index.count - 1)?;
+        Ok(Some((first, last)))
+    }
+
+    /// Get the ranges of heights missing between the first and last blocks, without reading blocks.
+    ///
+    /// Each range is inclusive, in ascending order.
+    pub fn gaps(&mut self) -> anyhow::Result<Vec<(u64, u64)>> {
+        let entries = self.index.entries()?;
+        Ok(entries
+            .windows(2)
+            .filter(|x| x[1].0 > x[0].0 + 1)
+            .map(|x| (x[0].0 + 1, x[1].0 - 1))
+            .collect())
+    }
+
+    /// Get the protobuf encoding of the block at a given height, seeking straight to it.
+    ///
+    /// This will return [Option::None] if there's no such block in the stream.
+    pub fn get_encoded_block(&mut self, height: u64) -> anyhow::Result<Option<Vec<u8>>> {
+        let Some(offset) = self.index.find(height)? else {
+            return Ok(None);
+        };
+        self.stream.seek(SeekFrom::Start(offset))?;
+        let (block, data) = read_block(&mut self.stream, self.format)?.ok_or(anyhow!(
+            "the stream ends before the block at height {}",
+            height
+        ))?;
+        anyhow::ensure!(
+            block.height() == height,
+            "the index points at a block for height {}, rather than height {}",
+            block.height(),
+            height
+        );
+        Ok(Some(data))
+    }
+
+    /// Read every block in the stream, in the order they were written, along with their heights.
+    ///
+    /// This goes through the stream from its start, without using the index.
+    pub fn blocks(&mut self) -> impl Iterator<Item = anyhow::Result<(u64, Vec<u8>)>> + '_ {
+        let mut start = Some(self.stream.seek(SeekFrom::Start(0)));
+        std::iter::from_fn(move || {
+            if let Some(Err(e)) = start.take() {
+                return Some(Err(e.into()));
+            }
+            read_block(&mut self.stream, self.format)
+                .transpose()
+                .map(|x| x.map(|(block, data)| (block.height(), data)))
+        })
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn test_stream_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!(
+            "penumbra-reindexer-test-stream-index-{}-{}",
+            name,
+            std::process::id()
+        ))
+    }
+
+    fn write_stream(path: &Path, format: StreamFormat, heights: &[u64]) -> anyhow::Result<()> {
+        let mut writer = BlockWriter::create(format, Some(path))?;
+        for &height in heights {
+            let block = match height % 3 {
+                0 => Block::test_value_with_transactions(height, vec![vec![height as u8; 40]]),
+                _ => Block::test_value_at_height(height),
+            };
+            writer.write(&block, &block.encode())?;
+        }
+        writer.flush()
+    }
+
+    fn remove_stream(path: &Path) -> anyhow::Result<()> {
+        for path in [path.to_owned(), index_path(path)] {
+            if path.exists() {
+                std::fs::remove_file(path)?;
+            }
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_random_access_matches_sequential_reads() -> anyhow::Result<()> {
+        for (name, format) in [("proto", StreamFormat::Proto), ("json", StreamFormat::Json)] {
+            let path = test_stream_path(name);
+            remove_stream(&path)?;
+            // One height missing, as skipping a block leaves it.
+            let heights: Vec<u64> = (5..=40).filter(|x| *x != 17).collect();
+            write_stream(&path, format, &heights)?;
+
+            let mut reader = StreamReader::open(&path)?;
+            assert_eq!(reader.format(), format);
+            assert_eq!(reader.height_range()?, Some((5, 40)));
+            assert_eq!(reader.block_count(), heights.len() as u64);
+            assert_eq!(reader.gaps()?, vec![(17, 17)]);
+            let sequential = reader.blocks().collect::<anyhow::Result<Vec<_>>>()?;
+            assert_eq!(
+                sequential.iter().map(|x| x.0).collect::<Vec<_>>(),
+                heights,
+                "{}",
+                name
+            );
+            // Out of order, on either side of the missing height.
+            for (height, data) in sequential.iter().rev() {
+                assert_eq!(
+                    reader.get_encoded_block(*height)?.as_ref(),
+                    Some(data),
+                    "{} at {}",
+                    name,
+                    height
+                );
+            }
+            for height in [1, 4, 17, 41] {
+                assert_eq!(reader.get_encoded_block(height)?, None);
+            }
+            drop(reader);
+            remove_stream(&path)?;
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_stale_index_is_regenerated() -> anyhow::Result<()> {
+        let path = test_stream_path("stale");
+        remove_stream(&path)?;
+        write_stream(&path, StreamFormat::Proto, &(1..=10).collect::<Vec<_>>())?;
+        let stale = std::fs::read(index_path(&path))?;
+        // The stream gets written again, but the index from before is put back.
+        write_stream(&path, StreamFormat::Proto, &(3..=6).collect::<Vec<_>>())?;
+        std::fs::write(index_path(&path), &stale)?;
+
+        let mut reader = StreamReader::open(&path)?;
+        assert_eq!(reader.height_range()?, Some((3, 6)));
+        assert_eq!(
+            reader.get_encoded_block(4)?,
+            Some(Block::test_value_at_height(4).encode())
+        );
+        assert_eq!(reader.get_encoded_block(8)?, None);
+        drop(reader);
+        assert_ne!(std::fs::read(index_path(&path))?, stale);
+
+        // A missing index is made, too.
+        std::fs::remove_file(index_path(&path))?;
+        let mut reader = StreamReader::open(&path)?;
+        assert_eq!(reader.height_range()?, Some((3, 6)));
+        assert!(index_path(&path).exists());
+        drop(reader);
+        remove_stream(&path)?;
+        Ok(())
+    }
+}